@@ -0,0 +1,134 @@
+// Package admin implements the HTTP admin API.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Server is the admin HTTP server. Features register their handlers on it before Start.
+type Server struct {
+	addr string
+	lc   net.ListenConfig
+	mux  *http.ServeMux
+	ln   net.Listener
+	srv  *http.Server
+
+	token  string          // bearer token clients must send (ADMIN_AUTH_TOKEN), empty for none
+	public map[string]bool // patterns served without the token
+}
+
+// New creates a new admin server listening on addr. ADMIN_AUTH_TOKEN, if set, is the
+// bearer token clients must send in the Authorization header, or the access_token query
+// parameter for browser clients that cannot set headers (images, EventSource, WebSocket).
+func New(addr string) *Server {
+	s := &Server{
+		addr:   addr,
+		mux:    http.NewServeMux(),
+		token:  os.Getenv("ADMIN_AUTH_TOKEN"),
+		public: make(map[string]bool),
+	}
+	s.HandlePublic("GET /healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	}))
+	return s
+}
+
+// Handle registers a handler for the given pattern.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers a handler function for the given pattern.
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// HandlePublic registers a handler served without the bearer token, for health checks and
+// static pages that hold no data.
+func (s *Server) HandlePublic(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+	s.public[pattern] = true
+}
+
+// ServeHTTP checks the bearer token of a request and serves it.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		if _, pattern := s.mux.Handler(r); !s.public[pattern] && !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized reports whether a request carries the bearer token.
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// SetListenConfig sets how the admin port is bound (e.g. with SO_REUSEPORT). It must be
+// called before Start.
+func (s *Server) SetListenConfig(lc net.ListenConfig) {
+	s.lc = lc
+}
+
+// Start binds the admin port. Requests are served by Serve.
+func (s *Server) Start() error {
+	ln, err := s.lc.Listen(context.Background(), "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	s.ln = ln
+	s.srv = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if s.token == "" {
+		log.Printf("[Admin] ⚠️  Admin server listening on %s (no ADMIN_AUTH_TOKEN, unauthenticated)", s.addr)
+	} else {
+		log.Printf("[Admin] Admin server listening on %s", s.addr)
+	}
+	return nil
+}
+
+// Serve serves requests until ctx is cancelled or Close is called, and returns an error
+// if the listener failed.
+func (s *Server) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, s.Close)
+	defer stop()
+	if err := s.srv.Serve(s.ln); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("admin server failed: %w", err)
+	}
+	return nil
+}
+
+// Close stops the admin server.
+func (s *Server) Close() {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+}
+
+// WriteJSON writes v as an indented JSON response.
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
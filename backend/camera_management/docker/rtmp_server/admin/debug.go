@@ -0,0 +1,111 @@
+// Package admin implements the HTTP admin API.
+package admin
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// EnableDiagnostics registers net/http/pprof and runtime dump handlers under /debug/.
+func (s *Server) EnableDiagnostics() {
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	s.mux.HandleFunc("GET /debug/goroutines", handleGoroutines)
+	s.mux.HandleFunc("GET /debug/heapdump", handleHeapDump)
+	s.mux.HandleFunc("GET /debug/runtime", handleRuntime)
+
+	log.Printf("[Admin] Diagnostics enabled at /debug/")
+}
+
+// handleGoroutines dumps the stack traces of all goroutines as plain text.
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "goroutines: %d\n\n", runtime.NumGoroutine())
+	w.Write(buf)
+}
+
+// handleHeapDump writes a full heap dump (runtime/debug.WriteHeapDump format) as a download.
+// The world is stopped while the dump is written, so use sparingly.
+func handleHeapDump(w http.ResponseWriter, r *http.Request) {
+	tmp, err := os.CreateTemp("", "heapdump-*")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create temp file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	debug.WriteHeapDump(tmp.Fd())
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("failed to read heap dump: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=heapdump-%s", time.Now().Format("20060102-150405")))
+	io.Copy(w, tmp)
+}
+
+// runtimeStats is the JSON document returned by /debug/runtime.
+type runtimeStats struct {
+	GoVersion    string  `json:"go_version"`
+	Goroutines   int     `json:"goroutines"`
+	NumCPU       int     `json:"num_cpu"`
+	HeapAlloc    uint64  `json:"heap_alloc_bytes"`
+	HeapInuse    uint64  `json:"heap_inuse_bytes"`
+	HeapObjects  uint64  `json:"heap_objects"`
+	Sys          uint64  `json:"sys_bytes"`
+	TotalAlloc   uint64  `json:"total_alloc_bytes"`
+	Mallocs      uint64  `json:"mallocs"`
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotalMs float64 `json:"gc_pause_total_ms"`
+	LastGC       string  `json:"last_gc,omitempty"`
+}
+
+// handleRuntime returns a summary of runtime and memory statistics.
+func handleRuntime(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := runtimeStats{
+		GoVersion:    runtime.Version(),
+		Goroutines:   runtime.NumGoroutine(),
+		NumCPU:       runtime.NumCPU(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		Sys:          m.Sys,
+		TotalAlloc:   m.TotalAlloc,
+		Mallocs:      m.Mallocs,
+		NumGC:        m.NumGC,
+		PauseTotalMs: float64(m.PauseTotalNs) / 1e6,
+	}
+	if m.LastGC != 0 {
+		stats.LastGC = time.Unix(0, int64(m.LastGC)).Format(time.RFC3339)
+	}
+
+	WriteJSON(w, http.StatusOK, stats)
+}
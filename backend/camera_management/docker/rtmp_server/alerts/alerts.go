@@ -0,0 +1,347 @@
+// Package alerts raises operational alerts (dropped frames, keyframe gaps, restart loops,
+// idle streams, panics) and notifies them via Amazon SNS.
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+	"rtmp_kvs/server"
+)
+
+// Alert types
+const (
+	FramesDropped    = "FramesDropped"
+	KeyframeGap      = "KeyframeGap"
+	PipelineRestarts = "PipelineRestarts"
+	StreamIdle       = "StreamIdle"
+	Panic            = "Panic"
+)
+
+// checkInterval is how often stream statistics are checked for keyframe gaps.
+const checkInterval = 5 * time.Second
+
+// Alert is a threshold violation of one stream.
+type Alert struct {
+	Type       string         `json:"type"`
+	Time       time.Time      `json:"time"`
+	Message    string         `json:"message"`
+	StreamPath string         `json:"stream_path,omitempty"`
+	StreamName string         `json:"stream_name,omitempty"`
+	CameraID   string         `json:"camera_id,omitempty"`
+	RemoteAddr string         `json:"remote_addr,omitempty"`
+	Value      float64        `json:"value"`
+	Threshold  float64        `json:"threshold"`
+	Detail     map[string]any `json:"detail,omitempty"`
+}
+
+// subject identifies the stream of the alert (camera ID when known), or the publisher's
+// address for alerts raised before its stream was known.
+func (a *Alert) subject() string {
+	switch {
+	case a.CameraID != "":
+		return a.CameraID
+	case a.StreamPath != "":
+		return a.StreamPath
+	case a.StreamName != "":
+		return a.StreamName
+	}
+	return a.RemoteAddr
+}
+
+// Notifier delivers alerts.
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// StatsSource provides the ingest statistics of active publishers.
+type StatsSource interface {
+	Stats() []server.StreamStats
+}
+
+// Thresholds configures when alerts are raised. Zero values disable a check.
+type Thresholds struct {
+	DroppedFrames int           // dropped frames per Window
+	KeyframeGap   time.Duration // longest accepted time between keyframes
+	Restarts      int           // pipeline restarts per Window
+	Window        time.Duration
+	Cooldown      time.Duration // minimum time between alerts of one type for one stream
+}
+
+// thresholdsFromEnv reads ALERT_DROPPED_FRAMES (default 30), ALERT_KEYFRAME_GAP (seconds,
+// default 10), ALERT_RESTARTS (default 3), ALERT_WINDOW (seconds, default 300) and
+// ALERT_COOLDOWN (seconds, default 900).
+func thresholdsFromEnv() Thresholds {
+	return Thresholds{
+		DroppedFrames: envInt("ALERT_DROPPED_FRAMES", 30),
+		KeyframeGap:   time.Duration(envInt("ALERT_KEYFRAME_GAP", 10)) * time.Second,
+		Restarts:      envInt("ALERT_RESTARTS", 3),
+		Window:        time.Duration(max(envInt("ALERT_WINDOW", 300), 1)) * time.Second,
+		Cooldown:      time.Duration(envInt("ALERT_COOLDOWN", 900)) * time.Second,
+	}
+}
+
+// envInt reads a non-negative integer environment variable, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("[Alerts] ⚠️  Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// Monitor evaluates events and stream statistics against the thresholds.
+type Monitor struct {
+	thresholds Thresholds
+	notifier   Notifier
+	source     StatsSource
+
+	mutex     sync.Mutex
+	drops     map[string]*dropCounter // by stream path
+	restarts  map[string][]time.Time  // by KVS stream name
+	lastAlert map[string]time.Time    // by type + stream
+	raised    map[string]uint64       // by type
+}
+
+// dropCounter tracks the dropped frames of one publisher within the window.
+type dropCounter struct {
+	lastTotal uint64
+	samples   []dropSample
+}
+
+type dropSample struct {
+	time  time.Time
+	count uint64
+}
+
+// NewFromEnv creates a monitor notifying ALERT_TOPIC_ARN, subscribes it to the event bus
+// and starts checking source. It returns nil if ALERT_TOPIC_ARN is not set.
+func NewFromEnv(region string, source StatsSource) *Monitor {
+	topicARN := os.Getenv("ALERT_TOPIC_ARN")
+	if topicARN == "" {
+		return nil
+	}
+
+	m := New(NewSNSNotifier(topicARN, region), source, thresholdsFromEnv())
+	events.Subscribe(m)
+	go m.run()
+
+	t := m.thresholds
+	log.Printf("[Alerts] Sending alerts to SNS topic %s (dropped frames: %d, keyframe gap: %s, restarts: %d per %s)",
+		topicARN, t.DroppedFrames, t.KeyframeGap, t.Restarts, t.Window)
+	return m
+}
+
+// New creates a monitor. Call Handle with events and Check periodically.
+func New(notifier Notifier, source StatsSource, thresholds Thresholds) *Monitor {
+	return &Monitor{
+		thresholds: thresholds,
+		notifier:   notifier,
+		source:     source,
+		drops:      make(map[string]*dropCounter),
+		restarts:   make(map[string][]time.Time),
+		lastAlert:  make(map[string]time.Time),
+		raised:     make(map[string]uint64),
+	}
+}
+
+func (m *Monitor) run() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.Check()
+	}
+}
+
+// Handle implements events.Subscriber.
+func (m *Monitor) Handle(e events.Event) {
+	switch e.Type {
+	case events.FramesDropped:
+		total, _ := e.Detail["dropped_frames"].(uint64)
+		if dropped, ok := m.countDrops(e.StreamPath, total, e.Time); ok {
+			m.raise(Alert{
+				Type:       FramesDropped,
+				Message:    fmt.Sprintf("%d frames dropped in the last %s", dropped, m.thresholds.Window),
+				StreamPath: e.StreamPath,
+				StreamName: e.StreamName,
+				CameraID:   e.CameraID,
+				RemoteAddr: e.RemoteAddr,
+				Value:      float64(dropped),
+				Threshold:  float64(m.thresholds.DroppedFrames),
+				Detail:     map[string]any{"dropped_frames_total": total},
+			})
+		}
+
+	case events.PipelineRestarted:
+		if restarts, ok := m.countRestart(e.StreamName, e.Time); ok {
+			m.raise(Alert{
+				Type:       PipelineRestarts,
+				Message:    fmt.Sprintf("KVS pipeline restarted %d times in the last %s", restarts, m.thresholds.Window),
+				StreamName: e.StreamName,
+				CameraID:   e.CameraID,
+				Value:      float64(restarts),
+				Threshold:  float64(m.thresholds.Restarts),
+				Detail:     e.Detail,
+			})
+		}
+
+	case events.StreamIdle:
+		m.raise(Alert{
+			Type:       StreamIdle,
+			Message:    "No frames received, publisher disconnected",
+			StreamPath: e.StreamPath,
+			StreamName: e.StreamName,
+			CameraID:   e.CameraID,
+			RemoteAddr: e.RemoteAddr,
+			Detail:     e.Detail,
+		})
+
+	case events.PanicRecovered:
+		where, _ := e.Detail["where"].(string)
+		value, _ := e.Detail["panic"].(string)
+		m.raise(Alert{
+			Type:       Panic,
+			Message:    fmt.Sprintf("Recovered from panic in %s: %s", where, value),
+			StreamPath: e.StreamPath,
+			StreamName: e.StreamName,
+			CameraID:   e.CameraID,
+			RemoteAddr: e.RemoteAddr,
+			Value:      1,
+			Detail:     e.Detail,
+		})
+
+	case events.StreamStopped:
+		m.mutex.Lock()
+		delete(m.drops, e.StreamPath)
+		m.mutex.Unlock()
+	}
+}
+
+// countDrops records the cumulative drop count of a publisher and returns the drops within
+// the window when they reach the threshold.
+func (m *Monitor) countDrops(streamPath string, total uint64, now time.Time) (uint64, bool) {
+	if m.thresholds.DroppedFrames == 0 {
+		return 0, false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counter := m.drops[streamPath]
+	if counter == nil || total < counter.lastTotal {
+		// New publisher on the path
+		counter = &dropCounter{}
+		m.drops[streamPath] = counter
+	}
+	counter.samples = append(counter.samples, dropSample{time: now, count: total - counter.lastTotal})
+	counter.lastTotal = total
+
+	var dropped uint64
+	kept := counter.samples[:0]
+	for _, sample := range counter.samples {
+		if now.Sub(sample.time) <= m.thresholds.Window {
+			kept = append(kept, sample)
+			dropped += sample.count
+		}
+	}
+	counter.samples = kept
+	return dropped, dropped >= uint64(m.thresholds.DroppedFrames)
+}
+
+// countRestart records a pipeline restart and returns the restarts within the window when
+// they reach the threshold.
+func (m *Monitor) countRestart(streamName string, now time.Time) (int, bool) {
+	if m.thresholds.Restarts == 0 {
+		return 0, false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	kept := []time.Time{now}
+	for _, t := range m.restarts[streamName] {
+		if now.Sub(t) <= m.thresholds.Window {
+			kept = append(kept, t)
+		}
+	}
+	m.restarts[streamName] = kept
+	return len(kept), len(kept) >= m.thresholds.Restarts
+}
+
+// Check raises KeyframeGap alerts for video streams whose last keyframe interval, or the
+// time since their last keyframe, exceeds the threshold.
+func (m *Monitor) Check() {
+	if m.thresholds.KeyframeGap == 0 || m.source == nil {
+		return
+	}
+	now := time.Now()
+	for _, st := range m.source.Stats() {
+		if st.AudioCodec != "" || st.Frames == 0 {
+			continue
+		}
+		since := st.LastKeyframeAt
+		if since.IsZero() {
+			since = st.StartedAt
+		}
+		gap := max(now.Sub(since), time.Duration(st.KeyframeInterval*float64(time.Second)))
+		if gap <= m.thresholds.KeyframeGap {
+			continue
+		}
+		m.raise(Alert{
+			Type:       KeyframeGap,
+			Message:    fmt.Sprintf("No keyframe for %.1f seconds", gap.Seconds()),
+			StreamPath: st.StreamPath,
+			StreamName: st.StreamName,
+			CameraID:   st.CameraID,
+			RemoteAddr: st.RemoteAddr,
+			Value:      gap.Seconds(),
+			Threshold:  m.thresholds.KeyframeGap.Seconds(),
+			Detail:     map[string]any{"keyframe_interval_seconds": st.KeyframeInterval},
+		})
+	}
+}
+
+// raise notifies an alert unless one of the same type was sent for the stream within the
+// cooldown.
+func (m *Monitor) raise(alert Alert) {
+	if alert.Time.IsZero() {
+		alert.Time = time.Now().UTC()
+	}
+	key := alert.Type + "|" + alert.StreamPath + "|" + alert.StreamName
+
+	m.mutex.Lock()
+	if last, ok := m.lastAlert[key]; ok && time.Since(last) < m.thresholds.Cooldown {
+		m.mutex.Unlock()
+		return
+	}
+	m.lastAlert[key] = time.Now()
+	m.raised[alert.Type]++
+	m.mutex.Unlock()
+
+	log.Printf("[Alerts] %s for %s: %s", alert.Type, alert.subject(), alert.Message)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := m.notifier.Notify(ctx, alert); err != nil {
+		log.Printf("[Alerts] ⚠️  Failed to send %s alert: %v", alert.Type, err)
+	}
+}
+
+// CollectMetrics writes the number of alerts raised by type.
+func (m *Monitor) CollectMetrics(w *metrics.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, alertType := range []string{FramesDropped, KeyframeGap, PipelineRestarts, StreamIdle, Panic} {
+		w.Counter("rtmp_alerts_total", "Alerts raised by type", float64(m.raised[alertType]), "type", alertType)
+	}
+}
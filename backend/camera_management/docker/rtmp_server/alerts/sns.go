@@ -0,0 +1,36 @@
+// Package alerts raises operational alerts (dropped frames, keyframe gaps, restart loops,
+// idle streams) and notifies them via Amazon SNS.
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"rtmp_kvs/awsapi"
+)
+
+// SNSNotifier publishes alerts to an SNS topic as JSON messages.
+type SNSNotifier struct {
+	topicARN string
+	client   *awsapi.SNS
+}
+
+// NewSNSNotifier creates a notifier for the topic.
+func NewSNSNotifier(topicARN, region string) *SNSNotifier {
+	return &SNSNotifier{topicARN: topicARN, client: awsapi.NewSNS(region)}
+}
+
+// Notify implements Notifier.
+func (n *SNSNotifier) Notify(ctx context.Context, alert Alert) error {
+	message, err := json.MarshalIndent(alert, "", "  ")
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("[rtmp-kvs] %s: %s", alert.Type, alert.subject())
+	if len(subject) > 100 {
+		// SNS subjects are limited to 100 characters
+		subject = subject[:100]
+	}
+	return n.client.Publish(ctx, n.topicARN, subject, string(message))
+}
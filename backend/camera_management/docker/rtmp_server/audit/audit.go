@@ -0,0 +1,264 @@
+// Package audit writes a structured record per ingest connection (who connected, from
+// where, the authorization result, duration, bytes and why it ended) to a dedicated
+// CloudWatch Logs stream or a Firehose delivery stream, separate from the debug log, for
+// security and compliance review.
+package audit
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/auth"
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/metrics"
+)
+
+const (
+	maxBatchRecords = 500             // PutRecordBatch limit (PutLogEvents allows more)
+	maxBatchBytes   = 1000 * 1000     // below the 1 MiB limit of PutLogEvents
+	maxPending      = 10000           // records kept for retry before the oldest are dropped
+	flushInterval   = 5 * time.Second // batches are sent at least this often
+	requestTimeout  = 10 * time.Second
+)
+
+// Authorization results
+const (
+	AuthAccepted = "accepted"
+	AuthRejected = "rejected"
+	AuthNone     = "none" // the connection ended before it was authorized
+)
+
+// Record describes one connection from its accept to its close.
+type Record struct {
+	Server           string        `json:"server"` // host name of the server
+	ConnectedAt      time.Time     `json:"connected_at"`
+	DisconnectedAt   time.Time     `json:"disconnected_at"`
+	DurationSeconds  float64       `json:"duration_seconds"`
+	RemoteAddr       string        `json:"remote_addr"`
+	Protocol         string        `json:"protocol"`
+	TLS              *auth.TLSInfo `json:"tls,omitempty"`
+	Tenant           string        `json:"tenant,omitempty"`
+	Mode             string        `json:"mode,omitempty"`        // publish or play
+	StreamPath       string        `json:"stream_path,omitempty"` // stream keys redacted
+	StreamName       string        `json:"stream_name,omitempty"`
+	CameraID         string        `json:"camera_id,omitempty"`
+	SessionID        string        `json:"session_id,omitempty"` // as in /stats and the stream events
+	Auth             string        `json:"auth"`
+	AuthReason       string        `json:"auth_reason,omitempty"`
+	BytesReceived    uint64        `json:"bytes_received"`
+	BytesSent        uint64        `json:"bytes_sent"`
+	Frames           uint64        `json:"frames,omitempty"`
+	DisconnectReason string        `json:"disconnect_reason"`
+	Error            string        `json:"error,omitempty"`
+}
+
+// Logger sends audit records in batches to CloudWatch Logs or Firehose.
+type Logger struct {
+	host string
+
+	logGroup  string
+	logStream string
+	logs      *awsapi.CloudWatchLogs
+
+	deliveryStream string
+	firehose       *awsapi.Firehose
+
+	queue   chan Record
+	closing chan struct{}
+	closed  chan struct{}
+
+	written atomic.Uint64
+	failed  atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// entry is a record waiting to be sent, encoded as a JSON line.
+type entry struct {
+	time time.Time // of the disconnect, orders the log events
+	data []byte
+}
+
+// NewFromEnv creates a logger writing to the CloudWatch Logs group AUDIT_LOG_GROUP (stream
+// AUDIT_LOG_STREAM, default the host name) or to the Firehose delivery stream
+// AUDIT_FIREHOSE_STREAM. It returns nil if neither is set.
+func NewFromEnv(region string) *Logger {
+	group := os.Getenv("AUDIT_LOG_GROUP")
+	deliveryStream := os.Getenv("AUDIT_FIREHOSE_STREAM")
+	if group == "" && deliveryStream == "" {
+		return nil
+	}
+	host, _ := os.Hostname()
+	l := &Logger{
+		host:    host,
+		queue:   make(chan Record, 1000),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	if group != "" {
+		if deliveryStream != "" {
+			log.Printf("[Audit] ⚠️  Both AUDIT_LOG_GROUP and AUDIT_FIREHOSE_STREAM are set, using CloudWatch Logs")
+		}
+		l.logGroup = group
+		l.logStream = cmp.Or(os.Getenv("AUDIT_LOG_STREAM"), host, "rtmp-server")
+		l.logs = awsapi.NewCloudWatchLogs(region)
+		log.Printf("[Audit] Writing connection audit records to CloudWatch Logs %s/%s", l.logGroup, l.logStream)
+	} else {
+		l.deliveryStream = deliveryStream
+		l.firehose = awsapi.NewFirehose(region)
+		log.Printf("[Audit] Writing connection audit records to Firehose stream %s", deliveryStream)
+	}
+	go l.run()
+	return l
+}
+
+// Write queues a record. Records are dropped when the queue is full, so an unavailable
+// destination never blocks connections.
+func (l *Logger) Write(r Record) {
+	r.Server = l.host
+	select {
+	case l.queue <- r:
+	default:
+		if n := l.dropped.Add(1); n == 1 || n%100 == 0 {
+			log.Printf("[Audit] ⚠️  Queue full, %d audit records dropped", n)
+		}
+	}
+}
+
+// Close sends the records still queued. Call it after the listeners have stopped, so the
+// records of the connections closed during shutdown are included.
+func (l *Logger) Close() {
+	close(l.closing)
+	<-l.closed
+}
+
+// run sends queued records until Close.
+func (l *Logger) run() {
+	defer close(l.closed)
+	if l.logs != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		if err := l.logs.CreateLogStream(ctx, l.logGroup, l.logStream); err != nil {
+			log.Printf("[Audit] ⚠️  Failed to create log stream %s/%s: %v", l.logGroup, l.logStream, err)
+		}
+		cancel()
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var pending []entry
+	for {
+		select {
+		case r := <-l.queue:
+			pending = append(pending, encode(r))
+			if len(pending) >= maxBatchRecords {
+				pending = l.send(pending)
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				pending = l.send(pending)
+			}
+		case <-l.closing:
+			for len(l.queue) > 0 {
+				pending = append(pending, encode(<-l.queue))
+			}
+			for len(pending) > 0 {
+				before := len(pending)
+				if pending = l.send(pending); len(pending) >= before {
+					break // no progress, give up on the rest
+				}
+			}
+			return
+		}
+	}
+}
+
+// encode encodes a record as a JSON line.
+func encode(r Record) entry {
+	data, _ := json.Marshal(r)
+	return entry{time: r.DisconnectedAt, data: append(data, '\n')}
+}
+
+// send writes the first batch of pending records and returns the records still pending:
+// the rest plus the records that failed, which are retried with the next batch.
+func (l *Logger) send(pending []entry) []entry {
+	n, size := 0, 0
+	for n < len(pending) && n < maxBatchRecords {
+		// PutLogEvents counts 26 bytes per event
+		if size += len(pending[n].data) + 26; size > maxBatchBytes {
+			break
+		}
+		n++
+	}
+	n = max(n, 1)
+	batch, rest := pending[:n], pending[n:]
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	var failed []entry
+	var err error
+	if l.logs != nil {
+		failed, err = l.putLogEvents(ctx, batch)
+	} else {
+		failed, err = l.putRecords(ctx, batch)
+	}
+	l.written.Add(uint64(len(batch) - len(failed)))
+	if err != nil {
+		l.failed.Add(uint64(len(failed)))
+		log.Printf("[Audit] ⚠️  Failed to write %d of %d audit records: %v", len(failed), len(batch), err)
+	}
+
+	pending = append(append([]entry(nil), failed...), rest...)
+	if n := len(pending) - maxPending; n > 0 {
+		l.dropped.Add(uint64(n))
+		pending = pending[n:]
+	}
+	return pending
+}
+
+// putLogEvents writes a batch to the log stream, recreating the stream if it was deleted.
+func (l *Logger) putLogEvents(ctx context.Context, batch []entry) ([]entry, error) {
+	// Log events must be in chronological order
+	batch = slices.Clone(batch)
+	slices.SortStableFunc(batch, func(a, b entry) int { return a.time.Compare(b.time) })
+	events := make([]awsapi.LogEvent, len(batch))
+	for i, e := range batch {
+		events[i] = awsapi.LogEvent{Timestamp: e.time, Message: string(bytes.TrimSuffix(e.data, []byte("\n")))}
+	}
+	err := l.logs.PutLogEvents(ctx, l.logGroup, l.logStream, events)
+	if awsapi.IsCode(err, "ResourceNotFoundException") {
+		if err := l.logs.CreateLogStream(ctx, l.logGroup, l.logStream); err == nil {
+			err = l.logs.PutLogEvents(ctx, l.logGroup, l.logStream, events)
+		}
+	}
+	if err != nil {
+		return batch, err
+	}
+	return nil, nil
+}
+
+// putRecords writes a batch to the delivery stream, one JSON line per record.
+func (l *Logger) putRecords(ctx context.Context, batch []entry) ([]entry, error) {
+	records := make([][]byte, len(batch))
+	for i, e := range batch {
+		records[i] = e.data
+	}
+	failedRecords, err := l.firehose.PutRecordBatch(ctx, l.deliveryStream, records)
+	failed := make([]entry, len(failedRecords))
+	for i, data := range failedRecords {
+		failed[i] = entry{data: data} // the time only orders log events
+	}
+	return failed, err
+}
+
+// CollectMetrics writes the number of records written, failed and dropped.
+func (l *Logger) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_audit_records_total", "Connection audit records written", float64(l.written.Load()))
+	w.Counter("rtmp_audit_record_errors_total", "Audit record writes that failed (retried with the next batch)", float64(l.failed.Load()))
+	w.Counter("rtmp_audit_records_dropped_total", "Audit records dropped because the queue or retry buffer was full", float64(l.dropped.Load()))
+}
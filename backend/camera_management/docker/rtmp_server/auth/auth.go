@@ -0,0 +1,85 @@
+// Package auth authorizes publishers before their stream is accepted.
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+)
+
+// ErrDenied is returned (wrapped) when an authorizer rejects a publisher.
+var ErrDenied = errors.New("publish denied")
+
+// PublishRequest describes a publisher asking to be accepted.
+type PublishRequest struct {
+	Protocol   string            `json:"protocol"`
+	StreamPath string            `json:"stream_path"`
+	Params     map[string]string `json:"params,omitempty"` // captured by the path template (PATH_TEMPLATES)
+	Query      map[string]string `json:"query,omitempty"`
+	RemoteAddr string            `json:"remote_addr"`
+	ClientIP   string            `json:"client_ip"`
+	TLS        *TLSInfo          `json:"tls,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// TLSInfo describes the TLS session of an RTMPS publisher.
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	// Subject of the client certificate, if one was presented
+	ClientSubject string `json:"client_subject,omitempty"`
+}
+
+// NewPublishRequest builds a request from connection metadata. conn may be a *tls.Conn.
+func NewPublishRequest(protocol, streamPath string, query url.Values, conn net.Conn, remoteAddr string) *PublishRequest {
+	req := &PublishRequest{
+		Protocol:   protocol,
+		StreamPath: streamPath,
+		RemoteAddr: remoteAddr,
+		ClientIP:   remoteAddr,
+		Time:       time.Now().UTC(),
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		req.ClientIP = host
+	}
+	if len(query) > 0 {
+		req.Query = make(map[string]string, len(query))
+		for k := range query {
+			req.Query[k] = query.Get(k)
+		}
+	}
+	req.TLS = NewTLSInfo(conn)
+	return req
+}
+
+// NewTLSInfo describes the TLS session of conn, or returns nil if conn is not a *tls.Conn.
+// The handshake must have completed.
+func NewTLSInfo(conn net.Conn) *TLSInfo {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.ClientSubject = state.PeerCertificates[0].Subject.String()
+	}
+	return info
+}
+
+// Authorizer decides whether a publisher is accepted. It returns nil to accept, an error
+// wrapping ErrDenied to reject, or another error when the decision could not be made
+// (which also rejects the publisher). An authorizer may rewrite req.StreamPath (e.g. to
+// resolve a token stream key to the stream it grants); later authorizers, routing and the
+// session use the rewritten path.
+type Authorizer interface {
+	Authorize(ctx context.Context, req *PublishRequest) error
+}
@@ -0,0 +1,325 @@
+// Package auth authorizes publishers before their stream is accepted.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// jwtClockSkew is the tolerance applied to the exp and nbf claims.
+const jwtClockSkew = 30 * time.Second
+
+// JWTAuthorizer accepts publishers presenting a signed JWT as their stream key
+// (rtmp://host/live/<jwt>) or in the "token" query parameter (rtmp://host/live/cam1?token=<jwt>).
+// Tokens are verified against a JWKS endpoint (RS256/ES256/...) or a shared HS256 secret, must
+// not be expired, must be issued for this server's audience and must carry a stream claim
+// naming the stream they grant. A token used as the stream key is replaced by the stream
+// claim, so routing and the registry see the stream name rather than the token.
+type JWTAuthorizer struct {
+	jwks        *jwksCache
+	secret      []byte
+	issuer      string
+	audience    string
+	tokenUse    string // required token_use claim (Cognito), empty for none
+	streamClaim string
+}
+
+// NewJWTAuthorizerFromEnv creates a JWT authorizer from JWT_JWKS_URL, JWT_COGNITO_USER_POOL_ID
+// (the JWKS URL and issuer are derived from the pool) or JWT_SECRET (HS256), plus
+// JWT_AUDIENCE, the optional JWT_ISSUER, JWT_TOKEN_USE and JWT_STREAM_CLAIM (default
+// "stream"). It returns nil if none of JWT_JWKS_URL, JWT_COGNITO_USER_POOL_ID and
+// JWT_SECRET is set, and an error if JWT_AUDIENCE is not, since a user pool signs tokens
+// for all of its app clients. JWT_TOKEN_USE ("access" or "id", default "access" with a
+// user pool) is the token_use claim the tokens must carry.
+func NewJWTAuthorizerFromEnv() (*JWTAuthorizer, error) {
+	a := &JWTAuthorizer{
+		issuer:      os.Getenv("JWT_ISSUER"),
+		audience:    os.Getenv("JWT_AUDIENCE"),
+		tokenUse:    os.Getenv("JWT_TOKEN_USE"),
+		streamClaim: os.Getenv("JWT_STREAM_CLAIM"),
+	}
+	if a.streamClaim == "" {
+		a.streamClaim = "stream"
+	}
+	switch a.tokenUse {
+	case "", "access", "id":
+	default:
+		return nil, fmt.Errorf("invalid JWT_TOKEN_USE %q, expected access or id", a.tokenUse)
+	}
+
+	jwksURL := os.Getenv("JWT_JWKS_URL")
+	if poolID := os.Getenv("JWT_COGNITO_USER_POOL_ID"); poolID != "" {
+		// Pool IDs are prefixed with their region, e.g. ap-northeast-1_AbCdEf123
+		region, _, _ := strings.Cut(poolID, "_")
+		issuer := fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", region, poolID)
+		if jwksURL == "" {
+			jwksURL = issuer + "/.well-known/jwks.json"
+		}
+		if a.issuer == "" {
+			a.issuer = issuer
+		}
+		if a.tokenUse == "" {
+			a.tokenUse = "access"
+		}
+	}
+	if jwksURL != "" {
+		a.jwks = newJWKSCache(jwksURL)
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		a.secret = []byte(secret)
+	}
+	if a.jwks == nil && a.secret == nil {
+		return nil, nil
+	}
+	if a.audience == "" {
+		return nil, fmt.Errorf("JWT_AUDIENCE is required with JWT stream keys (the app client ID for Cognito)")
+	}
+
+	switch {
+	case a.jwks != nil:
+		log.Printf("[Auth] Validating JWT stream keys with %s (audience %q, claim %q)", jwksURL, a.audience, a.streamClaim)
+	default:
+		log.Printf("[Auth] Validating HS256 JWT stream keys (audience %q, claim %q)", a.audience, a.streamClaim)
+	}
+	return a, nil
+}
+
+// Authorize implements Authorizer.
+func (a *JWTAuthorizer) Authorize(ctx context.Context, req *PublishRequest) error {
+	key := path.Base(req.StreamPath)
+	token, keyIsToken := key, looksLikeJWT(key)
+	if !keyIsToken {
+		token = req.Query["token"]
+		if token == "" {
+			return fmt.Errorf("%w: stream key is not a token", ErrDenied)
+		}
+	}
+
+	claims, err := a.verify(ctx, token)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDenied, err)
+	}
+
+	stream, _ := claims[a.streamClaim].(string)
+	if stream == "" || strings.Contains(stream, "/") {
+		return fmt.Errorf("%w: token has no valid %q claim", ErrDenied, a.streamClaim)
+	}
+	if keyIsToken {
+		req.StreamPath = path.Join(path.Dir(req.StreamPath), stream)
+	} else if stream != key {
+		return fmt.Errorf("%w: token is for stream %q, not %q", ErrDenied, stream, key)
+	}
+	// A token with a claim named like a path parameter (e.g. "site") is scoped to paths
+	// with that value
+	for name, value := range req.Params {
+		if value == key {
+			req.Params[name] = stream
+			continue
+		}
+		if claim, ok := claims[name].(string); ok && claim != value {
+			return fmt.Errorf("%w: token is for %s %q, not %q", ErrDenied, name, claim, value)
+		}
+	}
+	delete(req.Query, "token")
+	return nil
+}
+
+// looksLikeJWT reports whether s has the shape of a compact JWS (base64url JSON header).
+func looksLikeJWT(s string) bool {
+	return strings.HasPrefix(s, "eyJ") && strings.Count(s, ".") == 2
+}
+
+// verify checks the signature and the registered claims, and returns the claims.
+func (a *JWTAuthorizer) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+	if err := a.verifySignature(ctx, header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+
+	now := time.Now()
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("token has no exp claim")
+	}
+	if now.After(exp.Add(jwtClockSkew)) {
+		return nil, fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(jwtClockSkew).Before(nbf) {
+		return nil, fmt.Errorf("token not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !hasAudience(claims, a.audience) {
+		return nil, fmt.Errorf("token is not for audience %q", a.audience)
+	}
+	if a.tokenUse != "" && claims["token_use"] != a.tokenUse {
+		return nil, fmt.Errorf("token_use is %v, not %s", claims["token_use"], a.tokenUse)
+	}
+	return claims, nil
+}
+
+// Algorithms returns the signing algorithms of the tokens a accepts.
+func (a *JWTAuthorizer) Algorithms() []string {
+	var algorithms []string
+	if a.secret != nil {
+		algorithms = append(algorithms, "HS256")
+	}
+	if a.jwks != nil {
+		algorithms = append(algorithms, "RS256", "RS384", "RS512", "ES256", "ES384")
+	}
+	return algorithms
+}
+
+// verifySignature verifies the JWS signature over signingInput.
+func (a *JWTAuthorizer) verifySignature(ctx context.Context, alg, kid, signingInput string, signature []byte) error {
+	var hashFunc crypto.Hash
+	switch alg {
+	case "HS256", "RS256", "ES256":
+		hashFunc = crypto.SHA256
+	case "RS384", "ES384":
+		hashFunc = crypto.SHA384
+	case "RS512":
+		hashFunc = crypto.SHA512
+	default:
+		// Rejects "none" and anything we cannot verify
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	if alg == "HS256" {
+		if a.secret == nil {
+			return fmt.Errorf("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+
+	if a.jwks == nil {
+		return fmt.Errorf("%s tokens are not accepted", alg)
+	}
+	key, err := a.jwks.key(ctx, kid)
+	if err != nil {
+		return err
+	}
+	digest := digest(hashFunc, signingInput)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("key %q cannot verify %s", kid, alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hashFunc, digest, signature); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return fmt.Errorf("key %q cannot verify %s", kid, alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
+
+func digest(hashFunc crypto.Hash, data string) []byte {
+	var h hash.Hash
+	switch hashFunc {
+	case crypto.SHA384:
+		h = sha512.New384()
+	case crypto.SHA512:
+		h = sha512.New()
+	default:
+		h = sha256.New()
+	}
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// numericClaim returns a NumericDate claim (seconds since the epoch).
+func numericClaim(claims map[string]any, name string) (time.Time, bool) {
+	seconds, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// hasAudience checks the aud claim (string or array) and Cognito's client_id claim, which
+// access tokens carry instead of aud.
+func hasAudience(claims map[string]any, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == audience {
+			return true
+		}
+	case []any:
+		for _, v := range aud {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return claims["client_id"] == audience
+}
+
+// RedactStreamPath replaces a token stream key with "<token>" so tokens do not end up in
+// logs and events.
+func RedactStreamPath(streamPath string) string {
+	if looksLikeJWT(path.Base(streamPath)) {
+		return path.Join(path.Dir(streamPath), "<token>")
+	}
+	return streamPath
+}
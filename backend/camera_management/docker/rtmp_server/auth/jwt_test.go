@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+// signToken returns a compact JWS of claims. key is the HS256 secret ([]byte), an
+// *rsa.PrivateKey or an *ecdsa.PrivateKey; alg "none" leaves the signature empty.
+func signToken(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := key.(type) {
+	case nil:
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(input))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256([]byte(input))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, sum[:])
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// validClaims returns claims accepted by testAuthorizer, with overrides applied (nil deletes).
+func validClaims(overrides map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":       "https://issuer.example.com",
+		"aud":       "rtmp-server",
+		"token_use": "access",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"stream":    "cam1",
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+// testAuthorizer accepts HS256 tokens signed with testSecret and the given JWKS keys.
+func testAuthorizer(keys map[string]crypto.PublicKey) *JWTAuthorizer {
+	a := &JWTAuthorizer{
+		secret:      []byte(testSecret),
+		issuer:      "https://issuer.example.com",
+		audience:    "rtmp-server",
+		tokenUse:    "access",
+		streamClaim: "stream",
+	}
+	if keys != nil {
+		a.jwks = &jwksCache{url: "http://jwks.invalid", keys: keys, fetchedAt: time.Now()}
+	}
+	return a
+}
+
+func TestJWTAuthorizerFromEnv(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantNil      bool
+		wantErr      string
+		wantIssuer   string
+		wantTokenUse string
+	}{
+		{
+			name:    "disabled",
+			env:     map[string]string{"JWT_AUDIENCE": "rtmp-server"},
+			wantNil: true,
+		},
+		{
+			name:    "secret without audience",
+			env:     map[string]string{"JWT_SECRET": testSecret},
+			wantErr: "JWT_AUDIENCE is required",
+		},
+		{
+			name:    "user pool without audience",
+			env:     map[string]string{"JWT_COGNITO_USER_POOL_ID": "ap-northeast-1_AbCdEf123"},
+			wantErr: "JWT_AUDIENCE is required",
+		},
+		{
+			name: "secret",
+			env:  map[string]string{"JWT_SECRET": testSecret, "JWT_AUDIENCE": "rtmp-server"},
+		},
+		{
+			name:         "user pool",
+			env:          map[string]string{"JWT_COGNITO_USER_POOL_ID": "ap-northeast-1_AbCdEf123", "JWT_AUDIENCE": "client"},
+			wantIssuer:   "https://cognito-idp.ap-northeast-1.amazonaws.com/ap-northeast-1_AbCdEf123",
+			wantTokenUse: "access",
+		},
+		{
+			name: "user pool with id tokens",
+			env: map[string]string{
+				"JWT_COGNITO_USER_POOL_ID": "ap-northeast-1_AbCdEf123",
+				"JWT_AUDIENCE":             "client",
+				"JWT_TOKEN_USE":            "id",
+			},
+			wantIssuer:   "https://cognito-idp.ap-northeast-1.amazonaws.com/ap-northeast-1_AbCdEf123",
+			wantTokenUse: "id",
+		},
+		{
+			name:    "invalid token use",
+			env:     map[string]string{"JWT_SECRET": testSecret, "JWT_AUDIENCE": "rtmp-server", "JWT_TOKEN_USE": "refresh"},
+			wantErr: "invalid JWT_TOKEN_USE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"JWT_ISSUER", "JWT_AUDIENCE", "JWT_TOKEN_USE", "JWT_STREAM_CLAIM",
+				"JWT_JWKS_URL", "JWT_COGNITO_USER_POOL_ID", "JWT_SECRET"} {
+				t.Setenv(name, tt.env[name])
+			}
+			a, err := NewJWTAuthorizerFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (a == nil) != tt.wantNil {
+				t.Fatalf("authorizer = %v, want nil %v", a, tt.wantNil)
+			}
+			if a == nil {
+				return
+			}
+			if a.issuer != tt.wantIssuer {
+				t.Errorf("issuer = %q, want %q", a.issuer, tt.wantIssuer)
+			}
+			if a.tokenUse != tt.wantTokenUse {
+				t.Errorf("tokenUse = %q, want %q", a.tokenUse, tt.wantTokenUse)
+			}
+		})
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testAuthorizer(map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})
+	secret := []byte(testSecret)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"hs256", signToken(t, "HS256", "", secret, validClaims(nil)), ""},
+		{"rs256", signToken(t, "RS256", "rsa", rsaKey, validClaims(nil)), ""},
+		{"es256", signToken(t, "ES256", "ec", ecKey, validClaims(nil)), ""},
+		{"aud array", signToken(t, "HS256", "", secret, validClaims(map[string]any{"aud": []string{"other", "rtmp-server"}})), ""},
+		{"cognito client_id", signToken(t, "HS256", "", secret, validClaims(map[string]any{"aud": nil, "client_id": "rtmp-server"})), ""},
+		{"exp within skew", signToken(t, "HS256", "", secret, validClaims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()})), ""},
+
+		{"malformed", "eyJhbGciOiJIUzI1NiJ9.e30", "malformed token"},
+		{"alg none", signToken(t, "none", "", nil, validClaims(nil)), "unsupported signing algorithm"},
+		{"unsupported alg", signToken(t, "PS256", "rsa", nil, validClaims(nil)), "unsupported signing algorithm"},
+		{"wrong secret", signToken(t, "HS256", "", []byte("other"), validClaims(nil)), "invalid token signature"},
+		{"wrong rsa key", signToken(t, "RS256", "ec", rsaKey, validClaims(nil)), "cannot verify RS256"},
+		{"unknown kid", signToken(t, "RS256", "missing", rsaKey, validClaims(nil)), "unknown key ID"},
+		{"expired", signToken(t, "HS256", "", secret, validClaims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), "token expired"},
+		{"no exp", signToken(t, "HS256", "", secret, validClaims(map[string]any{"exp": nil})), "no exp claim"},
+		{"not yet valid", signToken(t, "HS256", "", secret, validClaims(map[string]any{"nbf": now.Add(time.Minute).Unix()})), "not valid before"},
+		{"wrong issuer", signToken(t, "HS256", "", secret, validClaims(map[string]any{"iss": "https://other.example.com"})), "unexpected issuer"},
+		{"wrong audience", signToken(t, "HS256", "", secret, validClaims(map[string]any{"aud": "other"})), "not for audience"},
+		{"no audience", signToken(t, "HS256", "", secret, validClaims(map[string]any{"aud": nil})), "not for audience"},
+		{"other app client", signToken(t, "HS256", "", secret, validClaims(map[string]any{"aud": nil, "client_id": "other"})), "not for audience"},
+		{"id token", signToken(t, "HS256", "", secret, validClaims(map[string]any{"token_use": "id"})), "token_use is id"},
+		{"no token_use", signToken(t, "HS256", "", secret, validClaims(map[string]any{"token_use": nil})), "token_use is"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.verify(context.Background(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTVerifyAlgorithmsNotConfigured(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// HS256 only: asymmetric tokens are refused
+	hsOnly := testAuthorizer(nil)
+	if _, err := hsOnly.verify(context.Background(), signToken(t, "RS256", "rsa", rsaKey, validClaims(nil))); err == nil ||
+		!strings.Contains(err.Error(), "RS256 tokens are not accepted") {
+		t.Errorf("RS256 with HS256 only: err = %v", err)
+	}
+
+	// JWKS only: an HS256 token signed with any secret is refused
+	jwksOnly := testAuthorizer(map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey})
+	jwksOnly.secret = nil
+	if _, err := jwksOnly.verify(context.Background(), signToken(t, "HS256", "rsa", []byte(""), validClaims(nil))); err == nil ||
+		!strings.Contains(err.Error(), "HS256 tokens are not accepted") {
+		t.Errorf("HS256 with JWKS only: err = %v", err)
+	}
+}
+
+func TestJWTAuthorize(t *testing.T) {
+	a := testAuthorizer(nil)
+	token := func(overrides map[string]any) string {
+		return signToken(t, "HS256", "", []byte(testSecret), validClaims(overrides))
+	}
+	siteToken := token(map[string]any{"site": "tokyo"})
+
+	tests := []struct {
+		name       string
+		streamPath string
+		query      map[string]string
+		params     map[string]string
+		wantPath   string
+		wantParams map[string]string
+		wantDenied bool
+	}{
+		{
+			name:       "token as stream key",
+			streamPath: "live/" + token(nil),
+			wantPath:   "live/cam1",
+		},
+		{
+			name:       "token in query",
+			streamPath: "live/cam1",
+			query:      map[string]string{"token": token(nil)},
+			wantPath:   "live/cam1",
+		},
+		{
+			name:       "query token for another stream",
+			streamPath: "live/cam2",
+			query:      map[string]string{"token": token(nil)},
+			wantDenied: true,
+		},
+		{
+			name:       "no token",
+			streamPath: "live/cam1",
+			wantDenied: true,
+		},
+		{
+			name:       "stream claim with slash",
+			streamPath: "live/" + token(map[string]any{"stream": "a/b"}),
+			wantDenied: true,
+		},
+		{
+			name:       "no stream claim",
+			streamPath: "live/" + token(map[string]any{"stream": nil}),
+			wantDenied: true,
+		},
+		{
+			name:       "path parameter matches claim",
+			streamPath: "tokyo/cam1",
+			query:      map[string]string{"token": siteToken},
+			params:     map[string]string{"site": "tokyo", "camera": "cam1"},
+			wantPath:   "tokyo/cam1",
+			wantParams: map[string]string{"site": "tokyo", "camera": "cam1"},
+		},
+		{
+			name:       "path parameter differs from claim",
+			streamPath: "osaka/cam1",
+			query:      map[string]string{"token": siteToken},
+			params:     map[string]string{"site": "osaka", "camera": "cam1"},
+			wantDenied: true,
+		},
+		{
+			// The template captured the token as the camera parameter
+			name:       "parameter holding the token",
+			streamPath: "tokyo/" + siteToken,
+			params:     map[string]string{"site": "tokyo", "camera": siteToken},
+			wantPath:   "tokyo/cam1",
+			wantParams: map[string]string{"site": "tokyo", "camera": "cam1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &PublishRequest{StreamPath: tt.streamPath, Query: map[string]string{}, Params: tt.params}
+			for k, v := range tt.query {
+				req.Query[k] = v
+			}
+
+			err := a.Authorize(context.Background(), req)
+			if tt.wantDenied {
+				if !errors.Is(err, ErrDenied) {
+					t.Fatalf("err = %v, want ErrDenied", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.StreamPath != tt.wantPath {
+				t.Errorf("StreamPath = %q, want %q", req.StreamPath, tt.wantPath)
+			}
+			if _, ok := req.Query["token"]; ok {
+				t.Errorf("token left in query")
+			}
+			for name, want := range tt.wantParams {
+				if got := req.Params[name]; got != want {
+					t.Errorf("Params[%s] = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactStreamPath(t *testing.T) {
+	tests := []struct {
+		streamPath string
+		want       string
+	}{
+		{"live/cam1", "live/cam1"},
+		{"live/eyJhbGciOiJIUzI1NiJ9.eyJzdHJlYW0iOiJjYW0xIn0.c2ln", "live/<token>"},
+		{"live/eyJnot.a-token", "live/eyJnot.a-token"},
+		{"eyJhbGciOiJIUzI1NiJ9.e30.c2ln", "<token>"},
+	}
+	for _, tt := range tests {
+		if got := RedactStreamPath(tt.streamPath); got != tt.want {
+			t.Errorf("RedactStreamPath(%q) = %q, want %q", tt.streamPath, got, tt.want)
+		}
+	}
+}
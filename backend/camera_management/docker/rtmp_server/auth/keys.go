@@ -0,0 +1,31 @@
+// Package auth authorizes publishers before their stream is accepted.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"path"
+)
+
+// StreamKeys accepts only publishers whose stream key (last path element) is in a fixed
+// list, e.g. the cameras of one tenant.
+type StreamKeys struct {
+	keys map[string]struct{}
+}
+
+// NewStreamKeys creates an authorizer accepting the given stream keys.
+func NewStreamKeys(keys []string) *StreamKeys {
+	a := &StreamKeys{keys: make(map[string]struct{}, len(keys))}
+	for _, key := range keys {
+		a.keys[key] = struct{}{}
+	}
+	return a
+}
+
+// Authorize implements Authorizer.
+func (a *StreamKeys) Authorize(ctx context.Context, req *PublishRequest) error {
+	if _, ok := a.keys[path.Base(req.StreamPath)]; !ok {
+		return fmt.Errorf("%w: unknown stream key", ErrDenied)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Package auth authorizes publishers before their stream is accepted.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Webhook authorizes publishers by POSTing the request metadata as JSON to an HTTPS
+// endpoint (e.g. API Gateway + Lambda). Only a 200 response accepts the publisher;
+// any other status, a timeout or a network error rejects it.
+type Webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookFromEnv creates a webhook from PUBLISH_AUTH_URL, PUBLISH_AUTH_TIMEOUT
+// (seconds, default 5) and PUBLISH_AUTH_SECRET (optional HMAC key).
+// It returns nil if PUBLISH_AUTH_URL is not set.
+func NewWebhookFromEnv() *Webhook {
+	endpoint := os.Getenv("PUBLISH_AUTH_URL")
+	if endpoint == "" {
+		return nil
+	}
+
+	timeout := 5 * time.Second
+	if v := os.Getenv("PUBLISH_AUTH_TIMEOUT"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds) * time.Second
+		} else {
+			log.Printf("[Auth] Invalid PUBLISH_AUTH_TIMEOUT %q, using %s", v, timeout)
+		}
+	}
+
+	log.Printf("[Auth] Authorizing publishers with webhook %s (timeout %s)", endpoint, timeout)
+	return NewWebhook(endpoint, []byte(os.Getenv("PUBLISH_AUTH_SECRET")), timeout)
+}
+
+// NewWebhook creates a webhook for endpoint. secret (optional) is the HMAC key the
+// request body is signed with.
+func NewWebhook(endpoint string, secret []byte, timeout time.Duration) *Webhook {
+	return &Webhook{
+		url:    endpoint,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Authorize implements Authorizer. When a secret is configured the body is signed with
+// HMAC-SHA256 and sent as "X-Signature: sha256=<hex>" so the endpoint can verify the caller.
+func (w *Webhook) Authorize(ctx context.Context, req *PublishRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "rtmp-kvs")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		httpReq.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("auth webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: auth webhook returned HTTP %d", ErrDenied, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import "context"
+
+// ExportedCertificate is the result of ExportCertificate. PrivateKey is an encrypted
+// PKCS#8 PEM block protected by the passphrase passed to the export.
+type ExportedCertificate struct {
+	Certificate      string `json:"Certificate"`
+	CertificateChain string `json:"CertificateChain"`
+	PrivateKey       string `json:"PrivateKey"`
+}
+
+// ACM is a client for the AWS Certificate Manager API.
+type ACM struct {
+	*Client
+}
+
+// NewACM creates an ACM client.
+func NewACM(region string) *ACM {
+	return &ACM{Client: NewClient("acm", region)}
+}
+
+// ExportCertificate exports an exportable (private CA or exportable public) certificate.
+func (a *ACM) ExportCertificate(ctx context.Context, arn string, passphrase []byte) (*ExportedCertificate, error) {
+	in := map[string]any{
+		"CertificateArn": arn,
+		"Passphrase":     passphrase,
+	}
+	var out ExportedCertificate
+	if err := a.JSON(ctx, "CertificateManager.ExportCertificate", "1.1", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CertificateSerial returns the serial number of the certificate's current issuance,
+// which changes when ACM renews it.
+func (a *ACM) CertificateSerial(ctx context.Context, arn string) (string, error) {
+	in := map[string]any{"CertificateArn": arn}
+	var out struct {
+		Certificate struct {
+			Serial string `json:"Serial"`
+		} `json:"Certificate"`
+	}
+	if err := a.JSON(ctx, "CertificateManager.DescribeCertificate", "1.1", in, &out); err != nil {
+		return "", err
+	}
+	return out.Certificate.Serial, nil
+}
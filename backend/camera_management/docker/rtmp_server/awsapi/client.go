@@ -0,0 +1,228 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+// It avoids pulling the full AWS SDK into the image; only the handful of calls we need are wrapped.
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Client sends signed requests to a single AWS service in a single region.
+type Client struct {
+	Service     string // SigV4 signing name, e.g. "dynamodb"
+	Region      string
+	Endpoint    string              // Base URL; defaults to https://<service>.<region>.amazonaws.com
+	Credentials CredentialsProvider // nil sends unsigned requests
+	HTTPClient  *http.Client
+}
+
+// NewClient creates a client for the given service and region using environment credentials.
+func NewClient(service, region string) *Client {
+	return &Client{
+		Service:     service,
+		Region:      region,
+		Credentials: EnvCredentials{},
+		HTTPClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// endpoint returns the base URL of the service.
+func (c *Client) endpoint() string {
+	if c.Endpoint != "" {
+		return strings.TrimSuffix(c.Endpoint, "/")
+	}
+	// AWS_ENDPOINT_URL_<SERVICE> follows the AWS SDK convention for endpoint overrides
+	if v := os.Getenv("AWS_ENDPOINT_URL_" + strings.ToUpper(strings.ReplaceAll(c.Service, "-", "_"))); v != "" {
+		return strings.TrimSuffix(v, "/")
+	}
+	return fmt.Sprintf("https://%s.%s.amazonaws.com", c.Service, c.Region)
+}
+
+// APIError is an error returned by an AWS service.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s (HTTP %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// IsCode reports whether err is an APIError with the given code.
+func IsCode(err error, code string) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.Code == code
+}
+
+// Do signs and sends a request. path may include a query string.
+// The response body is returned for 2xx responses; other statuses are returned as *APIError.
+func (c *Client) Do(ctx context.Context, method, path string, header http.Header, body []byte) ([]byte, error) {
+	return c.do(ctx, method, c.endpoint()+path, header, body)
+}
+
+// do signs and sends a request to an absolute URL.
+func (c *Client) do(ctx context.Context, method, rawURL string, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	// The trace header is signed with the request
+	span := c.startSpan(ctx, req)
+	respBody, statusCode, reqID, err := c.send(req, body)
+	if span != nil {
+		span.End(statusCode, reqID, err)
+	}
+	return respBody, err
+}
+
+// send signs and sends a request, returning the body, status and request ID of the response.
+func (c *Client) send(req *http.Request, body []byte) ([]byte, int, string, error) {
+	if c.Credentials != nil {
+		creds, err := c.Credentials.Credentials()
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("failed to get credentials: %w", err)
+		}
+		Sign(req, body, creds, c.Service, c.Region, time.Now())
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, requestID(resp), err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, resp.StatusCode, requestID(resp), parseError(resp, respBody)
+	}
+	return respBody, resp.StatusCode, requestID(resp), nil
+}
+
+// JSON sends an AWS JSON protocol request (DynamoDB, EventBridge, Kinesis, ...).
+// target is the X-Amz-Target header, e.g. "DynamoDB_20120810.GetItem".
+func (c *Client) JSON(ctx context.Context, target, jsonVersion string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-amz-json-"+jsonVersion)
+	header.Set("X-Amz-Target", target)
+
+	respBody, err := c.Do(withOperation(ctx, operationName(target)), http.MethodPost, "/", header, body)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// RESTJSON sends a REST-JSON protocol request (KVS control plane, IoT, ...).
+func (c *Client) RESTJSON(ctx context.Context, method, path string, in, out any) error {
+	var body []byte
+	header := http.Header{}
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		header.Set("Content-Type", "application/json")
+	}
+
+	respBody, err := c.Do(ctx, method, path, header, body)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// Query sends an AWS Query protocol request (STS, SNS, ...) and decodes the XML response into out.
+func (c *Client) Query(ctx context.Context, action, version string, params url.Values, out any) error {
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("Action", action)
+	form.Set("Version", version)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	respBody, err := c.Do(withOperation(ctx, action), http.MethodPost, "/", header, []byte(form.Encode()))
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(respBody, out)
+}
+
+// parseError extracts the error code and message from JSON or XML error responses.
+func parseError(resp *http.Response, body []byte) error {
+	apiErr := &APIError{StatusCode: resp.StatusCode, Code: resp.Header.Get("X-Amzn-Errortype")}
+
+	var jsonErr struct {
+		Type     string `json:"__type"`
+		Code     string `json:"code"`
+		Message  string `json:"message"`
+		Message2 string `json:"Message"`
+	}
+	var xmlErr struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}
+
+	if json.Unmarshal(body, &jsonErr) == nil {
+		if jsonErr.Type != "" {
+			apiErr.Code = jsonErr.Type
+		} else if jsonErr.Code != "" {
+			apiErr.Code = jsonErr.Code
+		}
+		apiErr.Message = jsonErr.Message + jsonErr.Message2
+	} else if xml.Unmarshal(body, &xmlErr) == nil {
+		apiErr.Code = xmlErr.Code
+		apiErr.Message = xmlErr.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	// Error types may be namespaced ("com.amazonaws.dynamodb.v20120810#ResourceNotFoundException")
+	// or carry a suffix ("AccessDeniedException:http://internal.amazon.com/...")
+	if i := strings.LastIndex(apiErr.Code, "#"); i >= 0 {
+		apiErr.Code = apiErr.Code[i+1:]
+	}
+	if i := strings.Index(apiErr.Code, ":"); i >= 0 {
+		apiErr.Code = apiErr.Code[:i]
+	}
+	if apiErr.Code == "" {
+		apiErr.Code = http.StatusText(resp.StatusCode)
+	}
+
+	return apiErr
+}
@@ -0,0 +1,53 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MetricDatum is a value of a CloudWatch metric.
+type MetricDatum struct {
+	MetricName string
+	Dimensions map[string]string
+	Value      float64
+	Unit       string // e.g. Count, Seconds
+	Timestamp  time.Time
+}
+
+// CloudWatch is a client for the CloudWatch API.
+type CloudWatch struct {
+	*Client
+}
+
+// NewCloudWatch creates a CloudWatch client.
+func NewCloudWatch(region string) *CloudWatch {
+	return &CloudWatch{Client: NewClient("monitoring", region)}
+}
+
+// PutMetricData publishes up to 1000 values to a namespace.
+func (c *CloudWatch) PutMetricData(ctx context.Context, namespace string, data []MetricDatum) error {
+	params := url.Values{}
+	params.Set("Namespace", namespace)
+	for i, d := range data {
+		prefix := "MetricData.member." + strconv.Itoa(i+1) + "."
+		params.Set(prefix+"MetricName", d.MetricName)
+		params.Set(prefix+"Value", strconv.FormatFloat(d.Value, 'f', -1, 64))
+		if d.Unit != "" {
+			params.Set(prefix+"Unit", d.Unit)
+		}
+		if !d.Timestamp.IsZero() {
+			params.Set(prefix+"Timestamp", d.Timestamp.UTC().Format(time.RFC3339))
+		}
+		n := 0
+		for name, value := range d.Dimensions {
+			n++
+			dimension := prefix + "Dimensions.member." + strconv.Itoa(n) + "."
+			params.Set(dimension+"Name", name)
+			params.Set(dimension+"Value", value)
+		}
+	}
+	return c.Query(ctx, "PutMetricData", "2010-08-01", params, nil)
+}
@@ -0,0 +1,44 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"errors"
+	"os"
+)
+
+// Credentials are AWS credentials used to sign requests.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// CredentialsProvider supplies credentials for signing.
+type CredentialsProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// EnvCredentials reads credentials from the standard AWS environment variables.
+// kvs.CredentialManager keeps these up to date on ECS Fargate and with IoT credentials.
+type EnvCredentials struct{}
+
+// Credentials implements CredentialsProvider.
+func (EnvCredentials) Credentials() (Credentials, error) {
+	creds := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, errors.New("AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY not set")
+	}
+	return creds, nil
+}
+
+// StaticCredentials is a fixed set of credentials (e.g. from an assumed role).
+type StaticCredentials Credentials
+
+// Credentials implements CredentialsProvider.
+func (s StaticCredentials) Credentials() (Credentials, error) {
+	return Credentials(s), nil
+}
@@ -0,0 +1,103 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"strconv"
+)
+
+// AttributeValue is a DynamoDB attribute value in the JSON wire format.
+type AttributeValue struct {
+	S    *string                   `json:"S,omitempty"`
+	N    *string                   `json:"N,omitempty"`
+	BOOL *bool                     `json:"BOOL,omitempty"`
+	M    map[string]AttributeValue `json:"M,omitempty"`
+	L    []AttributeValue          `json:"L,omitempty"`
+}
+
+// Item is a DynamoDB item.
+type Item map[string]AttributeValue
+
+// String returns a string attribute value.
+func String(v string) AttributeValue {
+	return AttributeValue{S: &v}
+}
+
+// Number returns a numeric attribute value.
+func Number(v int64) AttributeValue {
+	s := strconv.FormatInt(v, 10)
+	return AttributeValue{N: &s}
+}
+
+// Float returns a numeric attribute value from a float.
+func Float(v float64) AttributeValue {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	return AttributeValue{N: &s}
+}
+
+// Bool returns a boolean attribute value.
+func Bool(v bool) AttributeValue {
+	return AttributeValue{BOOL: &v}
+}
+
+// GetString returns a string attribute.
+func (i Item) GetString(name string) (string, bool) {
+	if v, ok := i[name]; ok && v.S != nil {
+		return *v.S, true
+	}
+	return "", false
+}
+
+// GetInt returns a numeric attribute as an integer.
+func (i Item) GetInt(name string) (int64, bool) {
+	if v, ok := i[name]; ok && v.N != nil {
+		n, err := strconv.ParseFloat(*v.N, 64)
+		if err == nil {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// GetBool returns a boolean attribute.
+func (i Item) GetBool(name string) (bool, bool) {
+	if v, ok := i[name]; ok && v.BOOL != nil {
+		return *v.BOOL, true
+	}
+	return false, false
+}
+
+// DynamoDB is a client for the DynamoDB API.
+type DynamoDB struct {
+	*Client
+}
+
+// NewDynamoDB creates a DynamoDB client.
+func NewDynamoDB(region string) *DynamoDB {
+	return &DynamoDB{Client: NewClient("dynamodb", region)}
+}
+
+// GetItem reads a single item. A nil item is returned if it does not exist.
+func (d *DynamoDB) GetItem(ctx context.Context, table string, key Item, consistent bool) (Item, error) {
+	in := map[string]any{
+		"TableName":      table,
+		"Key":            key,
+		"ConsistentRead": consistent,
+	}
+	var out struct {
+		Item Item `json:"Item"`
+	}
+	if err := d.JSON(ctx, "DynamoDB_20120810.GetItem", "1.0", in, &out); err != nil {
+		return nil, err
+	}
+	return out.Item, nil
+}
+
+// PutItem writes an item, replacing any existing item with the same key.
+func (d *DynamoDB) PutItem(ctx context.Context, table string, item Item) error {
+	in := map[string]any{
+		"TableName": table,
+		"Item":      item,
+	}
+	return d.JSON(ctx, "DynamoDB_20120810.PutItem", "1.0", in, nil)
+}
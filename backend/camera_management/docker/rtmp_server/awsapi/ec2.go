@@ -0,0 +1,48 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"net/url"
+)
+
+// EC2 is a client for the EC2 API.
+type EC2 struct {
+	*Client
+}
+
+// NewEC2 creates an EC2 client.
+func NewEC2(region string) *EC2 {
+	return &EC2{Client: NewClient("ec2", region)}
+}
+
+// GetManagedPrefixListEntries returns the CIDRs of a managed prefix list
+// (e.g. pl-0123456789abcdef0), following pagination.
+func (e *EC2) GetManagedPrefixListEntries(ctx context.Context, prefixListID string) ([]string, error) {
+	var cidrs []string
+	nextToken := ""
+	for {
+		params := url.Values{}
+		params.Set("PrefixListId", prefixListID)
+		params.Set("MaxResults", "100")
+		if nextToken != "" {
+			params.Set("NextToken", nextToken)
+		}
+		var out struct {
+			Entries []struct {
+				Cidr string `xml:"cidr"`
+			} `xml:"entrySet>item"`
+			NextToken string `xml:"nextToken"`
+		}
+		if err := e.Query(ctx, "GetManagedPrefixListEntries", "2016-11-15", params, &out); err != nil {
+			return nil, err
+		}
+		for _, entry := range out.Entries {
+			cidrs = append(cidrs, entry.Cidr)
+		}
+		if out.NextToken == "" {
+			return cidrs, nil
+		}
+		nextToken = out.NextToken
+	}
+}
@@ -0,0 +1,51 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"fmt"
+)
+
+// EventBridgeEntry is a PutEvents request entry.
+type EventBridgeEntry struct {
+	EventBusName string   `json:"EventBusName,omitempty"`
+	Source       string   `json:"Source"`
+	DetailType   string   `json:"DetailType"`
+	Detail       string   `json:"Detail"`
+	Resources    []string `json:"Resources,omitempty"`
+}
+
+// EventBridge is a client for the EventBridge API.
+type EventBridge struct {
+	*Client
+}
+
+// NewEventBridge creates an EventBridge client.
+func NewEventBridge(region string) *EventBridge {
+	return &EventBridge{Client: NewClient("events", region)}
+}
+
+// PutEvents sends up to 10 entries. Partial failures are returned as an error.
+func (e *EventBridge) PutEvents(ctx context.Context, entries []EventBridgeEntry) error {
+	in := map[string]any{"Entries": entries}
+	var out struct {
+		FailedEntryCount int `json:"FailedEntryCount"`
+		Entries          []struct {
+			ErrorCode    string `json:"ErrorCode"`
+			ErrorMessage string `json:"ErrorMessage"`
+		} `json:"Entries"`
+	}
+	if err := e.JSON(ctx, "AWSEvents.PutEvents", "1.1", in, &out); err != nil {
+		return err
+	}
+	if out.FailedEntryCount > 0 {
+		for _, entry := range out.Entries {
+			if entry.ErrorCode != "" {
+				return fmt.Errorf("%d of %d events failed: %s: %s",
+					out.FailedEntryCount, len(entries), entry.ErrorCode, entry.ErrorMessage)
+			}
+		}
+		return fmt.Errorf("%d of %d events failed", out.FailedEntryCount, len(entries))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"fmt"
+)
+
+// Firehose is a client for the Amazon Data Firehose API.
+type Firehose struct {
+	*Client
+}
+
+// NewFirehose creates a Firehose client.
+func NewFirehose(region string) *Firehose {
+	return &Firehose{Client: NewClient("firehose", region)}
+}
+
+// PutRecordBatch writes up to 500 records (4 MiB) to a delivery stream. It returns the
+// records that failed together with an error describing the first failure.
+func (f *Firehose) PutRecordBatch(ctx context.Context, deliveryStream string, records [][]byte) ([][]byte, error) {
+	type record struct {
+		Data []byte `json:"Data"` // base64-encoded by encoding/json
+	}
+	in := struct {
+		DeliveryStreamName string   `json:"DeliveryStreamName"`
+		Records            []record `json:"Records"`
+	}{DeliveryStreamName: deliveryStream}
+	for _, data := range records {
+		in.Records = append(in.Records, record{Data: data})
+	}
+	var out struct {
+		FailedPutCount   int `json:"FailedPutCount"`
+		RequestResponses []struct {
+			ErrorCode    string `json:"ErrorCode"`
+			ErrorMessage string `json:"ErrorMessage"`
+		} `json:"RequestResponses"`
+	}
+	if err := f.JSON(ctx, "Firehose_20150804.PutRecordBatch", "1.1", in, &out); err != nil {
+		return records, err
+	}
+	if out.FailedPutCount == 0 {
+		return nil, nil
+	}
+
+	var failed [][]byte
+	var first error
+	for i, result := range out.RequestResponses {
+		if result.ErrorCode == "" || i >= len(records) {
+			continue
+		}
+		failed = append(failed, records[i])
+		if first == nil {
+			first = fmt.Errorf("%d of %d records failed: %s: %s",
+				out.FailedPutCount, len(records), result.ErrorCode, result.ErrorMessage)
+		}
+	}
+	if first == nil {
+		first = fmt.Errorf("%d of %d records failed", out.FailedPutCount, len(records))
+	}
+	return failed, first
+}
@@ -0,0 +1,49 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// IAM is a client for the IAM API (global endpoint, signed for us-east-1).
+type IAM struct {
+	*Client
+}
+
+// NewIAM creates an IAM client.
+func NewIAM() *IAM {
+	c := NewClient("iam", "us-east-1")
+	if os.Getenv("AWS_ENDPOINT_URL_IAM") == "" {
+		c.Endpoint = "https://iam.amazonaws.com"
+	}
+	return &IAM{Client: c}
+}
+
+// SimulatePrincipalPolicy evaluates the policies of a user or role for actions on all
+// resources and returns the decision per action ("allowed", "implicitDeny" or
+// "explicitDeny").
+func (i *IAM) SimulatePrincipalPolicy(ctx context.Context, principalARN string, actions []string) (map[string]string, error) {
+	params := url.Values{}
+	params.Set("PolicySourceArn", principalARN)
+	for n, action := range actions {
+		params.Set("ActionNames.member."+strconv.Itoa(n+1), action)
+	}
+
+	var out struct {
+		Results []struct {
+			Action   string `xml:"EvalActionName"`
+			Decision string `xml:"EvalDecision"`
+		} `xml:"SimulatePrincipalPolicyResult>EvaluationResults>member"`
+	}
+	if err := i.Query(ctx, "SimulatePrincipalPolicy", "2010-05-08", params, &out); err != nil {
+		return nil, err
+	}
+	decisions := make(map[string]string, len(out.Results))
+	for _, r := range out.Results {
+		decisions[r.Action] = r.Decision
+	}
+	return decisions, nil
+}
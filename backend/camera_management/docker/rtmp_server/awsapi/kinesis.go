@@ -0,0 +1,60 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"fmt"
+)
+
+// KinesisRecord is a PutRecords request entry. Data is base64-encoded by encoding/json.
+type KinesisRecord struct {
+	Data         []byte `json:"Data"`
+	PartitionKey string `json:"PartitionKey"`
+}
+
+// Kinesis is a client for the Kinesis Data Streams API.
+type Kinesis struct {
+	*Client
+}
+
+// NewKinesis creates a Kinesis Data Streams client.
+func NewKinesis(region string) *Kinesis {
+	return &Kinesis{Client: NewClient("kinesis", region)}
+}
+
+// PutRecords sends up to 500 records to a stream. It returns the records that failed
+// (throttled or internal errors, which may be retried) together with an error describing
+// the first failure.
+func (k *Kinesis) PutRecords(ctx context.Context, streamName string, records []KinesisRecord) ([]KinesisRecord, error) {
+	in := map[string]any{"StreamName": streamName, "Records": records}
+	var out struct {
+		FailedRecordCount int `json:"FailedRecordCount"`
+		Records           []struct {
+			ErrorCode    string `json:"ErrorCode"`
+			ErrorMessage string `json:"ErrorMessage"`
+		} `json:"Records"`
+	}
+	if err := k.JSON(ctx, "Kinesis_20131202.PutRecords", "1.1", in, &out); err != nil {
+		return records, err
+	}
+	if out.FailedRecordCount == 0 {
+		return nil, nil
+	}
+
+	var failed []KinesisRecord
+	var first error
+	for i, result := range out.Records {
+		if result.ErrorCode == "" || i >= len(records) {
+			continue
+		}
+		failed = append(failed, records[i])
+		if first == nil {
+			first = fmt.Errorf("%d of %d records failed: %s: %s",
+				out.FailedRecordCount, len(records), result.ErrorCode, result.ErrorMessage)
+		}
+	}
+	if first == nil {
+		first = fmt.Errorf("%d of %d records failed", out.FailedRecordCount, len(records))
+	}
+	return failed, first
+}
@@ -0,0 +1,111 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Timeout of GetClip requests; the response carries up to 100 MB of media
+const getClipTimeout = 2 * time.Minute
+
+// KinesisVideo is a client for the Kinesis Video Streams control plane API.
+type KinesisVideo struct {
+	*Client
+}
+
+// NewKinesisVideo creates a Kinesis Video Streams client.
+func NewKinesisVideo(region string) *KinesisVideo {
+	return &KinesisVideo{Client: NewClient("kinesisvideo", region)}
+}
+
+// StreamInfo describes a stream.
+type StreamInfo struct {
+	StreamARN            string `json:"StreamARN"`
+	KmsKeyID             string `json:"KmsKeyId"` // key the stream's data is encrypted with
+	Version              string `json:"Version"`
+	DataRetentionInHours int    `json:"DataRetentionInHours"`
+}
+
+// DescribeStream returns the description of a stream.
+func (k *KinesisVideo) DescribeStream(ctx context.Context, streamName string) (*StreamInfo, error) {
+	var out struct {
+		StreamInfo StreamInfo `json:"StreamInfo"`
+	}
+	if err := k.RESTJSON(ctx, "POST", "/describeStream", map[string]string{"StreamName": streamName}, &out); err != nil {
+		return nil, err
+	}
+	return &out.StreamInfo, nil
+}
+
+// StreamARN returns the ARN of a stream.
+func (k *KinesisVideo) StreamARN(ctx context.Context, streamName string) (string, error) {
+	info, err := k.DescribeStream(ctx, streamName)
+	if err != nil {
+		return "", err
+	}
+	return info.StreamARN, nil
+}
+
+// UpdateDataRetention changes the retention period of a stream of the given version by
+// change hours, which may be negative.
+func (k *KinesisVideo) UpdateDataRetention(ctx context.Context, streamName, version string, change int) error {
+	operation := "INCREASE_DATA_RETENTION"
+	if change < 0 {
+		operation, change = "DECREASE_DATA_RETENTION", -change
+	}
+	return k.RESTJSON(ctx, "POST", "/updateDataRetention", map[string]any{
+		"StreamName":                 streamName,
+		"CurrentVersion":             version,
+		"Operation":                  operation,
+		"DataRetentionChangeInHours": change,
+	}, nil)
+}
+
+// GetDataEndpoint returns the data endpoint of a stream for an API (PUT_MEDIA, GET_CLIP, ...).
+func (k *KinesisVideo) GetDataEndpoint(ctx context.Context, streamName, apiName string) (string, error) {
+	var out struct {
+		DataEndpoint string `json:"DataEndpoint"`
+	}
+	err := k.RESTJSON(ctx, "POST", "/getDataEndpoint", map[string]string{"StreamName": streamName, "APIName": apiName}, &out)
+	if err != nil {
+		return "", err
+	}
+	return out.DataEndpoint, nil
+}
+
+// GetClip returns the fragments of a stream between start and end (producer timestamps)
+// as an MP4 file, using the archived media API.
+func (k *KinesisVideo) GetClip(ctx context.Context, streamName string, start, end time.Time) ([]byte, error) {
+	endpoint, err := k.GetDataEndpoint(ctx, streamName, "GET_CLIP")
+	if err != nil {
+		return nil, err
+	}
+	media := &Client{
+		Service:     k.Service,
+		Region:      k.Region,
+		Endpoint:    endpoint,
+		Credentials: k.Credentials,
+		HTTPClient:  &http.Client{Timeout: getClipTimeout},
+	}
+
+	seconds := func(t time.Time) float64 { return float64(t.UnixMilli()) / 1000 }
+	body, err := json.Marshal(map[string]any{
+		"StreamName": streamName,
+		"ClipFragmentSelector": map[string]any{
+			"FragmentSelectorType": "PRODUCER_TIMESTAMP",
+			"TimestampRange": map[string]float64{
+				"StartTimestamp": seconds(start),
+				"EndTimestamp":   seconds(end),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return media.Do(withOperation(ctx, "GetClip"), http.MethodPost, "/getClip", header, body)
+}
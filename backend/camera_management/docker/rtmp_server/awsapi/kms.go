@@ -0,0 +1,28 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import "context"
+
+// KMS is a client for the Key Management Service API.
+type KMS struct {
+	*Client
+}
+
+// NewKMS creates a KMS client.
+func NewKMS(region string) *KMS {
+	return &KMS{Client: NewClient("kms", region)}
+}
+
+// KeyARN resolves a key ID, key ARN, alias name ("alias/...") or alias ARN to the ARN of
+// the key.
+func (k *KMS) KeyARN(ctx context.Context, keyID string) (string, error) {
+	var out struct {
+		KeyMetadata struct {
+			Arn string `json:"Arn"`
+		} `json:"KeyMetadata"`
+	}
+	if err := k.JSON(ctx, "TrentService.DescribeKey", "1.1", map[string]string{"KeyId": keyID}, &out); err != nil {
+		return "", err
+	}
+	return out.KeyMetadata.Arn, nil
+}
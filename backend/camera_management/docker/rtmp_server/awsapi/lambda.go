@@ -0,0 +1,29 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// Lambda is a client for the Lambda API.
+type Lambda struct {
+	*Client
+}
+
+// NewLambda creates a Lambda client.
+func NewLambda(region string) *Lambda {
+	return &Lambda{Client: NewClient("lambda", region)}
+}
+
+// InvokeAsync invokes a function asynchronously (invocation type Event) with a JSON
+// payload. function is a name, an ARN or a partial ARN, optionally with a qualifier.
+func (l *Lambda) InvokeAsync(ctx context.Context, function string, payload []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Amz-Invocation-Type", "Event")
+	path := "/2015-03-31/functions/" + url.PathEscape(function) + "/invocations"
+	_, err := l.Do(withOperation(ctx, "Invoke"), http.MethodPost, path, header, payload)
+	return err
+}
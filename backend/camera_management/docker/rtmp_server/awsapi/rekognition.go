@@ -0,0 +1,111 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+)
+
+// StreamProcessor is a CreateStreamProcessor request. Exactly one of the settings
+// (ConnectedHome label detection or FaceSearch) is set.
+type StreamProcessor struct {
+	Name                string                  `json:"Name"`
+	RoleArn             string                  `json:"RoleArn"`
+	Input               StreamProcessorInput    `json:"Input"`
+	Output              StreamProcessorOutput   `json:"Output"`
+	Settings            StreamProcessorSettings `json:"Settings"`
+	NotificationChannel *StreamProcessorSNS     `json:"NotificationChannel,omitempty"`
+}
+
+// StreamProcessorInput is the KVS stream a stream processor analyzes.
+type StreamProcessorInput struct {
+	KinesisVideoStream struct {
+		Arn string `json:"Arn"`
+	} `json:"KinesisVideoStream"`
+}
+
+// StreamProcessorOutput is where a stream processor writes its results: S3 for label
+// detection, a Kinesis data stream for face search.
+type StreamProcessorOutput struct {
+	S3Destination     *S3Destination `json:"S3Destination,omitempty"`
+	KinesisDataStream *KinesisARN    `json:"KinesisDataStream,omitempty"`
+}
+
+// S3Destination is an S3 location for stream processor results.
+type S3Destination struct {
+	Bucket    string `json:"Bucket"`
+	KeyPrefix string `json:"KeyPrefix,omitempty"`
+}
+
+// KinesisARN identifies a Kinesis data stream.
+type KinesisARN struct {
+	Arn string `json:"Arn"`
+}
+
+// StreamProcessorSettings selects label detection or face search.
+type StreamProcessorSettings struct {
+	ConnectedHome *ConnectedHomeSettings `json:"ConnectedHome,omitempty"`
+	FaceSearch    *FaceSearchSettings    `json:"FaceSearch,omitempty"`
+}
+
+// ConnectedHomeSettings configures label detection (PERSON, PET, PACKAGE, ALL).
+type ConnectedHomeSettings struct {
+	Labels        []string `json:"Labels"`
+	MinConfidence float64  `json:"MinConfidence,omitempty"`
+}
+
+// FaceSearchSettings configures face search against a collection.
+type FaceSearchSettings struct {
+	CollectionId       string  `json:"CollectionId"`
+	FaceMatchThreshold float64 `json:"FaceMatchThreshold,omitempty"`
+}
+
+// StreamProcessorSNS is the SNS topic label detection results are announced on.
+type StreamProcessorSNS struct {
+	SNSTopicArn string `json:"SNSTopicArn"`
+}
+
+// Rekognition is a client for the Rekognition Video stream processor API.
+type Rekognition struct {
+	*Client
+}
+
+// NewRekognition creates a Rekognition client.
+func NewRekognition(region string) *Rekognition {
+	return &Rekognition{Client: NewClient("rekognition", region)}
+}
+
+// CreateStreamProcessor creates a stream processor.
+func (r *Rekognition) CreateStreamProcessor(ctx context.Context, p *StreamProcessor) error {
+	return r.JSON(ctx, "RekognitionService.CreateStreamProcessor", "1.1", p, nil)
+}
+
+// StreamProcessorStatus returns the status of a stream processor (STOPPED, STARTING,
+// RUNNING, FAILED, STOPPING, UPDATING).
+func (r *Rekognition) StreamProcessorStatus(ctx context.Context, name string) (string, error) {
+	var out struct {
+		Status string `json:"Status"`
+	}
+	err := r.JSON(ctx, "RekognitionService.DescribeStreamProcessor", "1.1", map[string]string{"Name": name}, &out)
+	return out.Status, err
+}
+
+// StartStreamProcessor starts a stream processor. Label detection sessions need a start
+// position and a maximum duration (startMillis and maxSeconds); face search processors
+// run until stopped (pass 0 for both).
+func (r *Rekognition) StartStreamProcessor(ctx context.Context, name string, startMillis int64, maxSeconds int) error {
+	in := map[string]any{"Name": name}
+	if startMillis > 0 {
+		in["StartSelector"] = map[string]any{
+			"KVSStreamStartSelector": map[string]any{"ProducerTimestamp": startMillis},
+		}
+	}
+	if maxSeconds > 0 {
+		in["StopSelector"] = map[string]any{"MaxDurationInSeconds": maxSeconds}
+	}
+	return r.JSON(ctx, "RekognitionService.StartStreamProcessor", "1.1", in, nil)
+}
+
+// StopStreamProcessor stops a running stream processor.
+func (r *Rekognition) StopStreamProcessor(ctx context.Context, name string) error {
+	return r.JSON(ctx, "RekognitionService.StopStreamProcessor", "1.1", map[string]string{"Name": name}, nil)
+}
@@ -0,0 +1,125 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Route53 is a client for the Route 53 API (global endpoint, signed for us-east-1).
+type Route53 struct {
+	*Client
+}
+
+// NewRoute53 creates a Route 53 client.
+func NewRoute53() *Route53 {
+	c := NewClient("route53", "us-east-1")
+	if os.Getenv("AWS_ENDPOINT_URL_ROUTE53") == "" {
+		c.Endpoint = "https://route53.amazonaws.com"
+	}
+	return &Route53{Client: c}
+}
+
+// route53Namespace is the XML namespace of the Route 53 API version used.
+const route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+// PublicZoneFor returns the ID (without the /hostedzone/ prefix) of the public hosted zone
+// with the longest name that name belongs to.
+func (r *Route53) PublicZoneFor(ctx context.Context, name string) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	for candidate := name; candidate != ""; {
+		var out struct {
+			Zones []struct {
+				ID      string `xml:"Id"`
+				Name    string `xml:"Name"`
+				Private bool   `xml:"Config>PrivateZone"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		query := url.Values{"dnsname": {candidate}, "maxitems": {"10"}}
+		body, err := r.Do(withOperation(ctx, "ListHostedZonesByName"), http.MethodGet, "/2013-04-01/hostedzonesbyname?"+query.Encode(), nil, nil)
+		if err != nil {
+			return "", err
+		}
+		if err := xml.Unmarshal(body, &out); err != nil {
+			return "", err
+		}
+		for _, zone := range out.Zones {
+			if strings.EqualFold(strings.TrimSuffix(zone.Name, "."), candidate) && !zone.Private {
+				return strings.TrimPrefix(zone.ID, "/hostedzone/"), nil
+			}
+		}
+
+		_, parent, found := strings.Cut(candidate, ".")
+		if !found {
+			break
+		}
+		candidate = parent
+	}
+	return "", fmt.Errorf("no public hosted zone found for %s", name)
+}
+
+// ChangeTXT creates or replaces (action UPSERT) or deletes (DELETE) the TXT record set
+// name with values, quoting each value, and returns the ID of the change.
+func (r *Route53) ChangeTXT(ctx context.Context, zoneID, action, name string, values []string, ttl int) (string, error) {
+	type resourceRecord struct {
+		Value string `xml:"Value"`
+	}
+	type change struct {
+		Action  string           `xml:"Action"`
+		Name    string           `xml:"ResourceRecordSet>Name"`
+		Type    string           `xml:"ResourceRecordSet>Type"`
+		TTL     int              `xml:"ResourceRecordSet>TTL"`
+		Records []resourceRecord `xml:"ResourceRecordSet>ResourceRecords>ResourceRecord"`
+	}
+	in := struct {
+		XMLName xml.Name `xml:"ChangeResourceRecordSetsRequest"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Changes []change `xml:"ChangeBatch>Changes>Change"`
+	}{
+		Xmlns:   route53Namespace,
+		Changes: []change{{Action: action, Name: name, Type: "TXT", TTL: ttl}},
+	}
+	for _, v := range values {
+		in.Changes[0].Records = append(in.Changes[0].Records, resourceRecord{Value: `"` + v + `"`})
+	}
+	body, err := xml.Marshal(in)
+	if err != nil {
+		return "", err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	path := "/2013-04-01/hostedzone/" + url.PathEscape(zoneID) + "/rrset/"
+	respBody, err := r.Do(withOperation(ctx, "ChangeResourceRecordSets"), http.MethodPost, path, header, append([]byte(xml.Header), body...))
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		ID string `xml:"ChangeInfo>Id"`
+	}
+	if err := xml.Unmarshal(respBody, &out); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(out.ID, "/change/"), nil
+}
+
+// ChangeStatus returns the status of a change: PENDING, or INSYNC once all Route 53
+// name servers answer with it.
+func (r *Route53) ChangeStatus(ctx context.Context, changeID string) (string, error) {
+	body, err := r.Do(withOperation(ctx, "GetChange"), http.MethodGet, "/2013-04-01/change/"+url.PathEscape(changeID), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Status string `xml:"ChangeInfo>Status"`
+	}
+	if err := xml.Unmarshal(body, &out); err != nil {
+		return "", err
+	}
+	return out.Status, nil
+}
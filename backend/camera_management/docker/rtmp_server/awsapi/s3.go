@@ -0,0 +1,59 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// S3 is a client for the S3 API.
+type S3 struct {
+	*Client
+}
+
+// NewS3 creates an S3 client.
+func NewS3(region string) *S3 {
+	return &S3{Client: NewClient("s3", region)}
+}
+
+// objectURL returns the URL of an object. Virtual-hosted style is used against AWS;
+// path style is used with an endpoint override (LocalStack, MinIO).
+func (s *S3) objectURL(bucket, key string) string {
+	path := (&url.URL{Path: "/" + key}).EscapedPath()
+	if s.Endpoint != "" || os.Getenv("AWS_ENDPOINT_URL_S3") != "" {
+		return s.endpoint() + "/" + bucket + path
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, s.Region, path)
+}
+
+// PutObject uploads an object.
+func (s *S3) PutObject(ctx context.Context, bucket, key, contentType string, body []byte) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	_, err := s.do(withOperation(ctx, "PutObject"), http.MethodPut, s.objectURL(bucket, key), header, body)
+	return err
+}
+
+// PresignGetObject returns a URL that downloads an object without credentials until it
+// expires. Presigned URLs outlive neither expires nor the credentials that signed them,
+// so with task role credentials they are valid for at most the remaining session.
+func (s *S3) PresignGetObject(bucket, key string, expires time.Duration) (string, error) {
+	if s.Credentials == nil {
+		return s.objectURL(bucket, key), nil
+	}
+	creds, err := s.Credentials.Credentials()
+	if err != nil {
+		return "", fmt.Errorf("failed to get credentials: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(bucket, key), nil)
+	if err != nil {
+		return "", err
+	}
+	return Presign(req, creds, "s3", s.Region, time.Now(), expires), nil
+}
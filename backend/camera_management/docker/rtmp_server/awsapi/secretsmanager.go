@@ -0,0 +1,51 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import "context"
+
+// SecretValue is the result of GetSecretValue.
+type SecretValue struct {
+	ARN          string `json:"ARN"`
+	VersionID    string `json:"VersionId"`
+	SecretString string `json:"SecretString"`
+	SecretBinary []byte `json:"SecretBinary"`
+}
+
+// SecretsManager is a client for the Secrets Manager API.
+type SecretsManager struct {
+	*Client
+}
+
+// NewSecretsManager creates a Secrets Manager client.
+func NewSecretsManager(region string) *SecretsManager {
+	return &SecretsManager{Client: NewClient("secretsmanager", region)}
+}
+
+// GetSecretValue reads the AWSCURRENT version of a secret.
+func (s *SecretsManager) GetSecretValue(ctx context.Context, secretID string) (*SecretValue, error) {
+	in := map[string]any{"SecretId": secretID}
+	var out SecretValue
+	if err := s.JSON(ctx, "secretsmanager.GetSecretValue", "1.1", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CurrentVersionID returns the version ID labelled AWSCURRENT, without reading the secret value.
+func (s *SecretsManager) CurrentVersionID(ctx context.Context, secretID string) (string, error) {
+	in := map[string]any{"SecretId": secretID}
+	var out struct {
+		VersionIdsToStages map[string][]string `json:"VersionIdsToStages"`
+	}
+	if err := s.JSON(ctx, "secretsmanager.DescribeSecret", "1.1", in, &out); err != nil {
+		return "", err
+	}
+	for versionID, stages := range out.VersionIdsToStages {
+		for _, stage := range stages {
+			if stage == "AWSCURRENT" {
+				return versionID, nil
+			}
+		}
+	}
+	return "", nil
+}
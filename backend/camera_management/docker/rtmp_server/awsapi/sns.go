@@ -0,0 +1,28 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"net/url"
+)
+
+// SNS is a client for the SNS API.
+type SNS struct {
+	*Client
+}
+
+// NewSNS creates an SNS client.
+func NewSNS(region string) *SNS {
+	return &SNS{Client: NewClient("sns", region)}
+}
+
+// Publish sends a message to a topic. subject is optional (used by email subscriptions).
+func (s *SNS) Publish(ctx context.Context, topicARN, subject, message string) error {
+	params := url.Values{}
+	params.Set("TopicArn", topicARN)
+	params.Set("Message", message)
+	if subject != "" {
+		params.Set("Subject", subject)
+	}
+	return s.Query(ctx, "Publish", "2010-03-31", params, nil)
+}
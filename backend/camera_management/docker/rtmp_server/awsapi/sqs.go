@@ -0,0 +1,52 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// SQS is a client for the SQS API (JSON protocol).
+type SQS struct {
+	*Client
+}
+
+// NewSQS creates an SQS client. Its HTTP timeout allows long polling.
+func NewSQS(region string) *SQS {
+	c := NewClient("sqs", region)
+	c.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	return &SQS{Client: c}
+}
+
+// SQSMessage is a message received from a queue.
+type SQSMessage struct {
+	MessageID     string `json:"MessageId"`
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+// ReceiveMessage receives up to max messages (1-10), waiting up to wait (at most 20
+// seconds) for one to arrive.
+func (s *SQS) ReceiveMessage(ctx context.Context, queueURL string, max int, wait time.Duration) ([]SQSMessage, error) {
+	var out struct {
+		Messages []SQSMessage `json:"Messages"`
+	}
+	err := s.JSON(ctx, "AmazonSQS.ReceiveMessage", "1.0", map[string]any{
+		"QueueUrl":            queueURL,
+		"MaxNumberOfMessages": max,
+		"WaitTimeSeconds":     int(wait / time.Second),
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return out.Messages, nil
+}
+
+// DeleteMessage deletes a received message from a queue.
+func (s *SQS) DeleteMessage(ctx context.Context, queueURL, receiptHandle string) error {
+	return s.JSON(ctx, "AmazonSQS.DeleteMessage", "1.0", map[string]string{
+		"QueueUrl":      queueURL,
+		"ReceiptHandle": receiptHandle,
+	}, nil)
+}
@@ -0,0 +1,103 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+package awsapi
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// STS is a client for the STS API (regional endpoint).
+type STS struct {
+	*Client
+}
+
+// NewSTS creates an STS client.
+func NewSTS(region string) *STS {
+	return &STS{Client: NewClient("sts", region)}
+}
+
+// AssumedRole is the result of AssumeRole.
+type AssumedRole struct {
+	Credentials
+	Expiration time.Time
+}
+
+// AssumeRole returns temporary credentials for roleARN. externalID is optional; duration
+// 0 uses the STS default (1 hour).
+func (s *STS) AssumeRole(ctx context.Context, roleARN, sessionName, externalID string, duration time.Duration) (*AssumedRole, error) {
+	params := url.Values{}
+	params.Set("RoleArn", roleARN)
+	params.Set("RoleSessionName", sessionName)
+	if externalID != "" {
+		params.Set("ExternalId", externalID)
+	}
+	if duration > 0 {
+		params.Set("DurationSeconds", strconv.Itoa(int(duration/time.Second)))
+	}
+
+	var out struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := s.Query(ctx, "AssumeRole", "2011-06-15", params, &out); err != nil {
+		return nil, err
+	}
+	return &AssumedRole{
+		Credentials: Credentials{
+			AccessKeyID:     out.Credentials.AccessKeyID,
+			SecretAccessKey: out.Credentials.SecretAccessKey,
+			SessionToken:    out.Credentials.SessionToken,
+		},
+		Expiration: out.Credentials.Expiration,
+	}, nil
+}
+
+// AssumeRoleWithWebIdentity returns temporary credentials for roleARN in exchange for an
+// OIDC token (e.g. the service account token of EKS IRSA). The request is not signed, so
+// it works without credentials.
+func (s *STS) AssumeRoleWithWebIdentity(ctx context.Context, roleARN, sessionName, token string) (*AssumedRole, error) {
+	params := url.Values{}
+	params.Set("RoleArn", roleARN)
+	params.Set("RoleSessionName", sessionName)
+	params.Set("WebIdentityToken", token)
+
+	unsigned := *s.Client
+	unsigned.Credentials = nil
+	var out struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := unsigned.Query(ctx, "AssumeRoleWithWebIdentity", "2011-06-15", params, &out); err != nil {
+		return nil, err
+	}
+	return &AssumedRole{
+		Credentials: Credentials{
+			AccessKeyID:     out.Credentials.AccessKeyID,
+			SecretAccessKey: out.Credentials.SecretAccessKey,
+			SessionToken:    out.Credentials.SessionToken,
+		},
+		Expiration: out.Credentials.Expiration,
+	}, nil
+}
+
+// GetCallerIdentity returns the ARN and account of the credentials in use.
+func (s *STS) GetCallerIdentity(ctx context.Context) (arn, account string, err error) {
+	var out struct {
+		Arn     string `xml:"GetCallerIdentityResult>Arn"`
+		Account string `xml:"GetCallerIdentityResult>Account"`
+	}
+	if err := s.Query(ctx, "GetCallerIdentity", "2011-06-15", nil, &out); err != nil {
+		return "", "", err
+	}
+	return out.Arn, out.Account, nil
+}
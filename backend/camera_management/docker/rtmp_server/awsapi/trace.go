@@ -0,0 +1,103 @@
+// Package awsapi is a minimal SigV4-signed client for the AWS service APIs used by this server.
+// It avoids pulling the full AWS SDK into the image; only the handful of calls we need are wrapped.
+package awsapi
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Call describes an AWS API call for tracing.
+type Call struct {
+	Service    string // SigV4 signing name, e.g. "dynamodb"
+	Region     string
+	Operation  string // e.g. "GetItem"
+	StreamPath string // stream the call was made for, empty if none
+	Start      time.Time
+}
+
+// Span is a traced call in progress.
+type Span interface {
+	// Header returns the X-Amzn-Trace-Id header sent with the request, or "".
+	Header() string
+	// End records the outcome: the HTTP status (0 if no response was received), the AWS
+	// request ID and the error of the call.
+	End(statusCode int, requestID string, err error)
+}
+
+// Tracer traces AWS API calls (X-Ray).
+type Tracer interface {
+	// Start returns the span of a call, or nil if the call is not sampled.
+	Start(call Call) Span
+}
+
+var tracer Tracer
+
+// SetTracer sets the tracer of all clients. It must be called before any request is sent.
+func SetTracer(t Tracer) {
+	tracer = t
+}
+
+type streamPathKey struct{}
+type operationKey struct{}
+
+// WithStreamPath returns ctx annotated with the stream the AWS calls made with it serve,
+// so traces can be correlated with the camera.
+func WithStreamPath(ctx context.Context, streamPath string) context.Context {
+	return context.WithValue(ctx, streamPathKey{}, streamPath)
+}
+
+// withOperation returns ctx carrying the API operation name of a request.
+func withOperation(ctx context.Context, operation string) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, operationKey{}, operation)
+}
+
+// startSpan starts the span of a request, or returns nil when tracing is disabled or the
+// call is not sampled.
+func (c *Client) startSpan(ctx context.Context, req *http.Request) Span {
+	if tracer == nil {
+		return nil
+	}
+	operation, _ := ctx.Value(operationKey{}).(string)
+	if operation == "" {
+		// REST calls without an explicit operation: the last path element ("/describeStream")
+		base := path.Base(req.URL.Path)
+		operation = strings.ToUpper(base[:1]) + base[1:]
+	}
+	streamPath, _ := ctx.Value(streamPathKey{}).(string)
+	span := tracer.Start(Call{
+		Service:    c.Service,
+		Region:     c.Region,
+		Operation:  operation,
+		StreamPath: streamPath,
+		Start:      time.Now(),
+	})
+	if span != nil {
+		if header := span.Header(); header != "" {
+			req.Header.Set("X-Amzn-Trace-Id", header)
+		}
+	}
+	return span
+}
+
+// requestID returns the AWS request ID of a response.
+func requestID(resp *http.Response) string {
+	for _, name := range []string{"X-Amzn-Requestid", "X-Amz-Request-Id", "X-Amzn-Request-Id"} {
+		if id := resp.Header.Get(name); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// operationName returns the operation of an X-Amz-Target header
+// ("DynamoDB_20120810.GetItem" is "GetItem").
+func operationName(target string) string {
+	return target[strings.LastIndex(target, ".")+1:]
+}
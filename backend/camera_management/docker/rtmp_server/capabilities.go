@@ -0,0 +1,182 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sync"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/server"
+	"rtmp_kvs/sink"
+)
+
+// capabilitiesSchema is the version of the /capabilities document. Fields are added
+// without changing it; it is incremented when a field is removed or changes meaning.
+const capabilitiesSchema = 1
+
+// version is the release of the server, set when building with
+// -ldflags "-X main.version=<release>".
+var version string
+
+// buildVersion returns the release of the server (version, else the module version of the
+// build, else "dev") and the VCS revision it was built from, if known.
+func buildVersion() (release, revision string) {
+	release = version
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+		if release == "" && info.Main.Version != "(devel)" {
+			release = info.Main.Version
+		}
+	}
+	return cmp.Or(release, "dev"), revision
+}
+
+// Modules whose versions are reported: they implement the ingest protocols and the gRPC API
+var reportedModules = map[string]string{
+	"github.com/bluenviron/gortmplib":      "gortmplib",
+	"github.com/bluenviron/mediacommon/v2": "mediacommon",
+	"google.golang.org/grpc":               "grpc",
+}
+
+// Capabilities is what this build and configuration of the server supports, for the
+// provisioning side to adapt the camera configuration to the deployed version.
+type Capabilities struct {
+	Schema     int                   `json:"schema_version"`
+	Version    string                `json:"version"`
+	Revision   string                `json:"revision,omitempty"` // VCS revision of the build
+	Ingest     []IngestCapability    `json:"ingest"`
+	Codecs     []server.CodecSupport `json:"codecs"`
+	Sinks      []SinkCapability      `json:"sinks"`
+	Auth       []server.AuthMode     `json:"auth"`
+	Components []Component           `json:"components"`
+}
+
+// IngestCapability is an ingest protocol and where it is served.
+type IngestCapability struct {
+	Protocol       string   `json:"protocol"` // RTMP, RTMPS, MPEG-TS/TCP, MPEG-TS/UDP or HTTP
+	Version        string   `json:"version"`
+	Implementation string   `json:"implementation"`
+	Enabled        bool     `json:"enabled"`
+	Addresses      []string `json:"addresses,omitempty"`
+	Playback       bool     `json:"playback,omitempty"` // RTMP read mode (-enable-playback)
+}
+
+// SinkCapability is an output streams can be written to.
+type SinkCapability struct {
+	Sink      string `json:"sink"`
+	Available bool   `json:"available"`
+	Default   bool   `json:"default"`           // written for streams without a sinks setting
+	Backend   string `json:"backend,omitempty"` // what the kvs sink writes to
+	Version   string `json:"version,omitempty"` // kvssink plugin of the kvs sink
+}
+
+// Component is a library or program the server is built or runs with.
+type Component struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// capabilities builds the /capabilities document. The listeners are recorded as they
+// start; the rest is read from the server and the environment on each request.
+type capabilities struct {
+	rtmp     *server.Server
+	playback bool
+
+	mutex     sync.Mutex
+	listening map[string][]string // addresses by protocol
+}
+
+func newCapabilities(rtmp *server.Server, playback bool) *capabilities {
+	return &capabilities{
+		rtmp:      rtmp,
+		playback:  playback,
+		listening: make(map[string][]string),
+	}
+}
+
+// listen records a listener of an ingest protocol.
+func (c *capabilities) listen(protocol, address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.listening[protocol] = append(c.listening[protocol], address)
+}
+
+// document returns the capabilities of the server.
+func (c *capabilities) document() Capabilities {
+	doc := Capabilities{
+		Schema:     capabilitiesSchema,
+		Codecs:     c.rtmp.Codecs(),
+		Auth:       c.rtmp.AuthModes(),
+		Components: []Component{{Name: "go", Version: runtime.Version()}},
+	}
+	doc.Version, doc.Revision = buildVersion()
+	modules := map[string]string{}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if name, ok := reportedModules[dep.Path]; ok {
+				modules[name] = dep.Version
+				doc.Components = append(doc.Components, Component{Name: name, Version: dep.Version})
+			}
+		}
+	}
+
+	var kvssink string
+	if gst := kvs.GStreamer(); gst != nil {
+		doc.Components = append(doc.Components, Component{Name: "gstreamer", Version: gst.Version})
+		for _, element := range gst.Elements {
+			if element.Name == "kvssink" {
+				kvssink = element.Version
+				doc.Components = append(doc.Components, Component{Name: "kvssink", Version: element.Version})
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	for _, ingest := range []IngestCapability{
+		{Protocol: "RTMP", Version: "3", Implementation: "gortmplib", Playback: c.playback},
+		{Protocol: "RTMPS", Version: "3 over TLS 1.3", Implementation: "gortmplib", Playback: c.playback},
+		{Protocol: "MPEG-TS/TCP", Version: "H.222.0", Implementation: "mediacommon"},
+		{Protocol: "MPEG-TS/UDP", Version: "H.222.0", Implementation: "mediacommon"},
+		{Protocol: "HTTP", Version: "HTTP/1.1", Implementation: "net/http"},
+	} {
+		ingest.Addresses = slices.Clone(c.listening[ingest.Protocol])
+		ingest.Enabled = len(ingest.Addresses) > 0
+		ingest.Playback = ingest.Playback && ingest.Enabled
+		if v := modules[ingest.Implementation]; v != "" {
+			ingest.Implementation += " " + v
+		}
+		doc.Ingest = append(doc.Ingest, ingest)
+	}
+	c.mutex.Unlock()
+
+	defaults := sink.ParseList(os.Getenv("SINKS"))
+	for _, kind := range sink.Kinds {
+		capability := SinkCapability{
+			Sink:      kind,
+			Available: kind != "s3" || os.Getenv("SINK_S3_BUCKET") != "",
+			Default:   kind == "kvs" || slices.Contains(defaults, kind),
+		}
+		if kind == "kvs" {
+			capability.Backend = kvs.Backend()
+			if capability.Backend != kvs.BackendFile {
+				capability.Version = kvssink
+			}
+		}
+		doc.Sinks = append(doc.Sinks, capability)
+	}
+	return doc
+}
+
+// serve serves the capabilities as JSON (GET /capabilities).
+func (c *capabilities) serve(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, c.document())
+}
@@ -0,0 +1,294 @@
+// Package capture records the bytes RTMP clients send, so that sessions which failed can
+// be replayed against the server (see the replay-session subcommand).
+package capture
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/metrics"
+)
+
+// Capture modes (SESSION_CAPTURE)
+const (
+	ModeErrors = "errors" // keep sessions that ended with an error or a panic
+	ModeAll    = "all"    // keep every session
+)
+
+// File extension of captures
+const fileExt = ".rtmpcap"
+
+// Recorder records RTMP sessions and keeps those selected by the mode in a directory,
+// optionally uploading them to S3.
+type Recorder struct {
+	mode     string
+	dir      string
+	maxBytes int // per session
+	maxFiles int // kept in dir
+
+	bucket string
+	prefix string
+	s3     *awsapi.S3
+
+	mutex  sync.Mutex // serializes saving and pruning
+	saved  atomic.Uint64
+	failed atomic.Uint64
+}
+
+// NewFromEnv creates the recorder when SESSION_CAPTURE is "errors" or "all". Captures are
+// written to SESSION_CAPTURE_DIR (default captures), which keeps the latest
+// SESSION_CAPTURE_MAX_FILES (default 100); each session records at most
+// SESSION_CAPTURE_MAX_SIZE MiB (default 16). With SESSION_CAPTURE_BUCKET they are uploaded
+// to S3 under SESSION_CAPTURE_PREFIX (default session-captures/) instead. It returns nil
+// when disabled.
+func NewFromEnv(region string) *Recorder {
+	mode := strings.ToLower(os.Getenv("SESSION_CAPTURE"))
+	switch mode {
+	case "", "off", "false":
+		return nil
+	case ModeErrors, ModeAll:
+	default:
+		log.Printf("Warning: invalid SESSION_CAPTURE %q, using %s", mode, ModeErrors)
+		mode = ModeErrors
+	}
+
+	r := &Recorder{
+		mode:     mode,
+		dir:      os.Getenv("SESSION_CAPTURE_DIR"),
+		maxBytes: envInt("SESSION_CAPTURE_MAX_SIZE", 16) << 20,
+		maxFiles: envInt("SESSION_CAPTURE_MAX_FILES", 100),
+		bucket:   os.Getenv("SESSION_CAPTURE_BUCKET"),
+		prefix:   os.Getenv("SESSION_CAPTURE_PREFIX"),
+	}
+	if r.dir == "" {
+		r.dir = "captures"
+	}
+	if r.prefix == "" {
+		r.prefix = "session-captures/"
+	}
+	if r.bucket != "" {
+		r.s3 = awsapi.NewS3(region)
+	}
+
+	target := r.dir
+	if r.bucket != "" {
+		target = "s3://" + r.bucket + "/" + r.prefix
+	}
+	log.Printf("[Capture] Recording RTMP sessions (%s, up to %d MiB each) to %s", mode, r.maxBytes>>20, target)
+	log.Printf("[Capture] ⚠️  Captures contain stream keys and tokens sent by the publishers")
+	return r
+}
+
+// Start begins recording a connection. Reads must go through Recording.Reader.
+func (r *Recorder) Start(remoteAddr, protocol string) *Recording {
+	return &Recording{
+		recorder: r,
+		header: Header{
+			RemoteAddr: remoteAddr,
+			Protocol:   protocol,
+			StartedAt:  time.Now(),
+		},
+	}
+}
+
+// Finish ends the recording of a connection that ended with err (nil for a clean close)
+// and saves it in the background if the mode selects it. closed reports that the server
+// closed the connection (shutdown, disconnect, replacement), which is not a failure.
+func (r *Recorder) Finish(rec *Recording, err error, closed bool) {
+	failed := err != nil && !closed && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed)
+	if r.mode != ModeAll && !failed {
+		return
+	}
+
+	rec.mutex.Lock()
+	rec.header.EndedAt = time.Now()
+	rec.header.Bytes = len(rec.data)
+	if err != nil {
+		rec.header.Error = err.Error()
+	}
+	header, chunks := rec.header, rec.chunks()
+	rec.mutex.Unlock()
+	if header.Bytes == 0 {
+		return
+	}
+
+	go func() {
+		if err := r.save(header, chunks); err != nil {
+			r.failed.Add(1)
+			log.Printf("[Capture] ⚠️  Failed to save the capture of %s: %v", header.RemoteAddr, err)
+			return
+		}
+		r.saved.Add(1)
+	}()
+}
+
+// save writes a capture to the directory, or uploads it to S3.
+func (r *Recorder) save(header Header, chunks []Chunk) error {
+	name := fmt.Sprintf("%s_%s%s", header.StartedAt.UTC().Format("20060102T150405.000Z"), fileSafe(header.RemoteAddr), fileExt)
+
+	if r.s3 != nil {
+		var buf bytes.Buffer
+		if err := write(&buf, header, chunks); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		key := r.prefix + name
+		if err := r.s3.PutObject(ctx, r.bucket, key, "application/octet-stream", buf.Bytes()); err != nil {
+			return err
+		}
+		log.Printf("[Capture] Session of %s (%s) uploaded to s3://%s/%s", header.RemoteAddr, header.Error, r.bucket, key)
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(r.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	err = write(f, header, chunks)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	log.Printf("[Capture] Session of %s (%s) saved to %s", header.RemoteAddr, header.Error, path)
+	r.prune()
+	return nil
+}
+
+// prune removes the oldest captures beyond maxFiles. Must be called with the mutex held.
+func (r *Recorder) prune() {
+	if r.maxFiles == 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(r.dir, "*"+fileExt))
+	if err != nil || len(files) <= r.maxFiles {
+		return
+	}
+	sort.Strings(files) // names start with the session start time
+	for _, path := range files[:len(files)-r.maxFiles] {
+		os.Remove(path)
+	}
+}
+
+// CollectMetrics writes the number of saved captures.
+func (r *Recorder) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_session_captures_total", "RTMP session captures saved", float64(r.saved.Load()))
+	w.Counter("rtmp_session_capture_errors_total", "RTMP session captures that failed to be saved", float64(r.failed.Load()))
+}
+
+// Recording holds the bytes received on one connection. A nil Recording records nothing.
+type Recording struct {
+	recorder *Recorder
+
+	mutex  sync.Mutex
+	header Header
+	data   []byte
+	ends   []int64 // end offset in data and arrival time (µs) of each read, interleaved
+}
+
+// Reader returns src with the data read from it recorded.
+func (rec *Recording) Reader(src io.Reader) io.Reader {
+	if rec == nil {
+		return src
+	}
+	return &recordingReader{src: src, rec: rec}
+}
+
+// SetStreamPath records the (redacted) stream path of the session.
+func (rec *Recording) SetStreamPath(streamPath string) {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	rec.header.StreamPath = streamPath
+	rec.mutex.Unlock()
+}
+
+// add records data read from the connection, up to the size limit.
+func (rec *Recording) add(p []byte) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.header.Truncated {
+		return
+	}
+	if len(rec.data)+len(p) > rec.recorder.maxBytes {
+		rec.header.Truncated = true
+		return
+	}
+	rec.data = append(rec.data, p...)
+	rec.ends = append(rec.ends, int64(len(rec.data)), int64(time.Since(rec.header.StartedAt)/time.Microsecond))
+}
+
+// chunks returns the recorded reads. Must be called with the mutex held.
+func (rec *Recording) chunks() []Chunk {
+	chunks := make([]Chunk, 0, len(rec.ends)/2)
+	start := 0
+	for i := 0; i < len(rec.ends); i += 2 {
+		end := int(rec.ends[i])
+		chunks = append(chunks, Chunk{At: time.Duration(rec.ends[i+1]) * time.Microsecond, Data: rec.data[start:end]})
+		start = end
+	}
+	return chunks
+}
+
+// recordingReader records what is read from src.
+type recordingReader struct {
+	src io.Reader
+	rec *Recording
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 {
+		r.rec.add(p[:n])
+	}
+	return n, err
+}
+
+// fileSafe replaces the characters of an address that are not allowed in file names.
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '/', '\\', '[', ']', '%':
+			return '-'
+		}
+		return r
+	}, s)
+}
+
+// envInt reads a non-negative integer environment variable, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("[Capture] ⚠️  Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,132 @@
+// Package capture records the bytes RTMP clients send, so that sessions which failed can
+// be replayed against the server (see the replay-session subcommand).
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// magic starts every capture file.
+var magic = []byte("RTMPCAP1")
+
+// Largest header and chunk accepted when reading a capture
+const (
+	maxHeaderSize = 64 << 10
+	maxChunkSize  = 16 << 20
+)
+
+// Header describes the captured session.
+type Header struct {
+	RemoteAddr string    `json:"remote_addr"`
+	Protocol   string    `json:"protocol"`
+	StreamPath string    `json:"stream_path,omitempty"` // redacted
+	StartedAt  time.Time `json:"started_at"`
+	EndedAt    time.Time `json:"ended_at"`
+	Error      string    `json:"error,omitempty"`
+	Bytes      int       `json:"bytes"`
+	Truncated  bool      `json:"truncated,omitempty"` // the session sent more than the size limit
+}
+
+// Chunk is the data of one read from the connection and when it arrived, relative to
+// the start of the session.
+type Chunk struct {
+	At   time.Duration
+	Data []byte
+}
+
+// File layout: magic, header length (uint32) and JSON header, then chunks of arrival
+// offset (int64 µs), length (uint32) and data. Integers are big-endian.
+
+// write writes a capture.
+func write(w io.Writer, header Header, chunks []Chunk) error {
+	bw := bufio.NewWriter(w)
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	bw.Write(magic)
+	bw.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data))))
+	bw.Write(data)
+
+	var prefix [12]byte
+	for _, chunk := range chunks {
+		binary.BigEndian.PutUint64(prefix[:8], uint64(chunk.At/time.Microsecond))
+		binary.BigEndian.PutUint32(prefix[8:], uint32(len(chunk.Data)))
+		bw.Write(prefix[:])
+		bw.Write(chunk.Data)
+	}
+	return bw.Flush()
+}
+
+// Reader reads a capture file.
+type Reader struct {
+	Header Header
+
+	file *os.File
+	r    *bufio.Reader
+}
+
+// Open opens a capture file and reads its header.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{file: f, r: bufio.NewReader(f)}
+
+	var prefix [12]byte
+	if _, err := io.ReadFull(r.r, prefix[:]); err != nil || string(prefix[:8]) != string(magic) {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a session capture", path)
+	}
+	size := binary.BigEndian.Uint32(prefix[8:])
+	if size > maxHeaderSize {
+		f.Close()
+		return nil, errors.New("capture header is too large")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read capture header: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.Header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to parse capture header: %w", err)
+	}
+	return r, nil
+}
+
+// Next returns the next chunk, or io.EOF at the end of the capture.
+func (r *Reader) Next() (*Chunk, error) {
+	var prefix [12]byte
+	if _, err := io.ReadFull(r.r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("capture is truncated")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(prefix[8:])
+	if size > maxChunkSize {
+		return nil, errors.New("capture chunk is too large")
+	}
+	chunk := &Chunk{
+		At:   time.Duration(binary.BigEndian.Uint64(prefix[:8])) * time.Microsecond,
+		Data: make([]byte, size),
+	}
+	if _, err := io.ReadFull(r.r, chunk.Data); err != nil {
+		return nil, errors.New("capture is truncated")
+	}
+	return chunk, nil
+}
+
+// Close closes the file.
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,292 @@
+// Package clip exports the last seconds of a stream as an MP4 file to S3, e.g. when an
+// analytics pipeline detected an incident, from the server's in-memory buffer of recent
+// frames or from the KVS archive (GetClip).
+package clip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+)
+
+// Sources of an exported clip
+const (
+	SourceBuffer = "buffer"
+	SourceKVS    = "kvs"
+)
+
+// How far the buffered frames may start after the requested start and still be used
+const bufferTolerance = time.Second
+
+// ErrNotBuffered is returned by a Source when the requested range is not buffered.
+var ErrNotBuffered = errors.New("clip is not buffered")
+
+// Frame is a buffered H.264 access unit. The access units of keyframes carry the SPS and
+// PPS.
+type Frame struct {
+	Time time.Time // presentation on the wall clock: arrival of the stream's first frame plus PTS
+	PTS  time.Duration
+	DTS  time.Duration
+	AU   [][]byte
+}
+
+// Source provides the recent frames of live streams.
+type Source interface {
+	// ClipFrames returns the buffered frames of a stream from the last keyframe presented
+	// at or before start up to end.
+	ClipFrames(streamPath string, start, end time.Time) ([]Frame, error)
+}
+
+// BufferConfig is the size of the per-stream buffer of recent frames.
+type BufferConfig struct {
+	Window   time.Duration // 0 disables buffering
+	MaxBytes int
+	Dir      string // keeps the frames in files below Dir instead of in memory if set
+}
+
+// BufferConfigFromEnv reads the buffer of the last CLIP_BUFFER_SECONDS (default window,
+// 0 disables it) of each stream, at most CLIP_BUFFER_MAX_MB (default 64) per stream, kept
+// on disk below CLIP_BUFFER_DIR if set.
+func BufferConfigFromEnv(window time.Duration) BufferConfig {
+	return BufferConfig{
+		Window:   time.Duration(envInt("CLIP_BUFFER_SECONDS", int(window/time.Second))) * time.Second,
+		MaxBytes: envInt("CLIP_BUFFER_MAX_MB", 64) << 20,
+		Dir:      os.Getenv("CLIP_BUFFER_DIR"),
+	}
+}
+
+// Request asks for the clip of a stream ending at Time.
+type Request struct {
+	RequestID string    `json:"request_id,omitempty"` // echoed in the completion event
+	Path      string    `json:"path"`                 // publish path, e.g. /live/cam1
+	Stream    string    `json:"stream,omitempty"`     // KVS stream, defaults to the stream of the path
+	Seconds   float64   `json:"seconds,omitempty"`
+	Time      time.Time `json:"time,omitzero"` // end of the clip, defaults to now
+}
+
+// Result describes an exported clip.
+type Result struct {
+	RequestID string    `json:"request_id,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Stream    string    `json:"stream,omitempty"`
+	Source    string    `json:"source"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	URI       string    `json:"s3_uri"`
+	Size      int       `json:"size"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+}
+
+// Exporter exports clips to S3.
+type Exporter struct {
+	source     Source
+	streamName func(streamPath string) string // KVS stream of a publish path
+	s3         *awsapi.S3
+	kvs        *awsapi.KinesisVideo
+	bucket     string
+	prefix     string
+	buffer     BufferConfig
+
+	defaultSeconds float64
+	maxSeconds     float64
+
+	queueURL string
+	sqs      *awsapi.SQS
+
+	exported  [2]atomic.Uint64 // by source: buffer, kvs
+	failed    atomic.Uint64
+	bytes     atomic.Uint64
+	received  atomic.Uint64
+	sqsErrors atomic.Uint64
+}
+
+// NewFromEnv creates an exporter uploading to CLIP_BUCKET (key prefix CLIP_PREFIX, default
+// "clips/"). It returns nil if CLIP_BUCKET is not set.
+//
+// Clips are cut from a buffer of the last CLIP_BUFFER_SECONDS (default 60) of each stream
+// (see BufferConfigFromEnv); clips that are not buffered are read from KVS with GetClip. Requests are accepted from the admin API and,
+// if CLIP_QUEUE_URL is set, from an SQS queue. streamName resolves the KVS stream of a
+// publish path.
+func NewFromEnv(source Source, streamName func(string) string, region string) *Exporter {
+	bucket := os.Getenv("CLIP_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	e := &Exporter{
+		source:         source,
+		streamName:     streamName,
+		s3:             awsapi.NewS3(region),
+		kvs:            awsapi.NewKinesisVideo(region),
+		bucket:         bucket,
+		prefix:         os.Getenv("CLIP_PREFIX"),
+		buffer:         BufferConfigFromEnv(60 * time.Second),
+		defaultSeconds: float64(envInt("CLIP_DEFAULT_SECONDS", 30)),
+		maxSeconds:     float64(max(envInt("CLIP_MAX_SECONDS", 300), 1)),
+		queueURL:       os.Getenv("CLIP_QUEUE_URL"),
+	}
+	if e.prefix == "" {
+		e.prefix = "clips/"
+	}
+	if e.queueURL != "" {
+		e.sqs = awsapi.NewSQS(region)
+	}
+	log.Printf("[Clip] Exporting clips to s3://%s/%s (buffer %s per stream)", e.bucket, e.prefix, e.buffer.Window)
+	return e
+}
+
+// Buffer returns the size of the per-stream frame buffer to keep.
+func (e *Exporter) Buffer() BufferConfig {
+	return e.buffer
+}
+
+// Export cuts the requested clip, from the frame buffer if it covers the range or from
+// KVS otherwise, uploads it and emits ClipExported (with the S3 URI) or ClipExportFailed.
+func (e *Exporter) Export(ctx context.Context, req Request) (*Result, error) {
+	result, err := e.export(ctx, req)
+	if err != nil {
+		e.failed.Add(1)
+		log.Printf("[Clip] ⚠️  Failed to export clip of %s: %v", req.Path+req.Stream, err)
+		events.Emit(events.Event{
+			Type:       events.ClipExportFailed,
+			StreamPath: req.Path,
+			StreamName: req.Stream,
+			Detail:     map[string]any{"request_id": req.RequestID, "error": err.Error()},
+		})
+		return nil, err
+	}
+
+	e.exported[sourceIndex(result.Source)].Add(1)
+	e.bytes.Add(uint64(result.Size))
+	log.Printf("[Clip] Exported %s of %s from %s to %s (%d bytes)",
+		result.End.Sub(result.Start).Round(time.Millisecond), req.Path+req.Stream, result.Source, result.URI, result.Size)
+	events.Emit(events.Event{
+		Type:       events.ClipExported,
+		StreamPath: result.Path,
+		StreamName: result.Stream,
+		Detail: map[string]any{
+			"request_id": result.RequestID,
+			"s3_uri":     result.URI,
+			"bucket":     result.Bucket,
+			"key":        result.Key,
+			"size":       result.Size,
+			"source":     result.Source,
+			"start":      result.Start,
+			"end":        result.End,
+		},
+	})
+	return result, nil
+}
+
+// export validates the request, cuts the clip and uploads it.
+func (e *Exporter) export(ctx context.Context, req Request) (*Result, error) {
+	if req.Path == "" && req.Stream == "" {
+		return nil, errors.New("path or stream is required")
+	}
+	seconds := req.Seconds
+	if seconds == 0 {
+		seconds = e.defaultSeconds
+	}
+	if seconds < 0 || seconds > e.maxSeconds {
+		return nil, fmt.Errorf("seconds must be between 0 and %g", e.maxSeconds)
+	}
+	end := req.Time
+	if end.IsZero() {
+		end = time.Now()
+	}
+	start := end.Add(-time.Duration(seconds * float64(time.Second)))
+
+	result := &Result{RequestID: req.RequestID, Path: req.Path, Stream: req.Stream}
+	var data []byte
+	var err error
+	bufferErr := ErrNotBuffered
+	if req.Path != "" && e.buffer.Window > 0 {
+		data, result.Start, result.End, bufferErr = cut(e.source, req.Path, start, end)
+		if bufferErr == nil {
+			result.Source = SourceBuffer
+		}
+	}
+	if result.Source == "" {
+		if result.Stream == "" && req.Path != "" {
+			result.Stream = e.streamName(req.Path)
+		}
+		if result.Stream == "" {
+			return nil, fmt.Errorf("%s: %w and its KVS stream is unknown", req.Path, bufferErr)
+		}
+		if data, err = e.kvs.GetClip(ctx, result.Stream, start, end); err != nil {
+			return nil, fmt.Errorf("GetClip of %s failed: %w", result.Stream, err)
+		}
+		result.Source, result.Start, result.End = SourceKVS, start, end
+	}
+
+	name := strings.Trim(req.Path, "/")
+	if name == "" {
+		name = result.Stream
+	}
+	result.Bucket = e.bucket
+	result.Key = fmt.Sprintf("%s%s/%s", e.prefix, name, start.UTC().Format("20060102-150405.000"))
+	if req.RequestID != "" {
+		result.Key += "-" + sanitize(req.RequestID)
+	}
+	result.Key += ".mp4"
+	result.URI = fmt.Sprintf("s3://%s/%s", result.Bucket, result.Key)
+	result.Size = len(data)
+	if err := e.s3.PutObject(awsapi.WithStreamPath(ctx, req.Path), e.bucket, result.Key, "video/mp4", data); err != nil {
+		return nil, fmt.Errorf("failed to upload %s: %w", result.URI, err)
+	}
+	return result, nil
+}
+
+// CollectMetrics writes the clip export counters.
+func (e *Exporter) CollectMetrics(w *metrics.Writer) {
+	for i, source := range []string{SourceBuffer, SourceKVS} {
+		w.Counter("rtmp_clip_exports_total", "Clips exported to S3", float64(e.exported[i].Load()), "source", source)
+	}
+	w.Counter("rtmp_clip_export_errors_total", "Clip exports that failed", float64(e.failed.Load()))
+	w.Counter("rtmp_clip_export_bytes_total", "Bytes of clips uploaded to S3", float64(e.bytes.Load()))
+	if e.sqs != nil {
+		w.Counter("rtmp_clip_requests_received_total", "Clip requests received from SQS", float64(e.received.Load()))
+		w.Counter("rtmp_clip_queue_errors_total", "Failed SQS requests of the clip request queue", float64(e.sqsErrors.Load()))
+	}
+}
+
+func sourceIndex(source string) int {
+	if source == SourceKVS {
+		return 1
+	}
+	return 0
+}
+
+// sanitize keeps the characters of a request ID that are safe in an S3 key.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// envInt reads a non-negative integer environment variable, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("[Clip] ⚠️  Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+// Package clip exports the last seconds of a stream as an MP4 file to S3, e.g. when an
+// analytics pipeline detected an incident, from the server's in-memory buffer of recent
+// frames or from the KVS archive (GetClip).
+package clip
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"rtmp_kvs/admin"
+)
+
+// Register registers the clip export endpoint on the admin server.
+//
+//	POST /clips?path=/live/cam1&seconds=30[&time=RFC3339][&stream=name][&request_id=id]
+func (e *Exporter) Register(srv *admin.Server) {
+	srv.HandleFunc("POST /clips", e.serveExport)
+}
+
+// RegisterLookback registers the endpoint returning the MP4 of the seconds (default 10)
+// before a time (default now) from the buffer of a live stream, with the range it covers
+// in the X-Clip-Start and X-Clip-End headers.
+//
+//	GET /clips/lookback?path=/live/cam1[&seconds=10][&time=RFC3339]
+func RegisterLookback(srv *admin.Server, source Source) {
+	srv.HandleFunc("GET /clips/lookback", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		path := q.Get("path")
+		if path == "" {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		seconds := 10.0
+		if value := q.Get("seconds"); value != "" {
+			var err error
+			if seconds, err = strconv.ParseFloat(value, 64); err != nil || seconds <= 0 {
+				http.Error(w, "invalid seconds", http.StatusBadRequest)
+				return
+			}
+		}
+		t := time.Now()
+		if value := q.Get("time"); value != "" {
+			var err error
+			if t, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				http.Error(w, "invalid time, expected RFC 3339", http.StatusBadRequest)
+				return
+			}
+		}
+
+		data, start, end, err := Lookback(source, path, t, time.Duration(seconds*float64(time.Second)))
+		if errors.Is(err, ErrNotBuffered) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("X-Clip-Start", start.UTC().Format(time.RFC3339Nano))
+		w.Header().Set("X-Clip-End", end.UTC().Format(time.RFC3339Nano))
+		w.Write(data)
+	})
+}
+
+func (e *Exporter) serveExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := Request{
+		RequestID: q.Get("request_id"),
+		Path:      q.Get("path"),
+		Stream:    q.Get("stream"),
+	}
+	if req.Path == "" && req.Stream == "" {
+		http.Error(w, "path or stream is required", http.StatusBadRequest)
+		return
+	}
+	if value := q.Get("seconds"); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		req.Seconds = seconds
+	}
+	if value := q.Get("time"); value != "" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, "invalid time, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+		req.Time = t
+	}
+
+	result, err := e.Export(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,35 @@
+// Package clip exports the last seconds of a stream as an MP4 file to S3, e.g. when an
+// analytics pipeline detected an incident, from the server's in-memory buffer of recent
+// frames or from the KVS archive (GetClip).
+package clip
+
+import (
+	"time"
+)
+
+// Lookback returns the MP4 of the duration d before t (e.g. "the 10 seconds before the
+// detection") from the buffer of a live stream, with the time range it covers, for
+// event-driven clips and analysis with pre-roll context. It returns ErrNotBuffered if the
+// buffer does not reach back to t-d.
+func Lookback(source Source, streamPath string, t time.Time, d time.Duration) ([]byte, time.Time, time.Time, error) {
+	return cut(source, streamPath, t.Add(-d), t)
+}
+
+// cut muxes the buffered frames of a stream from start to end into an MP4 file, returning
+// the time range it covers. The file starts at the keyframe before start, but its edit
+// list starts playback at the first frame presented at or after start, so the clip is
+// frame-accurate. It returns ErrNotBuffered if the buffer starts after start.
+func cut(source Source, streamPath string, start, end time.Time) ([]byte, time.Time, time.Time, error) {
+	frames, err := source.ClipFrames(streamPath, start, end)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	if len(frames) == 0 || frames[0].Time.After(start.Add(bufferTolerance)) {
+		return nil, time.Time{}, time.Time{}, ErrNotBuffered
+	}
+	data, first, err := marshalMP4(frames, start)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	return data, first, frames[len(frames)-1].Time, nil
+}
@@ -0,0 +1,104 @@
+// Package clip exports the last seconds of a stream as an MP4 file to S3, e.g. when an
+// analytics pipeline detected an incident, from the server's in-memory buffer of recent
+// frames or from the KVS archive (GetClip).
+package clip
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mp4/codecs"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/pmp4"
+)
+
+// Timescale of the video track
+const timeScale = 90000
+
+// MarshalMP4 muxes H.264 frames into an MP4 file with a single video track. The first
+// frame must be a keyframe carrying the SPS and PPS.
+func MarshalMP4(frames []Frame) ([]byte, error) {
+	data, _, err := marshalMP4(frames, time.Time{})
+	return data, err
+}
+
+// marshalMP4 is MarshalMP4 with playback starting at the first frame presented at or after
+// start: the frames before it are only decoded. It returns the time playback starts at.
+func marshalMP4(frames []Frame, start time.Time) ([]byte, time.Time, error) {
+	if len(frames) == 0 {
+		return nil, time.Time{}, errors.New("no frames")
+	}
+	var sps, pps []byte
+	for _, nalu := range frames[0].AU {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			sps = nalu
+		case h264.NALUTypePPS:
+			pps = nalu
+		}
+	}
+	if sps == nil || pps == nil {
+		return nil, time.Time{}, errors.New("the first frame has no SPS and PPS")
+	}
+
+	ticks := func(d time.Duration) int64 { return int64(d) * timeScale / int64(time.Second) }
+	track := &pmp4.Track{ID: 1, TimeScale: timeScale, Codec: &codecs.H264{SPS: sps, PPS: pps}}
+
+	// The edit list skips the media up to the first frame presented from start
+	first, found := frames[0], false
+	for _, frame := range frames {
+		if !frame.Time.Before(start) && (!found || frame.PTS < first.PTS) {
+			first, found = frame, true
+		}
+	}
+	if !found || first.PTS <= frames[0].PTS {
+		first = frames[0]
+	} else {
+		track.TimeOffset = -int32(ticks(first.PTS - frames[0].DTS))
+	}
+
+	var last uint32
+	for i, frame := range frames {
+		// Parameter sets are in the sample description
+		var au h264.AVCC
+		for _, nalu := range frame.AU {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch h264.NALUType(nalu[0] & 0x1F) {
+			case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter:
+			default:
+				au = append(au, nalu)
+			}
+		}
+		payload, err := au.Marshal()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		// The last frame lasts as long as the one before it
+		duration := last
+		if i+1 < len(frames) {
+			duration = uint32(max(ticks(frames[i+1].DTS-frame.DTS), 0))
+			last = duration
+		}
+		track.Samples = append(track.Samples, &pmp4.Sample{
+			Duration:        duration,
+			PTSOffset:       int32(ticks(frame.PTS - frame.DTS)),
+			IsNonSyncSample: !h264.IsRandomAccess(frame.AU),
+			PayloadSize:     uint32(len(payload)),
+			GetPayload:      func() ([]byte, error) { return payload, nil },
+		})
+	}
+
+	var buf bytes.Buffer
+	pres := pmp4.Presentation{Tracks: []*pmp4.Track{track}}
+	if err := pres.Marshal(&buf); err != nil {
+		return nil, time.Time{}, err
+	}
+	return buf.Bytes(), first.Time, nil
+}
@@ -0,0 +1,107 @@
+// Package clip exports the last seconds of a stream as an MP4 file to S3, e.g. when an
+// analytics pipeline detected an incident, from the server's in-memory buffer of recent
+// frames or from the KVS archive (GetClip).
+package clip
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+const (
+	// Long polling wait of ReceiveMessage
+	queueWait = 20 * time.Second
+	// Delay before polling again after a failed ReceiveMessage
+	queueRetryDelay = 10 * time.Second
+	// Timeout of an export started from the queue
+	exportTimeout = 3 * time.Minute
+)
+
+// RunQueue exports the clips requested on CLIP_QUEUE_URL until ctx is cancelled. It
+// returns immediately if no queue is configured.
+//
+// A message is a JSON Request, or an EventBridge event whose detail is one (so a rule can
+// forward detection events to the queue). Messages are deleted once handled; failed
+// exports stay in the queue and are retried when their visibility timeout expires.
+func (e *Exporter) RunQueue(ctx context.Context) {
+	if e.sqs == nil {
+		return
+	}
+	log.Printf("[Clip] Receiving clip requests from %s", e.queueURL)
+	for ctx.Err() == nil {
+		messages, err := e.sqs.ReceiveMessage(ctx, e.queueURL, 10, queueWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			e.sqsErrors.Add(1)
+			log.Printf("[Clip] ⚠️  Failed to receive clip requests: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(queueRetryDelay):
+			}
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, m := range messages {
+			e.received.Add(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				e.handleMessage(ctx, m)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// handleMessage exports the clip requested by a message and deletes the message unless
+// the export failed.
+func (e *Exporter) handleMessage(ctx context.Context, m awsapi.SQSMessage) {
+	req, err := parseMessage(m)
+	if err != nil {
+		log.Printf("[Clip] ⚠️  Discarding invalid clip request %s: %v", m.MessageID, err)
+	} else {
+		exportCtx, cancel := context.WithTimeout(ctx, exportTimeout)
+		_, err = e.Export(exportCtx, req)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+	if err := e.sqs.DeleteMessage(ctx, e.queueURL, m.ReceiptHandle); err != nil {
+		e.sqsErrors.Add(1)
+		log.Printf("[Clip] ⚠️  Failed to delete clip request %s: %v", m.MessageID, err)
+	}
+}
+
+// parseMessage decodes the request of a message. The message ID is the request ID of
+// requests without one.
+func parseMessage(m awsapi.SQSMessage) (Request, error) {
+	var envelope struct {
+		DetailType string          `json:"detail-type"`
+		Detail     json.RawMessage `json:"detail"`
+	}
+	body := []byte(m.Body)
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return Request{}, err
+	}
+	if envelope.DetailType != "" && len(envelope.Detail) > 0 {
+		body = envelope.Detail
+	}
+
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		return Request{}, err
+	}
+	if req.RequestID == "" {
+		req.RequestID = m.MessageID
+	}
+	return req, nil
+}
@@ -0,0 +1,316 @@
+// Command kvsemu is a Kinesis Video Streams emulator for local development without an AWS
+// account. It serves the control plane calls of kvssink and the server (DescribeStream,
+// CreateStream, GetDataEndpoint, ...) and accepts PutMedia, validating the MKV structure
+// and the fragment timing and acknowledging every fragment like KVS does. Point the server
+// at it with KVS_EMULATOR_URL.
+//
+//	go run ./cmd/kvsemu -listen :4566 -dir recordings/kvsemu
+//	KVS_EMULATOR_URL=http://127.0.0.1:4566 STREAM_NAME=dev-stream ./rtmp-kvs
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Region and account in the ARNs of emulated streams
+const (
+	emulatedRegion  = "us-east-1"
+	emulatedAccount = "000000000000"
+)
+
+// stream is an emulated KVS stream and its ingest statistics.
+type stream struct {
+	Name                 string            `json:"name"`
+	ARN                  string            `json:"arn"`
+	Created              time.Time         `json:"created"`
+	DataRetentionInHours int               `json:"data_retention_hours"`
+	Version              int               `json:"version"`
+	Tags                 map[string]string `json:"tags,omitempty"`
+
+	Connections    uint64            `json:"connections"`      // PutMedia requests
+	Fragments      uint64            `json:"fragments"`        // persisted fragments
+	Bytes          uint64            `json:"bytes"`            // PutMedia bytes
+	Frames         uint64            `json:"frames"`           // simple blocks of persisted fragments
+	Errors         map[string]uint64 `json:"errors,omitempty"` // ERROR acknowledgements by code
+	LastFragment   *fragmentInfo     `json:"last_fragment,omitempty"`
+	LastError      string            `json:"last_error,omitempty"`
+	LastPutMediaAt time.Time         `json:"last_put_media_at,omitzero"`
+
+	fragmentCount uint64 // fragment numbers are unique in the stream
+}
+
+// emulator holds the emulated streams.
+type emulator struct {
+	publicURL  string // data endpoint returned by GetDataEndpoint, "" for the request host
+	autoCreate bool   // DescribeStream creates unknown streams
+	dir        string // PutMedia bodies are saved here if set
+
+	mutex   sync.Mutex
+	streams map[string]*stream
+}
+
+func main() {
+	listen := flag.String("listen", ":4566", "Listen address")
+	publicURL := flag.String("public-url", "", "Data endpoint URL returned by GetDataEndpoint (default: the URL the request was sent to)")
+	strict := flag.Bool("strict", false, "Answer DescribeStream of unknown streams with ResourceNotFoundException (kvssink then calls CreateStream)")
+	dir := flag.String("dir", "", "Save the MKV of every PutMedia request in this directory")
+	flag.Parse()
+
+	e := &emulator{
+		publicURL:  strings.TrimSuffix(*publicURL, "/"),
+		autoCreate: !*strict,
+		dir:        *dir,
+		streams:    make(map[string]*stream),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /describeStream", e.describeStream)
+	mux.HandleFunc("POST /createStream", e.createStream)
+	mux.HandleFunc("POST /getDataEndpoint", e.getDataEndpoint)
+	mux.HandleFunc("POST /updateDataRetention", e.updateDataRetention)
+	mux.HandleFunc("POST /tagStream", e.tagStream)
+	mux.HandleFunc("POST /listTagsForStream", e.listTagsForStream)
+	mux.HandleFunc("POST /putMedia", e.putMedia)
+	mux.HandleFunc("GET /streams", e.serveStreams)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := &http.Server{Addr: *listen, Handler: logRequests(mux)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("KVS emulator listening on %s (GET /streams for the ingest statistics)", *listen)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// logRequests logs the control plane requests; PutMedia logs itself.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/putMedia" && r.URL.Path != "/streams" && r.URL.Path != "/healthz" {
+			log.Printf("%s %s", r.Method, r.URL.Path)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamRequest is the stream a control plane request refers to.
+type streamRequest struct {
+	StreamName           string            `json:"StreamName"`
+	StreamARN            string            `json:"StreamARN"`
+	DataRetentionInHours int               `json:"DataRetentionInHours"`
+	Tags                 map[string]string `json:"Tags"`
+}
+
+// name returns the stream name of the request, from the ARN if only that is given.
+func (req *streamRequest) name() string {
+	if req.StreamName != "" {
+		return req.StreamName
+	}
+	// arn:aws:kinesisvideo:<region>:<account>:stream/<name>/<creation time>
+	if _, rest, ok := strings.Cut(req.StreamARN, ":stream/"); ok {
+		name, _, _ := strings.Cut(rest, "/")
+		return name
+	}
+	return ""
+}
+
+// decode reads the JSON body of a control plane request.
+func decode(w http.ResponseWriter, r *http.Request) (*streamRequest, bool) {
+	var req streamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.name() == "" {
+		writeError(w, http.StatusBadRequest, "InvalidArgumentException", "StreamName or StreamARN is required")
+		return nil, false
+	}
+	return &req, true
+}
+
+// writeError writes an error like the KVS REST JSON API.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("x-amzn-ErrorType", code)
+	writeJSON(w, status, map[string]string{"__type": code, "message": message})
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// lookup returns a stream, creating it if create is true. Must be called with the mutex
+// held.
+func (e *emulator) lookup(name string, create bool) *stream {
+	if s, ok := e.streams[name]; ok || !create {
+		return s
+	}
+	now := time.Now()
+	s := &stream{
+		Name:    name,
+		ARN:     fmt.Sprintf("arn:aws:kinesisvideo:%s:%s:stream/%s/%d", emulatedRegion, emulatedAccount, name, now.UnixMilli()),
+		Created: now,
+		Version: 1,
+		Errors:  make(map[string]uint64),
+	}
+	e.streams[name] = s
+	log.Printf("Stream %s created", name)
+	return s
+}
+
+// info returns the StreamInfo of a stream.
+func (s *stream) info() map[string]any {
+	return map[string]any{
+		"StreamName":           s.Name,
+		"StreamARN":            s.ARN,
+		"Status":               "ACTIVE",
+		"CreationTime":         float64(s.Created.UnixMilli()) / 1000,
+		"DataRetentionInHours": s.DataRetentionInHours,
+		"Version":              fmt.Sprint(s.Version),
+		"MediaType":            "video/h264",
+		"KmsKeyId":             fmt.Sprintf("arn:aws:kms:%s:%s:alias/aws/kinesisvideo", emulatedRegion, emulatedAccount),
+	}
+}
+
+func (e *emulator) describeStream(w http.ResponseWriter, r *http.Request) {
+	req, ok := decode(w, r)
+	if !ok {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	s := e.lookup(req.name(), e.autoCreate)
+	if s == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFoundException", "The requested stream is not found or not active.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"StreamInfo": s.info()})
+}
+
+func (e *emulator) createStream(w http.ResponseWriter, r *http.Request) {
+	req, ok := decode(w, r)
+	if !ok {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.lookup(req.name(), false) != nil {
+		writeError(w, http.StatusBadRequest, "ResourceInUseException", "The stream already exists.")
+		return
+	}
+	s := e.lookup(req.name(), true)
+	s.DataRetentionInHours = req.DataRetentionInHours
+	s.Tags = req.Tags
+	writeJSON(w, http.StatusOK, map[string]any{"StreamARN": s.ARN})
+}
+
+func (e *emulator) getDataEndpoint(w http.ResponseWriter, r *http.Request) {
+	req, ok := decode(w, r)
+	if !ok {
+		return
+	}
+	e.mutex.Lock()
+	s := e.lookup(req.name(), e.autoCreate)
+	e.mutex.Unlock()
+	if s == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFoundException", "The requested stream is not found or not active.")
+		return
+	}
+	endpoint := e.publicURL
+	if endpoint == "" {
+		endpoint = "http://" + r.Host
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"DataEndpoint": endpoint})
+}
+
+func (e *emulator) updateDataRetention(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		streamRequest
+		Operation                  string `json:"Operation"`
+		DataRetentionChangeInHours int    `json:"DataRetentionChangeInHours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgumentException", err.Error())
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	s := e.lookup(req.name(), false)
+	if s == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFoundException", "The requested stream is not found or not active.")
+		return
+	}
+	change := req.DataRetentionChangeInHours
+	if req.Operation == "DECREASE_DATA_RETENTION" {
+		change = -change
+	}
+	s.DataRetentionInHours = max(s.DataRetentionInHours+change, 0)
+	s.Version++
+	writeJSON(w, http.StatusOK, map[string]any{})
+}
+
+func (e *emulator) tagStream(w http.ResponseWriter, r *http.Request) {
+	req, ok := decode(w, r)
+	if !ok {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	s := e.lookup(req.name(), e.autoCreate)
+	if s == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFoundException", "The requested stream is not found or not active.")
+		return
+	}
+	if s.Tags == nil {
+		s.Tags = make(map[string]string)
+	}
+	for k, v := range req.Tags {
+		s.Tags[k] = v
+	}
+	writeJSON(w, http.StatusOK, map[string]any{})
+}
+
+func (e *emulator) listTagsForStream(w http.ResponseWriter, r *http.Request) {
+	req, ok := decode(w, r)
+	if !ok {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	s := e.lookup(req.name(), e.autoCreate)
+	if s == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFoundException", "The requested stream is not found or not active.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"Tags": s.Tags})
+}
+
+// serveStreams serves the emulated streams and their ingest statistics as JSON.
+func (e *emulator) serveStreams(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	streams := make([]*stream, 0, len(e.streams))
+	for _, s := range e.streams {
+		streams = append(streams, s)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Name < streams[j].Name })
+	writeJSON(w, http.StatusOK, streams)
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KVS PutMedia limits
+const (
+	maxFragmentBytes    = 50 << 20
+	maxFragmentDuration = 20 * time.Second
+	maxTracks           = 3
+	// Producer timestamps further in the future are rejected
+	maxClockSkew = time.Minute
+)
+
+// Matroska element IDs
+const (
+	idEBML          = 0x1A45DFA3
+	idDocType       = 0x4282
+	idSegment       = 0x18538067
+	idInfo          = 0x1549A966
+	idTimecodeScale = 0x2AD7B1
+	idTracks        = 0x1654AE6B
+	idTrackEntry    = 0xAE
+	idTrackNumber   = 0xD7
+	idCodecID       = 0x86
+	idCluster       = 0x1F43B675
+	idTimecode      = 0xE7
+	idSimpleBlock   = 0xA3
+	idBlockGroup    = 0xA0
+	idBlock         = 0xA1
+	idReference     = 0xFB
+)
+
+// unknownSize is the size of a master element streamed without a known length.
+const unknownSize = -1
+
+// ackError is a PutMedia error acknowledgement (KVS error IDs).
+type ackError struct {
+	id   int
+	code string
+	msg  string
+}
+
+func (e *ackError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.code, e.id, e.msg)
+}
+
+func errInvalidMKV(format string, args ...any) *ackError {
+	return &ackError{4006, "INVALID_MKV_DATA", fmt.Sprintf(format, args...)}
+}
+
+// fragmentInfo describes an acknowledged fragment.
+type fragmentInfo struct {
+	Timecode   int64     `json:"timecode"` // producer timestamp (ms)
+	Number     string    `json:"number"`
+	DurationMs int64     `json:"duration_ms"`
+	Frames     int       `json:"frames"`
+	Bytes      int64     `json:"bytes"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// track is a track of the MKV stream.
+type track struct {
+	number uint64
+	codec  string
+}
+
+// fragment is the cluster being received.
+type fragment struct {
+	timecode    int64 // cluster timecode, in timecode scale units
+	hasTimecode bool
+	frames      int
+	bytes       int64
+	first       time.Duration // of the first and last block, relative to the cluster
+	last        time.Duration
+	trackFrames map[uint64]int
+}
+
+// putMediaSession validates one PutMedia request body and writes its acknowledgements.
+type putMediaSession struct {
+	e      *emulator
+	stream *stream
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	r      *bufio.Reader
+
+	relative      bool  // fragment timecodes are relative to the producer start timestamp
+	startMs       int64 // producer start timestamp (ms)
+	timecodeScale int64 // ns
+	tracks        map[uint64]*track
+	cluster       *fragment
+	previous      int64  // producer timestamp of the previous fragment (ms), -1 if none
+	number        uint64 // of the current fragment in the stream
+}
+
+// putMedia accepts a PutMedia request: an MKV stream whose clusters are fragments.
+// BUFFERING, RECEIVED and PERSISTED are acknowledged for every valid fragment; the first
+// invalid one is acknowledged with ERROR and ends the request, like KVS does.
+func (e *emulator) putMedia(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get("x-amzn-stream-name")
+	if name == "" {
+		name = (&streamRequest{StreamARN: r.Header.Get("x-amzn-stream-arn")}).name()
+	}
+	e.mutex.Lock()
+	s := e.lookup(name, e.autoCreate)
+	if s != nil {
+		s.Connections++
+		s.LastPutMediaAt = time.Now()
+	}
+	e.mutex.Unlock()
+	if s == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFoundException", "The requested stream is not found or not active.")
+		return
+	}
+
+	ps := &putMediaSession{
+		e:             e,
+		stream:        s,
+		w:             w,
+		rc:            http.NewResponseController(w),
+		timecodeScale: int64(time.Millisecond),
+		tracks:        make(map[uint64]*track),
+		previous:      -1,
+	}
+	switch r.Header.Get("x-amzn-fragment-timecode-type") {
+	case "RELATIVE":
+		start, err := strconv.ParseFloat(r.Header.Get("x-amzn-producer-start-timestamp"), 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgumentException", "x-amzn-producer-start-timestamp is required for RELATIVE timecodes")
+			return
+		}
+		ps.relative, ps.startMs = true, int64(start*1000)
+	case "ABSOLUTE":
+	default:
+		writeError(w, http.StatusBadRequest, "InvalidArgumentException", "x-amzn-fragment-timecode-type must be ABSOLUTE or RELATIVE")
+		return
+	}
+
+	var body io.Reader = r.Body
+	if e.dir != "" {
+		file, err := e.createRecording(name)
+		if err != nil {
+			log.Printf("[%s] ⚠️  Failed to save PutMedia: %v", name, err)
+		} else {
+			defer file.Close()
+			body = io.TeeReader(r.Body, file)
+		}
+	}
+	ps.r = bufio.NewReaderSize(&countingReader{r: body, s: s, e: e}, 64<<10)
+
+	// Acknowledgements are streamed while the body is still being read
+	ps.rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	ps.rc.Flush()
+
+	log.Printf("[%s] PutMedia from %s", name, r.RemoteAddr)
+	err := ps.run()
+	var ackErr *ackError
+	switch {
+	case errors.As(err, &ackErr):
+		log.Printf("[%s] ❌ %v", name, ackErr)
+		ps.ack("ERROR", ps.errorTimecode(), map[string]any{"ErrorId": ackErr.id, "ErrorCode": ackErr.code})
+		e.mutex.Lock()
+		s.Errors[ackErr.code]++
+		s.LastError = ackErr.Error()
+		e.mutex.Unlock()
+	case err != nil:
+		log.Printf("[%s] PutMedia ended: %v", name, err)
+	default:
+		log.Printf("[%s] PutMedia ended", name)
+	}
+}
+
+// createRecording creates the file a PutMedia body is saved to.
+func (e *emulator) createRecording(name string) (*os.File, error) {
+	dir := filepath.Join(e.dir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(dir, time.Now().Format("20060102-150405.000")+".mkv"))
+}
+
+// countingReader counts the bytes of a PutMedia body in the stream statistics.
+type countingReader struct {
+	r io.Reader
+	s *stream
+	e *emulator
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.e.mutex.Lock()
+	c.s.Bytes += uint64(n)
+	c.e.mutex.Unlock()
+	return n, err
+}
+
+// run reads the MKV elements until the end of the body. Segment and cluster contents are
+// read as a flat sequence, since both are usually streamed with an unknown size.
+func (ps *putMediaSession) run() error {
+	for {
+		id, size, err := ps.readHeader()
+		if err == io.EOF {
+			return ps.finishCluster()
+		}
+		if err != nil {
+			return err
+		}
+		if size == unknownSize && id != idSegment && id != idCluster {
+			return errInvalidMKV("element 0x%X with unknown size", id)
+		}
+
+		switch id {
+		case idEBML:
+			// A new MKV stream (e.g. after a producer restart) may follow in the same request
+			if err := ps.finishCluster(); err != nil {
+				return err
+			}
+			body, err := ps.readBody(size)
+			if err != nil {
+				return err
+			}
+			if docType := childString(body, idDocType); docType != "" && docType != "matroska" && docType != "webm" {
+				return errInvalidMKV("DocType %q", docType)
+			}
+		case idSegment:
+			if err := ps.finishCluster(); err != nil {
+				return err
+			}
+			ps.tracks = make(map[uint64]*track)
+			ps.timecodeScale = int64(time.Millisecond)
+		case idInfo:
+			body, err := ps.readBody(size)
+			if err != nil {
+				return err
+			}
+			if scale, ok := childUint(body, idTimecodeScale); ok && scale > 0 {
+				ps.timecodeScale = int64(scale)
+			}
+		case idTracks:
+			body, err := ps.readBody(size)
+			if err != nil {
+				return err
+			}
+			if err := ps.parseTracks(body); err != nil {
+				return err
+			}
+		case idCluster:
+			if err := ps.finishCluster(); err != nil {
+				return err
+			}
+			if len(ps.tracks) == 0 {
+				return errInvalidMKV("cluster before the track entries")
+			}
+			ps.cluster = &fragment{trackFrames: make(map[uint64]int)}
+		case idTimecode:
+			body, err := ps.readBody(size)
+			if err != nil {
+				return err
+			}
+			if err := ps.clusterTimecode(readUint(body)); err != nil {
+				return err
+			}
+		case idSimpleBlock:
+			body, err := ps.readBody(size)
+			if err != nil {
+				return err
+			}
+			if err := ps.block(body, len(body) > 3 && body[blockHeaderSize(body)-1]&0x80 != 0); err != nil {
+				return err
+			}
+		case idBlockGroup:
+			body, err := ps.readBody(size)
+			if err != nil {
+				return err
+			}
+			block, ok := child(body, idBlock)
+			if !ok {
+				return errInvalidMKV("block group without a block")
+			}
+			_, referenced := child(body, idReference)
+			if err := ps.block(block, !referenced); err != nil {
+				return err
+			}
+		default:
+			// SeekHead, Tags (fragment metadata), Cues, Void, ...
+			if _, err := ps.r.Discard(int(size)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseTracks reads the track entries.
+func (ps *putMediaSession) parseTracks(body []byte) error {
+	ps.tracks = make(map[uint64]*track)
+	for _, entry := range children(body, idTrackEntry) {
+		number, ok := childUint(entry, idTrackNumber)
+		if !ok || number == 0 {
+			return errInvalidMKV("track entry without a track number")
+		}
+		ps.tracks[number] = &track{number: number, codec: childString(entry, idCodecID)}
+	}
+	if len(ps.tracks) == 0 {
+		return errInvalidMKV("no track entries")
+	}
+	if len(ps.tracks) > maxTracks {
+		return &ackError{4005, "MORE_THAN_ALLOWED_TRACKS_FOUND", fmt.Sprintf("%d tracks", len(ps.tracks))}
+	}
+	codecs := make([]string, 0, len(ps.tracks))
+	for _, t := range ps.tracks {
+		codecs = append(codecs, fmt.Sprintf("%d:%s", t.number, t.codec))
+	}
+	log.Printf("[%s] Tracks %s", ps.stream.Name, strings.Join(codecs, ", "))
+	return nil
+}
+
+// clusterTimecode sets the timecode of the current cluster and acknowledges BUFFERING.
+func (ps *putMediaSession) clusterTimecode(timecode uint64) error {
+	c := ps.cluster
+	if c == nil || c.hasTimecode || c.frames > 0 {
+		return errInvalidMKV("cluster timecode outside the start of a cluster")
+	}
+	c.timecode, c.hasTimecode = int64(timecode), true
+
+	producerMs := ps.producerMs(c.timecode, 0)
+	if ps.previous >= 0 && producerMs <= ps.previous {
+		return &ackError{4004, "FRAGMENT_TIMECODE_LESSER_THAN_PREVIOUS",
+			fmt.Sprintf("fragment timecode %d after %d", producerMs, ps.previous)}
+	}
+	if skew := time.Until(time.UnixMilli(producerMs)); skew > maxClockSkew {
+		return &ackError{4007, "INVALID_PRODUCER_TIMESTAMP",
+			fmt.Sprintf("fragment timecode %s is %s in the future", time.UnixMilli(producerMs).UTC().Format(time.RFC3339Nano), skew.Round(time.Second))}
+	}
+	ps.e.mutex.Lock()
+	ps.stream.fragmentCount++
+	ps.number = ps.stream.fragmentCount
+	ps.e.mutex.Unlock()
+	ps.ack("BUFFERING", producerMs, nil)
+	return nil
+}
+
+// block validates a (simple) block of the current cluster.
+func (ps *putMediaSession) block(body []byte, keyframe bool) error {
+	c := ps.cluster
+	if c == nil || !c.hasTimecode {
+		return errInvalidMKV("block outside a cluster with a timecode")
+	}
+	number, n := readVINT(body)
+	if n == 0 || len(body) < n+3 {
+		return errInvalidMKV("truncated block header")
+	}
+	if ps.tracks[number] == nil {
+		return &ackError{4010, "TRACK_NUMBER_MISMATCH", fmt.Sprintf("block of track %d, which has no track entry", number)}
+	}
+	relative := time.Duration(int16(binary.BigEndian.Uint16(body[n:]))) * time.Duration(ps.timecodeScale)
+	if c.frames == 0 {
+		if !keyframe && strings.HasPrefix(ps.tracks[number].codec, "V_") {
+			return errInvalidMKV("fragment does not start with a keyframe")
+		}
+		c.first = relative
+	}
+	c.last = max(c.last, relative)
+	c.frames++
+	c.trackFrames[number]++
+	c.bytes += int64(len(body))
+	if c.bytes > maxFragmentBytes {
+		return &ackError{4001, "MAX_FRAGMENT_SIZE_REACHED", fmt.Sprintf("fragment exceeds %d MB", maxFragmentBytes>>20)}
+	}
+	if c.last-c.first > maxFragmentDuration {
+		return &ackError{4002, "MAX_FRAGMENT_DURATION_REACHED", fmt.Sprintf("fragment exceeds %s", maxFragmentDuration)}
+	}
+	return nil
+}
+
+// finishCluster validates the complete current cluster and acknowledges RECEIVED and
+// PERSISTED.
+func (ps *putMediaSession) finishCluster() error {
+	c := ps.cluster
+	if c == nil {
+		return nil
+	}
+	ps.cluster = nil
+	if !c.hasTimecode {
+		return errInvalidMKV("cluster without a timecode")
+	}
+	producerMs := ps.producerMs(c.timecode, 0)
+	if c.frames == 0 {
+		return errInvalidMKV("empty fragment at %d", producerMs)
+	}
+	if len(ps.tracks) > 1 {
+		for number := range ps.tracks {
+			if c.trackFrames[number] == 0 {
+				return &ackError{4011, "FRAMES_MISSING_FOR_TRACK", fmt.Sprintf("fragment at %d has no frames of track %d", producerMs, number)}
+			}
+		}
+	}
+	ps.previous = producerMs
+	ps.ack("RECEIVED", producerMs, nil)
+	ps.ack("PERSISTED", producerMs, nil)
+
+	info := &fragmentInfo{
+		Timecode:   producerMs,
+		Number:     ps.fragmentNumber(),
+		DurationMs: (c.last - c.first).Milliseconds(),
+		Frames:     c.frames,
+		Bytes:      c.bytes,
+		ReceivedAt: time.Now(),
+	}
+	e := ps.e
+	e.mutex.Lock()
+	ps.stream.Fragments++
+	ps.stream.Frames += uint64(c.frames)
+	ps.stream.LastFragment = info
+	e.mutex.Unlock()
+	log.Printf("[%s] Fragment %s at %s: %d frames, %d ms, %d bytes", ps.stream.Name, info.Number,
+		time.UnixMilli(producerMs).UTC().Format("15:04:05.000"), info.Frames, info.DurationMs, info.Bytes)
+	return nil
+}
+
+// producerMs returns the producer timestamp (ms) of a cluster timecode plus offset.
+func (ps *putMediaSession) producerMs(timecode int64, offset time.Duration) int64 {
+	ms := (time.Duration(timecode*ps.timecodeScale) + offset).Milliseconds()
+	if ps.relative {
+		ms += ps.startMs
+	}
+	return ms
+}
+
+// errorTimecode returns the timecode an error is acknowledged with: the current fragment,
+// or the last one.
+func (ps *putMediaSession) errorTimecode() int64 {
+	if ps.cluster != nil && ps.cluster.hasTimecode {
+		return ps.producerMs(ps.cluster.timecode, 0)
+	}
+	return max(ps.previous, 0)
+}
+
+// fragmentNumber returns the number of the current fragment, a decimal string like the
+// fragment numbers of KVS.
+func (ps *putMediaSession) fragmentNumber() string {
+	return fmt.Sprintf("91343852333%013d%015d", ps.stream.Created.UnixMilli(), ps.number)
+}
+
+// ack writes an acknowledgement event.
+func (ps *putMediaSession) ack(eventType string, timecode int64, extra map[string]any) {
+	event := map[string]any{"EventType": eventType}
+	if eventType != "IDLE" {
+		event["FragmentTimecode"] = timecode
+		event["FragmentNumber"] = ps.fragmentNumber()
+	}
+	for k, v := range extra {
+		event[k] = v
+	}
+	data, _ := json.Marshal(event)
+	ps.w.Write(append(data, '\n'))
+	ps.rc.Flush()
+}
+
+// readHeader reads the ID and size of the next element. The size is unknownSize for
+// elements streamed without a length.
+func (ps *putMediaSession) readHeader() (uint32, int64, error) {
+	first, err := ps.r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := vintLength(first)
+	if length == 0 || length > 4 {
+		return 0, 0, errInvalidMKV("invalid element ID")
+	}
+	id := uint32(first)
+	for range length - 1 {
+		b, err := ps.r.ReadByte()
+		if err != nil {
+			return 0, 0, unexpected(err)
+		}
+		id = id<<8 | uint32(b)
+	}
+
+	first, err = ps.r.ReadByte()
+	if err != nil {
+		return 0, 0, unexpected(err)
+	}
+	length = vintLength(first)
+	if length == 0 {
+		return 0, 0, errInvalidMKV("invalid size of element 0x%X", id)
+	}
+	size := uint64(first & (0xFF >> length))
+	allOnes := size == uint64(0xFF>>length)
+	for range length - 1 {
+		b, err := ps.r.ReadByte()
+		if err != nil {
+			return 0, 0, unexpected(err)
+		}
+		size = size<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if allOnes {
+		return id, unknownSize, nil
+	}
+	if size > maxFragmentBytes {
+		return 0, 0, &ackError{4001, "MAX_FRAGMENT_SIZE_REACHED", fmt.Sprintf("element 0x%X of %d bytes", id, size)}
+	}
+	return id, int64(size), nil
+}
+
+// readBody reads the content of an element.
+func (ps *putMediaSession) readBody(size int64) ([]byte, error) {
+	body := make([]byte, size)
+	if _, err := io.ReadFull(ps.r, body); err != nil {
+		return nil, unexpected(err)
+	}
+	return body, nil
+}
+
+// unexpected turns the end of the body inside an element into a truncation error.
+func unexpected(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errInvalidMKV("truncated element")
+	}
+	return err
+}
+
+// vintLength returns the length of a variable-size integer from its first byte, 0 if
+// invalid.
+func vintLength(first byte) int {
+	for i := range 8 {
+		if first&(0x80>>i) != 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// readVINT reads a variable-size integer without its marker, returning its length (0 if
+// invalid).
+func readVINT(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	length := vintLength(data[0])
+	if length == 0 || len(data) < length {
+		return 0, 0
+	}
+	value := uint64(data[0] & (0xFF >> length))
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// blockHeaderSize returns the size of a block header (track number, timecode, flags).
+func blockHeaderSize(block []byte) int {
+	_, n := readVINT(block)
+	return n + 3
+}
+
+// readUint reads a big-endian unsigned integer element.
+func readUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// children returns the contents of the direct children with the given ID of a master
+// element body of known size.
+func children(body []byte, id uint32) [][]byte {
+	var found [][]byte
+	for len(body) > 0 {
+		length := vintLength(body[0])
+		if length == 0 || length > 4 || len(body) < length {
+			break
+		}
+		childID := uint32(readUint(body[:length]))
+		size, n := readVINT(body[length:])
+		if n == 0 || uint64(len(body)-length-n) < size {
+			break
+		}
+		content := body[length+n : length+n+int(size)]
+		if childID == id {
+			found = append(found, content)
+		}
+		body = body[length+n+int(size):]
+	}
+	return found
+}
+
+// child returns the content of the first direct child with the given ID.
+func child(body []byte, id uint32) ([]byte, bool) {
+	found := children(body, id)
+	if len(found) == 0 {
+		return nil, false
+	}
+	return found[0], true
+}
+
+// childUint returns the value of an unsigned integer child.
+func childUint(body []byte, id uint32) (uint64, bool) {
+	content, ok := child(body, id)
+	return readUint(content), ok
+}
+
+// childString returns the value of a string child, "" if absent.
+func childString(body []byte, id uint32) string {
+	content, _ := child(body, id)
+	return strings.TrimRight(string(content), "\x00")
+}
@@ -0,0 +1,385 @@
+// Command loadgen opens many simulated camera publishers against the RTMP/RTMPS server to
+// size the ingest tasks. Each publisher pushes a synthetic H.264 stream (or loops a
+// recorded FLV/MP4 file) in real time; handshake latency and error rates are reported.
+//
+//	go run ./cmd/loadgen -url 'rtmp://10.0.1.5:1935/live/load-%d' -n 50 -duration 5m
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/bluenviron/gortmplib/pkg/codecs"
+
+	"rtmp_kvs/replay"
+)
+
+// writeTimeout bounds a single frame write, so a stalled server shows up as an error
+// instead of a hung publisher.
+const writeTimeout = 10 * time.Second
+
+func main() {
+	rawURL := flag.String("url", "rtmp://127.0.0.1:1935/live/loadgen-%d", "Publish URL (rtmp:// or rtmps://); %d is replaced by the publisher index")
+	count := flag.Int("n", 10, "Number of concurrent publishers")
+	duration := flag.Duration("duration", time.Minute, "How long each publisher streams")
+	ramp := flag.Duration("ramp", 0, "Spread the publisher connections over this period")
+	fps := flag.Int("fps", 30, "Frame rate of the synthetic stream")
+	bitrate := flag.Int("bitrate", 2000, "Bitrate of the synthetic stream (kbit/s)")
+	gop := flag.Int("gop", 60, "Keyframe interval of the synthetic stream (frames)")
+	file := flag.String("file", "", "Loop this FLV/MP4 file instead of the synthetic stream")
+	insecure := flag.Bool("insecure", false, "Skip RTMPS certificate verification")
+	interval := flag.Duration("report", 10*time.Second, "Progress report interval")
+	flag.Parse()
+
+	if *count < 1 || *fps < 1 || *bitrate < 1 || *gop < 1 {
+		log.Fatal("-n, -fps, -bitrate and -gop must be positive")
+	}
+
+	var media *stream
+	var err error
+	if *file != "" {
+		media, err = loadStream(*file)
+		if err != nil {
+			log.Fatalf("Failed to load %s: %v", *file, err)
+		}
+		log.Printf("Looping %s: %d frames, %s, %.0f kbit/s", *file, len(media.frames), media.length, media.kbps())
+	} else {
+		media = syntheticStream(*fps, *bitrate, *gop)
+		log.Printf("Synthetic stream: %d fps, %d kbit/s, keyframe every %d frames", *fps, *bitrate, *gop)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration+*ramp)
+	defer cancel()
+
+	var tlsConfig *tls.Config
+	if *insecure {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	results := &results{errors: make(map[string]int)}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range *count {
+		delay := time.Duration(0)
+		if *count > 1 {
+			delay = *ramp * time.Duration(i) / time.Duration(*count-1)
+		}
+		target := *rawURL
+		if strings.Contains(target, "%d") {
+			target = fmt.Sprintf(target, i)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			p := &publisher{url: target, tlsConfig: tlsConfig, stream: media, results: results}
+			p.run(ctx, *duration)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Printf("Progress: %s", results.progress(time.Since(start)))
+		case <-done:
+			results.report(os.Stdout, *count, time.Since(start))
+			if results.failed() > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+	}
+}
+
+// frame is one access unit of the looped stream.
+type frame struct {
+	pts, dts time.Duration
+	au       [][]byte
+	size     int
+}
+
+// stream is the media pushed by every publisher, looped until the test ends.
+type stream struct {
+	sps, pps []byte
+	frames   []frame
+	length   time.Duration // duration of one loop
+}
+
+// kbps returns the average bitrate of one loop.
+func (s *stream) kbps() float64 {
+	bytes := 0
+	for _, f := range s.frames {
+		bytes += f.size
+	}
+	return float64(bytes*8) / s.length.Seconds() / 1000
+}
+
+// 1920x1080 Constrained Baseline parameter sets. The payload is not decodable; the server
+// does not decode video for forwarding, only the frame structure and sizes matter.
+var (
+	syntheticSPS = []byte{0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02, 0x27, 0xe5, 0x84, 0x00,
+		0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9, 0x20}
+	syntheticPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// syntheticStream builds one GOP at the requested rate. Keyframes are four times the size
+// of the other frames, roughly what a camera encoder produces for a static scene.
+func syntheticStream(fps, kbps, gop int) *stream {
+	gopBytes := kbps * 1000 / 8 * gop / fps
+	unit := max(gopBytes/(gop+3), 16)
+	interval := time.Second / time.Duration(fps)
+
+	s := &stream{sps: syntheticSPS, pps: syntheticPPS, length: interval * time.Duration(gop)}
+	for i := range gop {
+		var au [][]byte
+		if i == 0 {
+			au = [][]byte{syntheticSPS, syntheticPPS, append([]byte{0x65, 0x88}, make([]byte, 4*unit-2)...)}
+		} else {
+			au = [][]byte{append([]byte{0x41, 0x9a}, make([]byte, unit-2)...)}
+		}
+		ts := interval * time.Duration(i)
+		s.frames = append(s.frames, frame{pts: ts, dts: ts, au: au, size: auSize(au)})
+	}
+	return s
+}
+
+// loadStream reads a recorded file into memory. The parameter sets of the first keyframe
+// become the track configuration.
+func loadStream(path string) (*stream, error) {
+	src, err := replay.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	s := &stream{}
+	var first, last time.Duration
+	for {
+		f, err := src.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, nalu := range f.AU {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch nalu[0] & 0x1F {
+			case 7:
+				if s.sps == nil {
+					s.sps = nalu
+				}
+			case 8:
+				if s.pps == nil {
+					s.pps = nalu
+				}
+			}
+		}
+		if len(s.frames) == 0 {
+			first = f.DTS
+		}
+		last = f.DTS
+		s.frames = append(s.frames, frame{pts: f.PTS - first, dts: f.DTS - first, au: f.AU, size: auSize(f.AU)})
+	}
+	if s.sps == nil || s.pps == nil {
+		return nil, fmt.Errorf("no H.264 parameter sets found")
+	}
+	if len(s.frames) < 2 {
+		return nil, fmt.Errorf("file has fewer than two frames")
+	}
+	// One frame interval after the last frame, so consecutive loops keep increasing
+	s.length = last - first + (last-first)/time.Duration(len(s.frames)-1)
+	return s, nil
+}
+
+func auSize(au [][]byte) int {
+	size := 0
+	for _, nalu := range au {
+		size += len(nalu)
+	}
+	return size
+}
+
+// publisher is one simulated camera.
+type publisher struct {
+	url       string
+	tlsConfig *tls.Config
+	stream    *stream
+	results   *results
+}
+
+// run connects, publishes until the duration has elapsed or ctx ends, and records the
+// outcome.
+func (p *publisher) run(ctx context.Context, duration time.Duration) {
+	u, err := url.Parse(p.url)
+	if err != nil {
+		p.results.fail("url")
+		return
+	}
+
+	start := time.Now()
+	dialCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	client := &gortmplib.Client{URL: u, TLSConfig: p.tlsConfig, Publish: true}
+	err = client.Initialize(dialCtx)
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil {
+			p.results.fail("connect")
+		}
+		return
+	}
+	defer client.Close()
+	context.AfterFunc(ctx, client.Close)
+
+	track := &gortmplib.Track{Codec: &codecs.H264{SPS: p.stream.sps, PPS: p.stream.pps}}
+	w := &gortmplib.Writer{Conn: client, Tracks: []*gortmplib.Track{track}}
+	if err := w.Initialize(); err != nil {
+		if ctx.Err() == nil {
+			p.results.fail("publish")
+		}
+		return
+	}
+	p.results.connected(time.Since(start))
+
+	// Stream in real time from now on
+	streamStart := time.Now()
+	for loop := time.Duration(0); ; loop += p.stream.length {
+		for _, f := range p.stream.frames {
+			dts := loop + f.dts
+			if dts >= duration {
+				p.results.finished()
+				return
+			}
+			select {
+			case <-time.After(time.Until(streamStart.Add(dts))):
+			case <-ctx.Done():
+				p.results.finished()
+				return
+			}
+
+			client.NetConn().SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := w.WriteH264(track, loop+f.pts, dts, f.au); err != nil {
+				if ctx.Err() != nil {
+					p.results.finished()
+				} else {
+					p.results.fail("write")
+				}
+				return
+			}
+			p.results.sent(f.size)
+		}
+	}
+}
+
+// results aggregates the outcome of all publishers.
+type results struct {
+	mutex      sync.Mutex
+	handshakes []time.Duration
+	errors     map[string]int // by phase: connect, publish, write
+	completed  int
+
+	active atomic.Int64
+	frames atomic.Uint64
+	bytes  atomic.Uint64
+}
+
+func (r *results) connected(latency time.Duration) {
+	r.active.Add(1)
+	r.mutex.Lock()
+	r.handshakes = append(r.handshakes, latency)
+	r.mutex.Unlock()
+}
+
+func (r *results) finished() {
+	r.active.Add(-1)
+	r.mutex.Lock()
+	r.completed++
+	r.mutex.Unlock()
+}
+
+func (r *results) fail(phase string) {
+	if phase == "write" {
+		r.active.Add(-1)
+	}
+	r.mutex.Lock()
+	r.errors[phase]++
+	r.mutex.Unlock()
+}
+
+func (r *results) sent(size int) {
+	r.frames.Add(1)
+	r.bytes.Add(uint64(size))
+}
+
+func (r *results) failed() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := 0
+	for _, count := range r.errors {
+		n += count
+	}
+	return n
+}
+
+// progress summarizes the current state for the periodic log line.
+func (r *results) progress(elapsed time.Duration) string {
+	return fmt.Sprintf("%d publishers active, %d errors, %d frames, %.1f Mbit/s average",
+		r.active.Load(), r.failed(), r.frames.Load(), float64(r.bytes.Load()*8)/elapsed.Seconds()/1e6)
+}
+
+// report prints the final summary.
+func (r *results) report(w io.Writer, count int, elapsed time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sorted := append([]time.Duration(nil), r.handshakes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) time.Duration {
+		if len(sorted) == 0 {
+			return 0
+		}
+		return sorted[min(int(p*float64(len(sorted))), len(sorted)-1)].Round(time.Millisecond)
+	}
+
+	errors := 0
+	for _, n := range r.errors {
+		errors += n
+	}
+
+	fmt.Fprintf(w, "\nPublishers:   %d started, %d connected, %d completed\n", count, len(r.handshakes), r.completed)
+	fmt.Fprintf(w, "Errors:       %d (%.1f%%) connect=%d publish=%d write=%d\n", errors,
+		100*float64(errors)/float64(count), r.errors["connect"], r.errors["publish"], r.errors["write"])
+	fmt.Fprintf(w, "Handshake:    p50=%s p95=%s p99=%s max=%s\n", percentile(0.5), percentile(0.95), percentile(0.99), percentile(1))
+	fmt.Fprintf(w, "Sent:         %d frames, %.1f MB, %.1f Mbit/s over %s\n", r.frames.Load(),
+		float64(r.bytes.Load())/1e6, float64(r.bytes.Load()*8)/elapsed.Seconds()/1e6, elapsed.Round(time.Second))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"rtmp_kvs/clip"
+	"rtmp_kvs/control"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/logging"
+	"rtmp_kvs/server"
+	"rtmp_kvs/snapshot"
+)
+
+// registerCommands registers the commands the cloud can send over MQTT. streamName is the
+// default KVS stream of commands without one (STREAM_NAME).
+func registerCommands(c *control.Controller, srv *server.Server, pool *kvs.Pool, snapshots *snapshot.Handler, clips *clip.Exporter, streamName, region string) {
+	c.SetStatus(func() any {
+		return map[string]any{
+			"log_level":  logging.Level(),
+			"publishers": srv.Stats(),
+		}
+	})
+
+	// {"path": "/live/cam1", "mode": "buffer"}, all paths when empty
+	pause := func(paused bool) control.Handler {
+		return func(ctx context.Context, raw json.RawMessage) (any, error) {
+			var args struct {
+				Path string `json:"path"`
+				Mode string `json:"mode"`
+			}
+			if err := decodeArgs(raw, &args); err != nil {
+				return nil, err
+			}
+			n, err := srv.SetForwardingPaused(args.Path, paused, args.Mode)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{"path": args.Path, "paused": paused, "publishers": n}, nil
+		}
+	}
+	c.Handle("pause_forwarding", pause(true))
+	c.Handle("resume_forwarding", pause(false))
+
+	// {"stream": "cam1-stream", "hours": 168}
+	c.Handle("set_retention", func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var args struct {
+			Stream string `json:"stream"`
+			Hours  int    `json:"hours"`
+		}
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if args.Stream == "" {
+			args.Stream = streamName
+		}
+		if args.Stream == "" {
+			return nil, errors.New("stream is required")
+		}
+		previous, err := pool.Get(args.Stream, region).SetRetention(ctx, args.Hours)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"stream": args.Stream, "previous_hours": previous, "hours": args.Hours}, nil
+	})
+
+	// {"path": "/live/cam1", "format": "jpeg"}
+	c.Handle("snapshot", func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var args struct {
+			Path   string `json:"path"`
+			Format string `json:"format"`
+		}
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if args.Path == "" {
+			return nil, errors.New("path is required")
+		}
+		return snapshots.Upload(ctx, args.Path, args.Format)
+	})
+
+	// {"path": "/live/cam1", "seconds": 30, "time": "2024-05-01T10:00:00Z", "request_id": "..."}
+	c.Handle("export_clip", func(ctx context.Context, raw json.RawMessage) (any, error) {
+		if clips == nil {
+			return nil, errors.New("CLIP_BUCKET is not configured")
+		}
+		var req clip.Request
+		if err := decodeArgs(raw, &req); err != nil {
+			return nil, err
+		}
+		return clips.Export(ctx, req)
+	})
+
+	// {"key": "<new key>", "disconnect": true}: the publisher using the old key is
+	// disconnected unless disconnect is false, and must reconnect with the new one
+	c.Handle("rotate_stream_key", func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var args struct {
+			Key        string `json:"key"`
+			Disconnect *bool  `json:"disconnect"`
+		}
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if args.Key == "" {
+			return nil, errors.New("key is required")
+		}
+		old := srv.SetStreamKey(args.Key)
+		log.Printf("[MQTT] Stream key rotated")
+		disconnected := false
+		if old != "" && old != args.Key && (args.Disconnect == nil || *args.Disconnect) {
+			for _, path := range srv.StreamKeyPaths(old) {
+				disconnected = srv.Disconnect(path) || disconnected
+			}
+		}
+		return map[string]any{"disconnected": disconnected}, nil
+	})
+
+	// {"level": "debug"}
+	c.Handle("set_log_level", func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var args struct {
+			Level string `json:"level"`
+		}
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		previous := logging.Level()
+		if err := logging.SetLevel(args.Level); err != nil {
+			return nil, err
+		}
+		log.Printf("[MQTT] Log level changed from %s to %s", previous, logging.Level())
+		return map[string]any{"previous": previous, "level": logging.Level()}, nil
+	})
+}
+
+// decodeArgs decodes the arguments of a command; commands without arguments get the
+// zero value.
+func decodeArgs(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
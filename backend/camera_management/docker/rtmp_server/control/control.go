@@ -0,0 +1,408 @@
+// Package control receives commands from the cloud over MQTT (AWS IoT Core) and
+// publishes the status of the server.
+package control
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+)
+
+const (
+	// Keep alive of the MQTT connection; the broker is considered gone after 1.5 times it
+	keepAlive = 60 * time.Second
+	// Limit of running one command
+	commandTimeout = 30 * time.Second
+	// Reconnect backoff
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// Handler runs a command with its JSON arguments and returns its result, which is sent
+// back to the cloud as JSON.
+type Handler func(ctx context.Context, args json.RawMessage) (any, error)
+
+// Command is a command received on the command topic.
+//
+//	{"id": "42", "command": "pause_forwarding", "args": {"path": "/live/cam1"}}
+type Command struct {
+	ID      string          `json:"id,omitempty"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// Response is published on the response topic for every command.
+type Response struct {
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Result  any    `json:"result,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Time    string `json:"time"`
+}
+
+// Controller connects to AWS IoT Core (or another MQTT broker) as the device, runs the
+// commands received on <prefix>/commands, answers on <prefix>/responses and publishes
+// heartbeats on <prefix>/status. The cloud side can thus manage the ingest of an edge
+// device without redeploying it.
+type Controller struct {
+	endpoint  string // host:port
+	plain     bool   // plain TCP (local test brokers) instead of TLS
+	clientID  string
+	certFile  string
+	keyFile   string
+	caFile    string
+	heartbeat time.Duration
+
+	commandTopic  string
+	responseTopic string
+	statusTopic   string
+
+	handlers map[string]Handler
+	status   func() any
+	started  time.Time
+
+	mutex sync.Mutex
+	conn  *mqttConn // current connection, nil while disconnected
+
+	connected  atomic.Bool
+	reconnects atomic.Uint64
+	results    sync.Map // "command\x00result" -> *atomic.Uint64
+}
+
+// NewFromEnv configures the controller from MQTT_ENDPOINT (the IoT Core data endpoint,
+// host[:port], default port 8883; tcp://host:port for a plain broker), MQTT_CLIENT_ID
+// (default IOT_THING_NAME), MQTT_TOPIC_PREFIX (default "rtmp-kvs/<client ID>") and
+// MQTT_HEARTBEAT_INTERVAL (seconds, default 60). The device certificate is the one of
+// the IoT credentials provider (IOT_CERT_FILE, IOT_KEY_FILE, IOT_CA_FILE). It returns nil
+// unless MQTT_ENDPOINT is set.
+func NewFromEnv() *Controller {
+	endpoint := os.Getenv("MQTT_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+
+	c := &Controller{
+		endpoint:  endpoint,
+		clientID:  os.Getenv("MQTT_CLIENT_ID"),
+		certFile:  os.Getenv("IOT_CERT_FILE"),
+		keyFile:   os.Getenv("IOT_KEY_FILE"),
+		caFile:    os.Getenv("IOT_CA_FILE"),
+		heartbeat: time.Minute,
+		handlers:  make(map[string]Handler),
+		started:   time.Now(),
+	}
+	if rest, ok := strings.CutPrefix(endpoint, "tcp://"); ok {
+		c.endpoint, c.plain = rest, true
+	}
+	if _, _, err := net.SplitHostPort(c.endpoint); err != nil {
+		c.endpoint = net.JoinHostPort(c.endpoint, "8883")
+	}
+	if c.clientID == "" {
+		c.clientID = os.Getenv("IOT_THING_NAME")
+	}
+	prefix := strings.TrimSuffix(os.Getenv("MQTT_TOPIC_PREFIX"), "/")
+	if prefix == "" {
+		prefix = "rtmp-kvs/" + c.clientID
+	}
+	c.commandTopic = prefix + "/commands"
+	c.responseTopic = prefix + "/responses"
+	c.statusTopic = prefix + "/status"
+
+	if value := os.Getenv("MQTT_HEARTBEAT_INTERVAL"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			log.Printf("Warning: invalid MQTT_HEARTBEAT_INTERVAL %q, using %s", value, c.heartbeat)
+		} else {
+			c.heartbeat = time.Duration(seconds) * time.Second
+		}
+	}
+	c.Handle("status", func(ctx context.Context, args json.RawMessage) (any, error) {
+		return c.statusMessage("online"), nil
+	})
+	return c
+}
+
+// Check returns the configuration problems of the controller.
+func (c *Controller) Check() []string {
+	var problems []string
+	if c.clientID == "" {
+		problems = append(problems, "MQTT_ENDPOINT is set but neither MQTT_CLIENT_ID nor IOT_THING_NAME")
+	}
+	if !c.plain && (c.certFile == "" || c.keyFile == "") {
+		problems = append(problems, "MQTT_ENDPOINT is set but IOT_CERT_FILE or IOT_KEY_FILE is missing")
+	}
+	return problems
+}
+
+// Handle registers the handler of a command. It must be called before Run.
+func (c *Controller) Handle(command string, handler Handler) {
+	c.handlers[command] = handler
+}
+
+// SetStatus sets the function returning the status included in heartbeats. It must be
+// called before Run.
+func (c *Controller) SetStatus(status func() any) {
+	c.status = status
+}
+
+// Run keeps the controller connected, reconnecting with a backoff, until ctx is
+// cancelled.
+func (c *Controller) Run(ctx context.Context) {
+	log.Printf("[MQTT] Command channel %s on %s as %s", c.commandTopic, c.endpoint, c.clientID)
+	delay := minReconnectDelay
+	for {
+		start := time.Now()
+		err := c.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		log.Printf("[MQTT] ⚠️  Disconnected from %s: %v; reconnecting in %s", c.endpoint, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(2*delay, maxReconnectDelay)
+		c.reconnects.Add(1)
+	}
+}
+
+// session connects, subscribes and serves commands until the connection fails or ctx is
+// cancelled.
+func (c *Controller) session(ctx context.Context) error {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	offline, _ := json.Marshal(c.statusMessage("offline"))
+	conn, err := dialMQTT(ctx, c.endpoint, tlsConfig, c.clientID, keepAlive, &will{topic: c.statusTopic, payload: offline})
+	if err != nil {
+		return err
+	}
+	if err := conn.subscribe(c.commandTopic); err != nil {
+		conn.conn.Close()
+		return err
+	}
+	log.Printf("[MQTT] Connected to %s, waiting for commands on %s", c.endpoint, c.commandTopic)
+
+	c.mutex.Lock()
+	c.conn = conn
+	c.mutex.Unlock()
+	c.connected.Store(true)
+	defer func() {
+		c.connected.Store(false)
+		c.mutex.Lock()
+		c.conn = nil
+		c.mutex.Unlock()
+	}()
+
+	// Heartbeats and keep-alive pings; closing the connection ends the read loop
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.keepAlive(sessionCtx, ctx, conn)
+	}()
+
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		msg, err := conn.receive()
+		if err != nil {
+			conn.conn.Close()
+			cancel()
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.run(sessionCtx, msg.payload)
+		}()
+	}
+}
+
+// keepAlive publishes heartbeats and pings the broker until the session ends. When the
+// controller stops (runCtx is cancelled) it disconnects, which ends the read loop.
+func (c *Controller) keepAlive(ctx, runCtx context.Context, conn *mqttConn) {
+	c.publish(c.statusTopic, c.statusMessage("online"))
+	heartbeat := time.NewTicker(c.heartbeat)
+	defer heartbeat.Stop()
+	ping := time.NewTicker(keepAlive / 2)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-heartbeat.C:
+			c.publish(c.statusTopic, c.statusMessage("online"))
+		case <-ping.C:
+			if err := conn.ping(); err != nil {
+				conn.conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			if runCtx.Err() != nil {
+				// A clean shutdown publishes the offline status itself, the last will
+				// is only for connections lost
+				c.publish(c.statusTopic, c.statusMessage("offline"))
+				conn.disconnect()
+			}
+			return
+		}
+	}
+}
+
+// run runs a command and publishes its response.
+func (c *Controller) run(ctx context.Context, payload []byte) {
+	var cmd Command
+	resp := Response{}
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		resp.Error = fmt.Sprintf("invalid command: %v", err)
+	} else if handler, ok := c.handlers[cmd.Command]; !ok {
+		resp.Error = fmt.Sprintf("unknown command %q", cmd.Command)
+	} else {
+		log.Printf("[MQTT] Running command %s (id %q)", cmd.Command, cmd.ID)
+		runCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+		result, err := handler(runCtx, cmd.Args)
+		cancel()
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.OK, resp.Result = true, result
+		}
+	}
+	resp.ID, resp.Command = cmd.ID, cmd.Command
+	resp.Time = time.Now().UTC().Format(time.RFC3339)
+
+	result := "ok"
+	if !resp.OK {
+		result = "error"
+		log.Printf("[MQTT] ⚠️  Command %s (id %q) failed: %s", cmd.Command, cmd.ID, resp.Error)
+	}
+	c.count(cmd.Command, result)
+	events.Emit(events.Event{
+		Type: events.RemoteCommand,
+		Detail: map[string]any{
+			"id":      cmd.ID,
+			"command": cmd.Command,
+			"ok":      resp.OK,
+			"error":   resp.Error,
+		},
+	})
+	c.publish(c.responseTopic, resp)
+}
+
+// statusMessage returns a heartbeat of the given state.
+func (c *Controller) statusMessage(state string) map[string]any {
+	msg := map[string]any{
+		"client_id":      c.clientID,
+		"state":          state,
+		"time":           time.Now().UTC().Format(time.RFC3339),
+		"uptime_seconds": int(time.Since(c.started).Seconds()),
+	}
+	if state == "online" && c.status != nil {
+		msg["status"] = c.status()
+	}
+	return msg
+}
+
+// publish sends a JSON message on the current connection, if any.
+func (c *Controller) publish(topic string, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[MQTT] ⚠️  Failed to encode message for %s: %v", topic, err)
+		return
+	}
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+	if err := conn.publish(topic, payload); err != nil {
+		log.Printf("[MQTT] ⚠️  Failed to publish to %s: %v", topic, err)
+		conn.conn.Close()
+	}
+}
+
+// tlsConfig loads the device certificate; the files are re-read on every connection so
+// rotated certificates are picked up. It returns nil for a plain TCP broker.
+func (c *Controller) tlsConfig() (*tls.Config, error) {
+	if c.plain {
+		return nil, nil
+	}
+	host, _, _ := net.SplitHostPort(c.endpoint)
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if c.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load device certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + c.caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// count counts a command by its result.
+func (c *Controller) count(command, result string) {
+	if _, ok := c.handlers[command]; !ok {
+		command = "unknown" // bounded label values
+	}
+	key := command + "\x00" + result
+	counter, _ := c.results.LoadOrStore(key, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// CollectMetrics writes the controller metrics.
+func (c *Controller) CollectMetrics(w *metrics.Writer) {
+	connected := 0.0
+	if c.connected.Load() {
+		connected = 1
+	}
+	w.Gauge("rtmp_mqtt_connected", "Whether the MQTT command channel is connected", connected)
+	w.Counter("rtmp_mqtt_reconnects_total", "Reconnects of the MQTT command channel", float64(c.reconnects.Load()))
+
+	var keys []string
+	c.results.Range(func(key, _ any) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, key := range keys {
+		counter, _ := c.results.Load(key)
+		command, result, _ := strings.Cut(key, "\x00")
+		w.Counter("rtmp_mqtt_commands_total", "Commands received over MQTT by command and result",
+			float64(counter.(*atomic.Uint64).Load()), "command", command, "result", result)
+	}
+}
@@ -0,0 +1,280 @@
+// Package control receives commands from the cloud over MQTT (AWS IoT Core) and
+// publishes the status of the server.
+package control
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types (high nibble of the fixed header)
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetSubscribe  = 8
+	packetSuback     = 9
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+const (
+	// Largest packet accepted from the broker (IoT Core limits payloads to 128 KiB)
+	maxPacketSize = 256 << 10
+	// A write stalled for this long fails the connection
+	writeTimeout = 10 * time.Second
+)
+
+// message is an application message received on a subscription.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// will is the message the broker publishes when the client disconnects unexpectedly.
+type will struct {
+	topic   string
+	payload []byte
+}
+
+// mqttConn is a minimal MQTT 3.1.1 client connection: clean sessions, QoS 0 publishing
+// and QoS 1 subscriptions, which is what the command channel needs from AWS IoT Core.
+type mqttConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	mutex sync.Mutex // serializes packet writes
+	id    uint16     // last packet identifier
+}
+
+// dialMQTT connects and sends CONNECT. tlsConfig is nil for a plain TCP broker.
+func dialMQTT(ctx context.Context, addr string, tlsConfig *tls.Config, clientID string, keepAlive time.Duration, lastWill *will) (*mqttConn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+
+	// CONNECT: protocol name and level, flags, keep alive, client ID and last will
+	flags := byte(0x02) // clean session
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4, 0) // level 4 (3.1.1), flags set below
+	body = binary.BigEndian.AppendUint16(body, uint16(keepAlive/time.Second))
+	body = appendString(body, clientID)
+	if lastWill != nil {
+		flags |= 0x04 // will, QoS 0, not retained
+		body = appendString(body, lastWill.topic)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(lastWill.payload)))
+		body = append(body, lastWill.payload...)
+	}
+	body[7] = flags
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := c.write(packetConnect<<4, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	kind, payload, err := c.read()
+	if err == nil && (kind != packetConnack || len(payload) != 2) {
+		err = fmt.Errorf("unexpected packet %d instead of CONNACK", kind)
+	}
+	if err == nil && payload[1] != 0 {
+		err = fmt.Errorf("connection refused (%s)", connackReason(payload[1]))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return c, nil
+}
+
+// connackReason describes a CONNACK return code.
+func connackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("return code %d", code)
+	}
+}
+
+// subscribe sends SUBSCRIBE for a topic filter at QoS 1. The SUBACK is checked by the
+// read loop (see receive).
+func (c *mqttConn) subscribe(topic string) error {
+	c.mutex.Lock()
+	c.id++
+	id := c.id
+	c.mutex.Unlock()
+
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = appendString(body, topic)
+	body = append(body, 1)
+	return c.write(packetSubscribe<<4|0x02, body)
+}
+
+// publish sends a QoS 0 message.
+func (c *mqttConn) publish(topic string, payload []byte) error {
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+	return c.write(packetPublish<<4, body)
+}
+
+// ping sends PINGREQ.
+func (c *mqttConn) ping() error {
+	return c.write(packetPingreq<<4, nil)
+}
+
+// disconnect sends DISCONNECT, so the broker does not publish the last will, and closes
+// the connection.
+func (c *mqttConn) disconnect() {
+	c.write(packetDisconnect<<4, nil)
+	c.conn.Close()
+}
+
+// receive reads packets until an application message arrives, acknowledging QoS 1
+// messages. A refused subscription is an error.
+func (c *mqttConn) receive() (*message, error) {
+	for {
+		header, payload, err := c.readRaw()
+		if err != nil {
+			return nil, err
+		}
+		switch header >> 4 {
+		case packetPublish:
+			return c.parsePublish(header, payload)
+		case packetSuback:
+			if len(payload) < 3 || payload[2] == 0x80 {
+				return nil, errors.New("subscription refused by the broker")
+			}
+		case packetPingresp, packetPuback:
+		default:
+			return nil, fmt.Errorf("unexpected packet %d", header>>4)
+		}
+	}
+}
+
+// parsePublish decodes a PUBLISH packet and acknowledges it if it is QoS 1.
+func (c *mqttConn) parsePublish(header byte, payload []byte) (*message, error) {
+	topic, rest, err := readString(payload)
+	if err != nil {
+		return nil, err
+	}
+	if qos := (header >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return nil, errors.New("malformed PUBLISH packet")
+		}
+		id := rest[:2]
+		rest = rest[2:]
+		if qos == 1 {
+			if err := c.write(packetPuback<<4, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &message{topic: topic, payload: rest}, nil
+}
+
+// read reads a packet and returns its type and body.
+func (c *mqttConn) read() (byte, []byte, error) {
+	header, body, err := c.readRaw()
+	return header >> 4, body, err
+}
+
+// readRaw reads a packet and returns its first header byte and body.
+func (c *mqttConn) readRaw() (byte, []byte, error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	if length > maxPacketSize {
+		return 0, nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// write sends a packet with the given first header byte and body.
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := make([]byte, 0, len(body)+5)
+	packet = append(packet, header)
+	for n := len(body); ; {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// appendString appends a length-prefixed UTF-8 string.
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readString reads a length-prefixed string and returns the rest.
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("malformed string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("malformed string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
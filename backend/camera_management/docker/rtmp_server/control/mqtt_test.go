@@ -0,0 +1,269 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordConn is a connection that records the packets written to it.
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *recordConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// connFrom returns a connection reading data and recording its writes.
+func connFrom(data []byte) (*mqttConn, *recordConn) {
+	rc := &recordConn{}
+	return &mqttConn{conn: rc, r: bufio.NewReader(bytes.NewReader(data))}, rc
+}
+
+func TestWriteReadRaw(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       byte
+		size         int
+		lengthLength int // bytes of the remaining length
+	}{
+		{"empty", packetPingreq << 4, 0, 1},
+		{"one byte length", packetPublish << 4, 127, 1},
+		{"two byte length", packetPublish<<4 | 0x02, 128, 2},
+		{"largest two byte length", packetPublish << 4, 16383, 2},
+		{"three byte length", packetPublish << 4, 16384, 3},
+		{"largest packet", packetPublish << 4, maxPacketSize, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := make([]byte, tt.size)
+			for i := range body {
+				body[i] = byte(i)
+			}
+			w, rc := connFrom(nil)
+			if err := w.write(tt.header, body); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rc.written.Len(), 1+tt.lengthLength+tt.size; got != want {
+				t.Errorf("wrote %d bytes, want %d", got, want)
+			}
+
+			r, _ := connFrom(rc.written.Bytes())
+			header, got, err := r.readRaw()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header != tt.header || !bytes.Equal(got, body) {
+				t.Errorf("read header %#x and %d bytes, want %#x and %d", header, len(got), tt.header, len(body))
+			}
+		})
+	}
+}
+
+func TestReadRawMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"too large", []byte{0x30, 0x81, 0x80, 0x10}, "too large"},
+		{"largest remaining length", []byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}, "too large"},
+		{"five byte remaining length", []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, "malformed remaining length"},
+		{"truncated remaining length", []byte{0x30, 0x80}, "EOF"},
+		{"truncated body", []byte{0x30, 0x05, 0x00, 0x01}, "unexpected EOF"},
+		{"no packet", nil, "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := connFrom(tt.data)
+			_, _, err := c.readRaw()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("readRaw: err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// packet encodes an MQTT packet.
+func packet(header byte, body ...[]byte) []byte {
+	c, rc := connFrom(nil)
+	c.write(header, bytes.Join(body, nil))
+	return rc.written.Bytes()
+}
+
+func TestReceive(t *testing.T) {
+	topic := appendString(nil, "cmd/cam1")
+	tests := []struct {
+		name        string
+		packets     [][]byte
+		wantPayload string
+		wantPuback  []byte
+		wantErr     string
+	}{
+		{
+			name:        "QoS 0",
+			packets:     [][]byte{packet(packetPublish<<4, topic, []byte("start"))},
+			wantPayload: "start",
+		},
+		{
+			name:        "QoS 1 is acknowledged",
+			packets:     [][]byte{packet(packetPublish<<4|0x02, topic, []byte{0x12, 0x34}, []byte("stop"))},
+			wantPayload: "stop",
+			wantPuback:  []byte{packetPuback << 4, 2, 0x12, 0x34},
+		},
+		{
+			name:        "empty payload",
+			packets:     [][]byte{packet(packetPublish<<4, topic)},
+			wantPayload: "",
+		},
+		{
+			name: "acknowledgements are skipped",
+			packets: [][]byte{
+				packet(packetSuback<<4, []byte{0, 1, 1}),
+				packet(packetPingresp << 4),
+				packet(packetPuback<<4, []byte{0, 1}),
+				packet(packetPublish<<4, topic, []byte("start")),
+			},
+			wantPayload: "start",
+		},
+		{
+			name:    "QoS 1 without packet identifier",
+			packets: [][]byte{packet(packetPublish<<4|0x02, topic, []byte{0x12})},
+			wantErr: "malformed PUBLISH",
+		},
+		{
+			name:    "topic longer than the packet",
+			packets: [][]byte{packet(packetPublish<<4, []byte{0, 20}, []byte("cmd"))},
+			wantErr: "malformed string",
+		},
+		{
+			name:    "no topic",
+			packets: [][]byte{packet(packetPublish<<4, []byte{0})},
+			wantErr: "malformed string",
+		},
+		{
+			name:    "subscription refused",
+			packets: [][]byte{packet(packetSuback<<4, []byte{0, 1, 0x80})},
+			wantErr: "subscription refused",
+		},
+		{
+			name:    "SUBACK without return code",
+			packets: [][]byte{packet(packetSuback<<4, []byte{0, 1})},
+			wantErr: "subscription refused",
+		},
+		{
+			name:    "unexpected packet",
+			packets: [][]byte{packet(packetConnack<<4, []byte{0, 0})},
+			wantErr: "unexpected packet 2",
+		},
+		{
+			name:    "connection closed",
+			wantErr: "EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rc := connFrom(bytes.Join(tt.packets, nil))
+			msg, err := c.receive()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("receive: err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.topic != "cmd/cam1" || string(msg.payload) != tt.wantPayload {
+				t.Errorf("message %q %q, want cmd/cam1 %q", msg.topic, msg.payload, tt.wantPayload)
+			}
+			if !bytes.Equal(rc.written.Bytes(), tt.wantPuback) {
+				t.Errorf("wrote % x, want % x", rc.written.Bytes(), tt.wantPuback)
+			}
+		})
+	}
+}
+
+func TestDialMQTT(t *testing.T) {
+	tests := []struct {
+		name       string
+		will       *will
+		returnCode byte
+		wantFlags  byte
+		wantErr    string
+	}{
+		{name: "clean session", wantFlags: 0x02},
+		{
+			name:      "last will",
+			will:      &will{topic: "status/cam1", payload: []byte(`{"online":false}`)},
+			wantFlags: 0x06,
+		},
+		{name: "refused", returnCode: 5, wantFlags: 0x02, wantErr: "not authorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			connect := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				broker := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+				header, body, err := broker.readRaw()
+				if err != nil || header != packetConnect<<4 {
+					close(connect)
+					return
+				}
+				connect <- body
+				broker.write(packetConnack<<4, []byte{0, tt.returnCode})
+				io.Copy(io.Discard, conn)
+			}()
+
+			c, err := dialMQTT(context.Background(), ln.Addr().String(), nil, "rtmp-server-1", 30*time.Second, tt.will)
+			if c != nil {
+				defer c.disconnect()
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("dialMQTT: err = %v, want %q", err, tt.wantErr)
+			}
+
+			body, ok := <-connect
+			if !ok {
+				t.Fatal("broker did not receive CONNECT")
+			}
+			want := appendString(nil, "MQTT")
+			want = append(want, 4, tt.wantFlags)
+			want = binary.BigEndian.AppendUint16(want, 30)
+			want = appendString(want, "rtmp-server-1")
+			if tt.will != nil {
+				want = appendString(want, tt.will.topic)
+				want = appendString(want, string(tt.will.payload))
+			}
+			if !bytes.Equal(body, want) {
+				t.Errorf("CONNECT body\n% x\nwant\n% x", body, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Package crashreport publishes the panics the server recovers from as CloudWatch metrics,
+// so that recurring panics (e.g. a gortmplib bug triggered by one camera model) show up on
+// dashboards and can be alarmed on.
+package crashreport
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+)
+
+// Name of the published metric
+const metricName = "RecoveredPanics"
+
+const requestTimeout = 10 * time.Second
+
+// Reporter publishes a RecoveredPanics datum per PanicRecovered event, once per dimension:
+// Where (read, publisher, connection), Signature (panic site) and CameraID when known.
+type Reporter struct {
+	namespace string
+	client    *awsapi.CloudWatch
+
+	sent   atomic.Uint64
+	failed atomic.Uint64
+}
+
+// NewFromEnv creates a reporter publishing to the CloudWatch namespace
+// PANIC_METRICS_NAMESPACE and subscribes it to the event bus. It returns nil if
+// PANIC_METRICS_NAMESPACE is not set.
+func NewFromEnv(region string) *Reporter {
+	namespace := os.Getenv("PANIC_METRICS_NAMESPACE")
+	if namespace == "" {
+		return nil
+	}
+	r := &Reporter{namespace: namespace, client: awsapi.NewCloudWatch(region)}
+	events.Subscribe(r)
+	log.Printf("[CrashReport] Publishing recovered panics to CloudWatch namespace %s", namespace)
+	return r
+}
+
+// Handle implements events.Subscriber.
+func (r *Reporter) Handle(e events.Event) {
+	if e.Type != events.PanicRecovered {
+		return
+	}
+	where, _ := e.Detail["where"].(string)
+	signature, _ := e.Detail["signature"].(string)
+
+	datum := func(name, value string) awsapi.MetricDatum {
+		return awsapi.MetricDatum{
+			MetricName: metricName,
+			Dimensions: map[string]string{name: value},
+			Value:      1,
+			Unit:       "Count",
+			Timestamp:  e.Time,
+		}
+	}
+	data := []awsapi.MetricDatum{datum("Where", where), datum("Signature", signature)}
+	if e.CameraID != "" {
+		data = append(data, datum("CameraID", e.CameraID))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := r.client.PutMetricData(ctx, r.namespace, data); err != nil {
+		r.failed.Add(1)
+		log.Printf("[CrashReport] ⚠️  Failed to publish panic metrics: %v", err)
+		return
+	}
+	r.sent.Add(1)
+}
+
+// CollectMetrics writes the number of panics published.
+func (r *Reporter) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_panic_reports_total", "Recovered panics published to CloudWatch", float64(r.sent.Load()))
+	w.Counter("rtmp_panic_report_errors_total", "Recovered panics that failed to be published to CloudWatch", float64(r.failed.Load()))
+}
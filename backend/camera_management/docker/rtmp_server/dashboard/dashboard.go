@@ -0,0 +1,146 @@
+// Package dashboard serves the embedded web UI for live ingest status.
+package dashboard
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/events"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/server"
+	"rtmp_kvs/snapshot"
+)
+
+//go:embed static
+var static embed.FS
+
+// maxRecentEvents is the number of events kept for the "recent events" panel.
+const maxRecentEvents = 50
+
+// thumbnailMaxAge is how long a decoded thumbnail is reused before decoding a newer keyframe.
+const thumbnailMaxAge = 10 * time.Second
+
+// Dashboard serves the status page and its JSON API.
+type Dashboard struct {
+	server *server.Server
+	pool   *kvs.Pool
+
+	mutex      sync.Mutex
+	recent     []events.Event
+	thumbnails map[string]thumbnail
+}
+
+// thumbnail is a decoded keyframe image.
+type thumbnail struct {
+	image     []byte
+	keyframe  time.Time // receive time of the decoded keyframe
+	decodedAt time.Time
+}
+
+// New creates a dashboard and subscribes it to server events.
+func New(srv *server.Server, pool *kvs.Pool) *Dashboard {
+	d := &Dashboard{
+		server:     srv,
+		pool:       pool,
+		thumbnails: make(map[string]thumbnail),
+	}
+	events.Subscribe(events.SubscriberFunc(d.record))
+	return d
+}
+
+// Register registers the dashboard on the admin server under /dashboard/.
+func (d *Dashboard) Register(srv *admin.Server) {
+	content, _ := fs.Sub(static, "static")
+	srv.HandlePublic("GET /dashboard/", http.StripPrefix("/dashboard/", http.FileServerFS(content)))
+	srv.HandleFunc("GET /dashboard/api/status", d.serveStatus)
+	srv.HandleFunc("GET /dashboard/api/thumbnail", d.serveThumbnail)
+}
+
+// record keeps the most recent events.
+func (d *Dashboard) record(e events.Event) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.recent = append(d.recent, e)
+	if len(d.recent) > maxRecentEvents {
+		d.recent = d.recent[len(d.recent)-maxRecentEvents:]
+	}
+}
+
+// status is the payload of /dashboard/api/status.
+type status struct {
+	Time       time.Time            `json:"time"`
+	Streams    []server.StreamStats `json:"streams"`
+	Forwarders []kvs.Status         `json:"forwarders"`
+	Events     []events.Event       `json:"events"`
+}
+
+func (d *Dashboard) serveStatus(w http.ResponseWriter, r *http.Request) {
+	st := status{
+		Time:    time.Now().UTC(),
+		Streams: d.server.Stats(),
+	}
+	for _, f := range d.pool.Forwarders() {
+		st.Forwarders = append(st.Forwarders, f.Status())
+	}
+
+	d.mutex.Lock()
+	// Drop thumbnails of streams that are no longer live
+	for path := range d.thumbnails {
+		live := false
+		for _, s := range st.Streams {
+			live = live || s.StreamPath == path
+		}
+		if !live {
+			delete(d.thumbnails, path)
+		}
+	}
+	// Newest first
+	for i := len(d.recent) - 1; i >= 0; i-- {
+		st.Events = append(st.Events, d.recent[i])
+	}
+	d.mutex.Unlock()
+
+	admin.WriteJSON(w, http.StatusOK, st)
+}
+
+// serveThumbnail returns the last keyframe of a stream as JPEG. Decoded images are
+// cached so that several open dashboards do not spawn a decoder per refresh.
+func (d *Dashboard) serveThumbnail(w http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("path")
+
+	au, received, err := d.server.LastKeyframe(streamPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	d.mutex.Lock()
+	cached, ok := d.thumbnails[streamPath]
+	d.mutex.Unlock()
+
+	if !ok || (cached.keyframe.Before(received) && time.Since(cached.decodedAt) > thumbnailMaxAge) {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		image, err := snapshot.Decode(ctx, au, "jpeg")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cached = thumbnail{image: image, keyframe: received, decodedAt: time.Now()}
+
+		d.mutex.Lock()
+		d.thumbnails[streamPath] = cached
+		d.mutex.Unlock()
+	}
+
+	w.Header().Set("Content-Type", snapshot.ContentType("jpeg"))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(cached.image)
+}
@@ -0,0 +1,168 @@
+// Package events distributes server lifecycle events to subscribers (EventBridge, ...).
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/metrics"
+)
+
+// detailTypes maps event types to EventBridge detail-type values.
+var detailTypes = map[string]string{
+	StreamStarted:     "RTMP Stream Started",
+	StreamStopped:     "RTMP Stream Stopped",
+	PipelineRestarted: "KVS Pipeline Restarted",
+	AuthRejected:      "RTMP Auth Rejected",
+	FragmentAckError:  "KVS Fragment Error",
+	IngestCheckpoint:  "KVS Ingest Checkpoint",
+	StreamIdle:        "RTMP Stream Idle",
+	PipelineError:     "KVS Pipeline Error",
+
+	PublisherConnected: "RTMP Publisher Connected",
+	TrackDetected:      "RTMP Track Detected",
+	TrackRejected:      "RTMP Track Rejected",
+	FramesDropped:      "RTMP Frames Dropped",
+	PublisherReplaced:  "RTMP Publisher Replaced",
+	SEIReceived:        "RTMP SEI Received",
+
+	FrameQueueHighWatermark: "RTMP Frame Queue High Watermark",
+
+	ForwardingPaused:  "KVS Forwarding Paused",
+	ForwardingResumed: "KVS Forwarding Resumed",
+
+	TimestampDiscontinuity: "RTMP Timestamp Discontinuity",
+
+	BitrateExceeded: "RTMP Bitrate Exceeded",
+
+	RemoteCommand: "RTMP Remote Command",
+
+	PanicRecovered: "RTMP Panic Recovered",
+
+	AddressQuarantined: "RTMP Address Quarantined",
+
+	ClipExported:     "RTMP Clip Exported",
+	ClipExportFailed: "RTMP Clip Export Failed",
+
+	ShardOpened: "KVS Shard Window Opened",
+	ShardClosed: "KVS Shard Window Closed",
+
+	FragmentDurationChanged: "KVS Fragment Duration Changed",
+
+	StreamDegraded:  "KVS Stream Degraded",
+	StreamRecovered: "KVS Stream Recovered",
+
+	SnapshotPublished: "RTMP Snapshot Published",
+
+	JitterHigh: "RTMP Jitter High",
+
+	AVSyncDrift: "RTMP AV Sync Drift",
+}
+
+// EventBridgePublisher forwards events to an EventBridge bus in batches of up to 10.
+type EventBridgePublisher struct {
+	busName string
+	source  string
+	client  *awsapi.EventBridge
+	queue   chan Event
+
+	dropped atomic.Uint64 // events not queued while PutEvents was slow
+	failed  atomic.Uint64 // events of failed PutEvents calls
+}
+
+// NewEventBridgePublisherFromEnv creates a publisher from EVENT_BUS_NAME and EVENT_SOURCE
+// (default "rtmp-kvs") and subscribes it. It returns nil if EVENT_BUS_NAME is not set.
+func NewEventBridgePublisherFromEnv(region string) *EventBridgePublisher {
+	busName := os.Getenv("EVENT_BUS_NAME")
+	if busName == "" {
+		return nil
+	}
+	source := os.Getenv("EVENT_SOURCE")
+	if source == "" {
+		source = "rtmp-kvs"
+	}
+
+	p := &EventBridgePublisher{
+		busName: busName,
+		source:  source,
+		client:  awsapi.NewEventBridge(region),
+		queue:   make(chan Event, 100),
+	}
+	go p.run()
+	Subscribe(p)
+
+	log.Printf("[Events] Publishing lifecycle events to EventBridge bus %s (source: %s)", busName, source)
+	return p
+}
+
+// Handle implements Subscriber. While EventBridge is throttling or unreachable and the
+// queue is full, the event is dropped rather than stalling the delivery of later events.
+func (p *EventBridgePublisher) Handle(e Event) {
+	select {
+	case p.queue <- e:
+	default:
+		if n := p.dropped.Add(1); n == 1 || n%100 == 0 {
+			log.Printf("[Events] ⚠️  EventBridge queue full, %d events dropped", n)
+		}
+	}
+}
+
+// CollectMetrics writes the number of events dropped and not delivered.
+func (p *EventBridgePublisher) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_eventbridge_events_dropped_total", "Events dropped because the EventBridge queue was full",
+		float64(p.dropped.Load()))
+	w.Counter("rtmp_eventbridge_events_failed_total", "Events of PutEvents calls that failed",
+		float64(p.failed.Load()))
+}
+
+// run batches queued events and sends them at most once per second.
+func (p *EventBridgePublisher) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []awsapi.EventBridgeEntry
+	for {
+		select {
+		case e := <-p.queue:
+			batch = append(batch, p.entry(e))
+			if len(batch) == 10 {
+				p.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				p.send(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+func (p *EventBridgePublisher) entry(e Event) awsapi.EventBridgeEntry {
+	detail, _ := json.Marshal(e)
+	detailType, ok := detailTypes[e.Type]
+	if !ok {
+		detailType = e.Type
+	}
+	return awsapi.EventBridgeEntry{
+		EventBusName: p.busName,
+		Source:       p.source,
+		DetailType:   detailType,
+		Detail:       string(detail),
+	}
+}
+
+func (p *EventBridgePublisher) send(batch []awsapi.EventBridgeEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := p.client.PutEvents(ctx, batch); err != nil {
+		p.failed.Add(uint64(len(batch)))
+		log.Printf("[Events] ⚠️  Failed to publish %d events to EventBridge: %v", len(batch), err)
+	}
+}
@@ -0,0 +1,132 @@
+// Package events distributes server lifecycle events to subscribers (EventBridge, ...).
+package events
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types
+const (
+	StreamStarted     = "StreamStarted"
+	StreamStopped     = "StreamStopped"
+	PipelineRestarted = "PipelineRestarted"
+	AuthRejected      = "AuthRejected"
+	FragmentAckError  = "FragmentAckError"
+	IngestCheckpoint  = "IngestCheckpoint"
+	StreamIdle        = "StreamIdle"
+	PipelineError     = "PipelineError"
+
+	PublisherConnected = "PublisherConnected"
+	TrackDetected      = "TrackDetected"
+	TrackRejected      = "TrackRejected"
+	FramesDropped      = "FramesDropped"
+	PublisherReplaced  = "PublisherReplaced"
+	SEIReceived        = "SEIReceived"
+
+	FrameQueueHighWatermark = "FrameQueueHighWatermark"
+
+	ForwardingPaused  = "ForwardingPaused"
+	ForwardingResumed = "ForwardingResumed"
+
+	TimestampDiscontinuity = "TimestampDiscontinuity"
+
+	BitrateExceeded = "BitrateExceeded"
+
+	RemoteCommand = "RemoteCommand"
+
+	PanicRecovered = "PanicRecovered"
+
+	AddressQuarantined = "AddressQuarantined"
+
+	ClipExported     = "ClipExported"
+	ClipExportFailed = "ClipExportFailed"
+
+	ShardOpened = "ShardOpened"
+	ShardClosed = "ShardClosed"
+
+	FragmentDurationChanged = "FragmentDurationChanged"
+
+	StreamDegraded  = "StreamDegraded"
+	StreamRecovered = "StreamRecovered"
+
+	SnapshotPublished = "SnapshotPublished"
+
+	JitterHigh = "JitterHigh"
+
+	AVSyncDrift = "AVSyncDrift"
+)
+
+// Event is a structured server event.
+type Event struct {
+	Type       string         `json:"type"`
+	Time       time.Time      `json:"time"`
+	StreamPath string         `json:"stream_path,omitempty"`
+	StreamName string         `json:"stream_name,omitempty"`
+	CameraID   string         `json:"camera_id,omitempty"`
+	RemoteAddr string         `json:"remote_addr,omitempty"`
+	Protocol   string         `json:"protocol,omitempty"`
+	Detail     map[string]any `json:"detail,omitempty"`
+}
+
+// Subscriber receives events. Handle is called from a dedicated goroutine per subscriber,
+// so a slow subscriber never blocks the ingest path.
+type Subscriber interface {
+	Handle(Event)
+}
+
+// SubscriberFunc adapts a function to the Subscriber interface.
+type SubscriberFunc func(Event)
+
+// Handle implements Subscriber.
+func (f SubscriberFunc) Handle(e Event) {
+	f(e)
+}
+
+// subscription is a subscriber with its delivery queue.
+type subscription struct {
+	ch      chan Event
+	dropped atomic.Uint64
+}
+
+var (
+	mutex         sync.RWMutex
+	subscriptions []*subscription
+)
+
+// Subscribe registers a subscriber. Events are queued (up to 1000) and delivered in order;
+// events are dropped when the queue is full.
+func Subscribe(s Subscriber) {
+	sub := &subscription{ch: make(chan Event, 1000)}
+	go func() {
+		for e := range sub.ch {
+			s.Handle(e)
+		}
+	}()
+
+	mutex.Lock()
+	subscriptions = append(subscriptions, sub)
+	mutex.Unlock()
+}
+
+// Emit publishes an event to all subscribers without blocking.
+func Emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for _, sub := range subscriptions {
+		select {
+		case sub.ch <- e:
+		default:
+			if n := sub.dropped.Add(1); n == 1 || n%100 == 0 {
+				log.Printf("[Events] ⚠️  Subscriber queue full, %d events dropped", n)
+			}
+		}
+	}
+}
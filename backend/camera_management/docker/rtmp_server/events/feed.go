@@ -0,0 +1,232 @@
+// Package events distributes server lifecycle events to subscribers (EventBridge, ...).
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp_kvs/admin"
+)
+
+// feedKeepalive is the interval of keepalive messages on idle feed connections.
+const feedKeepalive = 15 * time.Second
+
+// Feed streams events to HTTP clients as Server-Sent Events or over a WebSocket.
+type Feed struct {
+	mutex   sync.Mutex
+	clients map[*feedClient]struct{}
+
+	// Origins of web pages allowed to open the WebSocket besides the admin server's own
+	// (EVENTS_ALLOWED_ORIGINS)
+	allowedOrigins []string
+}
+
+// feedClient is a connected feed consumer with its event filter.
+type feedClient struct {
+	ch         chan Event
+	types      map[string]bool // nil = all types
+	streamPath string
+	dropped    uint64
+}
+
+// NewFeed creates a feed and subscribes it to the event bus. EVENTS_ALLOWED_ORIGINS is a
+// comma-separated list of the origins (e.g. https://console.example.com) of web pages that
+// may open the WebSocket, besides pages served by the admin server itself.
+func NewFeed() *Feed {
+	f := &Feed{clients: make(map[*feedClient]struct{})}
+	for _, origin := range strings.Split(os.Getenv("EVENTS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			f.allowedOrigins = append(f.allowedOrigins, strings.ToLower(origin))
+		}
+	}
+	Subscribe(f)
+	return f
+}
+
+// allowsOrigin reports whether the page a WebSocket request comes from may read the feed.
+// Browsers send the Origin of the page and, unlike for fetch, do not apply CORS to
+// WebSockets, so any page could otherwise subscribe. Clients other than browsers send no
+// Origin and are allowed.
+func (f *Feed) allowsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.Contains(f.allowedOrigins, strings.ToLower(origin))
+}
+
+// Register registers the feed endpoints on the admin server:
+// GET /events (Server-Sent Events) and GET /events/ws (WebSocket).
+// Both accept ?type=StreamStarted,StreamStopped and ?stream_path=/live/cam1 filters.
+func (f *Feed) Register(srv *admin.Server) {
+	srv.HandleFunc("GET /events", f.serveSSE)
+	srv.HandleFunc("GET /events/ws", f.serveWebSocket)
+}
+
+// Handle implements Subscriber.
+func (f *Feed) Handle(e Event) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for c := range f.clients {
+		if !c.matches(e) {
+			continue
+		}
+		select {
+		case c.ch <- e:
+		default:
+			// Slow consumer; it learns about the gap from the next message
+			c.dropped++
+		}
+	}
+}
+
+// matches reports whether the event passes the client's filter.
+func (c *feedClient) matches(e Event) bool {
+	if c.types != nil && !c.types[e.Type] {
+		return false
+	}
+	return c.streamPath == "" || c.streamPath == e.StreamPath
+}
+
+// addClient registers a client with the filter from the request query.
+func (f *Feed) addClient(r *http.Request) *feedClient {
+	c := &feedClient{
+		ch:         make(chan Event, 100),
+		streamPath: r.URL.Query().Get("stream_path"),
+	}
+	if types := r.URL.Query().Get("type"); types != "" {
+		c.types = make(map[string]bool)
+		for _, t := range strings.Split(types, ",") {
+			c.types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	f.mutex.Lock()
+	f.clients[c] = struct{}{}
+	n := len(f.clients)
+	f.mutex.Unlock()
+
+	log.Printf("[Events] Feed client %s connected (%d clients)", r.RemoteAddr, n)
+	return c
+}
+
+// removeClient unregisters a client.
+func (f *Feed) removeClient(c *feedClient, r *http.Request) {
+	f.mutex.Lock()
+	delete(f.clients, c)
+	n := len(f.clients)
+	f.mutex.Unlock()
+
+	log.Printf("[Events] Feed client %s disconnected (%d clients)", r.RemoteAddr, n)
+}
+
+// takeDropped returns and resets the number of events dropped for the client.
+func (f *Feed) takeDropped(c *feedClient) uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n := c.dropped
+	c.dropped = 0
+	return n
+}
+
+// serveSSE streams events as text/event-stream.
+func (f *Feed) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c := f.addClient(r)
+	defer f.removeClient(c, r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(feedKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e := <-c.ch:
+			if n := f.takeDropped(c); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", n)
+			}
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveWebSocket streams events as WebSocket text messages (one JSON event per message).
+func (f *Feed) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !f.allowsOrigin(r) {
+		log.Printf("[Events] WebSocket from %s refused: origin %q not allowed (EVENTS_ALLOWED_ORIGINS)", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if errors.Is(err, errHijacked) {
+		log.Printf("[Events] WebSocket from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer ws.close()
+
+	c := f.addClient(r)
+	defer f.removeClient(c, r)
+
+	keepalive := time.NewTicker(feedKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e := <-c.ch:
+			if n := f.takeDropped(c); n > 0 {
+				if err := ws.writeText([]byte(fmt.Sprintf(`{"type":"dropped","dropped":%d}`, n))); err != nil {
+					return
+				}
+			}
+			data, _ := json.Marshal(e)
+			if err := ws.writeText(data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err := ws.writePing(); err != nil {
+				return
+			}
+		case <-ws.closed:
+			return
+		}
+	}
+}
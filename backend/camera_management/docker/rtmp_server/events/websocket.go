@@ -0,0 +1,193 @@
+// Package events distributes server lifecycle events to subscribers (EventBridge, ...).
+package events
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the fixed GUID of the opening handshake (RFC 6455 section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+// errHijacked wraps upgrade errors after the connection was taken over from the HTTP
+// server: no HTTP response can be sent any more.
+var errHijacked = errors.New("websocket handshake failed")
+
+// websocketConn is a minimal server-side WebSocket connection for sending events.
+// Incoming data messages are discarded; pings are answered and close is honoured.
+type websocketConn struct {
+	conn   net.Conn
+	mutex  sync.Mutex // serializes frame writes
+	closed chan struct{}
+}
+
+// upgradeWebSocket performs the opening handshake and starts the read loop. Errors
+// wrapping errHijacked occur after the connection was hijacked, and closed.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, errors.New("websocket upgrade required")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be upgraded")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", errHijacked, err)
+	}
+
+	ws := &websocketConn{conn: conn, closed: make(chan struct{})}
+	go ws.readLoop(rw.Reader)
+	return ws, nil
+}
+
+// headerContains reports whether a comma-separated header contains token (case-insensitive).
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readLoop consumes client frames until the connection is closed.
+func (ws *websocketConn) readLoop(r *bufio.Reader) {
+	defer close(ws.closed)
+
+	for {
+		opcode, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opPing:
+			if ws.writeFrame(opPong, payload) != nil {
+				return
+			}
+		case opClose:
+			ws.writeFrame(opClose, payload)
+			return
+		}
+	}
+}
+
+// readFrame reads one (masked) client frame. Payloads are limited to 64 KiB.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > 65536 {
+		return 0, nil, errors.New("websocket frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+// writeFrame writes a single unmasked frame.
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode // FIN
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+func (ws *websocketConn) writeText(data []byte) error {
+	return ws.writeFrame(opText, data)
+}
+
+func (ws *websocketConn) writePing() error {
+	return ws.writeFrame(opPing, nil)
+}
+
+// close closes the underlying connection.
+func (ws *websocketConn) close() {
+	ws.conn.Close()
+}
@@ -0,0 +1,279 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientFrame encodes a client frame with the given length encoding (7, 16 or 64 bits),
+// masked with mask unless it is nil.
+func clientFrame(opcode byte, payload []byte, lengthBits int, mask []byte) []byte {
+	frame := []byte{0x80 | opcode, 0}
+	switch lengthBits {
+	case 7:
+		frame[1] = byte(len(payload))
+	case 16:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestReadFrame(t *testing.T) {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	large := bytes.Repeat([]byte("x"), 65536)
+	tests := []struct {
+		name        string
+		data        []byte
+		wantOpcode  byte
+		wantPayload []byte
+		wantErr     string
+	}{
+		{
+			// RFC 6455 section 5.7: a masked "Hello"
+			name:        "masked",
+			data:        []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+			wantOpcode:  opText,
+			wantPayload: []byte("Hello"),
+		},
+		{
+			name:        "unmasked",
+			data:        []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f},
+			wantOpcode:  opText,
+			wantPayload: []byte("Hello"),
+		},
+		{
+			name:        "16-bit length",
+			data:        clientFrame(opText, bytes.Repeat([]byte("a"), 300), 16, mask),
+			wantOpcode:  opText,
+			wantPayload: bytes.Repeat([]byte("a"), 300),
+		},
+		{
+			name:        "64-bit length at the limit",
+			data:        clientFrame(opText, large, 64, mask),
+			wantOpcode:  opText,
+			wantPayload: large,
+		},
+		{
+			name:        "empty ping",
+			data:        clientFrame(opPing, nil, 7, mask),
+			wantOpcode:  opPing,
+			wantPayload: []byte{},
+		},
+		{
+			name:    "over the limit",
+			data:    clientFrame(opText, append(large, 'x'), 64, mask),
+			wantErr: "too large",
+		},
+		{
+			name:    "64-bit length overflow",
+			data:    []byte{0x81, 0xFF, 0x80, 0, 0, 0, 0, 0, 0, 0},
+			wantErr: "too large",
+		},
+		{
+			name:    "truncated extended length",
+			data:    []byte{0x81, 0xFE, 0x01},
+			wantErr: "unexpected EOF",
+		},
+		{
+			name:    "truncated mask",
+			data:    []byte{0x81, 0x85, 0x37, 0xfa},
+			wantErr: "unexpected EOF",
+		},
+		{
+			name:    "truncated payload",
+			data:    []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f},
+			wantErr: "unexpected EOF",
+		},
+		{
+			name:    "no frame",
+			wantErr: "EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opcode, payload, err := readFrame(bufio.NewReader(bytes.NewReader(tt.data)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("readFrame: err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opcode != tt.wantOpcode || !bytes.Equal(payload, tt.wantPayload) {
+				t.Errorf("readFrame = %#x, %d bytes, want %#x, %d bytes", opcode, len(payload), tt.wantOpcode, len(tt.wantPayload))
+			}
+		})
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		size       int
+		wantHeader []byte
+	}{
+		{0, []byte{0x81, 0}},
+		{125, []byte{0x81, 125}},
+		{126, []byte{0x81, 126, 0, 126}},
+		{65535, []byte{0x81, 126, 0xFF, 0xFF}},
+		{65536, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		server, client := net.Pipe()
+		ws := &websocketConn{conn: server}
+		go func() {
+			ws.writeText(make([]byte, tt.size))
+			server.Close()
+		}()
+		frame, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(frame, tt.wantHeader) || len(frame) != len(tt.wantHeader)+tt.size {
+			t.Errorf("%d bytes: frame starts with % x and has %d bytes, want % x and %d",
+				tt.size, frame[:min(len(frame), 10)], len(frame), tt.wantHeader, len(tt.wantHeader)+tt.size)
+		}
+	}
+}
+
+func TestReadLoop(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	ws := &websocketConn{conn: server, closed: make(chan struct{})}
+	go ws.readLoop(bufio.NewReader(server))
+	mask := []byte{1, 2, 3, 4}
+	responses := bufio.NewReader(client)
+
+	tests := []struct {
+		name string
+		send []byte
+		want []byte // server response, nil for none
+	}{
+		{"text is discarded", clientFrame(opText, []byte("hello"), 7, mask), nil},
+		{"ping is answered", clientFrame(opPing, []byte("abc"), 7, mask), []byte{0x8A, 3, 'a', 'b', 'c'}},
+		{"close is echoed", clientFrame(opClose, []byte{0x03, 0xE8}, 7, mask), []byte{0x88, 2, 0x03, 0xE8}},
+	}
+	for _, tt := range tests {
+		if _, err := client.Write(tt.send); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.want == nil {
+			continue
+		}
+		got := make([]byte, len(tt.want))
+		if _, err := io.ReadFull(responses, got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: response % x, want % x", tt.name, got, tt.want)
+		}
+	}
+	select {
+	case <-ws.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("read loop did not end after close")
+	}
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	valid := http.Header{
+		"Connection":            {"keep-alive, Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+	}
+	without := func(name string) http.Header {
+		h := valid.Clone()
+		h.Del(name)
+		return h
+	}
+	tests := []struct {
+		name    string
+		header  http.Header
+		wantErr string
+	}{
+		{"no Connection", without("Connection"), "upgrade required"},
+		{"no Upgrade", without("Upgrade"), "upgrade required"},
+		{"no version", without("Sec-Websocket-Version"), "unsupported websocket version"},
+		{"no key", without("Sec-Websocket-Key"), "missing Sec-WebSocket-Key"},
+		{"not hijackable", valid, "cannot be upgraded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/events", nil)
+			r.Header = tt.header
+			_, err := upgradeWebSocket(httptest.NewRecorder(), r)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("upgradeWebSocket: err = %v, want %q", err, tt.wantErr)
+			}
+			if errors.Is(err, errHijacked) {
+				t.Errorf("%v reported after the hijack", err)
+			}
+		})
+	}
+}
+
+func TestUpgradeWebSocketHandshake(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.close()
+		ws.writeText([]byte("hi"))
+		<-ws.closed
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /events HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	// RFC 6455 section 1.3
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(br, frame); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x81, 2, 'h', 'i'}; !bytes.Equal(frame, want) {
+		t.Errorf("frame % x, want % x", frame, want)
+	}
+	conn.Write(clientFrame(opClose, nil, 7, []byte{1, 2, 3, 4}))
+}
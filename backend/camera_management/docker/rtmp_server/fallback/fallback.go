@@ -0,0 +1,307 @@
+// Package fallback keeps sampled visual coverage of streams whose KVS pipeline is down:
+// while a live stream cannot be forwarded (restart backoff, KVS unreachable), JPEG stills
+// of it are uploaded to S3 at a fixed interval until the pipeline recovers.
+package fallback
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/events"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/metrics"
+	"rtmp_kvs/server"
+	"rtmp_kvs/snapshot"
+)
+
+const (
+	checkInterval  = 5 * time.Second
+	captureTimeout = 15 * time.Second // keyframe wait and decode
+	uploadTimeout  = 30 * time.Second
+	// Streams captured at the same time; each decode runs a GStreamer process
+	maxConcurrentCaptures = 4
+)
+
+// Source provides the active publishers and their keyframes.
+type Source interface {
+	snapshot.KeyframeSource
+	Stats() []server.StreamStats
+}
+
+// ForwarderSource provides the KVS forwarders.
+type ForwarderSource interface {
+	Forwarders() []*kvs.Forwarder
+}
+
+// stream is the fallback state of a live stream path.
+type stream struct {
+	downSince   time.Time // first check the pipeline was down, zero while healthy
+	degraded    bool      // stills are being captured
+	reason      string
+	lastCapture time.Time
+	capturing   bool
+	stills      int // uploaded since the stream was degraded
+}
+
+// Fallback switches streams to still capture while their KVS pipeline is down.
+type Fallback struct {
+	source     Source
+	forwarders ForwarderSource
+	s3         *awsapi.S3
+	bucket     string
+	prefix     string
+	interval   time.Duration
+	after      time.Duration // how long the pipeline must be down before switching
+	ackTimeout time.Duration // a running pipeline without PERSISTED ACKs for this long is down
+
+	mutex   sync.Mutex
+	streams map[string]*stream // by stream path
+	slots   chan struct{}
+
+	switches       atomic.Uint64
+	recoveries     atomic.Uint64
+	uploaded       atomic.Uint64
+	captureErrors  atomic.Uint64
+	uploadErrors   atomic.Uint64
+	degradedStream atomic.Int64
+}
+
+// NewFromEnv creates the fallback writing to the S3 bucket FALLBACK_STILLS_BUCKET under
+// FALLBACK_STILLS_PREFIX (default "fallback/"), one image per FALLBACK_STILLS_INTERVAL
+// seconds (default 10) of every stream whose pipeline has been down for FALLBACK_AFTER
+// seconds (default 15). A running pipeline counts as down when no fragment was persisted
+// for FALLBACK_ACK_TIMEOUT seconds (default 30, 0 disables). It returns nil if
+// FALLBACK_STILLS_BUCKET is not set.
+func NewFromEnv(region string, source Source, forwarders ForwarderSource) *Fallback {
+	bucket := os.Getenv("FALLBACK_STILLS_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	prefix := os.Getenv("FALLBACK_STILLS_PREFIX")
+	if prefix == "" {
+		prefix = "fallback/"
+	}
+	f := &Fallback{
+		source:     source,
+		forwarders: forwarders,
+		s3:         awsapi.NewS3(region),
+		bucket:     bucket,
+		prefix:     prefix,
+		interval:   time.Duration(max(envInt("FALLBACK_STILLS_INTERVAL", 10), 1)) * time.Second,
+		after:      time.Duration(max(envInt("FALLBACK_AFTER", 15), 0)) * time.Second,
+		ackTimeout: time.Duration(max(envInt("FALLBACK_ACK_TIMEOUT", 30), 0)) * time.Second,
+		streams:    make(map[string]*stream),
+		slots:      make(chan struct{}, maxConcurrentCaptures),
+	}
+	log.Printf("[Fallback] Streams down for %s switch to one still per %s in s3://%s/%s",
+		f.after, f.interval, bucket, prefix)
+	return f
+}
+
+// envInt reads an integer environment variable.
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("[Fallback] ⚠️  Invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Run checks the pipelines of the live streams until ctx is cancelled.
+func (f *Fallback) Run(ctx context.Context) {
+	ticker := time.NewTicker(min(checkInterval, f.interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.Check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check updates the mode of every live stream, emitting StreamDegraded and
+// StreamRecovered on a switch, and starts the captures that are due.
+func (f *Fallback) Check(ctx context.Context) {
+	statuses := make(map[string]kvs.Status)
+	for _, forwarder := range f.forwarders.Forwarders() {
+		status := forwarder.Status()
+		statuses[status.StreamName] = status
+	}
+
+	now := time.Now()
+	live := make(map[string]bool)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, st := range f.source.Stats() {
+		// Audio-only and paused streams are not forwarded on purpose
+		if st.VideoCodec == "" || st.ForwardingPaused {
+			continue
+		}
+		live[st.StreamPath] = true
+		s := f.streams[st.StreamPath]
+		if s == nil {
+			s = &stream{}
+			f.streams[st.StreamPath] = s
+		}
+
+		reason := f.downReason(st, statuses[st.StreamName], now)
+		switch {
+		case reason == "":
+			if s.degraded {
+				f.recover(st, s, now)
+			}
+			s.downSince = time.Time{}
+		case s.downSince.IsZero():
+			s.downSince = now
+		}
+		if reason != "" && !s.degraded && now.Sub(s.downSince) >= f.after {
+			f.degrade(st, s, reason, now)
+		}
+		if s.degraded && !s.capturing && now.Sub(s.lastCapture) >= f.interval {
+			s.capturing = true
+			s.lastCapture = now
+			go f.capture(ctx, st, s)
+		}
+	}
+
+	// Streams whose publisher left are forgotten; a degraded one ends without recovery
+	for path, s := range f.streams {
+		if !live[path] && !s.capturing {
+			if s.degraded {
+				f.degradedStream.Add(-1)
+			}
+			delete(f.streams, path)
+		}
+	}
+}
+
+// downReason returns why the pipeline of a live stream cannot forward, or "" if it can.
+func (f *Fallback) downReason(st server.StreamStats, status kvs.Status, now time.Time) string {
+	switch {
+	case status.StreamName == "" || status.FileSink:
+		// Not forwarded to KVS
+		return ""
+	case !status.Running:
+		// Exited and waiting for its restart backoff, or failing to start
+		if status.Errors.LastClass != "" {
+			return "pipeline_down:" + status.Errors.LastClass
+		}
+		return "pipeline_down"
+	case f.ackTimeout > 0 && !status.Acks.LastPersistedAt.IsZero() &&
+		now.Sub(status.Acks.LastPersistedAt) >= f.ackTimeout && now.Sub(st.StartedAt) >= f.ackTimeout:
+		// Running, but KVS stopped persisting fragments
+		return "no_persisted_ack"
+	}
+	return ""
+}
+
+// degrade switches a stream to still capture. It is called with the mutex held.
+func (f *Fallback) degrade(st server.StreamStats, s *stream, reason string, now time.Time) {
+	s.degraded = true
+	s.reason = reason
+	s.stills = 0
+	s.lastCapture = time.Time{}
+	f.switches.Add(1)
+	f.degradedStream.Add(1)
+	log.Printf("[Fallback] ⚠️  KVS pipeline of %s down for %s (%s), capturing stills to S3",
+		st.StreamPath, now.Sub(s.downSince).Truncate(time.Second), reason)
+	events.Emit(events.Event{
+		Type:       events.StreamDegraded,
+		StreamPath: st.StreamPath,
+		StreamName: st.StreamName,
+		CameraID:   st.CameraID,
+		Detail: map[string]any{
+			"reason":           reason,
+			"down_seconds":     now.Sub(s.downSince).Seconds(),
+			"interval_seconds": f.interval.Seconds(),
+			"s3_prefix":        fmt.Sprintf("s3://%s/%s", f.bucket, f.keyPrefix(st.StreamPath)),
+		},
+	})
+}
+
+// recover switches a stream back to video. It is called with the mutex held.
+func (f *Fallback) recover(st server.StreamStats, s *stream, now time.Time) {
+	s.degraded = false
+	f.recoveries.Add(1)
+	f.degradedStream.Add(-1)
+	log.Printf("[Fallback] ✅ KVS pipeline of %s recovered after %s, %d stills captured",
+		st.StreamPath, now.Sub(s.downSince).Truncate(time.Second), s.stills)
+	events.Emit(events.Event{
+		Type:       events.StreamRecovered,
+		StreamPath: st.StreamPath,
+		StreamName: st.StreamName,
+		CameraID:   st.CameraID,
+		Detail: map[string]any{
+			"reason":           s.reason,
+			"degraded_seconds": now.Sub(s.downSince).Seconds(),
+			"stills":           s.stills,
+		},
+	})
+}
+
+// keyPrefix returns the S3 key prefix of the stills of a stream.
+func (f *Fallback) keyPrefix(streamPath string) string {
+	return f.prefix + strings.Trim(streamPath, "/") + "/"
+}
+
+// capture captures and uploads one still of a degraded stream.
+func (f *Fallback) capture(ctx context.Context, st server.StreamStats, s *stream) {
+	defer func() {
+		f.mutex.Lock()
+		s.capturing = false
+		f.mutex.Unlock()
+	}()
+	select {
+	case f.slots <- struct{}{}:
+		defer func() { <-f.slots }()
+	case <-ctx.Done():
+		return
+	}
+
+	captureCtx, cancel := context.WithTimeout(ctx, captureTimeout)
+	image, err := snapshot.Capture(captureCtx, f.source, st.StreamPath, "jpeg")
+	cancel()
+	if err != nil {
+		f.captureErrors.Add(1)
+		log.Printf("[Fallback] ⚠️  Failed to capture %s: %v", st.StreamPath, err)
+		return
+	}
+
+	key := f.keyPrefix(st.StreamPath) + time.Now().UTC().Format("20060102-150405.000") + snapshot.Extension("jpeg")
+	uploadCtx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	if err := f.s3.PutObject(awsapi.WithStreamPath(uploadCtx, st.StreamPath), f.bucket, key, snapshot.ContentType("jpeg"), image); err != nil {
+		f.uploadErrors.Add(1)
+		log.Printf("[Fallback] ⚠️  Failed to upload s3://%s/%s: %v", f.bucket, key, err)
+		return
+	}
+	f.uploaded.Add(1)
+	f.mutex.Lock()
+	s.stills++
+	f.mutex.Unlock()
+}
+
+// CollectMetrics writes the number of degraded streams, mode switches and stills.
+func (f *Fallback) CollectMetrics(w *metrics.Writer) {
+	w.Gauge("rtmp_fallback_degraded_streams", "Live streams whose KVS pipeline is down, covered by stills", float64(f.degradedStream.Load()))
+	w.Counter("rtmp_fallback_switches_total", "Streams switched to still capture", float64(f.switches.Load()))
+	w.Counter("rtmp_fallback_recoveries_total", "Streams switched back to video", float64(f.recoveries.Load()))
+	w.Counter("rtmp_fallback_stills_uploaded_total", "Fallback stills uploaded to S3", float64(f.uploaded.Load()))
+	w.Counter("rtmp_fallback_capture_failures_total", "Fallback stills that could not be captured (no keyframe, decode error)", float64(f.captureErrors.Load()))
+	w.Counter("rtmp_fallback_upload_errors_total", "Fallback stills S3 did not accept", float64(f.uploadErrors.Load()))
+}
@@ -0,0 +1,38 @@
+// Package flv implements reading and writing of FLV streams carrying H.264 video.
+package flv
+
+// Tag types
+const (
+	TagAudio  = 8
+	TagVideo  = 9
+	TagScript = 18
+)
+
+// Video codec and AVC packet types
+const (
+	CodecAVC          = 7
+	AVCSequenceHeader = 0
+	AVCNALU           = 1
+)
+
+// Audio sound formats and AAC packet types
+const (
+	SoundG711ALaw     = 7
+	SoundG711MuLaw    = 8
+	SoundAAC          = 10
+	AACSequenceHeader = 0
+	AACRaw            = 1
+)
+
+// Video frame types
+const (
+	FrameKey   = 1
+	FrameInter = 2
+)
+
+// Tag is a single FLV tag.
+type Tag struct {
+	Type      uint8
+	Timestamp uint32 // milliseconds
+	Data      []byte
+}
@@ -0,0 +1,116 @@
+// Package flv implements reading and writing of FLV streams carrying H.264 video.
+package flv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bluenviron/gortmplib/pkg/h264conf"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+)
+
+// Reader reads tags from an FLV stream.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader creates a new FLV reader and validates the file header.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(r, 1024*1024)
+
+	// FLV header: "FLV", version, flags, header size
+	var header [9]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read FLV header: %w", err)
+	}
+	if string(header[:3]) != "FLV" {
+		return nil, errors.New("not an FLV stream")
+	}
+
+	// Skip any extra header bytes and the first PreviousTagSize field
+	headerSize := binary.BigEndian.Uint32(header[5:9])
+	if headerSize < 9 {
+		return nil, fmt.Errorf("invalid FLV header size: %d", headerSize)
+	}
+	if _, err := br.Discard(int(headerSize-9) + 4); err != nil {
+		return nil, fmt.Errorf("failed to read FLV header: %w", err)
+	}
+
+	return &Reader{r: br}, nil
+}
+
+// ReadTag reads the next tag. A truncated trailing tag is reported as io.EOF.
+func (r *Reader) ReadTag() (*Tag, error) {
+	var header [11]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	tag := &Tag{
+		Type:      header[0] & 0x1F,
+		Timestamp: uint32(header[4])<<16 | uint32(header[5])<<8 | uint32(header[6]) | uint32(header[7])<<24,
+		Data:      make([]byte, size),
+	}
+
+	if _, err := io.ReadFull(r.r, tag.Data); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	// PreviousTagSize
+	if _, err := r.r.Discard(4); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return tag, nil
+}
+
+// ParseH264 parses the payload of a video tag. It returns the composition time offset in
+// milliseconds and the NAL units; sequence headers are returned as [SPS, PPS].
+// A nil access unit is returned for tags that carry no video data.
+func ParseH264(data []byte) (cts int32, au [][]byte, err error) {
+	if len(data) < 5 {
+		return 0, nil, nil
+	}
+
+	if data[0]&0x80 != 0 {
+		return 0, nil, errors.New("enhanced RTMP FLV tags are not supported")
+	}
+
+	if data[0]&0x0F != CodecAVC {
+		return 0, nil, fmt.Errorf("unsupported FLV video codec: %d", data[0]&0x0F)
+	}
+
+	// Composition time offset (signed 24-bit)
+	cts = int32(uint32(data[2])<<16|uint32(data[3])<<8|uint32(data[4])) << 8 >> 8
+
+	switch data[1] {
+	case AVCSequenceHeader:
+		var conf h264conf.Conf
+		if err := conf.Unmarshal(data[5:]); err != nil {
+			return 0, nil, fmt.Errorf("failed to parse AVC sequence header: %w", err)
+		}
+		return cts, [][]byte{conf.SPS, conf.PPS}, nil
+
+	case AVCNALU:
+		var avcc h264.AVCC
+		if err := avcc.Unmarshal(data[5:]); err != nil {
+			if errors.Is(err, h264.ErrAVCCNoNALUs) {
+				return 0, nil, nil
+			}
+			return 0, nil, fmt.Errorf("failed to decode AVCC: %w", err)
+		}
+		return cts, avcc, nil
+	}
+
+	return 0, nil, nil
+}
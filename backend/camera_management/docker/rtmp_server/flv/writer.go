@@ -0,0 +1,192 @@
+// Package flv implements reading and writing of FLV streams carrying H.264 video.
+package flv
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/bluenviron/gortmplib/pkg/h264conf"
+)
+
+// tagHeaderSize and tagTrailerSize frame every tag: 11-byte tag header, 4-byte PreviousTagSize.
+const (
+	tagHeaderSize  = 11
+	tagTrailerSize = 4
+)
+
+// maxPooledBuffer caps the size of buffers returned to the pool, so an occasional huge
+// keyframe does not pin memory forever.
+const maxPooledBuffer = 4 * 1024 * 1024
+
+// bufferPool holds tag buffers shared by all writers (one per pipeline).
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 64*1024)
+		return &buf
+	},
+}
+
+// getBuffer returns a pooled buffer of length size.
+func getBuffer(size int) *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// putBuffer returns a buffer to the pool.
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// Writer writes an FLV stream. Each tag is assembled in a pooled buffer and emitted with a
+// single Write call.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter creates a new FLV writer.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteHeader writes the FLV file header and the first PreviousTagSize field.
+func (w *Writer) WriteHeader(hasVideo, hasAudio bool) error {
+	var flags byte
+	if hasAudio {
+		flags |= 0x04
+	}
+	if hasVideo {
+		flags |= 0x01
+	}
+	_, err := w.w.Write([]byte{'F', 'L', 'V', 1, flags, 0, 0, 0, 9, 0, 0, 0, 0})
+	return err
+}
+
+// putTagHeader fills the tag header at the start of buf and the PreviousTagSize at its end.
+func putTagHeader(buf []byte, tagType uint8, timestamp uint32) {
+	size := len(buf) - tagHeaderSize - tagTrailerSize
+
+	buf[0] = tagType
+	buf[1] = byte(size >> 16)
+	buf[2] = byte(size >> 8)
+	buf[3] = byte(size)
+	buf[4] = byte(timestamp >> 16)
+	buf[5] = byte(timestamp >> 8)
+	buf[6] = byte(timestamp)
+	buf[7] = byte(timestamp >> 24)
+	buf[8], buf[9], buf[10] = 0, 0, 0 // StreamID
+	binary.BigEndian.PutUint32(buf[tagHeaderSize+size:], uint32(tagHeaderSize+size))
+}
+
+// WriteTag writes a tag followed by its PreviousTagSize field.
+func (w *Writer) WriteTag(tag *Tag) error {
+	buf := getBuffer(tagHeaderSize + len(tag.Data) + tagTrailerSize)
+	defer putBuffer(buf)
+
+	copy((*buf)[tagHeaderSize:], tag.Data)
+	putTagHeader(*buf, tag.Type, tag.Timestamp)
+
+	_, err := w.w.Write(*buf)
+	return err
+}
+
+// WriteH264Config writes an AVC sequence header (AVCDecoderConfigurationRecord).
+func (w *Writer) WriteH264Config(timestamp uint32, sps, pps []byte) error {
+	conf, err := h264conf.Conf{SPS: sps, PPS: pps}.Marshal()
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 5+len(conf))
+	data[0] = FrameKey<<4 | CodecAVC
+	data[1] = AVCSequenceHeader
+	copy(data[5:], conf)
+
+	return w.WriteTag(&Tag{Type: TagVideo, Timestamp: timestamp, Data: data})
+}
+
+// WriteH264 writes an H.264 access unit as AVCC with the given DTS and composition time offset.
+// The NAL units are copied directly into the pooled tag buffer.
+func (w *Writer) WriteH264(dts uint32, cts int32, keyframe bool, au [][]byte) error {
+	size := 5
+	for _, nalu := range au {
+		size += 4 + len(nalu)
+	}
+
+	buf := getBuffer(tagHeaderSize + size + tagTrailerSize)
+	defer putBuffer(buf)
+
+	data := (*buf)[tagHeaderSize : tagHeaderSize+size]
+	frameType := byte(FrameInter)
+	if keyframe {
+		frameType = FrameKey
+	}
+	data[0] = frameType<<4 | CodecAVC
+	data[1] = AVCNALU
+	data[2] = byte(cts >> 16)
+	data[3] = byte(cts >> 8)
+	data[4] = byte(cts)
+
+	pos := 5
+	for _, nalu := range au {
+		binary.BigEndian.PutUint32(data[pos:], uint32(len(nalu)))
+		pos += 4
+		pos += copy(data[pos:], nalu)
+	}
+	putTagHeader(*buf, TagVideo, dts)
+
+	_, err := w.w.Write(*buf)
+	return err
+}
+
+// aacSoundFlags is the audio tag header byte used for AAC (the rate, size and channel bits
+// are fixed by the spec; the real values come from the AudioSpecificConfig).
+const aacSoundFlags = SoundAAC<<4 | 3<<2 | 1<<1 | 1
+
+// WriteAACConfig writes an AAC sequence header (AudioSpecificConfig).
+func (w *Writer) WriteAACConfig(timestamp uint32, config []byte) error {
+	data := make([]byte, 2+len(config))
+	data[0] = aacSoundFlags
+	data[1] = AACSequenceHeader
+	copy(data[2:], config)
+
+	return w.WriteTag(&Tag{Type: TagAudio, Timestamp: timestamp, Data: data})
+}
+
+// WriteAAC writes a raw AAC frame.
+func (w *Writer) WriteAAC(timestamp uint32, frame []byte) error {
+	return w.writeAudio(timestamp, []byte{aacSoundFlags, AACRaw}, frame)
+}
+
+// WriteG711 writes G.711 samples (8 kHz, signalled with the 5.5 kHz rate index as RTMP does).
+func (w *Writer) WriteG711(timestamp uint32, muLaw, stereo bool, samples []byte) error {
+	flags := byte(SoundG711ALaw<<4 | 1<<1)
+	if muLaw {
+		flags = SoundG711MuLaw<<4 | 1<<1
+	}
+	if stereo {
+		flags |= 1
+	}
+	return w.writeAudio(timestamp, []byte{flags}, samples)
+}
+
+// writeAudio writes an audio tag made of header followed by payload.
+func (w *Writer) writeAudio(timestamp uint32, header, payload []byte) error {
+	size := len(header) + len(payload)
+	buf := getBuffer(tagHeaderSize + size + tagTrailerSize)
+	defer putBuffer(buf)
+
+	pos := tagHeaderSize + copy((*buf)[tagHeaderSize:], header)
+	copy((*buf)[pos:], payload)
+	putTagHeader(*buf, TagAudio, timestamp)
+
+	_, err := w.w.Write(*buf)
+	return err
+}
@@ -2,10 +2,21 @@ module rtmp_kvs
 
 go 1.24.0
 
-require github.com/bluenviron/gortmplib v0.2.0
+require (
+	github.com/bluenviron/gortmplib v0.2.0
+	github.com/bluenviron/mediacommon/v2 v2.6.0
+	golang.org/x/sync v0.16.0
+	golang.org/x/sys v0.34.0
+	google.golang.org/grpc v1.76.0
+	google.golang.org/protobuf v1.36.6
+)
 
 require (
 	github.com/abema/go-mp4 v1.4.1 // indirect
-	github.com/bluenviron/mediacommon/v2 v2.6.0 // indirect
+	github.com/asticode/go-astikit v0.30.0 // indirect
+	github.com/asticode/go-astits v1.14.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/net v0.42.0 // indirect
+	golang.org/x/text v0.27.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250804133106-a7a43d27e69b // indirect
 )
@@ -0,0 +1,166 @@
+// Package greengrass integrates the server with AWS IoT Greengrass v2: it reads the
+// component configuration and reports the component state over Greengrass IPC.
+package greengrass
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Largest message accepted from the nucleus
+const maxMessageSize = 16 << 20
+
+// Event stream header value types
+const (
+	headerBoolTrue  = 0
+	headerBoolFalse = 1
+	headerByte      = 2
+	headerInt16     = 3
+	headerInt32     = 4
+	headerInt64     = 5
+	headerBytes     = 6
+	headerString    = 7
+	headerTimestamp = 8
+	headerUUID      = 9
+)
+
+// header is an event stream header. Only int32 and string values are written; other
+// types are skipped when read.
+type header struct {
+	name  string
+	value any // int32 or string
+}
+
+// message is an event stream message: the binary framing Greengrass IPC (event stream
+// RPC) uses on the nucleus socket.
+type message struct {
+	headers []header
+	payload []byte
+}
+
+// int32Header returns the value of an int32 header, 0 if absent.
+func (m *message) int32Header(name string) int32 {
+	for _, h := range m.headers {
+		if v, ok := h.value.(int32); ok && h.name == name {
+			return v
+		}
+	}
+	return 0
+}
+
+// stringHeader returns the value of a string header, "" if absent.
+func (m *message) stringHeader(name string) string {
+	for _, h := range m.headers {
+		if v, ok := h.value.(string); ok && h.name == name {
+			return v
+		}
+	}
+	return ""
+}
+
+// writeMessage encodes a message: prelude (total length, headers length, CRC), headers,
+// payload and the CRC of the whole message, integers big-endian.
+func writeMessage(w io.Writer, m message) error {
+	var headers []byte
+	for _, h := range m.headers {
+		headers = append(headers, byte(len(h.name)))
+		headers = append(headers, h.name...)
+		switch v := h.value.(type) {
+		case int32:
+			headers = append(headers, headerInt32)
+			headers = binary.BigEndian.AppendUint32(headers, uint32(v))
+		case string:
+			headers = append(headers, headerString)
+			headers = binary.BigEndian.AppendUint16(headers, uint16(len(v)))
+			headers = append(headers, v...)
+		default:
+			return fmt.Errorf("unsupported header type %T", v)
+		}
+	}
+
+	total := 12 + len(headers) + len(m.payload) + 4
+	buf := make([]byte, 0, total)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(total))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(headers)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	buf = append(buf, headers...)
+	buf = append(buf, m.payload...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	_, err := w.Write(buf)
+	return err
+}
+
+// readMessage decodes a message and verifies its checksums.
+func readMessage(r *bufio.Reader) (*message, error) {
+	var prelude [12]byte
+	if _, err := io.ReadFull(r, prelude[:]); err != nil {
+		return nil, err
+	}
+	total := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, errors.New("event stream prelude checksum mismatch")
+	}
+	if total > maxMessageSize || total < 16 || uint64(headersLen)+16 > uint64(total) {
+		return nil, fmt.Errorf("invalid event stream message length %d", total)
+	}
+
+	buf := make([]byte, total)
+	copy(buf, prelude[:])
+	if _, err := io.ReadFull(r, buf[12:]); err != nil {
+		return nil, err
+	}
+	end := total - 4
+	if crc32.ChecksumIEEE(buf[:end]) != binary.BigEndian.Uint32(buf[end:]) {
+		return nil, errors.New("event stream message checksum mismatch")
+	}
+
+	m := &message{payload: buf[12+headersLen : end]}
+	headers := buf[12 : 12+headersLen]
+	for len(headers) > 0 {
+		nameLen := int(headers[0])
+		if len(headers) < 2+nameLen {
+			return nil, errors.New("truncated event stream header")
+		}
+		name := string(headers[1 : 1+nameLen])
+		valueType := headers[1+nameLen]
+		headers = headers[2+nameLen:]
+
+		var size int
+		switch valueType {
+		case headerBoolTrue, headerBoolFalse:
+		case headerByte:
+			size = 1
+		case headerInt16:
+			size = 2
+		case headerInt32:
+			size = 4
+		case headerInt64, headerTimestamp:
+			size = 8
+		case headerUUID:
+			size = 16
+		case headerBytes, headerString:
+			if len(headers) < 2 {
+				return nil, errors.New("truncated event stream header")
+			}
+			size = 2 + int(binary.BigEndian.Uint16(headers))
+		default:
+			return nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+		if len(headers) < size {
+			return nil, errors.New("truncated event stream header")
+		}
+		switch valueType {
+		case headerInt32:
+			m.headers = append(m.headers, header{name, int32(binary.BigEndian.Uint32(headers))})
+		case headerString:
+			m.headers = append(m.headers, header{name, string(headers[2:size])})
+		}
+		headers = headers[size:]
+	}
+	return m, nil
+}
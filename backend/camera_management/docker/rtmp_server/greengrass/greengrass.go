@@ -0,0 +1,351 @@
+// Package greengrass integrates the server with AWS IoT Greengrass v2: it reads the
+// component configuration and reports the component state over Greengrass IPC.
+package greengrass
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/logging"
+	"rtmp_kvs/metrics"
+)
+
+// IPC operations
+const (
+	opGetConfiguration         = "aws.greengrass#GetConfiguration"
+	opSubscribeToConfigUpdates = "aws.greengrass#SubscribeToConfigurationUpdate"
+	opUpdateState              = "aws.greengrass#UpdateState"
+)
+
+// Component states reported with UpdateState
+const (
+	StateRunning = "RUNNING"
+	StateErrored = "ERRORED"
+)
+
+// Key of the component configuration whose entries become environment variables
+const environmentKey = "Environment"
+
+const (
+	requestTimeout = 10 * time.Second
+	checkInterval  = 30 * time.Second
+	// Delay before reconnecting after the IPC connection failed
+	reconnectDelay = 10 * time.Second
+)
+
+// Component is the server running as a Greengrass component.
+type Component struct {
+	socketPath string
+	authToken  string
+
+	unhealthyTimeout time.Duration // 0 never reports ERRORED
+	failureThreshold int           // consecutive pipeline failures of a stream
+
+	mutex  sync.Mutex
+	client *ipcClient
+	state  string // last reported
+
+	stateUpdates atomic.Uint64
+	ipcErrors    atomic.Uint64
+	config       map[string]string // Environment entries of the component configuration
+}
+
+// NewFromEnv returns the component when the process was started by the Greengrass nucleus
+// (AWS_GG_NUCLEUS_DOMAIN_SOCKET_FILEPATH_FOR_COMPONENT and SVCUID are set) and
+// GREENGRASS_IPC is not "false". It returns nil otherwise.
+func NewFromEnv() *Component {
+	socketPath := os.Getenv("AWS_GG_NUCLEUS_DOMAIN_SOCKET_FILEPATH_FOR_COMPONENT")
+	authToken := os.Getenv("SVCUID")
+	if socketPath == "" || authToken == "" || strings.EqualFold(os.Getenv("GREENGRASS_IPC"), "false") {
+		return nil
+	}
+	return &Component{socketPath: socketPath, authToken: authToken}
+}
+
+// connect returns the IPC connection, dialing it if needed.
+func (c *Component) connect(ctx context.Context) (*ipcClient, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.client != nil {
+		select {
+		case <-c.client.closed:
+			c.client = nil
+		default:
+			return c.client, nil
+		}
+	}
+	client, err := dialIPC(ctx, c.socketPath, c.authToken)
+	if err != nil {
+		c.ipcErrors.Add(1)
+		return nil, fmt.Errorf("failed to connect to the Greengrass nucleus: %w", err)
+	}
+	c.client = client
+	return client, nil
+}
+
+// ApplyConfiguration reads the component configuration and sets its Environment entries
+// as environment variables, so the rest of the server is configured as in any other
+// deployment. Variables already set in the process environment (the recipe's Setenv)
+// take precedence. Call it before anything reads the environment.
+func (c *Component) ApplyConfiguration() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	env, err := c.environment(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.config = env
+	names := make([]string, 0, len(env))
+	for name, value := range env {
+		if _, set := os.LookupEnv(name); set || value == "" {
+			continue
+		}
+		os.Setenv(name, value)
+		names = append(names, name)
+
+		// The log level is read before main starts
+		if name == "LOG_LEVEL" {
+			if err := logging.SetLevel(value); err != nil {
+				log.Printf("[Greengrass] ⚠️  %v", err)
+			}
+		}
+	}
+	sort.Strings(names)
+	log.Printf("[Greengrass] Applied %d settings from the component configuration: %s", len(names), strings.Join(names, ", "))
+	return nil
+}
+
+// environment reads the Environment entries of the component configuration.
+func (c *Component) environment(ctx context.Context) (map[string]string, error) {
+	client, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		ComponentName string         `json:"componentName"`
+		Value         map[string]any `json:"value"`
+	}
+	if err := client.call(ctx, opGetConfiguration, map[string]any{"keyPath": []string{}}, &resp); err != nil {
+		c.ipcErrors.Add(1)
+		return nil, fmt.Errorf("failed to read the component configuration: %w", err)
+	}
+
+	values, _ := resp.Value[environmentKey].(map[string]any)
+	env := make(map[string]string, len(values))
+	for name, value := range values {
+		switch v := value.(type) {
+		case string:
+			env[name] = v
+		case float64:
+			env[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			env[name] = strconv.FormatBool(v)
+		case nil:
+		default:
+			log.Printf("[Greengrass] ⚠️  Ignoring %s.%s: not a string, number or boolean", environmentKey, name)
+		}
+	}
+	return env, nil
+}
+
+// ReportState reports the component state to the nucleus if it changed.
+func (c *Component) ReportState(state string) error {
+	c.mutex.Lock()
+	unchanged := c.state == state
+	c.mutex.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	client, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.call(ctx, opUpdateState, map[string]string{"state": state}, nil); err != nil {
+		c.ipcErrors.Add(1)
+		return fmt.Errorf("failed to report state %s: %w", state, err)
+	}
+	c.mutex.Lock()
+	c.state = state
+	c.mutex.Unlock()
+	c.stateUpdates.Add(1)
+	log.Printf("[Greengrass] Reported component state %s", state)
+	return nil
+}
+
+// Run reports RUNNING, then checks the KVS pipelines of pool and reports ERRORED, so that
+// the nucleus restarts the component, once the pipeline of a stream has failed
+// GREENGRASS_ERROR_RESTARTS times in a row (default 5) for GREENGRASS_UNHEALTHY_TIMEOUT
+// seconds (default 300, 0 to never report ERRORED). It also logs changes of the component
+// configuration (applying LOG_LEVEL) until ctx is cancelled.
+func (c *Component) Run(ctx context.Context, pool *kvs.Pool) {
+	c.unhealthyTimeout = time.Duration(envInt("GREENGRASS_UNHEALTHY_TIMEOUT", 300)) * time.Second
+	c.failureThreshold = max(envInt("GREENGRASS_ERROR_RESTARTS", 5), 1)
+	if err := c.ReportState(StateRunning); err != nil {
+		log.Printf("[Greengrass] ⚠️  %v", err)
+	}
+	go c.watchConfiguration(ctx)
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	var unhealthySince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			c.mutex.Lock()
+			if c.client != nil {
+				c.client.Close()
+			}
+			c.mutex.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		failing := c.failingStreams(pool)
+		state := StateRunning
+		switch {
+		case len(failing) == 0:
+			unhealthySince = time.Time{}
+		case unhealthySince.IsZero():
+			unhealthySince = time.Now()
+		case c.unhealthyTimeout > 0 && time.Since(unhealthySince) >= c.unhealthyTimeout:
+			state = StateErrored
+			if c.currentState() != StateErrored {
+				log.Printf("[Greengrass] ⚠️  KVS pipelines failing for %s: %s", time.Since(unhealthySince).Round(time.Second), strings.Join(failing, ", "))
+			}
+		}
+		if err := c.ReportState(state); err != nil {
+			log.Printf("[Greengrass] ⚠️  %v", err)
+		}
+	}
+}
+
+// failingStreams returns the streams whose pipeline failed failureThreshold times in a
+// row without persisting a fragment.
+func (c *Component) failingStreams(pool *kvs.Pool) []string {
+	var failing []string
+	for _, f := range pool.Forwarders() {
+		if f.ErrorStats().Consecutive >= c.failureThreshold {
+			failing = append(failing, f.StreamName())
+		}
+	}
+	return failing
+}
+
+func (c *Component) currentState() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+// watchConfiguration subscribes to updates of the component configuration. LOG_LEVEL is
+// applied at once; other changes take effect when the component restarts.
+func (c *Component) watchConfiguration(ctx context.Context) {
+	for {
+		if err := c.subscribeConfiguration(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("[Greengrass] ⚠️  Configuration updates: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// subscribeConfiguration handles configuration updates until the connection fails.
+func (c *Component) subscribeConfiguration(ctx context.Context) error {
+	subscribeCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	client, err := c.connect(subscribeCtx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	updates, err := client.subscribe(subscribeCtx, opSubscribeToConfigUpdates, map[string]any{"keyPath": []string{environmentKey}})
+	cancel()
+	if err != nil {
+		c.ipcErrors.Add(1)
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-updates:
+			if !ok {
+				return client.closedErr()
+			}
+		}
+
+		requestCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		env, err := c.environment(requestCtx)
+		cancel()
+		if err != nil {
+			log.Printf("[Greengrass] ⚠️  %v", err)
+			continue
+		}
+		c.applyUpdate(env)
+	}
+}
+
+// applyUpdate handles a new Environment configuration.
+func (c *Component) applyUpdate(env map[string]string) {
+	var changed []string
+	for name, value := range env {
+		if previous, ok := c.config[name]; ok && previous == value {
+			continue
+		}
+		c.config[name] = value
+		if name == "LOG_LEVEL" {
+			if err := logging.SetLevel(value); err != nil {
+				log.Printf("[Greengrass] ⚠️  %v", err)
+				continue
+			}
+			log.Printf("[Greengrass] Log level set to %s", value)
+			continue
+		}
+		changed = append(changed, name)
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		log.Printf("[Greengrass] Configuration changed (%s), restart the component to apply it", strings.Join(changed, ", "))
+	}
+}
+
+// CollectMetrics writes the Greengrass IPC counters.
+func (c *Component) CollectMetrics(w *metrics.Writer) {
+	errored := 0.0
+	if c.currentState() == StateErrored {
+		errored = 1
+	}
+	w.Gauge("rtmp_greengrass_errored", "1 while the component reports ERRORED to the Greengrass nucleus", errored)
+	w.Counter("rtmp_greengrass_state_updates_total", "Component state changes reported to the Greengrass nucleus", float64(c.stateUpdates.Load()))
+	w.Counter("rtmp_greengrass_ipc_errors_total", "Failed Greengrass IPC connections and operations", float64(c.ipcErrors.Load()))
+}
+
+// envInt reads a non-negative integer environment variable, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("[Greengrass] ⚠️  Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,289 @@
+// Package greengrass integrates the server with AWS IoT Greengrass v2: it reads the
+// component configuration and reports the component state over Greengrass IPC.
+package greengrass
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Event stream RPC message types (:message-type)
+const (
+	messageApplication      = 0
+	messageApplicationError = 1
+	messagePing             = 2
+	messagePingResponse     = 3
+	messageConnect          = 4
+	messageConnectAck       = 5
+	messageProtocolError    = 6
+	messageInternalError    = 7
+)
+
+// Event stream RPC message flags (:message-flags)
+const (
+	flagConnectionAccepted = 1
+	flagTerminateStream    = 2
+)
+
+// Version of the event stream RPC protocol sent on connect
+const rpcVersion = "0.1.0"
+
+// A write stalled for this long fails the connection
+const writeTimeout = 10 * time.Second
+
+// ipcClient is a minimal Greengrass IPC (event stream RPC) client: JSON requests on
+// numbered streams over the nucleus' Unix socket. It supports request/response
+// operations and subscriptions.
+type ipcClient struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	lastID  int32
+	streams map[int32]chan *message
+	err     error         // why the connection closed
+	closed  chan struct{} // closed when the connection fails
+}
+
+// ipcError is an error returned by an IPC operation, e.g. aws.greengrass#ResourceNotFoundError.
+type ipcError struct {
+	Type    string
+	Message string
+}
+
+func (e *ipcError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// dialIPC connects to the nucleus socket and authenticates with the component's SVCUID.
+func dialIPC(ctx context.Context, socketPath, authToken string) (*ipcClient, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &ipcClient{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		streams: make(map[int32]chan *message),
+		closed:  make(chan struct{}),
+	}
+
+	payload, _ := json.Marshal(map[string]string{"authToken": authToken})
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	err = c.write(message{
+		headers: []header{
+			{":message-type", int32(messageConnect)},
+			{":message-flags", int32(0)},
+			{":stream-id", int32(0)},
+			{":version", rpcVersion},
+		},
+		payload: payload,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack, err := readMessage(c.r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read connect response: %w", err)
+	}
+	if ack.int32Header(":message-type") != messageConnectAck || ack.int32Header(":message-flags")&flagConnectionAccepted == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection rejected by the nucleus: %s", ack.payload)
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	return c, nil
+}
+
+// write sends a message.
+func (c *ipcClient) write(m message) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeMessage(c.conn, m)
+}
+
+// readLoop dispatches the messages of the nucleus to their streams until the connection
+// fails.
+func (c *ipcClient) readLoop() {
+	var err error
+	for {
+		var m *message
+		if m, err = readMessage(c.r); err != nil {
+			break
+		}
+		switch m.int32Header(":message-type") {
+		case messagePing:
+			c.write(message{headers: []header{{":message-type", int32(messagePingResponse)}}, payload: m.payload})
+			continue
+		case messageProtocolError, messageInternalError:
+			err = fmt.Errorf("nucleus reported an error: %s", m.payload)
+		case messageApplication, messageApplicationError:
+			c.dispatch(m)
+			continue
+		default:
+			continue
+		}
+		break
+	}
+
+	c.mutex.Lock()
+	c.err = err
+	for id, ch := range c.streams {
+		close(ch)
+		delete(c.streams, id)
+	}
+	c.mutex.Unlock()
+	close(c.closed)
+	c.conn.Close()
+}
+
+// dispatch delivers a message to its stream. A stream that does not keep up loses
+// messages rather than blocking the connection.
+func (c *ipcClient) dispatch(m *message) {
+	id := m.int32Header(":stream-id")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch, ok := c.streams[id]
+	if !ok {
+		return
+	}
+	select {
+	case ch <- m:
+	default:
+	}
+	if m.int32Header(":message-flags")&flagTerminateStream != 0 {
+		close(ch)
+		delete(c.streams, id)
+	}
+}
+
+// open starts an operation on a new stream and returns the channel of its messages.
+func (c *ipcClient) open(operation string, request any) (int32, chan *message, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	ch := make(chan *message, 16)
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return 0, nil, c.err
+	}
+	c.lastID++
+	id := c.lastID
+	c.streams[id] = ch
+	c.mutex.Unlock()
+
+	err = c.write(message{
+		headers: []header{
+			{":message-type", int32(messageApplication)},
+			{":message-flags", int32(0)},
+			{":stream-id", id},
+			{"operation", operation},
+			{"service-model-type", operation + "Request"},
+			{":content-type", "application/json"},
+		},
+		payload: payload,
+	})
+	if err != nil {
+		c.closeStream(id)
+		return 0, nil, err
+	}
+	return id, ch, nil
+}
+
+// closeStream stops delivering the messages of a stream.
+func (c *ipcClient) closeStream(id int32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ch, ok := c.streams[id]; ok {
+		close(ch)
+		delete(c.streams, id)
+	}
+}
+
+// receive waits for the next message of a stream and decodes it into out.
+func (c *ipcClient) receive(ctx context.Context, ch <-chan *message, out any) error {
+	select {
+	case m, ok := <-ch:
+		if !ok {
+			return c.closedErr()
+		}
+		return decodeResponse(m, out)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// call sends a request and decodes the response into out (nil to ignore it).
+func (c *ipcClient) call(ctx context.Context, operation string, request, out any) error {
+	id, ch, err := c.open(operation, request)
+	if err != nil {
+		return err
+	}
+	defer c.closeStream(id)
+	return c.receive(ctx, ch, out)
+}
+
+// subscribe starts a subscription and returns the channel of its events, which is closed
+// when the connection fails.
+func (c *ipcClient) subscribe(ctx context.Context, operation string, request any) (<-chan *message, error) {
+	id, ch, err := c.open(operation, request)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.receive(ctx, ch, nil); err != nil {
+		c.closeStream(id)
+		return nil, err
+	}
+	return ch, nil
+}
+
+// closedErr is the error of operations on a failed connection.
+func (c *ipcClient) closedErr() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return fmt.Errorf("IPC connection closed: %w", c.err)
+	}
+	return errors.New("IPC stream closed")
+}
+
+// Close closes the connection.
+func (c *ipcClient) Close() error {
+	return c.conn.Close()
+}
+
+// decodeResponse decodes an application message into out, or returns the error of an
+// application error message.
+func decodeResponse(m *message, out any) error {
+	if m.int32Header(":message-type") == messageApplicationError {
+		var body struct {
+			Message  string `json:"message"`
+			Message2 string `json:"_message"`
+		}
+		json.Unmarshal(m.payload, &body)
+		if body.Message == "" {
+			body.Message = body.Message2
+		}
+		return &ipcError{Type: m.stringHeader("service-model-type"), Message: body.Message}
+	}
+	if out == nil || len(m.payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(m.payload, out)
+}
@@ -0,0 +1,840 @@
+// Control API of the RTMP server for other backend services (-grpc).
+//
+// The Go code in this directory is generated from this file:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	    --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: control.proto
+
+package controlpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ListStreamsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListStreamsRequest) Reset() {
+	*x = ListStreamsRequest{}
+	mi := &file_control_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListStreamsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListStreamsRequest) ProtoMessage() {}
+
+func (x *ListStreamsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListStreamsRequest.ProtoReflect.Descriptor instead.
+func (*ListStreamsRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{0}
+}
+
+type ListStreamsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Streams       []*StreamStats         `protobuf:"bytes,1,rep,name=streams,proto3" json:"streams,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListStreamsResponse) Reset() {
+	*x = ListStreamsResponse{}
+	mi := &file_control_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListStreamsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListStreamsResponse) ProtoMessage() {}
+
+func (x *ListStreamsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListStreamsResponse.ProtoReflect.Descriptor instead.
+func (*ListStreamsResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ListStreamsResponse) GetStreams() []*StreamStats {
+	if x != nil {
+		return x.Streams
+	}
+	return nil
+}
+
+type GetStreamStatsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Publish path, e.g. /live/cam1
+	StreamPath string `protobuf:"bytes,1,opt,name=stream_path,json=streamPath,proto3" json:"stream_path,omitempty"`
+	// Seconds between updates, default 1
+	IntervalSeconds uint32 `protobuf:"varint,2,opt,name=interval_seconds,json=intervalSeconds,proto3" json:"interval_seconds,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *GetStreamStatsRequest) Reset() {
+	*x = GetStreamStatsRequest{}
+	mi := &file_control_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStreamStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStreamStatsRequest) ProtoMessage() {}
+
+func (x *GetStreamStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStreamStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStreamStatsRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *GetStreamStatsRequest) GetStreamPath() string {
+	if x != nil {
+		return x.StreamPath
+	}
+	return ""
+}
+
+func (x *GetStreamStatsRequest) GetIntervalSeconds() uint32 {
+	if x != nil {
+		return x.IntervalSeconds
+	}
+	return 0
+}
+
+type DisconnectRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	StreamPath    string                 `protobuf:"bytes,1,opt,name=stream_path,json=streamPath,proto3" json:"stream_path,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DisconnectRequest) Reset() {
+	*x = DisconnectRequest{}
+	mi := &file_control_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DisconnectRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DisconnectRequest) ProtoMessage() {}
+
+func (x *DisconnectRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DisconnectRequest.ProtoReflect.Descriptor instead.
+func (*DisconnectRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *DisconnectRequest) GetStreamPath() string {
+	if x != nil {
+		return x.StreamPath
+	}
+	return ""
+}
+
+type DisconnectResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DisconnectResponse) Reset() {
+	*x = DisconnectResponse{}
+	mi := &file_control_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DisconnectResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DisconnectResponse) ProtoMessage() {}
+
+func (x *DisconnectResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DisconnectResponse.ProtoReflect.Descriptor instead.
+func (*DisconnectResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{4}
+}
+
+type UpdateStreamConfigRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// KVS stream name
+	StreamName    string        `protobuf:"bytes,1,opt,name=stream_name,json=streamName,proto3" json:"stream_name,omitempty"`
+	Config        *StreamConfig `protobuf:"bytes,2,opt,name=config,proto3" json:"config,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateStreamConfigRequest) Reset() {
+	*x = UpdateStreamConfigRequest{}
+	mi := &file_control_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateStreamConfigRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateStreamConfigRequest) ProtoMessage() {}
+
+func (x *UpdateStreamConfigRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateStreamConfigRequest.ProtoReflect.Descriptor instead.
+func (*UpdateStreamConfigRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *UpdateStreamConfigRequest) GetStreamName() string {
+	if x != nil {
+		return x.StreamName
+	}
+	return ""
+}
+
+func (x *UpdateStreamConfigRequest) GetConfig() *StreamConfig {
+	if x != nil {
+		return x.Config
+	}
+	return nil
+}
+
+// Statistics of a publisher's session (GET /stats on the admin port).
+type StreamStats struct {
+	state                    protoimpl.MessageState `protogen:"open.v1"`
+	SessionId                string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	StreamPath               string                 `protobuf:"bytes,2,opt,name=stream_path,json=streamPath,proto3" json:"stream_path,omitempty"`
+	StreamName               string                 `protobuf:"bytes,3,opt,name=stream_name,json=streamName,proto3" json:"stream_name,omitempty"`
+	CameraId                 string                 `protobuf:"bytes,4,opt,name=camera_id,json=cameraId,proto3" json:"camera_id,omitempty"`
+	RemoteAddr               string                 `protobuf:"bytes,5,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+	Protocol                 string                 `protobuf:"bytes,6,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	StartedAt                *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=started_at,json=startedAt,proto3" json:"started_at,omitempty"`
+	UptimeSeconds            float64                `protobuf:"fixed64,8,opt,name=uptime_seconds,json=uptimeSeconds,proto3" json:"uptime_seconds,omitempty"`
+	LastFrameAt              *timestamppb.Timestamp `protobuf:"bytes,9,opt,name=last_frame_at,json=lastFrameAt,proto3" json:"last_frame_at,omitempty"`
+	Frames                   uint64                 `protobuf:"varint,10,opt,name=frames,proto3" json:"frames,omitempty"`
+	Bytes                    uint64                 `protobuf:"varint,11,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	Keyframes                uint64                 `protobuf:"varint,12,opt,name=keyframes,proto3" json:"keyframes,omitempty"`
+	DroppedFrames            uint64                 `protobuf:"varint,13,opt,name=dropped_frames,json=droppedFrames,proto3" json:"dropped_frames,omitempty"`
+	BitrateKbps              float64                `protobuf:"fixed64,14,opt,name=bitrate_kbps,json=bitrateKbps,proto3" json:"bitrate_kbps,omitempty"`
+	Fps                      float64                `protobuf:"fixed64,15,opt,name=fps,proto3" json:"fps,omitempty"`
+	KeyframeIntervalSeconds  float64                `protobuf:"fixed64,16,opt,name=keyframe_interval_seconds,json=keyframeIntervalSeconds,proto3" json:"keyframe_interval_seconds,omitempty"`
+	LastKeyframeAt           *timestamppb.Timestamp `protobuf:"bytes,17,opt,name=last_keyframe_at,json=lastKeyframeAt,proto3" json:"last_keyframe_at,omitempty"`
+	Width                    int32                  `protobuf:"varint,18,opt,name=width,proto3" json:"width,omitempty"`
+	Height                   int32                  `protobuf:"varint,19,opt,name=height,proto3" json:"height,omitempty"`
+	VideoCodec               string                 `protobuf:"bytes,20,opt,name=video_codec,json=videoCodec,proto3" json:"video_codec,omitempty"`
+	Profile                  string                 `protobuf:"bytes,21,opt,name=profile,proto3" json:"profile,omitempty"`
+	Level                    string                 `protobuf:"bytes,22,opt,name=level,proto3" json:"level,omitempty"`
+	Readers                  int32                  `protobuf:"varint,23,opt,name=readers,proto3" json:"readers,omitempty"`
+	AudioCodec               string                 `protobuf:"bytes,24,opt,name=audio_codec,json=audioCodec,proto3" json:"audio_codec,omitempty"`
+	ForwardingPaused         bool                   `protobuf:"varint,25,opt,name=forwarding_paused,json=forwardingPaused,proto3" json:"forwarding_paused,omitempty"`
+	GatedFrames              uint64                 `protobuf:"varint,26,opt,name=gated_frames,json=gatedFrames,proto3" json:"gated_frames,omitempty"`
+	QueueDepth               int32                  `protobuf:"varint,27,opt,name=queue_depth,json=queueDepth,proto3" json:"queue_depth,omitempty"`
+	QueueCapacity            int32                  `protobuf:"varint,28,opt,name=queue_capacity,json=queueCapacity,proto3" json:"queue_capacity,omitempty"`
+	QueueHighWatermarks      uint64                 `protobuf:"varint,29,opt,name=queue_high_watermarks,json=queueHighWatermarks,proto3" json:"queue_high_watermarks,omitempty"`
+	TimestampDiscontinuities uint64                 `protobuf:"varint,30,opt,name=timestamp_discontinuities,json=timestampDiscontinuities,proto3" json:"timestamp_discontinuities,omitempty"`
+	ClockDriftMs             int64                  `protobuf:"varint,31,opt,name=clock_drift_ms,json=clockDriftMs,proto3" json:"clock_drift_ms,omitempty"`
+	unknownFields            protoimpl.UnknownFields
+	sizeCache                protoimpl.SizeCache
+}
+
+func (x *StreamStats) Reset() {
+	*x = StreamStats{}
+	mi := &file_control_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamStats) ProtoMessage() {}
+
+func (x *StreamStats) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamStats.ProtoReflect.Descriptor instead.
+func (*StreamStats) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *StreamStats) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *StreamStats) GetStreamPath() string {
+	if x != nil {
+		return x.StreamPath
+	}
+	return ""
+}
+
+func (x *StreamStats) GetStreamName() string {
+	if x != nil {
+		return x.StreamName
+	}
+	return ""
+}
+
+func (x *StreamStats) GetCameraId() string {
+	if x != nil {
+		return x.CameraId
+	}
+	return ""
+}
+
+func (x *StreamStats) GetRemoteAddr() string {
+	if x != nil {
+		return x.RemoteAddr
+	}
+	return ""
+}
+
+func (x *StreamStats) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+func (x *StreamStats) GetStartedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.StartedAt
+	}
+	return nil
+}
+
+func (x *StreamStats) GetUptimeSeconds() float64 {
+	if x != nil {
+		return x.UptimeSeconds
+	}
+	return 0
+}
+
+func (x *StreamStats) GetLastFrameAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastFrameAt
+	}
+	return nil
+}
+
+func (x *StreamStats) GetFrames() uint64 {
+	if x != nil {
+		return x.Frames
+	}
+	return 0
+}
+
+func (x *StreamStats) GetBytes() uint64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+func (x *StreamStats) GetKeyframes() uint64 {
+	if x != nil {
+		return x.Keyframes
+	}
+	return 0
+}
+
+func (x *StreamStats) GetDroppedFrames() uint64 {
+	if x != nil {
+		return x.DroppedFrames
+	}
+	return 0
+}
+
+func (x *StreamStats) GetBitrateKbps() float64 {
+	if x != nil {
+		return x.BitrateKbps
+	}
+	return 0
+}
+
+func (x *StreamStats) GetFps() float64 {
+	if x != nil {
+		return x.Fps
+	}
+	return 0
+}
+
+func (x *StreamStats) GetKeyframeIntervalSeconds() float64 {
+	if x != nil {
+		return x.KeyframeIntervalSeconds
+	}
+	return 0
+}
+
+func (x *StreamStats) GetLastKeyframeAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastKeyframeAt
+	}
+	return nil
+}
+
+func (x *StreamStats) GetWidth() int32 {
+	if x != nil {
+		return x.Width
+	}
+	return 0
+}
+
+func (x *StreamStats) GetHeight() int32 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+func (x *StreamStats) GetVideoCodec() string {
+	if x != nil {
+		return x.VideoCodec
+	}
+	return ""
+}
+
+func (x *StreamStats) GetProfile() string {
+	if x != nil {
+		return x.Profile
+	}
+	return ""
+}
+
+func (x *StreamStats) GetLevel() string {
+	if x != nil {
+		return x.Level
+	}
+	return ""
+}
+
+func (x *StreamStats) GetReaders() int32 {
+	if x != nil {
+		return x.Readers
+	}
+	return 0
+}
+
+func (x *StreamStats) GetAudioCodec() string {
+	if x != nil {
+		return x.AudioCodec
+	}
+	return ""
+}
+
+func (x *StreamStats) GetForwardingPaused() bool {
+	if x != nil {
+		return x.ForwardingPaused
+	}
+	return false
+}
+
+func (x *StreamStats) GetGatedFrames() uint64 {
+	if x != nil {
+		return x.GatedFrames
+	}
+	return 0
+}
+
+func (x *StreamStats) GetQueueDepth() int32 {
+	if x != nil {
+		return x.QueueDepth
+	}
+	return 0
+}
+
+func (x *StreamStats) GetQueueCapacity() int32 {
+	if x != nil {
+		return x.QueueCapacity
+	}
+	return 0
+}
+
+func (x *StreamStats) GetQueueHighWatermarks() uint64 {
+	if x != nil {
+		return x.QueueHighWatermarks
+	}
+	return 0
+}
+
+func (x *StreamStats) GetTimestampDiscontinuities() uint64 {
+	if x != nil {
+		return x.TimestampDiscontinuities
+	}
+	return 0
+}
+
+func (x *StreamStats) GetClockDriftMs() int64 {
+	if x != nil {
+		return x.ClockDriftMs
+	}
+	return 0
+}
+
+// kvssink settings of a KVS stream (STREAM_CONFIG_FILE).
+type StreamConfig struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	RetentionHours     int32                  `protobuf:"varint,1,opt,name=retention_hours,json=retentionHours,proto3" json:"retention_hours,omitempty"`
+	FragmentDurationMs int32                  `protobuf:"varint,2,opt,name=fragment_duration_ms,json=fragmentDurationMs,proto3" json:"fragment_duration_ms,omitempty"`
+	StorageSizeMb      int32                  `protobuf:"varint,3,opt,name=storage_size_mb,json=storageSizeMb,proto3" json:"storage_size_mb,omitempty"`
+	MaxBitrateKbps     int32                  `protobuf:"varint,4,opt,name=max_bitrate_kbps,json=maxBitrateKbps,proto3" json:"max_bitrate_kbps,omitempty"`
+	RoleArn            string                 `protobuf:"bytes,5,opt,name=role_arn,json=roleArn,proto3" json:"role_arn,omitempty"`
+	ExternalId         string                 `protobuf:"bytes,6,opt,name=external_id,json=externalId,proto3" json:"external_id,omitempty"`
+	KmsKeyId           string                 `protobuf:"bytes,7,opt,name=kms_key_id,json=kmsKeyId,proto3" json:"kms_key_id,omitempty"`
+	Sinks              []string               `protobuf:"bytes,8,rep,name=sinks,proto3" json:"sinks,omitempty"`
+	RelayUrl           string                 `protobuf:"bytes,9,opt,name=relay_url,json=relayUrl,proto3" json:"relay_url,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *StreamConfig) Reset() {
+	*x = StreamConfig{}
+	mi := &file_control_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamConfig) ProtoMessage() {}
+
+func (x *StreamConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamConfig.ProtoReflect.Descriptor instead.
+func (*StreamConfig) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *StreamConfig) GetRetentionHours() int32 {
+	if x != nil {
+		return x.RetentionHours
+	}
+	return 0
+}
+
+func (x *StreamConfig) GetFragmentDurationMs() int32 {
+	if x != nil {
+		return x.FragmentDurationMs
+	}
+	return 0
+}
+
+func (x *StreamConfig) GetStorageSizeMb() int32 {
+	if x != nil {
+		return x.StorageSizeMb
+	}
+	return 0
+}
+
+func (x *StreamConfig) GetMaxBitrateKbps() int32 {
+	if x != nil {
+		return x.MaxBitrateKbps
+	}
+	return 0
+}
+
+func (x *StreamConfig) GetRoleArn() string {
+	if x != nil {
+		return x.RoleArn
+	}
+	return ""
+}
+
+func (x *StreamConfig) GetExternalId() string {
+	if x != nil {
+		return x.ExternalId
+	}
+	return ""
+}
+
+func (x *StreamConfig) GetKmsKeyId() string {
+	if x != nil {
+		return x.KmsKeyId
+	}
+	return ""
+}
+
+func (x *StreamConfig) GetSinks() []string {
+	if x != nil {
+		return x.Sinks
+	}
+	return nil
+}
+
+func (x *StreamConfig) GetRelayUrl() string {
+	if x != nil {
+		return x.RelayUrl
+	}
+	return ""
+}
+
+var File_control_proto protoreflect.FileDescriptor
+
+const file_control_proto_rawDesc = "" +
+	"\n" +
+	"\rcontrol.proto\x12\x12rtmpkvs.control.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\x14\n" +
+	"\x12ListStreamsRequest\"P\n" +
+	"\x13ListStreamsResponse\x129\n" +
+	"\astreams\x18\x01 \x03(\v2\x1f.rtmpkvs.control.v1.StreamStatsR\astreams\"c\n" +
+	"\x15GetStreamStatsRequest\x12\x1f\n" +
+	"\vstream_path\x18\x01 \x01(\tR\n" +
+	"streamPath\x12)\n" +
+	"\x10interval_seconds\x18\x02 \x01(\rR\x0fintervalSeconds\"4\n" +
+	"\x11DisconnectRequest\x12\x1f\n" +
+	"\vstream_path\x18\x01 \x01(\tR\n" +
+	"streamPath\"\x14\n" +
+	"\x12DisconnectResponse\"v\n" +
+	"\x19UpdateStreamConfigRequest\x12\x1f\n" +
+	"\vstream_name\x18\x01 \x01(\tR\n" +
+	"streamName\x128\n" +
+	"\x06config\x18\x02 \x01(\v2 .rtmpkvs.control.v1.StreamConfigR\x06config\"\xfd\b\n" +
+	"\vStreamStats\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x12\x1f\n" +
+	"\vstream_path\x18\x02 \x01(\tR\n" +
+	"streamPath\x12\x1f\n" +
+	"\vstream_name\x18\x03 \x01(\tR\n" +
+	"streamName\x12\x1b\n" +
+	"\tcamera_id\x18\x04 \x01(\tR\bcameraId\x12\x1f\n" +
+	"\vremote_addr\x18\x05 \x01(\tR\n" +
+	"remoteAddr\x12\x1a\n" +
+	"\bprotocol\x18\x06 \x01(\tR\bprotocol\x129\n" +
+	"\n" +
+	"started_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\tstartedAt\x12%\n" +
+	"\x0euptime_seconds\x18\b \x01(\x01R\ruptimeSeconds\x12>\n" +
+	"\rlast_frame_at\x18\t \x01(\v2\x1a.google.protobuf.TimestampR\vlastFrameAt\x12\x16\n" +
+	"\x06frames\x18\n" +
+	" \x01(\x04R\x06frames\x12\x14\n" +
+	"\x05bytes\x18\v \x01(\x04R\x05bytes\x12\x1c\n" +
+	"\tkeyframes\x18\f \x01(\x04R\tkeyframes\x12%\n" +
+	"\x0edropped_frames\x18\r \x01(\x04R\rdroppedFrames\x12!\n" +
+	"\fbitrate_kbps\x18\x0e \x01(\x01R\vbitrateKbps\x12\x10\n" +
+	"\x03fps\x18\x0f \x01(\x01R\x03fps\x12:\n" +
+	"\x19keyframe_interval_seconds\x18\x10 \x01(\x01R\x17keyframeIntervalSeconds\x12D\n" +
+	"\x10last_keyframe_at\x18\x11 \x01(\v2\x1a.google.protobuf.TimestampR\x0elastKeyframeAt\x12\x14\n" +
+	"\x05width\x18\x12 \x01(\x05R\x05width\x12\x16\n" +
+	"\x06height\x18\x13 \x01(\x05R\x06height\x12\x1f\n" +
+	"\vvideo_codec\x18\x14 \x01(\tR\n" +
+	"videoCodec\x12\x18\n" +
+	"\aprofile\x18\x15 \x01(\tR\aprofile\x12\x14\n" +
+	"\x05level\x18\x16 \x01(\tR\x05level\x12\x18\n" +
+	"\areaders\x18\x17 \x01(\x05R\areaders\x12\x1f\n" +
+	"\vaudio_codec\x18\x18 \x01(\tR\n" +
+	"audioCodec\x12+\n" +
+	"\x11forwarding_paused\x18\x19 \x01(\bR\x10forwardingPaused\x12!\n" +
+	"\fgated_frames\x18\x1a \x01(\x04R\vgatedFrames\x12\x1f\n" +
+	"\vqueue_depth\x18\x1b \x01(\x05R\n" +
+	"queueDepth\x12%\n" +
+	"\x0equeue_capacity\x18\x1c \x01(\x05R\rqueueCapacity\x122\n" +
+	"\x15queue_high_watermarks\x18\x1d \x01(\x04R\x13queueHighWatermarks\x12;\n" +
+	"\x19timestamp_discontinuities\x18\x1e \x01(\x04R\x18timestampDiscontinuities\x12$\n" +
+	"\x0eclock_drift_ms\x18\x1f \x01(\x03R\fclockDriftMs\"\xc8\x02\n" +
+	"\fStreamConfig\x12'\n" +
+	"\x0fretention_hours\x18\x01 \x01(\x05R\x0eretentionHours\x120\n" +
+	"\x14fragment_duration_ms\x18\x02 \x01(\x05R\x12fragmentDurationMs\x12&\n" +
+	"\x0fstorage_size_mb\x18\x03 \x01(\x05R\rstorageSizeMb\x12(\n" +
+	"\x10max_bitrate_kbps\x18\x04 \x01(\x05R\x0emaxBitrateKbps\x12\x19\n" +
+	"\brole_arn\x18\x05 \x01(\tR\aroleArn\x12\x1f\n" +
+	"\vexternal_id\x18\x06 \x01(\tR\n" +
+	"externalId\x12\x1c\n" +
+	"\n" +
+	"kms_key_id\x18\a \x01(\tR\bkmsKeyId\x12\x14\n" +
+	"\x05sinks\x18\b \x03(\tR\x05sinks\x12\x1b\n" +
+	"\trelay_url\x18\t \x01(\tR\brelayUrl2\x8d\x03\n" +
+	"\aControl\x12^\n" +
+	"\vListStreams\x12&.rtmpkvs.control.v1.ListStreamsRequest\x1a'.rtmpkvs.control.v1.ListStreamsResponse\x12^\n" +
+	"\x0eGetStreamStats\x12).rtmpkvs.control.v1.GetStreamStatsRequest\x1a\x1f.rtmpkvs.control.v1.StreamStats0\x01\x12[\n" +
+	"\n" +
+	"Disconnect\x12%.rtmpkvs.control.v1.DisconnectRequest\x1a&.rtmpkvs.control.v1.DisconnectResponse\x12e\n" +
+	"\x12UpdateStreamConfig\x12-.rtmpkvs.control.v1.UpdateStreamConfigRequest\x1a .rtmpkvs.control.v1.StreamConfigB\x1cZ\x1artmp_kvs/grpcapi/controlpbb\x06proto3"
+
+var (
+	file_control_proto_rawDescOnce sync.Once
+	file_control_proto_rawDescData []byte
+)
+
+func file_control_proto_rawDescGZIP() []byte {
+	file_control_proto_rawDescOnce.Do(func() {
+		file_control_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_control_proto_rawDesc), len(file_control_proto_rawDesc)))
+	})
+	return file_control_proto_rawDescData
+}
+
+var file_control_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_control_proto_goTypes = []any{
+	(*ListStreamsRequest)(nil),        // 0: rtmpkvs.control.v1.ListStreamsRequest
+	(*ListStreamsResponse)(nil),       // 1: rtmpkvs.control.v1.ListStreamsResponse
+	(*GetStreamStatsRequest)(nil),     // 2: rtmpkvs.control.v1.GetStreamStatsRequest
+	(*DisconnectRequest)(nil),         // 3: rtmpkvs.control.v1.DisconnectRequest
+	(*DisconnectResponse)(nil),        // 4: rtmpkvs.control.v1.DisconnectResponse
+	(*UpdateStreamConfigRequest)(nil), // 5: rtmpkvs.control.v1.UpdateStreamConfigRequest
+	(*StreamStats)(nil),               // 6: rtmpkvs.control.v1.StreamStats
+	(*StreamConfig)(nil),              // 7: rtmpkvs.control.v1.StreamConfig
+	(*timestamppb.Timestamp)(nil),     // 8: google.protobuf.Timestamp
+}
+var file_control_proto_depIdxs = []int32{
+	6, // 0: rtmpkvs.control.v1.ListStreamsResponse.streams:type_name -> rtmpkvs.control.v1.StreamStats
+	7, // 1: rtmpkvs.control.v1.UpdateStreamConfigRequest.config:type_name -> rtmpkvs.control.v1.StreamConfig
+	8, // 2: rtmpkvs.control.v1.StreamStats.started_at:type_name -> google.protobuf.Timestamp
+	8, // 3: rtmpkvs.control.v1.StreamStats.last_frame_at:type_name -> google.protobuf.Timestamp
+	8, // 4: rtmpkvs.control.v1.StreamStats.last_keyframe_at:type_name -> google.protobuf.Timestamp
+	0, // 5: rtmpkvs.control.v1.Control.ListStreams:input_type -> rtmpkvs.control.v1.ListStreamsRequest
+	2, // 6: rtmpkvs.control.v1.Control.GetStreamStats:input_type -> rtmpkvs.control.v1.GetStreamStatsRequest
+	3, // 7: rtmpkvs.control.v1.Control.Disconnect:input_type -> rtmpkvs.control.v1.DisconnectRequest
+	5, // 8: rtmpkvs.control.v1.Control.UpdateStreamConfig:input_type -> rtmpkvs.control.v1.UpdateStreamConfigRequest
+	1, // 9: rtmpkvs.control.v1.Control.ListStreams:output_type -> rtmpkvs.control.v1.ListStreamsResponse
+	6, // 10: rtmpkvs.control.v1.Control.GetStreamStats:output_type -> rtmpkvs.control.v1.StreamStats
+	4, // 11: rtmpkvs.control.v1.Control.Disconnect:output_type -> rtmpkvs.control.v1.DisconnectResponse
+	7, // 12: rtmpkvs.control.v1.Control.UpdateStreamConfig:output_type -> rtmpkvs.control.v1.StreamConfig
+	9, // [9:13] is the sub-list for method output_type
+	5, // [5:9] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_control_proto_init() }
+func file_control_proto_init() {
+	if File_control_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_control_proto_rawDesc), len(file_control_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_control_proto_goTypes,
+		DependencyIndexes: file_control_proto_depIdxs,
+		MessageInfos:      file_control_proto_msgTypes,
+	}.Build()
+	File_control_proto = out.File
+	file_control_proto_goTypes = nil
+	file_control_proto_depIdxs = nil
+}
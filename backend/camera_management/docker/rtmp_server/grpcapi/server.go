@@ -0,0 +1,280 @@
+// Package grpcapi implements the gRPC control API (package controlpb) for other backend
+// services: stream listing and statistics, disconnecting publishers and per-stream
+// kvssink settings.
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"rtmp_kvs/grpcapi/controlpb"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/server"
+)
+
+const (
+	// Default and shortest interval of GetStreamStats updates
+	defaultStatsInterval = time.Second
+	minStatsInterval     = 100 * time.Millisecond
+	// Time in-flight calls get to finish on shutdown
+	stopTimeout = 5 * time.Second
+)
+
+// Server is the gRPC control server.
+type Server struct {
+	controlpb.UnimplementedControlServer
+
+	addr string
+	lc   net.ListenConfig
+	rtmp *server.Server
+	pool *kvs.Pool
+
+	token string // bearer token clients must send (GRPC_AUTH_TOKEN), empty for none
+	srv   *grpc.Server
+	ln    net.Listener
+
+	done     chan struct{} // closed by Close, ends the stats streams
+	stopOnce sync.Once
+}
+
+// New creates a gRPC control server listening on addr. GRPC_AUTH_TOKEN, if set, is the
+// bearer token clients must send in the authorization metadata.
+func New(addr string, rtmp *server.Server, pool *kvs.Pool) *Server {
+	s := &Server{
+		addr:  addr,
+		rtmp:  rtmp,
+		pool:  pool,
+		token: os.Getenv("GRPC_AUTH_TOKEN"),
+		done:  make(chan struct{}),
+	}
+	s.srv = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.authorizeUnary),
+		grpc.ChainStreamInterceptor(s.authorizeStream),
+	)
+	controlpb.RegisterControlServer(s.srv, s)
+	return s
+}
+
+// SetListenConfig sets how the port is bound (e.g. with SO_REUSEPORT). It must be called
+// before Start.
+func (s *Server) SetListenConfig(lc net.ListenConfig) {
+	s.lc = lc
+}
+
+// Start binds the port. Calls are served by Serve.
+func (s *Server) Start() error {
+	ln, err := s.lc.Listen(context.Background(), "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	if s.token == "" {
+		log.Printf("[gRPC] Control API listening on %s (no GRPC_AUTH_TOKEN, unauthenticated)", s.addr)
+	} else {
+		log.Printf("[gRPC] Control API listening on %s", s.addr)
+	}
+	return nil
+}
+
+// Serve serves calls until ctx is cancelled or Close is called, and returns an error if
+// the listener failed.
+func (s *Server) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, s.Close)
+	defer stop()
+	if err := s.srv.Serve(s.ln); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("gRPC server failed: %w", err)
+	}
+	return nil
+}
+
+// Close ends the stats streams and stops the server, giving unary calls a few seconds to
+// finish.
+func (s *Server) Close() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		stopped := make(chan struct{})
+		go func() {
+			s.srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(stopTimeout):
+			s.srv.Stop()
+		}
+	})
+}
+
+// authorize checks the bearer token of a call.
+func (s *Server) authorize(ctx context.Context) error {
+	if s.token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(value, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+}
+
+func (s *Server) authorizeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) authorizeStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// ListStreams implements controlpb.ControlServer.
+func (s *Server) ListStreams(ctx context.Context, req *controlpb.ListStreamsRequest) (*controlpb.ListStreamsResponse, error) {
+	resp := &controlpb.ListStreamsResponse{}
+	for _, st := range s.rtmp.Stats() {
+		resp.Streams = append(resp.Streams, streamStats(st))
+	}
+	return resp, nil
+}
+
+// GetStreamStats implements controlpb.ControlServer. The stream ends when the session
+// it started with ends, so a reconnecting publisher needs a new call.
+func (s *Server) GetStreamStats(req *controlpb.GetStreamStatsRequest, stream controlpb.Control_GetStreamStatsServer) error {
+	interval := defaultStatsInterval
+	if req.IntervalSeconds > 0 {
+		interval = time.Duration(req.IntervalSeconds) * time.Second
+	}
+	interval = max(interval, minStatsInterval)
+
+	st, ok := s.rtmp.SessionStats(req.StreamPath)
+	if !ok {
+		return status.Errorf(codes.NotFound, "no publisher on %s", req.StreamPath)
+	}
+	sessionID := st.SessionID
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(streamStats(st)); err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return nil
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+		st, ok = s.rtmp.SessionStats(req.StreamPath)
+		if !ok || st.SessionID != sessionID {
+			return nil
+		}
+	}
+}
+
+// Disconnect implements controlpb.ControlServer.
+func (s *Server) Disconnect(ctx context.Context, req *controlpb.DisconnectRequest) (*controlpb.DisconnectResponse, error) {
+	if !s.rtmp.Disconnect(req.StreamPath) {
+		return nil, status.Errorf(codes.NotFound, "no publisher on %s", req.StreamPath)
+	}
+	return &controlpb.DisconnectResponse{}, nil
+}
+
+// UpdateStreamConfig implements controlpb.ControlServer.
+func (s *Server) UpdateStreamConfig(ctx context.Context, req *controlpb.UpdateStreamConfigRequest) (*controlpb.StreamConfig, error) {
+	if req.StreamName == "" {
+		return nil, status.Error(codes.InvalidArgument, "stream_name is required")
+	}
+	c := req.GetConfig()
+	effective, err := s.pool.UpdateStreamConfig(req.StreamName, kvs.StreamConfig{
+		RetentionHours:     int(c.GetRetentionHours()),
+		FragmentDurationMs: int(c.GetFragmentDurationMs()),
+		StorageSizeMB:      int(c.GetStorageSizeMb()),
+		MaxBitrateKbps:     int(c.GetMaxBitrateKbps()),
+		RoleARN:            c.GetRoleArn(),
+		ExternalID:         c.GetExternalId(),
+		KMSKeyID:           c.GetKmsKeyId(),
+		Sinks:              c.GetSinks(),
+		RelayURL:           c.GetRelayUrl(),
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	log.Printf("[gRPC] Stream config of %s updated", req.StreamName)
+	return &controlpb.StreamConfig{
+		RetentionHours:     int32(effective.RetentionHours),
+		FragmentDurationMs: int32(effective.FragmentDurationMs),
+		StorageSizeMb:      int32(effective.StorageSizeMB),
+		MaxBitrateKbps:     int32(effective.MaxBitrateKbps),
+		RoleArn:            effective.RoleARN,
+		ExternalId:         effective.ExternalID,
+		KmsKeyId:           effective.KMSKeyID,
+		Sinks:              effective.Sinks,
+		RelayUrl:           effective.RelayURL,
+	}, nil
+}
+
+// streamStats converts the statistics of a publisher.
+func streamStats(st server.StreamStats) *controlpb.StreamStats {
+	return &controlpb.StreamStats{
+		SessionId:                st.SessionID,
+		StreamPath:               st.StreamPath,
+		StreamName:               st.StreamName,
+		CameraId:                 st.CameraID,
+		RemoteAddr:               st.RemoteAddr,
+		Protocol:                 st.Protocol,
+		StartedAt:                timestamp(st.StartedAt),
+		UptimeSeconds:            st.UptimeSeconds,
+		LastFrameAt:              timestamp(st.LastFrameAt),
+		Frames:                   st.Frames,
+		Bytes:                    st.Bytes,
+		Keyframes:                st.Keyframes,
+		DroppedFrames:            st.DroppedFrames,
+		BitrateKbps:              st.BitrateKbps,
+		Fps:                      st.FPS,
+		KeyframeIntervalSeconds:  st.KeyframeInterval,
+		LastKeyframeAt:           timestamp(st.LastKeyframeAt),
+		Width:                    int32(st.Width),
+		Height:                   int32(st.Height),
+		VideoCodec:               st.VideoCodec,
+		Profile:                  st.Profile,
+		Level:                    st.Level,
+		Readers:                  int32(st.Readers),
+		AudioCodec:               st.AudioCodec,
+		ForwardingPaused:         st.ForwardingPaused,
+		GatedFrames:              st.GatedFrames,
+		QueueDepth:               int32(st.QueueDepth),
+		QueueCapacity:            int32(st.QueueCapacity),
+		QueueHighWatermarks:      st.QueueHighMarks,
+		TimestampDiscontinuities: st.Discontinuities,
+		ClockDriftMs:             st.ClockDriftMs,
+	}
+}
+
+// timestamp converts a time, nil if unset.
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
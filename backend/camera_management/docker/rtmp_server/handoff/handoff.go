@@ -0,0 +1,177 @@
+// Package handoff lets a new server process bind the ingest ports while the old one is
+// still running (SO_REUSEPORT) and tells the old one to drain once the new one is ready.
+package handoff
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long either side waits for the other during a handoff
+const handshakeTimeout = 5 * time.Second
+
+// Handoff coordinates a process with its predecessor and successor on the same host.
+//
+// The successor binds its listeners next to the running process (SO_REUSEPORT), then
+// connects to the handoff socket and announces it is ready. The running process stops
+// accepting, lets its connections finish for up to the drain timeout, and exits; the
+// successor takes over the socket for the next upgrade.
+type Handoff struct {
+	reusePort    bool
+	socketPath   string        // unix socket of the handshake, empty to disable it
+	drainTimeout time.Duration // how long connections may keep running after a handoff
+
+	ln        *net.UnixListener
+	requested chan struct{} // closed when a successor is ready
+	once      sync.Once
+}
+
+// NewFromEnv reads LISTEN_REUSEPORT (bind the listeners with SO_REUSEPORT), HANDOFF_SOCKET
+// (unix socket path of the handshake, implies LISTEN_REUSEPORT) and DRAIN_TIMEOUT
+// (seconds connections may keep running after a handoff, default 300). Unlike the other
+// optional features it never returns nil: without any of them set, listeners are bound as
+// usual and Requested never fires.
+func NewFromEnv() *Handoff {
+	h := &Handoff{
+		socketPath:   os.Getenv("HANDOFF_SOCKET"),
+		drainTimeout: 5 * time.Minute,
+		requested:    make(chan struct{}),
+	}
+	h.reusePort, _ = strconv.ParseBool(os.Getenv("LISTEN_REUSEPORT"))
+	if h.socketPath != "" {
+		h.reusePort = true
+	}
+	if h.reusePort && !reusePortSupported {
+		log.Printf("Warning: SO_REUSEPORT is not supported on this platform, listener handoff disabled")
+		h.reusePort, h.socketPath = false, ""
+	}
+	if value := os.Getenv("DRAIN_TIMEOUT"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			log.Printf("Warning: invalid DRAIN_TIMEOUT %q, using %s", value, h.drainTimeout)
+		} else {
+			h.drainTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+	return h
+}
+
+// ListenConfig returns the configuration to bind the listeners with.
+func (h *Handoff) ListenConfig() net.ListenConfig {
+	if !h.reusePort {
+		return net.ListenConfig{}
+	}
+	return net.ListenConfig{Control: reusePort}
+}
+
+// DrainTimeout returns how long connections may keep running after a handoff.
+func (h *Handoff) DrainTimeout() time.Duration {
+	return h.drainTimeout
+}
+
+// Start is called once all listeners are bound. It tells a running predecessor to drain,
+// then listens on the handoff socket for a successor. It does nothing without
+// HANDOFF_SOCKET.
+func (h *Handoff) Start() error {
+	if h.socketPath == "" {
+		return nil
+	}
+	if err := h.notifyPredecessor(); err != nil {
+		return err
+	}
+
+	// The predecessor keeps its (now unlinked) listener open until it exits
+	os.Remove(h.socketPath)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: h.socketPath, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("failed to listen on handoff socket %s: %w", h.socketPath, err)
+	}
+	h.ln = ln
+	log.Printf("Listener handoff enabled (socket %s, drain timeout %s)", h.socketPath, h.drainTimeout)
+	go h.accept()
+	return nil
+}
+
+// notifyPredecessor announces this process on the socket of a running predecessor and
+// waits for it to acknowledge. No socket, or nobody listening on it, means there is no
+// predecessor.
+func (h *Handoff) notifyPredecessor() error {
+	conn, err := net.DialTimeout("unix", h.socketPath, handshakeTimeout)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	if _, err := fmt.Fprintf(conn, "ready %d\n", os.Getpid()); err != nil {
+		return fmt.Errorf("failed to notify previous process: %w", err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("previous process did not acknowledge the handoff: %w", err)
+	}
+	fields := strings.Fields(reply)
+	if len(fields) != 2 || fields[0] != "draining" {
+		return fmt.Errorf("unexpected handoff reply %q", reply)
+	}
+	log.Printf("Took over listeners from process %s, which is draining its connections", fields[1])
+	return nil
+}
+
+// accept waits for a successor on the handoff socket.
+func (h *Handoff) accept() {
+	for {
+		conn, err := h.ln.Accept()
+		if err != nil {
+			return
+		}
+		if h.handshake(conn) {
+			// The successor owns the socket path now; closing must not remove it
+			h.ln.SetUnlinkOnClose(false)
+			h.ln.Close()
+			h.once.Do(func() { close(h.requested) })
+			return
+		}
+	}
+}
+
+// handshake acknowledges the announcement of a successor.
+func (h *Handoff) handshake(conn net.Conn) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "ready" {
+		log.Printf("Warning: ignoring unexpected handoff message %q", line)
+		return false
+	}
+	if _, err := fmt.Fprintf(conn, "draining %d\n", os.Getpid()); err != nil {
+		return false
+	}
+	log.Printf("Process %s is ready to take over the listeners", fields[1])
+	return true
+}
+
+// Requested is closed once a successor has taken over the listeners.
+func (h *Handoff) Requested() <-chan struct{} {
+	return h.requested
+}
+
+// Close stops listening for a successor and removes the socket, unless a successor took
+// it over.
+func (h *Handoff) Close() {
+	if h.ln != nil {
+		h.ln.Close()
+	}
+}
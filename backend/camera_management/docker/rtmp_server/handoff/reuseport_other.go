@@ -0,0 +1,17 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+// Package handoff lets a new server process bind the ingest ports while the old one is
+// still running (SO_REUSEPORT) and tells the old one to drain once the new one is ready.
+package handoff
+
+import "syscall"
+
+// reusePortSupported reports whether SO_REUSEPORT is available on this platform. This
+// covers Windows, where SO_REUSEADDR lets a socket steal the port instead of sharing it,
+// and the few Unix systems without SO_REUSEPORT (Solaris, illumos).
+const reusePortSupported = false
+
+// reusePort is not used on platforms without SO_REUSEPORT.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
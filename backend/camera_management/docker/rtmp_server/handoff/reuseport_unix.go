@@ -0,0 +1,29 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+// Package handoff lets a new server process bind the ingest ports while the old one is
+// still running (SO_REUSEPORT) and tells the old one to drain once the new one is ready.
+package handoff
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported reports whether SO_REUSEPORT is available on this platform.
+const reusePortSupported = true
+
+// reusePort sets SO_REUSEADDR and SO_REUSEPORT on a socket before it is bound.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+			return
+		}
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,74 @@
+// Package history periodically persists per-stream ingest statistics (DynamoDB or
+// Amazon Timestream) so the camera management backend can show historical edge health.
+package history
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+// DynamoDBStore writes one item per sample, keyed by stream_path (partition key) and
+// timestamp (sort key, Unix seconds). Items expire through the expires_at TTL attribute.
+type DynamoDBStore struct {
+	table  string
+	ttl    time.Duration
+	client *awsapi.DynamoDB
+}
+
+// NewDynamoDBStore creates a store for the table. ttl 0 keeps items forever.
+func NewDynamoDBStore(table, region string, ttl time.Duration) *DynamoDBStore {
+	return &DynamoDBStore{table: table, ttl: ttl, client: awsapi.NewDynamoDB(region)}
+}
+
+// Write implements Store.
+func (d *DynamoDBStore) Write(ctx context.Context, samples []Sample) error {
+	var errs []error
+	for i := range samples {
+		if err := d.client.PutItem(ctx, d.table, d.item(&samples[i])); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// item converts a sample to a DynamoDB item.
+func (d *DynamoDBStore) item(s *Sample) awsapi.Item {
+	item := awsapi.Item{
+		"stream_path":               awsapi.String(s.StreamPath),
+		"timestamp":                 awsapi.Number(s.Time.Unix()),
+		"stream_name":               awsapi.String(s.StreamName),
+		"remote_addr":               awsapi.String(s.RemoteAddr),
+		"protocol":                  awsapi.String(s.Protocol),
+		"started_at":                awsapi.String(s.StartedAt.UTC().Format(time.RFC3339)),
+		"uptime_seconds":            awsapi.Number(int64(s.Uptime() / time.Second)),
+		"frames":                    awsapi.Number(int64(s.Frames)),
+		"bytes":                     awsapi.Number(int64(s.Bytes)),
+		"keyframes":                 awsapi.Number(int64(s.Keyframes)),
+		"dropped_frames":            awsapi.Number(int64(s.DroppedFrames)),
+		"restarts":                  awsapi.Number(int64(s.Restarts)),
+		"bitrate_kbps":              awsapi.Float(s.BitrateKbps),
+		"fps":                       awsapi.Float(s.FPS),
+		"keyframe_interval_seconds": awsapi.Float(s.KeyframeInterval),
+		"width":                     awsapi.Number(int64(s.Width)),
+		"height":                    awsapi.Number(int64(s.Height)),
+	}
+	if s.CameraID != "" {
+		item["camera_id"] = awsapi.String(s.CameraID)
+	}
+	if s.Instance != "" {
+		item["instance"] = awsapi.String(s.Instance)
+	}
+	if !s.LastKeyframeAt.IsZero() {
+		item["last_keyframe_at"] = awsapi.String(s.LastKeyframeAt.UTC().Format(time.RFC3339))
+	}
+	if s.AudioCodec != "" {
+		item["audio_codec"] = awsapi.String(s.AudioCodec)
+	}
+	if d.ttl > 0 {
+		item["expires_at"] = awsapi.Number(s.Time.Add(d.ttl).Unix())
+	}
+	return item
+}
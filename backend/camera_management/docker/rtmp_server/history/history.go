@@ -0,0 +1,172 @@
+// Package history periodically persists per-stream ingest statistics (DynamoDB or
+// Amazon Timestream) so the camera management backend can show historical edge health.
+package history
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/metrics"
+	"rtmp_kvs/server"
+)
+
+// Sample is the state of one publisher at a point in time.
+type Sample struct {
+	Time     time.Time
+	Instance string // host name of the task that wrote the sample
+	server.StreamStats
+	Restarts int // KVS pipeline restarts of the target stream
+}
+
+// Uptime returns how long the publisher has been connected.
+func (s *Sample) Uptime() time.Duration {
+	return s.Time.Sub(s.StartedAt)
+}
+
+// Store persists samples.
+type Store interface {
+	Write(ctx context.Context, samples []Sample) error
+}
+
+// StatsSource provides the ingest statistics of active publishers.
+type StatsSource interface {
+	Stats() []server.StreamStats
+}
+
+// ForwarderSource provides the KVS forwarders (pipeline restarts).
+type ForwarderSource interface {
+	Forwarders() []*kvs.Forwarder
+}
+
+// Recorder writes a sample of every active publisher to a store at a fixed interval.
+type Recorder struct {
+	store      Store
+	stats      StatsSource
+	forwarders ForwarderSource
+	interval   time.Duration
+	instance   string
+
+	written atomic.Uint64
+	failed  atomic.Uint64
+}
+
+// NewFromEnv creates a recorder for STATS_TABLE (DynamoDB) or STATS_TIMESTREAM_DATABASE
+// and STATS_TIMESTREAM_TABLE, writing every STATS_INTERVAL seconds (default 60). It
+// returns nil if neither is set.
+func NewFromEnv(region string, stats StatsSource, forwarders ForwarderSource) *Recorder {
+	var store Store
+	var target string
+	if table := os.Getenv("STATS_TABLE"); table != "" {
+		store = NewDynamoDBStore(table, region, statsTTL())
+		target = "DynamoDB table " + table
+	} else if database := os.Getenv("STATS_TIMESTREAM_DATABASE"); database != "" {
+		table := os.Getenv("STATS_TIMESTREAM_TABLE")
+		if table == "" {
+			log.Printf("[History] ⚠️  STATS_TIMESTREAM_TABLE is required with STATS_TIMESTREAM_DATABASE, stats history disabled")
+			return nil
+		}
+		store = NewTimestreamStore(database, table, region)
+		target = "Timestream table " + database + "." + table
+	} else {
+		return nil
+	}
+
+	r := New(store, stats, forwarders, time.Duration(max(envInt("STATS_INTERVAL", 60), 1))*time.Second)
+	log.Printf("[History] Writing stream statistics to %s every %s", target, r.interval)
+	return r
+}
+
+// New creates a recorder. Call Run to start writing.
+func New(store Store, stats StatsSource, forwarders ForwarderSource, interval time.Duration) *Recorder {
+	instance, _ := os.Hostname()
+	return &Recorder{
+		store:      store,
+		stats:      stats,
+		forwarders: forwarders,
+		interval:   interval,
+		instance:   instance,
+	}
+}
+
+// Run writes samples until ctx is cancelled.
+func (r *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Record(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Record writes one sample of every active publisher.
+func (r *Recorder) Record(ctx context.Context) {
+	samples := r.Samples(time.Now().UTC())
+	if len(samples) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := r.store.Write(ctx, samples); err != nil {
+		r.failed.Add(uint64(len(samples)))
+		log.Printf("[History] ⚠️  Failed to write %d samples: %v", len(samples), err)
+		return
+	}
+	r.written.Add(uint64(len(samples)))
+}
+
+// Samples returns the current state of the active publishers.
+func (r *Recorder) Samples(now time.Time) []Sample {
+	restarts := make(map[string]int)
+	if r.forwarders != nil {
+		for _, f := range r.forwarders.Forwarders() {
+			restarts[f.StreamName()] = f.Status().Restarts
+		}
+	}
+
+	stats := r.stats.Stats()
+	samples := make([]Sample, 0, len(stats))
+	for _, st := range stats {
+		samples = append(samples, Sample{
+			Time:        now,
+			Instance:    r.instance,
+			StreamStats: st,
+			Restarts:    restarts[st.StreamName],
+		})
+	}
+	return samples
+}
+
+// CollectMetrics writes the number of samples written and failed.
+func (r *Recorder) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_stats_history_samples_total", "Stream statistics samples written to the history store", float64(r.written.Load()))
+	w.Counter("rtmp_stats_history_errors_total", "Stream statistics samples that failed to be written", float64(r.failed.Load()))
+}
+
+// statsTTL reads STATS_TTL_DAYS (days DynamoDB keeps a sample, default 30, 0 = forever).
+func statsTTL() time.Duration {
+	return time.Duration(envInt("STATS_TTL_DAYS", 30)) * 24 * time.Hour
+}
+
+// envInt reads a non-negative integer environment variable, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("[History] ⚠️  Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
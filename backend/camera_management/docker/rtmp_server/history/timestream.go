@@ -0,0 +1,94 @@
+// Package history periodically persists per-stream ingest statistics (DynamoDB or
+// Amazon Timestream) so the camera management backend can show historical edge health.
+package history
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+// timestreamBatch is the maximum number of records per WriteRecords call.
+const timestreamBatch = 100
+
+// TimestreamStore writes one multi-measure record ("ingest") per sample. The stream
+// path, KVS stream name, camera ID, protocol and instance are dimensions.
+type TimestreamStore struct {
+	database string
+	table    string
+	client   *awsapi.TimestreamWrite
+}
+
+// NewTimestreamStore creates a store for the database table.
+func NewTimestreamStore(database, table, region string) *TimestreamStore {
+	return &TimestreamStore{database: database, table: table, client: awsapi.NewTimestreamWrite(region)}
+}
+
+// Write implements Store.
+func (t *TimestreamStore) Write(ctx context.Context, samples []Sample) error {
+	for start := 0; start < len(samples); start += timestreamBatch {
+		end := min(start+timestreamBatch, len(samples))
+		records := make([]awsapi.TimestreamRecord, 0, end-start)
+		for i := start; i < end; i++ {
+			records = append(records, record(&samples[i]))
+		}
+		if err := t.client.WriteRecords(ctx, t.database, t.table, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record converts a sample to a Timestream record.
+func record(s *Sample) awsapi.TimestreamRecord {
+	dimensions := []awsapi.TimestreamDimension{
+		{Name: "stream_path", Value: s.StreamPath},
+		{Name: "stream_name", Value: s.StreamName},
+		{Name: "protocol", Value: s.Protocol},
+	}
+	// Timestream rejects empty dimension values
+	if s.CameraID != "" {
+		dimensions = append(dimensions, awsapi.TimestreamDimension{Name: "camera_id", Value: s.CameraID})
+	}
+	if s.Instance != "" {
+		dimensions = append(dimensions, awsapi.TimestreamDimension{Name: "instance", Value: s.Instance})
+	}
+
+	bigint := func(name string, v int64) awsapi.TimestreamMeasure {
+		return awsapi.TimestreamMeasure{Name: name, Value: strconv.FormatInt(v, 10), Type: "BIGINT"}
+	}
+	double := func(name string, v float64) awsapi.TimestreamMeasure {
+		return awsapi.TimestreamMeasure{Name: name, Value: strconv.FormatFloat(v, 'f', -1, 64), Type: "DOUBLE"}
+	}
+	measures := []awsapi.TimestreamMeasure{
+		bigint("uptime_seconds", int64(s.Uptime()/time.Second)),
+		bigint("frames", int64(s.Frames)),
+		bigint("bytes", int64(s.Bytes)),
+		bigint("keyframes", int64(s.Keyframes)),
+		bigint("dropped_frames", int64(s.DroppedFrames)),
+		bigint("restarts", int64(s.Restarts)),
+		double("bitrate_kbps", s.BitrateKbps),
+		double("fps", s.FPS),
+		double("keyframe_interval_seconds", s.KeyframeInterval),
+		bigint("width", int64(s.Width)),
+		bigint("height", int64(s.Height)),
+	}
+	if !s.LastKeyframeAt.IsZero() {
+		measures = append(measures, awsapi.TimestreamMeasure{
+			Name:  "last_keyframe_at",
+			Value: strconv.FormatInt(s.LastKeyframeAt.UnixMilli(), 10),
+			Type:  "TIMESTAMP",
+		})
+	}
+
+	return awsapi.TimestreamRecord{
+		Dimensions:       dimensions,
+		MeasureName:      "ingest",
+		MeasureValueType: "MULTI",
+		MeasureValues:    measures,
+		Time:             strconv.FormatInt(s.Time.UnixMilli(), 10),
+		TimeUnit:         "MILLISECONDS",
+	}
+}
@@ -0,0 +1,376 @@
+// Package hooks notifies KVS pipeline restarts and restart storms to webhooks, SNS topics
+// and Lambda functions, with the context of the stream, so on-call engineers are paged
+// about degraded cameras.
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/events"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/metrics"
+	"rtmp_kvs/server"
+)
+
+// Notification types
+const (
+	Restart      = "restart"
+	RestartStorm = "restart_storm"
+	Test         = "test"
+)
+
+// notifyTimeout bounds the delivery of a notification to one hook.
+const notifyTimeout = 10 * time.Second
+
+// Notification describes a pipeline restart, or a storm of them, of one KVS stream.
+type Notification struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Text     string    `json:"text"` // summary (shown by Slack and Teams incoming webhooks)
+	Instance string    `json:"instance"`
+
+	StreamName string `json:"stream_name,omitempty"`
+	StreamPath string `json:"stream_path,omitempty"` // of the current publisher, if any
+	CameraID   string `json:"camera_id,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	Reason              string `json:"reason,omitempty"`               // error class, or why the pipeline was restarted
+	RestartCount        int    `json:"restart_count"`                  // restarts since the forwarder was created
+	ConsecutiveFailures int    `json:"consecutive_failures,omitempty"` // restarts since the last persisted fragment
+	LastError           string `json:"last_error,omitempty"`           // last classified kvssink error
+
+	// Restart storms
+	Restarts      int     `json:"restarts_in_window,omitempty"`
+	WindowSeconds float64 `json:"window_seconds,omitempty"`
+
+	Detail map[string]any `json:"detail,omitempty"` // of the PipelineRestarted event
+}
+
+// subject identifies the stream of the notification, camera ID first.
+func (n *Notification) subject() string {
+	switch {
+	case n.CameraID != "":
+		return n.CameraID
+	case n.StreamPath != "":
+		return n.StreamPath
+	}
+	return n.StreamName
+}
+
+// Notifier delivers notifications to one target.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// StatsSource provides the ingest statistics of active publishers.
+type StatsSource interface {
+	Stats() []server.StreamStats
+}
+
+// ForwarderSource provides the KVS forwarders.
+type ForwarderSource interface {
+	Forwarders() []*kvs.Forwarder
+}
+
+// hook is a notification target.
+type hook struct {
+	target    string // as configured
+	stormOnly bool
+	notifier  Notifier
+}
+
+// Manager fires the hooks on PipelineRestarted events.
+type Manager struct {
+	hooks      []*hook
+	stormCount int // restarts within window making a storm, 0 to disable
+	window     time.Duration
+	cooldown   time.Duration // minimum time between storm notifications of one stream
+	stats      StatsSource
+	forwarders ForwarderSource
+	instance   string
+
+	mutex     sync.Mutex
+	restarts  map[string][]time.Time // by KVS stream name
+	lastStorm map[string]time.Time   // by KVS stream name
+	sent      map[[2]string]uint64   // by type and result
+}
+
+// NewFromEnv creates a manager from RESTART_HOOKS, a comma-separated list of targets: an
+// http(s) URL (webhook), an SNS topic ARN or a Lambda function ARN, each optionally
+// prefixed with "storm:" to be notified of restart storms only. A storm is
+// RESTART_STORM_COUNT restarts (default 5) of a stream within RESTART_STORM_WINDOW
+// seconds (default 600), notified at most once per RESTART_STORM_COOLDOWN seconds
+// (default 900). The manager is subscribed to the event bus. It returns nil if
+// RESTART_HOOKS is not set.
+func NewFromEnv(stats StatsSource, forwarders ForwarderSource) (*Manager, error) {
+	value := os.Getenv("RESTART_HOOKS")
+	if value == "" {
+		return nil, nil
+	}
+	var hooks []*hook
+	for _, target := range strings.Split(value, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		h, err := newHook(target)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	if len(hooks) == 0 {
+		return nil, fmt.Errorf("no hooks in RESTART_HOOKS")
+	}
+
+	m := newManager(hooks, envInt("RESTART_STORM_COUNT", 5),
+		time.Duration(max(envInt("RESTART_STORM_WINDOW", 600), 1))*time.Second,
+		time.Duration(envInt("RESTART_STORM_COOLDOWN", 900))*time.Second)
+	m.stats, m.forwarders = stats, forwarders
+	events.Subscribe(m)
+
+	targets := make([]string, len(hooks))
+	for i, h := range hooks {
+		targets[i] = h.target
+	}
+	log.Printf("[Hooks] Notifying pipeline restarts to %s (storm: %d restarts in %s)",
+		strings.Join(targets, ", "), m.stormCount, m.window)
+	return m, nil
+}
+
+// newHook creates the hook of a RESTART_HOOKS target.
+func newHook(target string) (*hook, error) {
+	h := &hook{target: target}
+	if rest, ok := strings.CutPrefix(target, "storm:"); ok {
+		h.stormOnly, target = true, rest
+	}
+	// arn:<partition>:<service>:<region>:...
+	service := ""
+	if parts := strings.Split(target, ":"); len(parts) >= 6 && parts[0] == "arn" {
+		service = parts[2]
+	}
+	switch {
+	case strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "http://"):
+		h.notifier = NewWebhookNotifier(target, []byte(os.Getenv("RESTART_HOOK_SECRET")))
+	case service == "sns":
+		h.notifier = NewSNSNotifier(target)
+	case service == "lambda":
+		h.notifier = NewLambdaNotifier(target)
+	default:
+		return nil, fmt.Errorf("invalid restart hook %q: expected an http(s) URL, an SNS topic ARN or a Lambda function ARN", target)
+	}
+	return h, nil
+}
+
+// newManager creates a manager. Call Handle with events.
+func newManager(hooks []*hook, stormCount int, window, cooldown time.Duration) *Manager {
+	instance, _ := os.Hostname()
+	return &Manager{
+		hooks:      hooks,
+		stormCount: stormCount,
+		window:     window,
+		cooldown:   cooldown,
+		instance:   instance,
+		restarts:   make(map[string][]time.Time),
+		lastStorm:  make(map[string]time.Time),
+		sent:       make(map[[2]string]uint64),
+	}
+}
+
+// envInt reads a non-negative integer environment variable, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("[Hooks] ⚠️  Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// Handle implements events.Subscriber.
+func (m *Manager) Handle(e events.Event) {
+	if e.Type != events.PipelineRestarted {
+		return
+	}
+	n := m.notification(e)
+	n.Type = Restart
+	n.Text = fmt.Sprintf("KVS pipeline of %s restarted (restart #%d", n.subject(), n.RestartCount)
+	if n.Reason != "" {
+		n.Text += ", " + n.Reason
+	}
+	n.Text += ")"
+	m.notify(n, false)
+
+	// Planned restarts (parameter or fragment duration changes) do not make a storm
+	if _, planned := e.Detail["reason"]; planned {
+		return
+	}
+	if restarts, ok := m.countRestart(e.StreamName, e.Time); ok {
+		n.Type = RestartStorm
+		n.Restarts = restarts
+		n.WindowSeconds = m.window.Seconds()
+		n.Text = fmt.Sprintf("Restart storm: KVS pipeline of %s restarted %d times in the last %s", n.subject(), restarts, m.window)
+		if n.LastError != "" {
+			n.Text += ", last error: " + n.LastError
+		}
+		m.notify(n, true)
+	}
+}
+
+// notification returns the notification of a restart event, with the context of the
+// stream from its publisher and forwarder.
+func (m *Manager) notification(e events.Event) Notification {
+	n := Notification{
+		Time:       e.Time,
+		Instance:   m.instance,
+		StreamName: e.StreamName,
+		StreamPath: e.StreamPath,
+		CameraID:   e.CameraID,
+		RemoteAddr: e.RemoteAddr,
+		Detail:     e.Detail,
+	}
+	if count, ok := e.Detail["restart_count"].(int); ok {
+		n.RestartCount = count
+	}
+	if class, _ := e.Detail["error_class"].(string); class != "" {
+		n.Reason = class
+	} else if reason, _ := e.Detail["reason"].(string); reason != "" {
+		n.Reason = reason
+	}
+	if m.stats != nil && n.StreamPath == "" {
+		for _, st := range m.stats.Stats() {
+			if st.StreamName == e.StreamName {
+				n.StreamPath, n.CameraID, n.RemoteAddr = st.StreamPath, st.CameraID, st.RemoteAddr
+				break
+			}
+		}
+	}
+	if m.forwarders != nil {
+		for _, f := range m.forwarders.Forwarders() {
+			if f.StreamName() != e.StreamName {
+				continue
+			}
+			status := f.Status()
+			n.RestartCount = max(n.RestartCount, status.Restarts)
+			n.ConsecutiveFailures = status.Errors.Consecutive
+			if status.Errors.LastClass != "" {
+				n.LastError = status.Errors.LastClass + ": " + status.Errors.LastMessage
+			}
+			break
+		}
+	}
+	return n
+}
+
+// countRestart records a restart and returns the restarts within the window when they
+// make a storm not notified within the cooldown.
+func (m *Manager) countRestart(streamName string, now time.Time) (int, bool) {
+	if m.stormCount == 0 {
+		return 0, false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	kept := []time.Time{now}
+	for _, t := range m.restarts[streamName] {
+		if now.Sub(t) <= m.window {
+			kept = append(kept, t)
+		}
+	}
+	m.restarts[streamName] = kept
+	if len(kept) < m.stormCount {
+		return 0, false
+	}
+	if last, ok := m.lastStorm[streamName]; ok && now.Sub(last) < m.cooldown {
+		return 0, false
+	}
+	m.lastStorm[streamName] = now
+	return len(kept), true
+}
+
+// notify delivers a notification to the hooks in parallel, storm notifications to all
+// of them, and returns the errors by target.
+func (m *Manager) notify(n Notification, storm bool) map[string]error {
+	if storm || n.Type == Test {
+		log.Printf("[Hooks] %s", n.Text)
+	}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	errs := make(map[string]error)
+	for _, h := range m.hooks {
+		if h.stormOnly && !storm {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			err := h.notifier.Notify(ctx, n)
+			result := "sent"
+			if err != nil {
+				result = "failed"
+				log.Printf("[Hooks] ⚠️  Failed to notify %s of %s: %v", h.target, n.Type, err)
+			}
+			mutex.Lock()
+			errs[h.target] = err
+			mutex.Unlock()
+			m.mutex.Lock()
+			m.sent[[2]string{n.Type, result}]++
+			m.mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// ServeTest sends a test notification to every hook and reports the result of each as
+// JSON (POST /restart-hooks/test?stream=<KVS stream name>).
+func (m *Manager) ServeTest(w http.ResponseWriter, r *http.Request) {
+	n := m.notification(events.Event{
+		Type:       events.PipelineRestarted,
+		Time:       time.Now().UTC(),
+		StreamName: r.URL.Query().Get("stream"),
+	})
+	n.Type = Test
+	n.Text = "Test notification of the restart hooks"
+	if n.StreamName != "" {
+		n.Text += " for " + n.subject()
+	}
+
+	results := make(map[string]string)
+	status := http.StatusOK
+	for target, err := range m.notify(n, true) {
+		results[target] = "sent"
+		if err != nil {
+			results[target] = err.Error()
+			status = http.StatusBadGateway
+		}
+	}
+	admin.WriteJSON(w, status, map[string]any{"notification": n, "results": results})
+}
+
+// CollectMetrics writes the number of notifications by type and result.
+func (m *Manager) CollectMetrics(w *metrics.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, notificationType := range []string{Restart, RestartStorm} {
+		for _, result := range []string{"sent", "failed"} {
+			w.Counter("rtmp_restart_hook_notifications_total", "Restart hook notifications by type and result",
+				float64(m.sent[[2]string{notificationType, result}]), "type", notificationType, "result", result)
+		}
+	}
+}
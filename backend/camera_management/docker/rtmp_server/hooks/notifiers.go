@@ -0,0 +1,119 @@
+// Package hooks notifies KVS pipeline restarts and restart storms to webhooks, SNS topics
+// and Lambda functions, with the context of the stream, so on-call engineers are paged
+// about degraded cameras.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"rtmp_kvs/awsapi"
+)
+
+// WebhookNotifier POSTs notifications as JSON to an HTTP(S) endpoint.
+type WebhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier for endpoint. secret (optional) is the HMAC key
+// the request body is signed with.
+func NewWebhookNotifier(endpoint string, secret []byte) *WebhookNotifier {
+	return &WebhookNotifier{url: endpoint, secret: secret, client: &http.Client{Timeout: notifyTimeout}}
+}
+
+// Notify implements Notifier. Any 2xx response is a success. When a secret is configured
+// the body is signed with HMAC-SHA256 and sent as "X-Signature: sha256=<hex>", like the
+// publish authorization webhook.
+func (n *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rtmp-kvs")
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SNSNotifier publishes notifications to an SNS topic as JSON messages.
+type SNSNotifier struct {
+	topicARN string
+	client   *awsapi.SNS
+}
+
+// NewSNSNotifier creates a notifier for the topic, in the region of its ARN.
+func NewSNSNotifier(topicARN string) *SNSNotifier {
+	return &SNSNotifier{topicARN: topicARN, client: awsapi.NewSNS(arnRegion(topicARN))}
+}
+
+// Notify implements Notifier.
+func (n *SNSNotifier) Notify(ctx context.Context, notification Notification) error {
+	message, err := json.MarshalIndent(notification, "", "  ")
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("[rtmp-kvs] %s: %s", notification.Type, notification.subject())
+	if len(subject) > 100 {
+		// SNS subjects are limited to 100 characters
+		subject = subject[:100]
+	}
+	return n.client.Publish(ctx, n.topicARN, subject, string(message))
+}
+
+// LambdaNotifier invokes a Lambda function asynchronously with the notification as its
+// event.
+type LambdaNotifier struct {
+	function string
+	client   *awsapi.Lambda
+}
+
+// NewLambdaNotifier creates a notifier for the function, in the region of its ARN.
+func NewLambdaNotifier(functionARN string) *LambdaNotifier {
+	return &LambdaNotifier{function: functionARN, client: awsapi.NewLambda(arnRegion(functionARN))}
+}
+
+// Notify implements Notifier.
+func (n *LambdaNotifier) Notify(ctx context.Context, notification Notification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	return n.client.InvokeAsync(ctx, n.function, payload)
+}
+
+// arnRegion returns the region of an ARN (arn:partition:service:region:account:resource).
+func arnRegion(arn string) string {
+	parts := strings.SplitN(arn, ":", 5)
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[3]
+}
@@ -0,0 +1,163 @@
+// Package kinesis publishes a compact record per forwarded GOP (KVS fragment) to a
+// Kinesis Data Stream, so downstream analytics can index footage without calling
+// KVS ListFragments.
+package kinesis
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/metrics"
+)
+
+const (
+	maxBatchRecords = 500         // PutRecords limit
+	maxPending      = 10000       // records kept for retry before the oldest are dropped
+	flushInterval   = time.Second // batches are sent at least this often
+	requestTimeout  = 10 * time.Second
+)
+
+// Record is the JSON record written for every GOP.
+type Record struct {
+	StreamName        string    `json:"stream_name"`
+	ProducerTimestamp time.Time `json:"producer_timestamp"`
+	DurationMillis    int64     `json:"duration_ms"`
+	Keyframe          bool      `json:"keyframe"`
+	Frames            int       `json:"frames"`
+	Bytes             int       `json:"bytes"`
+}
+
+// Publisher sends GOP records to a Kinesis Data Stream in batches. Records are
+// partitioned by KVS stream name, so the records of a stream stay in order.
+type Publisher struct {
+	streamName string
+	client     *awsapi.Kinesis
+	queue      chan kvs.GOPRecord
+	closing    chan struct{}
+	closed     chan struct{}
+
+	sent    atomic.Uint64
+	failed  atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// NewFromEnv creates a publisher for KINESIS_STREAM_NAME and registers it as the GOP
+// sink of all forwarders. It returns nil if KINESIS_STREAM_NAME is not set.
+func NewFromEnv(region string) *Publisher {
+	streamName := os.Getenv("KINESIS_STREAM_NAME")
+	if streamName == "" {
+		return nil
+	}
+	p := &Publisher{
+		streamName: streamName,
+		client:     awsapi.NewKinesis(region),
+		queue:      make(chan kvs.GOPRecord, 1000),
+		closing:    make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	go p.run()
+	kvs.SetGOPSink(p)
+	log.Printf("[Kinesis] Publishing GOP records to Kinesis data stream %s", streamName)
+	return p
+}
+
+// WriteGOP implements kvs.GOPSink. Records are dropped when the queue is full, so a slow
+// or unavailable stream never blocks the ingest path.
+func (p *Publisher) WriteGOP(r kvs.GOPRecord) {
+	select {
+	case p.queue <- r:
+	default:
+		if n := p.dropped.Add(1); n == 1 || n%100 == 0 {
+			log.Printf("[Kinesis] ⚠️  Queue full, %d GOP records dropped", n)
+		}
+	}
+}
+
+// Close sends the records still queued (the last GOPs of the forwarders stopped during
+// shutdown). Call it after the forwarders have stopped.
+func (p *Publisher) Close() {
+	close(p.closing)
+	<-p.closed
+}
+
+// run sends queued records until Close.
+func (p *Publisher) run() {
+	defer close(p.closed)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var pending []awsapi.KinesisRecord
+	for {
+		select {
+		case r := <-p.queue:
+			pending = append(pending, p.record(r))
+			if len(pending) >= maxBatchRecords {
+				pending = p.send(pending)
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				pending = p.send(pending)
+			}
+		case <-p.closing:
+			for len(p.queue) > 0 {
+				pending = append(pending, p.record(<-p.queue))
+			}
+			for len(pending) > 0 {
+				before := len(pending)
+				if pending = p.send(pending); len(pending) >= before {
+					break // no progress, give up on the rest
+				}
+			}
+			return
+		}
+	}
+}
+
+// record encodes a GOP record.
+func (p *Publisher) record(r kvs.GOPRecord) awsapi.KinesisRecord {
+	data, _ := json.Marshal(Record{
+		StreamName:        r.StreamName,
+		ProducerTimestamp: r.ProducerTimestamp,
+		DurationMillis:    r.Duration.Milliseconds(),
+		Keyframe:          r.Keyframe,
+		Frames:            r.Frames,
+		Bytes:             r.Bytes,
+	})
+	return awsapi.KinesisRecord{Data: append(data, '\n'), PartitionKey: r.StreamName}
+}
+
+// send writes the first batch of pending records and returns the records still pending:
+// the rest of the queue plus the records that failed, which are retried with the next batch.
+func (p *Publisher) send(pending []awsapi.KinesisRecord) []awsapi.KinesisRecord {
+	batch := pending[:min(len(pending), maxBatchRecords)]
+	rest := pending[len(batch):]
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	failed, err := p.client.PutRecords(ctx, p.streamName, batch)
+	p.sent.Add(uint64(len(batch) - len(failed)))
+	if err != nil {
+		p.failed.Add(uint64(len(failed)))
+		log.Printf("[Kinesis] ⚠️  Failed to put %d of %d records to %s: %v", len(failed), len(batch), p.streamName, err)
+	}
+
+	pending = append(append([]awsapi.KinesisRecord(nil), failed...), rest...)
+	if n := len(pending) - maxPending; n > 0 {
+		p.dropped.Add(uint64(n))
+		pending = pending[n:]
+	}
+	return pending
+}
+
+// CollectMetrics writes the number of records sent, failed and dropped.
+func (p *Publisher) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_kinesis_records_total", "GOP records written to the Kinesis data stream", float64(p.sent.Load()))
+	w.Counter("rtmp_kinesis_record_errors_total", "GOP record writes that failed (retried with the next batch)", float64(p.failed.Load()))
+	w.Counter("rtmp_kinesis_records_dropped_total", "GOP records dropped because the queue or retry buffer was full", float64(p.dropped.Load()))
+}
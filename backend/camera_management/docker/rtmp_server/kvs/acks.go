@@ -0,0 +1,184 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"rtmp_kvs/events"
+)
+
+// PutMedia acknowledgement event types
+const (
+	AckBuffering = "BUFFERING"
+	AckReceived  = "RECEIVED"
+	AckPersisted = "PERSISTED"
+	AckError     = "ERROR"
+	AckIdle      = "IDLE"
+)
+
+// FragmentAck is a PutMedia fragment acknowledgement as echoed by the producer SDK log.
+type FragmentAck struct {
+	EventType        string `json:"EventType"`
+	FragmentTimecode int64  `json:"FragmentTimecode"`
+	FragmentNumber   string `json:"FragmentNumber"`
+	ErrorID          int    `json:"ErrorId"`
+	ErrorCode        string `json:"ErrorCode"`
+}
+
+// ackPattern matches the ACK JSON object embedded in a log line.
+var ackPattern = regexp.MustCompile(`\{\s*"EventType"\s*:\s*"[A-Z]+"[^{}]*\}`)
+
+// parseFragmentAck extracts a fragment ACK from a GStreamer/producer SDK log line.
+func parseFragmentAck(line string) (*FragmentAck, bool) {
+	match := ackPattern.FindString(line)
+	if match == "" {
+		return nil, false
+	}
+	var ack FragmentAck
+	if err := json.Unmarshal([]byte(match), &ack); err != nil {
+		return nil, false
+	}
+	return &ack, true
+}
+
+// AckStats summarizes the fragment ACKs received for a stream.
+type AckStats struct {
+	Counts             map[string]uint64 `json:"counts"`
+	LastPersistedTime  time.Time         `json:"last_persisted_time,omitempty"`  // producer timestamp of the fragment
+	LastPersistedAt    time.Time         `json:"last_persisted_at,omitempty"`    // when the ACK arrived
+	LastFragmentNumber string            `json:"last_fragment_number,omitempty"` // of the last persisted fragment
+	LastErrorCode      string            `json:"last_error_code,omitempty"`
+	LastErrorAt        time.Time         `json:"last_error_at,omitempty"`
+}
+
+// ackTracker accumulates ACKs and maintains the ingest checkpoint of a forwarder.
+type ackTracker struct {
+	mutex          sync.Mutex
+	stats          AckStats
+	lastCheckpoint time.Time
+}
+
+// checkpointEventInterval limits IngestCheckpoint events per stream.
+const checkpointEventInterval = time.Minute
+
+// handleLine parses a pipeline log line and records any ACK or classified error in it.
+func (f *Forwarder) handleLine(line string) {
+	f.recordError(line)
+
+	ack, ok := parseFragmentAck(line)
+	if !ok {
+		return
+	}
+
+	t := &f.acks
+	t.mutex.Lock()
+	if t.stats.Counts == nil {
+		t.stats.Counts = make(map[string]uint64)
+	}
+	t.stats.Counts[ack.EventType]++
+	now := time.Now()
+
+	var emitCheckpoint bool
+	switch ack.EventType {
+	case AckPersisted:
+		t.stats.LastPersistedTime = time.UnixMilli(ack.FragmentTimecode).UTC()
+		t.stats.LastPersistedAt = now
+		t.stats.LastFragmentNumber = ack.FragmentNumber
+		if now.Sub(t.lastCheckpoint) >= checkpointEventInterval {
+			t.lastCheckpoint = now
+			emitCheckpoint = true
+		}
+	case AckError:
+		t.stats.LastErrorCode = ack.ErrorCode
+		t.stats.LastErrorAt = now
+	}
+	stats := t.stats
+	t.mutex.Unlock()
+	f.latency.acknowledged(ack.FragmentTimecode, ack.EventType == AckPersisted, now)
+
+	switch ack.EventType {
+	case AckPersisted:
+		f.resetErrors()
+		f.observeFragment(stats.LastPersistedTime)
+		f.writeCheckpoint(stats)
+		if emitCheckpoint {
+			events.Emit(events.Event{
+				Type:       events.IngestCheckpoint,
+				StreamName: f.streamName,
+				Detail: map[string]any{
+					"last_persisted_time": stats.LastPersistedTime,
+					"fragment_number":     stats.LastFragmentNumber,
+					"persisted_fragments": stats.Counts[AckPersisted],
+				},
+			})
+		}
+	case AckError:
+		f.fragmentFailed()
+		log.Printf("[KVS] ⚠️  Fragment ACK error for %s: %s (id %d, timecode %d)",
+			f.streamName, ack.ErrorCode, ack.ErrorID, ack.FragmentTimecode)
+		events.Emit(events.Event{
+			Type:       events.FragmentAckError,
+			StreamName: f.streamName,
+			Detail: map[string]any{
+				"error_code":        ack.ErrorCode,
+				"error_id":          ack.ErrorID,
+				"fragment_timecode": ack.FragmentTimecode,
+			},
+		})
+	}
+}
+
+// AckStats returns the fragment ACK statistics of the forwarder.
+func (f *Forwarder) AckStats() AckStats {
+	f.acks.mutex.Lock()
+	defer f.acks.mutex.Unlock()
+
+	stats := f.acks.stats
+	stats.Counts = make(map[string]uint64, len(f.acks.stats.Counts))
+	for k, v := range f.acks.stats.Counts {
+		stats.Counts[k] = v
+	}
+	return stats
+}
+
+// writeCheckpoint persists the last persisted fragment to KVS_CHECKPOINT_DIR, if set.
+// The file is replaced atomically so a crash never leaves a partial checkpoint.
+func (f *Forwarder) writeCheckpoint(stats AckStats) {
+	dir := os.Getenv("KVS_CHECKPOINT_DIR")
+	if dir == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(map[string]any{
+		"stream_name":         f.streamName,
+		"last_persisted_time": stats.LastPersistedTime,
+		"fragment_number":     stats.LastFragmentNumber,
+		"updated_at":          stats.LastPersistedAt,
+	}, "", "  ")
+	if err != nil {
+		return
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, f.streamName+".checkpoint.json"), data); err != nil {
+		log.Printf("[KVS] ⚠️  Failed to write checkpoint: %v", err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
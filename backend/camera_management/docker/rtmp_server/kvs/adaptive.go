@@ -0,0 +1,196 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/events"
+)
+
+// Consecutive stable intervals before the fragment duration is increased
+const adaptiveStableIntervals = 3
+
+// adaptiveConfig bounds the fragment duration of video streams adapted to the PutMedia
+// conditions: shorter fragments are acknowledged sooner and resend less after a failed
+// request, longer fragments need fewer requests.
+type adaptiveConfig struct {
+	minMs     int
+	maxMs     int
+	threshold time.Duration // acknowledgement latency beyond the fragment duration
+	interval  time.Duration // between adjustments
+}
+
+// adaptiveConfigFromEnv reads FRAGMENT_ADAPTIVE=true with FRAGMENT_MIN_DURATION and
+// FRAGMENT_MAX_DURATION (ms, default 1000 and 10000), FRAGMENT_LATENCY_THRESHOLD (ms,
+// default 3000) and FRAGMENT_ADAPT_INTERVAL (seconds, default 60). It returns nil if
+// adaptive fragments are disabled.
+func adaptiveConfigFromEnv() *adaptiveConfig {
+	if os.Getenv("FRAGMENT_ADAPTIVE") != "true" {
+		return nil
+	}
+	c := &adaptiveConfig{
+		minMs:     max(envInt("FRAGMENT_MIN_DURATION", 1000), 100),
+		maxMs:     envInt("FRAGMENT_MAX_DURATION", 10000),
+		threshold: time.Duration(envInt("FRAGMENT_LATENCY_THRESHOLD", 3000)) * time.Millisecond,
+		interval:  time.Duration(max(envInt("FRAGMENT_ADAPT_INTERVAL", 60), 1)) * time.Second,
+	}
+	c.maxMs = max(c.maxMs, c.minMs)
+	return c
+}
+
+// clamp limits a fragment duration to the configured range.
+func (c *adaptiveConfig) clamp(ms int) int {
+	return min(max(ms, c.minMs), c.maxMs)
+}
+
+// fragmentAdapter tracks the acknowledgement latency and the failed requests of a stream
+// and picks its fragment duration. It has its own mutex since ACKs and errors are parsed
+// from the pipeline log without the forwarder's mutex.
+type fragmentAdapter struct {
+	mutex   sync.Mutex
+	current int // ms, 0 before the first pipeline start
+	applied int // ms of the running pipeline
+	changes int
+
+	// Observations since the last adjustment
+	since   time.Time
+	latency time.Duration // sum
+	samples int
+	errors  int
+	stable  int
+}
+
+// duration returns the fragment duration for a new pipeline and marks it applied.
+func (a *fragmentAdapter) duration(c *adaptiveConfig, configured int) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.current == 0 {
+		a.current = c.clamp(configured)
+		a.since = time.Now()
+	}
+	a.applied = a.current
+	return a.current
+}
+
+// observeFragment records the latency of a persisted fragment: how long after its start beyond
+// the fragment duration it was acknowledged.
+func (f *Forwarder) observeFragment(timecode time.Time) {
+	c := adaptiveConfigFromEnv()
+	if c == nil {
+		return
+	}
+	a := &f.adaptive
+	a.mutex.Lock()
+	if a.applied > 0 {
+		latency := time.Since(timecode) - time.Duration(a.applied)*time.Millisecond
+		a.latency += max(latency, 0)
+		a.samples++
+	}
+	a.mutex.Unlock()
+	f.adaptFragments(c)
+}
+
+// fragmentFailed records a throttled or failed PutMedia request.
+func (f *Forwarder) fragmentFailed() {
+	c := adaptiveConfigFromEnv()
+	if c == nil {
+		return
+	}
+	f.adaptive.mutex.Lock()
+	f.adaptive.errors++
+	f.adaptive.mutex.Unlock()
+	f.adaptFragments(c)
+}
+
+// adaptFragments adjusts the fragment duration once per interval: halved after failures
+// or when the acknowledgements lag more than the threshold, raised by half after stable
+// intervals. The next keyframe starts a pipeline with the new duration.
+func (f *Forwarder) adaptFragments(c *adaptiveConfig) {
+	a := &f.adaptive
+	a.mutex.Lock()
+	if a.current == 0 || time.Since(a.since) < c.interval {
+		a.mutex.Unlock()
+		return
+	}
+	var average time.Duration
+	if a.samples > 0 {
+		average = a.latency / time.Duration(a.samples)
+	}
+	from, to := a.current, a.current
+	reason := ""
+	switch {
+	case a.errors > 0:
+		to, reason = c.clamp(from/2), "failed_requests"
+		a.stable = 0
+	case average > c.threshold:
+		to, reason = c.clamp(from/2), "high_latency"
+		a.stable = 0
+	case a.samples > 0:
+		if a.stable++; a.stable >= adaptiveStableIntervals {
+			to, reason = c.clamp(from*3/2), "stable"
+			a.stable = 0
+		}
+	}
+	errorCount, samples := a.errors, a.samples
+	a.since, a.latency, a.samples, a.errors = time.Now(), 0, 0, 0
+	if to != from {
+		a.current = to
+		a.changes++
+	}
+	a.mutex.Unlock()
+
+	if to == from {
+		return
+	}
+	log.Printf("[KVS] Fragment duration of %s changed from %dms to %dms (%s: %d failed requests, %s average latency over %d fragments)",
+		f.streamName, from, to, reason, errorCount, average.Round(time.Millisecond), samples)
+	events.Emit(events.Event{
+		Type:       events.FragmentDurationChanged,
+		StreamName: f.streamName,
+		Detail: map[string]any{
+			"from_ms":            from,
+			"to_ms":              to,
+			"reason":             reason,
+			"failed_requests":    errorCount,
+			"average_latency_ms": average.Milliseconds(),
+		},
+	})
+}
+
+// fragmentDue reports whether the fragment duration changed and au is a keyframe to
+// start the new pipeline at. Must be called with the mutex held.
+func (f *Forwarder) fragmentDue(au [][]byte) bool {
+	if f.audio != nil || !h264.IsRandomAccess(au) {
+		return false
+	}
+	f.adaptive.mutex.Lock()
+	defer f.adaptive.mutex.Unlock()
+	return f.adaptive.applied != f.adaptive.current
+}
+
+// refragment records a fragment duration change. The caller then replaces the pipeline
+// with one using the new duration: the old pipeline gets an EOS, so kvssink completes the
+// current fragment, before the new one starts at the keyframe. Must be called with the
+// mutex held.
+func (f *Forwarder) refragment() {
+	events.Emit(events.Event{
+		Type:       events.PipelineRestarted,
+		StreamName: f.streamName,
+		Detail:     map[string]any{"reason": "fragment_duration"},
+	})
+}
+
+// fragmentStatus returns the fragment duration in use and the number of adjustments.
+func (f *Forwarder) fragmentStatus(configured int) (int, int) {
+	f.adaptive.mutex.Lock()
+	defer f.adaptive.mutex.Unlock()
+	if f.adaptive.current == 0 {
+		return configured, 0
+	}
+	return f.adaptive.current, f.adaptive.changes
+}
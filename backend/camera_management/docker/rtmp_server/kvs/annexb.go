@@ -0,0 +1,32 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+// annexBStartCode prefixes each NAL unit of an Annex-B byte stream.
+var annexBStartCode = []byte{0, 0, 0, 1}
+
+// annexB encodes an access unit as an Annex-B byte stream. The latest SPS/PPS are
+// inserted before every IDR, so a decoder can start or reconfigure at any keyframe.
+func (m *flvMuxer) annexB(au [][]byte, keyframe bool) []byte {
+	size := 0
+	for _, nalu := range au {
+		size += len(annexBStartCode) + len(nalu)
+	}
+	if keyframe {
+		size += 2*len(annexBStartCode) + len(m.sps) + len(m.pps)
+	}
+	data := make([]byte, 0, size)
+	if keyframe {
+		data = append(append(data, annexBStartCode...), m.sps...)
+		data = append(append(data, annexBStartCode...), m.pps...)
+	}
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		if typ := nalu[0] & 0x1F; keyframe && (typ == 7 || typ == 8) {
+			continue // already inserted
+		}
+		data = append(append(data, annexBStartCode...), nalu...)
+	}
+	return data
+}
@@ -0,0 +1,292 @@
+//go:build gst
+
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+/*
+#cgo pkg-config: gstreamer-1.0 gstreamer-app-1.0
+#include <stdlib.h>
+#include <gst/gst.h>
+#include <gst/app/gstappsrc.h>
+
+static const GstClockTime rtmp_clock_time_none = GST_CLOCK_TIME_NONE;
+
+static GstElement *rtmp_parse_launch(const char *description, char **error) {
+	GError *err = NULL;
+	GstElement *pipeline = gst_parse_launch(description, &err);
+	if (err != NULL) {
+		*error = g_strdup(err->message);
+		g_error_free(err);
+		if (pipeline != NULL) {
+			gst_object_unref(pipeline);
+		}
+		return NULL;
+	}
+	return pipeline;
+}
+
+static GstAppSrc *rtmp_get_appsrc(GstElement *pipeline, const char *name) {
+	GstElement *element = gst_bin_get_by_name(GST_BIN(pipeline), name);
+	if (element == NULL) {
+		return NULL;
+	}
+	if (!GST_IS_APP_SRC(element)) {
+		gst_object_unref(element);
+		return NULL;
+	}
+	return GST_APP_SRC(element);
+}
+
+static void rtmp_set_caps(GstAppSrc *src, const char *caps) {
+	GstCaps *c = gst_caps_from_string(caps);
+	gst_app_src_set_caps(src, c);
+	gst_caps_unref(c);
+}
+
+// rtmp_parse_message returns the source, message and debug string of an error or warning.
+static void rtmp_parse_message(GstMessage *msg, char **source, char **message, char **debug) {
+	GError *err = NULL;
+	if (GST_MESSAGE_TYPE(msg) == GST_MESSAGE_ERROR) {
+		gst_message_parse_error(msg, &err, debug);
+	} else {
+		gst_message_parse_warning(msg, &err, debug);
+	}
+	*source = g_strdup(GST_MESSAGE_SRC_NAME(msg));
+	*message = g_strdup(err != NULL ? err->message : "");
+	if (err != NULL) {
+		g_error_free(err);
+	}
+}
+
+static GstFlowReturn rtmp_push(GstAppSrc *src, const void *data, gsize size, GstClockTime pts, GstClockTime dts) {
+	GstBuffer *buffer = gst_buffer_new_allocate(NULL, size, NULL);
+	gst_buffer_fill(buffer, 0, data, size);
+	GST_BUFFER_PTS(buffer) = pts;
+	GST_BUFFER_DTS(buffer) = dts;
+	return gst_app_src_push_buffer(src, buffer);
+}
+
+static gboolean rtmp_add_metadata(GstAppSrc *src, const char *name, const char *value, gboolean persist) {
+	GstStructure *s = gst_structure_new("kvs-add-metadata",
+		"name", G_TYPE_STRING, name,
+		"value", G_TYPE_STRING, value,
+		"persist", G_TYPE_BOOLEAN, persist,
+		NULL);
+	return gst_element_send_event(GST_ELEMENT(src), gst_event_new_custom(GST_EVENT_CUSTOM_DOWNSTREAM, s));
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// inProcessBuild reports whether the in-process pipeline is available.
+const inProcessBuild = true
+
+// initGStreamer initializes the GStreamer library once per process.
+var initGStreamer = sync.OnceFunc(func() { C.gst_init(nil, nil) })
+
+// appsrcPipeline is an in-process GStreamer pipeline fed through appsrc (experimental,
+// PIPELINE_BACKEND=inprocess). Access units are pushed as byte-stream buffers with
+// explicit PTS/DTS, and errors arrive as bus messages instead of log lines of a child
+// process.
+type appsrcPipeline struct {
+	pipeline *C.GstElement
+	src      *C.GstAppSrc
+	bus      *C.GstBus
+	mux      *flvMuxer // parameter sets and output timeline (no FLV is written)
+
+	started bool // an IDR has been pushed
+
+	// Guards the GStreamer objects, released once the bus reports the end of the pipeline
+	mutex    sync.Mutex
+	released bool
+
+	done chan struct{}
+	err  error
+}
+
+// startAppsrcPipeline builds "appsrc ! <elements>" and sets it to PLAYING.
+// Bus errors and warnings are passed to onLine so they are classified like kvssink logs.
+func startAppsrcPipeline(elements []string, mux *flvMuxer, onLine func(string)) (pipeline, error) {
+	initGStreamer()
+
+	description := C.CString("appsrc name=src is-live=true format=time do-timestamp=false ! " + strings.Join(elements, " "))
+	defer C.free(unsafe.Pointer(description))
+	var cerr *C.char
+	gstPipeline := C.rtmp_parse_launch(description, &cerr)
+	if gstPipeline == nil {
+		defer C.g_free(C.gpointer(unsafe.Pointer(cerr)))
+		return nil, fmt.Errorf("failed to create GStreamer pipeline: %s", C.GoString(cerr))
+	}
+	name := C.CString("src")
+	defer C.free(unsafe.Pointer(name))
+	src := C.rtmp_get_appsrc(gstPipeline, name)
+	if src == nil {
+		C.gst_object_unref(C.gpointer(unsafe.Pointer(gstPipeline)))
+		return nil, fmt.Errorf("failed to find appsrc")
+	}
+	caps := C.CString("video/x-h264,stream-format=byte-stream,alignment=au")
+	defer C.free(unsafe.Pointer(caps))
+	C.rtmp_set_caps(src, caps)
+
+	p := &appsrcPipeline{
+		pipeline: gstPipeline,
+		src:      src,
+		bus:      C.gst_element_get_bus(gstPipeline),
+		mux:      mux,
+		done:     make(chan struct{}),
+	}
+	if C.gst_element_set_state(gstPipeline, C.GST_STATE_PLAYING) == C.GST_STATE_CHANGE_FAILURE {
+		p.release()
+		return nil, fmt.Errorf("failed to start GStreamer pipeline")
+	}
+	mux.reset(nil)
+
+	go p.watchBus(onLine)
+	return p, nil
+}
+
+// release stops the pipeline and drops the references held on it.
+func (p *appsrcPipeline) release() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.released = true
+	C.gst_element_set_state(p.pipeline, C.GST_STATE_NULL)
+	C.gst_object_unref(C.gpointer(unsafe.Pointer(p.bus)))
+	C.gst_object_unref(C.gpointer(unsafe.Pointer(p.src)))
+	C.gst_object_unref(C.gpointer(unsafe.Pointer(p.pipeline)))
+}
+
+// watchBus waits for EOS or an error on the pipeline bus, then shuts the pipeline down.
+func (p *appsrcPipeline) watchBus(onLine func(string)) {
+	defer close(p.done)
+	defer p.release()
+
+	types := C.GstMessageType(C.GST_MESSAGE_EOS | C.GST_MESSAGE_ERROR | C.GST_MESSAGE_WARNING)
+	for {
+		msg := C.gst_bus_timed_pop_filtered(p.bus, C.rtmp_clock_time_none, types)
+		if msg == nil {
+			// Bus flushed by stop()
+			return
+		}
+		msgType := msg._type
+		if msgType == C.GST_MESSAGE_EOS {
+			C.gst_mini_object_unref((*C.GstMiniObject)(unsafe.Pointer(msg)))
+			return
+		}
+
+		var source, message, debug *C.char
+		C.rtmp_parse_message(msg, &source, &message, &debug)
+		C.gst_mini_object_unref((*C.GstMiniObject)(unsafe.Pointer(msg)))
+		kind := "WARNING"
+		if msgType == C.GST_MESSAGE_ERROR {
+			kind = "ERROR"
+		}
+		line := fmt.Sprintf("%s from %s: %s (%s)", kind, C.GoString(source), C.GoString(message), C.GoString(debug))
+		if msgType == C.GST_MESSAGE_ERROR {
+			p.err = fmt.Errorf("%s: %s", C.GoString(source), C.GoString(message))
+		}
+		C.g_free(C.gpointer(unsafe.Pointer(source)))
+		C.g_free(C.gpointer(unsafe.Pointer(message)))
+		C.g_free(C.gpointer(unsafe.Pointer(debug)))
+
+		log.Printf("[GStreamer] %s", line)
+		onLine(line)
+		if p.err != nil {
+			return
+		}
+	}
+}
+
+// writeAU pushes the access unit as an Annex-B buffer. SPS/PPS are inserted before every
+// IDR so h264parse can (re)configure after parameter changes, and pictures are dropped
+// until the first IDR.
+func (p *appsrcPipeline) writeAU(pts, dts time.Duration, au [][]byte) error {
+	keyframe, hasSlice, _ := p.mux.inspect(au)
+	if !hasSlice || p.mux.sps == nil || p.mux.pps == nil {
+		return nil
+	}
+	if !p.started && !keyframe {
+		return nil
+	}
+	p.started = true
+
+	data := p.mux.annexB(au, keyframe)
+
+	// Timestamps on the forwarder's monotonic output timeline
+	ts := p.mux.timestamp(dts)
+	p.mux.advance(ts)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.released {
+		return fmt.Errorf("pipeline has exited")
+	}
+	flow := C.rtmp_push(p.src, unsafe.Pointer(&data[0]), C.gsize(len(data)),
+		C.GstClockTime(ts+(pts-dts)), C.GstClockTime(ts))
+	if flow != C.GST_FLOW_OK {
+		return fmt.Errorf("appsrc push failed: %s", C.GoString(C.gst_flow_get_name(flow)))
+	}
+	return nil
+}
+
+// addMetadata sends the kvs-add-metadata custom event, which kvssink attaches to the
+// next fragment (or to all following fragments if persistent).
+func (p *appsrcPipeline) addMetadata(name, value string, persistent bool) error {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(cvalue))
+	var persist C.gboolean
+	if persistent {
+		persist = 1
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.released {
+		return fmt.Errorf("pipeline has exited")
+	}
+	if C.rtmp_add_metadata(p.src, cname, cvalue, persist) == 0 {
+		return fmt.Errorf("pipeline did not accept metadata %s", name)
+	}
+	return nil
+}
+
+// writeAudio is not supported; audio-only streams always use gst-launch-1.0.
+func (p *appsrcPipeline) writeAudio(pts time.Duration, frame []byte) error {
+	return fmt.Errorf("audio is not supported by the in-process pipeline")
+}
+
+func (p *appsrcPipeline) wait() error {
+	<-p.done
+	return p.err
+}
+
+// stop sends EOS so kvssink can flush the last fragment, then tears the pipeline down.
+func (p *appsrcPipeline) stop(timeout time.Duration) {
+	p.mutex.Lock()
+	if !p.released {
+		C.gst_app_src_end_of_stream(p.src)
+	}
+	p.mutex.Unlock()
+
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		log.Printf("[KVS] Pipeline did not reach EOS in %s, forcing shutdown", timeout)
+		// The bus is only released after watchBus returns, which it cannot before done
+		C.gst_bus_set_flushing(p.bus, 1)
+		<-p.done
+	}
+}
+
+func (p *appsrcPipeline) String() string {
+	return "in-process appsrc"
+}
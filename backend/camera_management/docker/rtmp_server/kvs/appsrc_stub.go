@@ -0,0 +1,12 @@
+//go:build !gst
+
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+// inProcessBuild reports whether the in-process pipeline is available.
+const inProcessBuild = false
+
+// startAppsrcPipeline is only available in builds with the gst tag.
+func startAppsrcPipeline(elements []string, mux *flvMuxer, onLine func(string)) (pipeline, error) {
+	return nil, errInProcessUnavailable
+}
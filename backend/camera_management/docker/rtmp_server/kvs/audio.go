@@ -0,0 +1,190 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Audio codecs accepted for audio-only streams.
+const (
+	AudioCodecAAC  = "AAC"
+	AudioCodecPCMA = "PCMA" // G.711 A-law
+	AudioCodecPCMU = "PCMU" // G.711 mu-law
+)
+
+// AudioTrack describes the track of an audio-only publisher (e.g. an intercom sending
+// G.711 or AAC without video), or the AAC track forwarded with the H.264 video.
+type AudioTrack struct {
+	Codec        string `json:"codec"`
+	SampleRate   int    `json:"sample_rate"`
+	ChannelCount int    `json:"channels"`
+	Config       []byte `json:"-"` // AAC AudioSpecificConfig
+}
+
+func (t *AudioTrack) String() string {
+	return fmt.Sprintf("%s %d Hz, %d ch", t.Codec, t.SampleRate, t.ChannelCount)
+}
+
+// equal reports whether both tracks produce the same pipeline (nil means video).
+func (t *AudioTrack) equal(o *AudioTrack) bool {
+	if t == nil || o == nil {
+		return t == o
+	}
+	return t.Codec == o.Codec && t.SampleRate == o.SampleRate &&
+		t.ChannelCount == o.ChannelCount && bytes.Equal(t.Config, o.Config)
+}
+
+// elements returns the GStreamer elements between flvdemux's audio pad and kvssink.
+func (t *AudioTrack) elements() []string {
+	switch t.Codec {
+	case AudioCodecAAC:
+		return []string{"aacparse", "!", "audio/mpeg,mpegversion=4,stream-format=raw"}
+	default:
+		// RTMP signals G.711 with the 5.5 kHz rate index; kvssink needs the real 8 kHz rate
+		format := "audio/x-alaw"
+		if t.Codec == AudioCodecPCMU {
+			format = "audio/x-mulaw"
+		}
+		return []string{"capssetter", fmt.Sprintf("caps=%s,rate=%d,channels=%d", format, t.SampleRate, t.ChannelCount)}
+	}
+}
+
+// StartAudio starts an audio-only pipeline for the track, running until Stop is called or
+// ctx is cancelled. A running pipeline with a different track layout (e.g. a warm video
+// pipeline) is replaced.
+func (f *Forwarder) StartAudio(ctx context.Context, track AudioTrack) error {
+	return f.request(transition{kind: transitionStart, ctx: ctx, audio: &track})
+}
+
+// StartWithAudio starts the pipeline for H.264 video with an interleaved AAC track (nil
+// for video only), like Start. A running pipeline with a different audio track is replaced.
+func (f *Forwarder) StartWithAudio(ctx context.Context, track *AudioTrack) error {
+	return f.request(transition{kind: transitionStart, ctx: ctx, interleaved: track})
+}
+
+// WriteAudio writes an audio frame (AAC access unit or G.711 samples) to an audio-only
+// pipeline, or an AAC frame to a video pipeline started with StartWithAudio. Frames of
+// the interleaved track are dropped until the pipeline has its first keyframe, so every
+// fragment starts with video. Auto-restarts the pipeline if it has stopped unexpectedly.
+func (f *Forwarder) WriteAudio(ctx context.Context, pts time.Duration, frame []byte) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	if f.restartDue() {
+		if err := f.request(transition{kind: transitionRestart}); err != nil {
+			return
+		}
+	}
+
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+
+	// Written without the mutex, like video
+	f.mutex.Lock()
+	p, audioOnly := f.pipeline, f.audio != nil
+	skip := f.state != stateRunning || (!audioOnly && (f.interleaved == nil || f.awaitKeyframe))
+	f.mutex.Unlock()
+	if skip {
+		return
+	}
+	if err := p.writeAudio(pts, frame); err != nil {
+		log.Printf("[KVS] Failed to write audio frame: %v", err)
+		return
+	}
+	if !audioOnly {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.offlineWrote(pts)
+
+	f.frameCount++
+	f.runFrames++
+	if time.Since(f.lastLogTime) > 10*time.Second {
+		log.Printf("[KVS] Audio frames forwarded: %d", f.frameCount)
+		f.lastLogTime = time.Now()
+	}
+}
+
+// writeAudio writes an audio frame of the muxer's audio track in a single write.
+func (m *flvMuxer) writeAudio(pts time.Duration, frame []byte) (err error) {
+	if m.audio == nil {
+		if m.interleaved != nil {
+			return m.writeInterleaved(pts, frame)
+		}
+		return fmt.Errorf("no audio track configured")
+	}
+
+	if !m.configSent {
+		m.batch.hold()
+		defer func() {
+			if flushErr := m.batch.flush(); err == nil {
+				err = flushErr
+			}
+		}()
+	}
+
+	if !m.headerSent {
+		if err := m.w.WriteHeader(false, true); err != nil {
+			return err
+		}
+		m.headerSent = true
+	}
+
+	ts := m.timestamp(pts)
+
+	if !m.configSent && m.audio.Codec == AudioCodecAAC {
+		if err := m.w.WriteAACConfig(uint32(ts/time.Millisecond), m.audio.Config); err != nil {
+			return err
+		}
+	}
+	m.configSent = true
+
+	m.advance(ts)
+	switch m.audio.Codec {
+	case AudioCodecAAC:
+		return m.w.WriteAAC(uint32(ts/time.Millisecond), frame)
+	default:
+		return m.w.WriteG711(uint32(ts/time.Millisecond), m.audio.Codec == AudioCodecPCMU, m.audio.ChannelCount == 2, frame)
+	}
+}
+
+// writeInterleaved writes a frame of the AAC track of a video stream, on the timeline of
+// the video. Frames before the first video frame, out of order or too far from the video
+// (e.g. across a rebased video timeline) are dropped.
+func (m *flvMuxer) writeInterleaved(pts time.Duration, frame []byte) error {
+	if !m.configSent || !m.hasOutput {
+		return nil
+	}
+	ts := pts - m.base
+	if ts < 0 || (m.hasAudio && ts <= m.lastAudio) ||
+		ts < m.lastDTS-maxTimestampJump || ts > m.lastDTS+maxTimestampJump {
+		return nil
+	}
+	m.lastAudio, m.hasAudio = ts, true
+	return m.w.WriteAAC(uint32(ts/time.Millisecond), frame)
+}
+
+// writeInterleavedConfig writes the AAC sequence header of the interleaved track.
+func (m *flvMuxer) writeInterleavedConfig(ts time.Duration) error {
+	if m.interleaved == nil {
+		return nil
+	}
+	return m.w.WriteAACConfig(uint32(ts/time.Millisecond), m.interleaved.Config)
+}
+
+// interleavedElements returns the GStreamer branch from flvdemux's audio pad to the
+// kvssink named sink, for the AAC track of a video stream.
+func (t *AudioTrack) interleavedElements(queue []string) []string {
+	elements := []string{"demux.audio", "!"}
+	elements = append(elements, t.elements()...)
+	elements = append(elements, "!")
+	elements = append(elements, queue...)
+	return append(elements, "!", "sink.")
+}
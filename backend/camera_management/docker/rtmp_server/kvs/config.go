@@ -0,0 +1,322 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"rtmp_kvs/schedule"
+	"rtmp_kvs/sink"
+)
+
+// StreamConfig holds the kvssink parameters of one KVS stream. Zero values fall back to
+// the next source: registry entry > STREAM_CONFIG_FILE > environment > built-in default.
+type StreamConfig struct {
+	RetentionHours     int `json:"retention_hours,omitempty"`
+	FragmentDurationMs int `json:"fragment_duration_ms,omitempty"`
+	StorageSizeMB      int `json:"storage_size_mb,omitempty"`
+
+	// Ingest bitrate cap of the publisher in kbit/s, 0 for none (enforced by the server)
+	MaxBitrateKbps int `json:"max_bitrate_kbps,omitempty"`
+
+	// IAM role assumed (via STS) for writing to the stream instead of the task role, and
+	// the external ID required by its trust policy
+	RoleARN    string `json:"role_arn,omitempty"`
+	ExternalID string `json:"external_id,omitempty"`
+
+	// AWS account the stream must be written to, e.g. a central video lake; a pipeline
+	// whose credentials (task role or RoleARN) belong to another account is not started
+	AccountID string `json:"account_id,omitempty"`
+
+	// KMS key (ID, ARN or alias) the stream is created with, and which an existing stream
+	// must be encrypted with
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+
+	// Sinks the stream is written to besides KVS ("file", "s3", "rtmp"; see package sink)
+	// and the target of the rtmp sink
+	Sinks    []string `json:"sinks,omitempty"`
+	RelayURL string   `json:"relay_url,omitempty"`
+
+	// KVS streams the stream is sharded over, to stay under the ingestion limits of a
+	// single stream: the forwarder writes to one of them per time window of
+	// ShardWindowSeconds, switching at a keyframe, chosen by ShardStrategy
+	// ("round_robin" or "least_loaded")
+	Shards             []string `json:"shards,omitempty"`
+	ShardWindowSeconds int      `json:"shard_window_seconds,omitempty"`
+	ShardStrategy      string   `json:"shard_strategy,omitempty"`
+
+	// What happens to a publisher sending video in a codec other than H.264
+	// (TrackIgnore, TrackReject or TrackTranscode; enforced by the server)
+	UnsupportedVideo string `json:"unsupported_video,omitempty"`
+
+	// Time-of-day windows KVS forwarding is active in (see schedule.Parse), their IANA
+	// time zone (UTC when empty), and whether frames outside them are discarded or the
+	// latest of them buffered and forwarded when the window opens (ScheduleDiscard or
+	// ScheduleBuffer; enforced by the server)
+	Schedule         string `json:"schedule,omitempty"`
+	ScheduleTimezone string `json:"schedule_timezone,omitempty"`
+	ScheduleMode     string `json:"schedule_mode,omitempty"`
+
+	// Buffering of the pipeline: a profile (ProfileDefault, ProfileLowLatency or
+	// ProfileResilient) and overrides of its queue limits and of the kvssink max-latency
+	PipelineProfile   string `json:"pipeline_profile,omitempty"`
+	QueueMaxBytes     int    `json:"queue_max_bytes,omitempty"`
+	QueueMaxBuffers   int    `json:"queue_max_buffers,omitempty"`
+	QueueMaxTimeMs    int    `json:"queue_max_time_ms,omitempty"`
+	MaxLatencySeconds int    `json:"max_latency_seconds,omitempty"`
+}
+
+// Policies for video tracks in codecs other than H.264
+const (
+	TrackIgnore    = "ignore"    // ignore the track, forwarding only what the stream has besides it
+	TrackReject    = "reject"    // refuse the publisher
+	TrackTranscode = "transcode" // re-encode H.265 to H.264 (other codecs are refused)
+)
+
+// What happens to the frames of a stream outside its forwarding schedule
+const (
+	ScheduleDiscard = "discard" // discarded
+	ScheduleBuffer  = "buffer"  // the latest are kept and forwarded when the window opens
+)
+
+// Merge returns c with the non-zero fields of override applied.
+func (c StreamConfig) Merge(override StreamConfig) StreamConfig {
+	if override.RetentionHours > 0 {
+		c.RetentionHours = override.RetentionHours
+	}
+	if override.FragmentDurationMs > 0 {
+		c.FragmentDurationMs = override.FragmentDurationMs
+	}
+	if override.StorageSizeMB > 0 {
+		c.StorageSizeMB = override.StorageSizeMB
+	}
+	if override.MaxBitrateKbps > 0 {
+		c.MaxBitrateKbps = override.MaxBitrateKbps
+	}
+	if override.RoleARN != "" {
+		// The external ID belongs to the role's trust policy
+		c.RoleARN = override.RoleARN
+		c.ExternalID = override.ExternalID
+		c.AccountID = override.AccountID
+	}
+	if override.AccountID != "" {
+		c.AccountID = override.AccountID
+	}
+	if override.KMSKeyID != "" {
+		c.KMSKeyID = override.KMSKeyID
+	}
+	if len(override.Sinks) > 0 {
+		c.Sinks = override.Sinks
+	}
+	if override.RelayURL != "" {
+		c.RelayURL = override.RelayURL
+	}
+	if len(override.Shards) > 0 {
+		c.Shards = override.Shards
+	}
+	if override.ShardWindowSeconds > 0 {
+		c.ShardWindowSeconds = override.ShardWindowSeconds
+	}
+	if override.ShardStrategy != "" {
+		c.ShardStrategy = override.ShardStrategy
+	}
+	if override.UnsupportedVideo != "" {
+		c.UnsupportedVideo = override.UnsupportedVideo
+	}
+	if override.Schedule != "" {
+		// The time zone and mode belong to the windows
+		c.Schedule = override.Schedule
+		c.ScheduleTimezone = override.ScheduleTimezone
+		c.ScheduleMode = override.ScheduleMode
+	}
+	if override.ScheduleTimezone != "" {
+		c.ScheduleTimezone = override.ScheduleTimezone
+	}
+	if override.ScheduleMode != "" {
+		c.ScheduleMode = override.ScheduleMode
+	}
+	if override.PipelineProfile != "" {
+		// A profile replaces the limits inherited along with the previous one
+		c.PipelineProfile = override.PipelineProfile
+		c.QueueMaxBytes, c.QueueMaxBuffers, c.QueueMaxTimeMs, c.MaxLatencySeconds = 0, 0, 0, 0
+	}
+	if override.QueueMaxBytes > 0 {
+		c.QueueMaxBytes = override.QueueMaxBytes
+	}
+	if override.QueueMaxBuffers > 0 {
+		c.QueueMaxBuffers = override.QueueMaxBuffers
+	}
+	if override.QueueMaxTimeMs > 0 {
+		c.QueueMaxTimeMs = override.QueueMaxTimeMs
+	}
+	if override.MaxLatencySeconds > 0 {
+		c.MaxLatencySeconds = override.MaxLatencySeconds
+	}
+	return c
+}
+
+// defaultStreamConfig reads RETENTION_PERIOD (hours, default 24), FRAGMENT_DURATION
+// (ms, default 2000), STORAGE_SIZE (MiB, default 512), KVS_KMS_KEY_ID (default the
+// AWS managed key aws/kinesisvideo), SINKS (comma-separated, default KVS only),
+// MAX_INGEST_BITRATE (kbit/s, default unlimited), SHARD_WINDOW (seconds, default 60),
+// SHARD_STRATEGY (round_robin when empty), UNSUPPORTED_VIDEO (default ignore),
+// PIPELINE_PROFILE (default "default") and the overrides of its limits QUEUE_MAX_BYTES,
+// QUEUE_MAX_BUFFERS, QUEUE_MAX_TIME (ms) and KVS_MAX_LATENCY (seconds), and
+// FORWARDING_SCHEDULE (default always), FORWARDING_SCHEDULE_TIMEZONE and
+// FORWARDING_SCHEDULE_MODE (default discard).
+func defaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		RetentionHours:     envInt("RETENTION_PERIOD", 24),
+		FragmentDurationMs: envInt("FRAGMENT_DURATION", 2000),
+		StorageSizeMB:      envInt("STORAGE_SIZE", 512),
+		MaxBitrateKbps:     envInt("MAX_INGEST_BITRATE", 0),
+		KMSKeyID:           os.Getenv("KVS_KMS_KEY_ID"),
+		Sinks:              sink.ParseList(os.Getenv("SINKS")),
+		ShardWindowSeconds: envInt("SHARD_WINDOW", 60),
+		ShardStrategy:      os.Getenv("SHARD_STRATEGY"),
+		UnsupportedVideo:   cmp.Or(os.Getenv("UNSUPPORTED_VIDEO"), TrackIgnore),
+		PipelineProfile:    profileFromEnv(),
+		QueueMaxBytes:      envInt("QUEUE_MAX_BYTES", 0),
+		QueueMaxBuffers:    envInt("QUEUE_MAX_BUFFERS", 0),
+		QueueMaxTimeMs:     envInt("QUEUE_MAX_TIME", 0),
+		MaxLatencySeconds:  envInt("KVS_MAX_LATENCY", 0),
+		Schedule:           os.Getenv("FORWARDING_SCHEDULE"),
+		ScheduleTimezone:   os.Getenv("FORWARDING_SCHEDULE_TIMEZONE"),
+		ScheduleMode:       os.Getenv("FORWARDING_SCHEDULE_MODE"),
+	}
+}
+
+// streamConfigFile is the layout of STREAM_CONFIG_FILE:
+//
+//	{
+//	  "streams": {
+//	    "entrance-cam":    {"retention_hours": 720},
+//	    "loading-dock-cam": {"retention_hours": 24, "fragment_duration_ms": 4000, "max_bitrate_kbps": 8000},
+//	    "tenant-a-cam":    {"role_arn": "arn:aws:iam::111122223333:role/kvs-tenant-a", "external_id": "tenant-a"},
+//	    "tenant-b-cam":    {"kms_key_id": "arn:aws:kms:ap-northeast-1:444455556666:key/1234abcd-12ab-34cd-56ef-1234567890ab"},
+//	    "archived-cam":    {"sinks": ["kvs", "s3"]},
+//	    "relayed-cam":     {"sinks": ["kvs", "rtmp"], "relay_url": "rtmps://backup.example.com/live/relayed-cam"},
+//	    "high-fps-cam":    {"shards": ["high-fps-cam-0", "high-fps-cam-1"], "shard_window_seconds": 30},
+//	    "hevc-cam":        {"unsupported_video": "transcode"},
+//	    "monitor-cam":     {"pipeline_profile": "low_latency"},
+//	    "lte-cam":         {"pipeline_profile": "resilient", "queue_max_bytes": 134217728},
+//	    "store-cam":       {"schedule": "mon-sat 09:00-21:00; sun 10:00-19:00", "schedule_timezone": "Asia/Tokyo"}
+//	  }
+//	}
+type streamConfigFile struct {
+	Streams map[string]StreamConfig `json:"streams"`
+}
+
+// Effective returns the settings of a stream configured with c: c over the environment
+// defaults, as Forwarder.Config returns them.
+func (c StreamConfig) Effective() StreamConfig {
+	return defaultStreamConfig().Merge(c)
+}
+
+// LoadStreamConfigFile reads per-stream settings keyed by KVS stream name.
+func LoadStreamConfigFile(path string) (map[string]StreamConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream config: %w", err)
+	}
+	var file streamConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse stream config %s: %w", path, err)
+	}
+	for name, cfg := range file.Streams {
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("stream config for %s: %w", name, err)
+		}
+	}
+	return file.Streams, nil
+}
+
+// Validate checks the values of a per-stream configuration.
+func (c StreamConfig) Validate() error {
+	if c.RetentionHours < 0 || c.FragmentDurationMs < 0 || c.StorageSizeMB < 0 || c.MaxBitrateKbps < 0 {
+		return errors.New("negative values")
+	}
+	if c.RetentionHours > maxRetentionHours {
+		return fmt.Errorf("retention_hours exceeds %d", maxRetentionHours)
+	}
+	if c.RoleARN != "" && !strings.HasPrefix(c.RoleARN, "arn:") {
+		return fmt.Errorf("invalid role_arn %q", c.RoleARN)
+	}
+	if c.ExternalID != "" && c.RoleARN == "" {
+		return errors.New("external_id without a role_arn")
+	}
+	if c.AccountID != "" && !accountIDPattern.MatchString(c.AccountID) {
+		return fmt.Errorf("invalid account_id %q", c.AccountID)
+	}
+	if c.KMSKeyID != "" && !ValidKMSKeyID(c.KMSKeyID) {
+		return fmt.Errorf("invalid kms_key_id %q", c.KMSKeyID)
+	}
+	for _, kind := range c.Sinks {
+		if !sink.Valid(kind) {
+			return fmt.Errorf("unknown sink %q", kind)
+		}
+	}
+	if c.ShardWindowSeconds < 0 {
+		return errors.New("negative values")
+	}
+	if c.ShardStrategy != "" && c.ShardStrategy != ShardRoundRobin && c.ShardStrategy != ShardLeastLoaded {
+		return fmt.Errorf("unknown shard_strategy %q", c.ShardStrategy)
+	}
+	switch c.UnsupportedVideo {
+	case "", TrackIgnore, TrackReject, TrackTranscode:
+	default:
+		return fmt.Errorf("unknown unsupported_video %q", c.UnsupportedVideo)
+	}
+	if c.Schedule != "" {
+		if _, err := schedule.Parse(c.Schedule, ""); err != nil {
+			return err
+		}
+	}
+	if c.ScheduleTimezone != "" {
+		if _, err := time.LoadLocation(c.ScheduleTimezone); err != nil {
+			return fmt.Errorf("invalid schedule_timezone %q", c.ScheduleTimezone)
+		}
+	}
+	switch c.ScheduleMode {
+	case "", ScheduleDiscard, ScheduleBuffer:
+	default:
+		return fmt.Errorf("unknown schedule_mode %q", c.ScheduleMode)
+	}
+	if !validProfile(c.PipelineProfile) {
+		return fmt.Errorf("unknown pipeline_profile %q", c.PipelineProfile)
+	}
+	if c.QueueMaxBytes < 0 || c.QueueMaxBuffers < 0 || c.QueueMaxTimeMs < 0 || c.MaxLatencySeconds < 0 {
+		return errors.New("negative values")
+	}
+	for _, shard := range c.Shards {
+		if shard == "" {
+			return errors.New("empty shard stream name")
+		}
+	}
+	if c.RelayURL != "" {
+		return sink.CheckRelayURL(c.RelayURL)
+	}
+	return nil
+}
+
+// kvssinkArgs returns the kvssink properties for the configuration.
+func (c StreamConfig) kvssinkArgs() []string {
+	args := []string{
+		"retention-period=" + strconv.Itoa(c.RetentionHours),
+		"fragment-duration=" + strconv.Itoa(c.FragmentDurationMs),
+		"storage-size=" + strconv.Itoa(c.StorageSizeMB),
+	}
+	if c.KMSKeyID != "" {
+		args = append(args, "kms-key-id="+c.KMSKeyID)
+	}
+	if latency := c.pipelineLimits().maxLatencySeconds; latency > 0 {
+		args = append(args, "max-latency="+strconv.Itoa(latency))
+	}
+	return args
+}
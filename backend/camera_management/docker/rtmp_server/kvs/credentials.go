@@ -2,12 +2,14 @@
 package kvs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,9 +22,59 @@ type ecsCredentials struct {
 	Expiration      time.Time `json:"Expiration"`
 }
 
-// CredentialManager manages AWS credentials refresh for ECS Fargate environment.
+// credentials is a set of temporary AWS credentials obtained from a credential source.
+type credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// credentialSource fetches credentials from one provider (ECS, IoT, ...).
+type credentialSource interface {
+	name() string
+	fetch() (*credentials, error)
+	// checkInterval is how often the background refresh checks for expiry, 0 for
+	// credentials that do not expire.
+	checkInterval() time.Duration
+}
+
+// detectCredentialSource selects the credential source from the environment, in this
+// order: IoT credentials provider, static AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY, web
+// identity (EKS IRSA), an explicit AWS_PROFILE, the container credentials endpoint (ECS,
+// Greengrass), the default profile of the shared config files, and EC2 instance metadata
+// (IMDSv2). It returns nil when none is available.
+func detectCredentialSource() credentialSource {
+	if src := iotSourceFromEnv(); src != nil {
+		return src
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		return staticSource{}
+	}
+	if src := webIdentitySourceFromEnv(); src != nil {
+		return src
+	}
+	if os.Getenv("AWS_PROFILE") != "" {
+		return profileSourceFromEnv()
+	}
+	if src := containerSourceFromEnv(); src != nil {
+		return src
+	}
+	if src := profileSourceFromEnv(); src.exists() {
+		return src
+	}
+	if src := imdsSourceFromEnv(); src != nil {
+		return src
+	}
+	return nil
+}
+
+// CredentialManager manages AWS credentials refresh (ECS or Greengrass container
+// credentials, AWS IoT credentials provider, web identity, shared config profiles, EC2
+// instance metadata or static keys) and exports them as environment variables.
 type CredentialManager struct {
 	mutex           sync.RWMutex
+	source          credentialSource
 	lastRefresh     time.Time
 	refreshInterval time.Duration
 	expiration      time.Time
@@ -31,84 +83,82 @@ type CredentialManager struct {
 // NewCredentialManager creates a new credential manager.
 func NewCredentialManager() *CredentialManager {
 	return &CredentialManager{
+		source: detectCredentialSource(),
 		// Refresh credentials every 5 hours (before 6-hour expiration)
 		refreshInterval: 5 * time.Hour,
 	}
 }
 
-// RefreshCredentials fetches fresh credentials from ECS Container Credentials endpoint
+// Source describes where the credentials come from, empty if no source was found.
+func (cm *CredentialManager) Source() string {
+	if cm.source == nil {
+		return ""
+	}
+	return cm.source.name()
+}
+
+// RefreshCredentials fetches fresh credentials from the credential source
 // and exports them as environment variables for KVS SDK to use.
 func (cm *CredentialManager) RefreshCredentials() error {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
-	// Check if running on ECS Fargate
-	relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
-	if relativeURI == "" {
-		log.Println("[Credentials] Not running on ECS Fargate, skipping credential refresh")
+	if cm.source == nil {
+		log.Println("[Credentials] No AWS credential source found, skipping credential refresh")
 		return nil
 	}
 
 	// Check if refresh is needed
 	if !cm.needsRefresh() {
-		log.Printf("[Credentials] Credentials still valid until %s, skipping refresh", cm.expiration.Format(time.RFC3339))
+		if !cm.expiration.IsZero() {
+			log.Printf("[Credentials] Credentials still valid until %s, skipping refresh", cm.expiration.Format(time.RFC3339))
+		}
 		return nil
 	}
 
-	log.Println("[Credentials] Refreshing AWS credentials from ECS Container Credentials endpoint...")
-
-	// Build endpoint URL
-	endpoint := fmt.Sprintf("http://169.254.170.2%s", relativeURI)
+	log.Printf("[Credentials] Refreshing AWS credentials from %s...", cm.source.name())
 
-	// Fetch credentials
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(endpoint)
+	creds, err := cm.source.fetch()
 	if err != nil {
-		return fmt.Errorf("failed to fetch credentials: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("credentials endpoint returned status %d: %s", resp.StatusCode, string(body))
+		return err
 	}
 
-	// Parse response
-	var creds ecsCredentials
-	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
-		return fmt.Errorf("failed to parse credentials response: %w", err)
-	}
-
-	// Validate credentials
-	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" || creds.Token == "" {
-		return fmt.Errorf("incomplete credentials received from endpoint")
+	// Validate credentials (long-term keys have no session token or expiration)
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" || (creds.SessionToken == "" && !creds.Expiration.IsZero()) {
+		return fmt.Errorf("incomplete credentials received from %s", cm.source.name())
 	}
 
 	// Export as environment variables for KVS SDK
-	os.Setenv("AWS_ACCESS_KEY_ID", creds.AccessKeyId)
+	os.Setenv("AWS_ACCESS_KEY_ID", creds.AccessKeyID)
 	os.Setenv("AWS_SECRET_ACCESS_KEY", creds.SecretAccessKey)
-	os.Setenv("AWS_SESSION_TOKEN", creds.Token)
+	if creds.SessionToken != "" {
+		os.Setenv("AWS_SESSION_TOKEN", creds.SessionToken)
+	} else {
+		os.Unsetenv("AWS_SESSION_TOKEN")
+	}
 
 	// Update state
 	cm.lastRefresh = time.Now()
 	cm.expiration = creds.Expiration
 
 	log.Printf("[Credentials] ✅ AWS credentials refreshed successfully")
-	log.Printf("[Credentials]    AccessKeyId: %s...", creds.AccessKeyId[:10])
-	log.Printf("[Credentials]    Expiration: %s", creds.Expiration.Format(time.RFC3339))
+	log.Printf("[Credentials]    AccessKeyId: %s...", creds.AccessKeyID[:min(10, len(creds.AccessKeyID))])
+	if !creds.Expiration.IsZero() {
+		log.Printf("[Credentials]    Expiration: %s", creds.Expiration.Format(time.RFC3339))
+	}
 
 	return nil
 }
 
 // needsRefresh checks if credentials need to be refreshed.
 func (cm *CredentialManager) needsRefresh() bool {
-	// First time or no expiration set
-	if cm.lastRefresh.IsZero() || cm.expiration.IsZero() {
+	// First time
+	if cm.lastRefresh.IsZero() {
 		return true
 	}
 
-	// Refresh if within 30 minutes of expiration
-	if time.Until(cm.expiration) < 30*time.Minute {
+	// Refresh if within 30 minutes of expiration (long-term keys do not expire)
+	if !cm.expiration.IsZero() && time.Until(cm.expiration) < 30*time.Minute {
 		return true
 	}
 
@@ -129,31 +179,129 @@ func (cm *CredentialManager) ForceRefresh() error {
 	return cm.RefreshCredentials()
 }
 
-// StartBackgroundRefresh starts a background goroutine that periodically refreshes credentials.
-func (cm *CredentialManager) StartBackgroundRefresh(stopCh <-chan struct{}) {
-	// Only start if running on ECS Fargate
-	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") == "" {
-		log.Println("[Credentials] Background refresh not needed (not on ECS Fargate)")
+// RunBackgroundRefresh periodically refreshes credentials until ctx is cancelled. It
+// returns immediately when the credentials are not refreshable.
+func (cm *CredentialManager) RunBackgroundRefresh(ctx context.Context) {
+	// Only run with a refreshable credential source
+	if cm.source == nil || cm.source.checkInterval() == 0 {
+		log.Println("[Credentials] Background refresh not needed (no expiring credentials)")
 		return
 	}
+	interval := cm.source.checkInterval()
 
-	go func() {
-		// Check every 30 minutes
-		ticker := time.NewTicker(30 * time.Minute)
-		defer ticker.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		log.Println("[Credentials] Background credential refresh started (checking every 30 minutes)")
+	log.Printf("[Credentials] Background credential refresh started (checking every %s)", interval)
 
-		for {
-			select {
-			case <-ticker.C:
-				if err := cm.RefreshCredentials(); err != nil {
-					log.Printf("[Credentials] ⚠️  Background refresh failed: %v", err)
-				}
-			case <-stopCh:
-				log.Println("[Credentials] Background credential refresh stopped")
-				return
+	for {
+		select {
+		case <-ticker.C:
+			if err := cm.RefreshCredentials(); err != nil {
+				log.Printf("[Credentials] ⚠️  Background refresh failed: %v", err)
 			}
+		case <-ctx.Done():
+			log.Println("[Credentials] Background credential refresh stopped")
+			return
 		}
-	}()
+	}
+}
+
+// staticSource uses the long-term keys of AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY.
+type staticSource struct{}
+
+func (staticSource) name() string {
+	return "environment variables"
+}
+
+func (staticSource) checkInterval() time.Duration {
+	return 0
+}
+
+func (staticSource) fetch() (*credentials, error) {
+	return &credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+// ecsSource fetches credentials from a container credentials endpoint: the ECS task role
+// (AWS_CONTAINER_CREDENTIALS_RELATIVE_URI) or a full URI with an authorization token, as
+// the Greengrass token exchange service provides.
+type ecsSource struct {
+	endpoint  string
+	tokenFile string // AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE, re-read on every refresh
+	token     string // AWS_CONTAINER_AUTHORIZATION_TOKEN
+}
+
+// containerSourceFromEnv configures the container credentials endpoint from
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI. It
+// returns nil if neither is set.
+func containerSourceFromEnv() *ecsSource {
+	src := &ecsSource{
+		tokenFile: os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"),
+		token:     os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+	}
+	if relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeURI != "" {
+		src.endpoint = "http://169.254.170.2" + relativeURI
+	} else if fullURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); fullURI != "" {
+		src.endpoint = fullURI
+	} else {
+		return nil
+	}
+	return src
+}
+
+func (s *ecsSource) name() string {
+	return "container credentials endpoint"
+}
+
+func (s *ecsSource) checkInterval() time.Duration {
+	// Check every 30 minutes
+	return 30 * time.Minute
+}
+
+func (s *ecsSource) fetch() (*credentials, error) {
+	req, err := http.NewRequest(http.MethodGet, s.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := s.token
+	if s.tokenFile != "" {
+		data, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	// Fetch credentials
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch credentials: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("credentials endpoint returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// Parse response
+	var creds ecsCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials response: %w", err)
+	}
+
+	return &credentials{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		Expiration:      creds.Expiration,
+	}, nil
 }
@@ -0,0 +1,172 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/logging"
+)
+
+// DebugOptions are the debug settings of a stream, changed at runtime through the admin
+// API (/logging).
+type DebugOptions struct {
+	// Log level of the stream ("debug", or "" for the global level)
+	LogLevel string `json:"log_level,omitempty"`
+	// Frames whose NAL units are logged after each pipeline start (and when set)
+	NALUDumpFrames int `json:"nalu_dump_frames"`
+	// gst-launch-1.0 -v (caps negotiation and property changes); applies to pipelines
+	// started afterwards
+	GstVerbose bool `json:"gst_verbose"`
+}
+
+// defaultDebugOptions reads NALU_DUMP_FRAMES (default 0) and GST_VERBOSE=true.
+func defaultDebugOptions() DebugOptions {
+	return DebugOptions{
+		NALUDumpFrames: max(envInt("NALU_DUMP_FRAMES", 0), 0),
+		GstVerbose:     os.Getenv("GST_VERBOSE") == "true",
+	}
+}
+
+// SetDebug sets the debug settings of the forwarder. The NAL units of the next
+// NALUDumpFrames frames are logged right away.
+func (f *Forwarder) SetDebug(options DebugOptions) error {
+	if options.NALUDumpFrames < 0 {
+		return fmt.Errorf("invalid nalu_dump_frames %d", options.NALUDumpFrames)
+	}
+	if err := logging.SetStreamLevel(f.streamName, options.LogLevel); err != nil {
+		return err
+	}
+	options.LogLevel = logging.StreamLevel(f.streamName)
+	f.mutex.Lock()
+	f.debug = options
+	f.naluDump = options.NALUDumpFrames
+	f.mutex.Unlock()
+	return nil
+}
+
+// Debug returns the debug settings of the forwarder.
+func (f *Forwarder) Debug() DebugOptions {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	options := f.debug
+	options.LogLevel = logging.StreamLevel(f.streamName)
+	return options
+}
+
+// logNALUs logs the NAL units of an access unit. Must be called with the mutex held.
+func (f *Forwarder) logNALUs(au [][]byte) {
+	f.naluDump--
+	totalSize := 0
+	for i, nalu := range au {
+		totalSize += len(nalu)
+		if len(nalu) == 0 {
+			continue
+		}
+		head := make([]byte, 4)
+		copy(head, nalu)
+		log.Printf("[KVS] %s frame %d NALU %d: type=%d, size=%d, first bytes: % x",
+			f.streamName, f.runFrames, i, nalu[0]&0x1F, len(nalu), head)
+	}
+	log.Printf("[KVS] %s frame %d: %d NALUs, total size %d bytes", f.streamName, f.runFrames, len(au), totalSize)
+}
+
+// SetDebug sets the debug settings of a stream, for its forwarders in the pool and those
+// created later.
+func (p *Pool) SetDebug(streamName string, options DebugOptions) error {
+	if options.NALUDumpFrames < 0 {
+		return fmt.Errorf("invalid nalu_dump_frames %d", options.NALUDumpFrames)
+	}
+	if err := logging.SetStreamLevel(streamName, options.LogLevel); err != nil {
+		return err
+	}
+	for _, f := range p.Forwarders() {
+		if f.streamName != streamName {
+			continue
+		}
+		if err := f.SetDebug(options); err != nil {
+			return err
+		}
+	}
+	p.mutex.Lock()
+	if p.debug == nil {
+		p.debug = make(map[string]DebugOptions)
+	}
+	p.debug[streamName] = options
+	p.mutex.Unlock()
+	return nil
+}
+
+// ServeLogging serves the global log level and the debug settings of the streams as JSON
+// (GET /logging). POST /logging changes them: ?level=debug sets the global level;
+// ?stream=<KVS stream name> with log_level, nalu_dump_frames and gst_verbose sets those of
+// a stream, omitted parameters keeping their value.
+func (p *Pool) ServeLogging(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := p.updateLogging(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	streams := make(map[string]DebugOptions)
+	p.mutex.Lock()
+	for streamName, options := range p.debug {
+		streams[streamName] = options
+	}
+	p.mutex.Unlock()
+	for _, f := range p.Forwarders() {
+		streams[f.streamName] = f.Debug()
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]any{"level": logging.Level(), "streams": streams})
+}
+
+// updateLogging applies the parameters of a POST /logging request.
+func (p *Pool) updateLogging(r *http.Request) error {
+	query := r.URL.Query()
+	if level := query.Get("level"); level != "" {
+		previous := logging.Level()
+		if err := logging.SetLevel(level); err != nil {
+			return err
+		}
+		log.Printf("[Admin] Log level changed from %s to %s", previous, logging.Level())
+	}
+	streamName := query.Get("stream")
+	if streamName == "" {
+		return nil
+	}
+
+	p.mutex.Lock()
+	options, ok := p.debug[streamName]
+	p.mutex.Unlock()
+	if !ok {
+		options = defaultDebugOptions()
+	}
+	if query.Has("log_level") {
+		options.LogLevel = strings.ToLower(query.Get("log_level"))
+	}
+	if query.Has("nalu_dump_frames") {
+		n, err := strconv.Atoi(query.Get("nalu_dump_frames"))
+		if err != nil {
+			return fmt.Errorf("invalid nalu_dump_frames: %w", err)
+		}
+		options.NALUDumpFrames = n
+	}
+	if query.Has("gst_verbose") {
+		verbose, err := strconv.ParseBool(query.Get("gst_verbose"))
+		if err != nil {
+			return fmt.Errorf("invalid gst_verbose: %w", err)
+		}
+		options.GstVerbose = verbose
+	}
+	if err := p.SetDebug(streamName, options); err != nil {
+		return err
+	}
+	log.Printf("[Admin] Debug settings of %s: log level %q, NALU dump of %d frames, GStreamer verbose %v",
+		streamName, options.LogLevel, options.NALUDumpFrames, options.GstVerbose)
+	return nil
+}
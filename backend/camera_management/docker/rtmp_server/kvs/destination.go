@@ -0,0 +1,104 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+// accountIDPattern matches an AWS account ID.
+var accountIDPattern = regexp.MustCompile(`^\d{12}$`)
+
+// Destination is where a forwarder's stream is delivered: the account of the credentials
+// the pipeline writes with (the task role or the stream's role, which may belong to
+// another account such as a central video lake), and the stream and PutMedia endpoint
+// in that account.
+type Destination struct {
+	Account   string `json:"account,omitempty"`
+	StreamARN string `json:"stream_arn,omitempty"` // empty until kvssink created the stream
+	Endpoint  string `json:"endpoint,omitempty"`   // PUT_MEDIA data endpoint
+}
+
+// resolveDestination resolves the destination of the current stream with the credentials
+// the pipeline writes with, before a pipeline start. A pipeline whose credentials belong
+// to another account than StreamConfig.AccountID is refused. When the account or stream
+// cannot be looked up (e.g. missing kinesisvideo:DescribeStream permission), a warning is
+// logged and the pipeline starts anyway. Must be called with the mutex held, after
+// assumeRole.
+func (f *Forwarder) resolveDestination(config StreamConfig) error {
+	stream := f.target()
+	key := stream + "/" + config.RoleARN + "/" + config.AccountID
+	if f.destinationKey == key && f.destination.StreamARN != "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(f.ctx, 15*time.Second)
+	defer cancel()
+
+	stsClient, kvsClient := awsapi.NewSTS(f.awsRegion), awsapi.NewKinesisVideo(f.awsRegion)
+	if f.role != nil {
+		stsClient.Credentials = f.role.credentials()
+		kvsClient.Credentials = stsClient.Credentials
+	}
+
+	d := Destination{Account: arnAccount(config.RoleARN)}
+	if _, account, err := stsClient.GetCallerIdentity(ctx); err == nil {
+		d.Account = account
+	} else if d.Account == "" {
+		log.Printf("[KVS] ⚠️  Cannot determine the account of %s: %v", stream, err)
+	}
+	if config.AccountID != "" && d.Account != "" && d.Account != config.AccountID {
+		return fmt.Errorf("KVS stream %s would be written to account %s, not to the configured account %s",
+			stream, d.Account, config.AccountID)
+	}
+
+	info, err := kvsClient.DescribeStream(ctx, stream)
+	switch {
+	case awsapi.IsCode(err, "ResourceNotFoundException"):
+		// Created by kvssink in the account of the credentials; resolved again next start
+	case err != nil:
+		log.Printf("[KVS] ⚠️  Cannot describe stream %s: %v", stream, err)
+	default:
+		d.StreamARN = info.StreamARN
+		if account := arnAccount(info.StreamARN); account != "" {
+			d.Account = account
+		}
+		if d.Endpoint, err = kvsClient.GetDataEndpoint(ctx, stream, "PUT_MEDIA"); err != nil {
+			log.Printf("[KVS] ⚠️  Cannot get the PutMedia endpoint of %s: %v", stream, err)
+		}
+	}
+
+	if d.Account != f.destination.Account || d.StreamARN != f.destination.StreamARN {
+		switch {
+		case d.StreamARN != "":
+			log.Printf("[KVS] Stream %s is delivered to %s (%s)", stream, d.StreamARN, d.Endpoint)
+		case d.Account != "":
+			log.Printf("[KVS] Stream %s is delivered to account %s (created by kvssink)", stream, d.Account)
+		}
+	}
+	f.destination, f.destinationKey = d, key
+	return nil
+}
+
+// Destination returns the destination resolved at the last pipeline start, empty before
+// the first start and for the file sink.
+func (f *Forwarder) Destination() Destination {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.destination
+}
+
+// arnAccount returns the account of an ARN (arn:partition:service:region:account:resource),
+// "" if there is none.
+func arnAccount(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 || parts[0] != "arn" || !accountIDPattern.MatchString(parts[4]) {
+		return ""
+	}
+	return parts[4]
+}
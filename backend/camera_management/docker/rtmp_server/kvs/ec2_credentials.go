@@ -0,0 +1,139 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Instance metadata endpoint; AWS_EC2_METADATA_SERVICE_ENDPOINT overrides it
+	imdsEndpoint = "http://169.254.169.254"
+	// Lifetime requested for IMDSv2 session tokens
+	imdsTokenTTL = 6 * time.Hour
+)
+
+// imdsSource fetches the credentials of the EC2 instance profile from the instance
+// metadata service, using IMDSv2 session tokens.
+type imdsSource struct {
+	endpoint string
+	client   *http.Client
+}
+
+// imdsSourceFromEnv probes the instance metadata service. It returns nil when
+// AWS_EC2_METADATA_DISABLED is true or the service does not answer, i.e. outside EC2.
+func imdsSourceFromEnv() *imdsSource {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil
+	}
+	src := &imdsSource{
+		endpoint: imdsEndpoint,
+		client:   &http.Client{Timeout: time.Second},
+	}
+	if endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"); endpoint != "" {
+		src.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+	if _, err := src.token(); err != nil {
+		return nil
+	}
+	src.client.Timeout = 10 * time.Second
+	return src
+}
+
+func (s *imdsSource) name() string {
+	return "EC2 instance metadata (IMDSv2)"
+}
+
+func (s *imdsSource) checkInterval() time.Duration {
+	// Instance profile credentials are rotated well before they expire
+	return 5 * time.Minute
+}
+
+// token requests an IMDSv2 session token.
+func (s *imdsSource) token() (string, error) {
+	req, err := http.NewRequest(http.MethodPut, s.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(imdsTokenTTL/time.Second)))
+	body, err := s.do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get an IMDSv2 token: %w", err)
+	}
+	return string(body), nil
+}
+
+// get reads a metadata path with a session token.
+func (s *imdsSource) get(token, path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, s.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return s.do(req)
+}
+
+func (s *imdsSource) do(req *http.Request) ([]byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance metadata returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+func (s *imdsSource) fetch() (*credentials, error) {
+	token, err := s.token()
+	if err != nil {
+		return nil, err
+	}
+
+	// The first line is the role of the instance profile
+	roles, err := s.get(token, "/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the instance profile (is an IAM role attached?): %w", err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(roles)))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) == "" {
+		return nil, errors.New("no IAM role attached to the instance")
+	}
+	role := strings.TrimSpace(scanner.Text())
+
+	body, err := s.get(token, "/latest/meta-data/iam/security-credentials/"+role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch credentials of %s: %w", role, err)
+	}
+	var creds struct {
+		ecsCredentials
+		Code string `json:"Code"`
+	}
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials response: %w", err)
+	}
+	if creds.Code != "" && creds.Code != "Success" {
+		return nil, fmt.Errorf("instance metadata returned %s for %s", creds.Code, role)
+	}
+
+	return &credentials{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		Expiration:      creds.Expiration,
+	}, nil
+}
@@ -0,0 +1,33 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// UseEmulatorFromEnv points the server at a KVS emulator (cmd/kvsemu) when
+// KVS_EMULATOR_URL is set, for local development without an AWS account: the KVS API
+// calls of the server (AWS_ENDPOINT_URL_KINESISVIDEO) and of kvssink (CONTROL_PLANE_URI)
+// go to the emulator, and a region and dummy credentials are set unless already given.
+// It must be called before the environment is read.
+func UseEmulatorFromEnv() {
+	url := strings.TrimSuffix(os.Getenv("KVS_EMULATOR_URL"), "/")
+	if url == "" {
+		return
+	}
+	defaults := [][2]string{
+		{"AWS_ENDPOINT_URL_KINESISVIDEO", url},
+		{"CONTROL_PLANE_URI", url},
+		{"AWS_REGION", "us-east-1"},
+		{"AWS_ACCESS_KEY_ID", "emulator"},
+		{"AWS_SECRET_ACCESS_KEY", "emulator"},
+	}
+	for _, d := range defaults {
+		if os.Getenv(d[0]) == "" {
+			os.Setenv(d[0], d[1])
+		}
+	}
+	log.Printf("[KVS] 🧪 Using the KVS emulator at %s (no AWS account needed)", url)
+}
@@ -0,0 +1,90 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+// kmsKeyPattern matches a KMS key ID, key ARN, alias name or alias ARN.
+var kmsKeyPattern = regexp.MustCompile(`^(arn:aws[a-z-]*:kms:[a-z0-9-]+:\d{12}:(key/[0-9a-f-]+|alias/[\w/.-]+)|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|mrk-[0-9a-f]{32}|alias/[\w/.-]+)$`)
+
+// ValidKMSKeyID reports whether id is a KMS key ID, key ARN, alias name or alias ARN.
+func ValidKMSKeyID(id string) bool {
+	return kmsKeyPattern.MatchString(id)
+}
+
+// checkEncryption verifies that an existing stream is encrypted with the KMS key of the
+// configuration; kvssink only applies the key when it creates the stream, and would
+// otherwise write to a stream encrypted with another key without notice. A stream that
+// does not exist yet passes. When the stream or key cannot be described (missing
+// kinesisvideo:DescribeStream or kms:DescribeKey permission), a warning is logged and the
+// pipeline starts anyway. Must be called with the mutex held.
+func (f *Forwarder) checkEncryption(config StreamConfig) error {
+	stream := f.target()
+	if config.KMSKeyID == "" || f.kmsVerified == stream+"/"+config.KMSKeyID {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(f.ctx, 15*time.Second)
+	defer cancel()
+
+	kvsClient, kmsClient := awsapi.NewKinesisVideo(f.awsRegion), awsapi.NewKMS(f.awsRegion)
+	if f.role != nil {
+		// Streams of an assumed role may live in another account
+		kvsClient.Credentials = f.role.credentials()
+		kmsClient.Credentials = kvsClient.Credentials
+	}
+
+	info, err := kvsClient.DescribeStream(ctx, stream)
+	if awsapi.IsCode(err, "ResourceNotFoundException") {
+		return nil // created by kvssink with the key
+	}
+	if err != nil {
+		log.Printf("[KVS] ⚠️  Cannot verify the encryption key of %s: %v", stream, err)
+		return nil
+	}
+
+	if !sameKMSKey(info.KmsKeyID, config.KMSKeyID) {
+		want, err := kmsClient.KeyARN(ctx, config.KMSKeyID)
+		if err != nil {
+			log.Printf("[KVS] ⚠️  Cannot resolve KMS key %s of %s: %v", config.KMSKeyID, stream, err)
+			return nil
+		}
+		have := info.KmsKeyID
+		if !strings.Contains(have, ":key/") {
+			// The stream reports an alias (e.g. the AWS managed aws/kinesisvideo)
+			if have, err = kmsClient.KeyARN(ctx, have); err != nil {
+				log.Printf("[KVS] ⚠️  Cannot resolve KMS key %s of %s: %v", info.KmsKeyID, stream, err)
+				return nil
+			}
+		}
+		if have != want {
+			return fmt.Errorf("KVS stream %s is encrypted with %s, not with the configured KMS key %s",
+				stream, info.KmsKeyID, config.KMSKeyID)
+		}
+	}
+	log.Printf("[KVS] ✅ Stream %s is encrypted with KMS key %s", stream, config.KMSKeyID)
+	f.kmsVerified = stream + "/" + config.KMSKeyID
+	return nil
+}
+
+// sameKMSKey reports whether two key references are obviously the same key: equal, or
+// an ARN and the key ID or alias name it ends with.
+func sameKMSKey(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if !strings.HasPrefix(a, "arn:") {
+		a, b = b, a
+	}
+	if !strings.HasPrefix(a, "arn:") || strings.HasPrefix(b, "arn:") {
+		return false
+	}
+	return strings.HasSuffix(a, ":key/"+b) || strings.HasSuffix(a, ":"+b)
+}
@@ -0,0 +1,135 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// forwarderMode reads FORWARDER_MODE: "kvs" (default) forwards to KVS; "file" writes local
+// files instead (development and CI without AWS credentials or kvssink). Otherwise local
+// files are only written by the development fallback, see ProbeGStreamer.
+func forwarderMode() string {
+	switch mode := os.Getenv("FORWARDER_MODE"); mode {
+	case "", "kvs":
+		return "kvs"
+	case "file":
+		return "file"
+	default:
+		log.Printf("[KVS] ⚠️  Unknown FORWARDER_MODE %q, using kvs", mode)
+		return "kvs"
+	}
+}
+
+// fileSinkFallback is set by ProbeGStreamer when GStreamer or kvssink is missing on a
+// development machine: the forwarders then write local files.
+var fileSinkFallback atomic.Bool
+
+// developmentFallback reports whether a missing GStreamer installation makes the
+// forwarders fall back to the file sink: on Windows and macOS, where the server runs for
+// local development, unless FORWARDER_MODE is set. On Linux, where the container runs,
+// it never does, so a broken image cannot write every camera to local disk.
+func developmentFallback() bool {
+	return runtime.GOOS != "linux" && os.Getenv("FORWARDER_MODE") == ""
+}
+
+// fileSinkFormat reads FILE_SINK_FORMAT: "flv" (default, keeps timestamps and audio) or
+// "h264" (raw Annex-B byte stream, playable with ffplay/VLC).
+func fileSinkFormat() string {
+	switch format := os.Getenv("FILE_SINK_FORMAT"); format {
+	case "", "flv":
+		return "flv"
+	case "h264":
+		return "h264"
+	default:
+		log.Printf("[KVS] ⚠️  Unknown FILE_SINK_FORMAT %q, using flv", format)
+		return "flv"
+	}
+}
+
+// fileSinkDir returns the directory used by the file sink.
+func fileSinkDir() string {
+	if dir := os.Getenv("FILE_SINK_DIR"); dir != "" {
+		return dir
+	}
+	return "recordings"
+}
+
+// filePipeline writes the stream to a local file instead of GStreamer: FLV, or an Annex-B
+// byte stream starting at the first IDR.
+type filePipeline struct {
+	file   *os.File
+	mux    *flvMuxer
+	annexB bool
+	done   chan struct{}
+
+	started bool // an IDR has been written (Annex-B)
+}
+
+// startFileSink opens a new output file instead of starting GStreamer. Audio-only streams
+// are always written as FLV.
+// Must be called with the mutex held.
+func (f *Forwarder) startFileSink() (*filePipeline, error) {
+	dir := fileSinkDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create file sink directory: %w", err)
+	}
+
+	format := fileSinkFormat()
+	if f.audio != nil {
+		format = "flv"
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.%s", f.target(), time.Now().Format("20060102-150405"), format))
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file sink: %w", err)
+	}
+	f.mux.reset(file)
+
+	log.Printf("[KVS] File sink writing %s stream to %s", format, path)
+	return &filePipeline{file: file, mux: &f.mux, annexB: format == "h264", done: make(chan struct{})}, nil
+}
+
+func (p *filePipeline) writeAU(pts, dts time.Duration, au [][]byte) error {
+	if !p.annexB {
+		return p.mux.writeAU(pts, dts, au)
+	}
+
+	keyframe, hasSlice, _ := p.mux.inspect(au)
+	if !hasSlice || p.mux.sps == nil || p.mux.pps == nil {
+		return nil
+	}
+	if !p.started && !keyframe {
+		return nil
+	}
+	p.started = true
+	_, err := p.file.Write(p.mux.annexB(au, keyframe))
+	return err
+}
+
+// writeAudio writes an audio frame to the FLV file. Annex-B files only hold the video.
+func (p *filePipeline) writeAudio(pts time.Duration, frame []byte) error {
+	if p.annexB {
+		return nil
+	}
+	return p.mux.writeAudio(pts, frame)
+}
+
+func (p *filePipeline) wait() error {
+	<-p.done
+	return nil
+}
+
+func (p *filePipeline) stop(timeout time.Duration) {
+	p.file.Close()
+	close(p.done)
+}
+
+func (p *filePipeline) String() string {
+	return "file sink " + p.file.Name()
+}
@@ -0,0 +1,193 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"rtmp_kvs/flv"
+)
+
+// maxTimestampJump is the largest forward DTS gap accepted without rebasing the timeline.
+const maxTimestampJump = 10 * time.Second
+
+// flvMuxer converts RTMP access units into FLV tags for the GStreamer pipeline.
+// FLV carries DTS plus a composition time offset per frame, so PTS/DTS survive the pipe
+// into flvdemux and B-frame streams reach h264parse/kvssink with correct timestamps.
+type flvMuxer struct {
+	w     *flv.Writer
+	batch *tagBatch
+
+	// Track of an audio-only stream (nil for video)
+	audio *AudioTrack
+	// AAC track interleaved with the video (nil for video only)
+	interleaved *AudioTrack
+
+	// Latest parameter sets (kept across pipeline restarts)
+	sps []byte
+	pps []byte
+
+	headerSent bool
+	configSent bool
+
+	// Output timeline (relative to the start of the current pipeline)
+	base          time.Duration
+	hasOutput     bool
+	lastDTS       time.Duration
+	frameInterval time.Duration
+	// Last timestamp of the interleaved audio on the output timeline
+	hasAudio  bool
+	lastAudio time.Duration
+}
+
+// reset prepares the muxer for a new pipeline writing to w.
+func (m *flvMuxer) reset(w io.Writer) {
+	m.batch = &tagBatch{w: w}
+	m.w = flv.NewWriter(m.batch)
+	m.headerSent = false
+	m.configSent = false
+	m.hasOutput = false
+	m.lastDTS = 0
+	m.frameInterval = 0
+	m.hasAudio = false
+	m.lastAudio = 0
+}
+
+// writeAU writes an access unit. Frames are dropped until SPS/PPS are known, since
+// flvdemux needs the AVC sequence header before any video data. Every access unit
+// reaches the pipe in a single write, including the headers written before it.
+func (m *flvMuxer) writeAU(pts, dts time.Duration, au [][]byte) (err error) {
+	keyframe, hasSlice, paramsChanged := m.inspect(au)
+
+	if !m.headerSent || paramsChanged || !m.configSent {
+		m.batch.hold()
+		defer func() {
+			if flushErr := m.batch.flush(); err == nil {
+				err = flushErr
+			}
+		}()
+	}
+
+	if !m.headerSent {
+		if err := m.w.WriteHeader(true, m.interleaved != nil); err != nil {
+			return err
+		}
+		m.headerSent = true
+	}
+
+	ts := m.timestamp(dts)
+
+	if (paramsChanged || !m.configSent) && m.sps != nil && m.pps != nil {
+		if err := m.w.WriteH264Config(uint32(ts/time.Millisecond), m.sps, m.pps); err != nil {
+			return err
+		}
+		// flvdemux adds the audio pad, which kvssink waits for, with the AAC config
+		if !m.configSent {
+			if err := m.writeInterleavedConfig(ts); err != nil {
+				return err
+			}
+		}
+		m.configSent = true
+	}
+
+	if !hasSlice || !m.configSent {
+		return nil
+	}
+
+	m.advance(ts)
+	cts := int32((pts - dts) / time.Millisecond)
+	return m.w.WriteH264(uint32(ts/time.Millisecond), cts, keyframe, au)
+}
+
+// inspect records the parameter sets carried in au and reports whether it is a keyframe,
+// whether it contains a picture and whether the parameter sets changed.
+func (m *flvMuxer) inspect(au [][]byte) (keyframe, hasSlice, paramsChanged bool) {
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1F {
+		case 7: // SPS
+			if !bytes.Equal(m.sps, nalu) {
+				m.sps = append([]byte(nil), nalu...)
+				paramsChanged = true
+			}
+		case 8: // PPS
+			if !bytes.Equal(m.pps, nalu) {
+				m.pps = append([]byte(nil), nalu...)
+				paramsChanged = true
+			}
+		case 5: // IDR
+			keyframe = true
+			hasSlice = true
+		case 1, 2, 3, 4: // Non-IDR slice and data partitions
+			hasSlice = true
+		}
+	}
+	return keyframe, hasSlice, paramsChanged
+}
+
+// timestamp maps an input DTS onto the output timeline. Backward jumps and large gaps
+// (e.g. a publisher reconnecting to a warm pipeline) are rebased so output stays monotonic.
+func (m *flvMuxer) timestamp(dts time.Duration) time.Duration {
+	if !m.hasOutput {
+		m.base = dts
+		return 0
+	}
+
+	ts := dts - m.base
+	if ts < m.lastDTS || ts > m.lastDTS+maxTimestampJump {
+		m.base = dts - (m.lastDTS + m.frameInterval)
+		ts = m.lastDTS + m.frameInterval
+	}
+	return ts
+}
+
+// advance records ts as the last written DTS.
+func (m *flvMuxer) advance(ts time.Duration) {
+	if m.hasOutput && ts > m.lastDTS {
+		m.frameInterval = ts - m.lastDTS
+	}
+	m.lastDTS = ts
+	m.hasOutput = true
+}
+
+// Largest batch buffer kept between batches
+const maxBatchBuffer = 1 << 20
+
+// tagBatch passes tags through to the pipe, or collects them while held so that the
+// FLV header and sequence header go out with the following frame in one write.
+type tagBatch struct {
+	w       io.Writer
+	buf     []byte
+	holding bool
+}
+
+// hold collects the following writes until flush.
+func (b *tagBatch) hold() {
+	b.holding = true
+}
+
+// flush writes the collected tags and ends holding.
+func (b *tagBatch) flush() error {
+	b.holding = false
+	if len(b.buf) == 0 {
+		return nil
+	}
+	_, err := b.w.Write(b.buf)
+	if cap(b.buf) > maxBatchBuffer {
+		b.buf = nil
+	} else {
+		b.buf = b.buf[:0]
+	}
+	return err
+}
+
+func (b *tagBatch) Write(p []byte) (int, error) {
+	if !b.holding {
+		return b.w.Write(p)
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
@@ -0,0 +1,262 @@
+package kvs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"rtmp_kvs/flv"
+)
+
+// 352x288 SPS and a PPS
+var (
+	testSPS = []byte{
+		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+		0x00, 0x03, 0x00, 0x3d, 0x08,
+	}
+	testPPS   = []byte{0x68, 0xee, 0x3c, 0x80}
+	testIDR   = []byte{0x65, 0x88, 0x84, 0x00}
+	testSlice = []byte{0x41, 0x9a, 0x02, 0x03}
+)
+
+// writeRecorder records each write to the pipe.
+type writeRecorder struct {
+	writes [][]byte
+}
+
+func (r *writeRecorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (r *writeRecorder) bytes() []byte {
+	return bytes.Join(r.writes, nil)
+}
+
+// muxedTag is a tag of the muxer output.
+type muxedTag struct {
+	timestamp uint32
+	config    bool // AVC sequence header
+	keyframe  bool
+	cts       int32
+	nalus     int
+}
+
+// readTags parses the FLV written by the muxer.
+func readTags(t *testing.T, data []byte) []muxedTag {
+	t.Helper()
+	r, err := flv.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []muxedTag
+	for {
+		tag, err := r.ReadTag()
+		if errors.Is(err, io.EOF) {
+			return tags
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.Type != flv.TagVideo {
+			t.Fatalf("unexpected tag type %d", tag.Type)
+		}
+		cts, au, err := flv.ParseH264(tag.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, muxedTag{
+			timestamp: tag.Timestamp,
+			config:    tag.Data[1] == flv.AVCSequenceHeader,
+			keyframe:  tag.Data[0]>>4 == flv.FrameKey,
+			cts:       cts,
+			nalus:     len(au),
+		})
+	}
+}
+
+func TestFLVMuxerTimestamp(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		dts  []time.Duration
+		want []time.Duration
+	}{
+		{
+			name: "starts at zero",
+			dts:  []time.Duration{5000 * ms, 5033 * ms, 5066 * ms},
+			want: []time.Duration{0, 33 * ms, 66 * ms},
+		},
+		{
+			name: "backward jump continues after the last frame",
+			dts:  []time.Duration{1000 * ms, 1040 * ms, 1080 * ms, 0, 40 * ms},
+			want: []time.Duration{0, 40 * ms, 80 * ms, 120 * ms, 160 * ms},
+		},
+		{
+			name: "forward jump beyond the limit is rebased",
+			dts:  []time.Duration{0, 100 * ms, 200 * ms, 60 * time.Second, 60*time.Second + 100*ms},
+			want: []time.Duration{0, 100 * ms, 200 * ms, 300 * ms, 400 * ms},
+		},
+		{
+			name: "forward jump within the limit is kept",
+			dts:  []time.Duration{0, 100 * ms, 100*ms + maxTimestampJump},
+			want: []time.Duration{0, 100 * ms, 100*ms + maxTimestampJump},
+		},
+		{
+			name: "repeated timestamp is kept",
+			dts:  []time.Duration{0, 40 * ms, 40 * ms, 80 * ms},
+			want: []time.Duration{0, 40 * ms, 40 * ms, 80 * ms},
+		},
+		{
+			name: "jump before a frame interval is known",
+			dts:  []time.Duration{10 * time.Second, 0, 40 * ms},
+			want: []time.Duration{0, 0, 40 * ms},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m flvMuxer
+			var got []time.Duration
+			for _, dts := range tt.dts {
+				ts := m.timestamp(dts)
+				m.advance(ts)
+				got = append(got, ts)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("timestamps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFLVMuxerResetRebases(t *testing.T) {
+	var m flvMuxer
+	m.reset(io.Discard)
+	for _, dts := range []time.Duration{0, time.Second, 2 * time.Second} {
+		m.advance(m.timestamp(dts))
+	}
+
+	// A new pipeline starts its timeline at zero, keeping the parameter sets
+	m.sps = testSPS
+	m.reset(io.Discard)
+	if ts := m.timestamp(30 * time.Second); ts != 0 {
+		t.Errorf("first timestamp after reset = %s, want 0", ts)
+	}
+	if m.sps == nil {
+		t.Error("reset dropped the SPS")
+	}
+}
+
+func TestFLVMuxerWriteAU(t *testing.T) {
+	ms := time.Millisecond
+	type frame struct {
+		pts, dts time.Duration
+		au       [][]byte
+	}
+	keyframe := func(dts time.Duration) frame {
+		return frame{dts, dts, [][]byte{testSPS, testPPS, testIDR}}
+	}
+	tests := []struct {
+		name       string
+		frames     []frame
+		wantTags   []muxedTag
+		wantWrites int
+	}{
+		{
+			name: "sequence header with the first keyframe",
+			frames: []frame{
+				keyframe(1000 * ms),
+				{1040 * ms, 1040 * ms, [][]byte{testSlice}},
+			},
+			wantTags: []muxedTag{
+				{timestamp: 0, config: true, keyframe: true, nalus: 2},
+				{timestamp: 0, keyframe: true, nalus: 3},
+				{timestamp: 40, nalus: 1},
+			},
+			// Header, sequence header and keyframe in one write
+			wantWrites: 2,
+		},
+		{
+			name: "frames before the parameter sets are dropped",
+			frames: []frame{
+				{0, 0, [][]byte{testSlice}},
+				{40 * ms, 40 * ms, [][]byte{testSlice}},
+				keyframe(80 * ms),
+			},
+			wantTags: []muxedTag{
+				{timestamp: 0, config: true, keyframe: true, nalus: 2},
+				{timestamp: 0, keyframe: true, nalus: 3},
+			},
+			wantWrites: 2,
+		},
+		{
+			name: "B-frames keep their composition offset",
+			frames: []frame{
+				{80 * ms, 0, [][]byte{testSPS, testPPS, testIDR}},
+				{200 * ms, 40 * ms, [][]byte{testSlice}},
+				{120 * ms, 80 * ms, [][]byte{testSlice}},
+			},
+			wantTags: []muxedTag{
+				{timestamp: 0, config: true, keyframe: true, nalus: 2},
+				{timestamp: 0, keyframe: true, cts: 80, nalus: 3},
+				{timestamp: 40, cts: 160, nalus: 1},
+				{timestamp: 80, cts: 40, nalus: 1},
+			},
+			wantWrites: 3,
+		},
+		{
+			name: "changed parameter sets are sent again",
+			frames: []frame{
+				keyframe(0),
+				{40 * ms, 40 * ms, [][]byte{testSlice}},
+				{80 * ms, 80 * ms, [][]byte{testSPS, {0x68, 0xce, 0x3c, 0x80}, testIDR}},
+				keyframe(120 * ms),
+			},
+			wantTags: []muxedTag{
+				{timestamp: 0, config: true, keyframe: true, nalus: 2},
+				{timestamp: 0, keyframe: true, nalus: 3},
+				{timestamp: 40, nalus: 1},
+				{timestamp: 80, config: true, keyframe: true, nalus: 2},
+				{timestamp: 80, keyframe: true, nalus: 3},
+				{timestamp: 120, config: true, keyframe: true, nalus: 2},
+				{timestamp: 120, keyframe: true, nalus: 3},
+			},
+			wantWrites: 4,
+		},
+		{
+			// The output timeline starts with the first picture
+			name: "parameter sets without a picture",
+			frames: []frame{
+				{0, 0, [][]byte{testSPS, testPPS}},
+				{40 * ms, 40 * ms, [][]byte{testIDR}},
+			},
+			wantTags: []muxedTag{
+				{timestamp: 0, config: true, keyframe: true, nalus: 2},
+				{timestamp: 0, keyframe: true, nalus: 1},
+			},
+			wantWrites: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out writeRecorder
+			var m flvMuxer
+			m.reset(&out)
+			for _, f := range tt.frames {
+				if err := m.writeAU(f.pts, f.dts, f.au); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := readTags(t, out.bytes()); !slices.Equal(got, tt.wantTags) {
+				t.Errorf("tags =\n%+v\nwant\n%+v", got, tt.wantTags)
+			}
+			if len(out.writes) != tt.wantWrites {
+				t.Errorf("%d writes, want %d", len(out.writes), tt.wantWrites)
+			}
+		})
+	}
+}
@@ -2,11 +2,13 @@
 package kvs
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"os/exec"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,224 +19,431 @@ type Forwarder struct {
 	awsRegion  string
 
 	mutex    sync.Mutex
-	cmd      *exec.Cmd
-	stdin    io.WriteCloser
-	running  bool
-	stopped  bool // true when explicitly stopped (not auto-restart)
-	
-	// Frame statistics
-	frameCount uint64
+	pipeline pipeline
+	state    forwarderState
+
+	// Transitions applied by the run loop, which owns the state and the pipeline; closed
+	// by Close
+	transitions chan transition
+	closed      chan struct{}
+	closeOnce   sync.Once
+
+	// Context of the current run (Start until Stop or cancellation); the pipeline is
+	// auto-restarted only while it is alive. nil when stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+	starts uint64 // Start calls applied, including those reusing a warm pipeline
+
+	// Track of an audio-only stream; nil for H.264 video
+	audio *AudioTrack
+	// AAC track forwarded with the H.264 video (StartWithAudio); nil for video only
+	interleaved *AudioTrack
+
+	// Frame statistics: frameCount is the total of all runs and publishers (per-publisher
+	// statistics are kept by the server's sessions), runFrames counts the current run
+	frameCount  uint64
+	runFrames   uint64
 	lastLogTime time.Time
-	
+
+	// Pictures are dropped after a (re)start until the first IDR frame, so KVS never
+	// receives a leading fragment that cannot be decoded
+	awaitKeyframe bool
+	skippedFrames uint64 // pictures dropped while waiting for an IDR (all runs)
+	runSkipped    int    // pictures dropped since the current pipeline started
+
 	// Credential management
 	credManager *CredentialManager
-	
+
 	// Auto-restart
 	restartCount    int
 	lastRestartTime time.Time
+	lastExitTime    time.Time
+	restartAfter    time.Time // frames do not ask for a restart before, after a rate-limited one
+
+	// File sink fallback when GStreamer/kvssink is unavailable (local development)
+	fileSink bool
+
+	// FLV muxer feeding the pipeline (preserves PTS/DTS); also tracks the parameter sets
+	// and output timeline for the in-process pipeline. writeMutex guards it and is taken
+	// before mutex: pipeline writes may block, and are made without holding mutex.
+	writeMutex sync.Mutex
+	mux        flvMuxer
+
+	// Per-stream kvssink settings (zero fields use the environment defaults)
+	config StreamConfig
+
+	// PutMedia fragment ACKs parsed from the pipeline log
+	acks ackTracker
+
+	// Classified kvssink errors (drive the restart backoff)
+	pipelineErrors errorTracker
+
+	// GOP currently being written, reported to the GOP sink
+	gops gopTracker
+
+	// Credentials of the stream's IAM role (StreamConfig.RoleARN), nil for the task role
+	role *roleCredentials
+
+	// KMS key the existing stream was verified to be encrypted with
+	kmsVerified string
+
+	// Account, stream and endpoint the pipeline writes to, resolved for destinationKey
+	// (stream, role and expected account)
+	destination    Destination
+	destinationKey string
+
+	// Changed parameter sets held back until the IDR that activates them, and the number
+	// of pipelines replaced for new parameter sets
+	pendingSPS   []byte
+	pendingPPS   []byte
+	paramChanges int
+
+	// KVS stream of the current time window of a sharded stream (StreamConfig.Shards)
+	shard shardState
+
+	// Fragment duration adapted to the PutMedia latency and failures (FRAGMENT_ADAPTIVE)
+	adaptive fragmentAdapter
+
+	// Ingest-to-persisted latency of the fragments
+	latency latencyTracker
+
+	// Original timeline of backfilled footage (offline streaming type)
+	offline offlineState
+
+	// Debug settings, and the frames whose NAL units are still to be logged
+	debug    DebugOptions
+	naluDump int
 }
 
 // NewForwarder creates a new KVS forwarder.
 func NewForwarder(streamName, awsRegion string) *Forwarder {
-	return &Forwarder{
+	f := &Forwarder{
 		streamName:  streamName,
 		awsRegion:   awsRegion,
 		lastLogTime: time.Now(),
 		credManager: NewCredentialManager(),
+		debug:       defaultDebugOptions(),
+		transitions: make(chan transition),
+		closed:      make(chan struct{}),
 	}
+
+	if forwarderMode() == "file" {
+		log.Printf("[KVS] FORWARDER_MODE=file, writing %s to %s instead of KVS", streamName, fileSinkDir())
+		f.fileSink = true
+	} else if fileSinkFallback.Load() {
+		log.Printf("[KVS] GStreamer or kvssink not found, writing %s to %s instead of KVS", streamName, fileSinkDir())
+		f.fileSink = true
+	}
+
+	go f.run()
+	return f
 }
 
-// Start starts the GStreamer pipeline for KVS forwarding.
-func (f *Forwarder) Start() error {
+// SetConfig sets the per-stream kvssink settings. It takes effect on the next pipeline start.
+func (f *Forwarder) SetConfig(config StreamConfig) {
+	f.mutex.Lock()
+	f.config = config
+	f.mutex.Unlock()
+}
+
+// Config returns the effective kvssink settings (per-stream values over environment defaults).
+func (f *Forwarder) Config() StreamConfig {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	return defaultStreamConfig().Merge(f.config)
+}
 
-	if f.running {
-		return nil
+// StreamName returns the target KVS stream name.
+func (f *Forwarder) StreamName() string {
+	return f.streamName
+}
+
+// Region returns the region of the target KVS stream.
+func (f *Forwarder) Region() string {
+	return f.awsRegion
+}
+
+// Name identifies the forwarder as the "kvs" sink (sink.Sink).
+func (f *Forwarder) Name() string {
+	return "kvs"
+}
+
+// Status is a snapshot of a forwarder's pipeline state.
+type Status struct {
+	StreamName         string             `json:"stream_name"`
+	Region             string             `json:"region"`
+	Running            bool               `json:"running"`
+	State              string             `json:"state"` // idle, starting, running, restarting, stopping or stopped
+	FileSink           bool               `json:"file_sink"`
+	Restarts           int                `json:"restarts"`
+	ParamChanges       int                `json:"parameter_changes"`
+	Destination        *Destination       `json:"destination,omitempty"` // resolved at the last pipeline start
+	Shard              string             `json:"shard,omitempty"`       // KVS stream written to, if sharded
+	ShardSwitches      int                `json:"shard_switches,omitempty"`
+	FragmentDurationMs int                `json:"fragment_duration_ms"` // in use, adapted with FRAGMENT_ADAPTIVE
+	FragmentChanges    int                `json:"fragment_duration_changes,omitempty"`
+	FramesForwarded    uint64             `json:"frames_forwarded"`
+	SkippedFrames      uint64             `json:"skipped_frames"`
+	Audio              *AudioTrack        `json:"audio,omitempty"`
+	VideoAudio         *AudioTrack        `json:"video_audio,omitempty"` // AAC track forwarded with the video
+	Config             StreamConfig       `json:"config"`
+	Acks               AckStats           `json:"acks"`
+	Latency            *LatencyStats      `json:"latency,omitempty"` // ingest to PERSISTED ACK
+	Errors             PipelineErrorStats `json:"errors"`
+}
+
+// Status returns the current pipeline state.
+func (f *Forwarder) Status() Status {
+	f.mutex.Lock()
+	status := Status{
+		StreamName:      f.streamName,
+		Region:          f.awsRegion,
+		Running:         f.state == stateRunning,
+		State:           f.state.String(),
+		FileSink:        f.fileSink,
+		Restarts:        f.restartCount,
+		ParamChanges:    f.paramChanges,
+		Shard:           f.shard.name,
+		ShardSwitches:   f.shard.switches,
+		FramesForwarded: f.frameCount,
+		SkippedFrames:   f.skippedFrames,
+		Audio:           f.audio,
 	}
+	if f.audio == nil {
+		status.VideoAudio = f.interleaved
+	}
+	if f.destination != (Destination{}) {
+		destination := f.destination
+		status.Destination = &destination
+	}
+	f.mutex.Unlock()
+
+	status.Config = f.Config()
+	status.FragmentDurationMs, status.FragmentChanges = f.fragmentStatus(status.Config.FragmentDurationMs)
+	status.Acks = f.AckStats()
+	status.Latency = f.Latency()
+	status.Errors = f.ErrorStats()
+	return status
+}
+
+// FileSink reports whether the forwarder writes to local files instead of KVS.
+func (f *Forwarder) FileSink() bool {
+	return f.fileSink
+}
+
+// Start starts the GStreamer pipeline for KVS forwarding of H.264 video without audio.
+// The pipeline runs, and is auto-restarted after failures, until Stop is called or ctx
+// is cancelled.
+func (f *Forwarder) Start(ctx context.Context) error {
+	return f.StartWithAudio(ctx, nil)
+}
 
-	log.Printf("[KVS] Starting GStreamer pipeline for stream: %s in region: %s", f.streamName, f.awsRegion)
+// startPipelineFor starts a pipeline for H.264 video (audio == nil) or an audio-only
+// track: the file sink, or GStreamer once the stream's credentials, encryption and
+// destination are checked. Must be called from the run loop with the mutex held.
+func (f *Forwarder) startPipelineFor(audio *AudioTrack) (pipeline, error) {
+	f.audio = audio
+	f.mux.audio = audio
+	f.mux.interleaved = nil
+	if audio == nil {
+		f.mux.interleaved = f.interleaved
+	}
+	f.openShard(defaultStreamConfig().Merge(f.config))
+
+	if f.fileSink {
+		return f.startFileSink()
+	}
+	log.Printf("[KVS] Starting GStreamer pipeline for stream: %s in region: %s", f.target(), f.awsRegion)
 
 	// Refresh AWS credentials before starting pipeline (ECS Fargate)
 	if err := f.credManager.RefreshCredentials(); err != nil {
 		log.Printf("[KVS] ⚠️  Failed to refresh credentials: %v (continuing with existing credentials)", err)
 	}
+	// Per-stream IAM role (multi-tenant deployments), assumed with the task credentials
+	if err := f.assumeRole(defaultStreamConfig().Merge(f.config)); err != nil {
+		return nil, err
+	}
+	// An existing stream must be encrypted with the configured KMS key
+	if err := f.checkEncryption(defaultStreamConfig().Merge(f.config)); err != nil {
+		return nil, err
+	}
+	// The account written to, which must be the configured one (cross-account delivery)
+	if err := f.resolveDestination(defaultStreamConfig().Merge(f.config)); err != nil {
+		return nil, err
+	}
+
+	p, err := f.startPipeline()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[KVS] GStreamer pipeline started (%s)", p)
+	return p, nil
+}
+
+// startPipeline starts the KVS pipeline: in-process when PIPELINE_BACKEND=inprocess and the
+// binary was built with -tags gst, otherwise as a gst-launch-1.0 process.
+// Must be called with the mutex held.
+func (f *Forwarder) startPipeline() (pipeline, error) {
+	pad, elements := f.pipelineElements()
 
-	// Get optional KVS parameters from environment
-	retentionPeriod := os.Getenv("RETENTION_PERIOD")
-	if retentionPeriod == "" {
-		retentionPeriod = "24"
+	if inProcessPipeline() && f.audio == nil && f.interleaved == nil {
+		if f.role != nil {
+			// The role credentials need a process environment without the task credentials
+			log.Printf("[KVS] Stream %s assumes role %s, using gst-launch-1.0", f.streamName, f.role.roleARN)
+		} else {
+			p, err := startAppsrcPipeline(elements, &f.mux, f.handleLine)
+			if err == nil {
+				return p, nil
+			}
+			if !errors.Is(err, errInProcessUnavailable) {
+				return nil, err
+			}
+			log.Printf("[KVS] ⚠️  %v, using gst-launch-1.0", err)
+		}
 	}
+	input := defaultStreamConfig().Merge(f.config).queueElement()
+	return startExecPipeline(pad, input, elements, f.pipelineEnv(), f.debug.GstVerbose, &f.mux, f.handleLine)
+}
 
-	fragmentDuration := os.Getenv("FRAGMENT_DURATION")
-	if fragmentDuration == "" {
-		fragmentDuration = "2000"
+// pipelineElements returns the flvdemux pad and the GStreamer elements from it to kvssink
+// (h264parse ... kvssink for video). Must be called with the mutex held.
+func (f *Forwarder) pipelineElements() (string, []string) {
+	// KVS parameters: per-stream settings over RETENTION_PERIOD / FRAGMENT_DURATION / STORAGE_SIZE
+	config := defaultStreamConfig().Merge(f.config)
+	log.Printf("[KVS] Stream settings: retention=%dh fragment=%dms storage=%dMiB",
+		config.RetentionHours, config.FragmentDurationMs, config.StorageSizeMB)
+	if config.KMSKeyID != "" {
+		log.Printf("[KVS] Stream encryption key: %s", config.KMSKeyID)
+	}
+	log.Printf("[KVS] Pipeline profile: %s (%s)", cmp.Or(config.PipelineProfile, ProfileDefault), config.pipelineLimits())
+
+	// Audio-only: fragments are cut by duration, since every audio frame is a key frame
+	if f.audio != nil {
+		log.Printf("[KVS] Audio-only stream (%s)", f.audio)
+		elements := append(f.audio.elements(), "!")
+		elements = append(elements, config.queueElement()...)
+		elements = append(elements,
+			"!", "kvssink",
+			fmt.Sprintf("stream-name=%s", f.target()),
+			fmt.Sprintf("aws-region=%s", f.awsRegion),
+		)
+		elements = append(elements, config.kvssinkArgs()...)
+		elements = append(elements, f.credentialArgs()...)
+		elements = append(elements, "key-frame-fragmentation=false")
+		elements = append(elements, f.streamingTypeArgs()...)
+		return "audio", elements
 	}
 
-	storageSize := os.Getenv("STORAGE_SIZE")
-	if storageSize == "" {
-		storageSize = "512"
+	// Adaptive fragments are cut at the first keyframe after the fragment duration
+	keyFrameFragmentation := "key-frame-fragmentation=true"
+	if adaptive := adaptiveConfigFromEnv(); adaptive != nil {
+		config.FragmentDurationMs = f.adaptive.duration(adaptive, config.FragmentDurationMs)
+		keyFrameFragmentation = "key-frame-fragmentation=false"
+		log.Printf("[KVS] Adaptive fragment duration: %dms", config.FragmentDurationMs)
 	}
 
-	// Build GStreamer pipeline
-	// Input: H.264 Annex B byte stream from stdin
 	// Output: KVS via kvssink
-	// Note: do-timestamp=true ensures GStreamer generates timestamps for the incoming data
-	// Added queue with large buffer to handle bursty input from mobile devices
-	f.cmd = exec.Command("gst-launch-1.0", "-v",
-		"fdsrc", "fd=0", "do-timestamp=true", "blocksize=1048576",
-		"!", "queue", "max-size-buffers=0", "max-size-time=0", "max-size-bytes=10485760",
-		"!", "h264parse",
+	elements := []string{"h264parse"}
+	// Optional transcode branch (downscale / bitrate cap / keyframe interval)
+	if transcode := transcodeConfigFromEnv(); transcode != nil {
+		log.Printf("[KVS] Transcoding enabled (%s)", transcode)
+		elements = append(elements, transcode.elements()...)
+	}
+	elements = append(elements,
 		"!", "video/x-h264,stream-format=avc,alignment=au",
-		"!", "queue", "max-size-buffers=0", "max-size-time=0", "max-size-bytes=10485760",
+		"!",
+	)
+	elements = append(elements, config.queueElement()...)
+	elements = append(elements,
 		"!", "kvssink",
-		fmt.Sprintf("stream-name=%s", f.streamName),
+		fmt.Sprintf("stream-name=%s", f.target()),
 		fmt.Sprintf("aws-region=%s", f.awsRegion),
-		fmt.Sprintf("retention-period=%s", retentionPeriod),
-		fmt.Sprintf("fragment-duration=%s", fragmentDuration),
-		fmt.Sprintf("storage-size=%s", storageSize),
-		"key-frame-fragmentation=true",
-		"streaming-type=0",
 	)
-
-	// Set up environment for AWS credentials
-	f.cmd.Env = os.Environ()
-
-	// Get stdin pipe
-	var err error
-	f.stdin, err = f.cmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get stdin pipe: %w", err)
+	elements = append(elements, config.kvssinkArgs()...)
+	elements = append(elements, f.credentialArgs()...)
+	elements = append(elements, keyFrameFragmentation)
+	elements = append(elements, f.streamingTypeArgs()...)
+	// Interleaved AAC: a second branch from flvdemux into the same kvssink
+	if f.interleaved != nil {
+		log.Printf("[KVS] Forwarding audio with the video (%s)", f.interleaved)
+		elements = append(elements, "name=sink")
+		elements = append(elements, f.interleaved.interleavedElements(config.queueElement())...)
 	}
+	return "video", elements
+}
 
-	// Redirect stdout/stderr to log
-	f.cmd.Stdout = &logWriter{prefix: "[GStreamer] "}
-	f.cmd.Stderr = &logWriter{prefix: "[GStreamer] "}
-
-	// Start the command
-	if err := f.cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start GStreamer: %w", err)
-	}
-
-	f.running = true
-	f.frameCount = 0
-	f.lastLogTime = time.Now()
-
-	log.Printf("[KVS] GStreamer pipeline started (PID: %d)", f.cmd.Process.Pid)
-
-	// Monitor process in background and auto-restart on failure
-	go func() {
-		err := f.cmd.Wait()
-		f.mutex.Lock()
-		wasRunning := f.running
-		f.running = false
-		f.stdin = nil
-		shouldRestart := !f.stopped && wasRunning
-		f.mutex.Unlock()
-		
-		if err != nil {
-			log.Printf("[KVS] ⚠️  GStreamer pipeline exited with error: %v", err)
-		} else {
-			log.Printf("[KVS] GStreamer pipeline exited normally")
-		}
-		
-		// Auto-restart if not explicitly stopped
-		if shouldRestart {
-			log.Printf("[KVS] 🔄 Will auto-restart pipeline on next frame...")
-		}
-	}()
-
+// WriteAccessUnit implements sink.Sink. The forwarder restarts its pipeline itself, so
+// it never reports an error.
+func (f *Forwarder) WriteAccessUnit(ctx context.Context, pts, dts time.Duration, au [][]byte) error {
+	f.WriteH264(ctx, pts, dts, au)
 	return nil
 }
 
-// restart restarts the GStreamer pipeline with fresh credentials.
-// Must be called WITHOUT holding the mutex.
-func (f *Forwarder) restart() error {
-	f.mutex.Lock()
-	if f.running {
-		f.mutex.Unlock()
-		return nil
-	}
-	
-	// Rate limit restarts (max once per 5 seconds)
-	if time.Since(f.lastRestartTime) < 5*time.Second {
-		f.mutex.Unlock()
-		return fmt.Errorf("restart rate limited")
+// WriteH264 writes H.264 NAL units to the KVS forwarder. Frames written after ctx (the
+// publisher's context) is done are dropped.
+// Auto-restarts the pipeline if it has stopped unexpectedly.
+func (f *Forwarder) WriteH264(ctx context.Context, pts, dts time.Duration, au [][]byte) {
+	if ctx.Err() != nil {
+		return
 	}
-	f.lastRestartTime = time.Now()
-	f.restartCount++
-	f.mutex.Unlock()
-	
-	log.Printf("[KVS] 🔄 Auto-restarting pipeline (restart #%d)...", f.restartCount)
-	
-	// Force refresh credentials before restart
-	if err := f.credManager.ForceRefresh(); err != nil {
-		log.Printf("[KVS] ⚠️  Failed to refresh credentials during restart: %v", err)
-	}
-	
-	return f.Start()
-}
 
-// WriteH264 writes H.264 NAL units to the KVS forwarder.
-// Auto-restarts the pipeline if it has stopped unexpectedly.
-func (f *Forwarder) WriteH264(pts, dts time.Duration, au [][]byte) {
-	f.mutex.Lock()
-	needsRestart := !f.running && !f.stopped
-	f.mutex.Unlock()
-	
 	// Auto-restart if pipeline stopped unexpectedly
-	if needsRestart {
-		if err := f.restart(); err != nil {
+	if f.restartDue() {
+		if err := f.request(transition{kind: transitionRestart}); err != nil {
 			// Restart failed or rate limited, skip this frame
 			return
 		}
 	}
-	
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
 
-	if !f.running || f.stdin == nil {
-		// Still not running after restart attempt
+	f.writeMutex.Lock()
+	f.mutex.Lock()
+	au, replace := f.prepareH264(au)
+	f.mutex.Unlock()
+	f.writeMutex.Unlock()
+	if len(au) == 0 {
+		// Still not running after restart attempt, or nothing to write yet
 		return
 	}
 
-	// Log first few frames for debugging
-	if f.frameCount < 10 {
-		totalSize := 0
-		for i, nalu := range au {
-			totalSize += len(nalu)
-			if len(nalu) > 0 {
-				nalType := nalu[0] & 0x1F
-				log.Printf("[KVS] Frame %d NALU %d: type=%d, size=%d, first bytes: %02x %02x %02x %02x", 
-					f.frameCount, i, nalType, len(nalu), 
-					nalu[0], 
-					func() byte { if len(nalu) > 1 { return nalu[1] } else { return 0 } }(),
-					func() byte { if len(nalu) > 2 { return nalu[2] } else { return 0 } }(),
-					func() byte { if len(nalu) > 3 { return nalu[3] } else { return 0 } }())
-			}
+	// The run loop replaces the pipeline for the keyframe
+	if replace.needed() {
+		if err := f.request(transition{kind: transitionReplace, async: replace.async}); err != nil {
+			log.Printf("[KVS] ⚠️  Failed to restart pipeline for %s: %v", strings.Join(replace.reasons, " and "), err)
+			return
 		}
-		log.Printf("[KVS] WriteH264 frame %d: %d NALUs, total size %d bytes", f.frameCount, len(au), totalSize)
 	}
 
-	// Write H.264 NAL units with Annex B start codes
-	for _, nalu := range au {
-		// Write start code (0x00 0x00 0x00 0x01)
-		startCode := []byte{0x00, 0x00, 0x00, 0x01}
-		if _, err := f.stdin.Write(startCode); err != nil {
-			log.Printf("[KVS] Failed to write start code: %v", err)
-			return
-		}
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+	p := f.videoPipeline(au)
+	if p == nil {
+		return
+	}
 
-		// Write NAL unit
-		if _, err := f.stdin.Write(nalu); err != nil {
-			log.Printf("[KVS] Failed to write NAL unit: %v", err)
-			return
-		}
+	// Write the access unit as an FLV tag (keeps PTS/DTS for B-frames). The mutex is not
+	// held, so that a pipeline that stopped reading cannot block Stop and Status: Stop
+	// closes its input, which fails the write.
+	if err := p.writeAU(pts, dts, au); err != nil {
+		log.Printf("[KVS] Failed to write frame: %v", err)
+		return
 	}
 
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// The arrival of the keyframes is matched to the fragment ACKs
+	if idr, _ := pictureType(au); idr {
+		f.latency.wrote(f.mux.lastDTS+pts-dts, time.Now())
+	}
+
+	f.offlineWrote(dts)
+
 	// Update statistics
 	f.frameCount++
-	
+	f.runFrames++
+	f.gops.add(f.target(), pts, au)
+	f.countShardFrame(au)
+
 	// Log statistics every 10 seconds
 	if time.Since(f.lastLogTime) > 10*time.Second {
 		log.Printf("[KVS] Frames forwarded: %d", f.frameCount)
@@ -242,58 +451,142 @@ func (f *Forwarder) WriteH264(pts, dts time.Duration, au [][]byte) {
 	}
 }
 
-// Stop stops the KVS forwarder and disables auto-restart.
-func (f *Forwarder) Stop() {
+// videoPipeline returns the running video pipeline to write au to, or nil if the
+// forwarder is not running video or au is a picture before the first keyframe. Must be
+// called with writeMutex held.
+func (f *Forwarder) videoPipeline(au [][]byte) pipeline {
 	f.mutex.Lock()
-	f.stopped = true // Disable auto-restart
-	
-	if !f.running {
-		f.mutex.Unlock()
-		return
+	defer f.mutex.Unlock()
+
+	if f.state != stateRunning || f.audio != nil {
+		return nil
+	}
+
+	// Discard mid-GOP pictures until the first IDR after (re)start. Access units without
+	// a picture (parameter sets, SEI) still reach the muxer, which keeps the SPS/PPS.
+	if f.awaitKeyframe {
+		idr, picture := pictureType(au)
+		if picture && !idr {
+			f.skippedFrames++
+			f.runSkipped++
+			return nil
+		}
+		if idr {
+			f.awaitKeyframe = false
+			if f.runSkipped > 0 {
+				log.Printf("[KVS] Skipped %d frames before the first keyframe", f.runSkipped)
+			}
+		}
 	}
 
-	log.Printf("[KVS] Stopping GStreamer pipeline...")
+	// NAL units of the first frames (NALU_DUMP_FRAMES, /logging)
+	if f.naluDump > 0 {
+		f.logNALUs(au)
+	}
+	return f.pipeline
+}
 
-	if f.stdin != nil {
-		f.stdin.Close()
-		f.stdin = nil
+// prepareH264 returns the access unit to write and the pipeline replacement it starts, if
+// any; nil when the forwarder is not running video. Must be called with the mutex held.
+func (f *Forwarder) prepareH264(au [][]byte) ([][]byte, replacement) {
+	var replace replacement
+	if f.state != stateRunning || f.audio != nil {
+		return nil, replace
 	}
 
-	cmd := f.cmd
-	f.running = false
-	f.mutex.Unlock()
+	// New parameter sets (resolution or profile change) start a new pipeline at the IDR
+	// that activates them
+	au, reconfigure := f.paramChange(au)
+	if len(au) == 0 {
+		return nil, replace
+	}
+	if reconfigure {
+		f.reconfigure(au[0])
+		replace.add("new parameter sets", false)
+	}
+
+	// Sharded streams move to the next shard at the first keyframe of a new window
+	if f.shardDue(au) {
+		f.switchShard()
+		replace.add("the next shard of "+f.streamName, true)
+	}
+
+	// A new fragment duration starts a new pipeline at a keyframe
+	if f.fragmentDue(au) {
+		f.refragment()
+		replace.add("the new fragment duration", false)
+	}
+	return au, replace
+}
 
-	if cmd != nil && cmd.Process != nil {
-		cmd.Process.Signal(os.Interrupt)
-		
-		// Wait for graceful shutdown with timeout
-		done := make(chan struct{})
-		go func() {
-			cmd.Wait()
-			close(done)
-		}()
-
-		select {
-		case <-done:
-			log.Printf("[KVS] GStreamer pipeline stopped gracefully")
-		case <-time.After(5 * time.Second):
-			log.Printf("[KVS] Force killing GStreamer pipeline")
-			cmd.Process.Kill()
+// pictureType reports whether au contains an IDR picture and whether it contains a
+// picture at all.
+func pictureType(au [][]byte) (idr, picture bool) {
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1F {
+		case 5: // IDR
+			return true, true
+		case 1, 2, 3, 4: // Non-IDR slice and data partitions
+			picture = true
 		}
 	}
+	return false, picture
+}
+
+// Stop stops the KVS forwarder and disables auto-restart. It returns once the pipeline
+// has flushed.
+func (f *Forwarder) Stop() {
+	f.request(transition{kind: transitionStop})
+}
+
+// Starts returns the number of times the forwarder was started, for StopUnlessStarted.
+func (f *Forwarder) Starts() uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.starts
 }
 
-// Close closes the KVS forwarder.
+// StopUnlessStarted stops the KVS forwarder like Stop, unless it was started again after
+// Starts returned starts (a publisher reconnected while the stop was pending).
+func (f *Forwarder) StopUnlessStarted(starts uint64) {
+	f.request(transition{kind: transitionStop, starts: starts, conditional: true})
+}
+
+// Close stops the KVS forwarder and ends its run loop. It cannot be started again.
 func (f *Forwarder) Close() {
 	f.Stop()
+	f.closeOnce.Do(func() { close(f.closed) })
 }
 
 // logWriter is a simple io.Writer that logs each line with a prefix.
 type logWriter struct {
 	prefix string
+	onLine func(line string) // optional; called for every complete line
+	buf    []byte
 }
 
 func (w *logWriter) Write(p []byte) (n int, err error) {
-	log.Printf("%s%s", w.prefix, string(p))
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(w.buf[:i], "\r"))
+		w.buf = w.buf[i+1:]
+
+		log.Printf("%s%s", w.prefix, line)
+		if w.onLine != nil {
+			w.onLine(line)
+		}
+	}
+	// Never buffer more than 64 KiB of an unterminated line
+	if len(w.buf) > 65536 {
+		log.Printf("%s%s", w.prefix, string(w.buf))
+		w.buf = w.buf[:0]
+	}
 	return len(p), nil
 }
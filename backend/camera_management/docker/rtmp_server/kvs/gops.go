@@ -0,0 +1,88 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import "time"
+
+// GOPRecord describes one GOP written to a stream. kvssink starts a fragment at every
+// keyframe, so a GOP is also a KVS fragment.
+type GOPRecord struct {
+	StreamName        string        // target KVS stream
+	ProducerTimestamp time.Time     // wall clock of the first frame on the stream timeline
+	Duration          time.Duration // PTS span up to the next keyframe (last frame when stopped)
+	Keyframe          bool          // the GOP starts with an IDR frame
+	Frames            int
+	Bytes             int // H.264 payload, excluding container overhead
+}
+
+// GOPSink receives a record for every GOP forwarded. WriteGOP is called with the
+// forwarder's mutex held and must not block.
+type GOPSink interface {
+	WriteGOP(GOPRecord)
+}
+
+// gopSink receives the GOP records of all forwarders, nil if disabled
+var gopSink GOPSink
+
+// SetGOPSink sets the receiver of GOP records. It must be called before forwarders start.
+func SetGOPSink(s GOPSink) {
+	gopSink = s
+}
+
+// gopTracker accumulates the GOP currently being written.
+type gopTracker struct {
+	open     bool
+	record   GOPRecord
+	startPTS time.Duration
+	lastPTS  time.Duration
+
+	// Wall clock at PTS 0, so producer timestamps follow the stream timeline even when
+	// frames arrive in bursts
+	base time.Time
+}
+
+// add accounts a written access unit. A keyframe closes the current GOP; access units
+// without a picture (parameter sets, SEI) are added to the open GOP only.
+func (t *gopTracker) add(streamName string, pts time.Duration, au [][]byte) {
+	if gopSink == nil {
+		return
+	}
+	idr, picture := pictureType(au)
+	if idr && t.open {
+		t.record.Duration = pts - t.startPTS
+		t.emit()
+	}
+	if !t.open {
+		if !picture {
+			return
+		}
+		if t.base.IsZero() {
+			t.base = time.Now().UTC().Add(-pts)
+		}
+		t.open = true
+		t.record = GOPRecord{StreamName: streamName, ProducerTimestamp: t.base.Add(pts), Keyframe: idr}
+		t.startPTS = pts
+	}
+	t.record.Frames++
+	for _, nalu := range au {
+		t.record.Bytes += len(nalu)
+	}
+	t.lastPTS = pts
+}
+
+// flush closes the current GOP when the pipeline stops.
+func (t *gopTracker) flush() {
+	t.base = time.Time{}
+	if gopSink == nil || !t.open {
+		return
+	}
+	t.record.Duration = t.lastPTS - t.startPTS
+	t.emit()
+}
+
+func (t *gopTracker) emit() {
+	if t.record.Duration < 0 {
+		t.record.Duration = 0
+	}
+	gopSink.WriteGOP(t.record)
+	t.open = false
+}
@@ -0,0 +1,135 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// iotCredentials represents the JSON response from the AWS IoT credentials provider.
+type iotCredentials struct {
+	Credentials struct {
+		AccessKeyId     string    `json:"accessKeyId"`
+		SecretAccessKey string    `json:"secretAccessKey"`
+		SessionToken    string    `json:"sessionToken"`
+		Expiration      time.Time `json:"expiration"`
+	} `json:"credentials"`
+}
+
+// iotSource fetches credentials from the AWS IoT credentials provider using the
+// device's X.509 certificate (for edge gateways outside ECS).
+type iotSource struct {
+	endpoint  string // <prefix>.credentials.iot.<region>.amazonaws.com
+	roleAlias string
+	thingName string
+	certFile  string
+	keyFile   string
+	caFile    string // optional; system roots are used when empty
+}
+
+// iotSourceFromEnv configures the IoT credentials provider from IOT_CREDENTIAL_ENDPOINT,
+// IOT_ROLE_ALIAS, IOT_THING_NAME, IOT_CERT_FILE, IOT_KEY_FILE and IOT_CA_FILE.
+// It returns nil unless IOT_CREDENTIAL_ENDPOINT is set.
+func iotSourceFromEnv() *iotSource {
+	endpoint := os.Getenv("IOT_CREDENTIAL_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+
+	src := &iotSource{
+		endpoint:  endpoint,
+		roleAlias: os.Getenv("IOT_ROLE_ALIAS"),
+		thingName: os.Getenv("IOT_THING_NAME"),
+		certFile:  os.Getenv("IOT_CERT_FILE"),
+		keyFile:   os.Getenv("IOT_KEY_FILE"),
+		caFile:    os.Getenv("IOT_CA_FILE"),
+	}
+	if src.roleAlias == "" || src.thingName == "" || src.certFile == "" || src.keyFile == "" {
+		log.Printf("[Credentials] ⚠️  IOT_CREDENTIAL_ENDPOINT is set but IOT_ROLE_ALIAS, IOT_THING_NAME, IOT_CERT_FILE or IOT_KEY_FILE is missing")
+	}
+	return src
+}
+
+func (s *iotSource) name() string {
+	return "AWS IoT credentials provider"
+}
+
+func (s *iotSource) checkInterval() time.Duration {
+	// IoT credentials default to a 1 hour lifetime
+	return 5 * time.Minute
+}
+
+// httpClient builds a client presenting the device certificate.
+// The files are re-read on every refresh so rotated certificates are picked up.
+func (s *iotSource) httpClient() (*http.Client, error) {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if s.caFile != "" {
+		pem, err := os.ReadFile(s.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+func (s *iotSource) fetch() (*credentials, error) {
+	client, err := s.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("https://%s/role-aliases/%s/credentials", s.endpoint, url.PathEscape(s.roleAlias))
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-amzn-iot-thingname", s.thingName)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch credentials: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("IoT credentials provider returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var creds iotCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials response: %w", err)
+	}
+
+	return &credentials{
+		AccessKeyID:     creds.Credentials.AccessKeyId,
+		SecretAccessKey: creds.Credentials.SecretAccessKey,
+		SessionToken:    creds.Credentials.SessionToken,
+		Expiration:      creds.Credentials.Expiration,
+	}, nil
+}
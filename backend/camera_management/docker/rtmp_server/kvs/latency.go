@@ -0,0 +1,135 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// Persisted fragments the latency statistics cover
+	latencyWindow = 100
+	// Keyframes of the pipeline waiting for their fragment to be acknowledged
+	maxPendingKeyframes = 256
+	// Largest difference between a fragment timecode and the keyframe it is matched to
+	// (timecodes are in milliseconds)
+	latencyMatchTolerance = 20 * time.Millisecond
+)
+
+// LatencyStats summarizes the end-to-end latency of the last persisted fragments: from
+// the arrival of the keyframe that starts a fragment to its PERSISTED acknowledgement.
+type LatencyStats struct {
+	LastMs    int64     `json:"last_ms"`
+	AverageMs int64     `json:"average_ms"`
+	P95Ms     int64     `json:"p95_ms"`
+	MaxMs     int64     `json:"max_ms"`
+	Window    int       `json:"window"`  // fragments the average, p95 and max cover
+	Samples   uint64    `json:"samples"` // fragments measured since the forwarder was created
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// latencyTracker correlates PERSISTED acknowledgements with the keyframes written to the
+// pipeline. kvssink stamps frames with the wall clock of its first frame plus the stream
+// timestamp, so the fragment timecode minus the timecode of the first fragment is the
+// output timestamp of the fragment's keyframe, whose arrival was recorded when it was
+// written. It has its own mutex since ACKs are parsed from the pipeline log without the
+// forwarder's mutex.
+type latencyTracker struct {
+	mutex sync.Mutex
+
+	// Current pipeline: timecode of its first fragment and its unacknowledged keyframes
+	base      int64 // ms, 0 until the first ACK
+	keyframes []keyframeArrival
+
+	samples []time.Duration // last latencyWindow, oldest first
+	total   uint64
+	updated time.Time
+}
+
+// keyframeArrival is a keyframe written to the pipeline.
+type keyframeArrival struct {
+	pts time.Duration // on the output timeline of the pipeline
+	at  time.Time
+}
+
+// reset starts the correlation for a new pipeline, whose timecodes start anew.
+func (t *latencyTracker) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.base = 0
+	t.keyframes = t.keyframes[:0]
+}
+
+// wrote records the arrival of a keyframe written at pts of the output timeline.
+func (t *latencyTracker) wrote(pts time.Duration, at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.keyframes) >= maxPendingKeyframes {
+		t.keyframes = slices.Delete(t.keyframes, 0, len(t.keyframes)-maxPendingKeyframes+1)
+	}
+	t.keyframes = append(t.keyframes, keyframeArrival{pts: pts, at: at})
+}
+
+// acknowledged records an ACK of the fragment with timecode (ms). Every ACK calibrates
+// the timecode of the first fragment, which is the earliest of the pipeline; a PERSISTED
+// ACK matched to a keyframe adds a latency sample. Fragments are acknowledged in order,
+// so the keyframes up to the matched one are discarded.
+func (t *latencyTracker) acknowledged(timecode int64, persisted bool, at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if timecode <= 0 {
+		return
+	}
+	if t.base == 0 || timecode < t.base {
+		t.base = timecode
+	}
+	if !persisted {
+		return
+	}
+	pts := time.Duration(timecode-t.base) * time.Millisecond
+	i := slices.IndexFunc(t.keyframes, func(k keyframeArrival) bool {
+		return (k.pts - pts).Abs() <= latencyMatchTolerance
+	})
+	if i < 0 {
+		return
+	}
+	latency := at.Sub(t.keyframes[i].at)
+	t.keyframes = slices.Delete(t.keyframes, 0, i+1)
+
+	if len(t.samples) >= latencyWindow {
+		t.samples = slices.Delete(t.samples, 0, 1)
+	}
+	t.samples = append(t.samples, latency)
+	t.total++
+	t.updated = at
+}
+
+// stats returns the latency statistics, nil before the first sample.
+func (t *latencyTracker) stats() *LatencyStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.samples) == 0 {
+		return nil
+	}
+	sorted := slices.Sorted(slices.Values(t.samples))
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	return &LatencyStats{
+		LastMs:    t.samples[len(t.samples)-1].Milliseconds(),
+		AverageMs: (sum / time.Duration(len(sorted))).Milliseconds(),
+		P95Ms:     sorted[(len(sorted)*95-1)/100].Milliseconds(),
+		MaxMs:     sorted[len(sorted)-1].Milliseconds(),
+		Window:    len(sorted),
+		Samples:   t.total,
+		UpdatedAt: t.updated,
+	}
+}
+
+// Latency returns the ingest-to-persisted latency of the last fragments, nil before the
+// first fragment was measured (file sink, audio-only streams, no ACKs yet).
+func (f *Forwarder) Latency() *LatencyStats {
+	return f.latency.stats()
+}
@@ -0,0 +1,387 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"rtmp_kvs/events"
+)
+
+// forwarderState is the lifecycle state of a forwarder. Only its run loop changes it, with
+// the mutex held; writers and Status read it.
+type forwarderState int
+
+const (
+	stateIdle       forwarderState = iota // never started
+	stateStarting                         // a pipeline is being started
+	stateRunning                          // the pipeline accepts frames
+	stateRestarting                       // the pipeline exited, or is being replaced, during a run
+	stateStopping                         // the run ended and its pipeline is flushing
+	stateStopped                          // no run, Start begins a new one
+)
+
+var stateNames = [...]string{"idle", "starting", "running", "restarting", "stopping", "stopped"}
+
+func (s forwarderState) String() string {
+	return stateNames[s]
+}
+
+var (
+	errForwarderClosed    = errors.New("forwarder closed")
+	errForwarderStopped   = errors.New("forwarder stopped")
+	errRestartRateLimited = errors.New("restart rate limited")
+)
+
+// Requests to the run loop of a forwarder
+type transitionKind int
+
+const (
+	transitionStart   transitionKind = iota // start a run, or keep its running pipeline
+	transitionRestart                       // restart the pipeline that exited, after the backoff
+	transitionReplace                       // replace the running pipeline at a keyframe
+	transitionExited                        // a pipeline exited
+	transitionStop                          // end the run and stop its pipeline
+)
+
+// transition is a request to the run loop.
+type transition struct {
+	kind transitionKind
+
+	ctx         context.Context // start: context of the run; stop: the run to end, nil for any
+	audio       *AudioTrack     // start: track of an audio-only stream, nil for video
+	interleaved *AudioTrack     // start: AAC track forwarded with the video
+	async       bool            // replace: the old pipeline flushes while the new one starts
+	pipeline    pipeline        // exited: the pipeline that exited
+	err         error           // exited: its error
+	starts      uint64          // stop: the starts it applies to, if conditional
+	conditional bool
+
+	done chan error // receives the outcome, nil for exited
+}
+
+// run owns the lifecycle of the forwarder. It applies the transitions one at a time, so
+// that starts, stops, restarts, pipeline replacements and pipeline exits cannot
+// interleave. It returns when the forwarder is closed.
+func (f *Forwarder) run() {
+	for {
+		select {
+		case t := <-f.transitions:
+			err := f.apply(t)
+			if t.done != nil {
+				t.done <- err
+			}
+		case <-f.closed:
+			return
+		}
+	}
+}
+
+// request submits a transition to the run loop and waits for its outcome.
+func (f *Forwarder) request(t transition) error {
+	t.done = make(chan error, 1)
+	select {
+	case f.transitions <- t:
+	case <-f.closed:
+		return errForwarderClosed
+	}
+	return <-t.done
+}
+
+// apply performs a transition. Must be called from the run loop only.
+func (f *Forwarder) apply(t transition) error {
+	switch t.kind {
+	case transitionStart:
+		return f.startRun(t.ctx, t.audio, t.interleaved)
+	case transitionRestart:
+		return f.restart()
+	case transitionReplace:
+		return f.replace(t.async)
+	case transitionExited:
+		f.exited(t.pipeline, t.err)
+		return nil
+	default:
+		if t.conditional && f.Starts() != t.starts {
+			// Started again since the stop was requested
+			return nil
+		}
+		f.stop(t.ctx)
+		return nil
+	}
+}
+
+// startRun starts the pipeline for H.264 video (audio == nil), with the interleaved AAC
+// track if not nil, or for an audio-only track. A running pipeline with the same track
+// layout is kept; one with another layout is stopped with its run first.
+func (f *Forwarder) startRun(ctx context.Context, audio, interleaved *AudioTrack) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	f.starts++
+	changed := ""
+	if f.state == stateRunning {
+		switch {
+		case !f.audio.equal(audio):
+			changed = "Track layout"
+		case audio == nil && !f.interleaved.equal(interleaved):
+			changed = "Audio track"
+		}
+	}
+	f.mutex.Unlock()
+	if changed != "" {
+		// A warm pipeline for a different track layout cannot be reused
+		log.Printf("[KVS] %s of %s changed, replacing pipeline", changed, f.streamName)
+		f.stop(nil)
+	}
+
+	f.mutex.Lock()
+	if audio == nil {
+		f.interleaved = interleaved
+	}
+	if f.state == stateRunning {
+		// A new publisher on a warm pipeline also starts at a keyframe
+		f.awaitKeyframe = true
+		f.runSkipped = 0
+		f.mutex.Unlock()
+		return nil
+	}
+	if f.ctx == nil || f.ctx.Err() != nil {
+		// New run: stop the pipeline when the caller's context ends
+		runCtx, cancel := context.WithCancel(ctx)
+		f.ctx, f.cancel = runCtx, cancel
+		context.AfterFunc(runCtx, func() { f.request(transition{kind: transitionStop, ctx: runCtx}) })
+		// Role credentials are renewed for the lifetime of a run
+		if f.role != nil {
+			f.role.close()
+			f.role = nil
+		}
+	}
+	f.mutex.Unlock()
+
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.launch(audio)
+}
+
+// launch starts a pipeline for the run. On failure the run stays in the restarting state,
+// so that the next frame retries after the backoff. Must be called from the run loop with
+// writeMutex and the mutex held; no write is pending then, since the previous pipeline
+// has exited or been stopped.
+func (f *Forwarder) launch(audio *AudioTrack) error {
+	f.state = stateStarting
+	p, err := f.startPipelineFor(audio)
+	if err != nil {
+		f.state = stateRestarting
+		return err
+	}
+
+	f.pipeline = p
+	f.state = stateRunning
+	f.runFrames = 0
+	f.naluDump = f.debug.NALUDumpFrames
+	f.lastLogTime = time.Now()
+	f.awaitKeyframe = true
+	f.runSkipped = 0
+	f.latency.reset()
+
+	// The run loop learns of the exit, and restarts the pipeline on the next frame
+	go func() {
+		err := p.wait()
+		select {
+		case f.transitions <- transition{kind: transitionExited, pipeline: p, err: err}:
+		case <-f.closed:
+		}
+	}()
+	return nil
+}
+
+// exited records the exit of a pipeline. A pipeline replaced or stopped since is ignored.
+func (f *Forwarder) exited(p pipeline, err error) {
+	f.mutex.Lock()
+	if f.pipeline != p {
+		f.mutex.Unlock()
+		return
+	}
+	f.pipeline = nil
+	f.lastExitTime = time.Now()
+	restart := f.ctx != nil
+	f.state = stateStopped
+	if restart {
+		f.state = stateRestarting
+	}
+	f.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("[KVS] ⚠️  GStreamer pipeline exited with error: %v", err)
+	} else {
+		log.Printf("[KVS] GStreamer pipeline exited normally")
+	}
+	if restart {
+		log.Printf("[KVS] 🔄 Will auto-restart pipeline on next frame...")
+	}
+}
+
+// restartDue reports whether the pipeline exited during the run and may be restarted now.
+func (f *Forwarder) restartDue() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.state == stateRestarting && f.ctx != nil && f.ctx.Err() == nil && !time.Now().Before(f.restartAfter)
+}
+
+// restart restarts the pipeline of the run after it exited, with fresh credentials. It
+// is rate limited (once per 5 seconds), backing off further after auth, throttling,
+// stream-not-found and network errors.
+func (f *Forwarder) restart() error {
+	f.mutex.Lock()
+	switch {
+	case f.state == stateRunning:
+		f.mutex.Unlock()
+		return nil
+	case f.state != stateRestarting || f.ctx == nil:
+		f.mutex.Unlock()
+		return errForwarderStopped
+	}
+
+	delay, errorClass := f.nextRestartDelay()
+	if time.Since(f.lastRestartTime) < defaultRestartDelay || time.Since(f.lastExitTime) < delay {
+		f.restartAfter = f.lastRestartTime.Add(defaultRestartDelay)
+		if at := f.lastExitTime.Add(delay); at.After(f.restartAfter) {
+			f.restartAfter = at
+		}
+		f.mutex.Unlock()
+		return errRestartRateLimited
+	}
+	f.lastRestartTime = time.Now()
+	f.restartCount++
+	restartCount := f.restartCount
+	f.mutex.Unlock()
+	f.countRestart(delay)
+
+	if errorClass != "" {
+		log.Printf("[KVS] 🔄 Auto-restarting pipeline after %s error (restart #%d, waited %s)...", errorClass, restartCount, delay)
+	} else {
+		log.Printf("[KVS] 🔄 Auto-restarting pipeline (restart #%d)...", restartCount)
+	}
+	detail := map[string]any{"restart_count": restartCount}
+	if errorClass != "" {
+		detail["error_class"] = errorClass
+		detail["backoff_seconds"] = delay.Seconds()
+	}
+	events.Emit(events.Event{
+		Type:       events.PipelineRestarted,
+		StreamName: f.streamName,
+		Detail:     detail,
+	})
+
+	// Force refresh credentials before restart
+	if err := f.credManager.ForceRefresh(); err != nil {
+		log.Printf("[KVS] ⚠️  Failed to refresh credentials during restart: %v", err)
+	}
+
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.launch(f.audio)
+}
+
+// replace replaces the running pipeline with a new one of the run, for a keyframe that
+// needs other pipeline settings, without waiting for the restart backoff. The old
+// pipeline gets an EOS, so kvssink completes the current fragment, before the new one
+// starts or, if async, while it starts.
+func (f *Forwarder) replace(async bool) error {
+	f.mutex.Lock()
+	if f.state != stateRunning {
+		f.mutex.Unlock()
+		return errForwarderStopped
+	}
+	p := f.pipeline
+	f.pipeline = nil
+	f.state = stateRestarting
+	f.gops.flush()
+	f.mutex.Unlock()
+
+	if async {
+		go p.stop(pipelineStopTimeout())
+	} else {
+		p.stop(pipelineStopTimeout())
+	}
+
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.launch(nil)
+}
+
+// replacement is the pipeline replacement an access unit is written after: for new
+// parameter sets, the next shard or a new fragment duration.
+type replacement struct {
+	reasons []string
+	async   bool // the old pipeline may flush while the new one starts
+}
+
+// add records a reason for the replacement. It is async only if all of its reasons are.
+func (r *replacement) add(reason string, async bool) {
+	r.async = async && (len(r.reasons) == 0 || r.async)
+	r.reasons = append(r.reasons, reason)
+}
+
+// needed reports whether the pipeline is to be replaced.
+func (r replacement) needed() bool {
+	return len(r.reasons) > 0
+}
+
+// stop ends the run, if it is runCtx or runCtx is nil, and stops its pipeline, waiting
+// for the pipeline to flush.
+func (f *Forwarder) stop(runCtx context.Context) {
+	f.mutex.Lock()
+	if runCtx != nil && f.ctx != runCtx {
+		// A newer run has started since
+		f.mutex.Unlock()
+		return
+	}
+	if f.cancel != nil {
+		// Ends the run (disables auto-restart)
+		f.cancel()
+		f.ctx, f.cancel = nil, nil
+	}
+	f.closeShard()
+
+	p := f.pipeline
+	f.pipeline = nil
+	if p == nil {
+		if f.state != stateIdle {
+			f.state = stateStopped
+		}
+		f.mutex.Unlock()
+		return
+	}
+
+	log.Printf("[KVS] Stopping GStreamer pipeline...")
+	f.state = stateStopping
+	f.gops.flush()
+	f.mutex.Unlock()
+
+	persisted := f.AckStats().Counts[AckPersisted]
+	start := time.Now()
+	p.stop(pipelineStopTimeout())
+
+	acks := f.AckStats()
+	if acks.Counts[AckPersisted] > persisted {
+		log.Printf("[KVS] GStreamer pipeline stopped after %s (last persisted fragment %s)",
+			time.Since(start).Round(time.Millisecond), acks.LastPersistedTime.Format(time.RFC3339Nano))
+	} else {
+		log.Printf("[KVS] GStreamer pipeline stopped after %s", time.Since(start).Round(time.Millisecond))
+	}
+
+	f.mutex.Lock()
+	f.state = stateStopped
+	f.mutex.Unlock()
+}
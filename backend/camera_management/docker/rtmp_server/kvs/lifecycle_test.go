@@ -0,0 +1,110 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledPipeline is a pipeline that stopped reading: writes block until it is stopped.
+type stalledPipeline struct {
+	writing   chan struct{} // closed when a write blocks
+	closed    chan struct{} // closed by stop, like stdin
+	done      chan struct{}
+	writeOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func newStalledPipeline() *stalledPipeline {
+	return &stalledPipeline{writing: make(chan struct{}), closed: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (p *stalledPipeline) writeAU(pts, dts time.Duration, au [][]byte) error {
+	p.writeOnce.Do(func() { close(p.writing) })
+	<-p.closed
+	return errors.New("write |1: file already closed")
+}
+
+func (p *stalledPipeline) writeAudio(pts time.Duration, frame []byte) error {
+	return p.writeAU(pts, pts, nil)
+}
+
+func (p *stalledPipeline) wait() error {
+	<-p.done
+	return nil
+}
+
+func (p *stalledPipeline) stop(timeout time.Duration) {
+	p.stopOnce.Do(func() {
+		close(p.closed)
+		close(p.done)
+	})
+}
+
+func (p *stalledPipeline) String() string {
+	return "stalled"
+}
+
+func TestStopWithStalledWrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(f *Forwarder)
+	}{
+		{
+			name: "video",
+			write: func(f *Forwarder) {
+				f.WriteH264(context.Background(), 0, 0, [][]byte{testIDR})
+			},
+		},
+		{
+			name: "audio",
+			write: func(f *Forwarder) {
+				f.mutex.Lock()
+				f.audio = &AudioTrack{}
+				f.mutex.Unlock()
+				f.WriteAudio(context.Background(), 0, []byte{0x21, 0x10})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewForwarder("test-stream", "us-east-1")
+			defer f.Close()
+			p := newStalledPipeline()
+			defer p.stop(0) // unblocks the forwarder if the test fails
+			f.mutex.Lock()
+			f.pipeline, f.state = p, stateRunning
+			f.mutex.Unlock()
+
+			written := make(chan struct{})
+			go func() {
+				tt.write(f)
+				close(written)
+			}()
+			<-p.writing
+
+			// Status and Stop do not wait for the blocked write
+			stopped := make(chan struct{})
+			go func() {
+				f.Status()
+				f.Stop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Stop blocked behind the pipeline write")
+			}
+			select {
+			case <-written:
+			case <-time.After(5 * time.Second):
+				t.Fatal("write did not fail after Stop")
+			}
+			if status := f.Status(); status.Running {
+				t.Error("forwarder still running after Stop")
+			}
+		})
+	}
+}
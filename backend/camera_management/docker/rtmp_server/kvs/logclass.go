@@ -0,0 +1,176 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"rtmp_kvs/events"
+)
+
+// Pipeline error classes
+const (
+	ErrorAuth           = "auth"
+	ErrorThrottling     = "throttling"
+	ErrorStreamNotFound = "stream_not_found"
+	ErrorNetwork        = "network"
+)
+
+// errorClasses are the classes in classification order (first match wins).
+var errorClasses = []struct {
+	class   string
+	pattern *regexp.Regexp
+}{
+	{ErrorAuth, regexp.MustCompile(`(?i)access ?denied|unrecognizedclient|invalidsignature|expired ?token|security token.*(invalid|expired)|not authorized|STATUS_INVALID_AUTH|response code:? 40[13]\b`)},
+	{ErrorThrottling, regexp.MustCompile(`(?i)throttl|limitexceeded|limit exceeded|rate exceeded|too many requests|response code:? 429\b`)},
+	{ErrorStreamNotFound, regexp.MustCompile(`(?i)resourcenotfound|STATUS_STREAM_NOT_FOUND|stream .*(not found|does not exist)|response code:? 404\b`)},
+	{ErrorNetwork, regexp.MustCompile(`(?i)could ?n[o']t resolve|connection refused|connection reset|connection timed out|operation timed out|network is unreachable|no route to host|ssl connect error|failed to connect|CURLE_`)},
+}
+
+// classifyLine returns the error class of a pipeline log line, or "" if it is not a
+// recognized kvssink/producer SDK error.
+func classifyLine(line string) string {
+	for _, c := range errorClasses {
+		if c.pattern.MatchString(line) {
+			return c.class
+		}
+	}
+	return ""
+}
+
+// restartBaseDelays is the first auto-restart delay after an error of each class. It doubles
+// with every consecutive failed restart (up to maxRestartDelay), so a pipeline that cannot
+// authenticate or whose stream does not exist is not restarted in a hot loop.
+var restartBaseDelays = map[string]time.Duration{
+	ErrorAuth:           time.Minute,
+	ErrorThrottling:     30 * time.Second,
+	ErrorStreamNotFound: 5 * time.Minute,
+	ErrorNetwork:        5 * time.Second,
+}
+
+const (
+	defaultRestartDelay = 5 * time.Second
+	maxRestartDelay     = 10 * time.Minute
+)
+
+// errorEventInterval limits PipelineError events per stream and class.
+const errorEventInterval = time.Minute
+
+// PipelineErrorStats summarizes the classified pipeline errors of a stream.
+type PipelineErrorStats struct {
+	Counts       map[string]uint64 `json:"counts"`
+	LastClass    string            `json:"last_class,omitempty"`
+	LastMessage  string            `json:"last_message,omitempty"`
+	LastErrorAt  time.Time         `json:"last_error_at,omitempty"`
+	Consecutive  int               `json:"consecutive_failures"` // restarts since the last persisted fragment
+	RestartDelay float64           `json:"restart_delay_seconds"`
+}
+
+// errorTracker accumulates classified errors and drives the restart backoff.
+type errorTracker struct {
+	mutex      sync.Mutex
+	stats      PipelineErrorStats
+	lastEvents map[string]time.Time
+	// Class of the last error since the pipeline was (re)started
+	pendingClass string
+}
+
+// recordError classifies a pipeline log line and records it if it is an error.
+func (f *Forwarder) recordError(line string) {
+	class := classifyLine(line)
+	if class == "" {
+		return
+	}
+
+	t := &f.pipelineErrors
+	t.mutex.Lock()
+	if t.stats.Counts == nil {
+		t.stats.Counts = make(map[string]uint64)
+		t.lastEvents = make(map[string]time.Time)
+	}
+	now := time.Now()
+	t.stats.Counts[class]++
+	t.stats.LastClass = class
+	t.stats.LastMessage = truncate(line, 500)
+	t.stats.LastErrorAt = now
+	t.pendingClass = class
+	emit := now.Sub(t.lastEvents[class]) >= errorEventInterval
+	if emit {
+		t.lastEvents[class] = now
+	}
+	t.mutex.Unlock()
+
+	if class == ErrorThrottling || class == ErrorNetwork {
+		f.fragmentFailed()
+	}
+	if emit {
+		log.Printf("[KVS] ⚠️  Pipeline error for %s classified as %s", f.streamName, class)
+		events.Emit(events.Event{
+			Type:       events.PipelineError,
+			StreamName: f.streamName,
+			Detail: map[string]any{
+				"class":   class,
+				"message": truncate(line, 500),
+			},
+		})
+	}
+}
+
+// resetErrors clears the restart backoff once fragments are persisted again.
+func (f *Forwarder) resetErrors() {
+	f.pipelineErrors.mutex.Lock()
+	f.pipelineErrors.stats.Consecutive = 0
+	f.pipelineErrors.stats.RestartDelay = 0
+	f.pipelineErrors.pendingClass = ""
+	f.pipelineErrors.mutex.Unlock()
+}
+
+// nextRestartDelay returns the delay before the next auto-restart, based on the class of
+// the error that stopped the pipeline, and counts the failure.
+func (f *Forwarder) nextRestartDelay() (time.Duration, string) {
+	t := &f.pipelineErrors
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	class := t.pendingClass
+	delay, ok := restartBaseDelays[class]
+	if !ok {
+		return defaultRestartDelay, ""
+	}
+	for i := 0; i < t.stats.Consecutive && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRestartDelay)
+	return delay, class
+}
+
+// countRestart records a restart attempt and the delay that preceded it.
+func (f *Forwarder) countRestart(delay time.Duration) {
+	f.pipelineErrors.mutex.Lock()
+	f.pipelineErrors.stats.Consecutive++
+	f.pipelineErrors.stats.RestartDelay = delay.Seconds()
+	f.pipelineErrors.pendingClass = ""
+	f.pipelineErrors.mutex.Unlock()
+}
+
+// ErrorStats returns the classified pipeline errors of the forwarder.
+func (f *Forwarder) ErrorStats() PipelineErrorStats {
+	f.pipelineErrors.mutex.Lock()
+	defer f.pipelineErrors.mutex.Unlock()
+
+	stats := f.pipelineErrors.stats
+	stats.Counts = make(map[string]uint64, len(f.pipelineErrors.stats.Counts))
+	for k, v := range f.pipelineErrors.stats.Counts {
+		stats.Counts[k] = v
+	}
+	return stats
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
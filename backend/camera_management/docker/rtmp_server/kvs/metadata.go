@@ -0,0 +1,48 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KVS limits of fragment metadata
+const (
+	maxMetadataNameLength  = 128
+	maxMetadataValueLength = 256
+)
+
+// ErrMetadataUnsupported is returned by AddMetadata when the pipeline cannot attach
+// fragment metadata (only the in-process appsrc pipeline can).
+var ErrMetadataUnsupported = errors.New("fragment metadata requires the in-process pipeline (PIPELINE_BACKEND=inprocess)")
+
+// metadataWriter is implemented by pipelines that can attach metadata to KVS fragments.
+type metadataWriter interface {
+	// addMetadata attaches a name/value pair to the next fragment, or to every following
+	// fragment if persistent.
+	addMetadata(name, value string, persistent bool) error
+}
+
+// AddMetadata attaches a name/value pair to the next KVS fragment of the stream (kvssink
+// fragment metadata). It does nothing while the forwarder is stopped. The name must not
+// start with "AWS" and KVS allows at most 10 pairs per fragment, so callers should
+// rate-limit it.
+func (f *Forwarder) AddMetadata(name, value string) error {
+	if name == "" || len(name) > maxMetadataNameLength {
+		return fmt.Errorf("invalid metadata name %q", name)
+	}
+	if len(value) > maxMetadataValueLength {
+		return fmt.Errorf("metadata value of %s is %d bytes, KVS allows %d", name, len(value), maxMetadataValueLength)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.state != stateRunning {
+		return nil
+	}
+	writer, ok := f.pipeline.(metadataWriter)
+	if !ok {
+		return ErrMetadataUnsupported
+	}
+	return writer.addMetadata(name, value, false)
+}
@@ -0,0 +1,60 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"rtmp_kvs/metrics"
+)
+
+// CollectMetrics writes the pipeline and fragment ACK metrics of all forwarders.
+func (p *Pool) CollectMetrics(w *metrics.Writer) {
+	for _, f := range p.Forwarders() {
+		// The destination account is empty until resolved at the first pipeline start
+		labels := []string{"stream_name", f.streamName, "account", f.Destination().Account}
+
+		status := f.Status()
+		w.Gauge("kvs_pipeline_running", "Whether the KVS pipeline is running", boolToFloat(status.Running), labels...)
+		w.Counter("kvs_pipeline_restarts_total", "Automatic pipeline restarts", float64(status.Restarts), labels...)
+		w.Counter("kvs_pipeline_parameter_changes_total", "Pipelines replaced because the publisher changed its SPS/PPS", float64(status.ParamChanges), labels...)
+		w.Counter("kvs_frames_forwarded_total", "Frames written to the pipeline, across restarts and publishers", float64(status.FramesForwarded), labels...)
+		if len(f.Config().Shards) > 0 {
+			w.Counter("kvs_shard_switches_total", "Switches of a sharded stream to its next shard", float64(status.ShardSwitches), labels...)
+		}
+		w.Gauge("kvs_fragment_duration_ms", "Fragment duration of the pipeline (adapted with FRAGMENT_ADAPTIVE)", float64(status.FragmentDurationMs), labels...)
+		if adaptiveConfigFromEnv() != nil {
+			w.Counter("kvs_fragment_duration_changes_total", "Adjustments of the adaptive fragment duration", float64(status.FragmentChanges), labels...)
+		}
+		w.Counter("kvs_frames_skipped_total", "Frames dropped before the first keyframe after a pipeline start", float64(status.SkippedFrames), labels...)
+
+		for _, class := range []string{ErrorAuth, ErrorThrottling, ErrorStreamNotFound, ErrorNetwork} {
+			w.Counter("kvs_pipeline_errors_total", "Classified kvssink errors", float64(status.Errors.Counts[class]),
+				append(labels, "class", class)...)
+		}
+		w.Gauge("kvs_pipeline_restart_backoff_seconds", "Delay applied before the last automatic restart", status.Errors.RestartDelay, labels...)
+
+		acks := status.Acks
+		for _, typ := range []string{AckBuffering, AckReceived, AckPersisted, AckError, AckIdle} {
+			w.Counter("kvs_fragment_acks_total", "PutMedia fragment acknowledgements by type", float64(acks.Counts[typ]),
+				append(labels, "type", typ)...)
+		}
+		if !acks.LastPersistedTime.IsZero() {
+			w.Gauge("kvs_last_persisted_timestamp_seconds", "Producer timestamp of the last persisted fragment",
+				float64(acks.LastPersistedTime.UnixMilli())/1000, labels...)
+			w.Gauge("kvs_last_persisted_ack_timestamp_seconds", "Time the last PERSISTED acknowledgement was received",
+				float64(acks.LastPersistedAt.UnixMilli())/1000, labels...)
+		}
+		if latency := status.Latency; latency != nil {
+			w.Gauge("kvs_ingest_latency_seconds", "Latency from the arrival of the last persisted fragment's keyframe to its PERSISTED acknowledgement",
+				float64(latency.LastMs)/1000, labels...)
+			w.Gauge("kvs_ingest_latency_average_seconds", "Average ingest-to-persisted latency of the last fragments", float64(latency.AverageMs)/1000, labels...)
+			w.Gauge("kvs_ingest_latency_p95_seconds", "95th percentile ingest-to-persisted latency of the last fragments", float64(latency.P95Ms)/1000, labels...)
+			w.Gauge("kvs_ingest_latency_max_seconds", "Largest ingest-to-persisted latency of the last fragments", float64(latency.MaxMs)/1000, labels...)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
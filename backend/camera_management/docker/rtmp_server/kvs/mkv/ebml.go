@@ -0,0 +1,129 @@
+// Package mkv writes H.264 and AAC as fragmented Matroska, the format KVS PutMedia
+// accepts: a segment and clusters of unknown size, each cluster (a KVS fragment) starting
+// at a video keyframe and made of simple blocks with timestamps relative to it.
+package mkv
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Matroska element IDs
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+
+	idSegment       = 0x18538067
+	idInfo          = 0x1549A966
+	idTimecodeScale = 0x2AD7B1
+	idMuxingApp     = 0x4D80
+	idWritingApp    = 0x5741
+
+	idTracks            = 0x1654AE6B
+	idTrackEntry        = 0xAE
+	idTrackNumber       = 0xD7
+	idTrackUID          = 0x73C5
+	idTrackType         = 0x83
+	idCodecID           = 0x86
+	idCodecPrivate      = 0x63A2
+	idVideo             = 0xE0
+	idPixelWidth        = 0xB0
+	idPixelHeight       = 0xBA
+	idAudio             = 0xE1
+	idSamplingFrequency = 0xB5
+	idChannels          = 0x9F
+
+	idCluster     = 0x1F43B675
+	idTimecode    = 0xE7
+	idSimpleBlock = 0xA3
+)
+
+// Track types
+const (
+	trackTypeVideo = 1
+	trackTypeAudio = 2
+)
+
+// unknownSize is the size of a master element whose end is not known when it starts
+// (the segment and the clusters of a live stream).
+var unknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// appendID appends an element ID, which keeps its length marker.
+func appendID(buf []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(buf, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<16:
+		return append(buf, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(buf, byte(id>>8), byte(id))
+	}
+	return append(buf, byte(id))
+}
+
+// appendSize appends an element size as the shortest variable-size integer. All-ones
+// values are reserved for unknown sizes, hence the 2^(7n)-1 limits.
+func appendSize(buf []byte, size uint64) []byte {
+	length := 1
+	for length < 8 && size >= 1<<(7*length)-1 {
+		length++
+	}
+	for i := length - 1; i >= 0; i-- {
+		b := byte(size >> (8 * i))
+		if i == length-1 {
+			b |= 0x80 >> (length - 1)
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+// appendElement appends an element with the given content.
+func appendElement(buf []byte, id uint32, data []byte) []byte {
+	buf = appendID(buf, id)
+	buf = appendSize(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// appendUint appends an unsigned integer element in as few bytes as possible.
+func appendUint(buf []byte, id uint32, v uint64) []byte {
+	length := 1
+	for length < 8 && v >= 1<<(8*length) {
+		length++
+	}
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], v)
+	return appendElement(buf, id, data[8-length:])
+}
+
+// appendString appends a string element.
+func appendString(buf []byte, id uint32, s string) []byte {
+	return appendElement(buf, id, []byte(s))
+}
+
+// appendFloat appends an 8-byte float element.
+func appendFloat(buf []byte, id uint32, f float64) []byte {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], math.Float64bits(f))
+	return appendElement(buf, id, data[:])
+}
+
+// appendMaster appends a master element made of the given children.
+func appendMaster(buf []byte, id uint32, children ...[]byte) []byte {
+	size := 0
+	for _, child := range children {
+		size += len(child)
+	}
+	buf = appendID(buf, id)
+	buf = appendSize(buf, uint64(size))
+	for _, child := range children {
+		buf = append(buf, child...)
+	}
+	return buf
+}
@@ -0,0 +1,291 @@
+// Package mkv writes H.264 and AAC as fragmented Matroska, the format KVS PutMedia
+// accepts: a segment and clusters of unknown size, each cluster (a KVS fragment) starting
+// at a video keyframe and made of simple blocks with timestamps relative to it.
+package mkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/bluenviron/gortmplib/pkg/h264conf"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/mpeg4audio"
+)
+
+// Timestamps are written in milliseconds (the Matroska default, and what KVS expects)
+const timecodeScale = time.Millisecond
+
+// muxingApp is written to the segment info.
+const muxingApp = "rtmp_kvs"
+
+// maxBuffer caps the size of the write buffer kept between frames.
+const maxBuffer = 4 * 1024 * 1024
+
+// defaultAudioFragment is the cluster duration of audio-only streams, which have no
+// keyframes to cut at.
+const defaultAudioFragment = 2 * time.Second
+
+// Config describes the tracks and fragments of a stream.
+type Config struct {
+	// H.264 video track. Its codec private data and dimensions are taken from the SPS and
+	// PPS of the first keyframe, before which nothing is written.
+	Video bool
+	// AAC audio track (AudioSpecificConfig), nil for none
+	AudioConfig []byte
+	// Timestamps are offset by StartTime, making the cluster timecodes absolute
+	// (milliseconds since the epoch, KVS ABSOLUTE timecodes); zero keeps them relative to
+	// the start of the stream.
+	StartTime time.Time
+	// A new cluster starts at the first keyframe at least FragmentDuration after the start
+	// of the current one; 0 starts one at every keyframe. Audio-only streams are cut every
+	// FragmentDuration (default 2s).
+	FragmentDuration time.Duration
+}
+
+// Writer writes a stream as fragmented Matroska. The header is written with the first
+// frame, each cluster header when the cluster starts and each frame with a single Write
+// call, so the output can be streamed (PutMedia) or stored as is (S3 archive).
+type Writer struct {
+	w      io.Writer
+	config Config
+	audio  mpeg4audio.AudioSpecificConfig
+
+	videoTrack uint64 // 0 without a video track
+	audioTrack uint64 // 0 without an audio track
+
+	started      bool // the header was written
+	inCluster    bool
+	clusterStart int64 // timecode of the current cluster (ms)
+	buf          []byte
+}
+
+// NewWriter creates a writer. It writes nothing before the first frame.
+func NewWriter(w io.Writer, config Config) (*Writer, error) {
+	mw := &Writer{w: w, config: config}
+	if config.Video {
+		mw.videoTrack = 1
+	}
+	if config.AudioConfig != nil {
+		if err := mw.audio.Unmarshal(config.AudioConfig); err != nil {
+			return nil, fmt.Errorf("invalid AAC config: %w", err)
+		}
+		mw.audioTrack = mw.videoTrack + 1
+	}
+	if mw.videoTrack == 0 && mw.audioTrack == 0 {
+		return nil, errors.New("no tracks")
+	}
+	return mw, nil
+}
+
+// WriteH264 writes an H.264 access unit (NAL units without start codes) presented at pts.
+// Frames before the first keyframe carrying the SPS and PPS are dropped. Parameter sets
+// are kept in-band, so decoders follow resolution changes.
+func (mw *Writer) WriteH264(pts time.Duration, au [][]byte) error {
+	if mw.videoTrack == 0 {
+		return errors.New("no video track")
+	}
+	keyframe := h264.IsRandomAccess(au)
+	if !mw.started {
+		if !keyframe {
+			return nil
+		}
+		var sps, pps []byte
+		for _, nalu := range au {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch h264.NALUType(nalu[0] & 0x1F) {
+			case h264.NALUTypeSPS:
+				sps = nalu
+			case h264.NALUTypePPS:
+				pps = nalu
+			}
+		}
+		if sps == nil || pps == nil {
+			return nil
+		}
+		if err := mw.writeHeader(sps, pps); err != nil {
+			return err
+		}
+	}
+
+	timecode := mw.timecode(pts)
+	if keyframe && (!mw.inCluster || time.Duration(timecode-mw.clusterStart)*timecodeScale >= mw.config.FragmentDuration) {
+		if err := mw.startCluster(timecode); err != nil {
+			return err
+		}
+	}
+
+	size := 0
+	for _, nalu := range au {
+		if len(nalu) > 0 && h264.NALUType(nalu[0]&0x1F) != h264.NALUTypeAccessUnitDelimiter {
+			size += 4 + len(nalu)
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	buf, err := mw.startBlock(mw.videoTrack, timecode, keyframe, size)
+	if err != nil {
+		return err
+	}
+	for _, nalu := range au {
+		if len(nalu) > 0 && h264.NALUType(nalu[0]&0x1F) != h264.NALUTypeAccessUnitDelimiter {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(nalu)))
+			buf = append(buf, nalu...)
+		}
+	}
+	return mw.write(buf)
+}
+
+// WriteAAC writes a raw AAC frame presented at pts. With a video track, frames before the
+// first video keyframe are dropped, since fragments start with one.
+func (mw *Writer) WriteAAC(pts time.Duration, frame []byte) error {
+	if mw.audioTrack == 0 {
+		return errors.New("no audio track")
+	}
+	if !mw.started {
+		if mw.videoTrack != 0 {
+			return nil
+		}
+		if err := mw.writeHeader(nil, nil); err != nil {
+			return err
+		}
+	}
+
+	timecode := mw.timecode(pts)
+	if mw.videoTrack == 0 {
+		duration := mw.config.FragmentDuration
+		if duration == 0 {
+			duration = defaultAudioFragment
+		}
+		if !mw.inCluster || time.Duration(timecode-mw.clusterStart)*timecodeScale >= duration {
+			if err := mw.startCluster(timecode); err != nil {
+				return err
+			}
+		}
+	}
+	buf, err := mw.startBlock(mw.audioTrack, timecode, true, len(frame))
+	if err != nil {
+		return err
+	}
+	return mw.write(append(buf, frame...))
+}
+
+// timecode returns the timecode of a timestamp.
+func (mw *Writer) timecode(pts time.Duration) int64 {
+	timecode := int64(pts / timecodeScale)
+	if !mw.config.StartTime.IsZero() {
+		timecode += mw.config.StartTime.UnixMilli()
+	}
+	return timecode
+}
+
+// writeHeader writes the EBML header, the start of the segment, the segment info and the
+// tracks.
+func (mw *Writer) writeHeader(sps, pps []byte) error {
+	var tracks [][]byte
+	if mw.videoTrack != 0 {
+		codecPrivate, err := h264conf.Conf{SPS: sps, PPS: pps}.Marshal()
+		if err != nil {
+			return err
+		}
+		var video []byte
+		var parsed h264.SPS
+		if err := parsed.Unmarshal(sps); err == nil {
+			video = appendMaster(nil, idVideo,
+				appendUint(nil, idPixelWidth, uint64(parsed.Width())),
+				appendUint(nil, idPixelHeight, uint64(parsed.Height())))
+		}
+		tracks = append(tracks, appendMaster(nil, idTrackEntry,
+			appendUint(nil, idTrackNumber, mw.videoTrack),
+			appendUint(nil, idTrackUID, mw.videoTrack),
+			appendUint(nil, idTrackType, trackTypeVideo),
+			appendString(nil, idCodecID, "V_MPEG4/ISO/AVC"),
+			appendElement(nil, idCodecPrivate, codecPrivate),
+			video))
+	}
+	if mw.audioTrack != 0 {
+		tracks = append(tracks, appendMaster(nil, idTrackEntry,
+			appendUint(nil, idTrackNumber, mw.audioTrack),
+			appendUint(nil, idTrackUID, mw.audioTrack),
+			appendUint(nil, idTrackType, trackTypeAudio),
+			appendString(nil, idCodecID, "A_AAC"),
+			appendElement(nil, idCodecPrivate, mw.config.AudioConfig),
+			appendMaster(nil, idAudio,
+				appendFloat(nil, idSamplingFrequency, float64(mw.audio.SampleRate)),
+				appendUint(nil, idChannels, uint64(mw.audio.ChannelCount)))))
+	}
+
+	header := appendMaster(nil, idEBML,
+		appendUint(nil, idEBMLVersion, 1),
+		appendUint(nil, idEBMLReadVersion, 1),
+		appendUint(nil, idEBMLMaxIDLength, 4),
+		appendUint(nil, idEBMLMaxSizeLength, 8),
+		appendString(nil, idDocType, "matroska"),
+		appendUint(nil, idDocTypeVersion, 2),
+		appendUint(nil, idDocTypeReadVersion, 2))
+	header = appendID(header, idSegment)
+	header = append(header, unknownSize...)
+	header = appendMaster(header, idInfo,
+		appendUint(nil, idTimecodeScale, uint64(timecodeScale)),
+		appendString(nil, idMuxingApp, muxingApp),
+		appendString(nil, idWritingApp, muxingApp))
+	header = appendMaster(header, idTracks, tracks...)
+
+	if _, err := mw.w.Write(header); err != nil {
+		return err
+	}
+	mw.started = true
+	return nil
+}
+
+// startCluster writes the start of a cluster.
+func (mw *Writer) startCluster(timecode int64) error {
+	buf := appendID(mw.buf[:0], idCluster)
+	buf = append(buf, unknownSize...)
+	buf = appendUint(buf, idTimecode, uint64(max(timecode, 0)))
+	if err := mw.write(buf); err != nil {
+		return err
+	}
+	mw.inCluster, mw.clusterStart = true, max(timecode, 0)
+	return nil
+}
+
+// startBlock returns the header of a simple block with size bytes of frame data, in the
+// write buffer. A cluster is started first if the timestamp is out of the range of block
+// timestamps (16 bits relative to the cluster), e.g. in a GOP longer than 32 seconds, so
+// such clusters may not start with a keyframe.
+func (mw *Writer) startBlock(track uint64, timecode int64, keyframe bool, size int) ([]byte, error) {
+	if !mw.inCluster || timecode-mw.clusterStart > math.MaxInt16 || timecode-mw.clusterStart < math.MinInt16 {
+		if err := mw.startCluster(timecode); err != nil {
+			return nil, err
+		}
+	}
+	var flags byte
+	if keyframe {
+		flags = 0x80
+	}
+	// Track number (1-byte variable-size integer), relative timestamp, flags
+	buf := appendID(mw.buf[:0], idSimpleBlock)
+	buf = appendSize(buf, uint64(1+2+1+size))
+	buf = append(buf, 0x80|byte(track))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(int16(timecode-mw.clusterStart)))
+	buf = append(buf, flags)
+	return buf, nil
+}
+
+// write writes the content of the write buffer, which is kept for the next element unless
+// an occasional huge keyframe made it grow beyond maxBuffer.
+func (mw *Writer) write(buf []byte) error {
+	mw.buf = buf
+	if cap(buf) > maxBuffer {
+		mw.buf = nil
+	}
+	_, err := mw.w.Write(buf)
+	return err
+}
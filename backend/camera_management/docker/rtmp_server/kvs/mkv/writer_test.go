@@ -0,0 +1,420 @@
+package mkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// 352x288 SPS and a PPS
+var (
+	testSPS = []byte{
+		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+		0x00, 0x03, 0x00, 0x3d, 0x08,
+	}
+	testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+	// AAC-LC, 48 kHz, stereo
+	testAACConfig = []byte{0x11, 0x90}
+)
+
+// testFrame is a frame of a test stream.
+type testFrame struct {
+	audio bool
+	pts   time.Duration
+	au    [][]byte
+}
+
+func keyframe(pts time.Duration) testFrame {
+	return testFrame{pts: pts, au: [][]byte{{0x09, 0xf0}, testSPS, testPPS, {0x65, 0x88, 0x84, 0x00}}}
+}
+
+func interFrame(pts time.Duration) testFrame {
+	return testFrame{pts: pts, au: [][]byte{{0x41, 0x9a, 0x02, 0x03}}}
+}
+
+func aacFrame(pts time.Duration) testFrame {
+	return testFrame{audio: true, pts: pts, au: [][]byte{{0x21, 0x10, 0x04, 0x60, 0x8c, 0x1c}}}
+}
+
+// gop returns a GOP of n frames at 10 fps starting with a keyframe at start.
+func gop(start time.Duration, n int) []testFrame {
+	frames := []testFrame{keyframe(start)}
+	for i := 1; i < n; i++ {
+		frames = append(frames, interFrame(start+time.Duration(i)*100*time.Millisecond))
+	}
+	return frames
+}
+
+// mux writes frames with a new writer and returns the output.
+func mux(t *testing.T, config Config, frames []testFrame) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := NewWriter(&out, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		if frame.audio {
+			err = w.WriteAAC(frame.pts, frame.au[0])
+		} else {
+			err = w.WriteH264(frame.pts, frame.au)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out.Bytes()
+}
+
+// element is a parsed element; children are parsed for master elements.
+type element struct {
+	id       uint32
+	data     []byte
+	children []element
+}
+
+// masters are the master elements parsed by parse.
+var masters = map[uint32]bool{
+	idEBML: true, idSegment: true, idInfo: true, idTracks: true, idTrackEntry: true,
+	idVideo: true, idAudio: true, idCluster: true,
+}
+
+// parse parses a sequence of elements. Elements of unknown size extend to the end of
+// their parent, or to the next element of the same ID (clusters).
+func parse(t *testing.T, data []byte) []element {
+	t.Helper()
+	var elements []element
+	for len(data) > 0 {
+		idLength := vintLength(data[0])
+		if idLength == 0 || idLength > 4 || len(data) < idLength {
+			t.Fatalf("invalid element ID % x", data[:min(len(data), 4)])
+		}
+		id := uint32(0)
+		for _, b := range data[:idLength] {
+			id = id<<8 | uint32(b)
+		}
+		data = data[idLength:]
+		sizeLength := vintLength(data[0])
+		if sizeLength == 0 || len(data) < sizeLength {
+			t.Fatalf("invalid size of element %x", id)
+		}
+		var size uint64
+		if bytes.Equal(data[:sizeLength], unknownSize) {
+			size = uint64(len(data) - sizeLength)
+			if id == idCluster {
+				if next := bytes.Index(data[sizeLength:], []byte{0x1F, 0x43, 0xB6, 0x75}); next >= 0 {
+					size = uint64(next)
+				}
+			}
+		} else {
+			size = uint64(data[0] & (0xFF >> sizeLength))
+			for _, b := range data[1:sizeLength] {
+				size = size<<8 | uint64(b)
+			}
+		}
+		data = data[sizeLength:]
+		if uint64(len(data)) < size {
+			t.Fatalf("element %x of %d bytes truncated to %d", id, size, len(data))
+		}
+		e := element{id: id, data: data[:size]}
+		if masters[id] {
+			e.children = parse(t, e.data)
+		}
+		elements = append(elements, e)
+		data = data[size:]
+	}
+	return elements
+}
+
+func vintLength(first byte) int {
+	for i := range 8 {
+		if first&(0x80>>i) != 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (e element) child(id uint32) (element, bool) {
+	for _, c := range e.children {
+		if c.id == id {
+			return c, true
+		}
+	}
+	return element{}, false
+}
+
+func (e element) uint() uint64 {
+	var v uint64
+	for _, b := range e.data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// block is a parsed simple block.
+type block struct {
+	track    byte
+	relative int16
+	keyframe bool
+	data     []byte
+}
+
+// testCluster is a parsed cluster.
+type testCluster struct {
+	timecode uint64
+	blocks   []block
+}
+
+// clusters parses a stream and returns its clusters.
+func clusters(t *testing.T, data []byte) []testCluster {
+	t.Helper()
+	top := parse(t, data)
+	if len(top) != 2 || top[0].id != idEBML || top[1].id != idSegment {
+		t.Fatalf("expected an EBML header and a segment, got %d elements", len(top))
+	}
+	var result []testCluster
+	for _, e := range top[1].children {
+		if e.id != idCluster {
+			continue
+		}
+		timecode, ok := e.child(idTimecode)
+		if !ok || e.children[0].id != idTimecode {
+			t.Fatal("cluster does not start with its timecode")
+		}
+		c := testCluster{timecode: timecode.uint()}
+		for _, b := range e.children[1:] {
+			if b.id != idSimpleBlock {
+				t.Fatalf("unexpected element %x in cluster", b.id)
+			}
+			c.blocks = append(c.blocks, block{
+				track:    b.data[0] & 0x7F,
+				relative: int16(binary.BigEndian.Uint16(b.data[1:])),
+				keyframe: b.data[3]&0x80 != 0,
+				data:     b.data[4:],
+			})
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func TestGolden(t *testing.T) {
+	var av []testFrame
+	for i, frame := range append(gop(0, 20), gop(2*time.Second, 20)...) {
+		av = append(av, frame)
+		if i%2 == 0 {
+			av = append(av, aacFrame(frame.pts+21*time.Millisecond))
+		}
+	}
+	var audioOnly []testFrame
+	for i := range 200 {
+		audioOnly = append(audioOnly, aacFrame(time.Duration(i)*21333*time.Microsecond))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config Config
+		frames []testFrame
+	}{
+		{"h264", Config{Video: true}, append(gop(0, 10), gop(time.Second, 10)...)},
+		{"h264_aac", Config{Video: true, AudioConfig: testAACConfig}, av},
+		{"aac", Config{AudioConfig: testAACConfig}, audioOnly},
+		{"h264_absolute", Config{Video: true, StartTime: time.UnixMilli(1700000000000)}, gop(0, 10)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mux(t, tc.config, tc.frames)
+			path := filepath.Join("testdata", tc.name+".mkv")
+			if *update {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s (%d bytes, want %d); run with -update if intended", path, len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestHeader(t *testing.T) {
+	top := parse(t, mux(t, Config{Video: true, AudioConfig: testAACConfig}, gop(0, 2)))
+	docType, _ := top[0].child(idDocType)
+	if string(docType.data) != "matroska" {
+		t.Errorf("DocType %q", docType.data)
+	}
+	info, ok := top[1].child(idInfo)
+	if !ok {
+		t.Fatal("no segment info")
+	}
+	if scale, _ := info.child(idTimecodeScale); scale.uint() != 1000000 {
+		t.Errorf("TimecodeScale %d", scale.uint())
+	}
+	tracks, ok := top[1].child(idTracks)
+	if !ok || len(tracks.children) != 2 {
+		t.Fatal("expected 2 track entries")
+	}
+
+	video := tracks.children[0]
+	if codec, _ := video.child(idCodecID); string(codec.data) != "V_MPEG4/ISO/AVC" {
+		t.Errorf("video CodecID %q", codec.data)
+	}
+	private, _ := video.child(idCodecPrivate)
+	if len(private.data) < 8 || !bytes.Contains(private.data, testSPS) || !bytes.Contains(private.data, testPPS) {
+		t.Errorf("video CodecPrivate % x does not hold the SPS and PPS", private.data)
+	}
+	dimensions, _ := video.child(idVideo)
+	width, _ := dimensions.child(idPixelWidth)
+	height, _ := dimensions.child(idPixelHeight)
+	if width.uint() != 352 || height.uint() != 288 {
+		t.Errorf("dimensions %dx%d, want 352x288", width.uint(), height.uint())
+	}
+
+	audio := tracks.children[1]
+	if number, _ := audio.child(idTrackNumber); number.uint() != 2 {
+		t.Errorf("audio track number %d", number.uint())
+	}
+	if private, _ := audio.child(idCodecPrivate); !bytes.Equal(private.data, testAACConfig) {
+		t.Errorf("audio CodecPrivate % x", private.data)
+	}
+	settings, _ := audio.child(idAudio)
+	if channels, _ := settings.child(idChannels); channels.uint() != 2 {
+		t.Errorf("channels %d", channels.uint())
+	}
+}
+
+func TestClustersStartAtKeyframes(t *testing.T) {
+	frames := append(gop(0, 10), gop(time.Second, 10)...)
+	frames = append(frames, gop(2*time.Second, 10)...)
+	got := clusters(t, mux(t, Config{Video: true}, frames))
+	if len(got) != 3 {
+		t.Fatalf("%d clusters, want 3", len(got))
+	}
+	for i, c := range got {
+		if c.timecode != uint64(i*1000) {
+			t.Errorf("cluster %d timecode %d, want %d", i, c.timecode, i*1000)
+		}
+		if len(c.blocks) != 10 || !c.blocks[0].keyframe {
+			t.Fatalf("cluster %d: %d blocks, first keyframe %v", i, len(c.blocks), c.blocks[0].keyframe)
+		}
+		for j, b := range c.blocks {
+			if b.relative != int16(j*100) {
+				t.Errorf("cluster %d block %d relative timestamp %d, want %d", i, j, b.relative, j*100)
+			}
+			if b.keyframe != (j == 0) {
+				t.Errorf("cluster %d block %d keyframe %v", i, j, b.keyframe)
+			}
+		}
+	}
+
+	// AVCC with the parameter sets in-band and without the access unit delimiter
+	first := got[0].blocks[0].data
+	want := binary.BigEndian.AppendUint32(nil, uint32(len(testSPS)))
+	want = append(want, testSPS...)
+	if !bytes.HasPrefix(first, want) {
+		t.Errorf("keyframe % x does not start with the SPS", first[:min(len(first), 8)])
+	}
+}
+
+func TestFragmentDuration(t *testing.T) {
+	var frames []testFrame
+	for i := range 6 {
+		frames = append(frames, gop(time.Duration(i)*time.Second, 10)...)
+	}
+	got := clusters(t, mux(t, Config{Video: true, FragmentDuration: 2 * time.Second}, frames))
+	if len(got) != 3 {
+		t.Fatalf("%d clusters, want 3", len(got))
+	}
+	for i, c := range got {
+		if c.timecode != uint64(i*2000) || len(c.blocks) != 20 {
+			t.Errorf("cluster %d: timecode %d with %d blocks, want %d with 20", i, c.timecode, len(c.blocks), i*2000)
+		}
+	}
+}
+
+func TestFramesBeforeKeyframeDropped(t *testing.T) {
+	frames := []testFrame{interFrame(0), aacFrame(10 * time.Millisecond), interFrame(100 * time.Millisecond)}
+	if out := mux(t, Config{Video: true, AudioConfig: testAACConfig}, frames); len(out) != 0 {
+		t.Fatalf("%d bytes written before the first keyframe", len(out))
+	}
+
+	frames = append(frames, gop(200*time.Millisecond, 3)...)
+	got := clusters(t, mux(t, Config{Video: true, AudioConfig: testAACConfig}, frames))
+	if len(got) != 1 || got[0].timecode != 200 || len(got[0].blocks) != 3 || !got[0].blocks[0].keyframe {
+		t.Fatalf("unexpected clusters %+v", got)
+	}
+}
+
+func TestAudioOnly(t *testing.T) {
+	var frames []testFrame
+	for i := range 100 {
+		frames = append(frames, aacFrame(time.Duration(i)*100*time.Millisecond))
+	}
+	got := clusters(t, mux(t, Config{AudioConfig: testAACConfig}, frames))
+	if len(got) != 5 {
+		t.Fatalf("%d clusters, want 5 of 2s", len(got))
+	}
+	for _, c := range got {
+		if len(c.blocks) != 20 || c.blocks[0].track != 1 || !c.blocks[0].keyframe {
+			t.Errorf("cluster at %d: %d blocks, track %d", c.timecode, len(c.blocks), c.blocks[0].track)
+		}
+	}
+}
+
+func TestAbsoluteTimecodes(t *testing.T) {
+	start := time.UnixMilli(1700000000000)
+	got := clusters(t, mux(t, Config{Video: true, StartTime: start}, append(gop(0, 5), gop(500*time.Millisecond, 5)...)))
+	if len(got) != 2 || got[0].timecode != 1700000000000 || got[1].timecode != 1700000000500 {
+		t.Fatalf("unexpected clusters %+v", got)
+	}
+}
+
+func TestLongGOP(t *testing.T) {
+	// One keyframe and 40 s of inter frames: block timestamps are 16 bits
+	frames := []testFrame{keyframe(0)}
+	for i := 1; i <= 40; i++ {
+		frames = append(frames, interFrame(time.Duration(i)*time.Second))
+	}
+	got := clusters(t, mux(t, Config{Video: true}, frames))
+	if len(got) != 2 || got[1].timecode != 33000 || got[1].blocks[0].relative != 0 {
+		t.Fatalf("unexpected clusters %+v", got)
+	}
+}
+
+func TestAppendSize(t *testing.T) {
+	for _, tc := range []struct {
+		size uint64
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{126, []byte{0xFE}},
+		{127, []byte{0x40, 0x7F}}, // 0xFF would mean unknown
+		{16382, []byte{0x7F, 0xFE}},
+		{16383, []byte{0x20, 0x3F, 0xFF}},
+		{1 << 20, []byte{0x30, 0x00, 0x00}},
+	} {
+		if got := appendSize(nil, tc.size); !bytes.Equal(got, tc.want) {
+			t.Errorf("appendSize(%d) = % x, want % x", tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestNoTracks(t *testing.T) {
+	if _, err := NewWriter(&bytes.Buffer{}, Config{}); err == nil {
+		t.Error("expected an error without tracks")
+	}
+	if _, err := NewWriter(&bytes.Buffer{}, Config{AudioConfig: []byte{0xFF}}); err == nil {
+		t.Error("expected an error with an invalid AAC config")
+	}
+}
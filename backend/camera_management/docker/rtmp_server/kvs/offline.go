@@ -0,0 +1,61 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// offlineState places the frames of a backfill on their original timeline. kvssink in
+// the offline (REPLAY) streaming type stamps frames with file-start-time plus their
+// timestamp relative to the first frame of the pipeline, so a pipeline started after a
+// failure continues at the time of the last frame written.
+type offlineState struct {
+	start   time.Time // wall clock of the first frame, zero for live streaming
+	source  string    // footage being backfilled and the time of its first frame
+	origin  time.Time // (SetBackfillSource), kept when a resumed backfill moves start
+	first   time.Duration
+	last    time.Duration
+	written bool
+}
+
+// SetReplayStart switches the forwarder to the offline streaming type to backfill
+// recorded footage (e.g. recorded locally during a network outage): fragments land at
+// start, the original wall clock of the first frame, plus the stream timestamps instead
+// of at upload time, and kvssink waits for buffer space rather than dropping frames.
+// It takes effect on the next pipeline start; kvssink takes the start in whole seconds.
+func (f *Forwarder) SetReplayStart(start time.Time) {
+	f.mutex.Lock()
+	f.offline = offlineState{start: start, source: f.offline.source, origin: f.offline.origin}
+	f.mutex.Unlock()
+	log.Printf("[KVS] Offline (REPLAY) streaming for %s, footage starts at %s", f.streamName, start.Format(time.RFC3339))
+}
+
+// streamingTypeArgs returns the kvssink streaming type properties: realtime, or offline
+// starting at the time of the next frame. Must be called with the mutex held.
+func (f *Forwarder) streamingTypeArgs() []string {
+	o := &f.offline
+	if o.start.IsZero() {
+		return []string{"streaming-type=0"}
+	}
+	start := o.start
+	if o.written {
+		start = start.Add(o.last - o.first)
+	}
+	log.Printf("[KVS] Offline pipeline starts at %s", start.Format(time.RFC3339))
+	return []string{"streaming-type=2", "file-start-time=" + strconv.FormatInt(start.Unix(), 10)}
+}
+
+// offlineWrote records the DTS of a frame written in the offline streaming type. Must be
+// called with the mutex held.
+func (f *Forwarder) offlineWrote(dts time.Duration) {
+	o := &f.offline
+	if o.start.IsZero() {
+		return
+	}
+	if !o.written {
+		o.first, o.written = dts, true
+	}
+	o.last = dts
+}
@@ -0,0 +1,173 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// pipeline is a running media pipeline fed by a Forwarder: a gst-launch-1.0 process, an
+// in-process GStreamer pipeline (built with -tags gst) or the local file sink.
+type pipeline interface {
+	// writeAU pushes one H.264 access unit.
+	writeAU(pts, dts time.Duration, au [][]byte) error
+	// writeAudio pushes one frame of an audio-only stream.
+	writeAudio(pts time.Duration, frame []byte) error
+	// wait blocks until the pipeline has exited and returns its error.
+	wait() error
+	// stop ends the stream with EOS, giving the pipeline up to timeout to flush (kvssink
+	// uploads the last fragment) before forcing it down.
+	stop(timeout time.Duration)
+	// String describes the pipeline for logs.
+	String() string
+}
+
+// processKillDelay is how long an interrupted gst-launch-1.0 process may take to exit.
+const processKillDelay = 5 * time.Second
+
+// pipelineStopTimeout reads PIPELINE_STOP_TIMEOUT (seconds a stopping pipeline may take to
+// flush the last fragment after EOS, default 15).
+func pipelineStopTimeout() time.Duration {
+	return time.Duration(envInt("PIPELINE_STOP_TIMEOUT", 15)) * time.Second
+}
+
+// errInProcessUnavailable is returned by newAppsrcPipeline in builds without the gst tag.
+var errInProcessUnavailable = errors.New("in-process GStreamer is not available in this build (build with -tags gst)")
+
+// ackFeatures returns the enabled settings that act on fragment ACKs. kvssink only prints
+// ACKs to the log of a gst-launch-1.0 process, so the in-process pipeline never sees them.
+func ackFeatures() []string {
+	var features []string
+	if adaptiveConfigFromEnv() != nil {
+		features = append(features, "FRAGMENT_ADAPTIVE")
+	}
+	if os.Getenv("KVS_CHECKPOINT_DIR") != "" {
+		features = append(features, "KVS_CHECKPOINT_DIR")
+	}
+	return features
+}
+
+// inProcessPipeline reports whether PIPELINE_BACKEND selects the in-process GStreamer
+// pipeline instead of a gst-launch-1.0 process. The in-process pipeline is experimental
+// and only in builds with the gst tag; gst-launch-1.0 remains the production backend.
+func inProcessPipeline() bool {
+	switch backend := os.Getenv("PIPELINE_BACKEND"); backend {
+	case "", "exec":
+		return false
+	case "inprocess":
+		if features := ackFeatures(); len(features) > 0 {
+			log.Printf("[KVS] ⚠️  PIPELINE_BACKEND=inprocess is not supported with %s (needs fragment ACKs), using exec",
+				strings.Join(features, ", "))
+			return false
+		}
+		return true
+	default:
+		log.Printf("[KVS] ⚠️  Invalid PIPELINE_BACKEND %q, using exec", backend)
+		return false
+	}
+}
+
+// execPipeline is a gst-launch-1.0 process reading an FLV stream from stdin.
+type execPipeline struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	mux   *flvMuxer
+
+	done chan struct{}
+	err  error
+}
+
+// startExecPipeline launches gst-launch-1.0 with the given elements after flvdemux's pad
+// ("video" or "audio") and environment, with -v if verbose. input is the queue element
+// between stdin and flvdemux. Log lines are passed to onLine.
+func startExecPipeline(pad string, input, elements, env []string, verbose bool, mux *flvMuxer, onLine func(string)) (*execPipeline, error) {
+	// Input: FLV stream from stdin (H.264 with DTS and composition time offsets)
+	// Note: flvdemux restores PTS/DTS from the FLV tags, so B-frame streams stay monotonic
+	// Added queue (sized by the pipeline profile) to handle bursty input from mobile devices
+	// -e turns SIGINT into an EOS, so even an interrupted pipeline flushes kvssink
+	args := []string{"-e", "fdsrc", "fd=0", "blocksize=1048576", "!"}
+	args = append(args, input...)
+	args = append(args, "!", "flvdemux", "name=demux", "demux."+pad, "!")
+	args = append(args, elements...)
+	if verbose {
+		args = append([]string{"-v"}, args...)
+	}
+
+	p := &execPipeline{
+		cmd:  exec.Command("gst-launch-1.0", args...),
+		mux:  mux,
+		done: make(chan struct{}),
+	}
+
+	// Set up environment for AWS credentials
+	p.cmd.Env = env
+	// Do not wait for log output of orphaned children once the process has exited
+	p.cmd.WaitDelay = processKillDelay
+
+	var err error
+	p.stdin, err = p.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdin pipe: %w", err)
+	}
+
+	// Redirect stdout/stderr to log
+	p.cmd.Stdout = &logWriter{prefix: "[GStreamer] ", onLine: onLine}
+	p.cmd.Stderr = &logWriter{prefix: "[GStreamer] ", onLine: onLine}
+
+	if err := p.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start GStreamer: %w", err)
+	}
+	mux.reset(p.stdin)
+
+	go func() {
+		p.err = p.cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+func (p *execPipeline) writeAU(pts, dts time.Duration, au [][]byte) error {
+	return p.mux.writeAU(pts, dts, au)
+}
+
+func (p *execPipeline) writeAudio(pts time.Duration, frame []byte) error {
+	return p.mux.writeAudio(pts, frame)
+}
+
+func (p *execPipeline) wait() error {
+	<-p.done
+	return p.err
+}
+
+// stop closes stdin, which ends the FLV stream: fdsrc sends EOS, kvssink uploads the
+// buffered data and gst-launch-1.0 exits once EOS reaches the sink. The process is only
+// interrupted when it has not exited within timeout, and killed shortly after.
+func (p *execPipeline) stop(timeout time.Duration) {
+	p.stdin.Close()
+
+	select {
+	case <-p.done:
+		return
+	case <-time.After(timeout):
+	}
+
+	log.Printf("[KVS] GStreamer pipeline did not finish EOS in %s, interrupting", timeout)
+	interruptProcess(p.cmd.Process)
+	select {
+	case <-p.done:
+	case <-time.After(processKillDelay):
+		log.Printf("[KVS] Force killing GStreamer pipeline")
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+func (p *execPipeline) String() string {
+	return fmt.Sprintf("gst-launch-1.0 (PID: %d)", p.cmd.Process.Pid)
+}
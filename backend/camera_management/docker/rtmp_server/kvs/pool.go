@@ -0,0 +1,122 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"sort"
+	"sync"
+)
+
+// Pool manages one Forwarder per KVS stream, for servers that route publishers to
+// different streams.
+type Pool struct {
+	mutex      sync.Mutex
+	forwarders map[string]*Forwarder
+	configs    map[string]StreamConfig // per-stream settings by KVS stream name
+	debug      map[string]DebugOptions // debug settings set through the admin API
+	onCreate   func(*Forwarder)        // called for each new forwarder before it is returned
+}
+
+// NewPool creates an empty forwarder pool.
+func NewPool() *Pool {
+	return &Pool{forwarders: make(map[string]*Forwarder)}
+}
+
+// Get returns the forwarder for the stream, creating it on first use.
+func (p *Pool) Get(streamName, awsRegion string) *Forwarder {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := awsRegion + "/" + streamName
+	if f, exists := p.forwarders[key]; exists {
+		return f
+	}
+
+	f := NewForwarder(streamName, awsRegion)
+	f.SetConfig(p.configs[streamName])
+	if options, ok := p.debug[streamName]; ok {
+		f.SetDebug(options)
+	}
+	if p.onCreate != nil {
+		p.onCreate(f)
+	}
+	p.forwarders[key] = f
+	return f
+}
+
+// SetStreamConfigs sets the per-stream settings (e.g. from STREAM_CONFIG_FILE), keyed by
+// KVS stream name. Call before the first Get.
+func (p *Pool) SetStreamConfigs(configs map[string]StreamConfig) {
+	p.mutex.Lock()
+	p.configs = configs
+	p.mutex.Unlock()
+}
+
+// OnCreate sets a function called with each forwarder the pool creates, before it is
+// used (e.g. to restore its saved state). Call before the first Get.
+func (p *Pool) OnCreate(fn func(*Forwarder)) {
+	p.mutex.Lock()
+	p.onCreate = fn
+	p.mutex.Unlock()
+}
+
+// StreamConfig returns the configured settings of a stream (zero if none).
+func (p *Pool) StreamConfig(streamName string) StreamConfig {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.configs[streamName]
+}
+
+// UpdateStreamConfig applies the non-zero fields of override to the settings of a stream,
+// for forwarders created later and those in the pool, and returns the effective settings.
+// Running pipelines keep their settings until they restart.
+func (p *Pool) UpdateStreamConfig(streamName string, override StreamConfig) (StreamConfig, error) {
+	if err := override.Validate(); err != nil {
+		return StreamConfig{}, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.configs == nil {
+		p.configs = make(map[string]StreamConfig)
+	}
+	p.configs[streamName] = p.configs[streamName].Merge(override)
+	effective := defaultStreamConfig().Merge(p.configs[streamName])
+	for _, f := range p.forwarders {
+		if f.streamName != streamName {
+			continue
+		}
+		// Keeps the values the registry set for the forwarder
+		f.mutex.Lock()
+		f.config = f.config.Merge(override)
+		effective = defaultStreamConfig().Merge(f.config)
+		f.mutex.Unlock()
+	}
+	return effective, nil
+}
+
+// Forwarders returns the forwarders in the pool, sorted by stream name.
+func (p *Pool) Forwarders() []*Forwarder {
+	p.mutex.Lock()
+	forwarders := make([]*Forwarder, 0, len(p.forwarders))
+	for _, f := range p.forwarders {
+		forwarders = append(forwarders, f)
+	}
+	p.mutex.Unlock()
+
+	sort.Slice(forwarders, func(i, j int) bool { return forwarders[i].streamName < forwarders[j].streamName })
+	return forwarders
+}
+
+// Close stops all forwarders in the pool. The pipelines flush in parallel, so shutdown
+// takes at most one pipeline stop timeout.
+func (p *Pool) Close() {
+	var wg sync.WaitGroup
+	for _, f := range p.Forwarders() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Close()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,195 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// probeTimeout bounds each gst-inspect-1.0 call; the first one may build the plugin registry.
+const probeTimeout = 60 * time.Second
+
+// Element is an installed GStreamer element and the version of the plugin providing it.
+type Element struct {
+	Name    string `json:"name"`
+	Plugin  string `json:"plugin,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// ProbeResult describes the GStreamer installation the KVS pipelines run on.
+type ProbeResult struct {
+	Version  string    `json:"version,omitempty"` // GStreamer core version
+	Elements []Element `json:"elements,omitempty"`
+	Missing  []string  `json:"missing,omitempty"`
+}
+
+// probeResult is what ProbeGStreamer found, nil if it did not inspect GStreamer.
+var probeResult atomic.Pointer[ProbeResult]
+
+// What the forwarders write to, see Backend
+const (
+	BackendExec      = "gst-launch" // a gst-launch-1.0 process per pipeline
+	BackendInProcess = "inprocess"  // PIPELINE_BACKEND=inprocess in a build with -tags gst
+	BackendFile      = "file"       // local files, FORWARDER_MODE=file or the development fallback
+)
+
+// Backend returns what the forwarders write to. Streams assuming a role or carrying audio
+// use gst-launch-1.0 with the in-process backend.
+func Backend() string {
+	switch {
+	case forwarderMode() == "file" || fileSinkFallback.Load():
+		return BackendFile
+	case inProcessPipeline() && inProcessBuild:
+		return BackendInProcess
+	default:
+		return BackendExec
+	}
+}
+
+// GStreamer returns the GStreamer installation found by ProbeGStreamer, nil if it was not
+// inspected (GSTREAMER_PROBE=off, FORWARDER_MODE=file) or not installed.
+func GStreamer() *ProbeResult {
+	return probeResult.Load()
+}
+
+// requiredElements returns the elements of the video pipeline (with the transcode branch
+// when enabled) and, if audio is set, of the audio branches.
+func requiredElements(audio bool) []string {
+	elements := []string{"fdsrc", "flvdemux", "h264parse", "queue", "kvssink"}
+	if transcodeConfigFromEnv() != nil {
+		elements = append(elements, "avdec_h264", "videoscale", "videoconvert", "x264enc")
+	}
+	if audio {
+		elements = append(elements, "aacparse", "capssetter")
+	}
+	return elements
+}
+
+// Probe inspects the elements the KVS pipelines need. It returns an error if
+// gst-launch-1.0 or gst-inspect-1.0 is not installed at all.
+func Probe(audio bool) (ProbeResult, error) {
+	var result ProbeResult
+	if _, err := exec.LookPath("gst-launch-1.0"); err != nil {
+		return result, err
+	}
+	inspect, err := exec.LookPath("gst-inspect-1.0")
+	if err != nil {
+		return result, err
+	}
+
+	if out, err := runInspect(inspect, "--version"); err == nil {
+		for line := range strings.Lines(string(out)) {
+			if version, ok := strings.CutPrefix(line, "GStreamer "); ok {
+				result.Version = strings.TrimSpace(version)
+			}
+		}
+	}
+	for _, name := range requiredElements(audio) {
+		out, err := runInspect(inspect, name)
+		if err != nil {
+			result.Missing = append(result.Missing, name)
+			continue
+		}
+		result.Elements = append(result.Elements, parseElement(name, out))
+	}
+	return result, nil
+}
+
+// runInspect runs gst-inspect-1.0 with an argument.
+func runInspect(inspect, arg string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, inspect, arg).Output()
+}
+
+// parseElement reads the plugin name and version from the "Plugin Details" of
+// gst-inspect-1.0 output.
+func parseElement(name string, out []byte) Element {
+	element := Element{Name: name}
+	inPlugin := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, " ") {
+			inPlugin = strings.HasPrefix(line, "Plugin Details")
+			continue
+		}
+		if !inPlugin {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Name":
+			element.Plugin = fields[1]
+		case "Version":
+			element.Version = fields[1]
+		}
+	}
+	return element
+}
+
+// ProbeGStreamer checks at startup that the KVS pipelines can run, so that a broken image
+// fails when it starts rather than when the first camera connects. It returns an error if
+// GStreamer or any element is missing, except on a development machine (Windows or macOS
+// without FORWARDER_MODE), where the forwarders fall back to the file sink. GSTREAMER_PROBE
+// sets the policy:
+//
+//	auto  as above; the default
+//	fail  return an error on development machines too
+//	off   no probe: the pipelines fail when they start if GStreamer is missing
+//
+// It returns nil in FORWARDER_MODE=file, which writes local files without probing.
+func ProbeGStreamer(audio bool) error {
+	if forwarderMode() == "file" {
+		return nil
+	}
+	policy := os.Getenv("GSTREAMER_PROBE")
+	switch policy {
+	case "", "auto", "fail":
+	case "off":
+		return nil
+	case "fallback":
+		log.Printf("[KVS] ⚠️  GSTREAMER_PROBE=fallback is no longer supported, set FORWARDER_MODE=file to write local files")
+	default:
+		log.Printf("[KVS] ⚠️  Unknown GSTREAMER_PROBE %q, using auto", policy)
+	}
+
+	result, err := Probe(audio)
+	var problem error
+	switch {
+	case err != nil:
+		problem = fmt.Errorf("GStreamer is not installed: %w", err)
+	case len(result.Missing) > 0:
+		problem = fmt.Errorf("GStreamer elements not found: %s", strings.Join(result.Missing, ", "))
+	}
+	if problem != nil {
+		if policy != "fail" && developmentFallback() {
+			log.Printf("[KVS] ⚠️  %v, writing to the file sink in %s instead of KVS (local development)", problem, fileSinkDir())
+			fileSinkFallback.Store(true)
+			return nil
+		}
+		return fmt.Errorf("%w (FORWARDER_MODE=file writes local files instead)", problem)
+	}
+	probeResult.Store(&result)
+
+	versions := make([]string, len(result.Elements))
+	for i, element := range result.Elements {
+		versions[i] = element.Name
+		if element.Version != "" {
+			versions[i] += " " + element.Version
+		}
+	}
+	log.Printf("[KVS] GStreamer %s: %s", result.Version, strings.Join(versions, ", "))
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import "os"
+
+// interruptProcess asks the GStreamer process to shut down gracefully.
+func interruptProcess(p *os.Process) error {
+	return p.Signal(os.Interrupt)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import "os"
+
+// interruptProcess asks the GStreamer process to shut down.
+// Windows cannot deliver SIGINT to a child process, so the process is killed instead;
+// stdin has already been closed at this point so the pipeline has seen end-of-stream.
+func interruptProcess(p *os.Process) error {
+	return p.Kill()
+}
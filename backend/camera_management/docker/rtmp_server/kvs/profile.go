@@ -0,0 +1,90 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Pipeline profiles (pipeline_profile, PIPELINE_PROFILE)
+const (
+	ProfileDefault    = "default"     // 10 MiB queues, kvssink default latency
+	ProfileLowLatency = "low_latency" // small queues and max-latency, for live monitoring
+	ProfileResilient  = "resilient"   // large queues and max-latency, for bursty or lossy uplinks
+)
+
+// pipelineLimits are the sizes of the pipeline queues and the kvssink max-latency.
+// A zero queue limit is unlimited, a zero max-latency leaves the kvssink default.
+type pipelineLimits struct {
+	queueMaxBytes     int
+	queueMaxBuffers   int
+	queueMaxTimeMs    int
+	maxLatencySeconds int
+}
+
+// pipelineProfiles are the limits of each profile.
+var pipelineProfiles = map[string]pipelineLimits{
+	ProfileDefault:    {queueMaxBytes: 10 << 20},
+	ProfileLowLatency: {queueMaxBytes: 2 << 20, queueMaxTimeMs: 1000, maxLatencySeconds: 20},
+	ProfileResilient:  {queueMaxBytes: 64 << 20, maxLatencySeconds: 120},
+}
+
+// validProfile reports whether name is a pipeline profile ("" is the default).
+func validProfile(name string) bool {
+	_, ok := pipelineProfiles[name]
+	return ok || name == ""
+}
+
+// profileFromEnv reads PIPELINE_PROFILE, falling back to the default profile.
+func profileFromEnv() string {
+	profile := os.Getenv("PIPELINE_PROFILE")
+	if !validProfile(profile) {
+		log.Printf("[KVS] ⚠️  Invalid PIPELINE_PROFILE %q, using %s", profile, ProfileDefault)
+		return ""
+	}
+	return profile
+}
+
+// pipelineLimits returns the limits of the profile of the configuration with its
+// queue_max_bytes, queue_max_buffers, queue_max_time_ms and max_latency_seconds applied.
+func (c StreamConfig) pipelineLimits() pipelineLimits {
+	limits, ok := pipelineProfiles[c.PipelineProfile]
+	if !ok {
+		// Unset, or an unknown profile from the stream registry
+		limits = pipelineProfiles[ProfileDefault]
+	}
+	if c.QueueMaxBytes > 0 {
+		limits.queueMaxBytes = c.QueueMaxBytes
+	}
+	if c.QueueMaxBuffers > 0 {
+		limits.queueMaxBuffers = c.QueueMaxBuffers
+	}
+	if c.QueueMaxTimeMs > 0 {
+		limits.queueMaxTimeMs = c.QueueMaxTimeMs
+	}
+	if c.MaxLatencySeconds > 0 {
+		limits.maxLatencySeconds = c.MaxLatencySeconds
+	}
+	return limits
+}
+
+// queueElement returns the queue element with the limits of the configuration.
+func (c StreamConfig) queueElement() []string {
+	limits := c.pipelineLimits()
+	return []string{"queue",
+		"max-size-buffers=" + strconv.Itoa(limits.queueMaxBuffers),
+		"max-size-time=" + strconv.FormatInt(int64(time.Duration(limits.queueMaxTimeMs)*time.Millisecond), 10),
+		"max-size-bytes=" + strconv.Itoa(limits.queueMaxBytes),
+	}
+}
+
+func (l pipelineLimits) String() string {
+	s := fmt.Sprintf("queue %d bytes, %d buffers, %dms", l.queueMaxBytes, l.queueMaxBuffers, l.queueMaxTimeMs)
+	if l.maxLatencySeconds > 0 {
+		s += fmt.Sprintf(", max-latency %ds", l.maxLatencySeconds)
+	}
+	return s
+}
@@ -0,0 +1,208 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+// Longest chain of source_profile references followed
+const maxProfileDepth = 5
+
+// profileSource reads a profile of the shared config files (~/.aws/credentials and
+// ~/.aws/config): static keys, or a role assumed with the keys of a source_profile. The
+// files are re-read on every refresh.
+type profileSource struct {
+	profile         string
+	credentialsFile string
+	configFile      string
+}
+
+// profileSourceFromEnv configures the source from AWS_PROFILE (default "default"),
+// AWS_SHARED_CREDENTIALS_FILE and AWS_CONFIG_FILE.
+func profileSourceFromEnv() *profileSource {
+	src := &profileSource{
+		profile:         os.Getenv("AWS_PROFILE"),
+		credentialsFile: os.Getenv("AWS_SHARED_CREDENTIALS_FILE"),
+		configFile:      os.Getenv("AWS_CONFIG_FILE"),
+	}
+	if src.profile == "" {
+		src.profile = "default"
+	}
+	home, _ := os.UserHomeDir()
+	if src.credentialsFile == "" && home != "" {
+		src.credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	if src.configFile == "" && home != "" {
+		src.configFile = filepath.Join(home, ".aws", "config")
+	}
+	return src
+}
+
+// exists reports whether the profile is defined in the files.
+func (s *profileSource) exists() bool {
+	profiles, err := s.load()
+	return err == nil && profiles[s.profile] != nil
+}
+
+func (s *profileSource) name() string {
+	return "shared config profile " + s.profile
+}
+
+func (s *profileSource) checkInterval() time.Duration {
+	// Assumed role sessions default to a 1 hour lifetime
+	return 5 * time.Minute
+}
+
+func (s *profileSource) fetch() (*credentials, error) {
+	profiles, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return s.resolve(profiles, s.profile, 0)
+}
+
+// resolve returns the credentials of a profile, following source_profile.
+func (s *profileSource) resolve(profiles map[string]map[string]string, name string, depth int) (*credentials, error) {
+	p := profiles[name]
+	if p == nil {
+		return nil, fmt.Errorf("profile %s not found in %s or %s", name, s.credentialsFile, s.configFile)
+	}
+
+	roleARN := p["role_arn"]
+	if roleARN == "" || depth > 0 && p["source_profile"] == name {
+		if p["aws_access_key_id"] == "" || p["aws_secret_access_key"] == "" {
+			return nil, fmt.Errorf("profile %s has no aws_access_key_id/aws_secret_access_key (only static keys and role_arn with source_profile are supported)", name)
+		}
+		return &credentials{
+			AccessKeyID:     p["aws_access_key_id"],
+			SecretAccessKey: p["aws_secret_access_key"],
+			SessionToken:    p["aws_session_token"],
+		}, nil
+	}
+
+	if p["source_profile"] == "" {
+		return nil, fmt.Errorf("profile %s has a role_arn without a source_profile", name)
+	}
+	if depth >= maxProfileDepth {
+		return nil, fmt.Errorf("profile %s: too many nested source_profile references", name)
+	}
+	source, err := s.resolve(profiles, p["source_profile"], depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	region := p["region"]
+	if region == "" {
+		region = stsRegion()
+	}
+	session := p["role_session_name"]
+	if session == "" {
+		session = fmt.Sprintf("rtmp-kvs-%d", time.Now().Unix())
+	}
+	var duration time.Duration
+	if v := p["duration_seconds"]; v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("profile %s has an invalid duration_seconds %q", name, v)
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	sts := awsapi.NewSTS(region)
+	sts.Credentials = awsapi.StaticCredentials{
+		AccessKeyID:     source.AccessKeyID,
+		SecretAccessKey: source.SecretAccessKey,
+		SessionToken:    source.SessionToken,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	role, err := sts.AssumeRole(ctx, roleARN, session, p["external_id"], duration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assume %s for profile %s: %w", roleARN, name, err)
+	}
+	return &credentials{
+		AccessKeyID:     role.AccessKeyID,
+		SecretAccessKey: role.SecretAccessKey,
+		SessionToken:    role.SessionToken,
+		Expiration:      role.Expiration,
+	}, nil
+}
+
+// load reads the profiles of both files. Keys of the credentials file take precedence.
+func (s *profileSource) load() (map[string]map[string]string, error) {
+	profiles := make(map[string]map[string]string)
+	found := false
+	for _, file := range []struct {
+		path   string
+		config bool
+	}{{s.configFile, true}, {s.credentialsFile, false}} {
+		if file.path == "" {
+			continue
+		}
+		err := parseProfiles(file.path, file.config, profiles)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("no shared config files (%s, %s)", s.credentialsFile, s.configFile)
+	}
+	return profiles, nil
+}
+
+// parseProfiles adds the profiles of an INI file. Sections of the config file are named
+// "profile <name>", except "default".
+func parseProfiles(path string, config bool, profiles map[string]map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var section map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if config && name != "default" {
+				var ok bool
+				if name, ok = strings.CutPrefix(name, "profile "); !ok {
+					section = nil // sso-session and other sections
+					continue
+				}
+				name = strings.TrimSpace(name)
+			}
+			if profiles[name] == nil {
+				profiles[name] = make(map[string]string)
+			}
+			section = profiles[name]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section == nil {
+			continue
+		}
+		section[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package kvs
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPipelineLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		config StreamConfig
+		want   pipelineLimits
+	}{
+		{
+			name: "default",
+			want: pipelineLimits{queueMaxBytes: 10 << 20},
+		},
+		{
+			name:   "low latency",
+			config: StreamConfig{PipelineProfile: ProfileLowLatency},
+			want:   pipelineLimits{queueMaxBytes: 2 << 20, queueMaxTimeMs: 1000, maxLatencySeconds: 20},
+		},
+		{
+			name:   "resilient",
+			config: StreamConfig{PipelineProfile: ProfileResilient},
+			want:   pipelineLimits{queueMaxBytes: 64 << 20, maxLatencySeconds: 120},
+		},
+		{
+			name:   "unknown profile",
+			config: StreamConfig{PipelineProfile: "realtime"},
+			want:   pipelineLimits{queueMaxBytes: 10 << 20},
+		},
+		{
+			name: "overrides",
+			config: StreamConfig{
+				PipelineProfile:   ProfileLowLatency,
+				QueueMaxBytes:     1 << 20,
+				QueueMaxBuffers:   30,
+				QueueMaxTimeMs:    500,
+				MaxLatencySeconds: 10,
+			},
+			want: pipelineLimits{queueMaxBytes: 1 << 20, queueMaxBuffers: 30, queueMaxTimeMs: 500, maxLatencySeconds: 10},
+		},
+		{
+			name:   "partial override keeps the profile",
+			config: StreamConfig{PipelineProfile: ProfileResilient, QueueMaxBuffers: 100},
+			want:   pipelineLimits{queueMaxBytes: 64 << 20, queueMaxBuffers: 100, maxLatencySeconds: 120},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.pipelineLimits(); got != tt.want {
+				t.Errorf("pipelineLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueElement(t *testing.T) {
+	config := StreamConfig{PipelineProfile: ProfileLowLatency, QueueMaxBuffers: 30}
+	want := []string{"queue", "max-size-buffers=30", "max-size-time=1000000000", "max-size-bytes=2097152"}
+	if got := config.queueElement(); !slices.Equal(got, want) {
+		t.Errorf("queueElement() = %v, want %v", got, want)
+	}
+}
+
+func TestProfileFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"default", ProfileDefault},
+		{"low_latency", ProfileLowLatency},
+		{"resilient", ProfileResilient},
+		{"fast", ""},
+		{"Low_Latency", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("PIPELINE_PROFILE", tt.value)
+		if got := profileFromEnv(); got != tt.want {
+			t.Errorf("PIPELINE_PROFILE=%q: %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/events"
+)
+
+// paramChange tracks the parameter sets of au against those the pipeline was configured
+// with. It returns the access unit to write and whether the pipeline must be
+// reconfigured before writing it.
+//
+// Cameras switching between day/night profiles or resolutions send new parameter sets,
+// either in-band with the next IDR (MPEG-TS) or as a separate sequence header ahead of
+// it (RTMP). kvssink cannot change the codec private data of a running stream, so the
+// new sets are held back until the IDR that activates them, and that IDR starts a new
+// pipeline. Must be called with the mutex held.
+func (f *Forwarder) paramChange(au [][]byte) ([][]byte, bool) {
+	if f.mux.sps == nil || f.mux.pps == nil {
+		// Not configured yet: the muxer takes the first parameter sets as they come
+		return au, false
+	}
+
+	var sps, pps []byte
+	idr := false
+	rest := make([][]byte, 0, len(au))
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			sps = nalu
+		case h264.NALUTypePPS:
+			pps = nalu
+		case h264.NALUTypeIDR:
+			idr = true
+			rest = append(rest, nalu)
+		default:
+			rest = append(rest, nalu)
+		}
+	}
+	if sps != nil {
+		f.pendingSPS = nil
+		if !bytes.Equal(sps, f.mux.sps) {
+			f.pendingSPS = sps
+		}
+	}
+	if pps != nil {
+		f.pendingPPS = nil
+		if !bytes.Equal(pps, f.mux.pps) {
+			f.pendingPPS = pps
+		}
+	}
+	if f.pendingSPS == nil && f.pendingPPS == nil {
+		return au, false
+	}
+	if !idr {
+		// Pictures before the IDR still belong to the old parameter sets
+		return rest, false
+	}
+
+	sps, pps = f.mux.sps, f.mux.pps
+	if f.pendingSPS != nil {
+		sps = f.pendingSPS
+	}
+	if f.pendingPPS != nil {
+		pps = f.pendingPPS
+	}
+	f.pendingSPS, f.pendingPPS = nil, nil
+	return append([][]byte{sps, pps}, rest...), true
+}
+
+// reconfigure records a parameter change. The caller then replaces the pipeline without
+// waiting for the restart backoff: the old pipeline gets an EOS, so kvssink completes the
+// current fragment, and a new one is started for the IDR carrying the new sets. Must be
+// called with the mutex held.
+func (f *Forwarder) reconfigure(sps []byte) {
+	from, to := resolution(f.mux.sps), resolution(sps)
+	if from != to {
+		log.Printf("[KVS] Resolution of %s changed from %s to %s, restarting pipeline", f.streamName, from, to)
+	} else {
+		log.Printf("[KVS] Parameter sets of %s changed (%s), restarting pipeline", f.streamName, to)
+	}
+	f.paramChanges++
+
+	events.Emit(events.Event{
+		Type:       events.PipelineRestarted,
+		StreamName: f.streamName,
+		Detail: map[string]any{
+			"reason":          "parameter_change",
+			"from_resolution": from,
+			"to_resolution":   to,
+		},
+	})
+}
+
+// resolution returns the picture size of an SPS for logs and events.
+func resolution(sps []byte) string {
+	var parsed h264.SPS
+	if parsed.Unmarshal(sps) != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dx%d", parsed.Width(), parsed.Height())
+}
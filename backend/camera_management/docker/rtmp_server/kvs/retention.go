@@ -0,0 +1,72 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"rtmp_kvs/awsapi"
+)
+
+// Retention limit of a KVS stream (10 years)
+const maxRetentionHours = 87600
+
+// SetRetention changes the data retention of the KVS stream (all shards of a sharded
+// stream) to hours and returns the previous value. The stream is updated if it exists;
+// the setting also applies when kvssink creates the stream later. Fragments already
+// stored keep the retention they were ingested with.
+func (f *Forwarder) SetRetention(ctx context.Context, hours int) (int, error) {
+	if hours < 1 || hours > maxRetentionHours {
+		return 0, fmt.Errorf("retention must be between 1 and %d hours", maxRetentionHours)
+	}
+	if f.FileSink() {
+		return 0, fmt.Errorf("stream %s is written to local files", f.streamName)
+	}
+
+	client := awsapi.NewKinesisVideo(f.awsRegion)
+	f.mutex.Lock()
+	config := defaultStreamConfig().Merge(f.config)
+	previous := config.RetentionHours
+	f.config.RetentionHours = hours
+	if f.role != nil {
+		// Streams of an assumed role may live in another account
+		client.Credentials = f.role.credentials()
+	}
+	f.mutex.Unlock()
+
+	streams := config.Shards
+	if len(streams) == 0 {
+		streams = []string{f.streamName}
+	}
+	for i, stream := range streams {
+		current, err := updateRetention(ctx, client, stream, hours)
+		if err != nil {
+			return previous, err
+		}
+		if i == 0 && current > 0 {
+			previous = current
+		}
+	}
+	return previous, nil
+}
+
+// updateRetention changes the retention of one stream and returns the previous value, 0
+// if the stream does not exist yet.
+func updateRetention(ctx context.Context, client *awsapi.KinesisVideo, stream string, hours int) (int, error) {
+	info, err := client.DescribeStream(ctx, stream)
+	if awsapi.IsCode(err, "ResourceNotFoundException") {
+		log.Printf("[KVS] Retention of %s set to %d hours (applied when the stream is created)", stream, hours)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to describe %s: %w", stream, err)
+	}
+	if change := hours - info.DataRetentionInHours; change != 0 {
+		if err := client.UpdateDataRetention(ctx, stream, info.Version, change); err != nil {
+			return info.DataRetentionInHours, fmt.Errorf("failed to update the retention of %s: %w", stream, err)
+		}
+	}
+	log.Printf("[KVS] Retention of %s changed from %d to %d hours", stream, info.DataRetentionInHours, hours)
+	return info.DataRetentionInHours, nil
+}
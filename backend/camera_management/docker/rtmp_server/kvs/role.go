@@ -0,0 +1,217 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+// roleRefreshWindow is how long before expiry the credentials of an assumed role are renewed.
+const roleRefreshWindow = 15 * time.Minute
+
+// roleCredentials holds the credentials of a per-stream IAM role. They are written to a file
+// that kvssink reads through its credential-path property; the file is rewritten before the
+// session expires, so a running pipeline picks up new keys without a restart.
+type roleCredentials struct {
+	roleARN    string
+	externalID string
+	session    string
+	path       string
+	sts        *awsapi.STS
+
+	mutex      sync.Mutex
+	expiration time.Time
+	current    awsapi.Credentials
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newRoleCredentials creates the credentials of a stream's role and renews them in the
+// background until ctx is cancelled or close is called.
+func newRoleCredentials(ctx context.Context, streamName, region string, config StreamConfig) *roleCredentials {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &roleCredentials{
+		roleARN:    config.RoleARN,
+		externalID: config.ExternalID,
+		session:    roleSessionName(streamName),
+		path:       filepath.Join(roleCredentialsDir(), streamName+".credentials"),
+		sts:        awsapi.NewSTS(region),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go r.keepFresh(ctx)
+	return r
+}
+
+// matches reports whether r holds the credentials of the role configured in config.
+func (r *roleCredentials) matches(config StreamConfig) bool {
+	return r.roleARN == config.RoleARN && r.externalID == config.ExternalID
+}
+
+// refresh assumes the role when the current credentials are missing or about to expire.
+func (r *roleCredentials) refresh(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Until(r.expiration) > roleRefreshWindow {
+		return nil
+	}
+
+	role, err := r.sts.AssumeRole(ctx, r.roleARN, r.session, r.externalID, roleSessionDuration())
+	if err != nil {
+		return fmt.Errorf("failed to assume role %s: %w", r.roleARN, err)
+	}
+	if err := writeCredentialFile(r.path, role); err != nil {
+		return err
+	}
+	r.expiration = role.Expiration
+	r.current = role.Credentials
+
+	log.Printf("[KVS] ✅ Assumed role %s (expires %s)", r.roleARN, role.Expiration.Format(time.RFC3339))
+	return nil
+}
+
+// credentials returns the current credentials of the role, for API calls on the stream.
+func (r *roleCredentials) credentials() awsapi.CredentialsProvider {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return awsapi.StaticCredentials(r.current)
+}
+
+// keepFresh renews the credentials until ctx is cancelled, then removes the file.
+func (r *roleCredentials) keepFresh(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			refreshCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+			if err := r.refresh(refreshCtx); err != nil {
+				log.Printf("[KVS] ⚠️  %v", err)
+			}
+			cancel()
+		case <-ctx.Done():
+			os.Remove(r.path)
+			return
+		}
+	}
+}
+
+// close stops the background renewal and waits until the credentials file is removed.
+func (r *roleCredentials) close() {
+	r.cancel()
+	<-r.done
+}
+
+// writeCredentialFile writes the credentials in the format of kvssink's credential-path:
+//
+//	CREDENTIALS <access key id> <expiration> <secret access key> <session token>
+//
+// The file is replaced atomically so kvssink never reads a partial file.
+func writeCredentialFile(path string, role *awsapi.AssumedRole) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create credentials directory: %w", err)
+	}
+	content := fmt.Sprintf("CREDENTIALS %s %s %s %s\n",
+		role.AccessKeyID, role.Expiration.UTC().Format("2006-01-02T15:04:05Z"), role.SecretAccessKey, role.SessionToken)
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		return fmt.Errorf("failed to write credentials file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write credentials file: %w", err)
+	}
+	return nil
+}
+
+// assumeRole prepares the credentials of the stream's IAM role, if one is configured,
+// before a pipeline start. Must be called with the mutex held.
+func (f *Forwarder) assumeRole(config StreamConfig) error {
+	if f.role != nil && !f.role.matches(config) {
+		f.role.close()
+		f.role = nil
+	}
+	if config.RoleARN == "" {
+		return nil
+	}
+	if f.role == nil {
+		f.role = newRoleCredentials(f.ctx, f.streamName, f.awsRegion, config)
+	}
+
+	ctx, cancel := context.WithTimeout(f.ctx, 15*time.Second)
+	defer cancel()
+	return f.role.refresh(ctx)
+}
+
+// pipelineEnv returns the environment of a gst-launch-1.0 process. With an assumed role
+// the task credentials are removed, since kvssink prefers them over credential-path.
+// Must be called with the mutex held.
+func (f *Forwarder) pipelineEnv() []string {
+	env := os.Environ()
+	if f.role == nil {
+		return env
+	}
+	filtered := env[:0]
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		switch name {
+		case "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN":
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	return filtered
+}
+
+// credentialArgs returns the kvssink properties selecting the assumed role's credentials.
+// Must be called with the mutex held.
+func (f *Forwarder) credentialArgs() []string {
+	if f.role == nil {
+		return nil
+	}
+	return []string{"credential-path=" + f.role.path}
+}
+
+// roleCredentialsDir reads ROLE_CREDENTIALS_DIR (default: rtmp-kvs-credentials in the
+// temporary directory).
+func roleCredentialsDir() string {
+	if dir := os.Getenv("ROLE_CREDENTIALS_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "rtmp-kvs-credentials")
+}
+
+// roleSessionDuration reads ROLE_SESSION_DURATION (seconds, default 3600).
+func roleSessionDuration() time.Duration {
+	seconds := envInt("ROLE_SESSION_DURATION", 3600)
+	if seconds < 900 {
+		log.Printf("[KVS] ⚠️  ROLE_SESSION_DURATION must be at least 900 seconds, using 900")
+		seconds = 900
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+var sessionNameInvalid = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// roleSessionName returns the STS session name for a stream (visible in CloudTrail).
+func roleSessionName(streamName string) string {
+	name := "rtmp-kvs-" + sessionNameInvalid.ReplaceAllString(streamName, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
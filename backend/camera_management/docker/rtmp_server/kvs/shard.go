@@ -0,0 +1,160 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/events"
+)
+
+// Shard selection strategies (StreamConfig.ShardStrategy)
+const (
+	ShardRoundRobin  = "round_robin"  // the next shard in order
+	ShardLeastLoaded = "least_loaded" // the shard that received the fewest bytes
+)
+
+// shardUsage tracks the KVS streams used as shards by all forwarders, so that forwarders
+// of cameras aggregated over the same shards do not write to a stream at the same time.
+var shardUsage = struct {
+	sync.Mutex
+	writers map[string]int    // forwarders writing to the stream
+	bytes   map[string]uint64 // bytes written in completed windows
+}{writers: make(map[string]int), bytes: make(map[string]uint64)}
+
+// shardState is the shard a sharded forwarder currently writes to.
+type shardState struct {
+	shards   []string
+	window   time.Duration
+	strategy string
+
+	name   string // current shard, empty while stopped or not sharded
+	index  int    // of the current or last shard, -1 before the first
+	start  time.Time
+	frames int
+	bytes  uint64
+
+	switches int
+}
+
+// target returns the KVS stream the pipeline writes to: the current shard of a sharded
+// stream, the stream itself otherwise. Must be called with the mutex held.
+func (f *Forwarder) target() string {
+	if f.shard.name != "" {
+		return f.shard.name
+	}
+	return f.streamName
+}
+
+// openShard selects the shard of a new window when the stream is sharded. Must be
+// called with the mutex held, before the pipeline starts.
+func (f *Forwarder) openShard(config StreamConfig) {
+	if len(config.Shards) == 0 || f.audio != nil || f.shard.name != "" {
+		return
+	}
+	if f.shard.shards == nil {
+		f.shard.index = -1
+	}
+	f.shard.shards = config.Shards
+	f.shard.window = time.Duration(config.ShardWindowSeconds) * time.Second
+	f.shard.strategy = config.ShardStrategy
+	if f.shard.strategy != ShardLeastLoaded {
+		f.shard.strategy = ShardRoundRobin
+	}
+
+	shardUsage.Lock()
+	f.shard.index = pickShard(f.shard.shards, f.shard.index, f.shard.strategy)
+	f.shard.name = f.shard.shards[f.shard.index]
+	shardUsage.writers[f.shard.name]++
+	shardUsage.Unlock()
+	f.shard.start = time.Now()
+	f.shard.frames, f.shard.bytes = 0, 0
+
+	log.Printf("[KVS] Writing %s to shard %s (%s, window %s)", f.streamName, f.shard.name, f.shard.strategy, f.shard.window)
+	events.Emit(events.Event{
+		Type:       events.ShardOpened,
+		StreamName: f.streamName,
+		Detail: map[string]any{
+			"shard":        f.shard.name,
+			"region":       f.awsRegion,
+			"strategy":     f.shard.strategy,
+			"window_start": f.shard.start,
+		},
+	})
+}
+
+// closeShard ends the window of the current shard. Must be called with the mutex held.
+func (f *Forwarder) closeShard() {
+	if f.shard.name == "" {
+		return
+	}
+	shardUsage.Lock()
+	shardUsage.writers[f.shard.name]--
+	shardUsage.bytes[f.shard.name] += f.shard.bytes
+	shardUsage.Unlock()
+
+	events.Emit(events.Event{
+		Type:       events.ShardClosed,
+		StreamName: f.streamName,
+		Detail: map[string]any{
+			"shard":        f.shard.name,
+			"region":       f.awsRegion,
+			"window_start": f.shard.start,
+			"window_end":   time.Now(),
+			"frames":       f.shard.frames,
+			"bytes":        f.shard.bytes,
+		},
+	})
+	f.shard.name = ""
+}
+
+// pickShard returns the index of the next shard after last. Shards other forwarders
+// write to are skipped while a free one exists. Must be called with shardUsage locked.
+func pickShard(shards []string, last int, strategy string) int {
+	best := -1
+	for i := range shards {
+		// Candidates in round-robin order, starting after the last shard
+		n := (last + 1 + i) % len(shards)
+		switch {
+		case best < 0:
+			best = n
+		case shardUsage.writers[shards[n]] < shardUsage.writers[shards[best]]:
+			best = n
+		case shardUsage.writers[shards[n]] > shardUsage.writers[shards[best]]:
+		case strategy == ShardLeastLoaded && shardUsage.bytes[shards[n]] < shardUsage.bytes[shards[best]]:
+			best = n
+		}
+	}
+	return best
+}
+
+// shardDue reports whether the current window is over and au starts the next one.
+// Must be called with the mutex held.
+func (f *Forwarder) shardDue(au [][]byte) bool {
+	return f.shard.name != "" && len(f.shard.shards) > 1 && f.shard.window > 0 &&
+		time.Since(f.shard.start) >= f.shard.window && h264.IsRandomAccess(au)
+}
+
+// switchShard closes the shard at a keyframe. The caller then replaces the pipeline: a new
+// one is started for the next shard while the old one completes its last fragment. Must
+// be called with the mutex held.
+func (f *Forwarder) switchShard() {
+	f.gops.flush()
+	f.closeShard()
+	f.shard.switches++
+}
+
+// countShardFrame accounts a frame written to the current shard. Must be called with the
+// mutex held.
+func (f *Forwarder) countShardFrame(au [][]byte) {
+	if f.shard.name == "" {
+		return
+	}
+	f.shard.frames++
+	for _, nalu := range au {
+		f.shard.bytes += uint64(len(nalu))
+	}
+}
@@ -0,0 +1,113 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"log"
+	"time"
+)
+
+// StreamState is the runtime state of a forwarder kept across task restarts (package
+// state): the counters behind the statistics and the position of a backfill.
+type StreamState struct {
+	StreamName         string            `json:"stream_name"`
+	Region             string            `json:"region"`
+	Restarts           int               `json:"restarts"`
+	ParamChanges       int               `json:"parameter_changes"`
+	FramesForwarded    uint64            `json:"frames_forwarded"`
+	SkippedFrames      uint64            `json:"skipped_frames"`
+	AckCounts          map[string]uint64 `json:"ack_counts,omitempty"`
+	LastPersistedTime  time.Time         `json:"last_persisted_time,omitzero"` // producer timestamp of the fragment
+	LastFragmentNumber string            `json:"last_fragment_number,omitempty"`
+	Backfill           *BackfillState    `json:"backfill,omitempty"`
+}
+
+// BackfillState is the position of a backfill in the offline streaming type.
+type BackfillState struct {
+	Source string    `json:"source,omitempty"` // footage being backfilled, e.g. the replayed file
+	Start  time.Time `json:"start"`            // original time of its first frame
+	// Original time of the last frame written to the pipeline; frames after
+	// LastPersistedTime may not have reached KVS
+	Written time.Time `json:"written,omitzero"`
+}
+
+// Resume returns the original time from which the backfill of source starting at start
+// continues: the start of the last fragment KVS persisted, whose frames up to the next
+// keyframe are in the stream. It returns false if the state (which may be nil) is of
+// other footage or nothing was persisted.
+func (s *StreamState) Resume(source string, start time.Time) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	b := s.Backfill
+	if b == nil || b.Source != source || !b.Start.Equal(start) || s.LastPersistedTime.Before(start) {
+		return time.Time{}, false
+	}
+	return s.LastPersistedTime, true
+}
+
+// SetBackfillSource names the footage of the backfill and the original time of its first
+// frame, recorded with the position in the state. A resumed backfill passes SetReplayStart
+// the time of its first frame written instead.
+func (f *Forwarder) SetBackfillSource(source string, start time.Time) {
+	f.mutex.Lock()
+	f.offline.source, f.offline.origin = source, start
+	f.mutex.Unlock()
+}
+
+// State returns the runtime state of the forwarder to keep across restarts.
+func (f *Forwarder) State() StreamState {
+	f.mutex.Lock()
+	s := StreamState{
+		StreamName:      f.streamName,
+		Region:          f.awsRegion,
+		Restarts:        f.restartCount,
+		ParamChanges:    f.paramChanges,
+		FramesForwarded: f.frameCount,
+		SkippedFrames:   f.skippedFrames,
+	}
+	if o := &f.offline; !o.start.IsZero() {
+		s.Backfill = &BackfillState{Source: o.source, Start: o.start}
+		if !o.origin.IsZero() {
+			s.Backfill.Start = o.origin
+		}
+		if o.written {
+			s.Backfill.Written = o.start.Add(o.last - o.first)
+		}
+	}
+	f.mutex.Unlock()
+
+	acks := f.AckStats()
+	s.AckCounts = acks.Counts
+	s.LastPersistedTime = acks.LastPersistedTime
+	s.LastFragmentNumber = acks.LastFragmentNumber
+	return s
+}
+
+// RestoreState continues the counters of a previous task from its saved state, so the
+// statistics do not start from zero after a task is replaced. Call before the forwarder
+// starts; the backfill position is used by the replay subcommand (StreamState.Resume).
+func (f *Forwarder) RestoreState(s StreamState) {
+	f.mutex.Lock()
+	f.restartCount += s.Restarts
+	f.paramChanges += s.ParamChanges
+	f.frameCount += s.FramesForwarded
+	f.skippedFrames += s.SkippedFrames
+	f.mutex.Unlock()
+
+	t := &f.acks
+	t.mutex.Lock()
+	if t.stats.Counts == nil {
+		t.stats.Counts = make(map[string]uint64)
+	}
+	for event, n := range s.AckCounts {
+		t.stats.Counts[event] += n
+	}
+	if s.LastPersistedTime.After(t.stats.LastPersistedTime) {
+		t.stats.LastPersistedTime = s.LastPersistedTime
+		t.stats.LastFragmentNumber = s.LastFragmentNumber
+	}
+	t.mutex.Unlock()
+
+	log.Printf("[KVS] Restored state of %s: %d restarts, %d frames forwarded, last persisted %s",
+		f.streamName, s.Restarts, s.FramesForwarded, s.LastPersistedTime.Format(time.RFC3339))
+}
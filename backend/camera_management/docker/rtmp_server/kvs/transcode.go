@@ -0,0 +1,82 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// transcodeConfig configures the optional decode/scale/encode branch in front of kvssink.
+type transcodeConfig struct {
+	maxWidth         int
+	maxHeight        int
+	bitrateKbps      int
+	keyframeInterval int // frames
+}
+
+// transcodeConfigFromEnv reads TRANSCODE=true and the TRANSCODE_* limits.
+// It returns nil when transcoding is disabled.
+func transcodeConfigFromEnv() *transcodeConfig {
+	if enabled, _ := strconv.ParseBool(os.Getenv("TRANSCODE")); !enabled {
+		return nil
+	}
+	return &transcodeConfig{
+		maxWidth:         envInt("TRANSCODE_MAX_WIDTH", 1280),
+		maxHeight:        envInt("TRANSCODE_MAX_HEIGHT", 720),
+		bitrateKbps:      envInt("TRANSCODE_BITRATE", 2000),
+		keyframeInterval: envInt("TRANSCODE_KEYFRAME_INTERVAL", 60),
+	}
+}
+
+// elements returns the GStreamer elements between h264parse and kvssink.
+// videoscale keeps the aspect ratio while fitting the stream into the maximum size;
+// streams already smaller than the limits are not upscaled.
+func (c *transcodeConfig) elements() []string {
+	elements := []string{
+		"!", "avdec_h264",
+		"!", "videoscale",
+		"!", fmt.Sprintf("video/x-raw,width=[1,%d],height=[1,%d],pixel-aspect-ratio=1/1", c.maxWidth, c.maxHeight),
+		"!", "videoconvert",
+		"!",
+	}
+	return append(elements, encoderElements(c.bitrateKbps, c.keyframeInterval)...)
+}
+
+// encoderElements returns the x264enc element and the h264parse after it.
+func encoderElements(bitrateKbps, keyframeInterval int) []string {
+	return []string{
+		"x264enc",
+		fmt.Sprintf("bitrate=%d", bitrateKbps),
+		fmt.Sprintf("key-int-max=%d", keyframeInterval),
+		"bframes=0", "tune=zerolatency", "speed-preset=veryfast",
+		"!", "h264parse",
+	}
+}
+
+// EncoderElements returns the H.264 encoder of raw video with the TRANSCODE_BITRATE and
+// TRANSCODE_KEYFRAME_INTERVAL settings (x264enc ... ! h264parse), for pipelines
+// converting other codecs to H.264.
+func EncoderElements() []string {
+	return encoderElements(envInt("TRANSCODE_BITRATE", 2000), envInt("TRANSCODE_KEYFRAME_INTERVAL", 60))
+}
+
+func (c *transcodeConfig) String() string {
+	return fmt.Sprintf("max %dx%d, %d kbps, keyframe every %d frames",
+		c.maxWidth, c.maxHeight, c.bitrateKbps, c.keyframeInterval)
+}
+
+// envInt reads a positive integer environment variable, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("[KVS] ⚠️  Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+// Package kvs implements AWS Kinesis Video Streams forwarding.
+package kvs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+// webIdentitySource exchanges an OIDC token file for the credentials of a role with STS
+// AssumeRoleWithWebIdentity, e.g. the service account token of EKS IRSA.
+type webIdentitySource struct {
+	roleARN   string
+	tokenFile string // re-read on every refresh, the token is rotated by the kubelet
+	session   string
+}
+
+// webIdentitySourceFromEnv configures the source from AWS_WEB_IDENTITY_TOKEN_FILE,
+// AWS_ROLE_ARN and AWS_ROLE_SESSION_NAME (optional). It returns nil unless the token file
+// and role are set.
+func webIdentitySourceFromEnv() *webIdentitySource {
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return nil
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = fmt.Sprintf("rtmp-kvs-%d", time.Now().Unix())
+	}
+	return &webIdentitySource{roleARN: roleARN, tokenFile: tokenFile, session: session}
+}
+
+func (s *webIdentitySource) name() string {
+	return "web identity (" + s.roleARN + ")"
+}
+
+func (s *webIdentitySource) checkInterval() time.Duration {
+	// Web identity sessions default to a 1 hour lifetime
+	return 5 * time.Minute
+}
+
+func (s *webIdentitySource) fetch() (*credentials, error) {
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read web identity token: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	role, err := awsapi.NewSTS(stsRegion()).AssumeRoleWithWebIdentity(ctx, s.roleARN, s.session, strings.TrimSpace(string(token)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to assume %s with web identity: %w", s.roleARN, err)
+	}
+	return &credentials{
+		AccessKeyID:     role.AccessKeyID,
+		SecretAccessKey: role.SecretAccessKey,
+		SessionToken:    role.SessionToken,
+		Expiration:      role.Expiration,
+	}, nil
+}
+
+// stsRegion is the region of the STS endpoint used to obtain the server's credentials.
+func stsRegion() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenerDef is an RTMP(S) listener definition of -listen or LISTENERS:
+//
+//	rtmp://:1935                 all interfaces
+//	rtmp://192.0.2.10:1935       one address
+//	rtmps://[2001:db8::10]:1936  IPv6
+//	rtmp://eth1:1935             every address of a network interface
+//	unix:///run/rtmp/ingest.sock Unix domain socket (plain RTMP, for colocated encoders)
+type listenerDef struct {
+	tls     bool
+	network string // tcp or unix
+	address string
+}
+
+// String returns the definition in the -listen syntax.
+func (d listenerDef) String() string {
+	switch {
+	case d.network == "unix":
+		return "unix://" + d.address
+	case d.tls:
+		return "rtmps://" + d.address
+	default:
+		return "rtmp://" + d.address
+	}
+}
+
+// listenFlags collects repeated -listen flags.
+type listenFlags []string
+
+func (f *listenFlags) String() string     { return strings.Join(*f, ",") }
+func (f *listenFlags) Set(v string) error { *f = append(*f, v); return nil }
+
+// listenerDefs returns the listeners defined by -listen, or by LISTENERS (comma-separated)
+// without -listen flags. It returns nil if neither is set, in which case -rtmp and
+// -rtmps apply.
+func listenerDefs(flags []string) ([]listenerDef, error) {
+	values := flags
+	if len(values) == 0 {
+		for _, value := range strings.Split(os.Getenv("LISTENERS"), ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	var defs []listenerDef
+	for _, value := range values {
+		parsed, err := parseListener(value)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, parsed...)
+	}
+	return defs, nil
+}
+
+// parseListener parses a listener definition. A host naming a network interface expands
+// to one listener per address of the interface (IPv6 link-local addresses are skipped).
+func parseListener(value string) ([]listenerDef, error) {
+	scheme, address, ok := strings.Cut(value, "://")
+	if !ok || address == "" {
+		return nil, fmt.Errorf("invalid listener %q, expected rtmp://host:port, rtmps://host:port or unix:///path", value)
+	}
+	switch scheme {
+	case "unix":
+		return []listenerDef{{network: "unix", address: address}}, nil
+	case "rtmp", "rtmps":
+	default:
+		return nil, fmt.Errorf("invalid listener %q: unknown scheme %s", value, scheme)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener %q: %w", value, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid listener %q: invalid port %s", value, port)
+	}
+	def := listenerDef{tls: scheme == "rtmps", network: "tcp", address: address}
+	if host == "" || host == "localhost" {
+		return []listenerDef{def}, nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return []listenerDef{def}, nil
+	}
+
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener %q: %s is neither an IP address nor a network interface", value, host)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("listener %q: addresses of %s: %w", value, host, err)
+	}
+	var defs []listenerDef
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr.String())
+		if err != nil || prefix.Addr().IsLinkLocalUnicast() {
+			continue
+		}
+		def.address = net.JoinHostPort(prefix.Addr().String(), port)
+		defs = append(defs, def)
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("listener %q: %s has no usable address", value, host)
+	}
+	return defs, nil
+}
+
+// listen binds the listener. TCP listeners use lc (SO_REUSEPORT during a handoff).
+//
+// A Unix socket left by a previous process is replaced, and the socket file is not
+// removed on close, so a draining predecessor does not remove its successor's socket.
+// LISTEN_UNIX_MODE sets the permissions of the socket (octal, e.g. 0660; default umask).
+func (d listenerDef) listen(ctx context.Context, lc net.ListenConfig) (net.Listener, error) {
+	if d.network != "unix" {
+		return lc.Listen(ctx, d.network, d.address)
+	}
+
+	if info, err := os.Lstat(d.address); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", d.address)
+		}
+		if err := os.Remove(d.address); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var plain net.ListenConfig
+	ln, err := plain.Listen(ctx, "unix", d.address)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if value := os.Getenv("LISTEN_UNIX_MODE"); value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			log.Printf("Warning: invalid LISTEN_UNIX_MODE %q, keeping the default permissions", value)
+		} else if err := os.Chmod(d.address, fs.FileMode(mode)); err != nil {
+			log.Printf("Warning: failed to set the permissions of %s: %v", d.address, err)
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,89 @@
+// Package logging holds the log level of the server, which can be changed at runtime.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Levels in increasing order of verbosity
+const (
+	LevelInfo  = "info"
+	LevelDebug = "debug"
+)
+
+var (
+	debug atomic.Bool
+	// Streams logged at the debug level regardless of the global level
+	debugStreams sync.Map // stream name → struct{}
+)
+
+func init() {
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := SetLevel(value); err != nil {
+			log.Printf("Warning: invalid LOG_LEVEL %q, using %s", value, LevelInfo)
+		}
+	}
+}
+
+// SetLevel sets the log level: "info" (the default) or "debug", which adds per-frame
+// progress messages.
+func SetLevel(level string) error {
+	switch strings.ToLower(level) {
+	case LevelInfo:
+		debug.Store(false)
+	case LevelDebug:
+		debug.Store(true)
+	default:
+		return fmt.Errorf("unknown log level %q (use %s or %s)", level, LevelInfo, LevelDebug)
+	}
+	return nil
+}
+
+// Level returns the current log level.
+func Level() string {
+	if debug.Load() {
+		return LevelDebug
+	}
+	return LevelInfo
+}
+
+// Debugf logs a message at the debug level.
+func Debugf(format string, args ...any) {
+	if debug.Load() {
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
+
+// SetStreamLevel sets the log level of one stream: "debug" logs its debug messages at
+// any global level, "info" or "" follows the global level.
+func SetStreamLevel(stream, level string) error {
+	switch strings.ToLower(level) {
+	case "", LevelInfo:
+		debugStreams.Delete(stream)
+	case LevelDebug:
+		debugStreams.Store(stream, struct{}{})
+	default:
+		return fmt.Errorf("unknown log level %q (use %s or %s)", level, LevelInfo, LevelDebug)
+	}
+	return nil
+}
+
+// StreamLevel returns the log level of a stream, "" if it follows the global level.
+func StreamLevel(stream string) string {
+	if _, ok := debugStreams.Load(stream); ok {
+		return LevelDebug
+	}
+	return ""
+}
+
+// StreamDebugf logs a message of a stream at the debug level.
+func StreamDebugf(stream, format string, args ...any) {
+	if _, ok := debugStreams.Load(stream); ok || debug.Load() {
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
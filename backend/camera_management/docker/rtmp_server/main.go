@@ -3,96 +3,660 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"log"
-	"net"
 	"os"
 	"os/signal"
-	"syscall"
+	"strconv"
+	"sync"
+	"time"
 
+	"golang.org/x/sync/errgroup"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/alerts"
+	"rtmp_kvs/audit"
+	"rtmp_kvs/auth"
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/capture"
+	"rtmp_kvs/clip"
+	"rtmp_kvs/control"
+	"rtmp_kvs/crashreport"
+	"rtmp_kvs/dashboard"
+	"rtmp_kvs/events"
+	"rtmp_kvs/fallback"
+	"rtmp_kvs/greengrass"
+	"rtmp_kvs/grpcapi"
+	"rtmp_kvs/handoff"
+	"rtmp_kvs/history"
+	"rtmp_kvs/hooks"
+	"rtmp_kvs/kinesis"
 	"rtmp_kvs/kvs"
+	"rtmp_kvs/manifest"
+	"rtmp_kvs/metrics"
+	"rtmp_kvs/preview"
+	"rtmp_kvs/registry"
+	"rtmp_kvs/rekognition"
 	"rtmp_kvs/server"
+	"rtmp_kvs/sink"
+	"rtmp_kvs/snapshot"
+	"rtmp_kvs/state"
+	"rtmp_kvs/stills"
+	"rtmp_kvs/thumbnail"
+	"rtmp_kvs/tlscert"
+	"rtmp_kvs/xray"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay-session" {
+		runReplaySession(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		runValidate(os.Args[2:])
+		return
+	}
+
 	// Command line flags
 	rtmpAddr := flag.String("rtmp", ":1935", "RTMP listen address")
 	rtmpsAddr := flag.String("rtmps", ":1936", "RTMPS listen address")
 	certFile := flag.String("cert", "certs/server.crt", "TLS certificate file")
 	keyFile := flag.String("key", "certs/server.key", "TLS private key file")
 	enableRTMPS := flag.Bool("enable-rtmps", true, "Enable RTMPS listener")
+	adminAddr := flag.String("admin", "", "Admin HTTP listen address (empty to disable)")
+	grpcAddr := flag.String("grpc", "", "gRPC control API listen address (empty to disable)")
+	mpegtsTCPAddr := flag.String("mpegts-tcp", "", "MPEG-TS over TCP listen address (empty to disable)")
+	mpegtsUDPAddr := flag.String("mpegts-udp", "", "MPEG-TS over UDP listen address (empty to disable)")
+	mpegtsPath := flag.String("mpegts-path", "/live/mpegts", "Stream path used for MPEG-TS ingest")
+	httpIngestAddr := flag.String("http-ingest", "", "Listen address for H.264 Annex-B streams POSTed to /ingest/<path> (empty to disable)")
+	enablePlayback := flag.Bool("enable-playback", false, "Allow players to connect in RTMP read mode for local monitoring")
+	acceptAudioOnly := flag.Bool("accept-audio-only", false, "Accept publishers without video and forward their AAC/G.711 audio")
+	forwardAudio := flag.Bool("forward-audio", false, "Forward the AAC audio of H.264 publishers to KVS with the video")
+	enablePprof := flag.Bool("enable-pprof", false, "Expose pprof and runtime diagnostics on the admin port")
+	var listens listenFlags
+	flag.Var(&listens, "listen", "RTMP(S) listener: rtmp://host:port, rtmps://host:port or unix:///path (repeatable, replaces -rtmp and -rtmps)")
 	flag.Parse()
 
-	// Environment variables for KVS
-	streamName := os.Getenv("STREAM_NAME")
-	if streamName == "" {
-		log.Fatal("STREAM_NAME environment variable is required")
+	// On AWS IoT Greengrass, the component configuration provides environment variables
+	ggComponent := greengrass.NewFromEnv()
+	if ggComponent != nil {
+		if err := ggComponent.ApplyConfiguration(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	// Cancelled on shutdown signals: closes the listeners and their connections and stops
+	// the background refreshes
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	// Listeners, the admin server and the background refreshes run in one group. The first
+	// listener to fail cancels ctx, which shuts everything down, and the process exits
+	// non-zero so that the orchestrator restarts it rather than it running without a port.
+	group, ctx := errgroup.WithContext(ctx)
+	background := func(fn func(ctx context.Context)) {
+		group.Go(func() error {
+			fn(ctx)
+			return nil
+		})
 	}
 
+	// Environment variables for KVS (KVS_EMULATOR_URL fills them in for local development)
+	kvs.UseEmulatorFromEnv()
 	awsRegion := os.Getenv("AWS_REGION")
-	if awsRegion == "" {
-		log.Fatal("AWS_REGION environment variable is required")
+
+	// Check the GStreamer elements now rather than when the first camera connects
+	if err := kvs.ProbeGStreamer(*acceptAudioOnly || *forwardAudio); err != nil {
+		log.Fatalf("GStreamer check failed: %v", err)
+	}
+
+	// Optional X-Ray tracing of the AWS API calls (before any call is made)
+	tracer := xray.NewFromEnv()
+	if tracer != nil {
+		awsapi.SetTracer(tracer)
+		metrics.Register(tracer.CollectMetrics)
+	}
+
+	// Optional DynamoDB stream registry (routes publish keys to KVS streams)
+	streamRegistry := registry.NewFromEnv(awsRegion)
+	if streamRegistry != nil && awsRegion == "" {
+		log.Fatal("AWS_REGION environment variable is required when REGISTRY_TABLE is set")
+	}
+
+	// Optional EventBridge lifecycle events
+	if eventBridge := events.NewEventBridgePublisherFromEnv(awsRegion); eventBridge != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when EVENT_BUS_NAME is set")
+		}
+		metrics.Register(eventBridge.CollectMetrics)
+	}
+
+	streamName := os.Getenv("STREAM_NAME")
+	if streamName == "" && streamRegistry == nil {
+		log.Fatal("STREAM_NAME environment variable is required")
 	}
 
 	// Create credential manager and start background refresh
 	credManager := kvs.NewCredentialManager()
-	
+
 	// Initial credential refresh
 	if err := credManager.RefreshCredentials(); err != nil {
 		log.Printf("Warning: Initial credential refresh failed: %v", err)
 	}
-	
+
 	// Start background credential refresh
-	stopCredRefresh := make(chan struct{})
-	credManager.StartBackgroundRefresh(stopCredRefresh)
+	background(credManager.RunBackgroundRefresh)
 
-	// Create KVS forwarder
-	kvsForwarder := kvs.NewForwarder(streamName, awsRegion)
+	// Create KVS forwarders (one per target stream)
+	kvsPool := kvs.NewPool()
+	if configFile := os.Getenv("STREAM_CONFIG_FILE"); configFile != "" {
+		configs, err := kvs.LoadStreamConfigFile(configFile)
+		if err != nil {
+			log.Fatalf("Failed to load stream config: %v", err)
+		}
+		kvsPool.SetStreamConfigs(configs)
+		log.Printf("Loaded settings for %d streams from %s", len(configs), configFile)
+	}
+	// Optional per-stream state (DynamoDB / EFS) continued by a replacement task
+	stateKeeper := state.NewFromEnv(awsRegion, kvsPool)
+	if stateKeeper != nil {
+		if awsRegion == "" && os.Getenv("STATE_TABLE") != "" {
+			log.Fatal("AWS_REGION environment variable is required when STATE_TABLE is set")
+		}
+		kvsPool.OnCreate(func(f *kvs.Forwarder) { stateKeeper.Restore(f) })
+		metrics.Register(stateKeeper.CollectMetrics)
+		background(stateKeeper.Run)
+	}
+	var kvsForwarder *kvs.Forwarder
+	if streamName != "" {
+		kvsForwarder = kvsPool.Get(streamName, awsRegion)
+		if awsRegion == "" && !kvsForwarder.FileSink() {
+			log.Fatal("AWS_REGION environment variable is required")
+		}
+	}
 
 	// Create RTMP server
 	rtmpServer := server.New(kvsForwarder)
+	rtmpServer.SetPlayback(*enablePlayback)
+	rtmpServer.SetAudioOnly(*acceptAudioOnly)
+	rtmpServer.SetForwardAudio(*forwardAudio)
+	rtmpServer.SetForwarders(kvsPool)
+	connConfig := server.ConnConfigFromEnv()
+	rtmpServer.SetConnConfig(connConfig)
+	log.Printf("Connection settings: %s", connConfig)
+	ipFilter, err := server.NewIPFilterFromEnv(ctx, awsRegion)
+	if err != nil {
+		log.Fatalf("Failed to configure IP filter: %v", err)
+	}
+	if ipFilter != nil {
+		rtmpServer.SetIPFilter(ipFilter)
+		metrics.Register(ipFilter.CollectMetrics)
+		background(ipFilter.Watch)
+	}
+	if streamRegistry != nil {
+		rtmpServer.SetRouter(server.NewRegistryRouter(streamRegistry, kvsPool))
+	}
+	pathTemplates, err := server.PathTemplatesFromEnv(kvsPool, awsRegion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pathTemplates != nil {
+		rtmpServer.SetPathTemplates(pathTemplates)
+	}
+
+	// Optional multi-tenant RTMPS: the TLS server name selects the tenant
+	var tenants *server.Tenants
+	if tenantFile := os.Getenv("TENANT_CONFIG_FILE"); tenantFile != "" {
+		tenants, err = server.LoadTenants(tenantFile, kvsPool, awsRegion)
+		if err != nil {
+			log.Fatalf("Failed to load tenants: %v", err)
+		}
+		rtmpServer.SetTenants(tenants)
+	}
+	jwtAuth, err := auth.NewJWTAuthorizerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure JWT stream keys: %v", err)
+	}
+	if jwtAuth != nil {
+		rtmpServer.AddAuthorizer(jwtAuth)
+	}
+	if webhook := auth.NewWebhookFromEnv(); webhook != nil {
+		rtmpServer.AddAuthorizer(webhook)
+	}
+
+	// Optional capture of failed sessions for the replay-session subcommand
+	if recorder := capture.NewFromEnv(awsRegion); recorder != nil {
+		rtmpServer.SetCapture(recorder)
+		metrics.Register(recorder.CollectMetrics)
+	}
+
+	// Optional per-connection audit records to CloudWatch Logs or Firehose
+	auditLog := audit.NewFromEnv(awsRegion)
+	if auditLog != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when AUDIT_LOG_GROUP or AUDIT_FIREHOSE_STREAM is set")
+		}
+		rtmpServer.SetAudit(auditLog)
+		metrics.Register(auditLog.CollectMetrics)
+	}
 
-	// Start RTMP listener
-	rtmpLn, err := net.Listen("tcp", *rtmpAddr)
+	// Optional SNS alerting (dropped frames, keyframe gaps, restart loops, idle streams)
+	alertMonitor := alerts.NewFromEnv(awsRegion, rtmpServer)
+	if alertMonitor != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when ALERT_TOPIC_ARN is set")
+		}
+		metrics.Register(alertMonitor.CollectMetrics)
+	}
+
+	// Optional restart hooks (webhook, SNS, Lambda) paging on pipeline restarts and storms
+	restartHooks, err := hooks.NewFromEnv(rtmpServer, kvsPool)
 	if err != nil {
-		log.Fatalf("Failed to start RTMP listener: %v", err)
+		log.Fatalf("Invalid RESTART_HOOKS: %v", err)
+	}
+	if restartHooks != nil {
+		metrics.Register(restartHooks.CollectMetrics)
 	}
-	log.Printf("RTMP server listening on %s", *rtmpAddr)
-	go rtmpServer.Serve(rtmpLn, false)
 
-	// Start RTMPS listener (if enabled and certificates exist)
-	if *enableRTMPS {
-		if _, err := os.Stat(*certFile); err == nil {
-			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	// Optional CloudWatch metrics of recovered panics
+	if crashReporter := crashreport.NewFromEnv(awsRegion); crashReporter != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when PANIC_METRICS_NAMESPACE is set")
+		}
+		metrics.Register(crashReporter.CollectMetrics)
+	}
+
+	// Optional stats history (DynamoDB / Timestream) for the camera management backend
+	if statsRecorder := history.NewFromEnv(awsRegion, rtmpServer, kvsPool); statsRecorder != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when STATS_TABLE or STATS_TIMESTREAM_DATABASE is set")
+		}
+		metrics.Register(statsRecorder.CollectMetrics)
+		background(statsRecorder.Run)
+	}
+
+	// Optional sampled stills of every stream to Firehose (S3) for long-term imagery
+	if stillSampler := stills.NewFromEnv(awsRegion, rtmpServer); stillSampler != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when STILLS_FIREHOSE_STREAM is set")
+		}
+		metrics.Register(stillSampler.CollectMetrics)
+		background(stillSampler.Run)
+	}
+
+	// Optional JPEG stills to S3 of streams whose KVS pipeline is down
+	if stillFallback := fallback.NewFromEnv(awsRegion, rtmpServer, kvsPool); stillFallback != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when FALLBACK_STILLS_BUCKET is set")
+		}
+		metrics.Register(stillFallback.CollectMetrics)
+		background(stillFallback.Run)
+	}
+
+	// Optional manifest of the time windows of sharded streams
+	if shardManifest := manifest.NewFromEnv(awsRegion); shardManifest != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when SHARD_MANIFEST_TABLE is set")
+		}
+		metrics.Register(shardManifest.CollectMetrics)
+	}
+
+	// Optional GOP records to Kinesis Data Streams for downstream indexing
+	kinesisPublisher := kinesis.NewFromEnv(awsRegion)
+	if kinesisPublisher != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when KINESIS_STREAM_NAME is set")
+		}
+		metrics.Register(kinesisPublisher.CollectMetrics)
+	}
+
+	// Optional Rekognition Video stream processors on the KVS streams of publishers
+	rekognitionTrigger := rekognition.NewFromEnv(awsRegion, streamRegistry)
+	if rekognitionTrigger != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when REKOGNITION_ROLE_ARN is set")
+		}
+		metrics.Register(rekognitionTrigger.CollectMetrics)
+	}
+
+	// Optional clip export to S3 on request (admin API, SQS, MQTT); clips not in the
+	// buffer of recent frames are read from the KVS stream of the path
+	clipExporter := clip.NewFromEnv(rtmpServer, func(streamPath string) string {
+		if stats, ok := rtmpServer.SessionStats(streamPath); ok {
+			return stats.StreamName
+		}
+		return streamName
+	}, awsRegion)
+	if clipExporter != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when CLIP_BUCKET is set")
+		}
+		metrics.Register(clipExporter.CollectMetrics)
+		background(clipExporter.RunQueue)
+	}
+	// Buffer of recent frames for clips and lookback, also without clip export
+	clipBuffer := clip.BufferConfigFromEnv(0)
+	if clipExporter != nil {
+		clipBuffer = clipExporter.Buffer()
+	}
+	if clipBuffer.Window > 0 {
+		if clipBuffer.Dir != "" {
+			if err := os.MkdirAll(clipBuffer.Dir, 0o755); err != nil {
+				log.Fatalf("Failed to create CLIP_BUFFER_DIR: %v", err)
+			}
+		}
+		rtmpServer.SetClipBuffer(clipBuffer)
+	}
+
+	// Snapshots to S3, published for "last seen" thumbnails in the management console
+	snapshots := snapshot.NewHandlerFromEnv(rtmpServer, awsRegion)
+	if thumbnails := thumbnail.NewFromEnv(awsRegion, rtmpServer, snapshots); thumbnails != nil {
+		if awsRegion == "" {
+			log.Fatal("AWS_REGION environment variable is required when SNAPSHOT_BUCKET is set")
+		}
+		metrics.Register(thumbnails.CollectMetrics)
+		background(thumbnails.Run)
+	}
+
+	// Optional command channel over MQTT (AWS IoT Core): pause forwarding, snapshots, ...
+	if controller := control.NewFromEnv(); controller != nil {
+		if problems := controller.Check(); len(problems) > 0 {
+			log.Fatal(problems[0])
+		}
+		registerCommands(controller, rtmpServer, kvsPool, snapshots, clipExporter, streamName, awsRegion)
+		metrics.Register(controller.CollectMetrics)
+		background(controller.Run)
+	}
+
+	// What this version and configuration supports, for the provisioning side
+	serverCapabilities := newCapabilities(rtmpServer, *enablePlayback)
+
+	// Listeners are bound with SO_REUSEPORT when a new process may take them over
+	listenerHandoff := handoff.NewFromEnv()
+	listenConfig := listenerHandoff.ListenConfig()
+
+	// Start admin server (if enabled)
+	var adminServer *admin.Server
+	if *adminAddr != "" {
+		adminServer = admin.New(*adminAddr)
+		adminServer.SetListenConfig(listenConfig)
+		if *enablePprof {
+			adminServer.EnableDiagnostics()
+		}
+		snapshots.Register(adminServer)
+		if clipExporter != nil {
+			clipExporter.Register(adminServer)
+		}
+		if clipBuffer.Window > 0 {
+			clip.RegisterLookback(adminServer, rtmpServer)
+		}
+		adminServer.HandleFunc("GET /stats", rtmpServer.ServeStats)
+		adminServer.HandleFunc("GET /stats/{path...}", rtmpServer.ServeSessionStats)
+		adminServer.HandleFunc("GET /cameras", rtmpServer.ServeCameras)
+		adminServer.HandleFunc("GET /cameras/{id...}", rtmpServer.ServeCamera)
+		adminServer.HandleFunc("GET /capabilities", serverCapabilities.serve)
+		adminServer.HandleFunc("GET /panics", rtmpServer.ServePanics)
+		adminServer.HandleFunc("GET /quarantine", rtmpServer.ServeQuarantine)
+		adminServer.HandleFunc("DELETE /quarantine/{address}", rtmpServer.ServeQuarantine)
+		adminServer.HandleFunc("POST /forwarding/pause", rtmpServer.ServePause)
+		adminServer.HandleFunc("POST /forwarding/resume", rtmpServer.ServePause)
+		adminServer.HandleFunc("GET /forwarding/paused", rtmpServer.ServePaused)
+		adminServer.HandleFunc("GET /logging", kvsPool.ServeLogging)
+		adminServer.HandleFunc("POST /logging", kvsPool.ServeLogging)
+		if restartHooks != nil {
+			adminServer.HandleFunc("POST /restart-hooks/test", restartHooks.ServeTest)
+		}
+		metrics.Register(rtmpServer.CollectMetrics)
+		metrics.Register(kvsPool.CollectMetrics)
+		metrics.Register(sink.CollectMetrics)
+		adminServer.Handle("GET /metrics", metrics.Handler())
+		dashboard.New(rtmpServer, kvsPool).Register(adminServer)
+		events.NewFeed().Register(adminServer)
+		if previewServer := preview.NewFromEnv(); previewServer != nil {
+			rtmpServer.SetPreview(previewServer)
+			previewServer.Register(adminServer)
+			metrics.Register(previewServer.CollectMetrics)
+		}
+		if err := adminServer.Start(); err != nil {
+			log.Fatalf("Failed to start admin server: %v", err)
+		}
+		group.Go(func() error { return adminServer.Serve(ctx) })
+	} else if *enablePprof {
+		log.Printf("Warning: -enable-pprof has no effect without -admin")
+	}
+
+	// Start gRPC control API (if enabled)
+	if *grpcAddr != "" {
+		grpcServer := grpcapi.New(*grpcAddr, rtmpServer, kvsPool)
+		grpcServer.SetListenConfig(listenConfig)
+		if err := grpcServer.Start(); err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
+		}
+		group.Go(func() error { return grpcServer.Serve(ctx) })
+	}
+
+	// Listeners run until ctx is cancelled; serving tracks them until their connections end
+	var serving sync.WaitGroup
+	serve := func(fn func() error) {
+		serving.Add(1)
+		group.Go(func() error {
+			defer serving.Done()
+			return fn()
+		})
+	}
+
+	// Listener definitions (-listen or LISTENERS), by default -rtmp and -rtmps
+	listeners, err := listenerDefs(listens)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if listeners == nil {
+		listeners = []listenerDef{{network: "tcp", address: *rtmpAddr}}
+		if *enableRTMPS {
+			listeners = append(listeners, listenerDef{tls: true, network: "tcp", address: *rtmpsAddr})
+		}
+	}
+
+	// Start RTMP listeners
+	var rtmpsListeners []listenerDef
+	for _, def := range listeners {
+		if def.tls {
+			rtmpsListeners = append(rtmpsListeners, def)
+			continue
+		}
+		rtmpLn, err := def.listen(ctx, listenConfig)
+		if err != nil {
+			log.Fatalf("Failed to start RTMP listener %s: %v", def, err)
+		}
+		log.Printf("RTMP server listening on %s", def)
+		serverCapabilities.listen("RTMP", rtmpLn.Addr().String())
+		serve(func() error { return rtmpServer.Serve(ctx, rtmpLn, false) })
+	}
+
+	// Start MPEG-TS listeners (if enabled)
+	if *mpegtsTCPAddr != "" {
+		mpegtsLn, err := listenConfig.Listen(ctx, "tcp", *mpegtsTCPAddr)
+		if err != nil {
+			log.Fatalf("Failed to start MPEG-TS/TCP listener: %v", err)
+		}
+		log.Printf("MPEG-TS/TCP ingest listening on %s (path %s)", *mpegtsTCPAddr, *mpegtsPath)
+		serverCapabilities.listen("MPEG-TS/TCP", mpegtsLn.Addr().String())
+		serve(func() error { return rtmpServer.ServeMPEGTS(ctx, mpegtsLn, *mpegtsPath) })
+	}
+	if *mpegtsUDPAddr != "" {
+		mpegtsPC, err := listenConfig.ListenPacket(ctx, "udp", *mpegtsUDPAddr)
+		if err != nil {
+			log.Fatalf("Failed to start MPEG-TS/UDP listener: %v", err)
+		}
+		log.Printf("MPEG-TS/UDP ingest listening on %s (path %s)", *mpegtsUDPAddr, *mpegtsPath)
+		serverCapabilities.listen("MPEG-TS/UDP", mpegtsPC.LocalAddr().String())
+		serve(func() error { return rtmpServer.ServeMPEGTSUDP(ctx, mpegtsPC, *mpegtsPath) })
+	}
+
+	// Start the HTTP ingest listener (if enabled)
+	if *httpIngestAddr != "" {
+		httpIngestLn, err := listenConfig.Listen(ctx, "tcp", *httpIngestAddr)
+		if err != nil {
+			log.Fatalf("Failed to start HTTP ingest listener: %v", err)
+		}
+		log.Printf("HTTP ingest listening on %s (POST /ingest/<path>)", *httpIngestAddr)
+		serverCapabilities.listen("HTTP", httpIngestLn.Addr().String())
+		serve(func() error { return rtmpServer.ServeHTTPIngest(ctx, httpIngestLn) })
+	}
+
+	// Start RTMPS listeners (if enabled and certificates exist)
+	if len(rtmpsListeners) > 0 {
+		if certSource := certificateSource(*certFile, *keyFile, awsRegion); certSource != nil {
+			certReloader, err := tlscert.NewReloader(certSource)
 			if err != nil {
 				log.Printf("Warning: Failed to load TLS certificates: %v", err)
 				log.Printf("RTMPS disabled. Use generate-certs.sh to create certificates.")
 			} else {
-tlsConfig := &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				MinVersion:   tls.VersionTLS13,
-			}
-				rtmpsLn, err := tls.Listen("tcp", *rtmpsAddr, tlsConfig)
-				if err != nil {
-					log.Fatalf("Failed to start RTMPS listener: %v", err)
+				tlsConfig := certReloader.TLSConfig()
+				if tenants != nil {
+					tlsConfig = tenants.TLSConfig(tlsConfig)
+				}
+				for _, def := range rtmpsListeners {
+					rtmpsTCPLn, err := def.listen(ctx, listenConfig)
+					if err != nil {
+						log.Fatalf("Failed to start RTMPS listener %s: %v", def, err)
+					}
+					rtmpsLn := tls.NewListener(rtmpsTCPLn, tlsConfig)
+					log.Printf("RTMPS server listening on %s", def)
+					serverCapabilities.listen("RTMPS", rtmpsTCPLn.Addr().String())
+					serve(func() error { return rtmpServer.Serve(ctx, rtmpsLn, true) })
+				}
+
+				// Reload the certificate on change or SIGHUP without dropping connections
+				metrics.Register(certReloader.CollectMetrics)
+				var reloadCh chan os.Signal
+				if len(reloadSignals) > 0 {
+					reloadCh = make(chan os.Signal, 1)
+					signal.Notify(reloadCh, reloadSignals...)
+				}
+				background(func(ctx context.Context) { certReloader.Watch(ctx, tlsReloadInterval(), reloadCh) })
+				if acme, ok := certSource.(*tlscert.ACMESource); ok {
+					metrics.Register(acme.CollectMetrics)
+					background(acme.Run)
 				}
-				log.Printf("RTMPS server listening on %s", *rtmpsAddr)
-				go rtmpServer.Serve(rtmpsLn, true)
 			}
-		} else {
-			log.Printf("Warning: TLS certificate not found at %s", *certFile)
-			log.Printf("RTMPS disabled. Use generate-certs.sh to create certificates.")
 		}
 	}
 
-	// Wait for interrupt signal
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	// All listeners are bound: a previous process can drain now
+	if err := listenerHandoff.Start(); err != nil {
+		log.Fatalf("Listener handoff failed: %v", err)
+	}
+
+	// Report the component state to the Greengrass nucleus
+	if ggComponent != nil {
+		metrics.Register(ggComponent.CollectMetrics)
+		background(func(ctx context.Context) { ggComponent.Run(ctx, kvsPool) })
+	}
+
+	// Wait for interrupt signal, or for a new process to take over the listeners
+	select {
+	case <-ctx.Done():
+	case <-listenerHandoff.Requested():
+		rtmpServer.Drain()
+		drained := make(chan struct{})
+		go func() {
+			serving.Wait()
+			close(drained)
+		}()
+		log.Printf("Handed off listeners, waiting up to %s for connections to finish", listenerHandoff.DrainTimeout())
+		select {
+		case <-drained:
+		case <-time.After(listenerHandoff.DrainTimeout()):
+			log.Printf("Drain timeout, closing the remaining connections")
+		case <-ctx.Done():
+		}
+	}
+	stop() // A second signal terminates immediately
 
 	log.Println("Shutting down...")
-	close(stopCredRefresh) // Stop background credential refresh
-	rtmpLn.Close()
-	kvsForwarder.Close()
+	serving.Wait()
+	listenerHandoff.Close()
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	err = group.Wait()
+	kvsPool.Close()
+	if stateKeeper != nil {
+		stateKeeper.Close()
+	}
+	if rekognitionTrigger != nil {
+		rekognitionTrigger.Close()
+	}
+	if kinesisPublisher != nil {
+		kinesisPublisher.Close()
+	}
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	if tracer != nil {
+		tracer.Close()
+	}
+	if err != nil {
+		log.Fatalf("Exiting after failure: %v", err)
+	}
+}
+
+// Time allowed to obtain the ACME certificate at startup
+const acmeObtainTimeout = 10 * time.Minute
+
+// certificateSource selects where the RTMPS certificate is loaded from: Secrets Manager
+// (TLS_SECRET_ID), ACM (TLS_ACM_CERTIFICATE_ARN), an ACME server (TLS_ACME_DOMAINS) or
+// the -cert/-key files. It returns nil when no certificate is available.
+func certificateSource(certFile, keyFile, region string) tlscert.Source {
+	if secretID := os.Getenv("TLS_SECRET_ID"); secretID != "" {
+		if region == "" {
+			log.Fatal("AWS_REGION environment variable is required when TLS_SECRET_ID is set")
+		}
+		return tlscert.NewSecretsManagerSource(secretID, region)
+	}
+	if arn := os.Getenv("TLS_ACM_CERTIFICATE_ARN"); arn != "" {
+		if region == "" {
+			log.Fatal("AWS_REGION environment variable is required when TLS_ACM_CERTIFICATE_ARN is set")
+		}
+		return tlscert.NewACMSource(arn, region)
+	}
+	if acme := tlscert.NewACMESourceFromEnv(); acme != nil {
+		// DNS propagation and validation take a while; a cached certificate is used at once
+		ctx, cancel := context.WithTimeout(context.Background(), acmeObtainTimeout)
+		defer cancel()
+		if err := acme.Obtain(ctx); err != nil {
+			log.Printf("Warning: Failed to obtain an ACME certificate: %v", err)
+		}
+		return acme
+	}
+
+	if _, err := os.Stat(certFile); err != nil {
+		log.Printf("Warning: TLS certificate not found at %s", certFile)
+		log.Printf("RTMPS disabled. Use generate-certs.sh to create certificates.")
+		return nil
+	}
+	return &tlscert.FileSource{CertFile: certFile, KeyFile: keyFile}
+}
+
+// tlsReloadInterval reads TLS_RELOAD_INTERVAL (seconds between certificate change checks,
+// default 60, 0 = reload on SIGHUP only).
+func tlsReloadInterval() time.Duration {
+	value := os.Getenv("TLS_RELOAD_INTERVAL")
+	if value == "" {
+		return time.Minute
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		log.Printf("Warning: invalid TLS_RELOAD_INTERVAL %q, using 60 seconds", value)
+		return time.Minute
+	}
+	return time.Duration(seconds) * time.Second
 }
@@ -0,0 +1,109 @@
+// Package manifest records which KVS stream holds each time window of a sharded stream in
+// DynamoDB, so that consumers can find the shard to read for a given time range.
+package manifest
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+)
+
+const requestTimeout = 10 * time.Second
+
+// Writer writes an item per shard window: when the window opens, and again with its end,
+// frame and byte counts when it closes.
+//
+// Table layout:
+//
+//	stream_name    S   logical KVS stream (partition key)
+//	window_start   N   start of the window, Unix milliseconds (sort key)
+//	window_end     N   end of the window, Unix milliseconds (absent while open)
+//	shard_stream   S   KVS stream the window was written to
+//	region         S   region of the shard stream
+//	frames         N   frames written (closed windows)
+//	bytes          N   H.264 bytes written (closed windows)
+//	expires_at     N   TTL attribute (SHARD_MANIFEST_TTL_DAYS)
+type Writer struct {
+	table  string
+	ttl    time.Duration
+	client *awsapi.DynamoDB
+
+	written atomic.Uint64
+	failed  atomic.Uint64
+}
+
+// NewFromEnv creates a writer for the DynamoDB table SHARD_MANIFEST_TABLE and subscribes it
+// to the event bus. Items expire after SHARD_MANIFEST_TTL_DAYS (default 0, never). It
+// returns nil if SHARD_MANIFEST_TABLE is not set.
+func NewFromEnv(region string) *Writer {
+	table := os.Getenv("SHARD_MANIFEST_TABLE")
+	if table == "" {
+		return nil
+	}
+	days := 0
+	if value := os.Getenv("SHARD_MANIFEST_TTL_DAYS"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			days = n
+		} else {
+			log.Printf("[Manifest] ⚠️  Invalid SHARD_MANIFEST_TTL_DAYS %q, using %d", value, days)
+		}
+	}
+	w := &Writer{
+		table:  table,
+		ttl:    time.Duration(days) * 24 * time.Hour,
+		client: awsapi.NewDynamoDB(region),
+	}
+	events.Subscribe(w)
+	log.Printf("[Manifest] Writing shard windows to DynamoDB table %s", table)
+	return w
+}
+
+// Handle implements events.Subscriber.
+func (w *Writer) Handle(e events.Event) {
+	if e.Type != events.ShardOpened && e.Type != events.ShardClosed {
+		return
+	}
+	shard, _ := e.Detail["shard"].(string)
+	region, _ := e.Detail["region"].(string)
+	start, _ := e.Detail["window_start"].(time.Time)
+
+	item := awsapi.Item{
+		"stream_name":  awsapi.String(e.StreamName),
+		"window_start": awsapi.Number(start.UnixMilli()),
+		"shard_stream": awsapi.String(shard),
+		"region":       awsapi.String(region),
+	}
+	if e.Type == events.ShardClosed {
+		end, _ := e.Detail["window_end"].(time.Time)
+		frames, _ := e.Detail["frames"].(int)
+		bytes, _ := e.Detail["bytes"].(uint64)
+		item["window_end"] = awsapi.Number(end.UnixMilli())
+		item["frames"] = awsapi.Number(int64(frames))
+		item["bytes"] = awsapi.Number(int64(bytes))
+	}
+	if w.ttl > 0 {
+		item["expires_at"] = awsapi.Number(start.Add(w.ttl).Unix())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := w.client.PutItem(ctx, w.table, item); err != nil {
+		w.failed.Add(1)
+		log.Printf("[Manifest] ⚠️  Failed to write the window of %s on %s: %v", e.StreamName, shard, err)
+		return
+	}
+	w.written.Add(1)
+}
+
+// CollectMetrics writes the manifest write counters.
+func (w *Writer) CollectMetrics(mw *metrics.Writer) {
+	mw.Counter("rtmp_shard_manifest_writes_total", "Shard window items written to DynamoDB", float64(w.written.Load()))
+	mw.Counter("rtmp_shard_manifest_errors_total", "Shard window items that failed to be written", float64(w.failed.Load()))
+}
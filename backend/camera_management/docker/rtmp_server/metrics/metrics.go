@@ -0,0 +1,108 @@
+// Package metrics exposes server metrics in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector writes the current value of its metrics.
+type Collector func(w *Writer)
+
+var (
+	mutex      sync.Mutex
+	collectors []Collector
+)
+
+// Register adds a collector to the /metrics output.
+func Register(c Collector) {
+	mutex.Lock()
+	collectors = append(collectors, c)
+	mutex.Unlock()
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		cs := append([]Collector(nil), collectors...)
+		mutex.Unlock()
+
+		w := &Writer{families: make(map[string]*family)}
+		for _, c := range cs {
+			c(w)
+		}
+
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.writeTo(rw)
+	})
+}
+
+// family is a metric name with its samples.
+type family struct {
+	help    string
+	typ     string
+	samples []string
+}
+
+// labelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writer collects samples, grouping them by metric name as the text format requires.
+type Writer struct {
+	families map[string]*family
+}
+
+// Gauge writes a gauge sample. labels are key/value pairs.
+func (w *Writer) Gauge(name, help string, value float64, labels ...string) {
+	w.add(name, help, "gauge", value, labels)
+}
+
+// Counter writes a counter sample. labels are key/value pairs.
+func (w *Writer) Counter(name, help string, value float64, labels ...string) {
+	w.add(name, help, "counter", value, labels)
+}
+
+func (w *Writer) add(name, help, typ string, value float64, labels []string) {
+	f, ok := w.families[name]
+	if !ok {
+		f = &family{help: help, typ: typ}
+		w.families[name] = f
+	}
+
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	f.samples = append(f.samples, b.String())
+}
+
+func (w *Writer) writeTo(rw http.ResponseWriter) {
+	names := make([]string, 0, len(w.families))
+	for name := range w.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := w.families[name]
+		fmt.Fprintf(rw, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(rw, "# TYPE %s %s\n", name, f.typ)
+		for _, sample := range f.samples {
+			fmt.Fprintln(rw, sample)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Package preview serves a short rolling HLS (fMP4) window of live streams from memory,
+// for low-latency previews in the management console without KVS HLS sessions.
+package preview
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4/seekablebuffer"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mp4"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/metrics"
+)
+
+// Time scale of the video track
+const timeScale = 90000
+
+// Server keeps the HLS window of every active stream and serves it on the admin API.
+//
+//	GET /preview/live/cam1/index.m3u8  media playlist
+//	GET /preview/live/cam1/init.mp4    initialization segment
+//	GET /preview/live/cam1/<n>.m4s     media segment
+type Server struct {
+	window      time.Duration // playlist length
+	segment     time.Duration // minimum segment length; segments are cut at keyframes
+	allowOrigin string        // CORS Access-Control-Allow-Origin, empty to omit
+
+	mutex   sync.Mutex
+	muxers  map[string]*Muxer // by stream path
+	served  atomic.Uint64
+	evicted atomic.Uint64
+}
+
+// NewFromEnv creates the preview server when HLS_PREVIEW is true. The playlist covers
+// HLS_PREVIEW_WINDOW seconds (default 30) in segments of at least HLS_PREVIEW_SEGMENT
+// seconds (default 2, cut at the next keyframe). HLS_PREVIEW_ALLOW_ORIGIN sets the CORS
+// origin allowed to fetch the preview (e.g. the management console). It returns nil when
+// disabled.
+func NewFromEnv() *Server {
+	if enabled, _ := strconv.ParseBool(os.Getenv("HLS_PREVIEW")); !enabled {
+		return nil
+	}
+	s := &Server{
+		window:      envSeconds("HLS_PREVIEW_WINDOW", 30*time.Second),
+		segment:     envSeconds("HLS_PREVIEW_SEGMENT", 2*time.Second),
+		allowOrigin: os.Getenv("HLS_PREVIEW_ALLOW_ORIGIN"),
+		muxers:      make(map[string]*Muxer),
+	}
+	if s.segment > s.window {
+		s.segment = s.window
+	}
+	log.Printf("HLS preview enabled: %s window, %s segments", s.window, s.segment)
+	return s
+}
+
+// Register registers the preview endpoints on the admin server.
+func (s *Server) Register(srv *admin.Server) {
+	srv.HandleFunc("GET /preview/{path...}", s.serve)
+}
+
+// Open creates the muxer of a publisher, replacing a previous one of the same path.
+func (s *Server) Open(streamPath string) *Muxer {
+	m := &Muxer{server: s, streamPath: streamPath}
+	s.mutex.Lock()
+	s.muxers[streamPath] = m
+	s.mutex.Unlock()
+	return m
+}
+
+// serve serves the playlist and segments of a stream.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	dir, file := path.Split("/" + r.PathValue("path"))
+	s.mutex.Lock()
+	m := s.muxers[strings.TrimSuffix(dir, "/")]
+	s.mutex.Unlock()
+	if m == nil {
+		http.Error(w, "no publisher on this path", http.StatusNotFound)
+		return
+	}
+	if s.allowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.allowOrigin)
+	}
+
+	var (
+		body        []byte
+		contentType string
+		ok          bool
+	)
+	switch {
+	case file == "index.m3u8":
+		body, ok = m.playlist(), true
+		contentType = "application/vnd.apple.mpegurl"
+		w.Header().Set("Cache-Control", "no-cache")
+	case file == "init.mp4":
+		body, ok = m.initSegment()
+		contentType = "video/mp4"
+	case strings.HasSuffix(file, ".m4s"):
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file, ".m4s"), 10, 32)
+		if err == nil {
+			body, ok = m.mediaSegment(uint32(seq))
+		}
+		contentType = "video/iso.segment"
+	}
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.served.Add(1)
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// CollectMetrics writes the number of previewed streams and served requests.
+func (s *Server) CollectMetrics(w *metrics.Writer) {
+	s.mutex.Lock()
+	streams := len(s.muxers)
+	s.mutex.Unlock()
+	w.Gauge("rtmp_preview_streams", "Streams with an HLS preview window", float64(streams))
+	w.Counter("rtmp_preview_requests_total", "HLS preview playlists and segments served", float64(s.served.Load()))
+	w.Counter("rtmp_preview_segments_evicted_total", "HLS preview segments that left the window", float64(s.evicted.Load()))
+}
+
+// segment is a media segment of the window.
+type segment struct {
+	seq      uint32
+	duration time.Duration
+	data     []byte
+}
+
+// sample is an access unit waiting for the next one, which gives its duration.
+type sample struct {
+	pts, dts time.Duration
+	au       [][]byte
+	idr      bool
+}
+
+// Muxer packs the access units of one publisher into fMP4 segments.
+type Muxer struct {
+	server     *Server
+	streamPath string
+
+	mutex    sync.Mutex
+	init     []byte // initialization segment of sps/pps, nil before the first IDR
+	sps, pps []byte
+	segments []*segment
+	nextSeq  uint32
+
+	// Segment being built, written by the reader goroutine only
+	pending  *sample
+	samples  []*fmp4.Sample
+	startDTS time.Duration // DTS of the first sample of the segment
+}
+
+// WriteH264 adds an access unit. sps and pps are the current parameter sets of the
+// stream; the window restarts when they change (e.g. a new resolution).
+func (m *Muxer) WriteH264(pts, dts time.Duration, au [][]byte, sps, pps []byte) {
+	idr := h264.IsRandomAccess(au)
+	if m.pending == nil && !idr {
+		return // the window starts at a keyframe
+	}
+	if idr && sps != nil && pps != nil && (string(sps) != string(m.sps) || string(pps) != string(m.pps)) {
+		m.reset(sps, pps)
+	}
+	if m.init == nil {
+		return
+	}
+
+	if m.pending != nil {
+		duration := dts - m.pending.dts
+		if duration <= 0 {
+			duration = time.Millisecond // non-increasing DTS
+		}
+		m.appendSample(m.pending, duration)
+		if idr && dts-m.startDTS >= m.server.segment {
+			m.cut(dts)
+		}
+	}
+	if m.samples == nil {
+		m.startDTS = dts
+	}
+	m.pending = &sample{pts: pts, dts: dts, au: au, idr: idr}
+}
+
+// appendSample adds a sample to the segment being built.
+func (m *Muxer) appendSample(s *sample, duration time.Duration) {
+	fs := &fmp4.Sample{
+		Duration:        uint32(ticks(duration)),
+		PTSOffset:       int32(ticks(s.pts - s.dts)),
+		IsNonSyncSample: !s.idr,
+	}
+	if err := fs.FillH264(fs.PTSOffset, s.au); err != nil {
+		return
+	}
+	if m.samples == nil {
+		m.samples = []*fmp4.Sample{}
+	}
+	m.samples = append(m.samples, fs)
+}
+
+// cut closes the segment being built, which ends at end, and evicts segments that left
+// the window.
+func (m *Muxer) cut(end time.Duration) {
+	samples := m.samples
+	m.samples = nil
+	if len(samples) == 0 {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	part := fmp4.Part{
+		SequenceNumber: m.nextSeq,
+		Tracks: []*fmp4.PartTrack{{
+			ID:       1,
+			BaseTime: uint64(max(ticks(m.startDTS), 0)),
+			Samples:  samples,
+		}},
+	}
+	var buf seekablebuffer.Buffer
+	if err := part.Marshal(&buf); err != nil {
+		log.Printf("[Preview] ⚠️  Failed to write segment of %s: %v", m.streamPath, err)
+		return
+	}
+	m.segments = append(m.segments, &segment{seq: m.nextSeq, duration: end - m.startDTS, data: buf.Bytes()})
+	m.nextSeq++
+
+	total := time.Duration(0)
+	for _, seg := range m.segments {
+		total += seg.duration
+	}
+	for len(m.segments) > 1 && total-m.segments[0].duration >= m.server.window {
+		total -= m.segments[0].duration
+		m.segments = m.segments[1:]
+		m.server.evicted.Add(1)
+	}
+}
+
+// reset restarts the window with new parameter sets.
+func (m *Muxer) reset(sps, pps []byte) {
+	init := fmp4.Init{
+		Tracks: []*fmp4.InitTrack{{
+			ID:        1,
+			TimeScale: timeScale,
+			Codec:     &mp4.CodecH264{SPS: sps, PPS: pps},
+		}},
+	}
+	var buf seekablebuffer.Buffer
+	if err := init.Marshal(&buf); err != nil {
+		log.Printf("[Preview] ⚠️  Failed to write initialization segment of %s: %v", m.streamPath, err)
+		return
+	}
+
+	m.mutex.Lock()
+	if m.init != nil {
+		log.Printf("[Preview] Parameter sets of %s changed, restarting preview", m.streamPath)
+	}
+	m.init = buf.Bytes()
+	m.sps, m.pps = sps, pps
+	m.server.evicted.Add(uint64(len(m.segments)))
+	m.segments = nil
+	m.mutex.Unlock()
+
+	m.pending = nil
+	m.samples = nil
+}
+
+// Close removes the stream from the preview server.
+func (m *Muxer) Close() {
+	s := m.server
+	s.mutex.Lock()
+	if s.muxers[m.streamPath] == m {
+		delete(s.muxers, m.streamPath)
+	}
+	s.mutex.Unlock()
+}
+
+// playlist returns the media playlist of the window.
+func (m *Muxer) playlist() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	target := 1.0
+	for _, seg := range m.segments {
+		target = max(target, math.Ceil(seg.duration.Seconds()))
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	if len(m.segments) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.segments[0].seq)
+	}
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+	for _, seg := range m.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.m4s\n", seg.duration.Seconds(), seg.seq)
+	}
+	return []byte(b.String())
+}
+
+// initSegment returns the initialization segment.
+func (m *Muxer) initSegment() ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.init, m.init != nil
+}
+
+// mediaSegment returns a segment of the window.
+func (m *Muxer) mediaSegment(seq uint32) ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, seg := range m.segments {
+		if seg.seq == seq {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
+
+// ticks converts a duration to the time scale of the track.
+func ticks(d time.Duration) int64 {
+	return int64(d) * timeScale / int64(time.Second)
+}
+
+// envSeconds reads a positive number of seconds.
+func envSeconds(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		log.Printf("Warning: invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return time.Duration(n * float64(time.Second))
+}
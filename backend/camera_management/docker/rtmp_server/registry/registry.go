@@ -0,0 +1,271 @@
+// Package registry resolves RTMP publish keys to KVS stream settings stored in DynamoDB.
+// This lets the camera management backend onboard/offboard cameras without container changes.
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/sink"
+)
+
+// ErrNotFound is returned when a publish key has no registry entry.
+var ErrNotFound = errors.New("stream key not registered")
+
+// ErrDisabled is returned when a publish key is registered but disabled.
+var ErrDisabled = errors.New("stream key disabled")
+
+// Entry is a registered stream.
+//
+// Table layout (partition key configurable, default "stream_key"):
+//
+//	stream_key            S     publish key (last path element of rtmp://host/live/<key>)
+//	camera_id             S     camera ID in the camera management backend (optional)
+//	stream_name           S     target KVS stream name
+//	region                S     target KVS region (optional, defaults to AWS_REGION)
+//	retention_hours       N     KVS retention period (optional)
+//	fragment_duration_ms  N     kvssink fragment duration (optional)
+//	storage_size_mb       N     kvssink content store size in MiB (optional)
+//	max_bitrate_kbps      N     ingest bitrate cap of the publisher in kbit/s (optional)
+//	role_arn              S     IAM role assumed for writing to the stream (optional)
+//	external_id           S     external ID required by the role's trust policy (optional)
+//	account_id            S     AWS account the stream must be written to (optional)
+//	kms_key_id            S     KMS key the KVS stream is encrypted with (optional)
+//	sinks                 S     sinks besides KVS, comma-separated (file, s3, rtmp; optional)
+//	relay_url             S     RTMP(S) URL the rtmp sink re-publishes to (optional)
+//	shards                S     KVS streams the stream is sharded over, comma-separated (optional)
+//	shard_window_seconds  N     time window written to one shard (optional)
+//	shard_strategy        S     round_robin or least_loaded (optional)
+//	unsupported_video     S     ignore, reject or transcode video in codecs other than H.264 (optional)
+//	schedule              S     windows KVS forwarding is active in, e.g. "mon-fri 09:00-18:00" (optional)
+//	schedule_timezone     S     IANA time zone of the schedule (optional, defaults to UTC)
+//	schedule_mode         S     discard or buffer the frames outside the schedule (optional)
+//	pipeline_profile      S     default, low_latency or resilient pipeline buffering (optional)
+//	queue_max_bytes       N     pipeline queue limit in bytes, over the profile (optional)
+//	queue_max_buffers     N     pipeline queue limit in buffers, over the profile (optional)
+//	queue_max_time_ms     N     pipeline queue limit in ms, over the profile (optional)
+//	max_latency_seconds   N     kvssink max-latency, over the profile (optional)
+//	enabled               BOOL  whether publishing is allowed (optional, defaults to true)
+//	rekognition_labels    S     Rekognition labels to detect, comma-separated (PERSON, PET, PACKAGE, ALL; optional)
+//	rekognition_collection_id S Rekognition face collection to search (optional)
+//	rekognition_processor S     existing Rekognition stream processor to start instead (optional)
+type Entry struct {
+	StreamKey          string
+	CameraID           string
+	StreamName         string
+	Region             string
+	RetentionHours     int
+	FragmentDurationMs int
+	StorageSizeMB      int
+	MaxBitrateKbps     int
+	RoleARN            string // IAM role assumed for writing to the stream (optional)
+	ExternalID         string
+	AccountID          string // account the stream must be written to (optional)
+	KMSKeyID           string // KMS key the stream is created with and must be encrypted with (optional)
+	Sinks              []string
+	RelayURL           string
+	Enabled            bool
+
+	// Sharding over several KVS streams (optional)
+	Shards             []string
+	ShardWindowSeconds int
+	ShardStrategy      string
+
+	// Policy for video in codecs other than H.264 (optional)
+	UnsupportedVideo string
+
+	// Forwarding schedule (optional)
+	Schedule         string
+	ScheduleTimezone string
+	ScheduleMode     string
+
+	// Pipeline buffering (optional)
+	PipelineProfile   string
+	QueueMaxBytes     int
+	QueueMaxBuffers   int
+	QueueMaxTimeMs    int
+	MaxLatencySeconds int
+
+	// Rekognition Video analysis of the stream (optional)
+	RekognitionLabels       []string
+	RekognitionCollectionID string
+	RekognitionProcessor    string
+}
+
+type cacheEntry struct {
+	entry   *Entry
+	err     error
+	expires time.Time
+}
+
+// Registry looks up stream entries with a short TTL cache.
+type Registry struct {
+	table        string
+	keyAttribute string
+	region       string
+	ttl          time.Duration
+	db           *awsapi.DynamoDB
+
+	mutex sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// New creates a registry backed by the given DynamoDB table.
+func New(table, region string, ttl time.Duration) *Registry {
+	return &Registry{
+		table:        table,
+		keyAttribute: "stream_key",
+		region:       region,
+		ttl:          ttl,
+		db:           awsapi.NewDynamoDB(region),
+		cache:        make(map[string]cacheEntry),
+	}
+}
+
+// NewFromEnv creates a registry from REGISTRY_TABLE, REGISTRY_KEY_ATTRIBUTE and
+// REGISTRY_CACHE_TTL (seconds, default 60). It returns nil if REGISTRY_TABLE is not set.
+func NewFromEnv(region string) *Registry {
+	table := os.Getenv("REGISTRY_TABLE")
+	if table == "" {
+		return nil
+	}
+
+	ttl := 60 * time.Second
+	if v := os.Getenv("REGISTRY_CACHE_TTL"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+			ttl = time.Duration(seconds) * time.Second
+		} else {
+			log.Printf("[Registry] Invalid REGISTRY_CACHE_TTL %q, using %s", v, ttl)
+		}
+	}
+
+	r := New(table, region, ttl)
+	if attr := os.Getenv("REGISTRY_KEY_ATTRIBUTE"); attr != "" {
+		r.keyAttribute = attr
+	}
+
+	log.Printf("[Registry] Using DynamoDB table %s (key: %s, cache TTL: %s)", table, r.keyAttribute, ttl)
+	return r
+}
+
+// Lookup resolves a publish key. Results (including "not found") are cached for the TTL;
+// transient DynamoDB errors are not cached.
+func (r *Registry) Lookup(ctx context.Context, key string) (*Entry, error) {
+	r.mutex.Lock()
+	if cached, ok := r.cache[key]; ok && time.Now().Before(cached.expires) {
+		r.mutex.Unlock()
+		return cached.entry, cached.err
+	}
+	r.mutex.Unlock()
+
+	entry, err := r.fetch(ctx, key)
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrDisabled) {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	r.cache[key] = cacheEntry{entry: entry, err: err, expires: time.Now().Add(r.ttl)}
+	r.mutex.Unlock()
+
+	return entry, err
+}
+
+// Invalidate drops a cached entry so the next lookup hits DynamoDB.
+func (r *Registry) Invalidate(key string) {
+	r.mutex.Lock()
+	delete(r.cache, key)
+	r.mutex.Unlock()
+}
+
+func (r *Registry) fetch(ctx context.Context, key string) (*Entry, error) {
+	item, err := r.db.GetItem(ctx, r.table, awsapi.Item{r.keyAttribute: awsapi.String(key)}, false)
+	if err != nil {
+		return nil, fmt.Errorf("registry lookup failed: %w", err)
+	}
+	if item == nil {
+		return nil, ErrNotFound
+	}
+
+	entry := &Entry{StreamKey: key, Region: r.region, Enabled: true}
+	entry.CameraID, _ = item.GetString("camera_id")
+	entry.StreamName, _ = item.GetString("stream_name")
+	if region, ok := item.GetString("region"); ok && region != "" {
+		entry.Region = region
+	}
+	if hours, ok := item.GetInt("retention_hours"); ok {
+		entry.RetentionHours = int(hours)
+	}
+	if ms, ok := item.GetInt("fragment_duration_ms"); ok {
+		entry.FragmentDurationMs = int(ms)
+	}
+	if mb, ok := item.GetInt("storage_size_mb"); ok {
+		entry.StorageSizeMB = int(mb)
+	}
+	if kbps, ok := item.GetInt("max_bitrate_kbps"); ok {
+		entry.MaxBitrateKbps = int(kbps)
+	}
+	entry.RoleARN, _ = item.GetString("role_arn")
+	entry.ExternalID, _ = item.GetString("external_id")
+	entry.AccountID, _ = item.GetString("account_id")
+	entry.KMSKeyID, _ = item.GetString("kms_key_id")
+	if sinks, ok := item.GetString("sinks"); ok {
+		entry.Sinks = sink.ParseList(sinks)
+	}
+	entry.RelayURL, _ = item.GetString("relay_url")
+	if shards, ok := item.GetString("shards"); ok {
+		for _, shard := range strings.Split(shards, ",") {
+			if shard = strings.TrimSpace(shard); shard != "" {
+				entry.Shards = append(entry.Shards, shard)
+			}
+		}
+	}
+	if seconds, ok := item.GetInt("shard_window_seconds"); ok {
+		entry.ShardWindowSeconds = int(seconds)
+	}
+	entry.ShardStrategy, _ = item.GetString("shard_strategy")
+	entry.UnsupportedVideo, _ = item.GetString("unsupported_video")
+	entry.Schedule, _ = item.GetString("schedule")
+	entry.ScheduleTimezone, _ = item.GetString("schedule_timezone")
+	entry.ScheduleMode, _ = item.GetString("schedule_mode")
+	entry.PipelineProfile, _ = item.GetString("pipeline_profile")
+	if bytes, ok := item.GetInt("queue_max_bytes"); ok {
+		entry.QueueMaxBytes = int(bytes)
+	}
+	if buffers, ok := item.GetInt("queue_max_buffers"); ok {
+		entry.QueueMaxBuffers = int(buffers)
+	}
+	if ms, ok := item.GetInt("queue_max_time_ms"); ok {
+		entry.QueueMaxTimeMs = int(ms)
+	}
+	if seconds, ok := item.GetInt("max_latency_seconds"); ok {
+		entry.MaxLatencySeconds = int(seconds)
+	}
+	if labels, ok := item.GetString("rekognition_labels"); ok {
+		for _, label := range strings.Split(labels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				entry.RekognitionLabels = append(entry.RekognitionLabels, strings.ToUpper(label))
+			}
+		}
+	}
+	entry.RekognitionCollectionID, _ = item.GetString("rekognition_collection_id")
+	entry.RekognitionProcessor, _ = item.GetString("rekognition_processor")
+	if enabled, ok := item.GetBool("enabled"); ok {
+		entry.Enabled = enabled
+	}
+
+	if entry.StreamName == "" {
+		return nil, fmt.Errorf("registry entry for %s has no stream_name", key)
+	}
+	if !entry.Enabled {
+		return entry, ErrDisabled
+	}
+	return entry, nil
+}
@@ -0,0 +1,332 @@
+// Package rekognition starts a Rekognition Video stream processor on the KVS stream of
+// every publisher and stops it when the publisher disconnects, closing the loop between
+// ingest and analysis.
+package rekognition
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+	"rtmp_kvs/registry"
+)
+
+// How often a processor that is starting or stopping is polled before starting it
+const retryInterval = 5 * time.Second
+
+// Analysis is the Rekognition configuration of a stream.
+type Analysis struct {
+	Labels       []string // label detection (PERSON, PET, PACKAGE, ALL)
+	CollectionID string   // face search
+	Processor    string   // existing stream processor, used as is
+}
+
+func (a Analysis) empty() bool {
+	return len(a.Labels) == 0 && a.CollectionID == "" && a.Processor == ""
+}
+
+// labelDetection reports whether the processor detects labels. Label detection runs in
+// sessions of limited length; face search runs until stopped.
+func (a Analysis) labelDetection() bool {
+	return len(a.Labels) > 0
+}
+
+// Trigger starts and stops stream processors on StreamStarted and StreamStopped events.
+type Trigger struct {
+	region   string
+	registry *registry.Registry // per-stream configuration, nil to use the defaults only
+	defaults Analysis
+
+	// Settings of the processors created by the trigger
+	roleARN          string
+	bucket           string
+	keyPrefix        string
+	snsTopicARN      string
+	kinesisStreamARN string
+	minConfidence    float64
+	faceThreshold    float64
+	maxDuration      int // seconds per label detection session
+
+	mutex  sync.Mutex
+	active map[string]*run // by KVS stream name
+
+	sessions atomic.Uint64
+	failures atomic.Uint64
+}
+
+// run is the processor of one active stream.
+type run struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewFromEnv creates a trigger from REKOGNITION_ROLE_ARN (the role stream processors
+// created by the trigger use) and subscribes it to the server events. Streams are
+// analyzed as configured in the registry entry (rekognition_labels,
+// rekognition_collection_id, rekognition_processor), or else with REKOGNITION_LABELS /
+// REKOGNITION_COLLECTION_ID. Results of label detection go to REKOGNITION_S3_BUCKET
+// (REKOGNITION_S3_PREFIX) and REKOGNITION_SNS_TOPIC_ARN, face search results to
+// REKOGNITION_KINESIS_STREAM_ARN. It returns nil if REKOGNITION_ROLE_ARN is not set.
+func NewFromEnv(region string, reg *registry.Registry) *Trigger {
+	roleARN := os.Getenv("REKOGNITION_ROLE_ARN")
+	if roleARN == "" {
+		return nil
+	}
+	t := &Trigger{
+		region:   region,
+		registry: reg,
+		defaults: Analysis{
+			Labels:       splitLabels(os.Getenv("REKOGNITION_LABELS")),
+			CollectionID: os.Getenv("REKOGNITION_COLLECTION_ID"),
+		},
+		roleARN:          roleARN,
+		bucket:           os.Getenv("REKOGNITION_S3_BUCKET"),
+		keyPrefix:        os.Getenv("REKOGNITION_S3_PREFIX"),
+		snsTopicARN:      os.Getenv("REKOGNITION_SNS_TOPIC_ARN"),
+		kinesisStreamARN: os.Getenv("REKOGNITION_KINESIS_STREAM_ARN"),
+		minConfidence:    envFloat("REKOGNITION_MIN_CONFIDENCE", 0),
+		faceThreshold:    envFloat("REKOGNITION_FACE_MATCH_THRESHOLD", 0),
+		maxDuration:      int(envFloat("REKOGNITION_MAX_DURATION", 120)),
+		active:           make(map[string]*run),
+	}
+	events.Subscribe(t)
+	log.Printf("[Rekognition] Starting stream processors for publishers (default labels %v, collection %q)",
+		t.defaults.Labels, t.defaults.CollectionID)
+	return t
+}
+
+// Handle implements events.Subscriber.
+func (t *Trigger) Handle(e events.Event) {
+	switch e.Type {
+	case events.StreamStarted:
+		t.start(e)
+	case events.StreamStopped:
+		t.stop(e.StreamName)
+	}
+}
+
+// start runs the processor of a stream until the stream stops.
+func (t *Trigger) start(e events.Event) {
+	t.stop(e.StreamName) // a replaced publisher of the same stream
+
+	ctx, cancel := context.WithCancel(awsapi.WithStreamPath(context.Background(), e.StreamPath))
+	r := &run{cancel: cancel, done: make(chan struct{})}
+	t.mutex.Lock()
+	t.active[e.StreamName] = r
+	t.mutex.Unlock()
+
+	go func() {
+		defer close(r.done)
+		if err := t.run(ctx, e); err != nil && ctx.Err() == nil {
+			t.failures.Add(1)
+			log.Printf("[Rekognition] ⚠️  Stream processor for %s failed: %v", e.StreamName, err)
+		}
+	}()
+}
+
+// stop stops the processor of a stream and waits for it.
+func (t *Trigger) stop(streamName string) {
+	t.mutex.Lock()
+	r := t.active[streamName]
+	delete(t.active, streamName)
+	t.mutex.Unlock()
+	if r != nil {
+		r.cancel()
+		<-r.done
+	}
+}
+
+// run starts the processor and keeps it running until ctx is cancelled, then stops it.
+func (t *Trigger) run(ctx context.Context, e events.Event) error {
+	analysis, region, err := t.analysis(ctx, e)
+	if err != nil || analysis.empty() {
+		return err
+	}
+	client := awsapi.NewRekognition(region)
+
+	name := analysis.Processor
+	if name == "" {
+		name = "rtmp-kvs-" + e.StreamName
+		if err := t.ensure(ctx, client, region, name, e.StreamName, analysis); err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if err := client.StopStreamProcessor(stopCtx, name); err != nil && !awsapi.IsCode(err, "ResourceInUseException") {
+			log.Printf("[Rekognition] ⚠️  Failed to stop stream processor %s: %v", name, err)
+			return
+		}
+		log.Printf("[Rekognition] Stopped stream processor %s", name)
+	}()
+
+	for {
+		if err := t.startSession(ctx, client, name, analysis); err != nil {
+			return err
+		}
+		if !analysis.labelDetection() {
+			<-ctx.Done()
+			return nil
+		}
+		// Label detection sessions end after maxDuration; start the next one while the
+		// stream is still up
+		select {
+		case <-time.After(time.Duration(t.maxDuration)*time.Second + retryInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// startSession starts the processor once it is idle. A processor that is still stopping
+// (the previous session of a reconnecting publisher) is waited for.
+func (t *Trigger) startSession(ctx context.Context, client *awsapi.Rekognition, name string, analysis Analysis) error {
+	for {
+		status, err := client.StreamProcessorStatus(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to describe stream processor %s: %w", name, err)
+		}
+		switch status {
+		case "RUNNING":
+			if !analysis.labelDetection() {
+				log.Printf("[Rekognition] Stream processor %s is already running", name)
+				return nil
+			}
+		case "STOPPED", "FAILED":
+			var startMillis int64
+			var maxSeconds int
+			if analysis.labelDetection() {
+				startMillis, maxSeconds = time.Now().UnixMilli(), t.maxDuration
+			}
+			err := client.StartStreamProcessor(ctx, name, startMillis, maxSeconds)
+			if err == nil {
+				t.sessions.Add(1)
+				log.Printf("[Rekognition] ✅ Started stream processor %s", name)
+				return nil
+			}
+			if !awsapi.IsCode(err, "ResourceInUseException") {
+				return fmt.Errorf("failed to start stream processor %s: %w", name, err)
+			}
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// ensure creates the processor of a stream if it does not exist yet.
+func (t *Trigger) ensure(ctx context.Context, client *awsapi.Rekognition, region, name, streamName string, analysis Analysis) error {
+	_, err := client.StreamProcessorStatus(ctx, name)
+	if err == nil || !awsapi.IsCode(err, "ResourceNotFoundException") {
+		return err
+	}
+
+	streamARN, err := awsapi.NewKinesisVideo(region).StreamARN(ctx, streamName)
+	if err != nil {
+		return fmt.Errorf("failed to describe KVS stream %s: %w", streamName, err)
+	}
+	p := &awsapi.StreamProcessor{Name: name, RoleArn: t.roleARN}
+	p.Input.KinesisVideoStream.Arn = streamARN
+	if analysis.labelDetection() {
+		if t.bucket == "" {
+			return fmt.Errorf("label detection needs REKOGNITION_S3_BUCKET")
+		}
+		p.Settings.ConnectedHome = &awsapi.ConnectedHomeSettings{Labels: analysis.Labels, MinConfidence: t.minConfidence}
+		p.Output.S3Destination = &awsapi.S3Destination{Bucket: t.bucket, KeyPrefix: t.keyPrefix}
+		if t.snsTopicARN != "" {
+			p.NotificationChannel = &awsapi.StreamProcessorSNS{SNSTopicArn: t.snsTopicARN}
+		}
+	} else {
+		if t.kinesisStreamARN == "" {
+			return fmt.Errorf("face search needs REKOGNITION_KINESIS_STREAM_ARN")
+		}
+		p.Settings.FaceSearch = &awsapi.FaceSearchSettings{CollectionId: analysis.CollectionID, FaceMatchThreshold: t.faceThreshold}
+		p.Output.KinesisDataStream = &awsapi.KinesisARN{Arn: t.kinesisStreamARN}
+	}
+	if err := client.CreateStreamProcessor(ctx, p); err != nil {
+		return fmt.Errorf("failed to create stream processor %s: %w", name, err)
+	}
+	log.Printf("[Rekognition] Created stream processor %s for %s", name, streamName)
+	return nil
+}
+
+// analysis returns the configuration and region of a stream: its registry entry if it
+// has one with Rekognition settings, the defaults otherwise.
+func (t *Trigger) analysis(ctx context.Context, e events.Event) (Analysis, string, error) {
+	if t.registry != nil && e.StreamPath != "" {
+		entry, err := t.registry.Lookup(ctx, path.Base(e.StreamPath))
+		if err == nil {
+			analysis := Analysis{
+				Labels:       entry.RekognitionLabels,
+				CollectionID: entry.RekognitionCollectionID,
+				Processor:    entry.RekognitionProcessor,
+			}
+			if !analysis.empty() {
+				return analysis, entry.Region, nil
+			}
+		}
+	}
+	return t.defaults, t.region, nil
+}
+
+// Close stops all processors (server shutdown).
+func (t *Trigger) Close() {
+	t.mutex.Lock()
+	names := make([]string, 0, len(t.active))
+	for name := range t.active {
+		names = append(names, name)
+	}
+	t.mutex.Unlock()
+	for _, name := range names {
+		t.stop(name)
+	}
+}
+
+// CollectMetrics writes the number of sessions started, failures and active processors.
+func (t *Trigger) CollectMetrics(w *metrics.Writer) {
+	t.mutex.Lock()
+	active := len(t.active)
+	t.mutex.Unlock()
+	w.Gauge("rtmp_rekognition_active_processors", "Rekognition stream processors run for active streams", float64(active))
+	w.Counter("rtmp_rekognition_sessions_total", "Rekognition stream processor sessions started", float64(t.sessions.Load()))
+	w.Counter("rtmp_rekognition_errors_total", "Rekognition stream processors that could not be created or started", float64(t.failures.Load()))
+}
+
+// splitLabels parses a comma-separated label list.
+func splitLabels(list string) []string {
+	var labels []string
+	for _, label := range strings.Split(list, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, strings.ToUpper(label))
+		}
+	}
+	return labels
+}
+
+// envFloat reads a non-negative number, falling back to def.
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		log.Printf("[Rekognition] ⚠️  Invalid %s %q, using %v", name, value, def)
+		return def
+	}
+	return f
+}
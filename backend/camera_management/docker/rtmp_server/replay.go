@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/replay"
+	"rtmp_kvs/state"
+)
+
+// runReplay implements the "replay" subcommand: it reads a recorded FLV/MP4 file and pushes
+// its H.264 access units through the KVS forwarder as if they had arrived via RTMP.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "FLV or MP4 file to replay (required)")
+	streamName := fs.String("stream", os.Getenv("STREAM_NAME"), "KVS stream name (defaults to STREAM_NAME)")
+	awsRegion := fs.String("region", os.Getenv("AWS_REGION"), "AWS region (defaults to AWS_REGION)")
+	realtime := fs.Bool("realtime", true, "Pace frames according to their original timestamps")
+	loop := fs.Int("loop", 1, "Number of times to replay the file (0 = forever)")
+	startTime := fs.String("start-time", "", "Original time of the first frame (RFC 3339, or \"name\" for the time in a file sink name such as cam1-20250101-093000.flv): backfills the footage at its original timestamps with the KVS offline streaming type")
+	resume := fs.Bool("resume", true, "With -start-time and STATE_DIR or STATE_TABLE: skip the footage a previous run of the same backfill already persisted")
+	fs.Parse(args)
+
+	if *file == "" {
+		log.Fatal("-file is required")
+	}
+	if *streamName == "" {
+		log.Fatal("-stream or STREAM_NAME environment variable is required")
+	}
+	credManager := kvs.NewCredentialManager()
+	if err := credManager.RefreshCredentials(); err != nil {
+		log.Printf("Warning: Initial credential refresh failed: %v", err)
+	}
+
+	kvsForwarder := kvs.NewForwarder(*streamName, *awsRegion)
+	if *awsRegion == "" && !kvsForwarder.FileSink() {
+		log.Fatal("-region or AWS_REGION environment variable is required")
+	}
+
+	// Stop replaying on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	// Optional state of the stream: the counters continue, and a backfill interrupted by
+	// a stopped task resumes after the footage KVS persisted
+	keeper := state.NewFromEnv(*awsRegion, state.Forwarders{kvsForwarder})
+	var saved *kvs.StreamState
+	if keeper != nil {
+		saved = keeper.Restore(kvsForwarder)
+		defer keeper.Close()
+		go keeper.Run(ctx)
+	}
+
+	player := &replay.Player{Realtime: *realtime, Done: ctx.Done()}
+	if *startTime != "" {
+		start, err := parseReplayStart(*startTime, *file)
+		if err != nil {
+			log.Fatalf("Invalid -start-time: %v", err)
+		}
+		source := filepath.Base(*file)
+		kvsForwarder.SetBackfillSource(source, start)
+		kvsForwarder.SetReplayStart(start)
+		if resumeAt, ok := saved.Resume(source, start); ok && *resume {
+			log.Printf("[Replay] Resuming the backfill of %s after %s, persisted by a previous run", source, resumeAt.Format(time.RFC3339Nano))
+			player.Skip = resumeSkip(kvsForwarder, start, resumeAt)
+		}
+	}
+	// The pipeline is not bound to ctx, so the deferred Close still flushes it on interrupt.
+	// A resumed backfill starts it at its first frame written.
+	if player.Skip == nil {
+		if err := kvsForwarder.Start(context.Background()); err != nil {
+			log.Fatalf("Failed to start KVS forwarder: %v", err)
+		}
+	}
+	defer kvsForwarder.Close()
+
+	write := func(pts, dts time.Duration, au [][]byte) {
+		kvsForwarder.WriteH264(ctx, pts, dts, au)
+	}
+	for i := 0; *loop == 0 || i < *loop; i++ {
+		if ctx.Err() != nil {
+			log.Println("[Replay] Interrupted, stopping...")
+			return
+		}
+
+		src, err := replay.Open(*file)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *file, err)
+		}
+
+		log.Printf("[Replay] Replaying %s to stream %s (pass %d)", *file, *streamName, i+1)
+		end, frames, err := player.Play(src, write)
+		src.Close()
+		if err != nil {
+			log.Printf("[Replay] Replay failed after %d frames: %v", frames, err)
+			return
+		}
+		if ctx.Err() != nil {
+			log.Printf("[Replay] Interrupted after %d frames", frames)
+			return
+		}
+		log.Printf("[Replay] Pass %d finished: %d frames", i+1, frames)
+
+		// Continue the timeline on the next pass
+		player.Offset = end
+	}
+}
+
+// resumeSkip returns a replay.Player Skip function that skips the footage starting at
+// start up to the first keyframe after resumeAt, the last fragment persisted by a previous
+// run, and starts the forwarder in the offline streaming type at that keyframe.
+func resumeSkip(f *kvs.Forwarder, start, resumeAt time.Time) func(time.Duration, bool) bool {
+	var first time.Duration
+	seen, resumed := false, false
+	skipped := 0
+	return func(dts time.Duration, keyframe bool) bool {
+		if resumed {
+			return false
+		}
+		if !seen {
+			first, seen = dts, true
+		}
+		at := start.Add(dts - first)
+		if !keyframe || !at.After(resumeAt) {
+			skipped++
+			return true
+		}
+
+		resumed = true
+		log.Printf("[Replay] Skipped %d frames, resuming at %s", skipped, at.Format(time.RFC3339Nano))
+		f.SetReplayStart(at)
+		if err := f.Start(context.Background()); err != nil {
+			log.Fatalf("Failed to start KVS forwarder: %v", err)
+		}
+		return false
+	}
+}
+
+// fileSinkTime matches the start time in the name of a file sink recording
+// (<stream>-20060102-150405.<format>).
+var fileSinkTime = regexp.MustCompile(`-(\d{8}-\d{6})\.[a-z0-9]+$`)
+
+// parseReplayStart parses the -start-time flag: an RFC 3339 time, or "name" for the
+// local time in the name of a file sink recording.
+func parseReplayStart(value, file string) (time.Time, error) {
+	if value != "name" {
+		return time.Parse(time.RFC3339, value)
+	}
+	m := fileSinkTime.FindStringSubmatch(filepath.Base(file))
+	if m == nil {
+		return time.Time{}, fmt.Errorf("%s has no time in its name", file)
+	}
+	return time.ParseInLocation("20060102-150405", m[1], time.Local)
+}
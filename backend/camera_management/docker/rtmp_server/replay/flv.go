@@ -0,0 +1,59 @@
+// Package replay reads recorded FLV/MP4 files and replays their H.264 access units.
+package replay
+
+import (
+	"io"
+	"time"
+
+	"rtmp_kvs/flv"
+)
+
+// FLVSource reads H.264 access units from an FLV file.
+type FLVSource struct {
+	closer io.Closer
+	r      *flv.Reader
+}
+
+// NewFLVSource creates an FLV source and validates the file header.
+func NewFLVSource(rc io.ReadCloser) (*FLVSource, error) {
+	r, err := flv.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &FLVSource{closer: rc, r: r}, nil
+}
+
+// ReadFrame returns the next H.264 access unit. Sequence headers are returned as [SPS, PPS],
+// matching what gortmplib delivers for live RTMP publishers.
+func (s *FLVSource) ReadFrame() (*Frame, error) {
+	for {
+		tag, err := s.r.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+
+		if tag.Type != flv.TagVideo {
+			continue
+		}
+
+		cts, au, err := flv.ParseH264(tag.Data)
+		if err != nil {
+			return nil, err
+		}
+		if au == nil {
+			continue
+		}
+
+		dts := time.Duration(tag.Timestamp) * time.Millisecond
+		return &Frame{
+			PTS: dts + time.Duration(cts)*time.Millisecond,
+			DTS: dts,
+			AU:  au,
+		}, nil
+	}
+}
+
+// Close closes the underlying file.
+func (s *FLVSource) Close() error {
+	return s.closer.Close()
+}
@@ -0,0 +1,97 @@
+// Package replay reads recorded FLV/MP4 files and replays their H.264 access units.
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mp4/codecs"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/pmp4"
+)
+
+// MP4Source reads H.264 access units from the first H.264 track of an MP4 file.
+type MP4Source struct {
+	file      *os.File
+	track     *pmp4.Track
+	codec     *codecs.H264
+	next      int
+	dts       int64
+	sentParam bool
+}
+
+// NewMP4Source opens an MP4 file and locates its H.264 track.
+func NewMP4Source(path string) (*MP4Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var pres pmp4.Presentation
+	if err := pres.Unmarshal(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to parse MP4: %w", err)
+	}
+
+	for _, track := range pres.Tracks {
+		if codec, ok := track.Codec.(*codecs.H264); ok {
+			return &MP4Source{
+				file:  f,
+				track: track,
+				codec: codec,
+				dts:   int64(track.TimeOffset),
+			}, nil
+		}
+	}
+
+	f.Close()
+	return nil, errors.New("no H.264 track found in MP4 file")
+}
+
+// ReadFrame returns the next H.264 access unit. The first frame is preceded by SPS/PPS.
+func (s *MP4Source) ReadFrame() (*Frame, error) {
+	if !s.sentParam {
+		s.sentParam = true
+		ts := s.toDuration(s.dts)
+		return &Frame{PTS: ts, DTS: ts, AU: [][]byte{s.codec.SPS, s.codec.PPS}}, nil
+	}
+
+	if s.next >= len(s.track.Samples) {
+		return nil, io.EOF
+	}
+
+	sample := s.track.Samples[s.next]
+	s.next++
+
+	payload, err := sample.GetPayload()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sample %d: %w", s.next-1, err)
+	}
+
+	var au h264.AVCC
+	if err := au.Unmarshal(payload); err != nil {
+		return nil, fmt.Errorf("failed to decode sample %d: %w", s.next-1, err)
+	}
+
+	frame := &Frame{
+		DTS: s.toDuration(s.dts),
+		PTS: s.toDuration(s.dts + int64(sample.PTSOffset)),
+		AU:  au,
+	}
+	s.dts += int64(sample.Duration)
+
+	return frame, nil
+}
+
+// Close closes the underlying file.
+func (s *MP4Source) Close() error {
+	return s.file.Close()
+}
+
+func (s *MP4Source) toDuration(v int64) time.Duration {
+	ts := int64(s.track.TimeScale)
+	return time.Duration(v/ts)*time.Second + time.Duration(v%ts)*time.Second/time.Duration(ts)
+}
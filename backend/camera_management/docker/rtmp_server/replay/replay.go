@@ -0,0 +1,134 @@
+// Package replay reads recorded FLV/MP4 files and replays their H.264 access units.
+package replay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Frame is a single H.264 access unit with its original timestamps.
+type Frame struct {
+	PTS time.Duration
+	DTS time.Duration
+	AU  [][]byte
+}
+
+// Keyframe reports whether the frame contains an IDR picture.
+func (f *Frame) Keyframe() bool {
+	for _, nalu := range f.AU {
+		if len(nalu) > 0 && nalu[0]&0x1F == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// Source produces frames in decode order. ReadFrame returns io.EOF at the end of the input.
+type Source interface {
+	ReadFrame() (*Frame, error)
+	Close() error
+}
+
+// WriteFunc receives replayed frames. It has the same signature as kvs.Forwarder.WriteH264.
+type WriteFunc func(pts, dts time.Duration, au [][]byte)
+
+// Open opens a recorded file, selecting the container format from the file extension.
+func Open(path string) (Source, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flv":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		src, err := NewFLVSource(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return src, nil
+
+	case ".mp4", ".m4v", ".mov":
+		return NewMP4Source(path)
+
+	default:
+		return nil, fmt.Errorf("unsupported file format: %s", path)
+	}
+}
+
+// Player pushes frames from a Source to a WriteFunc.
+type Player struct {
+	// Realtime paces frames according to their DTS instead of sending as fast as possible.
+	Realtime bool
+
+	// Offset is added to every timestamp, so that consecutive loops keep increasing.
+	Offset time.Duration
+
+	// Done aborts playback when closed.
+	Done <-chan struct{}
+
+	// Skip, if set, is called with the DTS (including Offset) of every frame; frames it
+	// returns true for are neither paced nor written, but count towards the timeline.
+	Skip func(dts time.Duration, keyframe bool) bool
+}
+
+// Play reads all frames from src and passes them to write.
+// It returns the end of the replayed timeline (last DTS plus one frame interval, including
+// Offset), suitable as the Offset of a following pass, and the number of frames written.
+func (p *Player) Play(src Source, write WriteFunc) (time.Duration, int, error) {
+	var start time.Time
+	var firstDTS time.Duration
+	var lastDTS time.Duration
+	var frameInterval time.Duration
+	var hasDTS bool
+	count := 0
+
+	for {
+		select {
+		case <-p.Done:
+			return lastDTS + frameInterval, count, nil
+		default:
+		}
+
+		frame, err := src.ReadFrame()
+		if err == io.EOF {
+			return lastDTS + frameInterval, count, nil
+		}
+		if err != nil {
+			return lastDTS + frameInterval, count, err
+		}
+
+		dts := frame.DTS + p.Offset
+		if hasDTS && dts > lastDTS {
+			frameInterval = dts - lastDTS
+		}
+		lastDTS, hasDTS = dts, true
+		if p.Skip != nil && p.Skip(dts, frame.Keyframe()) {
+			continue
+		}
+
+		if count == 0 {
+			start = time.Now()
+			firstDTS = frame.DTS
+		}
+
+		if p.Realtime {
+			// Sleep until the frame's position on the original timeline
+			if wait := (frame.DTS - firstDTS) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		write(frame.PTS+p.Offset, dts, frame.AU)
+		count++
+
+		// Log progress every 300 frames
+		if count%300 == 0 {
+			log.Printf("[Replay] Replayed %d frames (DTS: %s)", count, lastDTS)
+		}
+	}
+}
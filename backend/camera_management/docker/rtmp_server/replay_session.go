@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os/signal"
+	"time"
+
+	"github.com/bluenviron/gortmplib/pkg/handshake"
+
+	"rtmp_kvs/capture"
+)
+
+// Size of the client side of the plain RTMP handshake (C0, C1, C2)
+const handshakeSize = 1 + 1536 + 1536
+
+// runReplaySession implements the "replay-session" subcommand: it sends the bytes of a
+// captured RTMP session (SESSION_CAPTURE) to a server, with the original timing, to
+// reproduce problems of a camera without the device. The handshake is performed anew;
+// the server's responses are read and discarded.
+func runReplaySession(args []string) {
+	fs := flag.NewFlagSet("replay-session", flag.ExitOnError)
+	file := fs.String("file", "", "Session capture (.rtmpcap) to replay (required)")
+	target := fs.String("url", "rtmp://127.0.0.1:1935", "Server to replay to (rtmp:// or rtmps://; the path is taken from the capture)")
+	realtime := fs.Bool("realtime", true, "Pace the data according to its original arrival times")
+	insecure := fs.Bool("insecure", false, "Skip TLS certificate verification (rtmps)")
+	linger := fs.Duration("linger", 2*time.Second, "Time to keep the connection open after the last byte")
+	fs.Parse(args)
+
+	if *file == "" {
+		log.Fatal("-file is required")
+	}
+	src, err := capture.Open(*file)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", *file, err)
+	}
+	defer src.Close()
+	h := src.Header
+	log.Printf("[Replay] Session of %s (%s %s) started %s: %d bytes, ended with %q",
+		h.RemoteAddr, h.Protocol, h.StreamPath, h.StartedAt.Format(time.RFC3339), h.Bytes, h.Error)
+	if h.Truncated {
+		log.Printf("[Replay] ⚠️  The capture was truncated at the size limit, the session ends early")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	conn, err := dialReplayTarget(ctx, *target, *insecure)
+	if err != nil {
+		log.Fatalf("Failed to connect to %s: %v", *target, err)
+	}
+	defer conn.Close()
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	// The captured handshake answered another server's S1, so it is replaced
+	if _, _, err := handshake.DoClient(conn, false, false); err != nil {
+		log.Fatalf("Handshake failed: %v", err)
+	}
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	skip, sent := handshakeSize, 0
+	start, first := time.Now(), time.Duration(-1)
+	for {
+		chunk, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", *file, err)
+		}
+
+		data := chunk.Data
+		if skip > 0 {
+			if skip == handshakeSize && len(data) > 0 && data[0] != 3 {
+				log.Fatal("The capture uses an encrypted handshake (RTMPE) and cannot be replayed")
+			}
+			n := min(skip, len(data))
+			skip -= n
+			data = data[n:]
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		if *realtime {
+			// Timing is relative to the first data after the handshake
+			if first < 0 {
+				first = chunk.At
+			}
+			if wait := time.Until(start.Add(chunk.At - first)); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if _, err := conn.Write(data); err != nil {
+			log.Printf("[Replay] Server closed the connection after %d bytes: %v", sent, err)
+			return
+		}
+		sent += len(data)
+	}
+	log.Printf("[Replay] Sent %d bytes in %s, waiting %s for the server", sent, time.Since(start).Round(time.Millisecond), *linger)
+
+	select {
+	case n := <-received:
+		log.Printf("[Replay] Server closed the connection (%d bytes received)", n)
+	case <-time.After(*linger):
+		conn.Close()
+		log.Printf("[Replay] Done (%d bytes received)", <-received)
+	case <-ctx.Done():
+	}
+}
+
+// dialReplayTarget connects to an rtmp:// or rtmps:// URL.
+func dialReplayTarget(ctx context.Context, rawURL string, insecure bool) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "rtmp":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1935")
+		}
+		return dialer.DialContext(ctx, "tcp", host)
+	case "rtmps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: insecure,
+		}}
+		return tlsDialer.DialContext(ctx, "tcp", host)
+	default:
+		return nil, errors.New("the URL must start with rtmp:// or rtmps://")
+	}
+}
@@ -0,0 +1,181 @@
+// Package schedule parses the time-of-day windows a stream is forwarded to KVS in, such as
+// "mon-fri 09:00-18:00; sat,sun 10:00-17:00", and evaluates them in a time zone.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the container image has no zoneinfo
+)
+
+// Schedule is a set of weekly windows in a time zone.
+type Schedule struct {
+	spec     string
+	location *time.Location
+	windows  []window
+}
+
+// window is active on its days from start to end, in minutes since midnight. A window
+// with end <= start runs past midnight into the next day.
+type window struct {
+	days       [7]bool // by time.Weekday
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Parse parses a schedule: windows separated by ";", each an optional list of days and a
+// time range, e.g. "mon-fri 09:00-18:00; sat,sun 10:00-17:00", "22:00-06:00" (every
+// night) or "daily 00:00-24:00". Days are mon to sun, ranges of them (fri-mon wraps), or
+// "daily" / "*". A range that ends at or before its start runs past midnight. timezone
+// is an IANA time zone such as "Asia/Tokyo", UTC when empty.
+func Parse(spec, timezone string) (*Schedule, error) {
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid time zone %q: %w", timezone, err)
+		}
+	}
+	s := &Schedule{spec: spec, location: location}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		w, err := parseWindow(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule window %q: %w", part, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	if len(s.windows) == 0 {
+		return nil, fmt.Errorf("schedule %q has no window", spec)
+	}
+	return s, nil
+}
+
+// parseWindow parses "[days] HH:MM-HH:MM".
+func parseWindow(text string) (window, error) {
+	var w window
+	fields := strings.Fields(text)
+	var days, hours string
+	switch len(fields) {
+	case 1:
+		days, hours = "daily", fields[0]
+	case 2:
+		days, hours = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+
+	for _, item := range strings.Split(strings.ToLower(days), ",") {
+		if item == "daily" || item == "*" {
+			w.days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		first, last, isRange := strings.Cut(item, "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return w, fmt.Errorf("unknown day %q", last)
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(hours, "-")
+	if !ok {
+		return w, fmt.Errorf("expected a time range HH:MM-HH:MM, got %q", hours)
+	}
+	var err error
+	if w.start, err = parseTime(start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseTime(end); err != nil {
+		return w, err
+	}
+	if w.start == 24*60 {
+		return w, fmt.Errorf("window starts at 24:00")
+	}
+	return w, nil
+}
+
+// parseTime parses HH:MM (00:00 to 24:00) into minutes since midnight.
+func parseTime(text string) (int, error) {
+	h, m, ok := strings.Cut(text, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", text)
+	}
+	return hours*60 + minutes, nil
+}
+
+// Active reports whether t is within a window of the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	local := t.In(s.location)
+	day := local.Weekday()
+	yesterday := (day + 6) % 7
+	minute := local.Hour()*60 + local.Minute()
+	for _, w := range s.windows {
+		if w.end > w.start {
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// Past midnight: from start on its day to end on the next day
+		if (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns when the schedule next changes from active to inactive or back after t,
+// the zero time if it never does.
+func (s *Schedule) Next(t time.Time) time.Time {
+	active := s.Active(t)
+	local := t.In(s.location)
+	var next time.Time
+	for offset := 0; offset <= 8; offset++ {
+		for _, w := range s.windows {
+			for _, minute := range []int{w.start, w.end} {
+				at := time.Date(local.Year(), local.Month(), local.Day()+offset, minute/60, minute%60, 0, 0, s.location)
+				if at.After(t) && (next.IsZero() || at.Before(next)) && s.Active(at) != active {
+					next = at
+				}
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return next
+}
+
+// Location returns the time zone of the schedule.
+func (s *Schedule) Location() *time.Location {
+	return s.location
+}
+
+// String returns the schedule as parsed.
+func (s *Schedule) String() string {
+	return s.spec
+}
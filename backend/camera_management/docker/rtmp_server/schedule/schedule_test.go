@@ -0,0 +1,138 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// at returns a time in the first week of 2024, which starts on Monday January 1.
+func at(day, hour, minute int, location *time.Location) time.Time {
+	return time.Date(2024, time.January, day, hour, minute, 0, 0, location)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec     string
+		timezone string
+		wantErr  string
+	}{
+		{spec: "09:00-18:00"},
+		{spec: "mon-fri 09:00-18:00; sat,sun 10:00-17:00"},
+		{spec: "daily 00:00-24:00"},
+		{spec: "* 22:00-06:00"},
+		{spec: "FRI-MON 20:00-04:00"},
+		{spec: "mon 09:00-18:00;", timezone: "Asia/Tokyo"},
+		{spec: "", wantErr: "has no window"},
+		{spec: " ; ", wantErr: "has no window"},
+		{spec: "mon-fri 09:00 18:00", wantErr: "expected [days]"},
+		{spec: "weekdays 09:00-18:00", wantErr: "unknown day"},
+		{spec: "mon-xyz 09:00-18:00", wantErr: "unknown day"},
+		{spec: "mon 09:00", wantErr: "expected a time range"},
+		{spec: "mon 9-18", wantErr: "invalid time"},
+		{spec: "mon 09:60-18:00", wantErr: "invalid time"},
+		{spec: "mon 09:00-24:30", wantErr: "invalid time"},
+		{spec: "mon 09:00-25:00", wantErr: "invalid time"},
+		{spec: "mon -01:00-18:00", wantErr: "invalid time"},
+		{spec: "mon 24:00-06:00", wantErr: "starts at 24:00"},
+		{spec: "09:00-18:00", timezone: "Mars/Olympus_Mons", wantErr: "invalid time zone"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.spec, tt.timezone)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("Parse(%q, %q): %v", tt.spec, tt.timezone, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Parse(%q, %q): err = %v, want %q", tt.spec, tt.timezone, err, tt.wantErr)
+		}
+	}
+}
+
+func TestActive(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		spec     string
+		timezone string
+		time     time.Time
+		want     bool
+	}{
+		{"before start", "mon-fri 09:00-18:00", "", at(1, 8, 59, time.UTC), false},
+		{"at start", "mon-fri 09:00-18:00", "", at(1, 9, 0, time.UTC), true},
+		{"before end", "mon-fri 09:00-18:00", "", at(5, 17, 59, time.UTC), true},
+		{"at end", "mon-fri 09:00-18:00", "", at(5, 18, 0, time.UTC), false},
+		{"other day", "mon-fri 09:00-18:00", "", at(6, 12, 0, time.UTC), false},
+		{"second window", "mon-fri 09:00-18:00; sat,sun 10:00-17:00", "", at(7, 10, 0, time.UTC), true},
+		{"whole day", "daily 00:00-24:00", "", at(3, 23, 59, time.UTC), true},
+
+		// Windows past midnight run from start on their days to end on the next day
+		{"wrap before start", "fri 22:00-06:00", "", at(5, 21, 59, time.UTC), false},
+		{"wrap at start", "fri 22:00-06:00", "", at(5, 22, 0, time.UTC), true},
+		{"wrap at midnight", "fri 22:00-06:00", "", at(6, 0, 0, time.UTC), true},
+		{"wrap next morning", "fri 22:00-06:00", "", at(6, 5, 59, time.UTC), true},
+		{"wrap at end", "fri 22:00-06:00", "", at(6, 6, 0, time.UTC), false},
+		{"wrap morning of the day", "fri 22:00-06:00", "", at(5, 5, 0, time.UTC), false},
+		{"wrap saturday night", "fri 22:00-06:00", "", at(6, 23, 0, time.UTC), false},
+		{"nightly", "22:00-06:00", "", at(3, 3, 0, time.UTC), true},
+		{"nightly daytime", "22:00-06:00", "", at(3, 12, 0, time.UTC), false},
+		{"equal start and end", "mon 09:00-09:00", "", at(2, 8, 59, time.UTC), true},
+		{"equal start and end after", "mon 09:00-09:00", "", at(2, 9, 0, time.UTC), false},
+
+		// Day ranges wrap over the end of the week
+		{"day range wrap sunday", "fri-mon 10:00-11:00", "", at(7, 10, 30, time.UTC), true},
+		{"day range wrap monday", "fri-mon 10:00-11:00", "", at(1, 10, 30, time.UTC), true},
+		{"day range wrap tuesday", "fri-mon 10:00-11:00", "", at(2, 10, 30, time.UTC), false},
+
+		// Evaluated in the time zone of the schedule
+		{"time zone", "mon 09:00-18:00", "Asia/Tokyo", at(1, 0, 0, time.UTC), true},
+		{"time zone other day", "mon 09:00-18:00", "Asia/Tokyo", at(1, 9, 0, time.UTC), false},
+		{"time zone local", "mon 09:00-18:00", "Asia/Tokyo", at(1, 9, 0, tokyo), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.spec, tt.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Active(tt.time); got != tt.want {
+				t.Errorf("Active(%s) = %v, want %v", tt.time, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		time time.Time
+		want time.Time
+	}{
+		{"until start", "mon-fri 09:00-18:00", at(1, 8, 0, time.UTC), at(1, 9, 0, time.UTC)},
+		{"until end", "mon-fri 09:00-18:00", at(1, 9, 0, time.UTC), at(1, 18, 0, time.UTC)},
+		{"over the weekend", "mon-fri 09:00-18:00", at(5, 18, 0, time.UTC), at(8, 9, 0, time.UTC)},
+		{"adjacent windows", "mon 09:00-12:00; mon 12:00-18:00", at(1, 10, 0, time.UTC), at(1, 18, 0, time.UTC)},
+		{"wrap until end", "fri 22:00-06:00", at(5, 23, 0, time.UTC), at(6, 6, 0, time.UTC)},
+		{"wrap after midnight", "fri 22:00-06:00", at(6, 1, 0, time.UTC), at(6, 6, 0, time.UTC)},
+		{"wrap until next week", "fri 22:00-06:00", at(6, 6, 0, time.UTC), at(12, 22, 0, time.UTC)},
+		{"nightly", "22:00-06:00", at(3, 12, 0, time.UTC), at(3, 22, 0, time.UTC)},
+		{"never changes", "daily 00:00-24:00", at(3, 12, 0, time.UTC), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.spec, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(tt.time); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.time, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/bluenviron/gortmplib/pkg/codecs"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/mpeg4audio"
+
+	"rtmp_kvs/kvs"
+)
+
+// audioFrame is an audio frame (AAC access unit or G.711 samples) of an audio-only stream,
+// or an AAC access unit forwarded with the video.
+type audioFrame struct {
+	pts  time.Duration
+	data []byte
+}
+
+// SetAudioOnly enables accepting publishers without an H.264 track; their AAC or G.711
+// audio is forwarded to KVS as an audio-only stream.
+func (s *Server) SetAudioOnly(enabled bool) {
+	s.audioOnly = enabled
+}
+
+// SetForwardAudio enables forwarding the AAC track of H.264 publishers to KVS with the
+// video, kept in sync with it (AV_SYNC_MAX_SKEW, AV_SYNC_CORRECTION).
+func (s *Server) SetForwardAudio(enabled bool) {
+	s.forwardAudio = enabled
+}
+
+// startAudio starts an audio-only forwarder and the goroutine feeding it.
+func (ss *session) startAudio(track kvs.AudioTrack) error {
+	log.Printf("[%s] Starting KVS forwarder for audio-only stream (%s)...", ss.protocol, &track)
+	if err := ss.forwarder.StartAudio(ss.serveCtx, track); err != nil {
+		log.Printf("[%s] Failed to start KVS forwarder: %v", ss.protocol, err)
+		return err
+	}
+	ss.stats.setAudioCodec(track.Codec)
+	ss.forwarderStarted(map[string]any{"audio_only": true, "audio_codec": track.Codec})
+
+	go ss.forwardAudio()
+	return nil
+}
+
+// forwardAudio feeds the queued audio frames to the forwarder until the session closes.
+func (ss *session) forwardAudio() {
+	for {
+		select {
+		case frame := <-ss.audioChan:
+			if ss.videoAudio == nil {
+				ss.stats.addAudioFrame(len(frame.data))
+			}
+			ss.forwarder.WriteAudio(ss.ctx, frame.pts, frame.data)
+		case <-ss.ctx.Done():
+			return
+		}
+	}
+}
+
+// forwardVideoAudio forwards the AAC track with the video of the session; it must be
+// called before startH264.
+func (ss *session) forwardVideoAudio(track kvs.AudioTrack) {
+	frame := time.Duration(mpeg4audio.SamplesPerAccessUnit) * time.Second / time.Duration(track.SampleRate)
+	ss.videoAudio = &track
+	ss.avSync = newAVSync(ss.server.avSync, track.Codec, frame)
+	ss.stats.avSync = ss.avSync.stats
+}
+
+// startForwarder starts the forwarder of a video session, with its audio if forwarded.
+func (ss *session) startForwarder() error {
+	return ss.forwarder.StartWithAudio(ss.serveCtx, ss.videoAudio)
+}
+
+// writeAudio queues an audio frame for the forwarder without blocking the reader.
+func (ss *session) writeAudio(pts time.Duration, data []byte) {
+	now := time.Now()
+	ss.lastFrameAt.Store(now.UnixNano())
+	if ss.audioTimestamps != nil {
+		pts, _ = ss.conditionTimestamps(ss.audioTimestamps, "audio", pts, pts, now)
+	}
+	select {
+	case ss.audioChan <- audioFrame{pts: pts, data: data}:
+	default:
+		ss.reportDropped(ss.stats.addDropped())
+	}
+}
+
+// writeVideoAudio queues a frame of the AAC track forwarded with the video, its timestamp
+// corrected to keep it in sync with the video.
+func (ss *session) writeVideoAudio(pts time.Duration, data []byte) {
+	now := time.Now()
+	if ss.audioTimestamps != nil {
+		pts, _ = ss.conditionTimestamps(ss.audioTimestamps, "audio", pts, pts, now)
+	}
+	pts, keep := ss.syncAudio(pts, now)
+	if !keep {
+		return
+	}
+	select {
+	case ss.audioChan <- audioFrame{pts: pts, data: data}:
+	default:
+		ss.reportDropped(ss.stats.addDropped())
+	}
+}
+
+// videoAudioTrack returns the AAC track forwarded with the H.264 video when audio
+// forwarding is enabled, or nil.
+func (s *Server) videoAudioTrack(tracks []*gortmplib.Track) *gortmplib.Track {
+	if !s.forwardAudio {
+		return nil
+	}
+	var video bool
+	var audio *gortmplib.Track
+	for _, track := range tracks {
+		switch track.Codec.(type) {
+		case *codecs.H264:
+			video = true
+		case *codecs.MPEG4Audio:
+			if audio == nil {
+				audio = track
+			}
+		}
+	}
+	if !video {
+		return nil
+	}
+	return audio
+}
+
+// audioOnlyTrack returns the track to forward when audio-only publishers are accepted and
+// the publisher has no H.264 track, or nil.
+func (s *Server) audioOnlyTrack(tracks []*gortmplib.Track) *gortmplib.Track {
+	if !s.audioOnly {
+		return nil
+	}
+	var audio *gortmplib.Track
+	for _, track := range tracks {
+		switch track.Codec.(type) {
+		case *codecs.H264:
+			return nil
+		case *codecs.MPEG4Audio, *codecs.G711:
+			if audio == nil {
+				audio = track
+			}
+		}
+	}
+	return audio
+}
+
+// aacTrack describes an AAC track for the forwarder.
+func aacTrack(config *mpeg4audio.AudioSpecificConfig) (kvs.AudioTrack, error) {
+	if config == nil || config.SampleRate <= 0 {
+		return kvs.AudioTrack{}, fmt.Errorf("AAC track without a valid AudioSpecificConfig")
+	}
+	data, err := config.Marshal()
+	if err != nil {
+		return kvs.AudioTrack{}, fmt.Errorf("invalid AAC config: %w", err)
+	}
+	return kvs.AudioTrack{
+		Codec:        kvs.AudioCodecAAC,
+		SampleRate:   config.SampleRate,
+		ChannelCount: config.ChannelCount,
+		Config:       data,
+	}, nil
+}
+
+// g711Codec returns the forwarder codec name of a G.711 track.
+func g711Codec(codec *codecs.G711) string {
+	if codec.MULaw {
+		return kvs.AudioCodecPCMU
+	}
+	return kvs.AudioCodecPCMA
+}
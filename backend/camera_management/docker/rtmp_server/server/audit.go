@@ -0,0 +1,204 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"rtmp_kvs/audit"
+)
+
+// Disconnect reasons of audit records, in addition to the connection failure reasons
+const (
+	disconnectClosed   = "closed"            // the handler finished, e.g. a player left
+	disconnectByClient = "client_closed"     // the client closed or reset the connection
+	disconnectShutdown = "server_shutdown"   // the listener's context was cancelled
+	disconnectIdle     = "idle"              // no video for the idle timeout
+	disconnectReplaced = "replaced"          // another publisher took over the path
+	disconnectRemote   = "remote_disconnect" // Disconnect (admin, gRPC or MQTT command)
+	disconnectError    = "error"
+)
+
+// SetAudit writes an audit record for every connection, including the ones refused by
+// the IP filter.
+func (s *Server) SetAudit(l *audit.Logger) {
+	s.audit = l
+}
+
+// auditKey is the context key of the audit record of a connection.
+type auditKey struct{}
+
+// connAudit collects the audit record of a connection while it is served. Its methods
+// do nothing on nil, i.e. without audit log.
+type connAudit struct {
+	mutex  sync.Mutex
+	record audit.Record
+	// Byte counters of the connection
+	counter interface {
+		BytesReceived() uint64
+		BytesSent() uint64
+	}
+}
+
+// startAudit returns ctx carrying a new audit record of a connection, or ctx and nil
+// without audit log.
+func (s *Server) startAudit(ctx context.Context, remoteAddr, protocol string) (context.Context, *connAudit) {
+	if s.audit == nil {
+		return ctx, nil
+	}
+	a := &connAudit{record: audit.Record{
+		ConnectedAt: time.Now(),
+		RemoteAddr:  remoteAddr,
+		Protocol:    protocol,
+		Auth:        audit.AuthNone,
+	}}
+	return context.WithValue(ctx, auditKey{}, a), a
+}
+
+// auditFrom returns the audit record of a connection, or nil.
+func auditFrom(ctx context.Context) *connAudit {
+	a, _ := ctx.Value(auditKey{}).(*connAudit)
+	return a
+}
+
+// update modifies the record.
+func (a *connAudit) update(fn func(r *audit.Record)) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	fn(&a.record)
+}
+
+// countBytes takes the byte counts of the record from the RTMP connection.
+func (a *connAudit) countBytes(counter interface {
+	BytesReceived() uint64
+	BytesSent() uint64
+}) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	a.counter = counter
+	a.mutex.Unlock()
+}
+
+// countReads returns r counting the bytes received for the record, for connections
+// without RTMP byte counters.
+func (a *connAudit) countReads(r io.Reader) io.Reader {
+	if a == nil {
+		return r
+	}
+	cr := &countingReader{r: r}
+	a.countBytes(cr)
+	return cr
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n atomic.Uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingReader) BytesReceived() uint64 { return c.n.Load() }
+func (c *countingReader) BytesSent() uint64     { return 0 }
+
+// setReason records why the connection ends. The first reason is kept: closing the
+// connection for one reason fails the reads with another.
+func (a *connAudit) setReason(reason string) {
+	a.update(func(r *audit.Record) {
+		if r.DisconnectReason == "" {
+			r.DisconnectReason = reason
+		}
+	})
+}
+
+// endSession records why the server ends a session (idle, replaced, ...) in its audit
+// record and for its camera session. The first reason is kept.
+func (ss *session) endSession(reason string) {
+	ss.endReason.CompareAndSwap(nil, &reason)
+	auditFrom(ss.ctx).setReason(reason)
+}
+
+// authorized records the result of the publisher's authorization.
+func (a *connAudit) authorized(err error) {
+	a.update(func(r *audit.Record) {
+		if err != nil {
+			r.Auth, r.AuthReason = audit.AuthRejected, err.Error()
+		} else {
+			r.Auth = audit.AuthAccepted
+		}
+	})
+}
+
+// finishAudit completes the record with the outcome of the connection and writes it.
+// shutdown reports whether the listener's context was cancelled.
+func (s *Server) finishAudit(a *connAudit, err error, shutdown bool) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	r := a.record
+	counter := a.counter
+	a.mutex.Unlock()
+
+	r.DisconnectedAt = time.Now()
+	r.DurationSeconds = r.DisconnectedAt.Sub(r.ConnectedAt).Seconds()
+	if counter != nil {
+		r.BytesReceived, r.BytesSent = counter.BytesReceived(), counter.BytesSent()
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if r.DisconnectReason == "" {
+		r.DisconnectReason = disconnectReason(err, shutdown)
+	}
+	s.audit.Write(r)
+}
+
+// disconnectReason classifies the error a connection ended with.
+func disconnectReason(err error, shutdown bool) string {
+	switch {
+	case shutdown:
+		return disconnectShutdown
+	case err == nil:
+		return disconnectClosed
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return disconnectByClient
+	case isTimeout(err):
+		return failReadTimeout
+	default:
+		return disconnectError
+	}
+}
+
+// auditDenied writes the record of a connection refused by the IP filter or the
+// quarantine.
+func (s *Server) auditDenied(addr net.Addr, protocol, reason, description string) {
+	if s.audit == nil {
+		return
+	}
+	now := time.Now()
+	s.audit.Write(audit.Record{
+		ConnectedAt:      now,
+		DisconnectedAt:   now,
+		RemoteAddr:       addr.String(),
+		Protocol:         protocol,
+		Auth:             audit.AuthRejected,
+		AuthReason:       description,
+		DisconnectReason: reason,
+	})
+}
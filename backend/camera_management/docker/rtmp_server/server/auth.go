@@ -0,0 +1,48 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"rtmp_kvs/auth"
+	"rtmp_kvs/events"
+)
+
+// AddAuthorizer adds a publish authorizer. All authorizers must accept a publisher,
+// in the order they were added.
+func (s *Server) AddAuthorizer(a auth.Authorizer) {
+	s.authorizers = append(s.authorizers, a)
+}
+
+// authorize runs the publish authorizers, emitting an AuthRejected event on rejection.
+// Publishers of a tenant are authorized by the tenant's policy instead.
+func (s *Server) authorize(ctx context.Context, req *auth.PublishRequest) error {
+	authorizers := s.authorizers
+	if tenant := tenantFrom(ctx); tenant != nil {
+		authorizers = tenant.authorizers
+	}
+	for _, a := range authorizers {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := a.Authorize(ctx, req)
+		cancel()
+		if err == nil {
+			continue
+		}
+
+		streamPath := auth.RedactStreamPath(req.StreamPath)
+		log.Printf("[%s] Publisher %s rejected for %s: %v", req.Protocol, req.RemoteAddr, streamPath, err)
+		s.countFailure(ctx, req.Protocol, req.RemoteAddr, failAuth)
+		auditFrom(ctx).authorized(err)
+		events.Emit(events.Event{
+			Type:       events.AuthRejected,
+			StreamPath: streamPath,
+			RemoteAddr: req.RemoteAddr,
+			Protocol:   req.Protocol,
+			Detail:     map[string]any{"reason": err.Error()},
+		})
+		return err
+	}
+	return nil
+}
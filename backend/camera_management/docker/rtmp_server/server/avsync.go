@@ -0,0 +1,261 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"rtmp_kvs/events"
+)
+
+// A/V sync corrections (AV_SYNC_CORRECTION)
+const (
+	avSyncRetime = "retime" // slew the audio timestamps, leaving gaps or overlaps of a fraction of a frame
+	avSyncDrop   = "drop"   // drop audio frames, or leave a frame-long gap
+	avSyncOff    = "off"    // measure only
+)
+
+const (
+	// Weight of the last frame in the smoothed position of each track
+	avSyncSmoothing = 32
+	// Share of the skew slewed away per audio frame (retime), and the largest share of an
+	// audio frame the timestamps are moved by per frame
+	avSyncSlewShare    = 100
+	avSyncSlewMaxShare = 10
+	// Skews beyond this are timestamp discontinuities the conditioner did not bridge, not
+	// drift, and restart the measurement
+	avSyncMaxSkew = 5 * time.Second
+	// The audio is only compared with video received this recently
+	avSyncVideoTimeout = 2 * time.Second
+	// AVSyncDrift events of a stream are limited to one per interval
+	avSyncEventInterval = time.Minute
+)
+
+// avSyncConfig holds the settings of the A/V sync of interleaved audio.
+type avSyncConfig struct {
+	maxSkew    time.Duration // skew tolerated before it is corrected
+	correction string
+}
+
+// avSyncConfigFromEnv reads AV_SYNC_MAX_SKEW (seconds, default 0.1) and
+// AV_SYNC_CORRECTION ("retime", the default, "drop" or "off").
+func avSyncConfigFromEnv() avSyncConfig {
+	c := avSyncConfig{
+		maxSkew:    envSeconds("AV_SYNC_MAX_SKEW", 100*time.Millisecond, false),
+		correction: avSyncRetime,
+	}
+	switch mode := os.Getenv("AV_SYNC_CORRECTION"); mode {
+	case "", avSyncRetime:
+	case avSyncDrop, avSyncOff:
+		c.correction = mode
+	default:
+		log.Printf("Warning: invalid AV_SYNC_CORRECTION %q, using %s", mode, avSyncRetime)
+	}
+	return c
+}
+
+// AVSyncStats describes the synchronization of the audio forwarded with the video.
+type AVSyncStats struct {
+	Codec         string  `json:"codec"`
+	SkewMs        float64 `json:"skew_ms"`       // audio ahead (+) or behind (-) the video, relative to the start of the session
+	CorrectionMs  float64 `json:"correction_ms"` // shift of the audio timestamps
+	Corrections   uint64  `json:"corrections"`   // times the skew exceeded AV_SYNC_MAX_SKEW
+	DroppedFrames uint64  `json:"dropped_frames"`
+	Gaps          uint64  `json:"gaps"` // audio frames moved a frame later
+}
+
+// avSync measures the skew between the audio and the video of a publisher and corrects
+// the audio timestamps. Encoders timestamp audio by its sample count and video by their
+// clock, so a sound card running slightly fast or slow moves the audio away from the
+// video by seconds over hours. The position of each track is its timestamp against the
+// arrival clock; their difference at the end of the warmup is the publisher's own offset,
+// and the change since then the skew. Used by the reader goroutine; stats by the stats
+// collectors.
+type avSync struct {
+	mutex  sync.Mutex
+	config avSyncConfig
+	codec  string
+	frame  time.Duration // duration of an audio frame
+
+	startedAt time.Time
+	hasVideo  bool
+	hasAudio  bool
+	videoLead time.Duration // smoothed timestamp minus the time since the start
+	audioLead time.Duration // the same, of the corrected audio timestamps
+	lastVideo time.Time
+	baseline  time.Duration
+	anchored  bool
+	over      bool // the skew exceeded maxSkew and is not back under a quarter of it
+	skew      time.Duration
+	overSkew  time.Duration // skew when it last exceeded maxSkew
+
+	offset  time.Duration // added to the audio timestamps
+	hasOut  bool
+	lastOut time.Duration
+
+	corrections uint64
+	dropped     uint64
+	gaps        uint64
+	lastEvent   time.Time
+}
+
+func newAVSync(config avSyncConfig, codec string, frame time.Duration) *avSync {
+	return &avSync{config: config, codec: codec, frame: frame}
+}
+
+// lead returns the smoothed position of a track after a frame with timestamp ts.
+func (a *avSync) lead(smoothed time.Duration, started bool, ts time.Duration, now time.Time) time.Duration {
+	sample := ts - now.Sub(a.startedAt)
+	if !started {
+		return sample
+	}
+	return smoothed + (sample-smoothed)/avSyncSmoothing
+}
+
+// video records the DTS of a video frame that arrived at now.
+func (a *avSync) video(dts time.Duration, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.startedAt.IsZero() {
+		a.startedAt = now
+	}
+	a.videoLead = a.lead(a.videoLead, a.hasVideo, dts, now)
+	a.hasVideo, a.lastVideo = true, now
+}
+
+// audio returns the corrected timestamp of an audio frame that arrived at now, false if
+// the frame is dropped, and whether a correction started.
+func (a *avSync) audio(pts time.Duration, now time.Time) (time.Duration, bool, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.startedAt.IsZero() {
+		a.startedAt = now
+	}
+	a.audioLead = a.lead(a.audioLead, a.hasAudio, pts+a.offset, now)
+	a.hasAudio = true
+
+	started, keep := false, true
+	if a.hasVideo && now.Sub(a.lastVideo) < avSyncVideoTimeout {
+		started = a.measure(now)
+		if a.over && a.config.correction != avSyncOff {
+			keep = a.correct()
+		}
+	}
+
+	out := pts + a.offset
+	if !keep || (a.hasOut && out <= a.lastOut) {
+		return 0, false, started
+	}
+	a.hasOut, a.lastOut = true, out
+	return out, true, started
+}
+
+// measure updates the skew and reports whether it started to exceed maxSkew.
+func (a *avSync) measure(now time.Time) bool {
+	skew := a.audioLead - a.videoLead
+	if !a.anchored {
+		if now.Sub(a.startedAt) < driftWarmup {
+			return false
+		}
+		a.baseline, a.anchored = skew, true
+	}
+	a.skew = skew - a.baseline
+	if a.skew.Abs() > avSyncMaxSkew {
+		a.baseline, a.skew, a.over = skew, 0, false
+		return false
+	}
+	if a.over && a.skew.Abs() < a.config.maxSkew/4 {
+		a.over = false
+	}
+	if a.over || a.skew.Abs() <= a.config.maxSkew {
+		return false
+	}
+	a.over, a.overSkew = true, a.skew
+	a.corrections++
+	return true
+}
+
+// correct moves the audio timestamps towards the video and reports whether the frame is
+// kept. The smoothed audio position moves with them, so the next frame sees the skew
+// that is left.
+func (a *avSync) correct() bool {
+	var shift time.Duration
+	keep := true
+	switch a.config.correction {
+	case avSyncRetime:
+		shift = min(a.skew.Abs()/avSyncSlewShare, a.frame/avSyncSlewMaxShare)
+	case avSyncDrop:
+		// Audio ahead: the following frames take the place of a dropped one
+		shift = a.frame
+		if a.skew > 0 {
+			keep = false
+			a.dropped++
+		} else {
+			a.gaps++
+		}
+	}
+	if a.skew > 0 {
+		shift = -shift
+	}
+	a.offset += shift
+	a.audioLead += shift
+	a.skew += shift
+	return keep
+}
+
+// stats returns the A/V sync statistics.
+func (a *avSync) stats() *AVSyncStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return &AVSyncStats{
+		Codec:         a.codec,
+		SkewMs:        milliseconds(a.skew),
+		CorrectionMs:  milliseconds(a.offset),
+		Corrections:   a.corrections,
+		DroppedFrames: a.dropped,
+		Gaps:          a.gaps,
+	}
+}
+
+// syncAudio corrects the timestamp of a frame of the audio forwarded with the video and
+// reports skews beyond AV_SYNC_MAX_SKEW. It returns false if the frame is dropped.
+func (ss *session) syncAudio(pts time.Duration, now time.Time) (time.Duration, bool) {
+	pts, keep, started := ss.avSync.audio(pts, now)
+	if !started {
+		return pts, keep
+	}
+	a := ss.avSync
+	a.mutex.Lock()
+	skew, correction, dropped := a.overSkew, a.offset, a.dropped
+	due := now.Sub(a.lastEvent) >= avSyncEventInterval
+	if due {
+		a.lastEvent = now
+	}
+	a.mutex.Unlock()
+
+	config := ss.server.avSync
+	log.Printf("[%s] Audio of %s drifted %s from the video (max %s), correction: %s",
+		ss.protocol, ss.streamPath, skew.Round(time.Millisecond), config.maxSkew, config.correction)
+	if !due {
+		return pts, keep
+	}
+	events.Emit(events.Event{
+		Type:       events.AVSyncDrift,
+		StreamPath: ss.streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   ss.route.CameraID,
+		RemoteAddr: ss.remoteAddr,
+		Protocol:   ss.protocol,
+		Detail: map[string]any{
+			"skew_ms":        skew.Milliseconds(),
+			"max_skew_ms":    config.maxSkew.Milliseconds(),
+			"correction":     config.correction,
+			"correction_ms":  correction.Milliseconds(),
+			"audio_codec":    a.codec,
+			"dropped_frames": dropped,
+		},
+	})
+	return pts, keep
+}
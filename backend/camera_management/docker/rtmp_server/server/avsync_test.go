@@ -0,0 +1,104 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAVSyncConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		skew, correction string
+		want             avSyncConfig
+	}{
+		{"", "", avSyncConfig{100 * time.Millisecond, avSyncRetime}},
+		{"0.25", "drop", avSyncConfig{250 * time.Millisecond, avSyncDrop}},
+		{"1", "off", avSyncConfig{time.Second, avSyncOff}},
+		{"0", "resample", avSyncConfig{100 * time.Millisecond, avSyncRetime}},
+	}
+	for _, tt := range tests {
+		t.Setenv("AV_SYNC_MAX_SKEW", tt.skew)
+		t.Setenv("AV_SYNC_CORRECTION", tt.correction)
+		if got := avSyncConfigFromEnv(); got != tt.want {
+			t.Errorf("AV_SYNC_MAX_SKEW=%q AV_SYNC_CORRECTION=%q: %+v, want %+v", tt.skew, tt.correction, got, tt.want)
+		}
+	}
+}
+
+func TestAVSync(t *testing.T) {
+	// AAC frames of 1024 samples at 48 kHz
+	frame := 21333 * time.Microsecond
+	maxSkew := 100 * time.Millisecond
+	tests := []struct {
+		name        string
+		correction  string
+		rate        float64 // audio clock speed relative to the video
+		corrections bool
+		wantDropped bool
+		wantGaps    bool
+		corrected   bool // the skew is back within maxSkew at the end
+	}{
+		{name: "in sync", correction: avSyncRetime, rate: 1, corrected: true},
+		{name: "retime fast audio", correction: avSyncRetime, rate: 1.001, corrections: true, corrected: true},
+		{name: "retime slow audio", correction: avSyncRetime, rate: 0.999, corrections: true, corrected: true},
+		{name: "drop fast audio", correction: avSyncDrop, rate: 1.001, corrections: true, wantDropped: true, corrected: true},
+		{name: "gaps in slow audio", correction: avSyncDrop, rate: 0.999, corrections: true, wantGaps: true, corrected: true},
+		{name: "measure only", correction: avSyncOff, rate: 1.001, corrections: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAVSync(avSyncConfig{maxSkew: maxSkew, correction: tt.correction}, "AAC", frame)
+			start := time.Now()
+			videoInterval := 40 * time.Millisecond
+
+			var video time.Duration
+			lastOut := time.Duration(-1)
+			// Ten minutes of audio, interleaved with the video by arrival
+			for n := range int(10 * time.Minute / frame) {
+				at := time.Duration(n) * frame
+				for ; video <= at; video += videoInterval {
+					a.video(video, start.Add(video))
+				}
+				out, keep, _ := a.audio(time.Duration(float64(at)*tt.rate), start.Add(at))
+				if !keep {
+					continue
+				}
+				if out <= lastOut {
+					t.Fatalf("frame %d: timestamp went backwards from %s to %s", n, lastOut, out)
+				}
+				lastOut = out
+			}
+
+			stats := a.stats()
+			if got := stats.Corrections > 0; got != tt.corrections {
+				t.Errorf("%d corrections", stats.Corrections)
+			}
+			if got := stats.DroppedFrames > 0; got != tt.wantDropped {
+				t.Errorf("%d frames dropped", stats.DroppedFrames)
+			}
+			if got := stats.Gaps > 0; got != tt.wantGaps {
+				t.Errorf("%d gaps", stats.Gaps)
+			}
+			if got := a.skew.Abs() <= maxSkew; got != tt.corrected {
+				t.Errorf("skew at the end = %s (correction %vms)", a.skew, stats.CorrectionMs)
+			}
+			if tt.correction == avSyncOff && stats.CorrectionMs != 0 {
+				t.Errorf("timestamps moved by %vms without correction", stats.CorrectionMs)
+			}
+		})
+	}
+}
+
+func TestAVSyncWithoutVideo(t *testing.T) {
+	a := newAVSync(avSyncConfig{maxSkew: 100 * time.Millisecond, correction: avSyncRetime}, "AAC", 20*time.Millisecond)
+	start := time.Now()
+	a.video(0, start)
+
+	// Audio long after the video stopped is forwarded unchanged
+	for n := range 3000 {
+		at := 3*time.Second + time.Duration(n)*20*time.Millisecond
+		out, keep, started := a.audio(2*at, start.Add(at))
+		if !keep || started || out != 2*at {
+			t.Fatalf("frame %d: audio(%s) = %s, %v, %v", n, 2*at, out, keep, started)
+		}
+	}
+}
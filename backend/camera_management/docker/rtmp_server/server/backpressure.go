@@ -0,0 +1,189 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/events"
+)
+
+// backpressureStrategy decides what happens when the frame queue between the reader and
+// the forwarder fills up (the forwarder or kvssink cannot keep up).
+type backpressureStrategy int
+
+const (
+	backpressureDrop       backpressureStrategy = iota // drop new frames while the queue is full
+	backpressureBlock                                  // stop reading from the publisher (TCP pushback)
+	backpressureDropNonRef                             // drop non-reference frames above the watermark
+	backpressureDisconnect                             // disconnect the publisher when the queue is full
+)
+
+func (b backpressureStrategy) String() string {
+	switch b {
+	case backpressureBlock:
+		return "block"
+	case backpressureDropNonRef:
+		return "drop-non-reference"
+	case backpressureDisconnect:
+		return "disconnect"
+	default:
+		return "drop"
+	}
+}
+
+// queueConfig holds the frame queue settings.
+type queueConfig struct {
+	capacity      int
+	highWatermark int // depth at which FrameQueueHighWatermark is emitted and drop-non-reference starts
+	strategy      backpressureStrategy
+	blockTimeout  time.Duration // block: frames are dropped after waiting this long
+}
+
+// queueConfigFromEnv reads FRAME_QUEUE_SIZE (frames, default 100),
+// FRAME_QUEUE_HIGH_WATERMARK (frames, default 80% of the size), FRAME_QUEUE_STRATEGY
+// (drop, block, drop-non-reference or disconnect, default drop) and
+// FRAME_QUEUE_BLOCK_TIMEOUT (seconds, default 2).
+func queueConfigFromEnv() queueConfig {
+	c := queueConfig{
+		capacity:     envFrames("FRAME_QUEUE_SIZE", 100),
+		blockTimeout: envSeconds("FRAME_QUEUE_BLOCK_TIMEOUT", 2*time.Second, false),
+	}
+	c.highWatermark = min(envFrames("FRAME_QUEUE_HIGH_WATERMARK", c.capacity*8/10), c.capacity)
+	switch value := os.Getenv("FRAME_QUEUE_STRATEGY"); value {
+	case "", "drop":
+	case "block":
+		c.strategy = backpressureBlock
+	case "drop-non-reference":
+		c.strategy = backpressureDropNonRef
+	case "disconnect":
+		c.strategy = backpressureDisconnect
+	default:
+		log.Printf("Warning: invalid FRAME_QUEUE_STRATEGY %q, using drop", value)
+	}
+	if c.strategy != backpressureDrop {
+		log.Printf("Frame queue: %d frames, high watermark %d, strategy %s", c.capacity, c.highWatermark, c.strategy)
+	}
+	return c
+}
+
+// envFrames reads a positive number of frames.
+func envFrames(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Printf("Warning: invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// enqueue queues an access unit for the forwarder, applying the backpressure strategy
+// when the forwarder falls behind. It runs on the reader goroutine.
+func (ss *session) enqueue(frame h264Frame) {
+	if ss.ctx.Err() != nil {
+		return // disconnected, the reader may still deliver buffered frames
+	}
+	config := &ss.server.queue
+	depth := len(ss.dataChan)
+	ss.checkWatermark(depth)
+	ss.feedback.observe(depth)
+
+	// After dropping a reference frame the following pictures cannot be decoded
+	if ss.awaitKeyframe {
+		if !h264.IsRandomAccess(frame.au) {
+			ss.reportDropped(ss.stats.addDropped())
+			return
+		}
+		ss.awaitKeyframe = false
+	}
+	if config.strategy == backpressureDropNonRef && depth >= config.highWatermark && !isReference(frame.au) {
+		ss.reportDropped(ss.stats.addDropped())
+		return
+	}
+
+	select {
+	case ss.dataChan <- frame:
+		return
+	default:
+	}
+
+	switch config.strategy {
+	case backpressureBlock:
+		// UDP sessions share the datagram reader, which must never block
+		if ss.conn != nil {
+			timer := time.NewTimer(config.blockTimeout)
+			defer timer.Stop()
+			select {
+			case ss.dataChan <- frame:
+				return
+			case <-timer.C:
+			case <-ss.ctx.Done():
+				return
+			}
+		}
+	case backpressureDisconnect:
+		log.Printf("[%s] ⚠️  Frame queue of %s full (%d frames), disconnecting %s",
+			ss.protocol, ss.streamPath, cap(ss.dataChan), ss.remoteAddr)
+		ss.server.countFailure(ss.ctx, ss.protocol, ss.remoteAddr, failQueueFull)
+		ss.cancel()
+		return
+	case backpressureDropNonRef:
+		ss.awaitKeyframe = isReference(frame.au)
+	}
+	ss.reportDropped(ss.stats.addDropped())
+}
+
+// checkWatermark emits FrameQueueHighWatermark when the queue depth reaches the high
+// watermark. It is emitted again only after the queue has drained to half the watermark.
+func (ss *session) checkWatermark(depth int) {
+	config := &ss.server.queue
+	switch {
+	case !ss.overWatermark && depth >= config.highWatermark:
+		ss.overWatermark = true
+		ss.stats.addHighWatermark()
+		log.Printf("[%s] ⚠️  Frame queue of %s reached %d/%d frames (strategy %s)",
+			ss.protocol, ss.streamPath, depth, cap(ss.dataChan), config.strategy)
+		events.Emit(events.Event{
+			Type:       events.FrameQueueHighWatermark,
+			StreamPath: ss.streamPath,
+			StreamName: ss.forwarder.StreamName(),
+			CameraID:   ss.route.CameraID,
+			RemoteAddr: ss.remoteAddr,
+			Protocol:   ss.protocol,
+			Detail: map[string]any{
+				"depth":          depth,
+				"capacity":       cap(ss.dataChan),
+				"high_watermark": config.highWatermark,
+				"strategy":       config.strategy.String(),
+			},
+		})
+		ss.feedback.congested(ss.stats.snapshot().BitrateKbps)
+	case ss.overWatermark && depth <= config.highWatermark/2:
+		ss.overWatermark = false
+	}
+}
+
+// isReference reports whether an access unit is referenced by other frames (nal_ref_idc
+// of its slices is non-zero). Access units without slices count as reference.
+func isReference(au [][]byte) bool {
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeIDR:
+			return true
+		case h264.NALUTypeNonIDR, h264.NALUTypeDataPartitionA:
+			return nalu[0]&0x60 != 0
+		}
+	}
+	return true
+}
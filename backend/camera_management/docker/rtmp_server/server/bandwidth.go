@@ -0,0 +1,142 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/bluenviron/gortmplib/pkg/message"
+)
+
+const (
+	// Peer bandwidth the connection starts with (gortmplib's default)
+	defaultPeerBandwidth = 2500000
+
+	// Set Peer Bandwidth limit types
+	peerBandwidthHard    = 0
+	peerBandwidthDynamic = 2
+)
+
+// bandwidthConfig is the bandwidth feedback sent to RTMP publishers that send more than
+// the server can forward (BANDWIDTH_FEEDBACK), before the frame queue overflows and frames
+// are dropped. Set Peer Bandwidth limits the data an encoder that honors it sends ahead of
+// the server's acknowledgements to one second at the requested rate; the encoder answers
+// with that window acknowledgement size, and the acknowledgements, sent as frames are
+// read, pace it. Several camera firmwares also lower their bitrate to the requested one.
+type bandwidthConfig struct {
+	enabled  bool
+	minKbps  int           // lowest bandwidth requested
+	step     int           // percent below the ingest rate requested when the queue backs up
+	recovery time.Duration // without backlog before the limit is lifted
+}
+
+// bandwidthConfigFromEnv reads BANDWIDTH_FEEDBACK=true with BANDWIDTH_FEEDBACK_MIN_KBPS
+// (default 256), BANDWIDTH_FEEDBACK_STEP (percent, default 25) and
+// BANDWIDTH_FEEDBACK_RECOVERY (seconds, default 30).
+func bandwidthConfigFromEnv() bandwidthConfig {
+	c := bandwidthConfig{
+		enabled:  os.Getenv("BANDWIDTH_FEEDBACK") == "true",
+		minKbps:  envFrames("BANDWIDTH_FEEDBACK_MIN_KBPS", 256),
+		step:     min(envFrames("BANDWIDTH_FEEDBACK_STEP", 25), 90),
+		recovery: envSeconds("BANDWIDTH_FEEDBACK_RECOVERY", 30*time.Second, false),
+	}
+	if c.enabled {
+		log.Printf("Bandwidth feedback: step %d%%, minimum %d kbit/s, lifted after %s without backlog", c.step, c.minKbps, c.recovery)
+	}
+	return c
+}
+
+// bandwidthFeedback sends the bandwidth feedback of one RTMP publisher. It is used by the
+// reader goroutine only, which also writes the acknowledgements.
+type bandwidthFeedback struct {
+	ss     *session
+	conn   gortmplib.Conn
+	config *bandwidthConfig
+
+	ceilingKbps int       // ingest bitrate limit of the publisher, 0 if unlimited
+	limitKbps   int       // requested bandwidth, 0 when not limited
+	clearSince  time.Time // since the queue has been below half the high watermark
+}
+
+// newBandwidthFeedback returns the feedback of an RTMP publisher, or nil if disabled. A
+// publisher with an ingest bitrate limit (max_bitrate_kbps, MAX_INGEST_BITRATE) is asked
+// to stay under it right away, rather than only having its reads throttled.
+func (ss *session) newBandwidthFeedback(conn gortmplib.Conn, ceilingKbps int) *bandwidthFeedback {
+	config := &ss.server.bandwidth
+	if !config.enabled {
+		return nil
+	}
+	f := &bandwidthFeedback{ss: ss, conn: conn, config: config, ceilingKbps: max(ceilingKbps, 0)}
+	if f.ceilingKbps > 0 {
+		f.limit(f.ceilingKbps, "bitrate limit")
+	}
+	return f
+}
+
+// congested asks the publisher to send less when the frame queue reached the high
+// watermark: the ingest rate, or the current limit if lower, minus the step.
+func (f *bandwidthFeedback) congested(ingestKbps float64) {
+	if f == nil {
+		return
+	}
+	kbps := int(ingestKbps)
+	if f.limitKbps > 0 {
+		kbps = min(kbps, f.limitKbps)
+	}
+	kbps = max(kbps*(100-f.config.step)/100, f.config.minKbps)
+	if f.limitKbps > 0 && kbps >= f.limitKbps {
+		return
+	}
+	f.limit(kbps, "backlog")
+}
+
+// limit requests a bandwidth of kbps.
+func (f *bandwidthFeedback) limit(kbps int, reason string) {
+	if err := f.send(uint32(kbps*1000/8), peerBandwidthHard); err != nil {
+		log.Printf("[%s] ⚠️  Failed to send bandwidth feedback to %s: %v", f.ss.protocol, f.ss.remoteAddr, err)
+		return
+	}
+	log.Printf("[%s] Asked publisher %s of %s to send at most %d kbit/s (%s)",
+		f.ss.protocol, f.ss.remoteAddr, f.ss.streamPath, kbps, reason)
+	f.limitKbps = kbps
+	f.clearSince = time.Time{}
+	f.ss.server.bandwidthRequests.Add(1)
+	f.ss.stats.setRequestedBandwidth(kbps)
+}
+
+// observe lifts the limit, back to the ingest bitrate limit if any, once the queue stayed
+// below half the high watermark for the recovery period.
+func (f *bandwidthFeedback) observe(depth int) {
+	if f == nil || f.limitKbps == 0 || f.limitKbps == f.ceilingKbps {
+		return
+	}
+	if depth > f.ss.server.queue.highWatermark/2 {
+		f.clearSince = time.Time{}
+		return
+	}
+	now := time.Now()
+	if f.clearSince.IsZero() {
+		f.clearSince = now
+	}
+	if now.Sub(f.clearSince) < f.config.recovery {
+		return
+	}
+	if f.ceilingKbps > 0 {
+		f.limit(f.ceilingKbps, "backlog cleared")
+		return
+	}
+	if err := f.send(defaultPeerBandwidth, peerBandwidthDynamic); err != nil {
+		log.Printf("[%s] ⚠️  Failed to send bandwidth feedback to %s: %v", f.ss.protocol, f.ss.remoteAddr, err)
+		return
+	}
+	log.Printf("[%s] Lifted the bandwidth limit of publisher %s of %s", f.ss.protocol, f.ss.remoteAddr, f.ss.streamPath)
+	f.limitKbps = 0
+	f.ss.stats.setRequestedBandwidth(0)
+}
+
+// send writes a Set Peer Bandwidth message with a window of bytes.
+func (f *bandwidthFeedback) send(window uint32, limitType byte) error {
+	return f.conn.Write(&message.SetPeerBandwidth{Value: window, Type: limitType})
+}
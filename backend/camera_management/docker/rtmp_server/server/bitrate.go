@@ -0,0 +1,156 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"rtmp_kvs/events"
+)
+
+// BitrateExceeded events of a throttled publisher are limited to one per interval
+const bitrateEventInterval = time.Minute
+
+// errBitrateExceeded ends the connection of a publisher over its bitrate limit.
+var errBitrateExceeded = errors.New("ingest bitrate limit exceeded")
+
+// bitrateConfig is what happens when a publisher exceeds its ingest bitrate limit
+// (max_bitrate_kbps, MAX_INGEST_BITRATE).
+type bitrateConfig struct {
+	disconnect bool          // disconnect instead of throttling reads
+	burst      time.Duration // how long the publisher may send above the limit
+}
+
+// bitrateConfigFromEnv reads BITRATE_LIMIT_ACTION ("throttle", the default, or
+// "disconnect") and BITRATE_BURST (seconds at the limit the publisher may send at once,
+// default 4).
+func bitrateConfigFromEnv() bitrateConfig {
+	c := bitrateConfig{burst: envSeconds("BITRATE_BURST", 4*time.Second, false)}
+	switch action := os.Getenv("BITRATE_LIMIT_ACTION"); action {
+	case "", "throttle":
+	case "disconnect":
+		c.disconnect = true
+	default:
+		log.Printf("Warning: invalid BITRATE_LIMIT_ACTION %q, using throttle", action)
+	}
+	return c
+}
+
+// bitrateLimiter caps the ingest rate of a publisher with a token bucket of burst
+// seconds at the limit. Throttling delays reads, so TCP flow control pushes back on the
+// encoder instead of one camera starving the other streams of the task. It is used by
+// the reader goroutine only.
+type bitrateLimiter struct {
+	server     *Server
+	limitKbps  int
+	rate       float64 // bytes per second
+	burst      float64 // bucket size in bytes
+	disconnect bool
+
+	tokens float64
+	last   time.Time
+
+	// Identifies the publisher in BitrateExceeded events
+	route      *Route
+	streamPath string
+	remoteAddr string
+	protocol   string
+	lastEvent  time.Time
+}
+
+// newBitrateLimiter returns the limiter of a publisher routed to route, or nil if its
+// bitrate is not limited. Publishers over UDP cannot be throttled and are always
+// disconnected.
+func (s *Server) newBitrateLimiter(route *Route, streamPath, remoteAddr, protocol string) *bitrateLimiter {
+	kbps := route.Config().MaxBitrateKbps
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1000 / 8
+	burst := rate * s.bitrate.burst.Seconds()
+	return &bitrateLimiter{
+		server:     s,
+		limitKbps:  kbps,
+		rate:       rate,
+		burst:      burst,
+		disconnect: s.bitrate.disconnect || protocol == "MPEG-TS/UDP",
+		tokens:     burst,
+		last:       time.Now(),
+		route:      route,
+		streamPath: streamPath,
+		remoteAddr: remoteAddr,
+		protocol:   protocol,
+	}
+}
+
+// take accounts for n bytes read. When the bucket is empty it waits until the rate is
+// back under the limit, or returns errBitrateExceeded in disconnect mode.
+func (l *bitrateLimiter) take(n int) error {
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate) - float64(n)
+	l.last = now
+	if l.tokens >= 0 {
+		return nil
+	}
+
+	if l.disconnect {
+		l.server.bitrateDisconnects.Add(1)
+		log.Printf("[%s] Publisher %s of %s exceeded %d kbit/s, disconnecting", l.protocol, l.remoteAddr, l.streamPath, l.limitKbps)
+		l.emit("disconnect")
+		return fmt.Errorf("%w (%d kbit/s)", errBitrateExceeded, l.limitKbps)
+	}
+
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.server.bitrateThrottled.Add(int64(delay))
+	if now.Sub(l.lastEvent) >= bitrateEventInterval {
+		log.Printf("[%s] Publisher %s of %s exceeds %d kbit/s, throttling reads", l.protocol, l.remoteAddr, l.streamPath, l.limitKbps)
+		l.emit("throttle")
+		l.lastEvent = now
+	}
+	time.Sleep(delay)
+	return nil
+}
+
+// emit reports the publisher exceeding its limit as a BitrateExceeded event.
+func (l *bitrateLimiter) emit(action string) {
+	events.Emit(events.Event{
+		Type:       events.BitrateExceeded,
+		StreamPath: l.streamPath,
+		StreamName: l.route.Forwarder.StreamName(),
+		CameraID:   l.route.CameraID,
+		RemoteAddr: l.remoteAddr,
+		Protocol:   l.protocol,
+		Detail: map[string]any{
+			"limit_kbps": l.limitKbps,
+			"action":     action,
+		},
+	})
+}
+
+// limitedReader applies the bitrate limits of a publisher and of its tenant to its
+// connection. limiter and tenant are nil until the publisher is routed, and when the
+// bitrate is not limited.
+type limitedReader struct {
+	r       io.Reader
+	limiter *bitrateLimiter
+	tenant  *tenantLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if lr.limiter != nil && n > 0 {
+		if limitErr := lr.limiter.take(n); limitErr != nil {
+			return 0, limitErr
+		}
+	}
+	if lr.tenant != nil && n > 0 {
+		if limitErr := lr.tenant.take(n); limitErr != nil {
+			return 0, limitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,321 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/kvs"
+)
+
+// States of a camera session
+const (
+	CameraOffline  = "offline"  // no publisher
+	CameraStarting = "starting" // publishing, KVS has not persisted a fragment of the session yet
+	CameraLive     = "live"     // publishing, and KVS persists the fragments
+	CameraPaused   = "paused"   // publishing, KVS forwarding paused (motion gate or remote command)
+	CameraDegraded = "degraded" // publishing, but the pipeline is down or KVS stopped persisting
+)
+
+// cameraPersistTimeout is how long KVS may go without persisting a fragment of a
+// publishing camera before its session is degraded.
+const cameraPersistTimeout = 30 * time.Second
+
+// publisherEndTTL is how long the end of a publisher is kept for its camera session.
+const publisherEndTTL = 24 * time.Hour
+
+// publisherRefused is the reason of a publisher refused before its session started.
+const publisherRefused = "refused"
+
+// CameraSession joins what is known about one camera along the ingest path: the
+// publisher connection, the forwarder's pipeline, what KVS persisted, and the last error
+// of any of them.
+type CameraSession struct {
+	CameraID   string `json:"camera_id,omitempty"`
+	StreamPath string `json:"stream_path,omitempty"` // empty for a forwarder without publisher
+	StreamName string `json:"stream_name,omitempty"`
+	Region     string `json:"region,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	State      string `json:"state"`
+
+	// Connected publisher, nil when offline
+	Publisher *StreamStats `json:"publisher,omitempty"`
+	// Last publisher of the path that disconnected or was refused
+	LastPublisher *PublisherEnd `json:"last_publisher,omitempty"`
+	// Forwarder of the stream, nil before the first publisher was routed
+	Pipeline    *kvs.Status  `json:"pipeline,omitempty"`
+	Persistence *Persistence `json:"persistence,omitempty"`
+
+	LastError *CameraError `json:"last_error,omitempty"`
+}
+
+// PublisherEnd is how a publisher session ended, or why a publisher was refused.
+type PublisherEnd struct {
+	SessionID  string    `json:"session_id,omitempty"` // empty if refused before the session started
+	CameraID   string    `json:"camera_id,omitempty"`
+	StreamName string    `json:"stream_name,omitempty"`
+	Region     string    `json:"region,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Protocol   string    `json:"protocol"`
+	StartedAt  time.Time `json:"started_at,omitzero"`
+	EndedAt    time.Time `json:"ended_at"`
+	Frames     uint64    `json:"frames"`
+	Reason     string    `json:"reason"` // disconnect reason of the audit log, or "refused"
+	Error      string    `json:"error,omitempty"`
+}
+
+// Persistence is what KVS acknowledged of a stream.
+type Persistence struct {
+	LastPersistedTime  time.Time `json:"last_persisted_time,omitzero"` // producer timestamp of the fragment
+	LastPersistedAt    time.Time `json:"last_persisted_at,omitzero"`   // when the ACK arrived
+	LastFragmentNumber string    `json:"last_fragment_number,omitempty"`
+	SincePersisted     float64   `json:"seconds_since_persisted,omitempty"`
+	FragmentsPersisted uint64    `json:"fragments_persisted"`
+	FragmentErrors     uint64    `json:"fragment_errors"`
+}
+
+// CameraError is the most recent error of a camera session.
+type CameraError struct {
+	Source  string    `json:"source"` // publisher, pipeline or kvs
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// SetForwarders sets where the camera sessions find the forwarders without a publisher,
+// e.g. the KVS pool.
+func (s *Server) SetForwarders(source interface{ Forwarders() []*kvs.Forwarder }) {
+	s.forwarders = source
+}
+
+// endPublisher records how the publisher of streamPath ended, sess being nil if it was
+// refused before its session started. shutdown reports whether the listener's context
+// was cancelled.
+func (s *Server) endPublisher(streamPath, remoteAddr, protocol string, sess *session, err error, shutdown bool) {
+	end := &PublisherEnd{
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+		EndedAt:    time.Now(),
+		Reason:     disconnectReason(err, shutdown),
+	}
+	switch {
+	case sess != nil:
+		stats := sess.stats.snapshot()
+		end.SessionID, end.StartedAt, end.Frames = stats.SessionID, stats.StartedAt, stats.Frames
+		end.CameraID, end.Tenant = sess.route.CameraID, tenantName(sess.tenant)
+		end.StreamName, end.Region = sess.forwarder.StreamName(), sess.forwarder.Region()
+		if reason := sess.endReason.Load(); reason != nil {
+			end.Reason = *reason
+		}
+	case err != nil:
+		end.Reason = publisherRefused
+	default:
+		return // closed before it published anything
+	}
+	switch end.Reason {
+	case disconnectError, failReadTimeout, publisherRefused:
+		end.Error = err.Error()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ended == nil {
+		s.ended = make(map[string]*PublisherEnd)
+	}
+	for path, e := range s.ended {
+		if time.Since(e.EndedAt) > publisherEndTTL {
+			delete(s.ended, path)
+		}
+	}
+	s.ended[streamPath] = end
+}
+
+// CameraSessions returns the sessions of the cameras publishing or published within the
+// last day, and of the forwarders without publisher, sorted by stream path and name.
+func (s *Server) CameraSessions() []CameraSession {
+	type active struct {
+		path   string
+		sess   *session
+		stats  *streamStats
+		tenant string
+	}
+	s.mutex.Lock()
+	publishers := make([]active, 0, len(s.publishers))
+	for path, sess := range s.publishers {
+		if stats := s.stats[path]; stats != nil {
+			publishers = append(publishers, active{path, sess, stats, tenantName(sess.tenant)})
+		}
+	}
+	ended := make(map[string]PublisherEnd, len(s.ended))
+	for path, e := range s.ended {
+		ended[path] = *e
+	}
+	s.mutex.Unlock()
+
+	var forwarders []*kvs.Forwarder
+	if s.forwarders != nil {
+		forwarders = s.forwarders.Forwarders()
+	}
+	statuses := make(map[*kvs.Forwarder]*kvs.Status)
+	status := func(f *kvs.Forwarder) *kvs.Status {
+		if st, ok := statuses[f]; ok {
+			return st
+		}
+		st := f.Status()
+		statuses[f] = &st
+		return &st
+	}
+
+	var cameras []CameraSession
+	for _, p := range publishers {
+		stats := p.stats.snapshot()
+		c := CameraSession{
+			CameraID:   p.sess.route.CameraID,
+			StreamPath: p.path,
+			StreamName: p.sess.forwarder.StreamName(),
+			Region:     p.sess.forwarder.Region(),
+			Tenant:     p.tenant,
+			Publisher:  &stats,
+			Pipeline:   status(p.sess.forwarder),
+		}
+		if e, ok := ended[p.path]; ok {
+			c.LastPublisher = &e
+			delete(ended, p.path)
+		}
+		cameras = append(cameras, c)
+	}
+	for path, e := range ended {
+		c := CameraSession{
+			CameraID:      e.CameraID,
+			StreamPath:    path,
+			StreamName:    e.StreamName,
+			Region:        e.Region,
+			Tenant:        e.Tenant,
+			LastPublisher: &e,
+		}
+		for _, f := range forwarders {
+			if f.StreamName() == e.StreamName && f.Region() == e.Region {
+				c.Pipeline = status(f)
+			}
+		}
+		cameras = append(cameras, c)
+	}
+	for _, f := range forwarders {
+		if _, ok := statuses[f]; !ok {
+			cameras = append(cameras, CameraSession{StreamName: f.StreamName(), Region: f.Region(), Pipeline: status(f)})
+		}
+	}
+
+	for i := range cameras {
+		cameras[i].summarize()
+	}
+	sort.Slice(cameras, func(i, j int) bool {
+		if cameras[i].StreamPath != cameras[j].StreamPath {
+			return cameras[i].StreamPath < cameras[j].StreamPath
+		}
+		return cameras[i].StreamName < cameras[j].StreamName
+	})
+	return cameras
+}
+
+// summarize derives the persistence, last error and state of the session.
+func (c *CameraSession) summarize() {
+	if p := c.Pipeline; p != nil && !p.FileSink {
+		acks := p.Acks
+		c.Persistence = &Persistence{
+			LastPersistedTime:  acks.LastPersistedTime,
+			LastPersistedAt:    acks.LastPersistedAt,
+			LastFragmentNumber: acks.LastFragmentNumber,
+			FragmentsPersisted: acks.Counts[kvs.AckPersisted],
+			FragmentErrors:     acks.Counts[kvs.AckError],
+		}
+		if !acks.LastPersistedAt.IsZero() {
+			c.Persistence.SincePersisted = time.Since(acks.LastPersistedAt).Seconds()
+		}
+	}
+
+	var last *CameraError
+	consider := func(source, message string, at time.Time) {
+		if message != "" && !at.IsZero() && (last == nil || at.After(last.At)) {
+			last = &CameraError{Source: source, Message: message, At: at}
+		}
+	}
+	if e := c.LastPublisher; e != nil {
+		consider("publisher", e.Error, e.EndedAt)
+	}
+	if p := c.Pipeline; p != nil {
+		message := p.Errors.LastMessage
+		if p.Errors.LastClass != "" {
+			message = p.Errors.LastClass + ": " + message
+		}
+		consider("pipeline", message, p.Errors.LastErrorAt)
+		if p.Acks.LastErrorCode != "" {
+			consider("kvs", "fragment error "+p.Acks.LastErrorCode, p.Acks.LastErrorAt)
+		}
+	}
+	c.LastError = last
+
+	c.State = c.state()
+}
+
+// state derives the state of the session from the publisher and pipeline.
+func (c *CameraSession) state() string {
+	pub, p := c.Publisher, c.Pipeline
+	switch {
+	case pub == nil:
+		return CameraOffline
+	case pub.ForwardingPaused:
+		return CameraPaused
+	}
+	young := time.Since(pub.StartedAt) < cameraPersistTimeout
+	switch {
+	case p == nil || !p.Running:
+		if young {
+			return CameraStarting
+		}
+		return CameraDegraded
+	case p.FileSink:
+		return CameraLive
+	case p.Acks.LastPersistedAt.After(pub.StartedAt):
+		if time.Since(p.Acks.LastPersistedAt) < cameraPersistTimeout {
+			return CameraLive
+		}
+		return CameraDegraded
+	case young:
+		return CameraStarting
+	default:
+		return CameraDegraded
+	}
+}
+
+// ServeCameras serves the camera sessions as JSON (GET /cameras).
+func (s *Server) ServeCameras(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, s.CameraSessions())
+}
+
+// ServeCamera serves the session of one camera as JSON, selected by camera ID, KVS stream
+// name or stream path (GET /cameras/{id...}, e.g. /cameras/cam-001 or /cameras/live/cam1).
+func (s *Server) ServeCamera(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.PathValue("id"), "/")
+	if id == "" {
+		http.Error(w, "unknown camera", http.StatusNotFound)
+		return
+	}
+	cameras := s.CameraSessions()
+	for _, match := range []func(c CameraSession) bool{
+		func(c CameraSession) bool { return c.CameraID == id },
+		func(c CameraSession) bool { return c.StreamPath == "/"+id },
+		func(c CameraSession) bool { return c.StreamName == id },
+	} {
+		for _, c := range cameras {
+			if match(c) {
+				admin.WriteJSON(w, http.StatusOK, c)
+				return
+			}
+		}
+	}
+	http.Error(w, "unknown camera", http.StatusNotFound)
+}
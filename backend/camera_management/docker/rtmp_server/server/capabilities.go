@@ -0,0 +1,74 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"rtmp_kvs/auth"
+	"rtmp_kvs/kvs"
+)
+
+// Ingest protocols carrying a codec, as named in logs, metrics and events
+var (
+	rtmpProtocols = []string{"RTMP", "RTMPS"}
+	aacProtocols  = []string{"RTMP", "RTMPS", "MPEG-TS/TCP", "MPEG-TS/UDP"}
+	allProtocols  = []string{"RTMP", "RTMPS", "MPEG-TS/TCP", "MPEG-TS/UDP", "HTTP"}
+)
+
+// CodecSupport describes how the server handles a codec.
+type CodecSupport struct {
+	Codec     string   `json:"codec"`    // H264, H265, AAC, PCMA or PCMU
+	Kind      string   `json:"kind"`     // video or audio
+	Handling  string   `json:"handling"` // forward, or transcode to H.264
+	Enabled   bool     `json:"enabled"`
+	Requires  string   `json:"requires,omitempty"` // setting that enables it
+	Protocols []string `json:"protocols"`          // ingest protocols carrying it
+}
+
+// Codecs returns the codecs the server accepts and how: H.264 is forwarded as is, H.265
+// transcoded to H.264 for streams with unsupported_video transcode, AAC forwarded with the
+// video (-forward-audio) or alone (-accept-audio-only), G.711 alone.
+func (s *Server) Codecs() []CodecSupport {
+	gstreamer := kvs.Backend() != kvs.BackendFile
+	return []CodecSupport{
+		{Codec: "H264", Kind: "video", Handling: "forward", Enabled: true, Protocols: allProtocols},
+		{Codec: "H265", Kind: "video", Handling: "transcode", Enabled: gstreamer,
+			Requires: "unsupported_video=transcode", Protocols: rtmpProtocols},
+		{Codec: kvs.AudioCodecAAC, Kind: "audio", Handling: "forward", Enabled: s.forwardAudio || s.audioOnly,
+			Requires: "-forward-audio or -accept-audio-only", Protocols: aacProtocols},
+		{Codec: kvs.AudioCodecPCMA, Kind: "audio", Handling: "forward", Enabled: s.audioOnly,
+			Requires: "-accept-audio-only", Protocols: rtmpProtocols},
+		{Codec: kvs.AudioCodecPCMU, Kind: "audio", Handling: "forward", Enabled: s.audioOnly,
+			Requires: "-accept-audio-only", Protocols: rtmpProtocols},
+	}
+}
+
+// AuthMode describes a way publishers are authorized.
+type AuthMode struct {
+	Mode       string   `json:"mode"`
+	Enabled    bool     `json:"enabled"`
+	Algorithms []string `json:"algorithms,omitempty"` // signing algorithms of jwt
+}
+
+// AuthModes returns the ways publishers can be authorized and whether each is enabled:
+// the stream key (RTMP_STREAM_PATH), JWT stream keys, the publish webhook, the publish
+// keys of the stream registry, tenant policies, the IP filter and signed session tokens.
+func (s *Server) AuthModes() []AuthMode {
+	modes := []AuthMode{
+		{Mode: "stream_key", Enabled: *s.streamKey.Load() != ""},
+		{Mode: "jwt"},
+		{Mode: "webhook"},
+		{Mode: "registry"},
+		{Mode: "tenant", Enabled: s.tenants != nil},
+		{Mode: "ip_filter", Enabled: s.ipFilter != nil},
+		{Mode: "session_token", Enabled: s.takeover.secret != nil},
+	}
+	for _, a := range s.authorizers {
+		switch a := a.(type) {
+		case *auth.JWTAuthorizer:
+			modes[1].Enabled, modes[1].Algorithms = true, a.Algorithms()
+		case *auth.Webhook:
+			modes[2].Enabled = true
+		}
+	}
+	_, modes[3].Enabled = s.router.(*RegistryRouter)
+	return modes
+}
@@ -0,0 +1,242 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/clip"
+)
+
+// How far the arrival of a frame may drift from its presentation time before the buffer's
+// clock is reset (timestamp jumps the conditioner did not smooth, stalls)
+const clipClockDrift = 5 * time.Second
+
+// SetClipBuffer keeps the recent frames of each H.264 publisher for clip export and
+// lookback.
+func (s *Server) SetClipBuffer(config clip.BufferConfig) {
+	s.clipBuffer = config
+}
+
+// clipBuffer is a ring buffer of the frames of a session presented during the last
+// window, starting at a keyframe. In memory it retains access units without copying them,
+// like the GOP cache; with a directory the access units are written to one file per GOP
+// and only their index is kept in memory.
+type clipBuffer struct {
+	config clip.BufferConfig
+
+	mutex  sync.Mutex
+	frames []bufferedFrame
+	bytes  int
+	closed bool
+
+	// Wall clock at PTS 0, maps the stream timeline to presentation times
+	base time.Time
+
+	// On disk: the session's directory and the file of the current GOP
+	dir  string
+	file *os.File
+	gops int
+}
+
+// bufferedFrame is a frame of the buffer. On disk its access unit is nil and is read
+// from size bytes at offset of file.
+type bufferedFrame struct {
+	clip.Frame
+	keyframe bool
+	size     int
+	file     string
+	offset   int64
+}
+
+// add appends a frame, making keyframes self-contained, and drops the oldest GOPs that
+// are no longer needed to cover the window or exceed the size limit.
+func (b *clipBuffer) add(frame h264Frame, params *paramTracker) {
+	keyframe := h264.IsRandomAccess(frame.au)
+	au := frame.au
+	if keyframe {
+		au = params.withParams(au)
+	}
+	size := 0
+	for _, nalu := range au {
+		size += len(nalu)
+	}
+	now := time.Now()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed || (!keyframe && len(b.frames) == 0) {
+		return
+	}
+	if t := b.base.Add(frame.pts); b.base.IsZero() || now.Sub(t).Abs() > clipClockDrift {
+		b.base = now.Add(-frame.pts)
+	}
+	f := bufferedFrame{
+		Frame:    clip.Frame{Time: b.base.Add(frame.pts), PTS: frame.pts, DTS: frame.dts, AU: au},
+		keyframe: keyframe,
+		size:     size,
+	}
+	if b.config.Dir != "" {
+		if err := b.write(&f); err != nil {
+			log.Printf("[Clip] ⚠️  Failed to buffer frame on disk, clearing the buffer: %v", err)
+			b.clear()
+			return
+		}
+	}
+	b.frames = append(b.frames, f)
+	b.bytes += f.size
+
+	cutoff := f.Time.Add(-b.config.Window)
+	for {
+		next := slices.IndexFunc(b.frames[1:], func(f bufferedFrame) bool { return f.keyframe }) + 1
+		if next == 0 || (b.bytes <= b.config.MaxBytes && b.frames[next].Time.After(cutoff)) {
+			return
+		}
+		b.drop(next)
+	}
+}
+
+// drop removes the first n frames, a whole number of GOPs, deleting their files.
+func (b *clipBuffer) drop(n int) {
+	for _, f := range b.frames[:n] {
+		b.bytes -= f.size
+		if f.keyframe && f.file != "" {
+			os.Remove(f.file)
+		}
+	}
+	b.frames = slices.Delete(b.frames, 0, n)
+}
+
+// clear empties the buffer, which then restarts at the next keyframe.
+func (b *clipBuffer) clear() {
+	b.drop(len(b.frames))
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+// write appends the access unit of f to the file of its GOP, starting a file at every
+// keyframe, and replaces it by its location. NAL units are stored with 4-byte lengths.
+func (b *clipBuffer) write(f *bufferedFrame) error {
+	if f.keyframe || b.file == nil {
+		if b.file != nil {
+			b.file.Close()
+			b.file = nil
+		}
+		if b.dir == "" {
+			dir, err := os.MkdirTemp(b.config.Dir, "session-")
+			if err != nil {
+				return err
+			}
+			b.dir = dir
+		}
+		file, err := os.Create(filepath.Join(b.dir, fmt.Sprintf("%08d.gop", b.gops)))
+		if err != nil {
+			return err
+		}
+		b.file = file
+		b.gops++
+	}
+	offset, err := b.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, f.size+4*len(f.AU))
+	for _, nalu := range f.AU {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(nalu)))
+		buf = append(buf, nalu...)
+	}
+	if _, err := b.file.Write(buf); err != nil {
+		return err
+	}
+	f.file, f.offset, f.size, f.AU = b.file.Name(), offset, len(buf), nil
+	return nil
+}
+
+// read returns the access unit of a frame stored on disk.
+func (f *bufferedFrame) read() ([][]byte, error) {
+	file, err := os.Open(f.file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	buf := make([]byte, f.size)
+	if _, err := file.ReadAt(buf, f.offset); err != nil {
+		return nil, err
+	}
+	var au [][]byte
+	for len(buf) >= 4 {
+		n := int(binary.BigEndian.Uint32(buf))
+		if n > len(buf)-4 {
+			return nil, errors.New("truncated frame")
+		}
+		au = append(au, buf[4:4+n])
+		buf = buf[4+n:]
+	}
+	return au, nil
+}
+
+// clip returns the frames from the last keyframe presented at or before start up to end.
+func (b *clipBuffer) clip(start, end time.Time) ([]clip.Frame, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	first := 0
+	for i, f := range b.frames {
+		if f.Time.After(start) {
+			break
+		}
+		if f.keyframe {
+			first = i
+		}
+	}
+	last := first
+	for last < len(b.frames) && !b.frames[last].Time.After(end) {
+		last++
+	}
+
+	frames := make([]clip.Frame, 0, last-first)
+	for _, f := range b.frames[first:last] {
+		if f.file != "" {
+			au, err := f.read()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read buffered frame: %w", err)
+			}
+			f.AU = au
+		}
+		frames = append(frames, f.Frame)
+	}
+	return frames, nil
+}
+
+// close releases the buffer and removes its files.
+func (b *clipBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.clear()
+	if b.dir != "" {
+		os.RemoveAll(b.dir)
+	}
+}
+
+// ClipFrames implements clip.Source.
+func (s *Server) ClipFrames(streamPath string, start, end time.Time) ([]clip.Frame, error) {
+	s.mutex.Lock()
+	ss, exists := s.publishers[streamPath]
+	s.mutex.Unlock()
+	if !exists || ss.clip == nil {
+		return nil, fmt.Errorf("%w: %s is not live", clip.ErrNotBuffered, streamPath)
+	}
+	return ss.clip.clip(start, end)
+}
@@ -0,0 +1,220 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"slices"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/bluenviron/gortmplib/pkg/codecs"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h265"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
+	mpegtscodecs "github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts/codecs"
+
+	"rtmp_kvs/events"
+	"rtmp_kvs/kvs"
+)
+
+// videoCodecName returns the name of a video codec for logs, events and status messages.
+func videoCodecName(codec codecs.Codec) string {
+	switch codec.(type) {
+	case *codecs.H264:
+		return "H264"
+	case *codecs.H265:
+		return "H265"
+	case *codecs.AV1:
+		return "AV1"
+	case *codecs.VP9:
+		return "VP9"
+	}
+	return fmt.Sprintf("%T", codec)
+}
+
+// applyVideoPolicy applies the unsupported_video policy of the stream to the video tracks
+// of an RTMP publisher that are not H.264. It returns the H.265 track to transcode, or an
+// error once the publisher was sent a NetStream.Publish.Rejected status:
+//   - ignore: the tracks are not read (the current behavior)
+//   - reject: the publisher is refused
+//   - transcode: an H.265 track is re-encoded to H.264 if the publisher has no H.264
+//     track; other codecs are refused
+func (s *Server) applyVideoPolicy(ctx context.Context, conn gortmplib.Conn, route *Route, tracks []*gortmplib.Track, streamPath, remoteAddr, protocol string) (*gortmplib.Track, error) {
+	policy := route.Config().UnsupportedVideo
+	if policy == "" || policy == kvs.TrackIgnore {
+		return nil, nil
+	}
+	hasH264 := slices.ContainsFunc(tracks, func(t *gortmplib.Track) bool {
+		_, ok := t.Codec.(*codecs.H264)
+		return ok
+	})
+	var transcode *gortmplib.Track
+	for _, track := range tracks {
+		if !track.Codec.IsVideo() {
+			continue
+		}
+		switch track.Codec.(type) {
+		case *codecs.H264:
+			continue
+		case *codecs.H265:
+			if policy == kvs.TrackTranscode {
+				if !hasH264 && transcode == nil {
+					transcode = track
+				}
+				continue
+			}
+		}
+		codec := videoCodecName(track.Codec)
+		detail := fmt.Sprintf("%s, %s accepts H.264 only", codec, streamPath)
+		if policy == kvs.TrackTranscode {
+			detail = fmt.Sprintf("%s, %s accepts H.264, or H.265 to transcode", codec, streamPath)
+		}
+		log.Printf("[%s] ⚠️  Rejecting publisher %s of %s: %s video track (policy %s)", protocol, remoteAddr, streamPath, codec, policy)
+		s.rejectStatus(conn, protocol, remoteAddr, statusPublishRejected, "Unsupported video codec", detail)
+		s.countFailure(ctx, protocol, remoteAddr, failUnsupportedCodec)
+		events.Emit(events.Event{
+			Type:       events.TrackRejected,
+			StreamPath: streamPath,
+			StreamName: route.Forwarder.StreamName(),
+			CameraID:   route.CameraID,
+			RemoteAddr: remoteAddr,
+			Protocol:   protocol,
+			Detail:     map[string]any{"codec": codec, "policy": policy},
+		})
+		return nil, fmt.Errorf("unsupported video codec %s", codec)
+	}
+	return transcode, nil
+}
+
+// hevcTranscoder re-encodes the H.265 track of a publisher to H.264 with GStreamer. Access
+// units are muxed to MPEG-TS on the stdin of gst-launch-1.0 by the reader goroutine; the
+// H.264 it produces is demuxed from its stdout and queued for the forwarder like MPEG-TS
+// ingest, with the parameter sets in-band.
+type hevcTranscoder struct {
+	ss     *session
+	codec  *codecs.H265
+	stdin  io.WriteCloser
+	writer *mpegts.Writer
+	track  *mpegts.Track
+}
+
+// startHEVCTranscoder starts the transcoding pipeline of a session. It runs until the
+// session ends; if it fails earlier, the publisher is disconnected.
+func (ss *session) startHEVCTranscoder(codec *codecs.H265) (*hevcTranscoder, error) {
+	args := []string{"-q",
+		"fdsrc", "fd=0",
+		"!", "tsdemux",
+		"!", "h265parse",
+		"!", "avdec_h265",
+		"!", "videoconvert",
+		"!",
+	}
+	args = append(args, kvs.EncoderElements()...)
+	args = append(args,
+		"config-interval=-1",
+		"!", "video/x-h264,stream-format=byte-stream,alignment=au",
+		"!", "mpegtsmux",
+		"!", "fdsink", "fd=1",
+	)
+	cmd := exec.CommandContext(ss.ctx, "gst-launch-1.0", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &hevcTranscoder{ss: ss, codec: codec, stdin: stdin, track: &mpegts.Track{Codec: &mpegtscodecs.H265{}}}
+	t.writer = &mpegts.Writer{W: stdin, Tracks: []*mpegts.Track{t.track}}
+	if err := t.writer.Initialize(); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start transcoder: %w", err)
+	}
+	log.Printf("[%s] Transcoding H.265 of %s to H.264", ss.protocol, ss.streamPath)
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("[%s] Transcoder of %s: %s", ss.protocol, ss.streamPath, scanner.Text())
+		}
+	}()
+	go func() {
+		err := t.readOutput(stdout)
+		cmd.Wait()
+		if ss.ctx.Err() == nil {
+			log.Printf("[%s] ⚠️  Transcoder of %s stopped (%v), disconnecting %s", ss.protocol, ss.streamPath, err, ss.remoteAddr)
+			ss.cancel()
+		}
+	}()
+	return t, nil
+}
+
+// readOutput forwards the H.264 access units produced by the pipeline until its stdout
+// is closed.
+func (t *hevcTranscoder) readOutput(r io.Reader) error {
+	reader := &mpegts.Reader{R: r}
+	if err := reader.Initialize(); err != nil {
+		return fmt.Errorf("failed to read transcoder output: %w", err)
+	}
+	var videoTrack *mpegts.Track
+	for _, track := range reader.Tracks() {
+		if _, ok := track.Codec.(*mpegtscodecs.H264); ok {
+			videoTrack = track
+			break
+		}
+	}
+	if videoTrack == nil {
+		return fmt.Errorf("no H.264 track in transcoder output")
+	}
+
+	var td mpegts.TimeDecoder
+	td.Initialize()
+	reader.OnDataH264(videoTrack, func(pts, dts int64, au [][]byte) error {
+		decodedDTS := td.Decode(dts)
+		t.ss.writeH264(ticksToDuration(decodedDTS+ptsOffset(pts, dts)), ticksToDuration(decodedDTS), au)
+		return nil
+	})
+	for {
+		if err := reader.Read(); err != nil {
+			return err
+		}
+	}
+}
+
+// write passes an H.265 access unit to the pipeline. RTMP carries the parameter sets in
+// the sequence header, so they are prepended to random access pictures that lack them.
+func (t *hevcTranscoder) write(pts, dts time.Duration, au [][]byte) {
+	if h265.IsRandomAccess(au) && !slices.ContainsFunc(au, func(nalu []byte) bool {
+		return len(nalu) > 0 && h265.NALUType((nalu[0]>>1)&0b111111) == h265.NALUType_VPS_NUT
+	}) {
+		au = append([][]byte{t.codec.VPS, t.codec.SPS, t.codec.PPS}, au...)
+	}
+	if err := t.writer.WriteH265(t.track, durationToTicks(pts), durationToTicks(dts), au); err != nil {
+		if t.ss.ctx.Err() == nil {
+			log.Printf("[%s] ⚠️  Failed to write to the transcoder of %s: %v", t.ss.protocol, t.ss.streamPath, err)
+			t.ss.cancel()
+		}
+	}
+}
+
+// close ends the input of the pipeline.
+func (t *hevcTranscoder) close() {
+	t.stdin.Close()
+}
+
+// durationToTicks converts a duration to 90 kHz ticks.
+func durationToTicks(d time.Duration) int64 {
+	return int64(d/time.Second)*90000 + int64(d%time.Second)*90000/int64(time.Second)
+}
@@ -0,0 +1,164 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"rtmp_kvs/metrics"
+)
+
+// Reasons a connection was closed before or while publishing
+const (
+	failIPDenied           = "ip_denied"           // outside the CIDR allow/deny lists
+	failHandshake          = "handshake"           // TLS or RTMP handshake, connect/publish commands
+	failAuth               = "auth"                // stream path, token, webhook or registry rejection
+	failDuplicatePublisher = "duplicate_publisher" // the path or its KVS stream already has a publisher
+	failUnsupportedCodec   = "unsupported_codec"   // no H.264 (or accepted audio) track
+	failReadTimeout        = "read_timeout"        // no data for the read timeout
+	failVideoTimeout       = "video_timeout"       // data, but no video for the video timeout
+	failQueueFull          = "queue_full"          // frame queue full (FRAME_QUEUE_STRATEGY=disconnect)
+	failTenantQuota        = "tenant_quota"        // the tenant has max_streams publishers
+	failMalformed          = "malformed_input"     // RTMP chunk stream outside the input limits
+	failQuarantined        = "quarantined"         // the address sent malformed input too often
+)
+
+// Source prefixes tracked before further ones are counted as "other", so a scan from
+// many networks cannot blow up the number of metric series
+const maxConnMetricPrefixes = 500
+
+// connCounterKey identifies a connection counter.
+type connCounterKey struct {
+	listener string // RTMP, RTMPS, MPEG-TS/TCP, MPEG-TS/UDP
+	prefix   string // source network (e.g. 203.0.113.0/24)
+	reason   string // empty for accepted connections
+}
+
+// connCounters counts accepted connections and connection failures by listener and
+// source network, to tell misconfigured cameras (a few networks, auth or codec errors)
+// from abuse (many networks, handshake failures).
+type connCounters struct {
+	mutex    sync.Mutex
+	counts   map[connCounterKey]uint64
+	prefixes map[string]struct{}
+
+	ipv4Bits int
+	ipv6Bits int
+}
+
+// newConnCounters reads CONN_METRICS_IPV4_PREFIX (default 24) and
+// CONN_METRICS_IPV6_PREFIX (default 48), the prefix lengths source addresses are
+// aggregated to.
+func newConnCounters() *connCounters {
+	return &connCounters{
+		counts:   make(map[connCounterKey]uint64),
+		prefixes: make(map[string]struct{}),
+		ipv4Bits: envPrefixBits("CONN_METRICS_IPV4_PREFIX", 24, 32),
+		ipv6Bits: envPrefixBits("CONN_METRICS_IPV6_PREFIX", 48, 128),
+	}
+}
+
+// envPrefixBits reads a prefix length between 0 and limit.
+func envPrefixBits(name string, def, limit int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < 0 || bits > limit {
+		return def
+	}
+	return bits
+}
+
+// sourcePrefix returns the source network of a remote address.
+func (c *connCounters) sourcePrefix(remoteAddr string) string {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return "unknown"
+	}
+	addr := addrPort.Addr().Unmap()
+	bits := c.ipv6Bits
+	if addr.Is4() {
+		bits = c.ipv4Bits
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "unknown"
+	}
+	return prefix.String()
+}
+
+// add increments the counter of a listener, source and reason.
+func (c *connCounters) add(listener, remoteAddr, reason string) {
+	prefix := c.sourcePrefix(remoteAddr)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.prefixes[prefix]; !ok {
+		if len(c.prefixes) >= maxConnMetricPrefixes {
+			prefix = "other"
+		} else {
+			c.prefixes[prefix] = struct{}{}
+		}
+	}
+	c.counts[connCounterKey{listener: listener, prefix: prefix, reason: reason}]++
+}
+
+// collect writes the counters, sorted for a stable exposition.
+func (c *connCounters) collect(w *metrics.Writer) {
+	c.mutex.Lock()
+	keys := make([]connCounterKey, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	counts := make([]uint64, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.listener != b.listener {
+			return a.listener < b.listener
+		}
+		if a.prefix != b.prefix {
+			return a.prefix < b.prefix
+		}
+		return a.reason < b.reason
+	})
+	for i, key := range keys {
+		counts[i] = c.counts[key]
+	}
+	c.mutex.Unlock()
+
+	for i, key := range keys {
+		if key.reason == "" {
+			w.Counter("rtmp_connections_total", "Connections accepted by listener and source network", float64(counts[i]),
+				"listener", key.listener, "source_prefix", key.prefix)
+		} else {
+			w.Counter("rtmp_connection_failures_total", "Connections closed by handshake, auth, codec or timeout failures", float64(counts[i]),
+				"listener", key.listener, "source_prefix", key.prefix, "reason", key.reason)
+		}
+	}
+}
+
+// countConnection counts an accepted connection.
+func (s *Server) countConnection(protocol, remoteAddr string) {
+	s.connCounters.add(protocol, remoteAddr, "")
+}
+
+// countFailure counts a connection failure, and records it as the reason the connection
+// ends in the audit record of ctx.
+func (s *Server) countFailure(ctx context.Context, protocol, remoteAddr, reason string) {
+	s.connCounters.add(protocol, remoteAddr, reason)
+	auditFrom(ctx).setReason(reason)
+}
+
+// isTimeout reports whether err is a network timeout (read deadline exceeded).
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
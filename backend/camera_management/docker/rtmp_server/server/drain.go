@@ -0,0 +1,28 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"log"
+)
+
+// Drain stops accepting new connections on all listeners (and ends the MPEG-TS/UDP
+// session) while existing connections carry on. It is used when a new process has taken
+// over the listeners; Serve returns once the drained connections have finished.
+func (s *Server) Drain() {
+	if s.draining.CompareAndSwap(false, true) {
+		log.Printf("[RTMP] Draining: no longer accepting connections")
+		s.drain()
+	}
+}
+
+// acceptContext returns a context derived from ctx that is also cancelled when the server
+// starts draining. Listeners are closed on it; connections keep using ctx.
+func (s *Server) acceptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	acceptCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.drainCtx, cancel)
+	return acceptCtx, func() {
+		stop()
+		cancel()
+	}
+}
@@ -0,0 +1,285 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/metrics"
+)
+
+// Repairs of malformed access units (metric label values)
+const (
+	repairSplit         = "split_nalu"             // Annex-B start codes inside an AVCC NAL unit
+	repairEmulation     = "emulation_prevention"   // missing emulation prevention bytes inserted
+	repairEmpty         = "empty_nalu"             // empty NAL unit removed
+	repairForbiddenBit  = "forbidden_bit"          // NAL unit with forbidden_zero_bit set removed
+	repairReordered     = "reordered"              // AUD / SEI / SPS / PPS moved before the slices
+	repairMissingParams = "missing_parameter_sets" // picture before any SPS/PPS dropped
+	repairTrailingZeros = "trailing_zeros"         // zero bytes after the end of a NAL unit removed
+)
+
+// h264ValidationEnabled reads H264_VALIDATE (default true).
+func h264ValidationEnabled() bool {
+	return os.Getenv("H264_VALIDATE") != "false"
+}
+
+// repairCounters counts repairs by kind across all publishers.
+type repairCounters struct {
+	mutex  sync.Mutex
+	counts map[string]uint64
+}
+
+func (c *repairCounters) add(kind string) {
+	c.mutex.Lock()
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[kind]++
+	c.mutex.Unlock()
+}
+
+func (c *repairCounters) collect(w *metrics.Writer) {
+	c.mutex.Lock()
+	kinds := make([]string, 0, len(c.counts))
+	for kind := range c.counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	counts := make([]uint64, len(kinds))
+	for i, kind := range kinds {
+		counts[i] = c.counts[kind]
+	}
+	c.mutex.Unlock()
+
+	for i, kind := range kinds {
+		w.Counter("rtmp_h264_repairs_total", "Malformed H.264 access units repaired or dropped before forwarding", float64(counts[i]), "kind", kind)
+	}
+}
+
+// h264Validator checks the access units of one publisher and repairs what buggy camera
+// firmware gets wrong, so malformed input cannot reach kvssink (where h264parse errors
+// stop the pipeline). Every repair is counted, and logged once per publisher and kind.
+type h264Validator struct {
+	ss       *session
+	haveSPS  bool
+	havePPS  bool
+	repaired map[string]bool
+}
+
+// newH264Validator creates a validator; sps and pps are the parameter sets from the
+// track header, if any.
+func newH264Validator(ss *session, sps, pps []byte) *h264Validator {
+	return &h264Validator{
+		ss:       ss,
+		haveSPS:  len(sps) > 0,
+		havePPS:  len(pps) > 0,
+		repaired: make(map[string]bool),
+	}
+}
+
+// repair records a repair.
+func (v *h264Validator) repair(kind string) {
+	v.ss.server.h264Repairs.add(kind)
+	if !v.repaired[kind] {
+		v.repaired[kind] = true
+		log.Printf("[%s] ⚠️  Repairing malformed H.264 from %s on %s: %s (logged once per publisher)",
+			v.ss.protocol, v.ss.remoteAddr, v.ss.streamPath, kind)
+	}
+}
+
+// check returns the repaired access unit, or nil to drop it. The input is never modified.
+func (v *h264Validator) check(au [][]byte) [][]byte {
+	var out [][]byte
+	for _, nalu := range au {
+		for _, part := range v.split(nalu) {
+			if part = v.trim(part); len(part) == 0 {
+				v.repair(repairEmpty)
+				continue
+			}
+			if part[0]&0x80 != 0 {
+				v.repair(repairForbiddenBit)
+				continue
+			}
+			out = append(out, v.escape(part))
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	out = v.reorder(out)
+
+	picture := false
+	for _, nalu := range out {
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			v.haveSPS = true
+		case h264.NALUTypePPS:
+			v.havePPS = true
+		case h264.NALUTypeIDR, h264.NALUTypeNonIDR:
+			picture = true
+		}
+	}
+	if picture && (!v.haveSPS || !v.havePPS) {
+		v.repair(repairMissingParams)
+		return nil
+	}
+	return out
+}
+
+// split separates NAL units that the camera concatenated with Annex-B start codes into
+// a single AVCC NAL unit (typically SPS+PPS+IDR). A start code only splits when it is
+// followed by a plausible NAL header; otherwise it is missing emulation prevention,
+// which escape repairs.
+func (v *h264Validator) split(nalu []byte) [][]byte {
+	// Start code in front of the NAL unit
+	start := startCodeLength(nalu, 0)
+	nalu = nalu[start:]
+
+	var parts [][]byte
+	begin := 0
+	for i := 1; i+3 < len(nalu); i++ {
+		if nalu[i] != 0 || nalu[i+1] != 0 || nalu[i+2] != 1 || !plausibleHeader(nalu[i+3]) {
+			continue
+		}
+		end := i
+		for end > begin && nalu[end-1] == 0 {
+			end-- // leading zero of a 4-byte start code
+		}
+		parts = append(parts, nalu[begin:end])
+		begin = i + 3
+		i += 3
+	}
+	if start > 0 || parts != nil {
+		v.repair(repairSplit)
+	}
+	if parts == nil {
+		return [][]byte{nalu}
+	}
+	return append(parts, nalu[begin:])
+}
+
+// startCodeLength returns the length of the Annex-B start code at i, or 0.
+func startCodeLength(buf []byte, i int) int {
+	switch {
+	case len(buf) >= i+4 && buf[i] == 0 && buf[i+1] == 0 && buf[i+2] == 0 && buf[i+3] == 1:
+		return 4
+	case len(buf) >= i+3 && buf[i] == 0 && buf[i+1] == 0 && buf[i+2] == 1:
+		return 3
+	}
+	return 0
+}
+
+// plausibleHeader reports whether b can start a NAL unit of a camera stream.
+func plausibleHeader(b byte) bool {
+	if b&0x80 != 0 {
+		return false
+	}
+	switch h264.NALUType(b & 0x1F) {
+	case h264.NALUTypeNonIDR, h264.NALUTypeIDR, h264.NALUTypeSEI, h264.NALUTypeSPS,
+		h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter:
+		// Reference slices and parameter sets have nal_ref_idc > 0, SEI and AUD have 0
+		return true
+	}
+	return false
+}
+
+// trim removes zero bytes after the end of the NAL unit (the leading zero of a 4-byte
+// start code or zero stuffing), which the last byte of a NAL unit cannot be.
+func (v *h264Validator) trim(nalu []byte) []byte {
+	end := len(nalu)
+	for end > 0 && nalu[end-1] == 0 {
+		end--
+	}
+	if end < len(nalu) {
+		v.repair(repairTrailingZeros)
+	}
+	return nalu[:end]
+}
+
+// escape inserts the emulation prevention bytes the encoder left out: within a NAL unit,
+// two zero bytes must never be followed by 0x00, 0x01 or 0x02.
+func (v *h264Validator) escape(nalu []byte) []byte {
+	if !needsEscape(nalu) {
+		return nalu
+	}
+	v.repair(repairEmulation)
+	out := make([]byte, 0, len(nalu)+len(nalu)/64+1)
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b <= 3 {
+			if b != 3 {
+				out = append(out, 3)
+			}
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// needsEscape reports whether the NAL unit contains 0x0000 followed by 0x00-0x02.
+func needsEscape(nalu []byte) bool {
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b <= 2 {
+			return true
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return false
+}
+
+// reorder moves an access unit delimiter to the front and SEI / parameter sets that
+// follow the first slice in front of it, as the access unit order requires.
+func (v *h264Validator) reorder(au [][]byte) [][]byte {
+	firstSlice := -1
+	misplaced := false
+	for i, nalu := range au {
+		switch typ := h264.NALUType(nalu[0] & 0x1F); {
+		case typ == h264.NALUTypeAccessUnitDelimiter:
+			misplaced = misplaced || i > 0
+		case typ >= h264.NALUTypeNonIDR && typ <= h264.NALUTypeIDR:
+			if firstSlice < 0 {
+				firstSlice = i
+			}
+		case typ == h264.NALUTypeSEI || typ == h264.NALUTypeSPS || typ == h264.NALUTypePPS:
+			misplaced = misplaced || firstSlice >= 0
+		}
+	}
+	if !misplaced {
+		return au
+	}
+	v.repair(repairReordered)
+
+	var aud, prefix, rest [][]byte
+	for _, nalu := range au {
+		switch typ := h264.NALUType(nalu[0] & 0x1F); {
+		case typ == h264.NALUTypeAccessUnitDelimiter:
+			if aud == nil {
+				aud = [][]byte{nalu}
+			}
+		case typ == h264.NALUTypeSEI || typ == h264.NALUTypeSPS || typ == h264.NALUTypePPS:
+			prefix = append(prefix, nalu)
+		default:
+			rest = append(rest, nalu)
+		}
+	}
+	out := make([][]byte, 0, len(au))
+	out = append(out, aud...)
+	out = append(out, prefix...)
+	return append(out, rest...)
+}
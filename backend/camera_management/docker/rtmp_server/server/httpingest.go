@@ -0,0 +1,393 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/audit"
+	"rtmp_kvs/auth"
+	"rtmp_kvs/registry"
+)
+
+// Largest NAL unit accepted from an HTTP publisher; without start codes for this long the
+// body is not an Annex-B stream
+const maxAnnexBNALU = 8 << 20
+
+// ServeHTTPIngest accepts H.264 elementary streams in Annex-B format POSTed to
+// /ingest/<stream path>, as minimal embedded devices produce them, e.g.
+//
+//	curl -T cam.h264 -H "Transfer-Encoding: chunked" "http://host:8088/ingest/live/cam1?token=..."
+//
+// A request publishes until its body ends. Publishers are authorized, routed and counted
+// like RTMP publishers; the query string carries the credentials. Like Serve, it runs
+// until ctx is cancelled and returns once its requests have finished.
+func (s *Server) ServeHTTPIngest(ctx context.Context, ln net.Listener) error {
+	const protocol = "HTTP"
+
+	var requests sync.WaitGroup
+	defer requests.Wait()
+
+	// PUT is accepted as well, since curl -T streams with it
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		defer requests.Done()
+		s.serveIngest(ctx, w, r, protocol)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /ingest/{path...}", handler)
+	mux.HandleFunc("PUT /ingest/{path...}", handler)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: s.connConfig.HandshakeTimeout,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			s.connConfig.tuneConn(conn)
+			return context.WithValue(ctx, httpConnKey{}, conn)
+		},
+		ErrorLog: log.Default(),
+	}
+
+	// Draining stops accepting new requests, cancelling ctx also ends the ones in progress
+	acceptCtx, cancel := s.acceptContext(ctx)
+	defer cancel()
+	stopAccept := context.AfterFunc(acceptCtx, func() { srv.Shutdown(context.Background()) })
+	defer stopAccept()
+	stopServe := context.AfterFunc(ctx, func() { srv.Close() })
+	defer stopServe()
+
+	err := srv.Serve(&admitListener{Listener: ln, server: s, protocol: protocol})
+	if errors.Is(err, http.ErrServerClosed) || acceptCtx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("%s listener failed: %w", protocol, err)
+}
+
+// httpConnKey is the context key of the connection of an HTTP request.
+type httpConnKey struct{}
+
+// admitListener applies the IP filter to the connections of an HTTP listener.
+type admitListener struct {
+	net.Listener
+	server   *Server
+	protocol string
+}
+
+func (l *admitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.server.admit(conn.RemoteAddr(), l.protocol) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// serveIngest handles one publisher request. ctx is the listener's context: the session
+// (and the forwarder's pipeline during the grace period) outlives the request.
+func (s *Server) serveIngest(ctx context.Context, w http.ResponseWriter, r *http.Request, protocol string) {
+	remoteAddr := r.RemoteAddr
+	streamPath := "/" + r.PathValue("path")
+	log.Printf("[%s] Publisher request from %s for %s", protocol, remoteAddr, auth.RedactStreamPath(streamPath))
+	s.countConnection(protocol, remoteAddr)
+
+	connCtx, connAudit := s.startAudit(ctx, remoteAddr, protocol)
+	frames, err := s.ingestAnnexB(connCtx, w, r, streamPath, remoteAddr, protocol)
+	if err != nil {
+		if isTimeout(err) {
+			s.countFailure(connCtx, protocol, remoteAddr, failReadTimeout)
+		}
+		log.Printf("[%s] Request from %s closed after %d frames: %v", protocol, remoteAddr, frames, err)
+	} else {
+		log.Printf("[%s] Request from %s finished after %d frames", protocol, remoteAddr, frames)
+		admin.WriteJSON(w, http.StatusOK, map[string]any{"frames": frames})
+	}
+	s.finishAudit(connAudit, err, ctx.Err() != nil)
+}
+
+// ingestAnnexB authorizes and routes an HTTP publisher and forwards the access units of
+// its request body. Errors before the body is read are answered with a status code. It
+// returns the number of access units forwarded.
+func (s *Server) ingestAnnexB(ctx context.Context, w http.ResponseWriter, r *http.Request, streamPath, remoteAddr, protocol string) (frames int, err error) {
+	conn, _ := r.Context().Value(httpConnKey{}).(net.Conn)
+	fail := func(status int, err error) (int, error) {
+		http.Error(w, err.Error(), status)
+		return 0, err
+	}
+
+	var sess *session
+	defer func() { s.endPublisher(streamPath, remoteAddr, protocol, sess, err, ctx.Err() != nil) }()
+
+	ctx, streamPath = s.withPathTenant(ctx, streamPath)
+	auditFrom(ctx).update(func(rec *audit.Record) {
+		rec.Mode = "publish"
+		rec.StreamPath = auth.RedactStreamPath(streamPath)
+		rec.TLS = auth.NewTLSInfo(conn)
+		rec.Tenant = tenantName(tenantFrom(ctx))
+	})
+
+	// The same path checks and authorizers as for RTMP publishers
+	if key := *s.streamKey.Load(); key != "" && !slices.Contains(s.StreamKeyPaths(key), streamPath) {
+		return fail(http.StatusForbidden, s.rejectPublisher(ctx, protocol, remoteAddr, streamPath, errors.New("invalid stream path")))
+	}
+	ctx, err = s.matchPath(ctx, streamPath)
+	if err != nil {
+		return fail(http.StatusNotFound, s.rejectPublisher(ctx, protocol, remoteAddr, streamPath, err))
+	}
+	authReq := auth.NewPublishRequest(protocol, streamPath, r.URL.Query(), conn, remoteAddr)
+	if m := pathMatchFrom(ctx); m != nil {
+		authReq.Params = m.params
+	}
+	if err := s.authorize(ctx, authReq); err != nil {
+		return fail(http.StatusForbidden, err)
+	}
+	if authReq.StreamPath != streamPath {
+		if ctx, err = s.matchPath(ctx, authReq.StreamPath); err != nil {
+			return fail(http.StatusNotFound, s.rejectPublisher(ctx, protocol, remoteAddr, authReq.StreamPath, err))
+		}
+	}
+	streamPath = tenantFrom(ctx).sessionPath(authReq.StreamPath)
+
+	route, err := s.route(ctx, streamPath, remoteAddr, protocol)
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, registry.ErrNotFound) || errors.Is(err, registry.ErrDisabled) || errors.Is(err, errTenantRole) {
+			status = http.StatusForbidden
+		}
+		return fail(status, err)
+	}
+
+	var fps float64
+	if value := r.URL.Query().Get("fps"); value != "" {
+		if fps, err = strconv.ParseFloat(value, 64); err != nil || fps <= 0 || fps > 240 {
+			return fail(http.StatusBadRequest, fmt.Errorf("invalid fps %q", value))
+		}
+	}
+
+	var closer io.Closer
+	if conn != nil {
+		closer = conn
+	}
+	sess, err = s.openSession(ctx, route, closer, streamPath, remoteAddr, protocol, authReq.Query[sessionTokenParam])
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		switch {
+		case errors.Is(err, errDuplicatePublisher):
+			status = http.StatusConflict
+		case errors.Is(err, errTenantQuota):
+			status = http.StatusTooManyRequests
+		}
+		return fail(status, err)
+	}
+	defer sess.close()
+	sess.trackDetected("H264", true)
+
+	// Parameter sets are carried in-band
+	if err := sess.startH264(nil, nil); err != nil {
+		return fail(http.StatusServiceUnavailable, err)
+	}
+
+	body := &limitedReader{
+		r:       &requestReader{body: r.Body, rc: http.NewResponseController(w), timeout: s.connConfig.ReadTimeout},
+		limiter: s.newBitrateLimiter(route, streamPath, remoteAddr, protocol),
+		tenant:  s.newTenantLimiter(ctx, route, streamPath, remoteAddr, protocol),
+	}
+	scanner := &naluScanner{r: body}
+	splitter := &accessUnitSplitter{fps: fps}
+
+	log.Printf("[%s] Starting read loop for %s...", protocol, remoteAddr)
+	for {
+		nalu, err := scanner.next()
+		if err == io.EOF {
+			if pts, au := splitter.flush(); au != nil {
+				sess.writeH264(pts, pts, au)
+				frames++
+			}
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		if pts, au := splitter.add(nalu); au != nil {
+			sess.writeH264(pts, pts, au)
+			frames++
+		}
+	}
+}
+
+// requestReader reads a request body, extending the read deadline before every read.
+type requestReader struct {
+	body    io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (r *requestReader) Read(p []byte) (int, error) {
+	r.rc.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.body.Read(p)
+}
+
+// naluScanner splits an Annex-B byte stream into NAL units.
+type naluScanner struct {
+	r    io.Reader
+	buf  []byte
+	scan int // offset from which to look for the start code ending the first NAL unit
+	eof  bool
+}
+
+// next returns the next NAL unit without start code, or io.EOF at the end of the stream.
+// Data before the first start code is skipped.
+func (sc *naluScanner) next() ([]byte, error) {
+	for {
+		if start, codeLen := findStartCode(sc.buf, 0); start >= 0 {
+			begin := start + codeLen
+			if end, _ := findStartCode(sc.buf, max(begin, sc.scan)); end >= 0 {
+				nalu := bytes.Clone(trimTrailingZeros(sc.buf[begin:end]))
+				sc.buf = sc.buf[end:]
+				sc.scan = 0
+				if len(nalu) == 0 {
+					continue
+				}
+				return nalu, nil
+			}
+			if sc.eof {
+				nalu := trimTrailingZeros(sc.buf[begin:])
+				sc.buf = nil
+				if len(nalu) == 0 {
+					return nil, io.EOF
+				}
+				return nalu, nil
+			}
+			// A start code may straddle the next read
+			sc.scan = max(begin, len(sc.buf)-3)
+			if len(sc.buf)-begin > maxAnnexBNALU {
+				return nil, fmt.Errorf("NAL unit larger than %d bytes, not an Annex-B stream", maxAnnexBNALU)
+			}
+		} else if sc.eof {
+			return nil, io.EOF
+		} else if len(sc.buf) > 3 {
+			sc.buf = sc.buf[len(sc.buf)-3:]
+		}
+
+		chunk := make([]byte, 64*1024)
+		n, err := sc.r.Read(chunk)
+		sc.buf = append(sc.buf, chunk[:n]...)
+		if err == io.EOF {
+			sc.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// findStartCode returns the offset and length of the first start code (00 00 01 or
+// 00 00 00 01) at or after from, or -1.
+func findStartCode(b []byte, from int) (int, int) {
+	i := bytes.Index(b[from:], []byte{0, 0, 1})
+	if i < 0 {
+		return -1, 0
+	}
+	i += from
+	if i > 0 && b[i-1] == 0 {
+		return i - 1, 4
+	}
+	return i, 3
+}
+
+// trimTrailingZeros removes the zero bytes following a NAL unit (trailing_zero_8bits).
+func trimTrailingZeros(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// accessUnitSplitter groups NAL units into access units. An elementary stream carries no
+// timestamps: access units are stamped with their arrival time, or at a fixed rate if
+// the publisher sets fps.
+type accessUnitSplitter struct {
+	fps float64
+
+	au      [][]byte
+	hasVCL  bool
+	arrival time.Time // of the first NAL unit of au
+
+	start time.Time
+	count int
+	last  time.Duration
+}
+
+// add adds a NAL unit and returns the previous access unit and its timestamp when the
+// NAL unit starts a new one.
+func (a *accessUnitSplitter) add(nalu []byte) (time.Duration, [][]byte) {
+	typ := h264.NALUType(nalu[0] & 0x1F)
+	var pts time.Duration
+	var au [][]byte
+	if a.hasVCL && startsAccessUnit(typ, nalu) {
+		pts, au = a.flush()
+	}
+	if typ == h264.NALUTypeAccessUnitDelimiter {
+		return pts, au
+	}
+	if len(a.au) == 0 {
+		a.arrival = time.Now()
+	}
+	a.au = append(a.au, nalu)
+	if typ >= h264.NALUTypeNonIDR && typ <= h264.NALUTypeIDR {
+		a.hasVCL = true
+	}
+	return pts, au
+}
+
+// flush returns the pending access unit and its timestamp, or nil if it has no picture.
+func (a *accessUnitSplitter) flush() (time.Duration, [][]byte) {
+	au, hasVCL := a.au, a.hasVCL
+	a.au, a.hasVCL = nil, false
+	if !hasVCL {
+		return 0, nil
+	}
+
+	var pts time.Duration
+	if a.fps > 0 {
+		pts = time.Duration(float64(a.count) * float64(time.Second) / a.fps)
+	} else if a.count == 0 {
+		a.start = a.arrival
+	} else {
+		// Access units read from the same chunk arrive together: keep timestamps increasing
+		pts = max(a.arrival.Sub(a.start), a.last+time.Millisecond)
+	}
+	a.count++
+	a.last = pts
+	return pts, au
+}
+
+// startsAccessUnit reports whether a NAL unit following a picture begins the next access
+// unit (ITU-T H.264 7.4.1.2.3): parameter sets, SEI and delimiters, or the first slice of
+// a picture (first_mb_in_slice 0, coded as a single 1 bit).
+func startsAccessUnit(typ h264.NALUType, nalu []byte) bool {
+	switch {
+	case typ == h264.NALUTypeSEI || typ == h264.NALUTypeSPS || typ == h264.NALUTypePPS ||
+		typ == h264.NALUTypeAccessUnitDelimiter:
+		return true
+	case typ >= 14 && typ <= 18: // prefix NAL unit, subset SPS, reserved
+		return true
+	case typ >= h264.NALUTypeNonIDR && typ <= h264.NALUTypeIDR:
+		return len(nalu) > 1 && nalu[1]&0x80 != 0
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestFindStartCode(t *testing.T) {
+	tests := []struct {
+		data       []byte
+		from       int
+		wantOffset int
+		wantLength int
+	}{
+		{[]byte{0, 0, 1, 0x65}, 0, 0, 3},
+		{[]byte{0, 0, 0, 1, 0x65}, 0, 0, 4},
+		{[]byte{0x65, 0x88, 0, 0, 1, 0x41}, 0, 2, 3},
+		{[]byte{0x65, 0, 0, 0, 1, 0x41}, 0, 1, 4},
+		{[]byte{0, 0, 1, 0x65, 0, 0, 1, 0x41}, 3, 4, 3},
+		{[]byte{0x65, 0, 0, 2, 0, 1}, 0, -1, 0},
+		{nil, 0, -1, 0},
+	}
+	for _, tt := range tests {
+		offset, length := findStartCode(tt.data, tt.from)
+		if offset != tt.wantOffset || length != tt.wantLength {
+			t.Errorf("findStartCode(% x, %d) = %d, %d, want %d, %d",
+				tt.data, tt.from, offset, length, tt.wantOffset, tt.wantLength)
+		}
+	}
+}
+
+func TestNALUScanner(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x0c}
+	pps := []byte{0x68, 0xee, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x10}
+	tests := []struct {
+		name    string
+		stream  []byte
+		want    [][]byte
+		wantErr bool
+	}{
+		{
+			name:   "three and four byte start codes",
+			stream: concat([]byte{0, 0, 0, 1}, sps, []byte{0, 0, 0, 1}, pps, []byte{0, 0, 1}, idr),
+			want:   [][]byte{sps, pps, idr},
+		},
+		{
+			name:   "data before the first start code is skipped",
+			stream: concat([]byte{0x12, 0x34, 0, 0, 1}, sps),
+			want:   [][]byte{sps},
+		},
+		{
+			name:   "trailing zeros are removed",
+			stream: concat([]byte{0, 0, 1}, pps, []byte{0, 0, 0, 0, 0, 1}, idr, []byte{0, 0}),
+			want:   [][]byte{pps, idr},
+		},
+		{
+			name:   "empty NAL units are skipped",
+			stream: concat([]byte{0, 0, 1, 0, 0, 1}, sps, []byte{0, 0, 1}),
+			want:   [][]byte{sps},
+		},
+		{
+			name:   "no start code",
+			stream: []byte{0x12, 0x34, 0x56, 0x78, 0x9a},
+		},
+		{
+			name:   "empty stream",
+			stream: nil,
+		},
+		{
+			name:    "NAL unit too large",
+			stream:  concat([]byte{0, 0, 1, 0x65}, bytes.Repeat([]byte{0xff}, maxAnnexBNALU+1)),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readers := map[string]io.Reader{
+				"whole":    bytes.NewReader(tt.stream),
+				"one byte": iotest.OneByteReader(bytes.NewReader(tt.stream)),
+			}
+			if tt.wantErr {
+				delete(readers, "one byte") // too slow for 8 MiB
+			}
+			for name, r := range readers {
+				sc := &naluScanner{r: r}
+				var got [][]byte
+				var err error
+				for {
+					var nalu []byte
+					if nalu, err = sc.next(); err != nil {
+						break
+					}
+					got = append(got, nalu)
+				}
+				if tt.wantErr {
+					if errors.Is(err, io.EOF) {
+						t.Errorf("%s: no error", name)
+					}
+					continue
+				}
+				if !errors.Is(err, io.EOF) {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !slices.EqualFunc(got, tt.want, bytes.Equal) {
+					t.Errorf("%s: NAL units = % x, want % x", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// concat returns the concatenation of byte slices.
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestAccessUnitSplitter(t *testing.T) {
+	aud := []byte{0x09, 0xf0}
+	sps := []byte{0x67, 0x64, 0x00, 0x0c}
+	pps := []byte{0x68, 0xee, 0x3c, 0x80}
+	sei := []byte{0x06, 0x05, 0x01}
+	idr := []byte{0x65, 0x88, 0x84}      // first_mb_in_slice 0
+	idrSlice := []byte{0x65, 0x40, 0x84} // second slice of the picture
+	slice := []byte{0x41, 0x9a, 0x02}
+	tests := []struct {
+		name  string
+		nalus [][]byte
+		want  [][][]byte
+	}{
+		{
+			name:  "keyframe and slices",
+			nalus: [][]byte{sps, pps, idr, slice, slice},
+			want:  [][][]byte{{sps, pps, idr}, {slice}, {slice}},
+		},
+		{
+			name:  "pictures of several slices",
+			nalus: [][]byte{sps, pps, idr, idrSlice, idrSlice, slice},
+			want:  [][][]byte{{sps, pps, idr, idrSlice, idrSlice}, {slice}},
+		},
+		{
+			name:  "delimiters are dropped",
+			nalus: [][]byte{aud, sps, pps, idr, aud, slice, aud},
+			want:  [][][]byte{{sps, pps, idr}, {slice}},
+		},
+		{
+			name:  "SEI starts the next access unit",
+			nalus: [][]byte{sps, pps, idr, sei, slice},
+			want:  [][][]byte{{sps, pps, idr}, {sei, slice}},
+		},
+		{
+			name:  "parameter sets without a picture",
+			nalus: [][]byte{sps, pps},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &accessUnitSplitter{fps: 25}
+			var got [][][]byte
+			var pts []time.Duration
+			collect := func(ts time.Duration, au [][]byte) {
+				if au != nil {
+					got = append(got, au)
+					pts = append(pts, ts)
+				}
+			}
+			for _, nalu := range tt.nalus {
+				collect(a.add(nalu))
+			}
+			collect(a.flush())
+
+			if !slices.EqualFunc(got, tt.want, func(a, b [][]byte) bool {
+				return slices.EqualFunc(a, b, bytes.Equal)
+			}) {
+				t.Errorf("access units = % x, want % x", got, tt.want)
+			}
+			for i, ts := range pts {
+				if want := time.Duration(i) * 40 * time.Millisecond; ts != want {
+					t.Errorf("access unit %d at %s, want %s", i, ts, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAccessUnitSplitterArrivalTimestamps(t *testing.T) {
+	// Access units arriving together get increasing timestamps
+	a := &accessUnitSplitter{}
+	var pts []time.Duration
+	for _, nalu := range [][]byte{{0x65, 0x88}, {0x41, 0x9a}, {0x41, 0x9a}, {0x41, 0x9a}} {
+		if ts, au := a.add(nalu); au != nil {
+			pts = append(pts, ts)
+		}
+	}
+	if ts, au := a.flush(); au != nil {
+		pts = append(pts, ts)
+	}
+	if len(pts) != 4 || pts[0] != 0 {
+		t.Fatalf("timestamps = %v", pts)
+	}
+	for i := 1; i < len(pts); i++ {
+		if pts[i] <= pts[i-1] {
+			t.Errorf("timestamps = %v, want increasing", pts)
+		}
+	}
+}
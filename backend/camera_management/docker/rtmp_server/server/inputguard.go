@@ -0,0 +1,303 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+)
+
+// errMalformedInput ends a connection that sent data outside the input limits.
+var errMalformedInput = errors.New("malformed input")
+
+// Kinds of malformed input, counted by rtmp_malformed_input_total
+const (
+	malformedChunkHeader  = "chunk_header"  // invalid chunk stream ID or chunk sequence
+	malformedChunkSize    = "chunk_size"    // Set Chunk Size outside the bounds
+	malformedChunkStreams = "chunk_streams" // too many chunk streams with a partial message
+	malformedMessageSize  = "message_size"  // message larger than RTMP_MAX_MESSAGE_MB
+	malformedCommandSize  = "command_size"  // AMF command or data message larger than RTMP_MAX_COMMAND_KB
+	malformedNALUCount    = "nalu_count"    // access unit with more than MAX_NALUS_PER_FRAME NAL units
+	malformedNALUSize     = "nalu_size"     // NAL unit larger than MAX_NALU_MB
+	malformedPanic        = "panic"         // a panic was recovered while serving the connection
+)
+
+// Size of the RTMP handshake messages C1 and C2
+const handshakeSize = 1536
+
+// RTMP chunk size the peer starts with and the smallest it may set: smaller chunks cost
+// gortmplib a fragment per few bytes of a message
+const minChunkSize = 128
+
+// Largest message gortmplib reads
+const maxRTMPMessageSize = 10 << 20
+
+// inputLimits bound what a client may send before it is considered malformed: the RTMP
+// chunk stream is checked before gortmplib parses it, the H.264 access units of every
+// protocol before they are forwarded.
+type inputLimits struct {
+	maxChunkSize    uint32 // Set Chunk Size of RTMP publishers
+	maxMessageSize  uint32 // RTMP message
+	maxCommandSize  uint32 // AMF command, data and shared object messages
+	maxChunkStreams int    // RTMP chunk streams with a partial message
+	maxNALUs        int    // NAL units of an access unit
+	maxNALUSize     int    // bytes of a NAL unit
+}
+
+// inputLimitsFromEnv reads RTMP_MAX_CHUNK_SIZE (bytes, default 65536),
+// RTMP_MAX_MESSAGE_MB (default 8), RTMP_MAX_COMMAND_KB (default 64),
+// RTMP_MAX_CHUNK_STREAMS (default 8), MAX_NALUS_PER_FRAME (default 512) and MAX_NALU_MB
+// (default 8).
+func inputLimitsFromEnv() inputLimits {
+	return inputLimits{
+		maxChunkSize:    uint32(envLimit("RTMP_MAX_CHUNK_SIZE", 65536, minChunkSize, maxRTMPMessageSize)),
+		maxMessageSize:  uint32(envLimit("RTMP_MAX_MESSAGE_MB", 8, 1, maxRTMPMessageSize>>20)) << 20,
+		maxCommandSize:  uint32(envLimit("RTMP_MAX_COMMAND_KB", 64, 1, maxRTMPMessageSize>>10)) << 10,
+		maxChunkStreams: envLimit("RTMP_MAX_CHUNK_STREAMS", 8, 1, 62),
+		maxNALUs:        envLimit("MAX_NALUS_PER_FRAME", 512, 1, 1<<20),
+		maxNALUSize:     envLimit("MAX_NALU_MB", 8, 1, 1024) << 20,
+	}
+}
+
+// envLimit reads a limit between minimum and maximum.
+func envLimit(name string, fallback, minimum, maximum int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < minimum || n > maximum {
+		log.Printf("Warning: invalid %s %q (expected %d to %d), using %d", name, value, minimum, maximum, fallback)
+		return fallback
+	}
+	return n
+}
+
+// inputError is a violation of the input limits.
+type inputError struct {
+	kind   string
+	detail string
+}
+
+func (e *inputError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", errMalformedInput, e.detail, e.kind)
+}
+
+func (e *inputError) Unwrap() error {
+	return errMalformedInput
+}
+
+// checkH264 returns the violation of the NAL unit limits by an access unit, nil if none.
+func (l inputLimits) checkH264(au [][]byte) *inputError {
+	if len(au) > l.maxNALUs {
+		return &inputError{malformedNALUCount, fmt.Sprintf("%d NAL units in an access unit, limit %d", len(au), l.maxNALUs)}
+	}
+	for _, nalu := range au {
+		if len(nalu) > l.maxNALUSize {
+			return &inputError{malformedNALUSize, fmt.Sprintf("%d bytes %s NAL unit, limit %d",
+				len(nalu), h264.NALUType(nalu[0]&0x1F), l.maxNALUSize)}
+		}
+	}
+	return nil
+}
+
+// chunkStreamState is what chunkGuard knows of a chunk stream, as gortmplib tracks it.
+type chunkStreamState struct {
+	started     bool   // a chunk with a message header was received
+	typ         uint8  // message type
+	length      uint32 // message length
+	received    uint32 // bytes of the partial message, 0 between messages
+	extended    bool   // chunks carry an extended timestamp
+	chunkSizeAt []byte // body of a Set Chunk Size message being received
+}
+
+// chunkGuard checks the RTMP chunk stream of a connection against the input limits
+// before gortmplib parses it. It follows the chunk headers the way gortmplib reads them,
+// handing out one chunk at a time, and fails the read that would deliver a chunk outside
+// the limits. Connections with an encrypted (RTMPE) handshake are passed through
+// unchecked.
+type chunkGuard struct {
+	br     *bufio.Reader
+	limits inputLimits
+	report func(err *inputError) // records the violation, called once
+
+	handshake bool   // the handshake is not complete
+	bypass    bool   // RTMPE: the chunk stream is encrypted
+	remaining int    // bytes left of the current handshake message or chunk
+	header    int    // bytes left of the header of the current chunk
+	chunkSize uint32 // chunk size of the peer
+	streams   map[byte]*chunkStreamState
+	current   *chunkStreamState // stream of the current chunk
+	failed    error
+}
+
+// newChunkGuard returns the guard of a connection read through r. A violation ends the
+// connection.
+func (s *Server) newChunkGuard(ctx context.Context, r io.Reader, protocol, remoteAddr string) *chunkGuard {
+	return &chunkGuard{
+		br:     bufio.NewReader(r),
+		limits: s.inputLimits,
+		report: func(err *inputError) {
+			s.countFailure(ctx, protocol, remoteAddr, failMalformed)
+			s.malformedInput(protocol, remoteAddr, err, nil)
+		},
+		handshake: true,
+		remaining: 1 + 2*handshakeSize, // C0, C1 and C2
+		chunkSize: minChunkSize,
+		streams:   make(map[byte]*chunkStreamState),
+	}
+}
+
+func (g *chunkGuard) Read(p []byte) (int, error) {
+	if g.failed != nil {
+		return 0, g.failed
+	}
+	if g.bypass {
+		return g.br.Read(p)
+	}
+	if g.handshake && g.remaining == 1+2*handshakeSize {
+		c0, err := g.br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		g.bypass = c0[0] == 6 // RTMPE
+	}
+	if g.remaining == 0 {
+		g.handshake = false
+		if err := g.nextChunk(); err != nil {
+			if inputErr := (*inputError)(nil); errors.As(err, &inputErr) {
+				g.failed = err
+				g.report(inputErr)
+			}
+			return 0, err
+		}
+	}
+
+	if len(p) > g.remaining {
+		p = p[:g.remaining]
+	}
+	n, err := g.br.Read(p)
+	g.remaining -= n
+	if st := g.current; st != nil && st.chunkSizeAt != nil {
+		body := p[min(n, g.header):n]
+		st.chunkSizeAt = append(st.chunkSizeAt, body[:min(len(body), 4-len(st.chunkSizeAt))]...)
+	}
+	g.header = max(g.header-n, 0)
+	return n, err
+}
+
+// nextChunk reads the header of the next chunk without consuming it and checks it,
+// setting remaining to the size of the chunk.
+func (g *chunkGuard) nextChunk() error {
+	if st := g.current; st != nil && st.received == 0 && st.chunkSizeAt != nil {
+		// The previous chunk completed a Set Chunk Size message (gortmplib refuses one
+		// that is not 4 bytes)
+		if st.length == 4 && len(st.chunkSizeAt) == 4 {
+			size := uint32(st.chunkSizeAt[0])<<24 | uint32(st.chunkSizeAt[1])<<16 | uint32(st.chunkSizeAt[2])<<8 | uint32(st.chunkSizeAt[3])
+			if size < minChunkSize || size > g.limits.maxChunkSize {
+				return &inputError{malformedChunkSize, fmt.Sprintf("chunk size %d, expected %d to %d", size, minChunkSize, g.limits.maxChunkSize)}
+			}
+			g.chunkSize = size
+		}
+		st.chunkSizeAt = nil
+	}
+
+	basic, err := g.br.Peek(1)
+	if err != nil {
+		return err
+	}
+	format, csid := basic[0]>>6, basic[0]&0x3F
+	if csid < 2 {
+		return &inputError{malformedChunkHeader, "extended chunk stream ID"}
+	}
+	st := g.streams[csid]
+	if st == nil {
+		st = &chunkStreamState{}
+		g.streams[csid] = st
+	}
+
+	headerSize := []int{12, 8, 4, 1}[format]
+	header, err := g.br.Peek(headerSize)
+	if err != nil {
+		return err
+	}
+	if format != 3 && st.received != 0 {
+		return &inputError{malformedChunkHeader, fmt.Sprintf("type %d chunk in the middle of a message", format)}
+	}
+	if format != 0 && !st.started {
+		return &inputError{malformedChunkHeader, fmt.Sprintf("type %d chunk without previous chunk", format)}
+	}
+
+	switch format {
+	case 0, 1:
+		st.length = uint32(header[4])<<16 | uint32(header[5])<<8 | uint32(header[6])
+		st.typ = header[7]
+		fallthrough
+	case 2:
+		timestamp := uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+		if timestamp == 0xFFFFFF {
+			ext, err := g.br.Peek(headerSize + 4)
+			if err != nil {
+				return err
+			}
+			headerSize += 4
+			timestamp = uint32(ext[headerSize-4])<<24 | uint32(ext[headerSize-3])<<16 | uint32(ext[headerSize-2])<<8 | uint32(ext[headerSize-1])
+		}
+		st.extended = timestamp >= 0xFFFFFF
+	default:
+		if st.extended {
+			headerSize += 4
+		}
+	}
+	st.started = true
+
+	if st.received == 0 {
+		if err := g.checkMessage(st); err != nil {
+			return err
+		}
+	}
+	body := min(st.length-st.received, g.chunkSize)
+	st.received += body
+	if st.received == st.length {
+		st.received = 0
+	} else if g.partialStreams() > g.limits.maxChunkStreams {
+		return &inputError{malformedChunkStreams, fmt.Sprintf("more than %d chunk streams with a partial message", g.limits.maxChunkStreams)}
+	}
+	g.current = st
+	g.remaining, g.header = headerSize+int(body), headerSize
+	return nil
+}
+
+// checkMessage checks the size of a message starting on the chunk stream.
+func (g *chunkGuard) checkMessage(st *chunkStreamState) error {
+	switch st.typ {
+	case 1: // Set Chunk Size, applied once complete
+		st.chunkSizeAt = make([]byte, 0, 4)
+	case 15, 16, 17, 18, 19, 20: // AMF3/AMF0 data, shared object and command messages
+		if st.length > g.limits.maxCommandSize {
+			return &inputError{malformedCommandSize, fmt.Sprintf("%d bytes type %d message, limit %d", st.length, st.typ, g.limits.maxCommandSize)}
+		}
+	}
+	if st.length > g.limits.maxMessageSize {
+		return &inputError{malformedMessageSize, fmt.Sprintf("%d bytes type %d message, limit %d", st.length, st.typ, g.limits.maxMessageSize)}
+	}
+	return nil
+}
+
+// partialStreams returns the number of chunk streams with a partial message.
+func (g *chunkGuard) partialStreams() int {
+	n := 0
+	for _, st := range g.streams {
+		if st.received != 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testLimits are the default input limits.
+var testLimits = inputLimits{
+	maxChunkSize:    65536,
+	maxMessageSize:  8 << 20,
+	maxCommandSize:  64 << 10,
+	maxChunkStreams: 8,
+	maxNALUs:        512,
+	maxNALUSize:     8 << 20,
+}
+
+func TestInputLimitsFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want inputLimits
+	}{
+		{name: "defaults", want: testLimits},
+		{
+			name: "configured",
+			env: map[string]string{
+				"RTMP_MAX_CHUNK_SIZE":    "4096",
+				"RTMP_MAX_MESSAGE_MB":    "2",
+				"RTMP_MAX_COMMAND_KB":    "16",
+				"RTMP_MAX_CHUNK_STREAMS": "4",
+				"MAX_NALUS_PER_FRAME":    "64",
+				"MAX_NALU_MB":            "1",
+			},
+			want: inputLimits{4096, 2 << 20, 16 << 10, 4, 64, 1 << 20},
+		},
+		{
+			name: "out of bounds falls back to defaults",
+			env: map[string]string{
+				"RTMP_MAX_CHUNK_SIZE":    "64",
+				"RTMP_MAX_MESSAGE_MB":    "11",
+				"RTMP_MAX_COMMAND_KB":    "0",
+				"RTMP_MAX_CHUNK_STREAMS": "63",
+				"MAX_NALUS_PER_FRAME":    "-1",
+				"MAX_NALU_MB":            "lots",
+			},
+			want: testLimits,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"RTMP_MAX_CHUNK_SIZE", "RTMP_MAX_MESSAGE_MB", "RTMP_MAX_COMMAND_KB",
+				"RTMP_MAX_CHUNK_STREAMS", "MAX_NALUS_PER_FRAME", "MAX_NALU_MB"} {
+				t.Setenv(name, tt.env[name])
+			}
+			if got := inputLimitsFromEnv(); got != tt.want {
+				t.Errorf("inputLimitsFromEnv() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckH264(t *testing.T) {
+	limits := inputLimits{maxNALUs: 4, maxNALUSize: 1024}
+	nalu := func(size int) []byte {
+		b := make([]byte, size)
+		b[0] = 0x65
+		return b
+	}
+	tests := []struct {
+		name string
+		au   [][]byte
+		want string
+	}{
+		{name: "within limits", au: [][]byte{nalu(10), nalu(1024)}},
+		{name: "NAL unit count at limit", au: [][]byte{nalu(1), nalu(1), nalu(1), nalu(1)}},
+		{name: "too many NAL units", au: [][]byte{nalu(1), nalu(1), nalu(1), nalu(1), nalu(1)}, want: malformedNALUCount},
+		{name: "NAL unit too large", au: [][]byte{nalu(10), nalu(1025)}, want: malformedNALUSize},
+		{name: "empty access unit", au: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := limits.checkH264(tt.au)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("checkH264: %v", err)
+			case tt.want != "" && (err == nil || err.kind != tt.want):
+				t.Errorf("checkH264 = %v, want %s", err, tt.want)
+			case err != nil && !errors.Is(err, errMalformedInput):
+				t.Errorf("%v does not wrap errMalformedInput", err)
+			}
+		})
+	}
+}
+
+// chunkStream builds an RTMP client stream: the handshake followed by chunks.
+type chunkStream struct {
+	bytes.Buffer
+}
+
+func newChunkStream(c0 byte) *chunkStream {
+	s := &chunkStream{}
+	s.WriteByte(c0)
+	s.Write(make([]byte, 2*handshakeSize))
+	return s
+}
+
+// chunk writes a chunk of the given format with a message header of length bytes of
+// type typ (formats 0 and 1), a timestamp (formats 0 to 2) and body bytes of payload.
+func (s *chunkStream) chunk(format, csid byte, timestamp uint32, length int, typ byte, body int) *chunkStream {
+	s.WriteByte(format<<6 | csid)
+	if format < 3 {
+		ts := min(timestamp, 0xFFFFFF)
+		s.Write([]byte{byte(ts >> 16), byte(ts >> 8), byte(ts)})
+	}
+	if format < 2 {
+		s.Write([]byte{byte(length >> 16), byte(length >> 8), byte(length), typ})
+	}
+	if format == 0 {
+		s.Write([]byte{1, 0, 0, 0}) // message stream ID, little endian
+	}
+	if timestamp >= 0xFFFFFF {
+		s.Write(binary.BigEndian.AppendUint32(nil, timestamp))
+	}
+	s.Write(make([]byte, body))
+	return s
+}
+
+// setChunkSize writes a Set Chunk Size message.
+func (s *chunkStream) setChunkSize(size uint32) *chunkStream {
+	s.chunk(0, 2, 0, 4, 1, 0)
+	s.Write(binary.BigEndian.AppendUint32(nil, size))
+	return s
+}
+
+func TestChunkGuard(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream *chunkStream
+		want   string // kind of the violation, "" to read to the end
+	}{
+		{
+			name:   "command",
+			stream: newChunkStream(3).chunk(0, 3, 0, 100, 20, 100),
+		},
+		{
+			name: "message in several chunks",
+			stream: newChunkStream(3).
+				chunk(0, 4, 0, 300, 9, 128).chunk(3, 4, 0, 0, 0, 128).chunk(3, 4, 0, 0, 0, 44).
+				chunk(2, 4, 40, 0, 0, 128),
+		},
+		{
+			name: "larger chunk size",
+			stream: newChunkStream(3).setChunkSize(4096).
+				chunk(0, 4, 0, 5000, 9, 4096).chunk(3, 4, 0, 0, 0, 904),
+		},
+		{
+			name: "extended timestamp",
+			stream: newChunkStream(3).
+				chunk(0, 4, 0x1000000, 200, 9, 128).chunk(3, 4, 0x1000000, 0, 0, 72),
+		},
+		{
+			name:   "encrypted handshake is not checked",
+			stream: newChunkStream(6).chunk(1, 0, 0, 100<<20, 20, 10),
+		},
+		{
+			name:   "command too large",
+			stream: newChunkStream(3).chunk(0, 3, 0, 65<<10, 20, 128),
+			want:   malformedCommandSize,
+		},
+		{
+			name:   "message too large",
+			stream: newChunkStream(3).chunk(0, 4, 0, 9<<20, 9, 128),
+			want:   malformedMessageSize,
+		},
+		{
+			name:   "chunk size too small",
+			stream: newChunkStream(3).setChunkSize(64).chunk(0, 3, 0, 10, 20, 10),
+			want:   malformedChunkSize,
+		},
+		{
+			name:   "chunk size too large",
+			stream: newChunkStream(3).setChunkSize(1<<20).chunk(0, 3, 0, 10, 20, 10),
+			want:   malformedChunkSize,
+		},
+		{
+			name:   "extended chunk stream ID",
+			stream: newChunkStream(3).chunk(0, 0, 0, 10, 20, 10),
+			want:   malformedChunkHeader,
+		},
+		{
+			name:   "chunk without previous chunk",
+			stream: newChunkStream(3).chunk(1, 3, 0, 10, 20, 10),
+			want:   malformedChunkHeader,
+		},
+		{
+			name:   "new message in the middle of a message",
+			stream: newChunkStream(3).chunk(0, 4, 0, 300, 9, 128).chunk(0, 4, 0, 10, 9, 10),
+			want:   malformedChunkHeader,
+		},
+		{
+			name: "too many partial messages",
+			stream: func() *chunkStream {
+				s := newChunkStream(3)
+				for csid := byte(3); csid < 12; csid++ {
+					s.chunk(0, csid, 0, 1000, 9, 128)
+				}
+				return s
+			}(),
+			want: malformedChunkStreams,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reported []*inputError
+			g := &chunkGuard{
+				br:        bufio.NewReader(bytes.NewReader(tt.stream.Bytes())),
+				limits:    testLimits,
+				report:    func(err *inputError) { reported = append(reported, err) },
+				handshake: true,
+				remaining: 1 + 2*handshakeSize,
+				chunkSize: minChunkSize,
+				streams:   make(map[byte]*chunkStreamState),
+			}
+
+			// Read in small pieces, as gortmplib reads headers and bodies separately
+			data, err := io.ReadAll(readerFunc(func(p []byte) (int, error) {
+				return g.Read(p[:min(len(p), 7)])
+			}))
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if !bytes.Equal(data, tt.stream.Bytes()) {
+					t.Errorf("read %d bytes, want %d", len(data), tt.stream.Len())
+				}
+				if len(reported) != 0 {
+					t.Errorf("reported %v", reported[0])
+				}
+				return
+			}
+			if !errors.Is(err, errMalformedInput) {
+				t.Fatalf("err = %v, want malformed input", err)
+			}
+			if len(reported) != 1 || reported[0].kind != tt.want {
+				t.Fatalf("reported %v, want one %s", reported, tt.want)
+			}
+			if _, err := g.Read(make([]byte, 1)); !errors.Is(err, errMalformedInput) {
+				t.Errorf("read after the violation: err = %v", err)
+			}
+		})
+	}
+}
+
+// readerFunc adapts a function to io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
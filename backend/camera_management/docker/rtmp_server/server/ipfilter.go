@@ -0,0 +1,226 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/metrics"
+)
+
+// IPFilter restricts the networks ingest connections are accepted from. It is checked
+// right after accept, before the RTMP or TLS handshake, so connections from unknown
+// networks cost no more than the TCP accept. Denied networks always win; when any allow
+// entry is configured, addresses outside the allowed networks are rejected.
+type IPFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+
+	// Managed prefix list merged into the allowed networks, refreshed by Watch
+	prefixListID string
+	ec2          *awsapi.EC2
+	prefixList   atomic.Pointer[[]netip.Prefix]
+	interval     time.Duration
+
+	rejected atomic.Uint64
+}
+
+// NewIPFilterFromEnv reads ALLOWED_CIDRS and DENIED_CIDRS (comma-separated CIDRs or
+// addresses) and ALLOWED_PREFIX_LIST_ID (an AWS managed prefix list of allowed networks,
+// reloaded every PREFIX_LIST_REFRESH_INTERVAL seconds, default 300). It returns nil if
+// none is set, and an error for an invalid entry or a prefix list that cannot be loaded,
+// since starting with a broken filter would expose or lock out cameras.
+func NewIPFilterFromEnv(ctx context.Context, region string) (*IPFilter, error) {
+	allow, err := parsePrefixes(os.Getenv("ALLOWED_CIDRS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ALLOWED_CIDRS: %w", err)
+	}
+	deny, err := parsePrefixes(os.Getenv("DENIED_CIDRS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DENIED_CIDRS: %w", err)
+	}
+	prefixListID := os.Getenv("ALLOWED_PREFIX_LIST_ID")
+	if len(allow) == 0 && len(deny) == 0 && prefixListID == "" {
+		return nil, nil
+	}
+
+	f := &IPFilter{allow: allow, deny: deny, prefixListID: prefixListID}
+	if prefixListID != "" {
+		if region == "" {
+			return nil, fmt.Errorf("AWS_REGION is required with ALLOWED_PREFIX_LIST_ID")
+		}
+		f.ec2 = awsapi.NewEC2(region)
+		f.interval = envSeconds("PREFIX_LIST_REFRESH_INTERVAL", 5*time.Minute, false)
+		if err := f.refresh(ctx); err != nil {
+			return nil, fmt.Errorf("failed to load prefix list %s: %w", prefixListID, err)
+		}
+	}
+	log.Printf("IP filter enabled: %s", f)
+	return f, nil
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs. A bare address is a single host.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// refresh reloads the managed prefix list.
+func (f *IPFilter) refresh(ctx context.Context) error {
+	cidrs, err := f.ec2.GetManagedPrefixListEntries(ctx, f.prefixListID)
+	if err != nil {
+		return err
+	}
+	prefixes, err := parsePrefixes(strings.Join(cidrs, ","))
+	if err != nil {
+		return err
+	}
+	f.prefixList.Store(&prefixes)
+	return nil
+}
+
+// Watch reloads the managed prefix list until ctx is cancelled, so networks added to or
+// removed from the list take effect without a restart. On failure the previous entries
+// stay in effect.
+func (f *IPFilter) Watch(ctx context.Context) {
+	if f.prefixListID == "" {
+		return
+	}
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			previous := len(f.prefixListEntries())
+			reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			err := f.refresh(reqCtx)
+			cancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("⚠️  Failed to refresh prefix list %s, keeping %d entries: %v", f.prefixListID, previous, err)
+				}
+				continue
+			}
+			if current := len(f.prefixListEntries()); current != previous {
+				log.Printf("🔄 Prefix list %s now has %d entries (was %d)", f.prefixListID, current, previous)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// prefixListEntries returns the last loaded prefix list.
+func (f *IPFilter) prefixListEntries() []netip.Prefix {
+	if p := f.prefixList.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Allowed reports whether a connection from addr may proceed.
+func (f *IPFilter) Allowed(addr net.Addr) bool {
+	// Unix socket clients are local processes; the socket permissions control access
+	if addr.Network() == "unix" {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+
+	for _, prefix := range f.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 && f.prefixListID == "" {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	for _, prefix := range f.prefixListEntries() {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// String summarizes the filter for the startup log.
+func (f *IPFilter) String() string {
+	var parts []string
+	if len(f.allow) > 0 {
+		parts = append(parts, fmt.Sprintf("allow %v", f.allow))
+	}
+	if f.prefixListID != "" {
+		parts = append(parts, fmt.Sprintf("allow prefix list %s (%d entries)", f.prefixListID, len(f.prefixListEntries())))
+	}
+	if len(f.deny) > 0 {
+		parts = append(parts, fmt.Sprintf("deny %v", f.deny))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// CollectMetrics writes the number of rejected connections and prefix list entries.
+func (f *IPFilter) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_connections_rejected_total", "Connections rejected by the IP allow/deny lists", float64(f.rejected.Load()))
+	if f.prefixListID != "" {
+		w.Gauge("rtmp_ip_filter_prefix_list_entries", "Entries loaded from the allowed managed prefix list", float64(len(f.prefixListEntries())), "prefix_list_id", f.prefixListID)
+	}
+}
+
+// SetIPFilter restricts the networks connections are accepted from (nil accepts all).
+func (s *Server) SetIPFilter(f *IPFilter) {
+	s.ipFilter = f
+}
+
+// admit checks a new connection or UDP session against the IP filter and the quarantine.
+func (s *Server) admit(addr net.Addr, protocol string) bool {
+	if s.ipFilter != nil && !s.ipFilter.Allowed(addr) {
+		s.ipFilter.rejected.Add(1)
+		s.countFailure(context.Background(), protocol, addr.String(), failIPDenied)
+		s.auditDenied(addr, protocol, failIPDenied, "address not allowed")
+		log.Printf("[%s] Rejected connection from %s: address not allowed", protocol, addr)
+		return false
+	}
+	if s.quarantine.refuses(addr.String()) {
+		s.countFailure(context.Background(), protocol, addr.String(), failQuarantined)
+		s.auditDenied(addr, protocol, failQuarantined, "address quarantined for malformed input")
+		log.Printf("[%s] Rejected connection from %s: address quarantined", protocol, addr)
+		return false
+	}
+	return true
+}
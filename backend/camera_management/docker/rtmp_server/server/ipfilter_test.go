@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: " , ", want: nil},
+		{list: "10.0.0.0/8", want: []string{"10.0.0.0/8"}},
+		{list: "10.1.2.3/8", want: []string{"10.0.0.0/8"}},
+		{list: "192.0.2.1", want: []string{"192.0.2.1/32"}},
+		{list: "::ffff:192.0.2.1", want: []string{"192.0.2.1/32"}},
+		{list: "2001:db8::1", want: []string{"2001:db8::1/128"}},
+		{list: "10.0.0.0/8, 2001:db8::/32 ,192.0.2.1", want: []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1/32"}},
+		{list: "10.0.0.0/33", wantErr: true},
+		{list: "10.0.0.0/8,camera.local", wantErr: true},
+		{list: "300.0.0.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		prefixes, err := parsePrefixes(tt.list)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePrefixes(%q) = %v, want error", tt.list, prefixes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePrefixes(%q): %v", tt.list, err)
+			continue
+		}
+		var got []string
+		for _, prefix := range prefixes {
+			got = append(got, prefix.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parsePrefixes(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestIPFilterAllowed(t *testing.T) {
+	mustParse := func(list string) []netip.Prefix {
+		prefixes, err := parsePrefixes(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prefixes
+	}
+	withPrefixList := func(f *IPFilter, list string) *IPFilter {
+		f.prefixListID = "pl-0123456789abcdef0"
+		prefixes := mustParse(list)
+		f.prefixList.Store(&prefixes)
+		return f
+	}
+
+	tests := []struct {
+		name   string
+		filter *IPFilter
+		addr   net.Addr
+		want   bool
+	}{
+		{
+			name:   "deny only, other address",
+			filter: &IPFilter{deny: mustParse("203.0.113.0/24")},
+			addr:   &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 50000},
+			want:   true,
+		},
+		{
+			name:   "deny only, denied address",
+			filter: &IPFilter{deny: mustParse("203.0.113.0/24")},
+			addr:   &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 50000},
+			want:   false,
+		},
+		{
+			name:   "allowed network",
+			filter: &IPFilter{allow: mustParse("10.0.0.0/8")},
+			addr:   &net.TCPAddr{IP: net.ParseIP("10.20.30.40"), Port: 50000},
+			want:   true,
+		},
+		{
+			name:   "outside allowed networks",
+			filter: &IPFilter{allow: mustParse("10.0.0.0/8")},
+			addr:   &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 50000},
+			want:   false,
+		},
+		{
+			name:   "deny wins over allow",
+			filter: &IPFilter{allow: mustParse("10.0.0.0/8"), deny: mustParse("10.1.0.0/16")},
+			addr:   &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 50000},
+			want:   false,
+		},
+		{
+			name:   "IPv4-mapped address",
+			filter: &IPFilter{allow: mustParse("10.0.0.0/8")},
+			addr:   &net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 50000},
+			want:   true,
+		},
+		{
+			name:   "IPv6 allowed network",
+			filter: &IPFilter{allow: mustParse("2001:db8::/32")},
+			addr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::42"), Port: 50000},
+			want:   true,
+		},
+		{
+			name:   "UDP address",
+			filter: &IPFilter{allow: mustParse("10.0.0.0/8")},
+			addr:   &net.UDPAddr{IP: net.ParseIP("172.16.0.1"), Port: 9000},
+			want:   false,
+		},
+		{
+			name:   "unix socket",
+			filter: &IPFilter{allow: mustParse("10.0.0.0/8")},
+			addr:   &net.UnixAddr{Name: "/run/rtmp.sock", Net: "unix"},
+			want:   true,
+		},
+		{
+			name:   "prefix list entry",
+			filter: withPrefixList(&IPFilter{allow: mustParse("10.0.0.0/8")}, "198.51.100.0/24"),
+			addr:   &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 50000},
+			want:   true,
+		},
+		{
+			name:   "outside prefix list",
+			filter: withPrefixList(&IPFilter{}, "198.51.100.0/24"),
+			addr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+			want:   false,
+		},
+		{
+			name:   "empty prefix list rejects all",
+			filter: withPrefixList(&IPFilter{}, ""),
+			addr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Allowed(tt.addr); got != tt.want {
+				t.Errorf("Allowed(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPFilterFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   string
+		deny    string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "unset", wantNil: true},
+		{name: "allow", allow: "10.0.0.0/8"},
+		{name: "deny", deny: "203.0.113.0/24"},
+		{name: "invalid allow", allow: "10.0.0.0/8,not-an-address", wantErr: true},
+		{name: "invalid deny", deny: "203.0.113.0/40", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOWED_CIDRS", tt.allow)
+			t.Setenv("DENIED_CIDRS", tt.deny)
+			t.Setenv("ALLOWED_PREFIX_LIST_ID", "")
+
+			f, err := NewIPFilterFromEnv(context.Background(), "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (f == nil) != tt.wantNil {
+				t.Errorf("filter = %v, want nil %v", f, tt.wantNil)
+			}
+		})
+	}
+
+	t.Run("prefix list without region", func(t *testing.T) {
+		t.Setenv("ALLOWED_CIDRS", "")
+		t.Setenv("DENIED_CIDRS", "")
+		t.Setenv("ALLOWED_PREFIX_LIST_ID", "pl-0123456789abcdef0")
+		if _, err := NewIPFilterFromEnv(context.Background(), ""); err == nil {
+			t.Error("want error without AWS_REGION")
+		}
+	})
+}
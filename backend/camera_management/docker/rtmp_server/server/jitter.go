@@ -0,0 +1,158 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"rtmp_kvs/events"
+)
+
+const (
+	// Frames the jitter percentiles cover (10 seconds at 30 fps)
+	jitterWindow = 300
+	// Frames measured before the percentiles are compared with the threshold
+	jitterMinSamples = 30
+	// How often the percentiles are compared with the threshold
+	jitterCheckInterval = time.Second
+	// JitterHigh events of a stream are limited to one per interval
+	jitterEventInterval = time.Minute
+	// Steps of the DTS or of the arrival time beyond this are discontinuities or stalls,
+	// reported elsewhere, and restart the measurement
+	jitterMaxStep = 5 * time.Second
+)
+
+// jitterConfigFromEnv reads JITTER_WARN_THRESHOLD (seconds of p95 jitter, default 0.5,
+// 0 disables the warnings).
+func jitterConfigFromEnv() time.Duration {
+	return envSeconds("JITTER_WARN_THRESHOLD", 500*time.Millisecond, true)
+}
+
+// JitterStats summarizes the arrival jitter of the last video frames: how far the time
+// between the arrival of two frames differs from the time between their timestamps.
+// Encoders pace frames evenly, so jitter is added by the uplink; bursts of it precede
+// kvssink buffer and fragment errors on congested links.
+type JitterStats struct {
+	SmoothedMs float64 `json:"smoothed_ms"` // interarrival jitter as in RFC 3550
+	P50Ms      float64 `json:"p50_ms"`
+	P95Ms      float64 `json:"p95_ms"`
+	P99Ms      float64 `json:"p99_ms"`
+	MaxMs      float64 `json:"max_ms"`
+	Window     int     `json:"window"`   // frames the percentiles and max cover
+	Warnings   uint64  `json:"warnings"` // JitterHigh events of the session
+}
+
+// jitterTracker measures the arrival jitter of the video frames of a publisher. add is
+// called by the reader goroutine; stats by the stats collectors.
+type jitterTracker struct {
+	mutex sync.Mutex
+
+	started     bool
+	lastDTS     time.Duration
+	lastArrival time.Time
+	smoothed    time.Duration
+	samples     []time.Duration // last jitterWindow, in a ring
+	next        int
+
+	lastCheck time.Time
+	lastEvent time.Time
+	warnings  uint64
+}
+
+// add records the arrival of a frame with the publisher's DTS. It returns the statistics
+// when their p95 is over threshold and a warning is due, nil otherwise.
+func (t *jitterTracker) add(dts time.Duration, now time.Time, threshold time.Duration) *JitterStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	step := dts - t.lastDTS
+	arrival := now.Sub(t.lastArrival)
+	t.lastDTS, t.lastArrival = dts, now
+	if !t.started || step < 0 || step > jitterMaxStep || arrival > jitterMaxStep {
+		t.started = true
+		return nil
+	}
+
+	deviation := (arrival - step).Abs()
+	t.smoothed += (deviation - t.smoothed) / 16
+	if len(t.samples) < jitterWindow {
+		t.samples = append(t.samples, deviation)
+	} else {
+		t.samples[t.next] = deviation
+		t.next = (t.next + 1) % jitterWindow
+	}
+
+	if threshold == 0 || len(t.samples) < jitterMinSamples || now.Sub(t.lastCheck) < jitterCheckInterval {
+		return nil
+	}
+	t.lastCheck = now
+	stats := t.statsLocked()
+	if stats.P95Ms < float64(threshold.Milliseconds()) || now.Sub(t.lastEvent) < jitterEventInterval {
+		return nil
+	}
+	t.lastEvent = now
+	t.warnings++
+	stats.Warnings = t.warnings
+	return stats
+}
+
+// stats returns the jitter statistics, nil before the first measured frame.
+func (t *jitterTracker) stats() *JitterStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.samples) == 0 {
+		return nil
+	}
+	return t.statsLocked()
+}
+
+func (t *jitterTracker) statsLocked() *JitterStats {
+	sorted := slices.Sorted(slices.Values(t.samples))
+	percentile := func(p float64) float64 {
+		return milliseconds(sorted[int(p*float64(len(sorted)-1))])
+	}
+	return &JitterStats{
+		SmoothedMs: milliseconds(t.smoothed),
+		P50Ms:      percentile(0.50),
+		P95Ms:      percentile(0.95),
+		P99Ms:      percentile(0.99),
+		MaxMs:      milliseconds(sorted[len(sorted)-1]),
+		Window:     len(sorted),
+		Warnings:   t.warnings,
+	}
+}
+
+// milliseconds returns d in milliseconds, rounded to 0.1 ms.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Round(100*time.Microsecond)) / float64(time.Millisecond)
+}
+
+// trackJitter measures the arrival jitter of a video frame and warns when its p95 exceeds
+// JITTER_WARN_THRESHOLD. It is called by the reader goroutine with the publisher's DTS.
+func (ss *session) trackJitter(dts time.Duration, now time.Time) {
+	stats := ss.jitter.add(dts, now, ss.server.jitterThreshold)
+	if stats == nil {
+		return
+	}
+	log.Printf("[%s] ⚠️  Frames of %s arrive unevenly: p95 jitter %.0fms (p99 %.0fms, max %.0fms), the uplink may be congested",
+		ss.protocol, ss.streamPath, stats.P95Ms, stats.P99Ms, stats.MaxMs)
+	events.Emit(events.Event{
+		Type:       events.JitterHigh,
+		StreamPath: ss.streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   ss.route.CameraID,
+		RemoteAddr: ss.remoteAddr,
+		Protocol:   ss.protocol,
+		Detail: map[string]any{
+			"p50_ms":       stats.P50Ms,
+			"p95_ms":       stats.P95Ms,
+			"p99_ms":       stats.P99Ms,
+			"max_ms":       stats.MaxMs,
+			"smoothed_ms":  stats.SmoothedMs,
+			"threshold_ms": ss.server.jitterThreshold.Milliseconds(),
+			"window":       stats.Window,
+		},
+	})
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterTracker(t *testing.T) {
+	interval := 33 * time.Millisecond
+	tests := []struct {
+		name      string
+		frames    int
+		late      func(i int) time.Duration // arrival delay of frame i
+		threshold time.Duration
+		wantP95   float64
+		warnings  uint64
+	}{
+		{
+			name:      "even arrival",
+			frames:    600,
+			late:      func(int) time.Duration { return 0 },
+			threshold: 500 * time.Millisecond,
+		},
+		{
+			// A late frame deviates from its predecessor and from its successor
+			name:      "jitter under the threshold",
+			frames:    600,
+			late:      every(10, 100*time.Millisecond),
+			threshold: 500 * time.Millisecond,
+			wantP95:   100,
+		},
+		{
+			name:      "jitter over the threshold",
+			frames:    600,
+			late:      every(10, 600*time.Millisecond),
+			threshold: 500 * time.Millisecond,
+			wantP95:   600,
+			warnings:  1,
+		},
+		{
+			name:      "warnings are limited to one a minute",
+			frames:    4500, // 148.5 seconds
+			late:      every(10, 600*time.Millisecond),
+			threshold: 500 * time.Millisecond,
+			wantP95:   600,
+			warnings:  3,
+		},
+		{
+			name:     "warnings disabled",
+			frames:   600,
+			late:     every(10, 600*time.Millisecond),
+			wantP95:  600,
+			warnings: 0,
+		},
+		{
+			name:      "stalls are not jitter",
+			frames:    600,
+			late:      func(i int) time.Duration { return time.Duration(i/100) * 10 * time.Second },
+			threshold: 500 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var j jitterTracker
+			start := time.Now()
+			var warnings uint64
+			for i := range tt.frames {
+				dts := time.Duration(i) * interval
+				if stats := j.add(dts, start.Add(dts+tt.late(i)), tt.threshold); stats != nil {
+					warnings++
+					if stats.Warnings != warnings {
+						t.Errorf("warning %d counts %d", warnings, stats.Warnings)
+					}
+				}
+			}
+			if warnings != tt.warnings {
+				t.Errorf("%d warnings, want %d", warnings, tt.warnings)
+			}
+			stats := j.stats()
+			if stats == nil {
+				t.Fatal("no statistics")
+			}
+			if stats.P95Ms != tt.wantP95 {
+				t.Errorf("p95 = %vms, want %vms", stats.P95Ms, tt.wantP95)
+			}
+			if stats.Window != min(tt.frames-1, jitterWindow) {
+				t.Errorf("window = %d, want %d", stats.Window, min(tt.frames-1, jitterWindow))
+			}
+		})
+	}
+}
+
+// every delays every nth frame by delay.
+func every(n int, delay time.Duration) func(int) time.Duration {
+	return func(i int) time.Duration {
+		if i%n == n-1 {
+			return delay
+		}
+		return 0
+	}
+}
+
+func TestJitterTrackerNoFrames(t *testing.T) {
+	var j jitterTracker
+	if stats := j.stats(); stats != nil {
+		t.Errorf("stats() = %+v before any frame", stats)
+	}
+	j.add(0, time.Now(), time.Second)
+	if stats := j.stats(); stats != nil {
+		t.Errorf("stats() = %+v after one frame", stats)
+	}
+}
+
+func TestMilliseconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want float64
+	}{
+		{0, 0},
+		{time.Millisecond, 1},
+		{1549 * time.Microsecond, 1.5},
+		{1550 * time.Microsecond, 1.6},
+		{2 * time.Second, 2000},
+	}
+	for _, tt := range tests {
+		if got := milliseconds(tt.d); got != tt.want {
+			t.Errorf("milliseconds(%s) = %v, want %v", tt.d, got, tt.want)
+		}
+	}
+}
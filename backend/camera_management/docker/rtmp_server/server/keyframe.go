@@ -0,0 +1,118 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/snapshot"
+)
+
+// paramTracker keeps the latest SPS/PPS of a publisher so keyframes can be made self-contained.
+type paramTracker struct {
+	sps []byte
+	pps []byte
+}
+
+// update records in-band parameter sets.
+func (p *paramTracker) update(au [][]byte) {
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			p.sps = nalu
+		case h264.NALUTypePPS:
+			p.pps = nalu
+		}
+	}
+}
+
+// withParams returns the access unit with the current SPS/PPS prepended.
+func (p *paramTracker) withParams(au [][]byte) [][]byte {
+	out := make([][]byte, 0, len(au)+2)
+	if p.sps != nil && p.pps != nil {
+		out = append(out, p.sps, p.pps)
+	}
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		typ := h264.NALUType(nalu[0] & 0x1F)
+		if typ == h264.NALUTypeSPS || typ == h264.NALUTypePPS {
+			continue
+		}
+		out = append(out, nalu)
+	}
+	return out
+}
+
+// Keyframe waits for the next keyframe of the stream and returns it as a self-contained
+// access unit (SPS, PPS, IDR slices).
+func (s *Server) Keyframe(ctx context.Context, streamPath string) ([][]byte, error) {
+	ch := make(chan [][]byte, 1)
+
+	s.mutex.Lock()
+	if _, exists := s.publishers[streamPath]; !exists {
+		s.mutex.Unlock()
+		return nil, snapshot.ErrStreamNotLive
+	}
+	s.keyframeWaiters[streamPath] = append(s.keyframeWaiters[streamPath], ch)
+	s.mutex.Unlock()
+
+	select {
+	case au := <-ch:
+		return au, nil
+	case <-ctx.Done():
+		s.mutex.Lock()
+		waiters := s.keyframeWaiters[streamPath]
+		for i, w := range waiters {
+			if w == ch {
+				s.keyframeWaiters[streamPath] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		s.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// LastKeyframe returns the most recent keyframe of the stream and when it was received.
+func (s *Server) LastKeyframe(streamPath string) ([][]byte, time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ss, exists := s.publishers[streamPath]
+	if !exists {
+		return nil, time.Time{}, snapshot.ErrStreamNotLive
+	}
+	if ss.lastKeyframe == nil {
+		return nil, time.Time{}, errors.New("no keyframe received yet")
+	}
+	return ss.lastKeyframe, ss.lastKeyframeTime, nil
+}
+
+// deliverKeyframe records the keyframe as the session's latest and hands it to the
+// waiters of the stream, if any.
+func (s *Server) deliverKeyframe(ss *session, params *paramTracker, au [][]byte) {
+	// Copy: the reader may reuse its buffers once the frame has been forwarded
+	frame := params.withParams(au)
+	for i, nalu := range frame {
+		frame[i] = append([]byte(nil), nalu...)
+	}
+
+	s.mutex.Lock()
+	ss.lastKeyframe = frame
+	ss.lastKeyframeTime = time.Now()
+	waiters := s.keyframeWaiters[ss.streamPath]
+	delete(s.keyframeWaiters, ss.streamPath)
+	s.mutex.Unlock()
+
+	for _, ch := range waiters {
+		ch <- frame
+	}
+}
@@ -0,0 +1,137 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/bluenviron/gortmplib/pkg/amf0"
+	"github.com/bluenviron/gortmplib/pkg/message"
+
+	"rtmp_kvs/kvs"
+)
+
+// Name of the KVS fragment metadata carrying the publisher's onMetaData
+const metadataFragmentName = "RTMP_METADATA"
+
+// StreamMetadata is the stream description a publisher sends in its onMetaData message.
+// Fields the publisher did not send are zero.
+type StreamMetadata struct {
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	FrameRate     float64 `json:"framerate,omitempty"`
+	VideoDataRate float64 `json:"videodatarate,omitempty"` // kbit/s
+	Encoder       string  `json:"encoder,omitempty"`
+}
+
+// String formats the metadata for logs.
+func (m StreamMetadata) String() string {
+	var parts []string
+	if m.Width > 0 && m.Height > 0 {
+		parts = append(parts, fmt.Sprintf("%dx%d", m.Width, m.Height))
+	}
+	if m.FrameRate > 0 {
+		parts = append(parts, fmt.Sprintf("%.4g fps", m.FrameRate))
+	}
+	if m.VideoDataRate > 0 {
+		parts = append(parts, fmt.Sprintf("%.0f kbps", m.VideoDataRate))
+	}
+	if m.Encoder != "" {
+		parts = append(parts, fmt.Sprintf("encoder %q", m.Encoder))
+	}
+	if len(parts) == 0 {
+		return "empty"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseMetadata decodes an onMetaData data message, sent either as
+// ["onMetaData", object] or as ["@setDataFrame", "onMetaData", object].
+func parseMetadata(payload amf0.Data) (StreamMetadata, bool) {
+	if len(payload) > 0 && payload[0] == "@setDataFrame" {
+		payload = payload[1:]
+	}
+	if len(payload) < 2 || payload[0] != "onMetaData" {
+		return StreamMetadata{}, false
+	}
+	var object amf0.Object
+	switch v := payload[1].(type) {
+	case amf0.Object:
+		object = v
+	case amf0.ECMAArray:
+		object = amf0.Object(v)
+	default:
+		return StreamMetadata{}, false
+	}
+
+	number := func(keys ...string) float64 {
+		for _, key := range keys {
+			if v, ok := object.GetFloat64(key); ok && v > 0 && !math.IsInf(v, 0) {
+				return v
+			}
+		}
+		return 0
+	}
+	var m StreamMetadata
+	m.Width = int(number("width"))
+	m.Height = int(number("height"))
+	// Some encoders use the names of the FLV file metadata
+	m.FrameRate = number("framerate", "videoframerate", "fps")
+	m.VideoDataRate = number("videodatarate")
+	m.Encoder, _ = object.GetString("encoder")
+	return m, true
+}
+
+// metadataConn passes the messages of a publisher to the gortmplib reader, which ignores
+// data messages, and reports the onMetaData messages among them.
+type metadataConn struct {
+	gortmplib.Conn
+
+	// Last metadata received, and the function reporting updates (nil until the session
+	// exists). Used by the reader goroutine only.
+	metadata   *StreamMetadata
+	onMetadata func(StreamMetadata)
+}
+
+func (c *metadataConn) Read() (message.Message, error) {
+	msg, err := c.Conn.Read()
+	if data, ok := msg.(*message.DataAMF0); ok && err == nil {
+		if m, ok := parseMetadata(data.Payload); ok {
+			c.metadata = &m
+			if c.onMetadata != nil {
+				c.onMetadata(m)
+			}
+		}
+	}
+	return msg, err
+}
+
+// setMetadata records the publisher's metadata in the statistics and attaches it to the
+// next KVS fragment. Later onMetaData messages (e.g. after an encoder change) replace it.
+func (ss *session) setMetadata(m StreamMetadata) {
+	log.Printf("[%s] Metadata of %s: %s", ss.protocol, ss.streamPath, m)
+	ss.stats.setMetadata(m)
+	if ss.started {
+		ss.attachMetadata(m)
+	}
+}
+
+// attachMetadata attaches the metadata to the next KVS fragment as JSON. Pipelines that
+// cannot attach fragment metadata are skipped silently.
+func (ss *session) attachMetadata(m StreamMetadata) {
+	value, _ := json.Marshal(m)
+	if len(value) > 256 {
+		// KVS limits values to 256 bytes, only the free-form encoder name can exceed it
+		m.Encoder = ""
+		value, _ = json.Marshal(m)
+	}
+	err := ss.forwarder.AddMetadata(metadataFragmentName, string(value))
+	if err != nil && !errors.Is(err, kvs.ErrMetadataUnsupported) {
+		log.Printf("[%s] ⚠️  Metadata of %s not attached to fragments: %v", ss.protocol, ss.streamPath, err)
+	}
+}
@@ -0,0 +1,274 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/events"
+)
+
+const (
+	// Frames used to learn the quiet-scene baseline before motion is reported
+	motionWarmupFrames = 50
+	// Minimum growth over the baseline, so tiny low-bitrate frames do not trigger on noise
+	motionMinBytes = 512
+	// Upper bound of the pre-roll buffer of one paused stream
+	maxPrerollBytes = 32 << 20
+)
+
+// motionConfig holds the settings of motion-gated forwarding (MOTION_GATE).
+type motionConfig struct {
+	threshold   float64       // inter-frame size over the quiet baseline that counts as motion
+	idleTimeout time.Duration // forwarding pauses after this long without motion
+	preroll     time.Duration // video kept while paused and sent ahead of the motion
+}
+
+// motionConfigFromEnv reads MOTION_GATE, MOTION_THRESHOLD (default 3.0),
+// MOTION_IDLE_TIMEOUT (seconds, default 60) and MOTION_PREROLL (seconds, default 5).
+// It returns nil when motion gating is disabled.
+func motionConfigFromEnv() *motionConfig {
+	if os.Getenv("MOTION_GATE") != "true" {
+		return nil
+	}
+	c := &motionConfig{
+		threshold:   3.0,
+		idleTimeout: envSeconds("MOTION_IDLE_TIMEOUT", 60*time.Second, false),
+		preroll:     envSeconds("MOTION_PREROLL", 5*time.Second, true),
+	}
+	if value := os.Getenv("MOTION_THRESHOLD"); value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 1 {
+			log.Printf("Warning: invalid MOTION_THRESHOLD %q, using %.1f", value, c.threshold)
+		} else {
+			c.threshold = threshold
+		}
+	}
+	log.Printf("Motion-gated forwarding enabled (threshold %.1f, idle %s, pre-roll %s)", c.threshold, c.idleTimeout, c.preroll)
+	return c
+}
+
+// motionDetector is a compressed-domain motion heuristic. A static scene encodes to small
+// P-frames of a steady size; motion makes them several times larger. The detector keeps
+// a baseline of the inter-frame size that follows quiet frames quickly and motion frames
+// only slowly, so persistent changes (rain, swaying trees) are eventually absorbed into it.
+type motionDetector struct {
+	baseline float64
+	samples  int
+}
+
+// observe reports whether the access unit shows motion. Keyframes carry no motion
+// information and are ignored.
+func (d *motionDetector) observe(au [][]byte, threshold float64) bool {
+	size := 0
+	for _, nalu := range au {
+		if len(nalu) > 0 && h264.NALUType(nalu[0]&0x1F) == h264.NALUTypeNonIDR {
+			size += len(nalu)
+		}
+	}
+	if size == 0 {
+		return false
+	}
+
+	if d.samples < motionWarmupFrames {
+		d.samples++
+		d.baseline += (float64(size) - d.baseline) / float64(d.samples)
+		return false
+	}
+
+	s := float64(size)
+	motion := s > d.baseline*threshold && s-d.baseline > motionMinBytes
+	alpha := 0.1
+	switch {
+	case motion:
+		alpha = 0.002
+	case s > d.baseline:
+		alpha = 0.02
+	}
+	d.baseline += alpha * (s - d.baseline)
+	return motion
+}
+
+// prerollFrame is a frame buffered while forwarding is paused.
+type prerollFrame struct {
+	frame    h264Frame
+	keyframe bool
+	size     int
+}
+
+// frameBuffer holds the latest frames of a stream while forwarding is paused, from a
+// keyframe, to be forwarded ahead of the live frames when it resumes.
+type frameBuffer struct {
+	frames []prerollFrame
+	bytes  int
+}
+
+// add appends a frame. The buffer starts at a keyframe; whole GOPs are dropped from its
+// front while the rest still covers window, or when it exceeds maxBytes. It returns the
+// number of frames that were dropped or not buffered.
+func (b *frameBuffer) add(frame h264Frame, keyframe bool, window time.Duration, maxBytes int) int {
+	if len(b.frames) == 0 && !keyframe {
+		return 1
+	}
+	size := 0
+	for _, nalu := range frame.au {
+		size += len(nalu)
+	}
+	b.frames = append(b.frames, prerollFrame{frame: frame, keyframe: keyframe, size: size})
+	b.bytes += size
+
+	dropped := 0
+	for {
+		next := 0
+		for i := 1; i < len(b.frames); i++ {
+			if b.frames[i].keyframe {
+				next = i
+				break
+			}
+		}
+		if next == 0 {
+			break
+		}
+		if frame.dts-b.frames[next].frame.dts < window && b.bytes <= maxBytes {
+			break
+		}
+		dropped += b.drop(next)
+	}
+
+	// A single GOP over the byte limit cannot be kept
+	if b.bytes > maxBytes {
+		dropped += b.drop(len(b.frames))
+	}
+	return dropped
+}
+
+// drop removes the first n frames and returns n.
+func (b *frameBuffer) drop(n int) int {
+	for _, p := range b.frames[:n] {
+		b.bytes -= p.size
+	}
+	b.frames = append(b.frames[:0:0], b.frames[n:]...)
+	return n
+}
+
+// take empties the buffer and returns its frames.
+func (b *frameBuffer) take() []h264Frame {
+	out := make([]h264Frame, 0, len(b.frames))
+	for _, p := range b.frames {
+		out = append(out, p.frame)
+	}
+	b.frames = nil
+	b.bytes = 0
+	return out
+}
+
+// motionGate pauses KVS forwarding of a static scene. While paused, the latest frames
+// (from a keyframe, covering at least the pre-roll) are buffered; on motion they are
+// forwarded ahead of the live frames, so the recording starts before the motion did.
+type motionGate struct {
+	config   *motionConfig
+	detector motionDetector
+
+	paused     bool
+	pausedAt   time.Time
+	lastMotion time.Duration // DTS of the last frame with motion
+	started    bool
+
+	preroll frameBuffer
+	gated   uint64 // frames never forwarded
+}
+
+// push passes a frame through the gate and returns the frames to forward: nil while
+// paused, the pre-roll followed by the frame on resume. The transition reports whether
+// forwarding paused (-1) or resumed (+1) on this frame.
+func (g *motionGate) push(frame h264Frame) (out []h264Frame, transition int) {
+	keyframe := h264.IsRandomAccess(frame.au)
+	motion := g.detector.observe(frame.au, g.config.threshold)
+	if motion || !g.started {
+		g.lastMotion = frame.dts
+		g.started = true
+	}
+
+	if !g.paused {
+		if frame.dts-g.lastMotion < g.config.idleTimeout {
+			return []h264Frame{frame}, 0
+		}
+		g.paused = true
+		g.pausedAt = time.Now()
+		transition = -1
+	}
+
+	if !motion {
+		g.gated += uint64(g.preroll.add(frame, keyframe, g.config.preroll, maxPrerollBytes))
+		return nil, transition
+	}
+
+	g.paused = false
+	return append(g.preroll.take(), frame), 1
+}
+
+// forward passes a frame to the forwarder, unless forwarding is paused by a remote
+// command, through the motion gate when enabled.
+func (ss *session) forward(frame h264Frame) {
+	frames, held := ss.applyHold(frame)
+	if held {
+		return
+	}
+	for _, f := range frames {
+		ss.gateFrame(f)
+	}
+}
+
+// gateFrame passes a frame through the motion gate when enabled. The pipeline is stopped
+// while forwarding is paused and restarted on motion, so KVS is neither billed for the
+// static scene nor handed a timeline with a gap in it.
+func (ss *session) gateFrame(frame h264Frame) {
+	if ss.gate == nil {
+		ss.forwarder.WriteH264(ss.ctx, frame.pts, frame.dts, frame.au)
+		return
+	}
+
+	frames, transition := ss.gate.push(frame)
+	switch transition {
+	case -1:
+		log.Printf("[%s] No motion on %s for %s, pausing KVS forwarding",
+			ss.protocol, ss.streamPath, ss.gate.config.idleTimeout)
+		ss.forwarder.Stop()
+		ss.emitGate(events.ForwardingPaused, map[string]any{
+			"idle_seconds": ss.gate.config.idleTimeout.Seconds(),
+		})
+	case 1:
+		paused := time.Since(ss.gate.pausedAt)
+		log.Printf("[%s] Motion on %s after %s, resuming KVS forwarding with %d pre-roll frames",
+			ss.protocol, ss.streamPath, paused.Truncate(time.Second), len(frames)-1)
+		if err := ss.startForwarder(); err != nil {
+			log.Printf("[%s] ⚠️  Failed to restart KVS forwarder: %v", ss.protocol, err)
+		}
+		ss.emitGate(events.ForwardingResumed, map[string]any{
+			"paused_seconds": paused.Seconds(),
+			"preroll_frames": len(frames) - 1,
+		})
+	}
+	ss.recordPause()
+
+	for _, f := range frames {
+		ss.forwarder.WriteH264(ss.ctx, f.pts, f.dts, f.au)
+	}
+}
+
+// emitGate emits a ForwardingPaused or ForwardingResumed event.
+func (ss *session) emitGate(eventType string, detail map[string]any) {
+	events.Emit(events.Event{
+		Type:       eventType,
+		StreamPath: ss.streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   ss.route.CameraID,
+		RemoteAddr: ss.remoteAddr,
+		Protocol:   ss.protocol,
+		Detail:     detail,
+	})
+}
@@ -0,0 +1,324 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/mpeg4audio"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
+	mpegtscodecs "github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts/codecs"
+
+	"rtmp_kvs/audit"
+	"rtmp_kvs/auth"
+)
+
+// ServeMPEGTS accepts raw MPEG-TS pushed over TCP (e.g. ffmpeg -f mpegts tcp://host:port).
+// Every connection publishes to streamPath. Like Serve, it runs until ctx is cancelled and
+// returns once its connections have finished, with an error if the listener failed.
+func (s *Server) ServeMPEGTS(ctx context.Context, ln net.Listener, streamPath string) error {
+	const protocol = "MPEG-TS/TCP"
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	acceptCtx, cancel := s.acceptContext(ctx)
+	defer cancel()
+	stop := context.AfterFunc(acceptCtx, func() { ln.Close() })
+	defer stop()
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if acceptCtx.Err() != nil {
+				return nil
+			}
+			if backoff = acceptBackoff(backoff, err); backoff > 0 {
+				log.Printf("[%s] Accept error: %v; retrying in %s", protocol, err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return fmt.Errorf("%s listener failed: %w", protocol, err)
+		}
+		backoff = 0
+		if !s.admit(conn.RemoteAddr(), protocol) {
+			conn.Close()
+			continue
+		}
+		s.countConnection(protocol, conn.RemoteAddr().String())
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer conn.Close()
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			remoteAddr := conn.RemoteAddr().String()
+			log.Printf("[%s] Connection opened from %s", protocol, remoteAddr)
+			s.connConfig.tuneConn(conn)
+
+			connCtx, connAudit := s.startAudit(ctx, remoteAddr, protocol)
+			r := &deadlineReader{conn: conn, timeout: s.connConfig.ReadTimeout}
+			err := s.ingestMPEGTS(connCtx, r, conn, streamPath, remoteAddr, protocol)
+			if err != nil {
+				if isTimeout(err) {
+					s.countFailure(connCtx, protocol, remoteAddr, failReadTimeout)
+				}
+				log.Printf("[%s] Connection %s closed: %v", protocol, remoteAddr, err)
+			} else {
+				log.Printf("[%s] Connection %s closed", protocol, remoteAddr)
+			}
+			s.finishAudit(connAudit, err, ctx.Err() != nil)
+		}()
+	}
+}
+
+// ServeMPEGTSUDP reads raw MPEG-TS datagrams (e.g. ffmpeg -f mpegts udp://host:port) and
+// publishes them to streamPath. A session ends after the UDP idle timeout without data.
+// It runs until ctx is cancelled or the server drains, which closes pc: datagrams have
+// no connection to finish, so the session ends and the next process receives them. It
+// returns an error if the socket failed.
+func (s *Server) ServeMPEGTSUDP(ctx context.Context, pc net.PacketConn, streamPath string) error {
+	const protocol = "MPEG-TS/UDP"
+
+	acceptCtx, cancel := s.acceptContext(ctx)
+	defer cancel()
+	stop := context.AfterFunc(acceptCtx, func() { pc.Close() })
+	defer stop()
+
+	if udpConn, ok := pc.(*net.UDPConn); ok {
+		s.connConfig.tuneBuffers(udpConn)
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		// Wait (without deadline) for the first datagram of a session
+		pc.SetReadDeadline(time.Time{})
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if acceptCtx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("%s listener failed: %w", protocol, err)
+		}
+
+		if !s.admit(addr, protocol) {
+			continue
+		}
+		remoteAddr := addr.String()
+		log.Printf("[%s] Receiving from %s", protocol, remoteAddr)
+		s.countConnection(protocol, remoteAddr)
+
+		sessCtx, sessAudit := s.startAudit(ctx, remoteAddr, protocol)
+		r := &datagramReader{pc: pc, buf: buf, pending: buf[:n], timeout: s.connConfig.UDPIdleTimeout, filter: s.ipFilter}
+		err = s.ingestMPEGTS(sessCtx, r, nil, streamPath, remoteAddr, protocol)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			log.Printf("[%s] No data from %s for %s, session ended", protocol, remoteAddr, s.connConfig.UDPIdleTimeout)
+			sessAudit.setReason(disconnectIdle)
+		} else if err != nil {
+			log.Printf("[%s] Session from %s ended: %v", protocol, remoteAddr, err)
+		}
+		s.finishAudit(sessAudit, err, ctx.Err() != nil)
+	}
+}
+
+// ingestMPEGTS demuxes an MPEG-TS stream and forwards its H.264 track.
+// conn is the connection to close on idle, or nil.
+func (s *Server) ingestMPEGTS(ctx context.Context, r io.Reader, conn io.Closer, streamPath, remoteAddr, protocol string) (err error) {
+	var sess *session
+	defer func() { s.endPublisher(streamPath, remoteAddr, protocol, sess, err, ctx.Err() != nil) }()
+	r = auditFrom(ctx).countReads(r)
+	ctx, streamPath = s.withPathTenant(ctx, streamPath)
+	auditFrom(ctx).update(func(r *audit.Record) {
+		r.Mode = "publish"
+		r.StreamPath = auth.RedactStreamPath(streamPath)
+		r.Tenant = tenantName(tenantFrom(ctx))
+	})
+	netConn, _ := conn.(net.Conn)
+	authReq := auth.NewPublishRequest(protocol, streamPath, nil, netConn, remoteAddr)
+	if err := s.authorize(ctx, authReq); err != nil {
+		return err
+	}
+	streamPath = tenantFrom(ctx).sessionPath(authReq.StreamPath)
+
+	route, err := s.route(ctx, streamPath, remoteAddr, protocol)
+	if err != nil {
+		return err
+	}
+
+	reader := &mpegts.Reader{R: &limitedReader{
+		r:       r,
+		limiter: s.newBitrateLimiter(route, streamPath, remoteAddr, protocol),
+		tenant:  s.newTenantLimiter(ctx, route, streamPath, remoteAddr, protocol),
+	}}
+	if err := reader.Initialize(); err != nil {
+		return fmt.Errorf("failed to read MPEG-TS header: %w", err)
+	}
+
+	var videoTrack, audioTrack *mpegts.Track
+	for i, track := range reader.Tracks() {
+		log.Printf("[%s] Track %d: %T", protocol, i, track.Codec)
+		switch track.Codec.(type) {
+		case *mpegtscodecs.H264:
+			if videoTrack == nil {
+				videoTrack = track
+			}
+		case *mpegtscodecs.MPEG4Audio:
+			log.Printf("[%s] AAC audio track detected", protocol)
+			if audioTrack == nil {
+				audioTrack = track
+			}
+		}
+	}
+	// The AAC track of a video stream is forwarded with the video (-forward-audio)
+	var videoAudio *mpegts.Track
+	if videoTrack != nil && s.forwardAudio {
+		videoAudio = audioTrack
+	}
+	if videoTrack != nil || !s.audioOnly {
+		audioTrack = nil
+	}
+	if videoTrack == nil && audioTrack == nil {
+		log.Printf("[%s] No H.264 track found, closing connection", protocol)
+		s.countFailure(ctx, protocol, remoteAddr, failUnsupportedCodec)
+		return nil
+	}
+
+	sess, err = s.openSession(ctx, route, conn, streamPath, remoteAddr, protocol, "")
+	if err != nil {
+		return err
+	}
+	defer sess.close()
+
+	for _, track := range reader.Tracks() {
+		switch track.Codec.(type) {
+		case *mpegtscodecs.H264:
+			sess.trackDetected("H264", track == videoTrack)
+		case *mpegtscodecs.MPEG4Audio:
+			sess.trackDetected("AAC", track == audioTrack || track == videoAudio)
+		default:
+			sess.trackDetected(fmt.Sprintf("%T", track.Codec), false)
+		}
+	}
+
+	var td mpegts.TimeDecoder
+	td.Initialize()
+
+	if audioTrack != nil {
+		// Audio-only stream: each PES carries one or more AAC access units
+		config := &audioTrack.Codec.(*mpegtscodecs.MPEG4Audio).Config
+		kvsTrack, err := aacTrack(config)
+		if err != nil {
+			return err
+		}
+		if err := sess.startAudio(kvsTrack); err != nil {
+			return err
+		}
+		auDuration := time.Duration(mpeg4audio.SamplesPerAccessUnit) * time.Second / time.Duration(config.SampleRate)
+		reader.OnDataMPEG4Audio(audioTrack, func(pts int64, aus [][]byte) error {
+			start := ticksToDuration(td.Decode(pts))
+			for i, au := range aus {
+				sess.writeAudio(start+time.Duration(i)*auDuration, au)
+			}
+			return nil
+		})
+	} else {
+		if videoAudio != nil {
+			config := &videoAudio.Codec.(*mpegtscodecs.MPEG4Audio).Config
+			if kvsTrack, err := aacTrack(config); err != nil {
+				log.Printf("[%s] ⚠️  Not forwarding the audio of %s: %v", protocol, streamPath, err)
+			} else {
+				sess.forwardVideoAudio(kvsTrack)
+				auDuration := time.Duration(mpeg4audio.SamplesPerAccessUnit) * time.Second / time.Duration(config.SampleRate)
+				reader.OnDataMPEG4Audio(videoAudio, func(pts int64, aus [][]byte) error {
+					start := ticksToDuration(td.Decode(pts))
+					for i, au := range aus {
+						sess.writeVideoAudio(start+time.Duration(i)*auDuration, au)
+					}
+					return nil
+				})
+			}
+		}
+
+		// Parameter sets are carried in-band
+		if err := sess.startH264(nil, nil); err != nil {
+			return err
+		}
+
+		reader.OnDataH264(videoTrack, func(pts, dts int64, au [][]byte) error {
+			decodedDTS := td.Decode(dts)
+			sess.writeH264(ticksToDuration(decodedDTS+ptsOffset(pts, dts)), ticksToDuration(decodedDTS), au)
+			return nil
+		})
+	}
+	reader.OnDecodeError(func(err error) {
+		log.Printf("[%s] Decode error: %v", protocol, err)
+	})
+
+	log.Printf("[%s] Starting read loop for %s...", protocol, remoteAddr)
+	for {
+		if err := reader.Read(); err != nil {
+			return err
+		}
+	}
+}
+
+// ptsOffset returns PTS-DTS in 90 kHz ticks, handling 33-bit wraparound.
+func ptsOffset(pts, dts int64) int64 {
+	const maximum = 0x1FFFFFFFF
+	diff := (pts - dts) & maximum
+	if diff > maximum/2 {
+		diff -= maximum + 1
+	}
+	return diff
+}
+
+// ticksToDuration converts 90 kHz ticks to a duration.
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks/90000)*time.Second + time.Duration(ticks%90000)*time.Second/90000
+}
+
+// deadlineReader extends the read deadline before every read.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+// datagramReader presents a stream of UDP datagrams as an io.Reader.
+type datagramReader struct {
+	pc      net.PacketConn
+	buf     []byte
+	pending []byte
+	timeout time.Duration
+	filter  *IPFilter // datagrams from other networks are dropped, nil accepts all
+}
+
+func (r *datagramReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		r.pc.SetReadDeadline(time.Now().Add(r.timeout))
+		n, addr, err := r.pc.ReadFrom(r.buf)
+		if err != nil {
+			return 0, err
+		}
+		if r.filter != nil && !r.filter.Allowed(addr) {
+			r.filter.rejected.Add(1)
+			continue
+		}
+		r.pending = r.buf[:n]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,169 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ConnConfig holds the timeouts and socket options applied to ingest connections.
+// The defaults suit mobile clients on the public internet; LAN cameras usually want
+// shorter timeouts and satellite-backhauled sites longer ones.
+type ConnConfig struct {
+	// Time allowed for the RTMP handshake and connect/publish commands (HANDSHAKE_TIMEOUT)
+	HandshakeTimeout time.Duration
+	// A publisher sending nothing for this long is disconnected (READ_TIMEOUT)
+	ReadTimeout time.Duration
+	// A publisher whose connection stays alive (pings, audio, metadata) but sends no video
+	// for this long is disconnected, 0 disables the check (VIDEO_TIMEOUT)
+	VideoTimeout time.Duration
+	// Write deadline for player connections (WRITE_TIMEOUT)
+	WriteTimeout time.Duration
+	// A UDP MPEG-TS session ends after this long without a datagram (UDP_IDLE_TIMEOUT)
+	UDPIdleTimeout time.Duration
+	// TCP keepalive probe interval, 0 disables keepalive (TCP_KEEPALIVE)
+	KeepAlive time.Duration
+	// Socket receive/send buffer sizes in bytes, 0 keeps the OS default
+	// (SOCKET_READ_BUFFER, SOCKET_WRITE_BUFFER)
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// DefaultConnConfig returns the settings used when nothing is configured.
+func DefaultConnConfig() ConnConfig {
+	return ConnConfig{
+		HandshakeTimeout: 30 * time.Second,
+		ReadTimeout:      30 * time.Second,
+		VideoTimeout:     30 * time.Second,
+		WriteTimeout:     10 * time.Second,
+		UDPIdleTimeout:   5 * time.Second,
+		KeepAlive:        15 * time.Second,
+	}
+}
+
+// ConnConfigFromEnv reads the connection settings from the environment, falling back
+// to DefaultConnConfig for unset or invalid values.
+func ConnConfigFromEnv() ConnConfig {
+	c := DefaultConnConfig()
+	return ConnConfig{
+		HandshakeTimeout: envSeconds("HANDSHAKE_TIMEOUT", c.HandshakeTimeout, false),
+		ReadTimeout:      envSeconds("READ_TIMEOUT", c.ReadTimeout, false),
+		VideoTimeout:     envSeconds("VIDEO_TIMEOUT", c.VideoTimeout, true),
+		WriteTimeout:     envSeconds("WRITE_TIMEOUT", c.WriteTimeout, false),
+		UDPIdleTimeout:   envSeconds("UDP_IDLE_TIMEOUT", c.UDPIdleTimeout, false),
+		KeepAlive:        envSeconds("TCP_KEEPALIVE", c.KeepAlive, true),
+		ReadBuffer:       envBytes("SOCKET_READ_BUFFER"),
+		WriteBuffer:      envBytes("SOCKET_WRITE_BUFFER"),
+	}
+}
+
+// SetConnConfig replaces the connection settings used for new connections.
+func (s *Server) SetConnConfig(cfg ConnConfig) {
+	s.connConfig = cfg
+}
+
+// String summarizes the settings for the startup log.
+func (c ConnConfig) String() string {
+	off := func(d time.Duration) string {
+		if d == 0 {
+			return "off"
+		}
+		return d.String()
+	}
+	buffer := func(n int) string {
+		if n == 0 {
+			return "default"
+		}
+		return strconv.Itoa(n)
+	}
+	return "handshake " + c.HandshakeTimeout.String() +
+		", read " + c.ReadTimeout.String() +
+		", video " + off(c.VideoTimeout) +
+		", write " + c.WriteTimeout.String() +
+		", udp idle " + c.UDPIdleTimeout.String() +
+		", keepalive " + off(c.KeepAlive) +
+		", rcvbuf " + buffer(c.ReadBuffer) +
+		", sndbuf " + buffer(c.WriteBuffer)
+}
+
+// trackProbeTimeout is the deadline for reading the track metadata of an RTMP publisher.
+// gortmplib analyzes up to two seconds of media before reporting the tracks, so the
+// analysis window is added to the longer of the handshake and read timeouts.
+func (c ConnConfig) trackProbeTimeout() time.Duration {
+	return max(c.HandshakeTimeout, c.ReadTimeout) + 2*time.Second
+}
+
+// tuneConn applies keepalive and buffer sizes to a TCP connection (or the TCP connection
+// under a TLS connection). Failures are logged and the connection is used as is.
+func (c ConnConfig) tuneConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if c.KeepAlive > 0 {
+		err := tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     c.KeepAlive,
+			Interval: c.KeepAlive,
+		})
+		if err != nil {
+			log.Printf("Warning: failed to set TCP keepalive on %s: %v", conn.RemoteAddr(), err)
+		}
+	} else if err := tcpConn.SetKeepAlive(false); err != nil {
+		log.Printf("Warning: failed to disable TCP keepalive on %s: %v", conn.RemoteAddr(), err)
+	}
+	c.tuneBuffers(tcpConn)
+}
+
+// tuneBuffers applies the socket buffer sizes to a TCP or UDP socket.
+func (c ConnConfig) tuneBuffers(conn interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}) {
+	if c.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(c.ReadBuffer); err != nil {
+			log.Printf("Warning: failed to set socket receive buffer: %v", err)
+		}
+	}
+	if c.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(c.WriteBuffer); err != nil {
+			log.Printf("Warning: failed to set socket send buffer: %v", err)
+		}
+	}
+}
+
+// envSeconds reads a duration in seconds. Zero is accepted only when allowZero is set.
+func envSeconds(name string, fallback time.Duration, allowZero bool) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 || (seconds == 0 && !allowZero) {
+		log.Printf("Warning: invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// envBytes reads a non-negative byte count (0 = OS default).
+func envBytes(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Warning: invalid %s %q, using the OS default", name, value)
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,261 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+)
+
+// Where a panic was recovered
+const (
+	panicRead       = "read"       // gortmplib Read() of a publisher
+	panicPublisher  = "publisher"  // the rest of the publisher handler
+	panicConnection = "connection" // handshake, commands and track detection
+)
+
+// Reports kept for GET /panics, and distinct signatures tracked before further ones are
+// counted as "other"
+const (
+	maxPanicReports    = 20
+	maxPanicSignatures = 100
+)
+
+// Largest stack trace attached to events
+const maxEventStack = 8 << 10
+
+// PanicReport describes a recovered panic and the session it ended.
+type PanicReport struct {
+	Time       time.Time    `json:"time"`
+	Where      string       `json:"where"`
+	Value      string       `json:"value"`
+	Signature  string       `json:"signature"` // identifies the panic site across sessions
+	Frame      string       `json:"frame"`     // function and line that panicked
+	Protocol   string       `json:"protocol"`
+	RemoteAddr string       `json:"remote_addr"`
+	Session    *StreamStats `json:"session,omitempty"` // nil before the publisher was registered
+	Stack      string       `json:"stack"`
+}
+
+// PanicSignature counts the panics of one site.
+type PanicSignature struct {
+	Signature string    `json:"signature"`
+	Where     string    `json:"where"`
+	Frame     string    `json:"frame"`
+	Value     string    `json:"last_value"`
+	Count     uint64    `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	CameraIDs []string  `json:"camera_ids,omitempty"` // cameras that triggered it
+}
+
+// panicLog keeps the latest panic reports and counts panics by location and signature.
+type panicLog struct {
+	mutex      sync.Mutex
+	reports    []PanicReport // newest last
+	counts     map[string]uint64
+	signatures map[string]*PanicSignature
+}
+
+func newPanicLog() *panicLog {
+	return &panicLog{
+		counts:     make(map[string]uint64),
+		signatures: make(map[string]*PanicSignature),
+	}
+}
+
+// recoverPanic records a panic recovered in where: it logs the stack trace, counts it,
+// emits a PanicRecovered event and counts a strike against the client's address, whose
+// data most likely caused it. sess is the publisher session, nil if not yet opened.
+func (s *Server) recoverPanic(where string, value any, protocol, remoteAddr string, sess *session) {
+	stack := debug.Stack()
+	signature, frame := panicSignature(stack)
+	report := PanicReport{
+		Time:       time.Now().UTC(),
+		Where:      where,
+		Value:      fmt.Sprint(value),
+		Signature:  signature,
+		Frame:      frame,
+		Protocol:   protocol,
+		RemoteAddr: remoteAddr,
+		Stack:      string(stack),
+	}
+	event := events.Event{
+		Type:       events.PanicRecovered,
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+	}
+	if sess != nil {
+		stats := sess.stats.snapshot()
+		report.Session = &stats
+		event.StreamPath = sess.streamPath
+		event.StreamName = sess.forwarder.StreamName()
+		event.CameraID = sess.route.CameraID
+	}
+	log.Printf("[%s] ⚠️  Recovered from panic in %s from %s (signature %s at %s): %v\n%s",
+		protocol, where, remoteAddr, signature, frame, value, stack)
+	s.panics.add(report)
+
+	event.Detail = map[string]any{
+		"where":     where,
+		"panic":     report.Value,
+		"signature": signature,
+		"frame":     frame,
+		"stack":     truncate(report.Stack, maxEventStack),
+	}
+	if stats := report.Session; stats != nil {
+		event.Detail["session_id"] = stats.SessionID
+		event.Detail["frames"] = stats.Frames
+		event.Detail["video_codec"] = stats.VideoCodec
+		event.Detail["audio_codec"] = stats.AudioCodec
+		event.Detail["width"] = stats.Width
+		event.Detail["height"] = stats.Height
+	}
+	events.Emit(event)
+
+	s.malformedInput(protocol, remoteAddr, &inputError{malformedPanic, fmt.Sprintf("%s at %s", report.Value, frame)}, nil)
+}
+
+// add records a report.
+func (p *panicLog) add(report PanicReport) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.counts[report.Where]++
+	if len(p.reports) == maxPanicReports {
+		p.reports = append(p.reports[:0], p.reports[1:]...)
+	}
+	p.reports = append(p.reports, report)
+
+	sig := p.signatures[report.Signature]
+	if sig == nil {
+		if len(p.signatures) >= maxPanicSignatures {
+			report.Signature, report.Frame = "other", ""
+			sig = p.signatures["other"]
+		}
+		if sig == nil {
+			sig = &PanicSignature{Signature: report.Signature, Where: report.Where, Frame: report.Frame, FirstSeen: report.Time}
+			p.signatures[report.Signature] = sig
+		}
+	}
+	sig.Count++
+	sig.Value = report.Value
+	sig.LastSeen = report.Time
+	if report.Session != nil && report.Session.CameraID != "" && !slices.Contains(sig.CameraIDs, report.Session.CameraID) && len(sig.CameraIDs) < 20 {
+		sig.CameraIDs = append(sig.CameraIDs, report.Session.CameraID)
+	}
+}
+
+// PanicSummary is the response of GET /panics.
+type PanicSummary struct {
+	Total      uint64            `json:"total"`
+	Signatures []PanicSignature  `json:"signatures"` // most frequent first
+	Recent     []PanicReport     `json:"recent"`     // newest first
+	ByLocation map[string]uint64 `json:"by_location"`
+}
+
+// Panics returns the recovered panics.
+func (s *Server) Panics() PanicSummary {
+	p := s.panics
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	summary := PanicSummary{
+		Signatures: make([]PanicSignature, 0, len(p.signatures)),
+		Recent:     make([]PanicReport, 0, len(p.reports)),
+		ByLocation: make(map[string]uint64, len(p.counts)),
+	}
+	for where, n := range p.counts {
+		summary.ByLocation[where] = n
+		summary.Total += n
+	}
+	for _, sig := range p.signatures {
+		sig := *sig
+		sig.CameraIDs = append([]string(nil), sig.CameraIDs...)
+		summary.Signatures = append(summary.Signatures, sig)
+	}
+	sort.Slice(summary.Signatures, func(i, j int) bool {
+		return summary.Signatures[i].Count > summary.Signatures[j].Count
+	})
+	for i := len(p.reports) - 1; i >= 0; i-- {
+		summary.Recent = append(summary.Recent, p.reports[i])
+	}
+	return summary
+}
+
+// ServePanics serves the recovered panics as JSON (GET /panics).
+func (s *Server) ServePanics(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, s.Panics())
+}
+
+// collect writes the panic counters.
+func (p *panicLog) collect(w *metrics.Writer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, where := range []string{panicRead, panicPublisher, panicConnection} {
+		w.Counter("rtmp_panics_total", "Panics recovered while serving a connection, by location", float64(p.counts[where]), "where", where)
+	}
+	for _, sig := range p.signatures {
+		w.Counter("rtmp_panic_signature_total", "Panics recovered by panic site", float64(sig.Count), "signature", sig.Signature, "frame", sig.Frame)
+	}
+}
+
+// panicSignature identifies the site of a panic from the stack trace of the recovering
+// goroutine: a hash of the first frames below runtime.gopanic, and the first of them.
+func panicSignature(stack []byte) (signature, frame string) {
+	// Frames are a function line followed by a "\tfile:line +0x.." line
+	lines := strings.Split(string(stack), "\n")
+	var frames []string
+	panicking := false
+	for i := 0; i+1 < len(lines) && len(frames) < 5; i++ {
+		if lines[i] == "" || strings.HasPrefix(lines[i], "\t") || strings.HasPrefix(lines[i], "goroutine ") {
+			continue
+		}
+		function := lines[i]
+		if n := strings.LastIndexByte(function, '('); n > 0 {
+			function = function[:n]
+		}
+		if !panicking {
+			panicking = function == "panic" || function == "runtime.gopanic"
+			continue
+		}
+		if strings.HasPrefix(function, "runtime.") {
+			continue // runtime.panicIndex, ...
+		}
+		location := strings.TrimPrefix(lines[i+1], "\t")
+		if n := strings.LastIndex(location, " +0x"); n > 0 {
+			location = location[:n]
+		}
+		frames = append(frames, function+" "+location)
+	}
+	if len(frames) == 0 {
+		return "unknown", ""
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(frames, "\n")))
+	function, location, _ := strings.Cut(frames[0], " ")
+	if n := strings.LastIndexByte(location, '/'); n >= 0 {
+		location = location[n+1:]
+	}
+	return hex.EncodeToString(sum[:6]), function + " (" + location + ")"
+}
+
+// truncate shortens s to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "\n..."
+}
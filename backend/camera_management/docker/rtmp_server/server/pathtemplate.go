@@ -0,0 +1,241 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"rtmp_kvs/kvs"
+)
+
+var (
+	// Characters allowed in KVS stream names
+	streamNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,256}$`)
+	// {name} parameters of a stream name template
+	streamParamPattern = regexp.MustCompile(`\{([^}]*)\}`)
+)
+
+// pathTemplate is a publish path pattern such as /cameras/{site}/{camera}: literal
+// segments must be equal, {name} captures one non-empty segment. A stream name template
+// such as cam-{site}-{camera} maps the captured parameters to the KVS stream.
+type pathTemplate struct {
+	pattern  string
+	segments []string
+	stream   string
+}
+
+// PathTemplates restricts publish and play paths to RTMP application names and path
+// templates, and routes the paths of templates with a stream name template.
+type PathTemplates struct {
+	apps      []string // allowed first path segments, any if empty
+	templates []*pathTemplate
+	pool      *kvs.Pool
+	region    string
+}
+
+// pathMatch is the result of matching a path.
+type pathMatch struct {
+	template *pathTemplate // nil if no templates are configured
+	params   map[string]string
+}
+
+// PathTemplatesFromEnv reads RTMP_APPS (comma-separated application names, e.g.
+// "live,cameras") and PATH_TEMPLATES (comma-separated <pattern>[=<stream name>], e.g.
+// "/cameras/{site}/{camera}=cam-{site}-{camera},/live/{key}"). It returns nil if neither
+// is set. Forwarders of mapped stream names come from pool in region.
+func PathTemplatesFromEnv(pool *kvs.Pool, region string) (*PathTemplates, error) {
+	t := &PathTemplates{pool: pool, region: region}
+	for _, app := range strings.Split(os.Getenv("RTMP_APPS"), ",") {
+		app = strings.Trim(strings.TrimSpace(app), "/")
+		if strings.Contains(app, "/") {
+			return nil, fmt.Errorf("invalid RTMP_APPS entry %q", app)
+		}
+		if app != "" {
+			t.apps = append(t.apps, app)
+		}
+	}
+	for _, spec := range strings.Split(os.Getenv("PATH_TEMPLATES"), ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		template, err := parsePathTemplate(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PATH_TEMPLATES entry %q: %w", spec, err)
+		}
+		t.templates = append(t.templates, template)
+	}
+	if len(t.apps) == 0 && len(t.templates) == 0 {
+		return nil, nil
+	}
+
+	patterns := make([]string, len(t.templates))
+	for i, template := range t.templates {
+		patterns[i] = template.pattern
+		if template.stream != "" {
+			patterns[i] += " → " + template.stream
+		}
+	}
+	log.Printf("Publish paths: apps %v, templates %v", t.apps, patterns)
+	return t, nil
+}
+
+// parsePathTemplate parses <pattern>[=<stream name>].
+func parsePathTemplate(spec string) (*pathTemplate, error) {
+	pattern, stream, _ := strings.Cut(spec, "=")
+	pattern, stream = strings.TrimSpace(pattern), strings.TrimSpace(stream)
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("pattern must start with /")
+	}
+	t := &pathTemplate{pattern: pattern, segments: strings.Split(pattern[1:], "/"), stream: stream}
+	names := make(map[string]bool)
+	for _, segment := range t.segments {
+		if segment == "" {
+			return nil, errors.New("empty path segment")
+		}
+		name, ok := paramName(segment)
+		if !ok {
+			if strings.ContainsAny(segment, "{}") {
+				return nil, fmt.Errorf("invalid segment %q", segment)
+			}
+			continue
+		}
+		if name == "" || names[name] {
+			return nil, fmt.Errorf("invalid or duplicate parameter %q", segment)
+		}
+		names[name] = true
+	}
+	// Every parameter of the stream name must be captured by the pattern
+	for _, m := range streamParamPattern.FindAllStringSubmatch(stream, -1) {
+		if !names[m[1]] {
+			return nil, fmt.Errorf("stream name uses unknown parameter {%s}", m[1])
+		}
+	}
+	return t, nil
+}
+
+// paramName returns the name of a {name} segment.
+func paramName(segment string) (string, bool) {
+	if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+		return "", false
+	}
+	return segment[1 : len(segment)-1], true
+}
+
+// match returns the parameters of a path, or false if the path does not match.
+func (t *pathTemplate) match(streamPath string) (map[string]string, bool) {
+	segments := strings.Split(strings.TrimPrefix(streamPath, "/"), "/")
+	if len(segments) != len(t.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, segment := range t.segments {
+		if name, ok := paramName(segment); ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[name] = segments[i]
+		} else if segments[i] != segment {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// streamName returns the KVS stream name of the matched parameters, or "" if the
+// template maps no stream name.
+func (m *pathMatch) streamName() (string, error) {
+	if m.template == nil || m.template.stream == "" {
+		return "", nil
+	}
+	name := m.template.stream
+	for param, value := range m.params {
+		name = strings.ReplaceAll(name, "{"+param+"}", value)
+	}
+	if !streamNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid stream name %q", name)
+	}
+	return name, nil
+}
+
+// match checks a path against the application names and templates. Without templates
+// the parameters are empty.
+func (t *PathTemplates) match(streamPath string) (*pathMatch, error) {
+	if len(t.apps) > 0 {
+		app, _, _ := strings.Cut(strings.TrimPrefix(streamPath, "/"), "/")
+		if !slices.Contains(t.apps, app) {
+			return nil, fmt.Errorf("unknown application %q", app)
+		}
+	}
+	if len(t.templates) == 0 {
+		return &pathMatch{}, nil
+	}
+	for _, template := range t.templates {
+		if params, ok := template.match(streamPath); ok {
+			return &pathMatch{template: template, params: params}, nil
+		}
+	}
+	return nil, errors.New("path does not match any template")
+}
+
+// Route implements Router for paths of templates with a stream name template. The
+// {camera} parameter, if any, is the camera ID.
+func (t *PathTemplates) Route(ctx context.Context, streamPath string) (*Route, error) {
+	m, err := t.match(streamPath)
+	if err != nil {
+		return nil, err
+	}
+	streamName, err := m.streamName()
+	if err != nil {
+		return nil, err
+	}
+	forwarder := t.pool.Get(streamName, t.region)
+	settings := t.pool.StreamConfig(streamName)
+	return &Route{Forwarder: forwarder, CameraID: m.params["camera"], Settings: &settings}, nil
+}
+
+// SetPathTemplates restricts paths to application names and templates.
+func (s *Server) SetPathTemplates(t *PathTemplates) {
+	s.paths = t
+}
+
+// StreamKeyPaths returns the paths of a stream key (RTMP_STREAM_PATH) under the allowed
+// application names, /live/<key> by default.
+func (s *Server) StreamKeyPaths(key string) []string {
+	apps := []string{"live"}
+	if s.paths != nil && len(s.paths.apps) > 0 {
+		apps = s.paths.apps
+	}
+	paths := make([]string, len(apps))
+	for i, app := range apps {
+		paths[i] = "/" + app + "/" + key
+	}
+	return paths
+}
+
+// pathKey is the context key of the path match of a connection.
+type pathKey struct{}
+
+// matchPath returns ctx carrying the match of the path of a connection, or an error if
+// the path is not allowed. It returns ctx unchanged without templates.
+func (s *Server) matchPath(ctx context.Context, streamPath string) (context.Context, error) {
+	if s.paths == nil {
+		return ctx, nil
+	}
+	m, err := s.paths.match(streamPath)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, pathKey{}, m), nil
+}
+
+// pathMatchFrom returns the path match of a connection, or nil.
+func pathMatchFrom(ctx context.Context) *pathMatch {
+	m, _ := ctx.Value(pathKey{}).(*pathMatch)
+	return m
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	tests := []struct {
+		spec         string
+		wantPattern  string
+		wantSegments []string
+		wantStream   string
+		wantErr      string
+	}{
+		{
+			spec:         "/live/{key}",
+			wantPattern:  "/live/{key}",
+			wantSegments: []string{"live", "{key}"},
+		},
+		{
+			spec:         " /cameras/{site}/{camera} = cam-{site}-{camera} ",
+			wantPattern:  "/cameras/{site}/{camera}",
+			wantSegments: []string{"cameras", "{site}", "{camera}"},
+			wantStream:   "cam-{site}-{camera}",
+		},
+		{spec: "live/{key}", wantErr: "must start with /"},
+		{spec: "/live//{key}", wantErr: "empty path segment"},
+		{spec: "/live/", wantErr: "empty path segment"},
+		{spec: "/live/{}", wantErr: "invalid or duplicate parameter"},
+		{spec: "/{site}/{site}", wantErr: "invalid or duplicate parameter"},
+		{spec: "/live/cam{id}", wantErr: "invalid segment"},
+		{spec: "/live/{key", wantErr: "invalid segment"},
+		{spec: "/cameras/{site}=cam-{camera}", wantErr: "unknown parameter {camera}"},
+	}
+	for _, tt := range tests {
+		template, err := parsePathTemplate(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parsePathTemplate(%q): err = %v, want %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePathTemplate(%q): %v", tt.spec, err)
+			continue
+		}
+		if template.pattern != tt.wantPattern || template.stream != tt.wantStream ||
+			!slices.Equal(template.segments, tt.wantSegments) {
+			t.Errorf("parsePathTemplate(%q) = %+v", tt.spec, template)
+		}
+	}
+}
+
+func TestPathTemplateMatch(t *testing.T) {
+	template, err := parsePathTemplate("/cameras/{site}/{camera}=cam-{site}-{camera}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path       string
+		wantParams map[string]string
+		wantMatch  bool
+	}{
+		{"/cameras/tokyo/cam1", map[string]string{"site": "tokyo", "camera": "cam1"}, true},
+		{"cameras/tokyo/cam1", map[string]string{"site": "tokyo", "camera": "cam1"}, true},
+		{"/cameras/tokyo", nil, false},
+		{"/cameras/tokyo/cam1/extra", nil, false},
+		{"/live/tokyo/cam1", nil, false},
+		{"/cameras//cam1", nil, false},
+		{"/cameras/tokyo/", nil, false},
+	}
+	for _, tt := range tests {
+		params, ok := template.match(tt.path)
+		if ok != tt.wantMatch || !maps.Equal(params, tt.wantParams) {
+			t.Errorf("match(%q) = %v, %v, want %v, %v", tt.path, params, ok, tt.wantParams, tt.wantMatch)
+		}
+	}
+}
+
+func TestPathTemplatesMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		apps       string
+		templates  string
+		path       string
+		wantStream string
+		wantCamera string
+		wantErr    string
+	}{
+		{name: "any app", templates: "/live/{key}", path: "/live/abc"},
+		{name: "allowed app", apps: "live,cameras", path: "/cameras/anything"},
+		{name: "unknown app", apps: "live", path: "/other/abc", wantErr: "unknown application"},
+		{name: "app with slashes trimmed", apps: " /live/ ", path: "/live/abc"},
+		{
+			name:       "first matching template",
+			templates:  "/cameras/{site}/{camera}=cam-{site}-{camera},/cameras/{camera}=cam-{camera}",
+			path:       "/cameras/tokyo/cam1",
+			wantStream: "cam-tokyo-cam1",
+			wantCamera: "cam1",
+		},
+		{
+			name:       "second template",
+			templates:  "/cameras/{site}/{camera}=cam-{site}-{camera},/cameras/{camera}=cam-{camera}",
+			path:       "/cameras/cam2",
+			wantStream: "cam-cam2",
+			wantCamera: "cam2",
+		},
+		{name: "no stream name template", templates: "/live/{key}", path: "/live/abc"},
+		{name: "no matching template", templates: "/live/{key}", path: "/cameras/abc", wantErr: "does not match any template"},
+		{name: "app checked before templates", apps: "live", templates: "/cameras/{camera}", path: "/cameras/abc", wantErr: "unknown application"},
+		{
+			name:      "invalid stream name",
+			templates: "/cameras/{camera}=cam-{camera}",
+			path:      "/cameras/a:b",
+			wantErr:   "invalid stream name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RTMP_APPS", tt.apps)
+			t.Setenv("PATH_TEMPLATES", tt.templates)
+			templates, err := PathTemplatesFromEnv(nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := templates.match(tt.path)
+			var stream string
+			if err == nil {
+				stream, err = m.streamName()
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stream != tt.wantStream {
+				t.Errorf("stream name = %q, want %q", stream, tt.wantStream)
+			}
+			if camera := m.params["camera"]; camera != tt.wantCamera {
+				t.Errorf("camera = %q, want %q", camera, tt.wantCamera)
+			}
+		})
+	}
+}
+
+func TestPathTemplatesFromEnv(t *testing.T) {
+	tests := []struct {
+		apps      string
+		templates string
+		wantNil   bool
+		wantErr   bool
+	}{
+		{wantNil: true},
+		{apps: " , ", templates: " ,", wantNil: true},
+		{apps: "live"},
+		{templates: "/live/{key}"},
+		{apps: "live/cam", wantErr: true},
+		{templates: "/live/{key},live", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("RTMP_APPS", tt.apps)
+		t.Setenv("PATH_TEMPLATES", tt.templates)
+		templates, err := PathTemplatesFromEnv(nil, "")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("RTMP_APPS=%q PATH_TEMPLATES=%q: err = %v, want error %v", tt.apps, tt.templates, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (templates == nil) != tt.wantNil {
+			t.Errorf("RTMP_APPS=%q PATH_TEMPLATES=%q: templates = %v, want nil %v", tt.apps, tt.templates, templates, tt.wantNil)
+		}
+	}
+}
+
+func TestStreamKeyPaths(t *testing.T) {
+	s := &Server{}
+	if got := s.StreamKeyPaths("key"); !slices.Equal(got, []string{"/live/key"}) {
+		t.Errorf("StreamKeyPaths = %v without apps", got)
+	}
+	s.paths = &PathTemplates{apps: []string{"live", "cameras"}}
+	if got := s.StreamKeyPaths("key"); !slices.Equal(got, []string{"/live/key", "/cameras/key"}) {
+		t.Errorf("StreamKeyPaths = %v with apps", got)
+	}
+}
@@ -0,0 +1,200 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/bluenviron/gortmplib/pkg/codecs"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/preview"
+)
+
+// GOP cache limits; a GOP exceeding them is dropped until the next keyframe.
+const (
+	gopCacheMaxFrames = 600
+	gopCacheMaxBytes  = 32 * 1024 * 1024
+)
+
+// playbackReader is a player attached to a live session.
+type playbackReader struct {
+	ch           chan h264Frame
+	needKeyframe bool // set after frames were dropped; resync on the next keyframe
+}
+
+// SetPlayback enables RTMP read mode: players (ffplay, VLC) can connect to a live path and
+// receive the stream, starting from the cached GOP.
+func (s *Server) SetPlayback(enabled bool) {
+	s.playback = enabled
+}
+
+// SetPreview enables the on-box HLS preview of H.264 publishers.
+func (s *Server) SetPreview(p *preview.Server) {
+	s.preview = p
+}
+
+// publish updates the GOP cache and fans the frame out to attached players.
+// Access units are retained without copying: both readers allocate a new buffer per message.
+func (ss *session) publish(frame h264Frame, params *paramTracker) {
+	keyframe := h264.IsRandomAccess(frame.au)
+	size := 0
+	for _, nalu := range frame.au {
+		size += len(nalu)
+	}
+
+	ss.playbackMutex.Lock()
+	defer ss.playbackMutex.Unlock()
+
+	if keyframe {
+		ss.gop = ss.gop[:0]
+		ss.gopBytes = 0
+		ss.sps, ss.pps = params.sps, params.pps
+	}
+	if keyframe || len(ss.gop) > 0 {
+		if len(ss.gop) >= gopCacheMaxFrames || ss.gopBytes+size > gopCacheMaxBytes {
+			ss.gop = ss.gop[:0]
+			ss.gopBytes = 0
+		} else {
+			ss.gop = append(ss.gop, frame)
+			ss.gopBytes += size
+		}
+	}
+
+	for rd := range ss.readers {
+		if rd.needKeyframe {
+			if !keyframe {
+				continue
+			}
+			rd.needKeyframe = false
+		}
+		select {
+		case rd.ch <- frame:
+		default:
+			// Player is too slow; skip to the next keyframe
+			rd.needKeyframe = true
+		}
+	}
+}
+
+// addReader attaches a player and returns the cached GOP to send first.
+func (ss *session) addReader() (*playbackReader, []h264Frame, error) {
+	ss.playbackMutex.Lock()
+	defer ss.playbackMutex.Unlock()
+
+	if ss.readers == nil {
+		return nil, nil, errors.New("stream is closing")
+	}
+
+	rd := &playbackReader{ch: make(chan h264Frame, 300)}
+	backlog := append([]h264Frame(nil), ss.gop...)
+	if len(backlog) == 0 {
+		rd.needKeyframe = true
+	}
+	ss.readers[rd] = struct{}{}
+	ss.stats.setReaders(len(ss.readers))
+	return rd, backlog, nil
+}
+
+// removeReader detaches a player.
+func (ss *session) removeReader(rd *playbackReader) {
+	ss.playbackMutex.Lock()
+	defer ss.playbackMutex.Unlock()
+
+	if ss.readers != nil {
+		delete(ss.readers, rd)
+		ss.stats.setReaders(len(ss.readers))
+	}
+}
+
+// closeReaders disconnects all players when the publisher goes away.
+func (ss *session) closeReaders() {
+	ss.playbackMutex.Lock()
+	defer ss.playbackMutex.Unlock()
+
+	for rd := range ss.readers {
+		close(rd.ch)
+	}
+	ss.readers = nil
+	ss.gop = nil
+}
+
+// parameterSets returns the SPS/PPS of the cached GOP.
+func (ss *session) parameterSets() ([]byte, []byte) {
+	ss.playbackMutex.Lock()
+	defer ss.playbackMutex.Unlock()
+	return ss.sps, ss.pps
+}
+
+// handleReader serves a player connected in read mode.
+func (s *Server) handleReader(ctx context.Context, sc *gortmplib.ServerConn, conn net.Conn, isTLS bool) error {
+	protocol := protocolName(isTLS)
+	streamPath := tenantFrom(ctx).sessionPath(sc.URL.Path)
+	remoteAddr := conn.RemoteAddr().String()
+
+	s.mutex.Lock()
+	ss, exists := s.publishers[streamPath]
+	s.mutex.Unlock()
+	if !exists {
+		log.Printf("[%s] Player %s requested %s but it has no publisher", protocol, remoteAddr, streamPath)
+		return fmt.Errorf("no active publisher for %s", streamPath)
+	}
+
+	rd, backlog, err := ss.addReader()
+	if err != nil {
+		return err
+	}
+	defer ss.removeReader(rd)
+
+	// Without a cached GOP, wait for the next keyframe before describing the track
+	if len(backlog) == 0 {
+		select {
+		case frame, ok := <-rd.ch:
+			if !ok {
+				return errors.New("publisher disconnected")
+			}
+			backlog = append(backlog, frame)
+		case <-time.After(30 * time.Second):
+			return errors.New("timed out waiting for a keyframe")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	sps, pps := ss.parameterSets()
+	if sps == nil || pps == nil {
+		return errors.New("stream parameters (SPS/PPS) not available yet")
+	}
+	track := &gortmplib.Track{Codec: &codecs.H264{SPS: sps, PPS: pps}}
+	writer := &gortmplib.Writer{Conn: sc, Tracks: []*gortmplib.Track{track}}
+
+	conn.SetWriteDeadline(time.Now().Add(s.connConfig.WriteTimeout))
+	if err := writer.Initialize(); err != nil {
+		return err
+	}
+
+	log.Printf("[%s] Player %s watching %s (%d cached frames)", protocol, remoteAddr, streamPath, len(backlog))
+
+	write := func(frame h264Frame) error {
+		conn.SetWriteDeadline(time.Now().Add(s.connConfig.WriteTimeout))
+		return writer.WriteH264(track, frame.pts, frame.dts, frame.au)
+	}
+	for _, frame := range backlog {
+		if err := write(frame); err != nil {
+			return err
+		}
+	}
+	for frame := range rd.ch {
+		if err := write(frame); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[%s] Publisher of %s disconnected, closing player %s", protocol, streamPath, remoteAddr)
+	return nil
+}
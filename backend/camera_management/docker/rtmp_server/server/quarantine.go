@@ -0,0 +1,296 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+)
+
+// Addresses tracked before strikes of further ones are only counted, so a scan from many
+// addresses cannot grow the quarantine without bound
+const maxQuarantineOffenders = 10000
+
+// quarantineConfig is when an address sending malformed input is quarantined: its
+// connections and UDP sessions are refused for duration after strikes violations of the
+// input limits (or recovered panics) within window.
+type quarantineConfig struct {
+	strikes  int // 0 disables the quarantine, violations are still counted
+	window   time.Duration
+	duration time.Duration
+}
+
+// quarantineConfigFromEnv reads QUARANTINE_STRIKES (default 5, 0 disables),
+// QUARANTINE_WINDOW (seconds, default 300) and QUARANTINE_DURATION (seconds, default
+// 900).
+func quarantineConfigFromEnv() quarantineConfig {
+	c := quarantineConfig{
+		strikes:  5,
+		window:   envSeconds("QUARANTINE_WINDOW", 5*time.Minute, false),
+		duration: envSeconds("QUARANTINE_DURATION", 15*time.Minute, false),
+	}
+	if value := os.Getenv("QUARANTINE_STRIKES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			log.Printf("Warning: invalid QUARANTINE_STRIKES %q, using 5", value)
+		} else {
+			c.strikes = n
+		}
+	}
+	return c
+}
+
+// Offender is an address that sent malformed input.
+type Offender struct {
+	Address          string    `json:"address"` // IPv4 address or IPv6 /64
+	Strikes          int       `json:"strikes"` // within the quarantine window
+	Total            uint64    `json:"total"`
+	LastKind         string    `json:"last_kind"`
+	LastDetail       string    `json:"last_detail"`
+	LastProtocol     string    `json:"last_protocol"`
+	LastAt           time.Time `json:"last_at"`
+	QuarantinedUntil time.Time `json:"quarantined_until,omitzero"`
+	Rejected         uint64    `json:"rejected"` // connections refused while quarantined
+}
+
+// quarantine counts the violations of the input limits by source address and refuses
+// the addresses with too many of them.
+type quarantine struct {
+	config quarantineConfig
+
+	mutex     sync.Mutex
+	offenders map[netip.Prefix]*offender
+	counts    map[string]uint64 // violations by kind
+
+	rejected atomic.Uint64
+}
+
+type offender struct {
+	Offender
+	strikes []time.Time // within the window, oldest first
+}
+
+func newQuarantine(config quarantineConfig) *quarantine {
+	return &quarantine{
+		config:    config,
+		offenders: make(map[netip.Prefix]*offender),
+		counts:    make(map[string]uint64),
+	}
+}
+
+// offenderKey returns the quarantined network of an address: the address itself for
+// IPv4, its /64 for IPv6, where a host picks any address of its prefix.
+func offenderKey(remoteAddr string) (netip.Prefix, bool) {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr := addrPort.Addr().Unmap()
+	bits := 32
+	if addr.Is6() {
+		bits = 64
+	}
+	prefix, err := addr.Prefix(bits)
+	return prefix, err == nil
+}
+
+// offenderAddress returns how the quarantined network of an address is shown.
+func offenderAddress(key netip.Prefix) string {
+	if key.Bits() == 32 {
+		return key.Addr().String()
+	}
+	return key.String()
+}
+
+// strike records a violation by remoteAddr and reports whether it put the address in
+// quarantine, and whether the address already had a violation within the last second.
+func (q *quarantine) strike(remoteAddr, protocol string, violation *inputError) (until time.Time, quarantined, repeated bool) {
+	now := time.Now()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.counts[violation.kind]++
+
+	key, ok := offenderKey(remoteAddr)
+	if !ok {
+		return time.Time{}, false, false
+	}
+	o := q.offenders[key]
+	if o == nil {
+		if len(q.offenders) >= maxQuarantineOffenders {
+			q.prune(now)
+		}
+		if len(q.offenders) >= maxQuarantineOffenders {
+			return time.Time{}, false, false
+		}
+		o = &offender{Offender: Offender{Address: offenderAddress(key)}}
+		q.offenders[key] = o
+	}
+	repeated = now.Sub(o.LastAt) < time.Second
+	o.Total++
+	o.LastKind, o.LastDetail, o.LastProtocol, o.LastAt = violation.kind, violation.detail, protocol, now
+	o.strikes = append(o.strikes, now)
+	for len(o.strikes) > 0 && now.Sub(o.strikes[0]) > q.config.window {
+		o.strikes = o.strikes[1:]
+	}
+	o.Strikes = len(o.strikes)
+
+	if q.config.strikes == 0 || o.Strikes < q.config.strikes || now.Before(o.QuarantinedUntil) {
+		return time.Time{}, false, repeated
+	}
+	o.QuarantinedUntil = now.Add(q.config.duration)
+	o.strikes = nil
+	return o.QuarantinedUntil, true, repeated
+}
+
+// prune forgets the addresses neither quarantined nor with strikes within the window.
+// Must be called with the mutex held.
+func (q *quarantine) prune(now time.Time) {
+	for key, o := range q.offenders {
+		if now.After(o.QuarantinedUntil) && now.Sub(o.LastAt) > q.config.window {
+			delete(q.offenders, key)
+		}
+	}
+}
+
+// refuses reports whether connections from remoteAddr are refused, counting the refusal.
+func (q *quarantine) refuses(remoteAddr string) bool {
+	key, ok := offenderKey(remoteAddr)
+	if !ok {
+		return false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	o := q.offenders[key]
+	if o == nil || !time.Now().Before(o.QuarantinedUntil) {
+		return false
+	}
+	o.Rejected++
+	q.rejected.Add(1)
+	return true
+}
+
+// release lifts the quarantine of an address and forgets its strikes.
+func (q *quarantine) release(address string) bool {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	key, ok := offenderKey(netip.AddrPortFrom(addr, 0).String())
+	if !ok {
+		return false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, ok := q.offenders[key]; !ok {
+		return false
+	}
+	delete(q.offenders, key)
+	return true
+}
+
+// malformedInput records a violation of the input limits by a client: it counts a strike
+// against its address, and when that puts the address in quarantine, emits an
+// AddressQuarantined event and ends the publisher session sess (nil if none) at once.
+// Violations are logged at most once a second per address.
+func (s *Server) malformedInput(protocol, remoteAddr string, violation *inputError, sess *session) {
+	until, quarantined, repeated := s.quarantine.strike(remoteAddr, protocol, violation)
+	if !repeated {
+		log.Printf("[%s] ⚠️  Malformed input from %s: %s (%s)", protocol, remoteAddr, violation.detail, violation.kind)
+	}
+	if !quarantined {
+		return
+	}
+
+	key, _ := offenderKey(remoteAddr)
+	log.Printf("[%s] ⚠️  Quarantined %s until %s after %d violations of the input limits",
+		protocol, offenderAddress(key), until.Format(time.RFC3339), s.quarantine.config.strikes)
+	event := events.Event{
+		Type:       events.AddressQuarantined,
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+		Detail: map[string]any{
+			"kind":              violation.kind,
+			"detail":            violation.detail,
+			"strikes":           s.quarantine.config.strikes,
+			"window_seconds":    s.quarantine.config.window.Seconds(),
+			"quarantined_until": until,
+		},
+	}
+	if sess != nil {
+		event.StreamPath = sess.streamPath
+		event.StreamName = sess.forwarder.StreamName()
+		event.CameraID = sess.route.CameraID
+		sess.endSession(failQuarantined)
+		sess.cancel() // closes the connection
+	}
+	events.Emit(event)
+}
+
+// Quarantine returns the addresses that sent malformed input within the quarantine
+// window or are quarantined, most recent first.
+func (s *Server) Quarantine() []Offender {
+	q := s.quarantine
+	now := time.Now()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	offenders := make([]Offender, 0, len(q.offenders))
+	for _, o := range q.offenders {
+		if now.After(o.QuarantinedUntil) && now.Sub(o.LastAt) > q.config.window {
+			continue
+		}
+		entry := o.Offender
+		if now.After(entry.QuarantinedUntil) {
+			entry.QuarantinedUntil = time.Time{}
+		}
+		offenders = append(offenders, entry)
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		return offenders[i].LastAt.After(offenders[j].LastAt)
+	})
+	return offenders
+}
+
+// ServeQuarantine serves the offending addresses as JSON (GET /quarantine), or lifts the
+// quarantine of one (DELETE /quarantine/{address}).
+func (s *Server) ServeQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		admin.WriteJSON(w, http.StatusOK, s.Quarantine())
+		return
+	}
+	address := r.PathValue("address")
+	if !s.quarantine.release(address) {
+		http.Error(w, "unknown address", http.StatusNotFound)
+		return
+	}
+	log.Printf("Quarantine of %s lifted", address)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// collect writes the violation and quarantine metrics.
+func (q *quarantine) collect(w *metrics.Writer) {
+	now := time.Now()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, kind := range []string{malformedChunkHeader, malformedChunkSize, malformedChunkStreams, malformedMessageSize,
+		malformedCommandSize, malformedNALUCount, malformedNALUSize, malformedPanic} {
+		w.Counter("rtmp_malformed_input_total", "Violations of the input limits by clients, by kind", float64(q.counts[kind]), "kind", kind)
+	}
+	quarantined := 0
+	for _, o := range q.offenders {
+		if now.Before(o.QuarantinedUntil) {
+			quarantined++
+		}
+	}
+	w.Gauge("rtmp_quarantined_addresses", "Addresses whose connections are refused for sending malformed input", float64(quarantined))
+	w.Counter("rtmp_quarantine_rejections_total", "Connections and UDP sessions refused from quarantined addresses", float64(q.rejected.Load()))
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOffenderKey(t *testing.T) {
+	tests := []struct {
+		remoteAddr  string
+		wantAddress string
+		wantOK      bool
+	}{
+		{"192.0.2.1:50000", "192.0.2.1", true},
+		{"[::ffff:192.0.2.1]:50000", "192.0.2.1", true},
+		{"[2001:db8:1:2:3:4:5:6]:50000", "2001:db8:1:2::/64", true},
+		{"[2001:db8:1:2::ffff]:1935", "2001:db8:1:2::/64", true},
+		{"/run/rtmp.sock", "", false},
+		{"192.0.2.1", "", false},
+	}
+	for _, tt := range tests {
+		key, ok := offenderKey(tt.remoteAddr)
+		if ok != tt.wantOK {
+			t.Errorf("offenderKey(%q) ok = %v, want %v", tt.remoteAddr, ok, tt.wantOK)
+			continue
+		}
+		if ok && offenderAddress(key) != tt.wantAddress {
+			t.Errorf("offenderKey(%q) = %s, want %s", tt.remoteAddr, offenderAddress(key), tt.wantAddress)
+		}
+	}
+}
+
+func TestQuarantineStrikes(t *testing.T) {
+	violation := &inputError{malformedMessageSize, "9437184 bytes type 9 message, limit 8388608"}
+	tests := []struct {
+		name    string
+		strikes int
+		addrs   []string // one strike each
+		want    []bool   // quarantined by the strike
+		refused []string
+		allowed []string
+	}{
+		{
+			name:    "quarantined on the last strike",
+			strikes: 3,
+			addrs:   []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"},
+			want:    []bool{false, false, true},
+			refused: []string{"192.0.2.1:4"},
+			allowed: []string{"192.0.2.2:1"},
+		},
+		{
+			name:    "strikes count per address",
+			strikes: 2,
+			addrs:   []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.3:1"},
+			want:    []bool{false, false, false},
+			allowed: []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.3:1"},
+		},
+		{
+			name:    "IPv6 addresses of a /64 share strikes",
+			strikes: 2,
+			addrs:   []string{"[2001:db8::1]:1", "[2001:db8::2]:1"},
+			want:    []bool{false, true},
+			refused: []string{"[2001:db8::3]:1"},
+			allowed: []string{"[2001:db8:0:1::1]:1"},
+		},
+		{
+			name:    "strikes while quarantined do not extend it",
+			strikes: 1,
+			addrs:   []string{"192.0.2.1:1", "192.0.2.1:2"},
+			want:    []bool{true, false},
+			refused: []string{"192.0.2.1:3"},
+		},
+		{
+			name:    "disabled",
+			strikes: 0,
+			addrs:   []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"},
+			want:    []bool{false, false, false},
+			allowed: []string{"192.0.2.1:4"},
+		},
+		{
+			name:    "unix socket clients are not tracked",
+			strikes: 1,
+			addrs:   []string{"/run/rtmp.sock"},
+			want:    []bool{false},
+			allowed: []string{"/run/rtmp.sock"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuarantine(quarantineConfig{strikes: tt.strikes, window: time.Minute, duration: time.Hour})
+			for i, addr := range tt.addrs {
+				until, quarantined, _ := q.strike(addr, "RTMP", violation)
+				if quarantined != tt.want[i] {
+					t.Errorf("strike %d from %s: quarantined = %v, want %v", i+1, addr, quarantined, tt.want[i])
+				}
+				if quarantined && time.Until(until) < 59*time.Minute {
+					t.Errorf("quarantined until %s, want an hour", until)
+				}
+			}
+			for _, addr := range tt.refused {
+				if !q.refuses(addr) {
+					t.Errorf("%s is not refused", addr)
+				}
+			}
+			for _, addr := range tt.allowed {
+				if q.refuses(addr) {
+					t.Errorf("%s is refused", addr)
+				}
+			}
+			if got := q.counts[malformedMessageSize]; got != uint64(len(tt.addrs)) {
+				t.Errorf("%d violations counted, want %d", got, len(tt.addrs))
+			}
+		})
+	}
+}
+
+func TestQuarantineRelease(t *testing.T) {
+	q := newQuarantine(quarantineConfig{strikes: 1, window: time.Minute, duration: time.Hour})
+	violation := &inputError{malformedChunkHeader, "extended chunk stream ID"}
+	q.strike("192.0.2.1:50000", "RTMP", violation)
+	q.strike("[2001:db8::1]:50000", "RTMP", violation)
+
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.1", false}, // already released
+		{"192.0.2.9", false},
+		{"2001:db8::42", true}, // any address of the /64
+		{"not-an-address", false},
+	}
+	for _, tt := range tests {
+		if got := q.release(tt.address); got != tt.want {
+			t.Errorf("release(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+	if q.refuses("192.0.2.1:50001") || q.refuses("[2001:db8::1]:50001") {
+		t.Error("released address is still refused")
+	}
+}
@@ -0,0 +1,231 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/events"
+)
+
+// Pause modes of SetForwardingPaused
+const (
+	PauseDiscard = "discard" // frames are discarded, e.g. in privacy mode
+	PauseBuffer  = "buffer"  // the latest frames are kept and forwarded on resume
+)
+
+// pauseBufferConfig bounds the frames a stream paused in buffer mode keeps.
+type pauseBufferConfig struct {
+	window   time.Duration
+	maxBytes int
+}
+
+// pauseBufferConfigFromEnv reads PAUSE_BUFFER_SECONDS (default 300) and
+// PAUSE_BUFFER_MAX_MB (default 64).
+func pauseBufferConfigFromEnv() pauseBufferConfig {
+	c := pauseBufferConfig{
+		window:   envSeconds("PAUSE_BUFFER_SECONDS", 300*time.Second, false),
+		maxBytes: 64 << 20,
+	}
+	if value := os.Getenv("PAUSE_BUFFER_MAX_MB"); value != "" {
+		mb, err := strconv.Atoi(value)
+		if err != nil || mb < 1 {
+			log.Printf("Warning: invalid PAUSE_BUFFER_MAX_MB %q, using 64", value)
+		} else {
+			c.maxBytes = mb << 20
+		}
+	}
+	return c
+}
+
+// SetForwardingPaused pauses or resumes KVS forwarding of a publish path, or of all paths
+// when streamPath is empty, e.g. for a maintenance window or by a command from the cloud.
+// The camera stays connected: in PauseDiscard mode (the default) its frames are
+// discarded, in PauseBuffer mode the latest frames are kept and forwarded ahead of the
+// live frames on resume. Forwarding resumes at a keyframe. The pause also applies to
+// publishers that connect later, until it is resumed. Live playback, snapshots and the
+// secondary sinks keep receiving the stream. It returns the number of active publishers
+// affected.
+func (s *Server) SetForwardingPaused(streamPath string, paused bool, mode string) (int, error) {
+	switch mode {
+	case "":
+		mode = PauseDiscard
+	case PauseDiscard, PauseBuffer:
+	default:
+		return 0, fmt.Errorf("invalid pause mode %q, expected %s or %s", mode, PauseDiscard, PauseBuffer)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if streamPath == "" && !paused {
+		clear(s.held)
+	} else if paused {
+		s.held[streamPath] = mode
+	} else {
+		delete(s.held, streamPath)
+	}
+
+	n := 0
+	for path, ss := range s.publishers {
+		if streamPath == "" || path == streamPath {
+			ss.setHold(s.holdMode(path))
+			n++
+		}
+	}
+	return n, nil
+}
+
+// PausedPaths returns the pause mode of the paths paused by SetForwardingPaused, "" for
+// all paths.
+func (s *Server) PausedPaths() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return maps.Clone(s.held)
+}
+
+// ServePause pauses or resumes KVS forwarding of a path, all paths without path
+// (POST /forwarding/pause?path=/live/cam1[&mode=buffer], POST /forwarding/resume?path=...).
+func (s *Server) ServePause(w http.ResponseWriter, r *http.Request) {
+	paused := strings.HasSuffix(r.URL.Path, "/pause")
+	path := r.URL.Query().Get("path")
+	n, err := s.SetForwardingPaused(path, paused, r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]any{"path": path, "paused": paused, "publishers": n})
+}
+
+// ServePaused serves the paths paused by SetForwardingPaused and their mode as JSON
+// (GET /forwarding/paused, "" for all paths).
+func (s *Server) ServePaused(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, s.PausedPaths())
+}
+
+// holdMode returns the mode forwarding of a path is paused in by SetForwardingPaused,
+// or "". Must be called with the mutex held.
+func (s *Server) holdMode(streamPath string) string {
+	if mode, ok := s.held[streamPath]; ok {
+		return mode
+	}
+	return s.held[""]
+}
+
+// setHold sets the pause mode the forwarding goroutine applies.
+func (ss *session) setHold(mode string) {
+	ss.remoteHold.Store(&mode)
+}
+
+// holdMode returns the pause mode set by setHold.
+func (ss *session) holdMode() string {
+	if mode := ss.remoteHold.Load(); mode != nil {
+		return *mode
+	}
+	return ""
+}
+
+// applyHold stops or restarts the forwarder when the remote pause of the session
+// changed or its schedule opened or closed, and discards or buffers frame while paused.
+// It returns the frames to forward, or true if the frame must not be forwarded.
+// Forwarding resumes at a keyframe, or with the buffered frames, which start at one.
+// Used by the forwarding goroutine only.
+func (ss *session) applyHold(frame h264Frame) ([]h264Frame, bool) {
+	mode, reason := ss.hold(time.Now())
+	keyframe := h264.IsRandomAccess(frame.au)
+
+	if mode != "" {
+		if ss.held == "" {
+			log.Printf("[%s] KVS forwarding of %s paused %s (%s)", ss.protocol, ss.streamPath, holdCause(reason), mode)
+			ss.forwarder.Stop()
+			ss.heldAt = time.Now()
+			ss.emitGate(events.ForwardingPaused, map[string]any{"reason": reason, "mode": mode})
+		}
+		ss.held, ss.heldBy = mode, reason
+		if mode == PauseBuffer {
+			ss.heldDropped += uint64(ss.heldFrames.add(frame, keyframe, ss.server.pauseBuffer.window, ss.server.pauseBuffer.maxBytes))
+		} else {
+			ss.heldDropped += uint64(len(ss.heldFrames.take()) + 1)
+		}
+		ss.recordPause()
+		return nil, true
+	}
+	if ss.held == "" {
+		return []h264Frame{frame}, false
+	}
+
+	buffered := ss.heldFrames.take()
+	if !keyframe && len(buffered) == 0 {
+		ss.heldDropped++
+		ss.recordPause()
+		return nil, true
+	}
+	paused := time.Since(ss.heldAt)
+	cause := "by remote command"
+	if ss.heldBy == holdSchedule {
+		cause = "as its forwarding schedule opened"
+	}
+	log.Printf("[%s] KVS forwarding of %s resumed %s after %s with %d buffered frames",
+		ss.protocol, ss.streamPath, cause, paused.Truncate(time.Second), len(buffered))
+	// A stream paused by the motion gate resumes on motion
+	if ss.gate == nil || !ss.gate.paused {
+		if err := ss.startForwarder(); err != nil {
+			log.Printf("[%s] ⚠️  Failed to restart KVS forwarder: %v", ss.protocol, err)
+		}
+	}
+	ss.emitGate(events.ForwardingResumed, map[string]any{
+		"reason":          ss.heldBy,
+		"mode":            ss.held,
+		"paused_seconds":  paused.Seconds(),
+		"buffered_frames": len(buffered),
+	})
+	ss.held, ss.heldBy = "", ""
+	ss.recordPause()
+	return append(buffered, frame), false
+}
+
+// recordPause updates the forwarding_paused statistic after a remote or scheduled pause
+// or resume, or a transition of the motion gate.
+func (ss *session) recordPause() {
+	paused, gated := ss.held != "", uint64(0)
+	if ss.gate != nil {
+		paused = paused || ss.gate.paused
+		gated = ss.gate.gated
+	}
+	ss.stats.setGate(paused, gated, ss.held, ss.heldBy, ss.heldDropped)
+}
+
+// SetStreamKey replaces the stream key (RTMP_STREAM_PATH) RTMP publishers must use and
+// returns the previous one. An empty key accepts any path. Publishers already connected
+// with the old key stay connected; see Disconnect.
+func (s *Server) SetStreamKey(key string) string {
+	old := s.streamKey.Swap(&key)
+	if old == nil {
+		return ""
+	}
+	return *old
+}
+
+// Disconnect closes the connection of the publisher of a path. It reports whether the
+// path had a publisher.
+func (s *Server) Disconnect(streamPath string) bool {
+	s.mutex.Lock()
+	ss, exists := s.publishers[streamPath]
+	s.mutex.Unlock()
+	if !exists {
+		return false
+	}
+	log.Printf("[%s] Disconnecting publisher %s of %s", ss.protocol, ss.remoteAddr, streamPath)
+	ss.endSession(disconnectRemote)
+	ss.cancel()
+	return true
+}
@@ -0,0 +1,106 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/registry"
+)
+
+// Route is the result of routing a publish path.
+type Route struct {
+	Forwarder *kvs.Forwarder
+	CameraID  string            // empty when not known
+	Params    map[string]string // captured by the path template (PATH_TEMPLATES)
+
+	// Settings of the stream for this publisher (registry entry, tenant, STREAM_CONFIG_FILE),
+	// given to the forwarder once the publisher is accepted; nil keeps the forwarder's own.
+	// A publisher refused because the stream has one must not change them.
+	Settings *kvs.StreamConfig
+}
+
+// Config returns the effective kvssink settings the publisher is forwarded with.
+func (r *Route) Config() kvs.StreamConfig {
+	if r.Settings != nil {
+		return r.Settings.Effective()
+	}
+	return r.Forwarder.Config()
+}
+
+// Router resolves the KVS forwarder for a publish path. ctx is cancelled when the
+// publisher disconnects or the server shuts down.
+type Router interface {
+	Route(ctx context.Context, streamPath string) (*Route, error)
+}
+
+// staticRouter sends every publisher to the same forwarder.
+type staticRouter struct {
+	forwarder *kvs.Forwarder
+}
+
+func (r *staticRouter) Route(ctx context.Context, streamPath string) (*Route, error) {
+	return &Route{Forwarder: r.forwarder}, nil
+}
+
+// RegistryRouter resolves the publish key (last path element) through the stream registry
+// and returns a forwarder for the registered KVS stream.
+type RegistryRouter struct {
+	registry *registry.Registry
+	pool     *kvs.Pool
+}
+
+// NewRegistryRouter creates a router backed by the stream registry.
+func NewRegistryRouter(reg *registry.Registry, pool *kvs.Pool) *RegistryRouter {
+	return &RegistryRouter{registry: reg, pool: pool}
+}
+
+// Route implements Router.
+func (r *RegistryRouter) Route(ctx context.Context, streamPath string) (*Route, error) {
+	key := path.Base(streamPath)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	entry, err := r.registry.Lookup(ctx, key)
+	if errors.Is(err, registry.ErrNotFound) || errors.Is(err, registry.ErrDisabled) {
+		return nil, fmt.Errorf("unauthorized: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Registry] Stream key resolved: camera=%s stream=%s region=%s", entry.CameraID, entry.StreamName, entry.Region)
+
+	settings := r.pool.StreamConfig(entry.StreamName).Merge(kvs.StreamConfig{
+		RetentionHours:     entry.RetentionHours,
+		FragmentDurationMs: entry.FragmentDurationMs,
+		StorageSizeMB:      entry.StorageSizeMB,
+		MaxBitrateKbps:     entry.MaxBitrateKbps,
+		RoleARN:            entry.RoleARN,
+		ExternalID:         entry.ExternalID,
+		AccountID:          entry.AccountID,
+		KMSKeyID:           entry.KMSKeyID,
+		Sinks:              entry.Sinks,
+		RelayURL:           entry.RelayURL,
+		Shards:             entry.Shards,
+		ShardWindowSeconds: entry.ShardWindowSeconds,
+		ShardStrategy:      entry.ShardStrategy,
+		UnsupportedVideo:   entry.UnsupportedVideo,
+		Schedule:           entry.Schedule,
+		ScheduleTimezone:   entry.ScheduleTimezone,
+		ScheduleMode:       entry.ScheduleMode,
+		PipelineProfile:    entry.PipelineProfile,
+		QueueMaxBytes:      entry.QueueMaxBytes,
+		QueueMaxBuffers:    entry.QueueMaxBuffers,
+		QueueMaxTimeMs:     entry.QueueMaxTimeMs,
+		MaxLatencySeconds:  entry.MaxLatencySeconds,
+	})
+	forwarder := r.pool.Get(entry.StreamName, entry.Region)
+	return &Route{Forwarder: forwarder, CameraID: entry.CameraID, Settings: &settings}, nil
+}
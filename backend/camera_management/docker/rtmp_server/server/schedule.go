@@ -0,0 +1,76 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"cmp"
+	"log"
+	"time"
+
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/schedule"
+)
+
+// Why KVS forwarding of a session is held
+const (
+	holdRemote   = "remote"   // SetForwardingPaused
+	holdSchedule = "schedule" // outside the forwarding schedule of the stream
+)
+
+// ScheduleStats describes the forwarding schedule of a stream.
+type ScheduleStats struct {
+	Schedule   string    `json:"schedule"`
+	Timezone   string    `json:"timezone"`
+	Mode       string    `json:"mode"`   // discard or buffer outside the windows
+	Active     bool      `json:"active"` // within a window, forwarding
+	NextChange time.Time `json:"next_change,omitzero"`
+}
+
+// loadSchedule reads the forwarding schedule of the session's stream. A schedule that
+// does not parse is ignored with a warning: the stream is forwarded at all times rather
+// than not recorded.
+func (ss *session) loadSchedule() {
+	config := ss.forwarder.Config()
+	if config.Schedule == "" {
+		return
+	}
+	sched, err := schedule.Parse(config.Schedule, config.ScheduleTimezone)
+	if err != nil {
+		log.Printf("[%s] ⚠️  Ignoring the forwarding schedule of %s: %v", ss.protocol, ss.streamPath, err)
+		return
+	}
+	ss.schedule, ss.scheduleMode = sched, cmp.Or(config.ScheduleMode, kvs.ScheduleDiscard)
+	ss.stats.setSchedule(func() *ScheduleStats {
+		now := time.Now()
+		return &ScheduleStats{
+			Schedule:   sched.String(),
+			Timezone:   sched.Location().String(),
+			Mode:       ss.scheduleMode,
+			Active:     sched.Active(now),
+			NextChange: sched.Next(now),
+		}
+	})
+	if !sched.Active(time.Now()) {
+		log.Printf("[%s] %s is outside its forwarding schedule (%s, %s) until %s", ss.protocol, ss.streamPath,
+			sched, sched.Location(), sched.Next(time.Now()).Format(time.RFC3339))
+	}
+}
+
+// hold returns the mode forwarding is paused in, by a remote command or else by the
+// schedule, and why; "" when forwarding.
+func (ss *session) hold(now time.Time) (mode, reason string) {
+	if mode := ss.holdMode(); mode != "" {
+		return mode, holdRemote
+	}
+	if ss.schedule != nil && !ss.schedule.Active(now) {
+		return ss.scheduleMode, holdSchedule
+	}
+	return "", ""
+}
+
+// holdCause describes a hold reason in logs.
+func holdCause(reason string) string {
+	if reason == holdSchedule {
+		return "outside its forwarding schedule"
+	}
+	return "by remote command"
+}
@@ -0,0 +1,202 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/events"
+)
+
+// SEI payload types carrying camera user data
+const (
+	seiUserDataRegistered   = 4 // ITU-T T.35 country/provider code followed by the payload
+	seiUserDataUnregistered = 5 // 16-byte UUID followed by the payload
+)
+
+// seiConfig holds the settings of SEI user-data extraction.
+type seiConfig struct {
+	events   bool                // emit SEIReceived events
+	metadata bool                // attach the payloads to KVS fragments
+	interval time.Duration       // minimum interval per stream and key
+	keys     map[string]struct{} // UUIDs / T.35 keys to extract, nil extracts all
+}
+
+// seiConfigFromEnv reads SEI_EVENTS and SEI_METADATA (true enables), SEI_INTERVAL
+// (seconds, default 1) and SEI_KEYS (comma-separated UUIDs or T.35 keys, default all).
+// It returns nil when extraction is disabled.
+func seiConfigFromEnv() *seiConfig {
+	c := &seiConfig{
+		events:   os.Getenv("SEI_EVENTS") == "true",
+		metadata: os.Getenv("SEI_METADATA") == "true",
+		interval: envSeconds("SEI_INTERVAL", time.Second, true),
+	}
+	if !c.events && !c.metadata {
+		return nil
+	}
+	if keys := os.Getenv("SEI_KEYS"); keys != "" {
+		c.keys = make(map[string]struct{})
+		for _, key := range strings.Split(keys, ",") {
+			if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+				c.keys[key] = struct{}{}
+			}
+		}
+	}
+	log.Printf("SEI user-data extraction enabled (events %v, fragment metadata %v, interval %s)", c.events, c.metadata, c.interval)
+	return c
+}
+
+// seiMessage is a user-data SEI message.
+type seiMessage struct {
+	payloadType int
+	key         string // UUID, or "t35-<country>-<provider>" for registered user data
+	data        []byte
+}
+
+// parseSEI returns the user-data messages of an SEI NAL unit. Other payload types
+// (buffering period, picture timing, ...) are skipped.
+func parseSEI(nalu []byte) ([]seiMessage, error) {
+	if len(nalu) < 2 || h264.NALUType(nalu[0]&0x1F) != h264.NALUTypeSEI {
+		return nil, errors.New("not an SEI NAL unit")
+	}
+	buf := h264.EmulationPreventionRemove(nalu[1:])
+
+	var messages []seiMessage
+	for len(buf) > 0 && buf[0] != 0x80 { // rbsp_trailing_bits
+		payloadType, n := seiVarint(buf)
+		buf = buf[n:]
+		payloadSize, n := seiVarint(buf)
+		buf = buf[n:]
+		if n == 0 || payloadSize > len(buf) {
+			return messages, errors.New("truncated SEI message")
+		}
+		payload := buf[:payloadSize]
+		buf = buf[payloadSize:]
+
+		switch payloadType {
+		case seiUserDataUnregistered:
+			if len(payload) < 16 {
+				continue
+			}
+			u := payload[:16]
+			messages = append(messages, seiMessage{
+				payloadType: payloadType,
+				key:         fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]),
+				data:        payload[16:],
+			})
+		case seiUserDataRegistered:
+			country := payload
+			if len(country) > 0 && country[0] == 0xFF {
+				country = country[1:]
+			}
+			if len(country) < 3 {
+				continue
+			}
+			messages = append(messages, seiMessage{
+				payloadType: payloadType,
+				key:         fmt.Sprintf("t35-%02x-%x", country[0], country[1:3]),
+				data:        country[3:],
+			})
+		}
+	}
+	return messages, nil
+}
+
+// seiVarint reads an SEI payload type or size (a run of 0xFF bytes plus a last byte).
+// It returns the value and the number of bytes read, 0 if buf ends first.
+func seiVarint(buf []byte) (int, int) {
+	value := 0
+	for i, b := range buf {
+		value += int(b)
+		if b != 0xFF {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// seiText returns the payload as text if it is printable UTF-8, base64 otherwise.
+func seiText(data []byte) (text, encoding string) {
+	s := strings.TrimRight(string(data), "\x00")
+	if utf8.ValidString(s) && strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r) && !unicode.IsSpace(r)
+	}) < 0 {
+		return s, "utf-8"
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+// seiExtractor surfaces the SEI user data of one publisher, at most once per interval
+// for each key (cameras often repeat it in every frame).
+type seiExtractor struct {
+	config  *seiConfig
+	last    map[string]time.Duration // PTS of the last message surfaced, by key
+	skipped map[string]bool          // keys that could not be attached as fragment metadata
+}
+
+func newSEIExtractor(config *seiConfig) *seiExtractor {
+	return &seiExtractor{config: config, last: make(map[string]time.Duration), skipped: make(map[string]bool)}
+}
+
+// process extracts the user-data SEI messages of an access unit.
+func (x *seiExtractor) process(ss *session, pts time.Duration, au [][]byte) {
+	for _, nalu := range au {
+		if len(nalu) == 0 || h264.NALUType(nalu[0]&0x1F) != h264.NALUTypeSEI {
+			continue
+		}
+		messages, _ := parseSEI(nalu)
+		for _, m := range messages {
+			if x.config.keys != nil {
+				if _, ok := x.config.keys[m.key]; !ok {
+					continue
+				}
+			}
+			if last, seen := x.last[m.key]; seen && pts-last < x.config.interval && pts >= last {
+				continue
+			}
+			x.last[m.key] = pts
+			ss.server.seiMessages.Add(1)
+			x.surface(ss, pts, m)
+		}
+	}
+}
+
+// surface emits an SEIReceived event and/or attaches the payload to the next fragment.
+func (x *seiExtractor) surface(ss *session, pts time.Duration, m seiMessage) {
+	text, encoding := seiText(m.data)
+
+	if x.config.events {
+		events.Emit(events.Event{
+			Type:       events.SEIReceived,
+			StreamPath: ss.streamPath,
+			StreamName: ss.forwarder.StreamName(),
+			CameraID:   ss.route.CameraID,
+			RemoteAddr: ss.remoteAddr,
+			Protocol:   ss.protocol,
+			Detail: map[string]any{
+				"payload_type": m.payloadType,
+				"key":          m.key,
+				"data":         text,
+				"encoding":     encoding,
+				"pts_seconds":  pts.Seconds(),
+			},
+		})
+	}
+
+	if x.config.metadata && !x.skipped[m.key] {
+		if err := ss.forwarder.AddMetadata("SEI_"+m.key, text); err != nil {
+			// Oversized or unsupported metadata fails the same way every time, log it once
+			x.skipped[m.key] = true
+			log.Printf("[%s] ⚠️  SEI %s on %s not attached to fragments: %v", ss.protocol, m.key, ss.streamPath, err)
+		}
+	}
+}
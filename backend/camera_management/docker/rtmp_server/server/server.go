@@ -2,165 +2,583 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/bluenviron/gortmplib"
 	"github.com/bluenviron/gortmplib/pkg/codecs"
 
+	"rtmp_kvs/audit"
+	"rtmp_kvs/auth"
+	"rtmp_kvs/capture"
+	"rtmp_kvs/clip"
+	"rtmp_kvs/events"
 	"rtmp_kvs/kvs"
+	"rtmp_kvs/logging"
+	"rtmp_kvs/preview"
+	"rtmp_kvs/sink"
 )
 
+// h264Frame is an H.264 access unit with its RTMP timestamps.
+type h264Frame struct {
+	pts time.Duration
+	dts time.Duration
+	au  [][]byte
+}
+
 // Server represents an RTMP/RTMPS server.
 type Server struct {
-	forwarder *kvs.Forwarder
-	mutex     sync.Mutex
-	publishers map[string]*gortmplib.ServerConn
+	router     Router
+	mutex      sync.Mutex
+	publishers map[string]*session
+
+	// Reconnect grace period: the pipeline is kept warm after a publisher disconnects
+	gracePeriod time.Duration
+	stopTimers  map[string]*pendingStop
+
+	// Snapshot requests waiting for the next keyframe, by stream path
+	keyframeWaiters map[string][]chan [][]byte
+
+	// Ingest statistics of active publishers, by stream path
+	stats map[string]*streamStats
+	// How the last publisher of each stream path ended, for the camera sessions
+	ended map[string]*PublisherEnd
+	// Forwarders of the camera sessions (SetForwarders), nil if only the publishers' ones
+	forwarders interface{ Forwarders() []*kvs.Forwarder }
+
+	// RTMP read mode (local monitoring)
+	playback bool
+
+	// On-box HLS preview, nil when disabled
+	preview *preview.Server
+
+	// Accept publishers without H.264 and forward their audio
+	audioOnly bool
+	// Forward the AAC track of H.264 publishers with the video, and how it is kept in sync
+	forwardAudio bool
+	avSync       avSyncConfig
+
+	// Idle-stream watchdog: publishers without video for this long are disconnected
+	idleTimeout     time.Duration
+	idleDisconnects atomic.Uint64
+
+	// Publish authorization (webhook, ...)
+	authorizers []auth.Authorizer
+
+	// Timeouts and socket options for ingest connections
+	connConfig ConnConfig
+
+	// Motion-gated forwarding, nil when disabled
+	motion *motionConfig
+
+	// Networks connections are accepted from, nil accepts all
+	ipFilter *IPFilter
+
+	// SEI user-data extraction, nil when disabled
+	sei         *seiConfig
+	seiMessages atomic.Uint64
+
+	// Frame queue between the reader and the forwarder, and what to do when it fills up
+	queue queueConfig
+
+	// Timestamp jump and drift correction, nil when disabled (TIMESTAMP_CORRECTION)
+	timestamps *timestampConfig
+
+	// Settings of the secondary sinks (S3 archive, local files) of the streams
+	sinks sink.Config
+
+	// What happens when a publisher exceeds its ingest bitrate limit
+	bitrate            bitrateConfig
+	bitrateDisconnects atomic.Uint64
+	bitrateThrottled   atomic.Int64 // nanoseconds reads were delayed
+
+	// What refused RTMP publishers are told (PUBLISH_ERROR_STATUS)
+	status statusConfig
+
+	// p95 arrival jitter of a stream that is warned about, 0 for none
+	jitterThreshold time.Duration
+
+	// Bandwidth feedback sent to RTMP publishers whose frames back up (BANDWIDTH_FEEDBACK)
+	bandwidth         bandwidthConfig
+	bandwidthRequests atomic.Uint64
+
+	// Check and repair H.264 access units before forwarding (H264_VALIDATE)
+	validateH264 bool
+	h264Repairs  repairCounters
+
+	// Connections and connection failures by listener and source network
+	connCounters *connCounters
+
+	// Tenants of the RTMPS endpoint by TLS server name, nil when not multi-tenant
+	tenants *Tenants
+
+	// What happens when a second publisher connects to a path
+	takeover  takeoverConfig
+	takeovers atomic.Uint64
+
+	// Pause mode of publish paths whose KVS forwarding is paused by a remote command
+	// ("" pauses all), guarded by the mutex
+	held map[string]string
+	// Buffer kept by streams paused in buffer mode
+	pauseBuffer pauseBufferConfig
+
+	// Stream key RTMP publishers must use (RTMP_STREAM_PATH), empty accepts any path
+	streamKey atomic.Pointer[string]
+
+	// Allowed application names and path templates (RTMP_APPS / PATH_TEMPLATES), nil
+	// accepts any path
+	paths *PathTemplates
+
+	// Recording of RTMP sessions for replay (SESSION_CAPTURE), nil when disabled
+	capture *capture.Recorder
+
+	// Connection audit log (AUDIT_LOG_GROUP / AUDIT_FIREHOSE_STREAM), nil when disabled
+	audit *audit.Logger
+
+	// Panics recovered while serving connections
+	panics *panicLog
+
+	// Limits of the RTMP chunk stream and H.264 access units, and the addresses
+	// quarantined for exceeding them too often
+	inputLimits inputLimits
+	quarantine  *quarantine
+
+	// Buffer of recent frames per stream for clip export (CLIP_BUCKET), zero when disabled
+	clipBuffer clip.BufferConfig
+
+	// Cancelled by Drain: listeners stop accepting, connections carry on
+	drainCtx context.Context
+	drain    context.CancelFunc
+	draining atomic.Bool
 }
 
-// New creates a new RTMP server.
+// New creates a new RTMP server that forwards every publisher to the given forwarder.
 func New(forwarder *kvs.Forwarder) *Server {
-	return &Server{
-		forwarder:  forwarder,
-		publishers: make(map[string]*gortmplib.ServerConn),
+	drainCtx, drain := context.WithCancel(context.Background())
+	s := &Server{
+		router:      &staticRouter{forwarder: forwarder},
+		publishers:  make(map[string]*session),
+		gracePeriod: reconnectGracePeriod(),
+		stopTimers:  make(map[string]*pendingStop),
+		idleTimeout: idleStreamTimeout(),
+		connConfig:  DefaultConnConfig(),
+		motion:      motionConfigFromEnv(),
+		takeover:    takeoverConfigFromEnv(),
+		sei:         seiConfigFromEnv(),
+		timestamps:  timestampConfigFromEnv(),
+		panics:      newPanicLog(),
+		inputLimits: inputLimitsFromEnv(),
+		quarantine:  newQuarantine(quarantineConfigFromEnv()),
+		sinks:       sink.ConfigFromEnv(),
+		bitrate:     bitrateConfigFromEnv(),
+		status:      statusConfigFromEnv(),
+		bandwidth:   bandwidthConfigFromEnv(),
+
+		queue:           queueConfigFromEnv(),
+		validateH264:    h264ValidationEnabled(),
+		jitterThreshold: jitterConfigFromEnv(),
+		avSync:          avSyncConfigFromEnv(),
+		connCounters:    newConnCounters(),
+		keyframeWaiters: make(map[string][]chan [][]byte),
+		stats:           make(map[string]*streamStats),
+		held:            make(map[string]string),
+		pauseBuffer:     pauseBufferConfigFromEnv(),
+		drainCtx:        drainCtx,
+		drain:           drain,
 	}
+	s.SetStreamKey(os.Getenv("RTMP_STREAM_PATH"))
+	return s
+}
+
+// SetRouter replaces the router used to select the forwarder for each publisher.
+func (s *Server) SetRouter(router Router) {
+	s.router = router
 }
 
-// Serve starts accepting connections on the given listener.
-func (s *Server) Serve(ln net.Listener, isTLS bool) {
+// SetCapture records the bytes RTMP clients send, and keeps the sessions the recorder
+// selects for replay.
+func (s *Server) SetCapture(c *capture.Recorder) {
+	s.capture = c
+}
+
+// reconnectGracePeriod reads RECONNECT_GRACE_PERIOD (seconds, default 10).
+func reconnectGracePeriod() time.Duration {
+	value := os.Getenv("RECONNECT_GRACE_PERIOD")
+	if value == "" {
+		return 10 * time.Second
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		log.Printf("Warning: invalid RECONNECT_GRACE_PERIOD %q, using 10 seconds", value)
+		return 10 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// pendingStop is a grace-period stop scheduled for a disconnected publisher's forwarder.
+type pendingStop struct {
+	timer     *time.Timer
+	forwarder *kvs.Forwarder
+	starts    uint64 // starts of the forwarder when scheduled
+}
+
+// scheduleStop stops the forwarder after the grace period unless the path re-publishes.
+// Must be called with the mutex held.
+func (s *Server) scheduleStop(streamPath string, forwarder *kvs.Forwarder) {
+	if pending, exists := s.stopTimers[streamPath]; exists {
+		pending.timer.Stop()
+	}
+
+	log.Printf("Keeping pipeline for %s warm for %s", streamPath, s.gracePeriod)
+
+	pending := &pendingStop{forwarder: forwarder, starts: forwarder.Starts()}
+	pending.timer = time.AfterFunc(s.gracePeriod, func() {
+		s.mutex.Lock()
+		// Superseded by a newer timer or cancelled by a reconnect
+		if s.stopTimers[streamPath] != pending {
+			s.mutex.Unlock()
+			return
+		}
+		delete(s.stopTimers, streamPath)
+		s.mutex.Unlock()
+
+		log.Printf("Grace period for %s expired, stopping forwarder", streamPath)
+		// The flush takes up to PIPELINE_STOP_TIMEOUT, so the mutex is not held; a
+		// re-publish starting the forwarder meanwhile keeps its pipeline
+		forwarder.StopUnlessStarted(pending.starts)
+	})
+	s.stopTimers[streamPath] = pending
+}
+
+// cancelStop cancels a pending grace-period stop for the path.
+// Must be called with the mutex held. Returns true if the warm pipeline of forwarder was
+// reclaimed; a warm pipeline of a different forwarder (the route changed) is stopped.
+func (s *Server) cancelStop(streamPath string, forwarder *kvs.Forwarder) bool {
+	pending, exists := s.stopTimers[streamPath]
+	if !exists {
+		return false
+	}
+	pending.timer.Stop()
+	delete(s.stopTimers, streamPath)
+
+	if pending.forwarder != forwarder {
+		go pending.forwarder.StopUnlessStarted(pending.starts)
+		return false
+	}
+	return true
+}
+
+// Serve accepts connections on the given listener until ctx is cancelled, which closes
+// the listener and all of its connections, or the server drains, which only closes the
+// listener. It returns once the connections have finished, with an error if the
+// listener failed.
+func (s *Server) Serve(ctx context.Context, ln net.Listener, isTLS bool) error {
 	protocol := "RTMP"
 	if isTLS {
 		protocol = "RTMPS"
 	}
 
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	acceptCtx, cancel := s.acceptContext(ctx)
+	defer cancel()
+	stop := context.AfterFunc(acceptCtx, func() { ln.Close() })
+	defer stop()
+
+	var backoff time.Duration
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("[%s] Accept error: %v", protocol, err)
-			return
+			if acceptCtx.Err() != nil {
+				return nil
+			}
+			if backoff = acceptBackoff(backoff, err); backoff > 0 {
+				log.Printf("[%s] Accept error: %v; retrying in %s", protocol, err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return fmt.Errorf("%s listener failed: %w", protocol, err)
+		}
+		backoff = 0
+		if !s.admit(conn.RemoteAddr(), protocol) {
+			conn.Close()
+			continue
 		}
-		go s.handleConn(conn, isTLS)
+		s.countConnection(protocol, conn.RemoteAddr().String())
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			s.handleConn(ctx, conn, isTLS)
+		}()
+	}
+}
+
+// acceptBackoff returns how long to wait before accepting again after a temporary accept
+// error, such as running out of file descriptors, doubling prev up to a second. It
+// returns 0 for errors the listener cannot recover from.
+func acceptBackoff(prev time.Duration, err error) time.Duration {
+	if !errors.Is(err, syscall.EMFILE) && !errors.Is(err, syscall.ENFILE) &&
+		!errors.Is(err, syscall.ENOBUFS) && !errors.Is(err, syscall.ENOMEM) {
+		return 0
+	}
+	return min(max(2*prev, 5*time.Millisecond), time.Second)
+}
+
+// protocolName returns the log/event name of the listener protocol.
+func protocolName(isTLS bool) string {
+	if isTLS {
+		return "RTMPS"
 	}
+	return "RTMP"
 }
 
-func (s *Server) handleConn(conn net.Conn, isTLS bool) {
+func (s *Server) handleConn(ctx context.Context, conn net.Conn, isTLS bool) {
 	protocol := "RTMP"
 	if isTLS {
 		protocol = "RTMPS"
 	}
 
 	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 	remoteAddr := conn.RemoteAddr().String()
 	log.Printf("[%s] Connection opened from %s", protocol, remoteAddr)
 
-	err := s.handleConnInner(conn, isTLS)
+	var rec *capture.Recording
+	if s.capture != nil {
+		rec = s.capture.Start(remoteAddr, protocol)
+	}
+	connCtx, connAudit := s.startAudit(ctx, remoteAddr, protocol)
+	err := func() (err error) {
+		// Panics of the handshake and commands, the publisher handler recovers its own
+		defer func() {
+			if v := recover(); v != nil {
+				s.recoverPanic(panicConnection, v, protocol, remoteAddr, nil)
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		return s.handleConnInner(connCtx, conn, rec, isTLS)
+	}()
 	if err != nil {
 		log.Printf("[%s] Connection %s closed: %v", protocol, remoteAddr, err)
 	} else {
 		log.Printf("[%s] Connection %s closed", protocol, remoteAddr)
 	}
+	if rec != nil {
+		s.capture.Finish(rec, err, ctx.Err() != nil)
+	}
+	s.finishAudit(connAudit, err, ctx.Err() != nil)
 }
 
-func (s *Server) handleConnInner(conn net.Conn, isTLS bool) error {
-	// Set initial read deadline for handshake (30 seconds for mobile clients)
-	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+func (s *Server) handleConnInner(ctx context.Context, conn net.Conn, rec *capture.Recording, isTLS bool) error {
+	s.connConfig.tuneConn(conn)
+
+	// Set initial read deadline for the handshake and connect/publish commands
+	conn.SetReadDeadline(time.Now().Add(s.connConfig.HandshakeTimeout))
 
-	// Initialize RTMP server connection
+	// Initialize RTMP server connection. Reads go through the input limits, and the
+	// bitrate limit of the publisher once it is known.
+	lr := &limitedReader{r: s.newChunkGuard(ctx, rec.Reader(conn), protocolName(isTLS), conn.RemoteAddr().String())}
 	sc := &gortmplib.ServerConn{
-		RW: conn,
+		RW: struct {
+			io.Reader
+			io.Writer
+		}{lr, conn},
 	}
+	auditFrom(ctx).countBytes(sc)
 	if err := sc.Initialize(); err != nil {
+		if !errors.Is(err, errMalformedInput) {
+			s.countFailure(ctx, protocolName(isTLS), conn.RemoteAddr().String(), failHandshake)
+		}
 		return err
 	}
 
 	// Accept connection and determine publish/read mode
 	if err := sc.Accept(); err != nil {
+		if !errors.Is(err, errMalformedInput) {
+			s.countFailure(ctx, protocolName(isTLS), conn.RemoteAddr().String(), failHandshake)
+		}
+		return err
+	}
+
+	// Select the tenant by the TLS server name, or else by the prefix of the stream path
+	ctx, err := s.withTenant(ctx, conn)
+	if err != nil {
+		s.countFailure(ctx, protocolName(isTLS), conn.RemoteAddr().String(), failHandshake)
 		return err
 	}
+	ctx, sc.URL.Path = s.withPathTenant(ctx, sc.URL.Path)
 
 	// Get stream path
 	streamPath := sc.URL.Path
-	log.Printf("Stream path: %s, Publish: %v", streamPath, sc.Publish)
+	log.Printf("Stream path: %s, Publish: %v", auth.RedactStreamPath(streamPath), sc.Publish)
+	rec.SetStreamPath(auth.RedactStreamPath(streamPath))
+	auditFrom(ctx).update(func(r *audit.Record) {
+		r.TLS = auth.NewTLSInfo(conn)
+		r.Mode = "play"
+		if sc.Publish {
+			r.Mode = "publish"
+		}
+		r.StreamPath = auth.RedactStreamPath(streamPath)
+		if tenant := tenantFrom(ctx); tenant != nil {
+			r.Tenant = tenant.Name
+		}
+	})
 
 	// Validate stream path against expected value
-	expectedPath := os.Getenv("RTMP_STREAM_PATH")
+	expectedPath := *s.streamKey.Load()
 	if expectedPath != "" {
-		expectedFullPath := "/live/" + expectedPath
-		if streamPath != expectedFullPath {
-			log.Printf("Invalid stream path: expected %s, got %s", expectedFullPath, streamPath)
-			return errors.New("unauthorized: invalid stream path")
+		expectedFullPaths := s.StreamKeyPaths(expectedPath)
+		if !slices.Contains(expectedFullPaths, streamPath) {
+			log.Printf("Invalid stream path: expected %s, got %s", strings.Join(expectedFullPaths, " or "), streamPath)
+			return s.rejectPath(ctx, sc, conn, isTLS, streamPath, errors.New("invalid stream path"))
 		}
 		log.Printf("Stream path validated successfully")
 	}
 
+	// Match the path against the application names and templates
+	ctx, err = s.matchPath(ctx, streamPath)
+	if err != nil {
+		log.Printf("Invalid stream path %s: %v", auth.RedactStreamPath(streamPath), err)
+		return s.rejectPath(ctx, sc, conn, isTLS, streamPath, err)
+	}
+
 	if sc.Publish {
-		return s.handlePublisher(sc, conn, isTLS)
+		return s.handlePublisher(ctx, sc, conn, lr, isTLS)
 	}
 
-	// Read mode not supported - this server only receives streams
-	log.Printf("Read mode not supported, closing connection")
+	if s.playback {
+		return s.handleReader(ctx, sc, conn, isTLS)
+	}
+
+	// Read mode disabled - this server only receives streams
+	log.Printf("Read mode not enabled (-enable-playback), closing connection")
 	return nil
 }
 
-func (s *Server) handlePublisher(sc *gortmplib.ServerConn, conn net.Conn, isTLS bool) error {
-	protocol := "RTMP"
-	if isTLS {
-		protocol = "RTMPS"
+// rejectPath refuses a connection to a path that is not allowed, telling a publisher
+// with NetStream.Publish.BadName.
+func (s *Server) rejectPath(ctx context.Context, sc *gortmplib.ServerConn, conn net.Conn, isTLS bool, streamPath string, reason error) error {
+	protocol, remoteAddr := protocolName(isTLS), conn.RemoteAddr().String()
+	if sc.Publish {
+		s.rejectStatus(sc, protocol, remoteAddr, statusPublishBadName, "Stream path is not allowed", reason.Error())
+	}
+	return s.rejectPublisher(ctx, protocol, remoteAddr, streamPath, reason)
+}
+
+// rejectPublisher refuses a publisher of a path that is not allowed.
+func (s *Server) rejectPublisher(ctx context.Context, protocol, remoteAddr, streamPath string, reason error) error {
+	s.countFailure(ctx, protocol, remoteAddr, failAuth)
+	auditFrom(ctx).authorized(reason)
+	events.Emit(events.Event{
+		Type:       events.AuthRejected,
+		StreamPath: auth.RedactStreamPath(streamPath),
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+		Detail:     map[string]any{"reason": reason.Error()},
+	})
+	return fmt.Errorf("unauthorized: %w", reason)
+}
+
+func (s *Server) handlePublisher(ctx context.Context, sc *gortmplib.ServerConn, conn net.Conn, lr *limitedReader, isTLS bool) (err error) {
+	protocol := protocolName(isTLS)
+
+	// Get stream path for logging
+	streamPath := sc.URL.Path
+	remoteAddr := conn.RemoteAddr().String()
+	// The outcome is kept for the camera session of the path (GET /cameras)
+	var sess *session
+	defer func() { s.endPublisher(streamPath, remoteAddr, protocol, sess, err, ctx.Err() != nil) }()
+
+	// Authorize the publisher (JWT, webhook, ...); a token stream key is resolved to its stream
+	authReq := auth.NewPublishRequest(protocol, streamPath, sc.URL.Query(), conn, remoteAddr)
+	if m := pathMatchFrom(ctx); m != nil {
+		authReq.Params = maps.Clone(m.params)
+	}
+	if err := s.authorize(ctx, authReq); err != nil {
+		s.rejectStatus(sc, protocol, remoteAddr, statusConnectRejected, "Authentication failed", err.Error())
+		return err
+	}
+	// A token stream key was resolved to its stream: match the path of the stream
+	if authReq.StreamPath != streamPath {
+		if ctx, err = s.matchPath(ctx, authReq.StreamPath); err != nil {
+			log.Printf("[%s] Invalid stream path %s: %v", protocol, authReq.StreamPath, err)
+			return s.rejectPath(ctx, sc, conn, isTLS, authReq.StreamPath, err)
+		}
 	}
+	streamPath = tenantFrom(ctx).sessionPath(authReq.StreamPath)
 
-	// Set read deadline (30 seconds for mobile clients)
-	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	// Resolve the target forwarder for this path
+	route, err := s.route(ctx, streamPath, remoteAddr, protocol)
+	if err != nil {
+		s.rejectError(sc, protocol, remoteAddr, err)
+		return err
+	}
+	lr.limiter = s.newBitrateLimiter(route, streamPath, remoteAddr, protocol)
+	lr.tenant = s.newTenantLimiter(ctx, route, streamPath, remoteAddr, protocol)
 
-	// Initialize reader
+	// Set read deadline for track detection, which reads up to two seconds of media
+	conn.SetReadDeadline(time.Now().Add(s.connConfig.trackProbeTimeout()))
+
+	// Initialize reader; onMetaData is read from the data messages it skips
+	mc := &metadataConn{Conn: sc}
 	reader := &gortmplib.Reader{
-		Conn: sc,
+		Conn: mc,
 	}
 	if err := reader.Initialize(); err != nil {
 		log.Printf("[%s] Failed to initialize reader: %v", protocol, err)
+		if isTimeout(err) {
+			s.countFailure(ctx, protocol, remoteAddr, failReadTimeout)
+		}
 		return err
 	}
 
-	// Get stream path for logging
-	streamPath := sc.URL.Path
-	remoteAddr := conn.RemoteAddr().String()
+	// Video in codecs other than H.264 is ignored, refused or transcoded per stream
+	transcodeTrack, err := s.applyVideoPolicy(ctx, mc, route, reader.Tracks(), streamPath, remoteAddr, protocol)
+	if err != nil {
+		return err
+	}
 
 	// Register publisher
-	s.mutex.Lock()
-	if _, exists := s.publishers[streamPath]; exists {
-		s.mutex.Unlock()
-		log.Printf("[%s] Stream %s already has a publisher", protocol, streamPath)
-		return nil
+	sess, err = s.openSession(ctx, route, conn, streamPath, remoteAddr, protocol, authReq.Query[sessionTokenParam])
+	if err != nil {
+		s.rejectError(mc, protocol, remoteAddr, err)
+		return err
 	}
-	s.publishers[streamPath] = sc
-	s.mutex.Unlock()
-
-	// Track if forwarder was started
-	forwarderStarted := false
 
 	defer func() {
 		// Recover from panic (use 'rec' to avoid shadowing 'reader')
 		if rec := recover(); rec != nil {
-			log.Printf("[%s] Recovered from panic: %v", protocol, rec)
-		}
-		
-		log.Printf("[%s] Cleaning up publisher from %s", protocol, remoteAddr)
-		
-		s.mutex.Lock()
-		delete(s.publishers, streamPath)
-		s.mutex.Unlock()
-		
-		if forwarderStarted {
-			log.Printf("[%s] Stopping forwarder...", protocol)
-			s.forwarder.Stop()
+			s.recoverPanic(panicPublisher, rec, protocol, remoteAddr, sess)
+			err = fmt.Errorf("panic: %v", rec)
 		}
+		sess.close()
 	}()
 
-	log.Printf("[%s] Publisher connected from %s to path %s", protocol, remoteAddr, streamPath)
+	// Ask encoders that honor Set Peer Bandwidth to slow down instead of dropping frames.
+	// Transcoded frames are queued by the transcoder, which the feedback cannot pace.
+	if transcodeTrack == nil {
+		sess.feedback = sess.newBandwidthFeedback(mc, route.Config().MaxBitrateKbps)
+	}
+
+	// Metadata sent before the first frames was read with the tracks
+	if mc.metadata != nil {
+		sess.setMetadata(*mc.metadata)
+	}
+	mc.onMetadata = sess.setMetadata
 
 	// Log tracks
 	tracks := reader.Tracks()
@@ -171,73 +589,119 @@ func (s *Server) handlePublisher(sc *gortmplib.ServerConn, conn net.Conn, isTLS
 
 	// Set up H.264 callback for KVS forwarding using channel
 	h264Found := false
-	dataChan := make(chan [][]byte, 100) // Buffered channel for H.264 data
-	stopChan := make(chan struct{})
-	
+
+	// Audio-only publishers (e.g. intercoms) get their first audio track forwarded instead
+	audioTrack := s.audioOnlyTrack(tracks)
+	if transcodeTrack != nil {
+		audioTrack = nil
+	}
+
+	// The AAC track of an H.264 publisher is forwarded with the video (-forward-audio)
+	videoAudio := s.videoAudioTrack(tracks)
+	if videoAudio != nil {
+		kvsTrack, err := aacTrack(videoAudio.Codec.(*codecs.MPEG4Audio).Config)
+		if err != nil {
+			log.Printf("[%s] ⚠️  Not forwarding the audio of %s: %v", protocol, streamPath, err)
+			videoAudio = nil
+		} else {
+			sess.forwardVideoAudio(kvsTrack)
+		}
+	}
+
 	for _, track := range tracks {
+		if track == transcodeTrack {
+			log.Printf("[%s] H.265 track detected (transcoded to H.264)", protocol)
+			sess.trackDetected("H265", true)
+			if err := sess.startH264(nil, nil); err != nil {
+				return err
+			}
+			transcoder, err := sess.startHEVCTranscoder(track.Codec.(*codecs.H265))
+			if err != nil {
+				return err
+			}
+			defer transcoder.close()
+			h264Found = true
+			reader.OnDataH265(track, transcoder.write)
+			continue
+		}
+
 		switch codec := track.Codec.(type) {
 		case *codecs.H264:
-			log.Printf("[%s] H.264 track detected (SPS: %d bytes, PPS: %d bytes)", 
+			log.Printf("[%s] H.264 track detected (SPS: %d bytes, PPS: %d bytes)",
 				protocol, len(codec.SPS), len(codec.PPS))
-			
+			sess.trackDetected("H264", true)
+
 			// Start KVS forwarder
-			log.Printf("[%s] Starting KVS forwarder...", protocol)
-			if err := s.forwarder.Start(); err != nil {
-				log.Printf("[%s] Failed to start KVS forwarder: %v", protocol, err)
+			if err := sess.startH264(codec.SPS, codec.PPS); err != nil {
 				return err
 			}
-			forwarderStarted = true
 			h264Found = true
-			log.Printf("[%s] KVS forwarder started successfully", protocol)
-
-			// Start goroutine to process H.264 data from channel
-			go func() {
-				for {
-					select {
-					case au := <-dataChan:
-						s.forwarder.WriteH264(0, 0, au)
-					case <-stopChan:
-						return
-					}
-				}
-			}()
 
 			// Capture track in closure
 			currentTrack := track
-			
+
 			// Set up callback for H.264 data - just send to channel
 			log.Printf("[%s] Setting up H.264 data callback...", protocol)
-			reader.OnDataH264(currentTrack, func(pts time.Duration, dts time.Duration, au [][]byte) {
-				// Non-blocking send to channel
-				select {
-				case dataChan <- au:
-				default:
-					// Channel full, drop frame
-				}
-			})
+			reader.OnDataH264(currentTrack, sess.writeH264)
 			log.Printf("[%s] H.264 data callback set up", protocol)
 
 		case *codecs.MPEG4Audio:
+			if track == audioTrack {
+				log.Printf("[%s] AAC audio track detected (audio-only stream)", protocol)
+				sess.trackDetected("AAC", true)
+				kvsTrack, err := aacTrack(codec.Config)
+				if err != nil {
+					return err
+				}
+				if err := sess.startAudio(kvsTrack); err != nil {
+					return err
+				}
+				reader.OnDataMPEG4Audio(track, sess.writeAudio)
+				continue
+			}
+			if track == videoAudio {
+				log.Printf("[%s] AAC audio track detected (forwarded with the video)", protocol)
+				sess.trackDetected("AAC", true)
+				reader.OnDataMPEG4Audio(track, sess.writeVideoAudio)
+				continue
+			}
 			log.Printf("[%s] AAC audio track detected (not forwarded to KVS)", protocol)
+			sess.trackDetected("AAC", false)
 			// Set up dummy callback for AAC to prevent gortmplib internal issues
 			currentAudioTrack := track
 			reader.OnDataMPEG4Audio(currentAudioTrack, func(pts time.Duration, au []byte) {
 				// Discard audio data - not forwarding to KVS
 			})
 			log.Printf("[%s] AAC audio callback set up (data discarded)", protocol)
-		
+
+		case *codecs.G711:
+			forwarded := track == audioTrack
+			log.Printf("[%s] G.711 audio track detected (forwarded: %v)", protocol, forwarded)
+			sess.trackDetected(g711Codec(codec), forwarded)
+			if forwarded {
+				if err := sess.startAudio(kvs.AudioTrack{
+					Codec:        g711Codec(codec),
+					SampleRate:   codec.SampleRate,
+					ChannelCount: codec.ChannelCount,
+				}); err != nil {
+					return err
+				}
+				reader.OnDataG711(track, sess.writeAudio)
+			} else {
+				reader.OnDataG711(track, func(pts time.Duration, samples []byte) {})
+			}
+
 		default:
 			log.Printf("[%s] Unknown track type: %T", protocol, track.Codec)
+			sess.trackDetected(fmt.Sprintf("%T", track.Codec), false)
 		}
 	}
-	
-	// Ensure stopChan is closed when function exits
-	defer func() {
-		close(stopChan)
-	}()
 
-	if !h264Found {
+	if !h264Found && audioTrack == nil {
 		log.Printf("[%s] No H.264 track found, closing connection", protocol)
+		s.rejectStatus(mc, protocol, remoteAddr, statusPublishRejected, "Unsupported video codec",
+			fmt.Sprintf("no H.264 video or supported audio track, %s accepts H.264", streamPath))
+		s.countFailure(ctx, protocol, remoteAddr, failUnsupportedCodec)
 		return nil
 	}
 
@@ -246,28 +710,31 @@ func (s *Server) handlePublisher(sc *gortmplib.ServerConn, conn net.Conn, isTLS
 	// Read loop with error handling and panic recovery per iteration
 	frameCount := 0
 	for {
-		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-		
+		conn.SetReadDeadline(time.Now().Add(s.connConfig.ReadTimeout))
+
 		// Wrap Read() in a function with panic recovery
 		err := func() (readErr error) {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Printf("[%s] Panic in Read(): %v", protocol, r)
+					s.recoverPanic(panicRead, r, protocol, remoteAddr, sess)
 					readErr = fmt.Errorf("panic in Read: %v", r)
 				}
 			}()
 			return reader.Read()
 		}()
-		
+
 		if err != nil {
 			log.Printf("[%s] Read error from %s after %d frames: %v", protocol, remoteAddr, frameCount, err)
+			if isTimeout(err) {
+				s.countFailure(ctx, protocol, remoteAddr, failReadTimeout)
+			}
 			return err
 		}
 		frameCount++
-		
-		// Log progress every 100 frames
+
+		// Log progress every 100 frames (LOG_LEVEL=debug, or debug level of the stream)
 		if frameCount%100 == 0 {
-			log.Printf("[%s] Processed %d frames from %s", protocol, frameCount, remoteAddr)
+			logging.StreamDebugf(sess.forwarder.StreamName(), "[%s] Processed %d frames from %s", protocol, frameCount, remoteAddr)
 		}
 	}
 }
@@ -0,0 +1,509 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/audit"
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/events"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/preview"
+	"rtmp_kvs/registry"
+	"rtmp_kvs/schedule"
+	"rtmp_kvs/sink"
+)
+
+// session is an active publisher of a stream path. It is shared by all ingest protocols
+// (RTMP, MPEG-TS) and owns the frame queue between the reader and the forwarder.
+type session struct {
+	server     *Server
+	streamPath string
+	remoteAddr string
+	protocol   string
+	route      *Route
+	forwarder  *kvs.Forwarder
+	stats      *streamStats
+	conn       io.Closer // publisher connection, nil if it cannot be closed (UDP)
+	tenant     *Tenant   // nil unless multi-tenant
+
+	// Arrival time (UnixNano) of the last video frame, for the idle-stream watchdog
+	lastFrameAt atomic.Int64
+	// Arrival time (UnixNano) of the last video message, for VIDEO_TIMEOUT. Unlike
+	// lastFrameAt it ignores audio, and it stays 0 for audio-only sessions.
+	lastVideoAt atomic.Int64
+	// Arrival jitter of the video frames
+	jitter jitterTracker
+
+	// AAC track forwarded with the video and its A/V sync, nil if the audio is not forwarded
+	videoAudio *kvs.AudioTrack
+	avSync     *avSync
+
+	// Why the server ended the session (idle, replaced, ...), nil if the publisher did
+	endReason atomic.Pointer[string]
+
+	// Time (UnixNano) of the last FramesDropped event
+	lastDropEvent atomic.Int64
+
+	started   bool
+	startTime time.Time
+	dataChan  chan h264Frame
+	audioChan chan audioFrame // audio-only streams and the audio forwarded with the video
+
+	// Backpressure state, used by the reader goroutine only
+	overWatermark bool // the queue reached the high watermark and has not drained yet
+	awaitKeyframe bool // a reference frame was dropped, drop pictures until the next keyframe
+	// Bandwidth feedback to the RTMP publisher, nil if disabled or not RTMP
+	feedback *bandwidthFeedback
+
+	// Publisher context, cancelled when the session closes; cancelling it also closes conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Context of the listener. It bounds the forwarder's pipeline, which outlives the
+	// session during the reconnect grace period.
+	serveCtx context.Context
+
+	// Latest keyframe (SPS, PPS, IDR), guarded by the server mutex
+	lastKeyframe     [][]byte
+	lastKeyframeTime time.Time
+
+	// Playback (read mode): GOP cache and attached players
+	playbackMutex sync.Mutex
+	gop           []h264Frame
+	gopBytes      int
+	sps, pps      []byte
+	readers       map[*playbackReader]struct{}
+
+	// Motion gate of the forwarder, nil unless MOTION_GATE is enabled (video only)
+	gate *motionGate
+
+	// KVS forwarding paused by a remote command (SetForwardingPaused): the pause mode, ""
+	// when forwarding. held is the mode applied by the forwarding goroutine, which also
+	// owns the frames kept while paused and the count of discarded frames.
+	remoteHold  atomic.Pointer[string]
+	held        string
+	heldBy      string // holdRemote or holdSchedule
+	heldAt      time.Time
+	heldFrames  frameBuffer
+	heldDropped uint64
+
+	// Forwarding schedule of the stream, nil to forward at all times. Outside its windows
+	// forwarding is held in scheduleMode like by a remote command.
+	schedule     *schedule.Schedule
+	scheduleMode string
+
+	// SEI user-data extraction, nil unless SEI_EVENTS or SEI_METADATA is enabled
+	sei *seiExtractor
+
+	// Timestamp conditioners of the video and audio-only tracks, nil if
+	// TIMESTAMP_CORRECTION is false. Used by the reader goroutine only.
+	videoTimestamps *timestampConditioner
+	audioTimestamps *timestampConditioner
+
+	// Repairs malformed access units, nil if H264_VALIDATE is false
+	validator *h264Validator
+
+	// HLS preview window of the stream, nil unless HLS_PREVIEW is enabled
+	preview *preview.Muxer
+
+	// Secondary sinks of the stream, nil if it is only forwarded to KVS
+	sinks *sink.Tee
+
+	// Recent frames for clip export and lookback (H.264 only), nil unless clip buffering
+	// is enabled
+	clip *clipBuffer
+
+	// Session token presented by the publisher, lets the same device replace this session
+	token string
+	// Closed by close once the session is unregistered, before its forwarder is stopped,
+	// so that a publisher taking over the path does not wait for the pipeline to flush
+	done chan struct{}
+}
+
+// route resolves the forwarder for a publish path, emitting an AuthRejected event
+// when the registry refuses the key.
+func (s *Server) route(ctx context.Context, streamPath, remoteAddr, protocol string) (*Route, error) {
+	router := s.router
+	m := pathMatchFrom(ctx)
+	if tenant := tenantFrom(ctx); tenant != nil {
+		router = tenant
+	} else if m != nil && m.template != nil && m.template.stream != "" {
+		router = s.paths
+	}
+	route, err := router.Route(awsapi.WithStreamPath(ctx, streamPath), streamPath)
+	if err != nil {
+		log.Printf("[%s] Failed to route stream %s: %v", protocol, streamPath, err)
+		if errors.Is(err, registry.ErrNotFound) || errors.Is(err, registry.ErrDisabled) || errors.Is(err, errTenantRole) {
+			s.countFailure(ctx, protocol, remoteAddr, failAuth)
+			auditFrom(ctx).authorized(err)
+			events.Emit(events.Event{
+				Type:       events.AuthRejected,
+				StreamPath: streamPath,
+				RemoteAddr: remoteAddr,
+				Protocol:   protocol,
+				Detail:     map[string]any{"reason": err.Error()},
+			})
+		}
+		return nil, err
+	}
+	if m != nil && len(m.params) > 0 {
+		route.Params = m.params
+		if route.CameraID == "" {
+			route.CameraID = m.params["camera"]
+		}
+	}
+	return route, nil
+}
+
+// openSession registers a publisher for the path. Only one publisher per path is allowed;
+// the takeover policy and the session token decide whether a new publisher replaces the
+// current one or is rejected. ctx is the listener's context; conn is closed when the
+// session's context is cancelled (e.g. by the idle-stream watchdog) and may be nil.
+func (s *Server) openSession(ctx context.Context, route *Route, conn io.Closer, streamPath, remoteAddr, protocol, token string) (*session, error) {
+	ss := &session{
+		server:     s,
+		streamPath: streamPath,
+		remoteAddr: remoteAddr,
+		protocol:   protocol,
+		route:      route,
+		forwarder:  route.Forwarder,
+		conn:       conn,
+		tenant:     tenantFrom(ctx),
+		startTime:  time.Now(),
+		dataChan:   make(chan h264Frame, s.queue.capacity),
+		audioChan:  make(chan audioFrame, s.queue.capacity),
+		serveCtx:   ctx,
+		readers:    make(map[*playbackReader]struct{}),
+		token:      token,
+		done:       make(chan struct{}),
+	}
+	ss.stats = newStreamStats(StreamStats{
+		StreamPath: streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   route.CameraID,
+		Tenant:     tenantName(ss.tenant),
+		PathParams: route.Params,
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+	})
+	ss.stats.queue = func() (int, int) { return len(ss.dataChan), cap(ss.dataChan) }
+	ss.stats.latency = ss.forwarder.Latency
+	ss.stats.jitter = ss.jitter.stats
+	if s.timestamps != nil {
+		ss.videoTimestamps = newTimestampConditioner(s.timestamps)
+		ss.audioTimestamps = newTimestampConditioner(s.timestamps)
+	}
+	if s.clipBuffer.Window > 0 {
+		ss.clip = &clipBuffer{config: s.clipBuffer}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		current, exists := s.publishers[streamPath]
+		if !exists {
+			break
+		}
+		s.mutex.Unlock()
+		err := s.claimPath(ctx, current, token, remoteAddr, protocol)
+		s.mutex.Lock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ss.tenant != nil {
+		if err := s.checkTenantStreams(ss.tenant); err != nil {
+			log.Printf("[%s] Publisher %s rejected for %s: %v", protocol, remoteAddr, streamPath, err)
+			s.countFailure(ctx, protocol, remoteAddr, failTenantQuota)
+			return nil, err
+		}
+	}
+	if err := s.claimForwarder(ctx, ss.forwarder, streamPath, remoteAddr, protocol); err != nil {
+		return nil, err
+	}
+	if route.Settings != nil {
+		ss.forwarder.SetConfig(*route.Settings)
+	}
+	ss.ctx, ss.cancel = context.WithCancel(ctx)
+	if conn != nil {
+		context.AfterFunc(ss.ctx, func() { conn.Close() })
+	}
+	s.publishers[streamPath] = ss
+	s.stats[streamPath] = ss.stats
+	ss.setHold(s.holdMode(streamPath))
+	if s.cancelStop(streamPath, ss.forwarder) {
+		log.Printf("[%s] Publisher reconnected to %s within grace period, reusing warm pipeline", protocol, streamPath)
+	}
+
+	auditFrom(ctx).update(func(r *audit.Record) {
+		r.Auth = audit.AuthAccepted
+		r.StreamName = ss.forwarder.StreamName()
+		r.CameraID = route.CameraID
+		r.SessionID = ss.stats.snapshot().SessionID
+	})
+
+	log.Printf("[%s] Publisher connected from %s to path %s", protocol, remoteAddr, streamPath)
+	var detail map[string]any
+	if len(route.Params) > 0 {
+		detail = map[string]any{"path_params": route.Params}
+	}
+	events.Emit(events.Event{
+		Type:       events.PublisherConnected,
+		StreamPath: streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   route.CameraID,
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+		Detail:     detail,
+	})
+	return ss, nil
+}
+
+// startH264 starts the forwarder and the goroutine feeding it. sps and pps may be nil
+// when the parameter sets are only sent in-band.
+func (ss *session) startH264(sps, pps []byte) error {
+	ss.loadSchedule()
+	if ss.held, ss.heldBy = ss.hold(time.Now()); ss.held != "" {
+		log.Printf("[%s] KVS forwarding of %s is paused %s (%s)", ss.protocol, ss.streamPath, holdCause(ss.heldBy), ss.held)
+		ss.heldAt = time.Now()
+		ss.forwarder.Stop()
+		ss.recordPause()
+	} else {
+		log.Printf("[%s] Starting KVS forwarder...", ss.protocol)
+		if err := ss.startForwarder(); err != nil {
+			log.Printf("[%s] Failed to start KVS forwarder: %v", ss.protocol, err)
+			return err
+		}
+	}
+	ss.lastVideoAt.Store(time.Now().UnixNano())
+	ss.forwarderStarted(nil)
+	if ss.server.motion != nil {
+		ss.gate = &motionGate{config: ss.server.motion}
+	}
+	if ss.server.sei != nil {
+		ss.sei = newSEIExtractor(ss.server.sei)
+	}
+	if ss.server.validateH264 {
+		ss.validator = newH264Validator(ss, sps, pps)
+	}
+	if ss.server.preview != nil {
+		ss.preview = ss.server.preview.Open(ss.streamPath)
+	}
+	config := ss.forwarder.Config()
+	stream := sink.Stream{Name: ss.forwarder.StreamName(), Region: ss.forwarder.Region(), RelayURL: config.RelayURL}
+	if sinks := ss.server.sinks.Secondary(config.Sinks, stream); len(sinks) > 0 {
+		ss.sinks = sink.NewTee(ss.forwarder.StreamName(), sinks...)
+		ss.sinks.Start(ss.ctx)
+	}
+
+	if ss.videoAudio != nil {
+		go ss.forwardAudio()
+	}
+
+	// Start goroutine to process H.264 data from channel
+	params := &paramTracker{sps: sps, pps: pps}
+	ss.stats.setSPS(sps)
+	go func() {
+		for {
+			select {
+			case frame := <-ss.dataChan:
+				if ss.validator != nil {
+					if frame.au = ss.validator.check(frame.au); frame.au == nil {
+						continue
+					}
+				}
+				params.update(frame.au)
+				ss.stats.setSPS(params.sps)
+				ss.stats.addFrame(frame.dts, frame.au)
+				if h264.IsRandomAccess(frame.au) {
+					ss.server.deliverKeyframe(ss, params, frame.au)
+				}
+				if ss.server.playback {
+					ss.publish(frame, params)
+				}
+				if ss.clip != nil {
+					ss.clip.add(frame, params)
+				}
+				if ss.preview != nil {
+					ss.preview.WriteH264(frame.pts, frame.dts, frame.au, params.sps, params.pps)
+				}
+				if ss.sei != nil {
+					ss.sei.process(ss, frame.pts, frame.au)
+				}
+				if ss.sinks != nil {
+					au := frame.au
+					if h264.IsRandomAccess(au) {
+						au = params.withParams(au)
+					}
+					ss.sinks.WriteAccessUnit(ss.ctx, frame.pts, frame.dts, au)
+				}
+				ss.forward(frame)
+			case <-ss.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// forwarderStarted marks the session as started, emits StreamStarted and starts the
+// idle-stream and video timeout watchdog. detail is added to the event.
+func (ss *session) forwarderStarted(detail map[string]any) {
+	ss.started = true
+	log.Printf("[%s] KVS forwarder started successfully", ss.protocol)
+
+	if detail == nil {
+		detail = make(map[string]any)
+	}
+	snapshot := ss.stats.snapshot()
+	detail["session_id"] = snapshot.SessionID
+	if snapshot.Metadata != nil {
+		detail["metadata"] = snapshot.Metadata
+		ss.attachMetadata(*snapshot.Metadata)
+	}
+
+	events.Emit(events.Event{
+		Type:       events.StreamStarted,
+		StreamPath: ss.streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   ss.route.CameraID,
+		RemoteAddr: ss.remoteAddr,
+		Protocol:   ss.protocol,
+		Detail:     detail,
+	})
+
+	ss.lastFrameAt.Store(time.Now().UnixNano())
+	videoTimeout := ss.server.connConfig.VideoTimeout
+	if ss.lastVideoAt.Load() == 0 {
+		videoTimeout = 0
+	}
+	if (ss.server.idleTimeout > 0 || videoTimeout > 0) && ss.conn != nil {
+		go ss.watchIdle(ss.server.idleTimeout, videoTimeout)
+	}
+}
+
+// writeH264 queues an access unit for the forwarder. Whether the reader is blocked when
+// the forwarder falls behind depends on FRAME_QUEUE_STRATEGY. Access units outside the
+// NAL unit limits are dropped and count against the publisher's address.
+func (ss *session) writeH264(pts, dts time.Duration, au [][]byte) {
+	if violation := ss.server.inputLimits.checkH264(au); violation != nil {
+		ss.server.malformedInput(ss.protocol, ss.remoteAddr, violation, ss)
+		return
+	}
+	now := time.Now()
+	ss.lastFrameAt.Store(now.UnixNano())
+	ss.lastVideoAt.Store(now.UnixNano())
+	ss.trackJitter(dts, now)
+	if ss.videoTimestamps != nil {
+		pts, dts = ss.conditionTimestamps(ss.videoTimestamps, "video", pts, dts, now)
+	}
+	if ss.avSync != nil {
+		ss.avSync.video(dts, now)
+	}
+	ss.enqueue(h264Frame{pts: pts, dts: dts, au: au})
+}
+
+// dropEventInterval limits FramesDropped events per session.
+const dropEventInterval = 5 * time.Second
+
+// reportDropped emits a FramesDropped event, at most once per dropEventInterval.
+func (ss *session) reportDropped(total uint64) {
+	now := time.Now().UnixNano()
+	last := ss.lastDropEvent.Load()
+	if now-last < int64(dropEventInterval) || !ss.lastDropEvent.CompareAndSwap(last, now) {
+		return
+	}
+	events.Emit(events.Event{
+		Type:       events.FramesDropped,
+		StreamPath: ss.streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   ss.route.CameraID,
+		RemoteAddr: ss.remoteAddr,
+		Protocol:   ss.protocol,
+		Detail:     map[string]any{"dropped_frames": total},
+	})
+}
+
+// trackDetected emits a TrackDetected event for a track of the publisher.
+func (ss *session) trackDetected(codec string, forwarded bool) {
+	events.Emit(events.Event{
+		Type:       events.TrackDetected,
+		StreamPath: ss.streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   ss.route.CameraID,
+		RemoteAddr: ss.remoteAddr,
+		Protocol:   ss.protocol,
+		Detail:     map[string]any{"codec": codec, "forwarded": forwarded},
+	})
+}
+
+// close unregisters the publisher and stops (or keeps warm) its forwarder.
+func (ss *session) close() {
+	s := ss.server
+	ss.cancel()
+	ss.closeReaders()
+	if ss.clip != nil {
+		ss.clip.close()
+	}
+	frames := ss.stats.snapshot().Frames
+	auditFrom(ss.ctx).update(func(r *audit.Record) { r.Frames = frames })
+	if ss.preview != nil {
+		ss.preview.Close()
+	}
+	if ss.sinks != nil {
+		ss.sinks.Stop()
+	}
+
+	log.Printf("[%s] Cleaning up publisher from %s", ss.protocol, ss.remoteAddr)
+
+	s.mutex.Lock()
+	delete(s.publishers, ss.streamPath)
+	delete(s.stats, ss.streamPath)
+	// No grace period when the server is shutting down
+	keepWarm := ss.started && s.gracePeriod > 0 && ss.serveCtx.Err() == nil
+	if keepWarm {
+		s.scheduleStop(ss.streamPath, ss.forwarder)
+	}
+	stop := ss.started && !keepWarm
+	var starts uint64
+	if stop {
+		starts = ss.forwarder.Starts()
+	}
+	s.mutex.Unlock()
+	close(ss.done)
+
+	if stop {
+		// A publisher that took over the path may have started the forwarder again since
+		log.Printf("[%s] Stopping forwarder...", ss.protocol)
+		ss.forwarder.StopUnlessStarted(starts)
+	}
+
+	if ss.started {
+		stats := ss.stats.snapshot()
+		events.Emit(events.Event{
+			Type:       events.StreamStopped,
+			StreamPath: ss.streamPath,
+			StreamName: ss.forwarder.StreamName(),
+			CameraID:   ss.route.CameraID,
+			RemoteAddr: ss.remoteAddr,
+			Protocol:   ss.protocol,
+			Detail: map[string]any{
+				"session_id":       stats.SessionID,
+				"duration_seconds": time.Since(ss.startTime).Seconds(),
+				"frames":           stats.Frames,
+				"bytes":            stats.Bytes,
+				"keep_warm":        keepWarm,
+			},
+		})
+	}
+}
@@ -0,0 +1,456 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/metrics"
+)
+
+// statsWindow is the interval over which bitrate and FPS are computed.
+const statsWindow = 2 * time.Second
+
+// StreamStats is a snapshot of a publisher's ingest statistics. The statistics belong to
+// the publisher's session: a reconnecting camera starts a new session with fresh counters,
+// while the KVS forwarder of the stream may be shared by consecutive sessions.
+type StreamStats struct {
+	SessionID        string    `json:"session_id"`
+	StreamPath       string    `json:"stream_path"`
+	StreamName       string    `json:"stream_name"`
+	CameraID         string    `json:"camera_id,omitempty"`
+	Tenant           string    `json:"tenant,omitempty"`
+	RemoteAddr       string    `json:"remote_addr"`
+	Protocol         string    `json:"protocol"`
+	StartedAt        time.Time `json:"started_at"`
+	UptimeSeconds    float64   `json:"uptime_seconds"`
+	LastFrameAt      time.Time `json:"last_frame_at,omitzero"`
+	Frames           uint64    `json:"frames"`
+	Bytes            uint64    `json:"bytes"`
+	Keyframes        uint64    `json:"keyframes"`
+	DroppedFrames    uint64    `json:"dropped_frames"`
+	BitrateKbps      float64   `json:"bitrate_kbps"`
+	FPS              float64   `json:"fps"`
+	KeyframeInterval float64   `json:"keyframe_interval_seconds"`
+	LastKeyframeAt   time.Time `json:"last_keyframe_at,omitzero"`
+	Width            int       `json:"width"`
+	Height           int       `json:"height"`
+	VideoCodec       string    `json:"video_codec,omitempty"` // codec details parsed from the SPS
+	Profile          string    `json:"profile,omitempty"`     // e.g. High
+	Level            string    `json:"level,omitempty"`       // e.g. 4.1
+	Readers          int       `json:"readers"`
+	AudioCodec       string    `json:"audio_codec,omitempty"`       // audio-only streams
+	ForwardingPaused bool      `json:"forwarding_paused,omitempty"` // motion gate, remote command or schedule
+	GatedFrames      uint64    `json:"gated_frames,omitempty"`      // frames not forwarded by the motion gate
+	PauseMode        string    `json:"pause_mode,omitempty"`        // discard or buffer, while paused by a remote command or the schedule
+	PauseReason      string    `json:"pause_reason,omitempty"`      // remote or schedule
+	PausedFrames     uint64    `json:"paused_frames,omitempty"`     // frames discarded while paused by a remote command or the schedule
+	QueueDepth       int       `json:"queue_depth"`                 // frames waiting for the forwarder
+	QueueCapacity    int       `json:"queue_capacity"`
+	QueueHighMarks   uint64    `json:"queue_high_watermarks"`     // times the queue reached the high watermark
+	Discontinuities  uint64    `json:"timestamp_discontinuities"` // timestamp jumps bridged and drift slews started
+	ClockDriftMs     int64     `json:"clock_drift_ms"`            // publisher clock ahead (+) or behind (-) real time
+
+	// Stream description sent by RTMP publishers (onMetaData)
+	Metadata *StreamMetadata `json:"metadata,omitempty"`
+
+	// Parameters captured by the path template (PATH_TEMPLATES)
+	PathParams map[string]string `json:"path_params,omitempty"`
+
+	// Ingest-to-persisted latency of the stream's KVS fragments
+	IngestLatency *kvs.LatencyStats `json:"ingest_latency,omitempty"`
+
+	// Arrival jitter of the video frames
+	Jitter *JitterStats `json:"jitter,omitempty"`
+
+	// Synchronization of the audio forwarded with the video (-forward-audio)
+	AVSync *AVSyncStats `json:"av_sync,omitempty"`
+
+	// Bandwidth the RTMP publisher was asked to stay under (BANDWIDTH_FEEDBACK), 0 if none
+	RequestedBandwidthKbps int `json:"requested_bandwidth_kbps,omitempty"`
+
+	// Forwarding schedule of the stream, nil if it is forwarded at all times
+	Schedule *ScheduleStats `json:"schedule,omitempty"`
+}
+
+// streamStats accumulates the statistics of one publisher.
+type streamStats struct {
+	mutex sync.Mutex
+	s     StreamStats
+
+	windowStart  time.Time
+	windowBytes  uint64
+	windowFrames uint64
+	lastKeyDTS   time.Duration
+	hasKeyframe  bool
+	lastSPS      []byte
+
+	// Depth and capacity of the frame queue, nil if unknown
+	queue func() (depth, capacity int)
+
+	// Ingest-to-persisted latency of the forwarder, nil if unknown
+	latency func() *kvs.LatencyStats
+
+	// Arrival jitter of the video frames, nil if unknown
+	jitter func() *JitterStats
+
+	// A/V sync of the audio forwarded with the video, nil if none
+	avSync func() *AVSyncStats
+
+	// Forwarding schedule, nil if none
+	schedule func() *ScheduleStats
+}
+
+func newStreamStats(s StreamStats) *streamStats {
+	s.SessionID = newSessionID()
+	s.StartedAt = time.Now()
+	return &streamStats{s: s, windowStart: s.StartedAt}
+}
+
+// newSessionID returns a random identifier of a publisher session.
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setSPS updates the resolution when the SPS changes.
+func (st *streamStats) setSPS(sps []byte) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if string(sps) == string(st.lastSPS) {
+		return
+	}
+	st.lastSPS = sps
+
+	var parsed h264.SPS
+	if err := parsed.Unmarshal(sps); err != nil {
+		return
+	}
+	st.s.Width = parsed.Width()
+	st.s.Height = parsed.Height()
+	st.s.VideoCodec = "H264"
+	st.s.Profile = profileName(parsed.ProfileIdc)
+	st.s.Level = fmt.Sprintf("%d.%d", parsed.LevelIdc/10, parsed.LevelIdc%10)
+}
+
+// profileName returns the name of an H.264 profile_idc.
+func profileName(idc uint8) string {
+	switch idc {
+	case 66:
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4"
+	default:
+		return fmt.Sprintf("profile %d", idc)
+	}
+}
+
+// addFrame records a received access unit.
+func (st *streamStats) addFrame(dts time.Duration, au [][]byte) {
+	size := 0
+	for _, nalu := range au {
+		size += len(nalu)
+	}
+	keyframe := h264.IsRandomAccess(au)
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.s.Frames++
+	st.s.Bytes += uint64(size)
+	st.s.LastFrameAt = time.Now()
+	st.windowFrames++
+	st.windowBytes += uint64(size)
+
+	if keyframe {
+		st.s.Keyframes++
+		st.s.LastKeyframeAt = time.Now()
+		if st.hasKeyframe && dts > st.lastKeyDTS {
+			st.s.KeyframeInterval = (dts - st.lastKeyDTS).Seconds()
+		}
+		st.lastKeyDTS = dts
+		st.hasKeyframe = true
+	}
+
+	if elapsed := time.Since(st.windowStart); elapsed >= statsWindow {
+		st.s.BitrateKbps = float64(st.windowBytes*8) / elapsed.Seconds() / 1000
+		st.s.FPS = float64(st.windowFrames) / elapsed.Seconds()
+		st.windowStart = time.Now()
+		st.windowBytes = 0
+		st.windowFrames = 0
+	}
+}
+
+// setAudioCodec marks the stream as audio-only.
+func (st *streamStats) setAudioCodec(codec string) {
+	st.mutex.Lock()
+	st.s.AudioCodec = codec
+	st.mutex.Unlock()
+}
+
+// addAudioFrame records a received frame of an audio-only stream.
+func (st *streamStats) addAudioFrame(size int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.s.Frames++
+	st.s.Bytes += uint64(size)
+	st.s.LastFrameAt = time.Now()
+	st.windowFrames++
+	st.windowBytes += uint64(size)
+
+	if elapsed := time.Since(st.windowStart); elapsed >= statsWindow {
+		st.s.BitrateKbps = float64(st.windowBytes*8) / elapsed.Seconds() / 1000
+		st.s.FPS = float64(st.windowFrames) / elapsed.Seconds()
+		st.windowStart = time.Now()
+		st.windowBytes = 0
+		st.windowFrames = 0
+	}
+}
+
+// setGate records the state of the motion gate and of the remote or scheduled pause.
+func (st *streamStats) setGate(paused bool, gated uint64, mode, reason string, discarded uint64) {
+	st.mutex.Lock()
+	st.s.ForwardingPaused = paused
+	st.s.GatedFrames = gated
+	st.s.PauseMode = mode
+	st.s.PauseReason = reason
+	st.s.PausedFrames = discarded
+	st.mutex.Unlock()
+}
+
+// setSchedule sets how the forwarding schedule of the stream is described.
+func (st *streamStats) setSchedule(schedule func() *ScheduleStats) {
+	st.mutex.Lock()
+	st.schedule = schedule
+	st.mutex.Unlock()
+}
+
+// addDropped records a frame dropped before reaching the forwarder and returns the total.
+func (st *streamStats) addDropped() uint64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.s.DroppedFrames++
+	return st.s.DroppedFrames
+}
+
+// addDiscontinuity records a corrected timestamp discontinuity.
+func (st *streamStats) addDiscontinuity() {
+	st.mutex.Lock()
+	st.s.Discontinuities++
+	st.mutex.Unlock()
+}
+
+// setClockDrift records the drift of the publisher's clock from real time.
+func (st *streamStats) setClockDrift(drift time.Duration) {
+	st.mutex.Lock()
+	st.s.ClockDriftMs = drift.Milliseconds()
+	st.mutex.Unlock()
+}
+
+// setRequestedBandwidth records the bandwidth the publisher was asked to stay under.
+func (st *streamStats) setRequestedBandwidth(kbps int) {
+	st.mutex.Lock()
+	st.s.RequestedBandwidthKbps = kbps
+	st.mutex.Unlock()
+}
+
+// addHighWatermark records that the frame queue reached the high watermark.
+func (st *streamStats) addHighWatermark() {
+	st.mutex.Lock()
+	st.s.QueueHighMarks++
+	st.mutex.Unlock()
+}
+
+// setMetadata records the onMetaData of the publisher.
+func (st *streamStats) setMetadata(m StreamMetadata) {
+	st.mutex.Lock()
+	st.s.Metadata = &m
+	st.mutex.Unlock()
+}
+
+// setReaders records the number of attached players.
+func (st *streamStats) setReaders(n int) {
+	st.mutex.Lock()
+	st.s.Readers = n
+	st.mutex.Unlock()
+}
+
+// snapshot returns a copy of the statistics.
+func (st *streamStats) snapshot() StreamStats {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	s := st.s
+	s.UptimeSeconds = time.Since(s.StartedAt).Seconds()
+	// A stalled publisher would otherwise keep reporting its last rates
+	if elapsed := time.Since(st.windowStart); elapsed >= 2*statsWindow {
+		s.BitrateKbps = float64(st.windowBytes*8) / elapsed.Seconds() / 1000
+		s.FPS = float64(st.windowFrames) / elapsed.Seconds()
+	}
+	if st.queue != nil {
+		s.QueueDepth, s.QueueCapacity = st.queue()
+	}
+	if st.latency != nil {
+		s.IngestLatency = st.latency()
+	}
+	if st.jitter != nil {
+		s.Jitter = st.jitter()
+	}
+	if st.avSync != nil {
+		s.AVSync = st.avSync()
+	}
+	if st.schedule != nil {
+		s.Schedule = st.schedule()
+	}
+	return s
+}
+
+// Stats returns the statistics of all active publishers, sorted by stream path.
+func (s *Server) Stats() []StreamStats {
+	s.mutex.Lock()
+	all := make([]StreamStats, 0, len(s.stats))
+	for _, st := range s.stats {
+		all = append(all, st.snapshot())
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].StreamPath < all[j].StreamPath })
+	return all
+}
+
+// SessionStats returns the statistics of the publisher of a stream path.
+func (s *Server) SessionStats(streamPath string) (StreamStats, bool) {
+	s.mutex.Lock()
+	st, ok := s.stats[streamPath]
+	s.mutex.Unlock()
+	if !ok {
+		return StreamStats{}, false
+	}
+	return st.snapshot(), true
+}
+
+// ServeStats serves the per-stream statistics as JSON (GET /stats).
+func (s *Server) ServeStats(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, s.Stats())
+}
+
+// ServeSessionStats serves the statistics of one publisher as JSON
+// (GET /stats/{path...}, e.g. /stats/live/cam1).
+func (s *Server) ServeSessionStats(w http.ResponseWriter, r *http.Request) {
+	stats, ok := s.SessionStats("/" + r.PathValue("path"))
+	if !ok {
+		http.Error(w, "no publisher on this path", http.StatusNotFound)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, stats)
+}
+
+// CollectMetrics writes the per-stream statistics as metrics.
+func (s *Server) CollectMetrics(w *metrics.Writer) {
+	stats := s.Stats()
+	w.Gauge("rtmp_publishers", "Number of active publishers", float64(len(stats)))
+	w.Counter("rtmp_idle_disconnects_total", "Publishers disconnected by the idle-stream watchdog", float64(s.idleDisconnects.Load()))
+	w.Counter("rtmp_publisher_takeovers_total", "Publishers replaced by a new publisher of the same path", float64(s.takeovers.Load()))
+	w.Counter("rtmp_bitrate_disconnects_total", "Publishers disconnected for exceeding their ingest bitrate limit", float64(s.bitrateDisconnects.Load()))
+	w.Counter("rtmp_bitrate_throttled_seconds_total", "Time reads of publishers over their ingest bitrate limit were delayed", time.Duration(s.bitrateThrottled.Load()).Seconds())
+	draining := 0.0
+	if s.draining.Load() {
+		draining = 1
+	}
+	w.Gauge("rtmp_draining", "1 while the listeners are handed off to a new process and connections drain", draining)
+	s.connCounters.collect(w)
+	if s.tenants != nil {
+		s.tenants.collectMetrics(w, stats)
+	}
+	s.h264Repairs.collect(w)
+	s.panics.collect(w)
+	s.quarantine.collect(w)
+	if s.bandwidth.enabled {
+		w.Counter("rtmp_bandwidth_feedback_total", "Set Peer Bandwidth limits sent to RTMP publishers", float64(s.bandwidthRequests.Load()))
+	}
+	if s.sei != nil {
+		w.Counter("rtmp_sei_messages_total", "SEI user-data messages surfaced as events or fragment metadata", float64(s.seiMessages.Load()))
+	}
+
+	for _, st := range stats {
+		labels := append([]string{"stream_path", st.StreamPath, "stream_name", st.StreamName}, s.tenants.streamLabels(st.Tenant)...)
+		w.Gauge("rtmp_stream_uptime_seconds", "Time since the publisher session started", st.UptimeSeconds, labels...)
+		if !st.LastFrameAt.IsZero() {
+			w.Gauge("rtmp_stream_last_frame_timestamp_seconds", "Time the last frame of the session was received",
+				float64(st.LastFrameAt.UnixMilli())/1000, labels...)
+		}
+		w.Counter("rtmp_stream_frames_total", "H.264 access units received", float64(st.Frames), labels...)
+		w.Counter("rtmp_stream_bytes_total", "H.264 bytes received", float64(st.Bytes), labels...)
+		w.Counter("rtmp_stream_keyframes_total", "Keyframes received", float64(st.Keyframes), labels...)
+		w.Counter("rtmp_stream_dropped_frames_total", "Frames dropped because the forwarder fell behind", float64(st.DroppedFrames), labels...)
+		w.Gauge("rtmp_stream_bitrate_kbps", "Ingest bitrate in kbit/s", st.BitrateKbps, labels...)
+		w.Gauge("rtmp_stream_fps", "Ingest frame rate", st.FPS, labels...)
+		w.Counter("rtmp_stream_timestamp_discontinuities_total", "Timestamp jumps bridged and clock drift slews started", float64(st.Discontinuities), labels...)
+		w.Gauge("rtmp_stream_clock_drift_seconds", "Drift of the publisher clock from real time", float64(st.ClockDriftMs)/1000, labels...)
+		w.Gauge("rtmp_stream_keyframe_interval_seconds", "Interval between the last two keyframes", st.KeyframeInterval, labels...)
+		w.Gauge("rtmp_stream_width", "Video width parsed from the SPS", float64(st.Width), labels...)
+		w.Gauge("rtmp_stream_height", "Video height parsed from the SPS", float64(st.Height), labels...)
+		w.Gauge("rtmp_stream_readers", "Players attached in read mode", float64(st.Readers), labels...)
+		w.Gauge("rtmp_stream_queue_depth", "Frames waiting in the queue between the reader and the forwarder", float64(st.QueueDepth), labels...)
+		w.Gauge("rtmp_stream_queue_capacity", "Capacity of the frame queue", float64(st.QueueCapacity), labels...)
+		w.Counter("rtmp_stream_queue_high_watermarks_total", "Times the frame queue reached the high watermark", float64(st.QueueHighMarks), labels...)
+		if j := st.Jitter; j != nil {
+			for _, q := range []struct {
+				quantile string
+				ms       float64
+			}{{"0.5", j.P50Ms}, {"0.95", j.P95Ms}, {"0.99", j.P99Ms}, {"1", j.MaxMs}} {
+				w.Gauge("rtmp_stream_jitter_seconds", "Arrival jitter of the last video frames", q.ms/1000, append(labels, "quantile", q.quantile)...)
+			}
+			w.Gauge("rtmp_stream_jitter_smoothed_seconds", "Interarrival jitter of the video frames as in RFC 3550", j.SmoothedMs/1000, labels...)
+			w.Counter("rtmp_stream_jitter_warnings_total", "Times the p95 arrival jitter exceeded JITTER_WARN_THRESHOLD", float64(j.Warnings), labels...)
+		}
+		if a := st.AVSync; a != nil {
+			w.Gauge("rtmp_stream_av_skew_seconds", "Audio ahead (+) or behind (-) the video since the start of the session", a.SkewMs/1000, labels...)
+			w.Gauge("rtmp_stream_av_sync_correction_seconds", "Shift of the audio timestamps by the A/V sync", a.CorrectionMs/1000, labels...)
+			w.Counter("rtmp_stream_av_sync_corrections_total", "Times the A/V skew exceeded AV_SYNC_MAX_SKEW", float64(a.Corrections), labels...)
+			w.Counter("rtmp_stream_av_sync_dropped_frames_total", "Audio frames dropped by the A/V sync", float64(a.DroppedFrames), labels...)
+			w.Counter("rtmp_stream_av_sync_gaps_total", "Audio frames moved a frame later by the A/V sync", float64(a.Gaps), labels...)
+		}
+		paused := 0.0
+		if st.ForwardingPaused {
+			paused = 1
+		}
+		w.Gauge("rtmp_stream_forwarding_paused", "Whether KVS forwarding is paused by the motion gate, a remote command or the schedule", paused, labels...)
+		if sc := st.Schedule; sc != nil {
+			active := 0.0
+			if sc.Active {
+				active = 1
+			}
+			w.Gauge("rtmp_stream_schedule_active", "Whether the stream is within a window of its forwarding schedule", active, labels...)
+		}
+		if s.motion != nil {
+			w.Counter("rtmp_stream_gated_frames_total", "Frames not forwarded to KVS because the scene was static", float64(st.GatedFrames), labels...)
+		}
+		if s.bandwidth.enabled {
+			w.Gauge("rtmp_stream_requested_bandwidth_kbps", "Bandwidth the RTMP publisher was asked to stay under (0 if not limited)", float64(st.RequestedBandwidthKbps), labels...)
+		}
+		w.Counter("rtmp_stream_paused_frames_total", "Frames not forwarded to KVS while paused by a remote command or the schedule", float64(st.PausedFrames), labels...)
+	}
+}
@@ -0,0 +1,108 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/bluenviron/gortmplib/pkg/amf0"
+	"github.com/bluenviron/gortmplib/pkg/message"
+
+	"rtmp_kvs/registry"
+)
+
+// RTMP status codes sent to publishers before they are disconnected
+const (
+	statusPublishRejected = "NetStream.Publish.Rejected"     // refused by policy (codec, quota)
+	statusPublishBadName  = "NetStream.Publish.BadName"      // path not allowed or already published
+	statusConnectRejected = "NetConnection.Connect.Rejected" // authentication failed
+)
+
+// What refused publishers are told (PUBLISH_ERROR_STATUS)
+const (
+	statusDetailed = "detailed" // the reason, e.g. "Authentication failed (token expired)"
+	statusGeneric  = "generic"  // only the kind of failure, e.g. "Authentication failed"
+	statusOff      = "off"      // nothing, the connection is closed
+)
+
+// statusConfig is what RTMP publishers are told when they are refused.
+type statusConfig struct {
+	mode string
+	hint string // appended to every description, e.g. who to contact
+}
+
+// statusConfigFromEnv reads PUBLISH_ERROR_STATUS ("detailed", the default, "generic" or
+// "off") and PUBLISH_ERROR_HINT.
+func statusConfigFromEnv() statusConfig {
+	c := statusConfig{mode: statusDetailed, hint: strings.TrimSpace(os.Getenv("PUBLISH_ERROR_HINT"))}
+	switch mode := os.Getenv("PUBLISH_ERROR_STATUS"); mode {
+	case "", statusDetailed:
+	case statusGeneric, statusOff:
+		c.mode = mode
+	default:
+		log.Printf("Warning: invalid PUBLISH_ERROR_STATUS %q, using %s", mode, statusDetailed)
+	}
+	return c
+}
+
+// rejectStatus tells an RTMP publisher why it is refused: generic is the kind of failure,
+// detail its reason, sent unless PUBLISH_ERROR_STATUS is generic.
+func (s *Server) rejectStatus(conn gortmplib.Conn, protocol, remoteAddr, code, generic, detail string) {
+	description := generic
+	switch s.status.mode {
+	case statusOff:
+		return
+	case statusDetailed:
+		if detail != "" {
+			description += " (" + detail + ")"
+		}
+	}
+	if s.status.hint != "" {
+		description += ". " + s.status.hint
+	}
+	sendStatus(conn, protocol, remoteAddr, code, description)
+}
+
+// rejectError tells an RTMP publisher why routing or registering it failed.
+func (s *Server) rejectError(conn gortmplib.Conn, protocol, remoteAddr string, err error) {
+	code, generic := statusPublishRejected, "Stream is temporarily unavailable"
+	switch {
+	case errors.Is(err, errDuplicatePublisher):
+		code, generic = statusPublishBadName, "Stream is already being published"
+	case errors.Is(err, errTenantQuota):
+		generic = "Stream quota reached"
+	case errors.Is(err, registry.ErrNotFound), errors.Is(err, registry.ErrDisabled), errors.Is(err, errTenantRole):
+		code, generic = statusConnectRejected, "Authentication failed"
+	}
+	s.rejectStatus(conn, protocol, remoteAddr, code, generic, err.Error())
+}
+
+// sendStatus sends an error onStatus, which encoders log or show to the user (OBS,
+// ffmpeg, most cameras) instead of only seeing the connection drop. NetConnection codes
+// are sent on the connection, NetStream codes on the publishing stream. Failures are
+// logged: the connection is closed afterwards in any case.
+func sendStatus(conn gortmplib.Conn, protocol, remoteAddr, code, description string) {
+	chunkStreamID, messageStreamID := byte(5), uint32(0x1000000)
+	if strings.HasPrefix(code, "NetConnection.") {
+		chunkStreamID, messageStreamID = 3, 0
+	}
+	err := conn.Write(&message.CommandAMF0{
+		ChunkStreamID:   chunkStreamID,
+		MessageStreamID: messageStreamID,
+		Name:            "onStatus",
+		Arguments: []any{
+			nil,
+			amf0.Object{
+				{Key: "level", Value: "error"},
+				{Key: "code", Value: code},
+				{Key: "description", Value: description},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("[%s] Failed to send %s to %s: %v", protocol, code, remoteAddr, err)
+	}
+}
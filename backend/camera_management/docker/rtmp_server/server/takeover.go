@@ -0,0 +1,218 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"rtmp_kvs/events"
+	"rtmp_kvs/kvs"
+)
+
+// sessionTokenParam is the publish URL query parameter carrying the session token
+// (rtmp://host/live/cam1?session=<token>).
+const sessionTokenParam = "session"
+
+// How long a new publisher waits for the session it replaces to shut down
+const takeoverWaitTimeout = 5 * time.Second
+
+// takeoverPolicy decides what happens when a publisher connects to a path that
+// already has one.
+type takeoverPolicy int
+
+const (
+	takeoverReject   takeoverPolicy = iota // keep the current publisher
+	takeoverKickOld                        // replace the current publisher
+	takeoverKickIdle                       // replace the current publisher if it sends no video
+)
+
+func (p takeoverPolicy) String() string {
+	switch p {
+	case takeoverKickOld:
+		return "kick-old"
+	case takeoverKickIdle:
+		return "kick-idle"
+	default:
+		return "reject"
+	}
+}
+
+// takeoverConfig holds the takeover policy and the session token settings.
+type takeoverConfig struct {
+	policy      takeoverPolicy
+	idleTimeout time.Duration // kick-idle: the current publisher is idle after this long without video
+	secret      []byte        // session tokens must be signed with this key, nil accepts any token
+}
+
+// takeoverConfigFromEnv reads TAKEOVER_POLICY (reject, kick-old or kick-idle, default
+// reject), TAKEOVER_IDLE_TIMEOUT (seconds, default 10) and SESSION_TOKEN_SECRET.
+func takeoverConfigFromEnv() takeoverConfig {
+	c := takeoverConfig{
+		idleTimeout: envSeconds("TAKEOVER_IDLE_TIMEOUT", 10*time.Second, false),
+	}
+	switch value := os.Getenv("TAKEOVER_POLICY"); value {
+	case "", "reject":
+	case "kick-old":
+		c.policy = takeoverKickOld
+	case "kick-idle":
+		c.policy = takeoverKickIdle
+	default:
+		log.Printf("Warning: invalid TAKEOVER_POLICY %q, using reject", value)
+	}
+	if secret := os.Getenv("SESSION_TOKEN_SECRET"); secret != "" {
+		c.secret = []byte(secret)
+	}
+	if c.policy != takeoverReject || c.secret != nil {
+		log.Printf("Publisher takeover policy: %s (signed session tokens: %v)", c.policy, c.secret != nil)
+	}
+	return c
+}
+
+// verifyToken checks a session token. Without a secret any non-empty token is accepted
+// as an opaque device identifier. With a secret the token must have the form
+// <id>.<expiry unix seconds>.<hex HMAC-SHA256 of "<id>.<expiry>">, as issued by the
+// camera management backend.
+func (c *takeoverConfig) verifyToken(token string, now time.Time) error {
+	if token == "" {
+		return errors.New("no session token")
+	}
+	if c.secret == nil {
+		return nil
+	}
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return errors.New("session token is not signed")
+	}
+	payload, signature := token[:i], token[i+1:]
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(payload))
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("invalid session token signature")
+	}
+	j := strings.LastIndexByte(payload, '.')
+	if j < 0 {
+		return errors.New("session token has no expiry")
+	}
+	expiry, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil {
+		return errors.New("invalid session token expiry")
+	}
+	if now.After(time.Unix(expiry, 0)) {
+		return errors.New("session token expired")
+	}
+	return nil
+}
+
+// preempts reports whether a new publisher presenting token may replace the current
+// publisher of the path, and why. A publisher presenting the same valid session token
+// is the same device reconnecting, so it replaces its predecessor under any policy.
+func (c *takeoverConfig) preempts(current *session, token string) (string, bool) {
+	if current.token != "" && token == current.token {
+		if err := c.verifyToken(token, time.Now()); err == nil {
+			return "same session token", true
+		}
+	}
+	switch c.policy {
+	case takeoverKickOld:
+		return "takeover policy kick-old", true
+	case takeoverKickIdle:
+		idle := time.Since(time.Unix(0, current.lastFrameAt.Load()))
+		if idle >= c.idleTimeout {
+			return fmt.Sprintf("no video for %s", idle.Truncate(time.Second)), true
+		}
+	}
+	return "", false
+}
+
+// errDuplicatePublisher refuses a publisher of a path, or of a KVS stream, that already
+// has one.
+var errDuplicatePublisher = errors.New("already has a publisher")
+
+// claimForwarder refuses a publisher routed to the forwarder of another path's publisher
+// (registry keys, path templates or tenants naming the same KVS stream): the frames of
+// both would interleave in one pipeline. Must be called with the mutex held.
+func (s *Server) claimForwarder(ctx context.Context, forwarder *kvs.Forwarder, streamPath, remoteAddr, protocol string) error {
+	for _, current := range s.publishers {
+		if current.forwarder != forwarder || current.streamPath == streamPath {
+			continue
+		}
+		log.Printf("[%s] KVS stream %s already has a publisher (%s from %s on %s), rejecting %s for %s",
+			protocol, forwarder.StreamName(), current.protocol, current.remoteAddr, current.streamPath, remoteAddr, streamPath)
+		s.countFailure(ctx, protocol, remoteAddr, failDuplicatePublisher)
+		events.Emit(events.Event{
+			Type:       events.AuthRejected,
+			StreamPath: streamPath,
+			StreamName: forwarder.StreamName(),
+			RemoteAddr: remoteAddr,
+			Protocol:   protocol,
+			Detail: map[string]any{
+				"reason":          "KVS stream already has a publisher",
+				"current_path":    current.streamPath,
+				"current_address": current.remoteAddr,
+			},
+		})
+		return fmt.Errorf("KVS stream %s %w (%s)", forwarder.StreamName(), errDuplicatePublisher, current.streamPath)
+	}
+	return nil
+}
+
+// claimPath makes room for a new publisher on a path that already has one: the current
+// publisher is disconnected if the takeover policy or the session token allow it, and the
+// call returns once its session has closed. It returns an error to reject the new one.
+func (s *Server) claimPath(ctx context.Context, current *session, token, remoteAddr, protocol string) error {
+	reason, ok := s.takeover.preempts(current, token)
+	if !ok {
+		log.Printf("[%s] Stream %s already has a publisher (%s from %s), rejecting %s",
+			protocol, current.streamPath, current.protocol, current.remoteAddr, remoteAddr)
+		s.countFailure(ctx, protocol, remoteAddr, failDuplicatePublisher)
+		events.Emit(events.Event{
+			Type:       events.AuthRejected,
+			StreamPath: current.streamPath,
+			RemoteAddr: remoteAddr,
+			Protocol:   protocol,
+			Detail: map[string]any{
+				"reason":          "stream already has a publisher",
+				"current_address": current.remoteAddr,
+			},
+		})
+		return fmt.Errorf("stream %s %w", current.streamPath, errDuplicatePublisher)
+	}
+
+	log.Printf("[%s] 🔄 Publisher from %s replaces %s on %s (%s)",
+		protocol, remoteAddr, current.remoteAddr, current.streamPath, reason)
+	events.Emit(events.Event{
+		Type:       events.PublisherReplaced,
+		StreamPath: current.streamPath,
+		StreamName: current.forwarder.StreamName(),
+		CameraID:   current.route.CameraID,
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+		Detail: map[string]any{
+			"reason":           reason,
+			"replaced_address": current.remoteAddr,
+			"replaced_seconds": time.Since(current.startTime).Seconds(),
+		},
+	})
+	s.takeovers.Add(1)
+	current.endSession(disconnectReplaced)
+	current.cancel()
+
+	select {
+	case <-current.done:
+		return nil
+	case <-time.After(takeoverWaitTimeout):
+		return fmt.Errorf("previous publisher of %s did not close within %s", current.streamPath, takeoverWaitTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
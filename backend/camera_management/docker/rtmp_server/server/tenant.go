@@ -0,0 +1,354 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"rtmp_kvs/auth"
+	"rtmp_kvs/kvs"
+)
+
+// Tenant is a customer or business unit sharing the ingest tier, selected by the TLS
+// server name (SNI) the camera connects with or by the prefix of its stream path.
+type Tenant struct {
+	Name string `json:"name"`
+
+	// KVS streams are named <stream_prefix><stream key>, in the tenant's account
+	// (region and IAM role)
+	StreamPrefix string `json:"stream_prefix,omitempty"`
+	Region       string `json:"region,omitempty"`
+	RoleARN      string `json:"role_arn,omitempty"`
+	ExternalID   string `json:"external_id,omitempty"`
+	AccountID    string `json:"account_id,omitempty"` // account the role must write to
+	KMSKeyID     string `json:"kms_key_id,omitempty"` // customer managed key of the tenant's streams
+
+	// Publish authorization, replacing the global authorizers for this tenant
+	StreamKeys        []string `json:"stream_keys,omitempty"`
+	PublishAuthURL    string   `json:"publish_auth_url,omitempty"`
+	PublishAuthSecret string   `json:"publish_auth_secret,omitempty"`
+
+	// Certificate presented for the tenant's server name, the shared one if empty
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// Quotas of all the tenant's publishers together (0 = unlimited): concurrent streams
+	// and aggregate ingest bitrate
+	MaxStreams              int `json:"max_streams,omitempty"`
+	MaxAggregateBitrateKbps int `json:"max_aggregate_bitrate_kbps,omitempty"`
+
+	// KVS accounts and IAM roles (path.Match patterns) the tenant's streams may be written
+	// with. When either is set, streams written with the task role or another role are
+	// refused, e.g. a role_arn of STREAM_CONFIG_FILE pointing to another tenant's account.
+	AllowedAccounts []string `json:"allowed_accounts,omitempty"`
+	AllowedRoleARNs []string `json:"allowed_role_arns,omitempty"`
+
+	// Labels added to the metrics of the tenant and its streams, e.g. the business unit
+	MetricLabels map[string]string `json:"metric_labels,omitempty"`
+
+	authorizers []auth.Authorizer
+	cert        *tls.Certificate
+	pool        *kvs.Pool
+	usage       *tenantUsage // shared by the entries of the same tenant name
+}
+
+// tenantFile is the layout of TENANT_CONFIG_FILE:
+//
+//	{
+//	  "allow_unknown_server_name": false,
+//	  "tenants": {
+//	    "tenant-a.rtmp.example.com": {
+//	      "name": "tenant-a",
+//	      "stream_prefix": "tenant-a-",
+//	      "role_arn": "arn:aws:iam::111122223333:role/kvs-tenant-a",
+//	      "external_id": "tenant-a",
+//	      "kms_key_id": "arn:aws:kms:ap-northeast-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+//	      "stream_keys": ["entrance-cam", "loading-dock-cam"],
+//	      "max_streams": 20,
+//	      "max_aggregate_bitrate_kbps": 40000,
+//	      "allowed_accounts": ["111122223333"],
+//	      "metric_labels": {"business_unit": "logistics"}
+//	    }
+//	  },
+//	  "path_prefixes": {
+//	    "/retail/": {"name": "retail", "stream_prefix": "retail-", "max_streams": 50}
+//	  }
+//	}
+type tenantFile struct {
+	AllowUnknownServerName bool               `json:"allow_unknown_server_name"`
+	Tenants                map[string]*Tenant `json:"tenants"`
+	PathPrefixes           map[string]*Tenant `json:"path_prefixes"`
+}
+
+// Tenants maps TLS server names and stream path prefixes to tenants.
+type Tenants struct {
+	byServerName map[string]*Tenant
+	byPrefix     []pathTenant // longest prefix first
+	allowUnknown bool         // RTMPS connections without a known server name use the global settings
+	usage        map[string]*tenantUsage
+}
+
+// pathTenant is a tenant selected by the prefix of the stream path.
+type pathTenant struct {
+	prefix string // with leading and trailing slash
+	tenant *Tenant
+}
+
+// LoadTenants reads the tenants of TENANT_CONFIG_FILE, keyed by server name or stream path
+// prefix. Forwarders of tenant streams come from pool; region is the default KVS region.
+func LoadTenants(file string, pool *kvs.Pool, region string) (*Tenants, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant config: %w", err)
+	}
+	var config tenantFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant config %s: %w", file, err)
+	}
+	if len(config.Tenants) == 0 && len(config.PathPrefixes) == 0 {
+		return nil, fmt.Errorf("tenant config %s has no tenants", file)
+	}
+
+	// Without server name tenants, RTMPS handshakes are not restricted
+	t := &Tenants{
+		byServerName: make(map[string]*Tenant),
+		allowUnknown: config.AllowUnknownServerName || len(config.Tenants) == 0,
+		usage:        make(map[string]*tenantUsage),
+	}
+	for serverName, tenant := range config.Tenants {
+		if err := t.add(tenant, pool, region, "server name "+serverName); err != nil {
+			return nil, err
+		}
+		t.byServerName[strings.ToLower(serverName)] = tenant
+	}
+	for prefix, tenant := range config.PathPrefixes {
+		clean := path.Clean("/" + prefix)
+		if clean == "/" {
+			return nil, fmt.Errorf("tenant path prefix %q is empty", prefix)
+		}
+		if err := t.add(tenant, pool, region, "path prefix "+clean+"/"); err != nil {
+			return nil, err
+		}
+		t.byPrefix = append(t.byPrefix, pathTenant{prefix: clean + "/", tenant: tenant})
+	}
+	sort.Slice(t.byPrefix, func(i, j int) bool { return len(t.byPrefix[i].prefix) > len(t.byPrefix[j].prefix) })
+	return t, nil
+}
+
+// add validates a tenant entry, selected by what (for messages), and prepares its
+// authorizers, certificate and quota state.
+func (t *Tenants) add(tenant *Tenant, pool *kvs.Pool, region, what string) error {
+	if tenant.Name == "" || strings.Contains(tenant.Name, "/") {
+		return fmt.Errorf("tenant of %s needs a name without '/'", what)
+	}
+	if tenant.Region == "" {
+		tenant.Region = region
+	}
+	if tenant.KMSKeyID != "" && !kvs.ValidKMSKeyID(tenant.KMSKeyID) {
+		return fmt.Errorf("tenant %s has an invalid kms_key_id %q", tenant.Name, tenant.KMSKeyID)
+	}
+	if err := (kvs.StreamConfig{RoleARN: tenant.RoleARN, AccountID: tenant.AccountID}).Validate(); err != nil {
+		return fmt.Errorf("tenant %s: %w", tenant.Name, err)
+	}
+	if tenant.MaxStreams < 0 || tenant.MaxAggregateBitrateKbps < 0 {
+		return fmt.Errorf("tenant %s has a negative quota", tenant.Name)
+	}
+	for _, pattern := range tenant.AllowedRoleARNs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("tenant %s has an invalid allowed_role_arns pattern %q", tenant.Name, pattern)
+		}
+	}
+	if tenant.RoleARN != "" && !tenant.allowsRole(tenant.RoleARN) {
+		return fmt.Errorf("tenant %s: role_arn %s is not in its allowed accounts or roles", tenant.Name, tenant.RoleARN)
+	}
+	for label := range tenant.MetricLabels {
+		if !validMetricLabel(label) {
+			return fmt.Errorf("tenant %s has an invalid metric label %q", tenant.Name, label)
+		}
+	}
+	if len(tenant.StreamKeys) > 0 {
+		tenant.authorizers = append(tenant.authorizers, auth.NewStreamKeys(tenant.StreamKeys))
+	}
+	if tenant.PublishAuthURL != "" {
+		tenant.authorizers = append(tenant.authorizers, auth.NewWebhook(tenant.PublishAuthURL, []byte(tenant.PublishAuthSecret), 5*time.Second))
+	}
+	if tenant.CertFile != "" || tenant.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tenant.CertFile, tenant.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate of tenant %s: %w", tenant.Name, err)
+		}
+		tenant.cert = &cert
+	}
+	tenant.pool = pool
+
+	// Entries of the same tenant share its quotas, so they must agree on them
+	if usage, ok := t.usage[tenant.Name]; ok {
+		if !usage.sameQuotas(tenant) {
+			return fmt.Errorf("tenant %s is defined with different quotas or metric labels", tenant.Name)
+		}
+		tenant.usage = usage
+		log.Printf("Tenant %s: %s", tenant.Name, what)
+		return nil
+	}
+	tenant.usage = newTenantUsage(tenant)
+	t.usage[tenant.Name] = tenant.usage
+	log.Printf("Tenant %s: %s, stream prefix %q, region %s, role %s, %d authorizers, max streams %d, max bitrate %d kbit/s",
+		tenant.Name, what, tenant.StreamPrefix, tenant.Region, tenant.RoleARN, len(tenant.authorizers),
+		tenant.MaxStreams, tenant.MaxAggregateBitrateKbps)
+	return nil
+}
+
+// lookup returns the tenant of a server name, or nil.
+func (t *Tenants) lookup(serverName string) *Tenant {
+	return t.byServerName[strings.ToLower(strings.TrimSuffix(serverName, "."))]
+}
+
+// TLSConfig returns base extended to select the tenant by SNI during the handshake: the
+// tenant's certificate is presented if it has one, and handshakes for unknown server
+// names are refused unless allow_unknown_server_name is set.
+func (t *Tenants) TLSConfig(base *tls.Config) *tls.Config {
+	config := base.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		tenant := t.lookup(hello.ServerName)
+		if tenant == nil {
+			if t.allowUnknown {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown server name %q", hello.ServerName)
+		}
+		if tenant.cert == nil {
+			return nil, nil
+		}
+		tenantConfig := base.Clone()
+		tenantConfig.GetCertificate = nil
+		tenantConfig.Certificates = []tls.Certificate{*tenant.cert}
+		return tenantConfig, nil
+	}
+	return config
+}
+
+// SetTenants enables SNI-based tenant routing for RTMPS connections.
+func (s *Server) SetTenants(t *Tenants) {
+	s.tenants = t
+}
+
+// tenantKey is the context key of the tenant of a connection.
+type tenantKey struct{}
+
+// withTenant returns ctx carrying the tenant of an RTMPS connection, selected by the
+// server name of its TLS handshake. The handshake has completed once the RTMP handshake
+// has been read.
+func (s *Server) withTenant(ctx context.Context, conn net.Conn) (context.Context, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if s.tenants == nil || !ok {
+		return ctx, nil
+	}
+	serverName := tlsConn.ConnectionState().ServerName
+	tenant := s.tenants.lookup(serverName)
+	if tenant == nil {
+		if s.tenants.allowUnknown {
+			return ctx, nil
+		}
+		// Refused during the TLS handshake already, unless the listener lacks GetConfigForClient
+		return ctx, fmt.Errorf("unknown server name %q", serverName)
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant), nil
+}
+
+// withPathTenant returns ctx carrying the tenant selected by the prefix of streamPath, and
+// the path without the prefix, when the connection has no tenant yet.
+func (s *Server) withPathTenant(ctx context.Context, streamPath string) (context.Context, string) {
+	if s.tenants == nil || tenantFrom(ctx) != nil {
+		return ctx, streamPath
+	}
+	for _, p := range s.tenants.byPrefix {
+		if rest, ok := strings.CutPrefix(streamPath, p.prefix); ok {
+			return context.WithValue(ctx, tenantKey{}, p.tenant), "/" + rest
+		}
+	}
+	return ctx, streamPath
+}
+
+// tenantName returns the name of a tenant, or "" for nil.
+func tenantName(t *Tenant) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// tenantFrom returns the tenant of a connection, or nil.
+func tenantFrom(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return tenant
+}
+
+// sessionPath returns the stream path a tenant's publisher is registered under, so
+// tenants cannot see or replace each other's streams. A nil tenant keeps the path.
+func (t *Tenant) sessionPath(streamPath string) string {
+	if t == nil {
+		return streamPath
+	}
+	return path.Join("/", t.Name, streamPath)
+}
+
+// Route implements Router for the tenant's streams: <stream_prefix><stream key> in the
+// tenant's region, written with the tenant's role. The stream registry is not consulted.
+// Streams whose role is outside the tenant's allowed accounts and roles are refused.
+func (t *Tenant) Route(ctx context.Context, streamPath string) (*Route, error) {
+	key := path.Base(streamPath)
+	if key == "" || key == "/" || key == "." {
+		return nil, errors.New("missing stream key")
+	}
+	streamName := t.StreamPrefix + key
+	config := t.pool.StreamConfig(streamName).Merge(kvs.StreamConfig{
+		RoleARN:    t.RoleARN,
+		ExternalID: t.ExternalID,
+		AccountID:  t.AccountID,
+		KMSKeyID:   t.KMSKeyID,
+	})
+	if !t.allowsRole(config.RoleARN) {
+		role := config.RoleARN
+		if role == "" {
+			role = "the task role"
+		}
+		return nil, fmt.Errorf("%w: stream %s of tenant %s would be written with %s", errTenantRole, streamName, t.Name, role)
+	}
+	forwarder := t.pool.Get(streamName, t.Region)
+	return &Route{Forwarder: forwarder, Settings: &config}, nil
+}
+
+// errTenantRole refuses a tenant's stream configured with a role the tenant may not use.
+var errTenantRole = errors.New("KVS account or role not allowed for the tenant")
+
+// allowsRole reports whether the tenant's streams may be written with roleARN ("" for the
+// task role).
+func (t *Tenant) allowsRole(roleARN string) bool {
+	if len(t.AllowedAccounts) == 0 && len(t.AllowedRoleARNs) == 0 {
+		return true
+	}
+	if roleARN == "" {
+		return false
+	}
+	// arn:partition:iam::account:role/name
+	if parts := strings.SplitN(roleARN, ":", 6); len(parts) == 6 && slices.Contains(t.AllowedAccounts, parts[4]) {
+		return true
+	}
+	for _, pattern := range t.AllowedRoleARNs {
+		if ok, _ := path.Match(pattern, roleARN); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+)
+
+// tenantUsage is the quota state of a tenant, shared by its publishers and by the
+// entries of the tenant (server names, path prefixes).
+type tenantUsage struct {
+	name         string
+	maxStreams   int
+	limitKbps    int
+	metricLabels map[string]string
+	labels       []string // metric labels: tenant, then metric_labels sorted by name
+
+	// Token bucket of the aggregate bitrate limit, filled on first use
+	mutex     sync.Mutex
+	rate      float64 // bytes per second
+	burst     float64 // bucket size in bytes
+	tokens    float64
+	last      time.Time
+	lastEvent time.Time
+
+	rejectedStreams atomic.Uint64
+	disconnects     atomic.Uint64
+	throttled       atomic.Int64 // nanoseconds
+}
+
+// newTenantUsage returns the quota state of a tenant.
+func newTenantUsage(tenant *Tenant) *tenantUsage {
+	u := &tenantUsage{
+		name:         tenant.Name,
+		maxStreams:   tenant.MaxStreams,
+		limitKbps:    tenant.MaxAggregateBitrateKbps,
+		metricLabels: tenant.MetricLabels,
+		labels:       []string{"tenant", tenant.Name},
+	}
+	for _, label := range slices.Sorted(maps.Keys(tenant.MetricLabels)) {
+		u.labels = append(u.labels, label, tenant.MetricLabels[label])
+	}
+	return u
+}
+
+// sameQuotas reports whether another entry of the tenant has the same quotas and labels.
+func (u *tenantUsage) sameQuotas(tenant *Tenant) bool {
+	return tenant.MaxStreams == u.maxStreams && tenant.MaxAggregateBitrateKbps == u.limitKbps &&
+		maps.Equal(tenant.MetricLabels, u.metricLabels)
+}
+
+// metricLabelPattern is the Prometheus label name syntax.
+var metricLabelPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validMetricLabel reports whether a tenant metric label is a valid label name that does
+// not collide with the labels of the stream metrics.
+func validMetricLabel(label string) bool {
+	switch label {
+	case "tenant", "stream_path", "stream_name":
+		return false
+	}
+	return metricLabelPattern.MatchString(label)
+}
+
+// errTenantQuota refuses a publisher over its tenant's stream quota.
+var errTenantQuota = errors.New("tenant stream quota exceeded")
+
+// checkTenantStreams refuses a new publisher of tenant when the tenant already has
+// max_streams publishers. It is called with the server mutex held.
+func (s *Server) checkTenantStreams(tenant *Tenant) error {
+	if tenant.MaxStreams == 0 {
+		return nil
+	}
+	count := 0
+	for _, ss := range s.publishers {
+		if ss.tenant != nil && ss.tenant.Name == tenant.Name {
+			count++
+		}
+	}
+	if count < tenant.MaxStreams {
+		return nil
+	}
+	tenant.usage.rejectedStreams.Add(1)
+	return fmt.Errorf("%w (%s has %d of %d streams)", errTenantQuota, tenant.Name, count, tenant.MaxStreams)
+}
+
+// take accounts for n bytes read by a publisher of the tenant and returns how long the
+// reader has to wait to stay under the aggregate limit. In disconnect mode the bytes are
+// not accounted when the bucket is empty, and exceeded is returned instead.
+func (u *tenantUsage) take(n int, burst time.Duration, disconnect bool) (delay time.Duration, exceeded bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := time.Now()
+	if u.rate == 0 {
+		u.rate = float64(u.limitKbps) * 1000 / 8
+		u.burst = u.rate * burst.Seconds()
+		u.tokens = u.burst
+		u.last = now
+	}
+	u.tokens = min(u.burst, u.tokens+now.Sub(u.last).Seconds()*u.rate) - float64(n)
+	u.last = now
+	if u.tokens >= 0 {
+		return 0, false
+	}
+	if disconnect {
+		u.tokens += float64(n)
+		return 0, true
+	}
+	return time.Duration(-u.tokens / u.rate * float64(time.Second)), false
+}
+
+// tenantLimiter applies the aggregate bitrate limit of a tenant to one of its publishers.
+// Reads of all the tenant's publishers draw from the same bucket, so together they stay
+// under max_aggregate_bitrate_kbps. It follows BITRATE_LIMIT_ACTION and BITRATE_BURST
+// like the per-stream limit.
+type tenantLimiter struct {
+	server     *Server
+	usage      *tenantUsage
+	disconnect bool
+
+	// Identifies the publisher in BitrateExceeded events
+	route      *Route
+	streamPath string
+	remoteAddr string
+	protocol   string
+}
+
+// newTenantLimiter returns the limiter of a publisher of the tenant of ctx, or nil if it
+// has no tenant or its tenant's bitrate is not limited.
+func (s *Server) newTenantLimiter(ctx context.Context, route *Route, streamPath, remoteAddr, protocol string) *tenantLimiter {
+	tenant := tenantFrom(ctx)
+	if tenant == nil || tenant.MaxAggregateBitrateKbps == 0 {
+		return nil
+	}
+	return &tenantLimiter{
+		server:     s,
+		usage:      tenant.usage,
+		disconnect: s.bitrate.disconnect || protocol == "MPEG-TS/UDP",
+		route:      route,
+		streamPath: streamPath,
+		remoteAddr: remoteAddr,
+		protocol:   protocol,
+	}
+}
+
+// take accounts for n bytes read, waiting while the tenant is over its limit, or returns
+// errBitrateExceeded in disconnect mode.
+func (l *tenantLimiter) take(n int) error {
+	u := l.usage
+	delay, exceeded := u.take(n, l.server.bitrate.burst, l.disconnect)
+	if exceeded {
+		u.disconnects.Add(1)
+		log.Printf("[%s] Tenant %s exceeded %d kbit/s, disconnecting publisher %s of %s",
+			l.protocol, u.name, u.limitKbps, l.remoteAddr, l.streamPath)
+		l.emit("disconnect")
+		return fmt.Errorf("%w (tenant %s, %d kbit/s)", errBitrateExceeded, u.name, u.limitKbps)
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	u.throttled.Add(int64(delay))
+	u.mutex.Lock()
+	report := time.Since(u.lastEvent) >= bitrateEventInterval
+	if report {
+		u.lastEvent = time.Now()
+	}
+	u.mutex.Unlock()
+	if report {
+		log.Printf("[%s] Tenant %s exceeds %d kbit/s, throttling reads of its publishers", l.protocol, u.name, u.limitKbps)
+		l.emit("throttle")
+	}
+	time.Sleep(delay)
+	return nil
+}
+
+// emit reports the tenant exceeding its limit as a BitrateExceeded event.
+func (l *tenantLimiter) emit(action string) {
+	events.Emit(events.Event{
+		Type:       events.BitrateExceeded,
+		StreamPath: l.streamPath,
+		StreamName: l.route.Forwarder.StreamName(),
+		CameraID:   l.route.CameraID,
+		RemoteAddr: l.remoteAddr,
+		Protocol:   l.protocol,
+		Detail: map[string]any{
+			"tenant":     l.usage.name,
+			"limit_kbps": l.usage.limitKbps,
+			"action":     action,
+		},
+	})
+}
+
+// streamLabels returns the metric labels a stream of tenant adds to the stream labels.
+func (t *Tenants) streamLabels(tenant string) []string {
+	if t == nil || tenant == "" {
+		return nil
+	}
+	if u := t.usage[tenant]; u != nil {
+		return u.labels
+	}
+	return nil
+}
+
+// collectMetrics writes the usage and quotas of each tenant.
+func (t *Tenants) collectMetrics(w *metrics.Writer, stats []StreamStats) {
+	streams := make(map[string]int)
+	bitrate := make(map[string]float64)
+	for _, st := range stats {
+		if st.Tenant != "" {
+			streams[st.Tenant]++
+			bitrate[st.Tenant] += st.BitrateKbps
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(t.usage)) {
+		u := t.usage[name]
+		w.Gauge("rtmp_tenant_streams", "Active publishers of the tenant", float64(streams[name]), u.labels...)
+		w.Gauge("rtmp_tenant_max_streams", "Stream quota of the tenant (0 = unlimited)", float64(u.maxStreams), u.labels...)
+		w.Gauge("rtmp_tenant_bitrate_kbps", "Aggregate ingest bitrate of the tenant's publishers in kbit/s", bitrate[name], u.labels...)
+		w.Gauge("rtmp_tenant_max_bitrate_kbps", "Aggregate bitrate limit of the tenant in kbit/s (0 = unlimited)", float64(u.limitKbps), u.labels...)
+		w.Counter("rtmp_tenant_rejected_streams_total", "Publishers refused because the tenant reached its stream quota", float64(u.rejectedStreams.Load()), u.labels...)
+		w.Counter("rtmp_tenant_bitrate_disconnects_total", "Publishers disconnected because the tenant exceeded its bitrate limit", float64(u.disconnects.Load()), u.labels...)
+		w.Counter("rtmp_tenant_bitrate_throttled_seconds_total", "Time reads of the tenant's publishers were delayed by its bitrate limit", time.Duration(u.throttled.Load()).Seconds(), u.labels...)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestValidMetricLabel(t *testing.T) {
+	tests := []struct {
+		label string
+		want  bool
+	}{
+		{"business_unit", true},
+		{"_team", true},
+		{"Region2", true},
+		{"2region", false},
+		{"cost-center", false},
+		{"", false},
+		{"tenant", false},
+		{"stream_path", false},
+		{"stream_name", false},
+	}
+	for _, tt := range tests {
+		if got := validMetricLabel(tt.label); got != tt.want {
+			t.Errorf("validMetricLabel(%q) = %v, want %v", tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestTenantUsageLabels(t *testing.T) {
+	u := newTenantUsage(&Tenant{
+		Name:         "acme",
+		MetricLabels: map[string]string{"unit": "retail", "cost_center": "cc-42"},
+	})
+	want := []string{"tenant", "acme", "cost_center", "cc-42", "unit", "retail"}
+	if !slices.Equal(u.labels, want) {
+		t.Errorf("labels = %v, want %v", u.labels, want)
+	}
+}
+
+func TestTenantUsageTake(t *testing.T) {
+	// 8000 kbit/s is 1,000,000 bytes per second
+	const rate = 1_000_000
+	tests := []struct {
+		name       string
+		disconnect bool
+		reads      []int
+		wantDelay  []time.Duration
+		exceeded   []bool
+	}{
+		{
+			name:      "within the burst",
+			reads:     []int{rate / 2, rate / 2},
+			wantDelay: []time.Duration{0, 0},
+			exceeded:  []bool{false, false},
+		},
+		{
+			name:      "throttled beyond the burst",
+			reads:     []int{rate / 2, rate / 2, rate / 5, rate / 10},
+			wantDelay: []time.Duration{0, 0, 200 * time.Millisecond, 300 * time.Millisecond},
+			exceeded:  []bool{false, false, false, false},
+		},
+		{
+			// Refused reads are not accounted
+			name:       "disconnect beyond the burst",
+			disconnect: true,
+			reads:      []int{rate * 3 / 4, rate / 2, rate / 5},
+			wantDelay:  []time.Duration{0, 0, 0},
+			exceeded:   []bool{false, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTenantUsage(&Tenant{Name: "acme", MaxAggregateBitrateKbps: 8000})
+			for i, n := range tt.reads {
+				delay, exceeded := u.take(n, time.Second, tt.disconnect)
+				if exceeded != tt.exceeded[i] {
+					t.Errorf("read %d: exceeded = %v, want %v", i+1, exceeded, tt.exceeded[i])
+				}
+				// The bucket refills while the test runs
+				if delay > tt.wantDelay[i] || delay < tt.wantDelay[i]-10*time.Millisecond {
+					t.Errorf("read %d: delay = %s, want %s", i+1, delay, tt.wantDelay[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckTenantStreams(t *testing.T) {
+	acme := &Tenant{Name: "acme", MaxStreams: 2}
+	acme.usage = newTenantUsage(acme)
+	other := &Tenant{Name: "other", MaxStreams: 1}
+	other.usage = newTenantUsage(other)
+	unlimited := &Tenant{Name: "unlimited"}
+	unlimited.usage = newTenantUsage(unlimited)
+
+	s := &Server{publishers: map[string]*session{
+		"live/a": {tenant: acme},
+		"live/b": {tenant: other},
+		"live/c": {tenant: unlimited},
+		"live/d": {},
+	}}
+	tests := []struct {
+		tenant *Tenant
+		add    string // publisher added before the check
+		want   bool   // refused
+	}{
+		{tenant: acme},
+		{tenant: other, want: true},
+		{tenant: unlimited, add: "live/e"},
+		{tenant: acme, add: "live/f", want: true},
+	}
+	for _, tt := range tests {
+		if tt.add != "" {
+			s.publishers[tt.add] = &session{tenant: tt.tenant}
+		}
+		err := s.checkTenantStreams(tt.tenant)
+		if refused := errors.Is(err, errTenantQuota); refused != tt.want || (err != nil && !refused) {
+			t.Errorf("checkTenantStreams(%s) with %d publishers = %v, want refused %v",
+				tt.tenant.Name, len(s.publishers), err, tt.want)
+		}
+	}
+	if got := acme.usage.rejectedStreams.Load(); got != 1 {
+		t.Errorf("acme rejected %d streams, want 1", got)
+	}
+	if got := other.usage.rejectedStreams.Load(); got != 1 {
+		t.Errorf("other rejected %d streams, want 1", got)
+	}
+}
@@ -0,0 +1,204 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"rtmp_kvs/events"
+)
+
+const (
+	// Frame interval assumed to bridge a discontinuity before any interval was observed
+	defaultFrameInterval = 33 * time.Millisecond
+	// Drift is measured from this long into the session, after the burst of buffered
+	// frames publishers send on connect
+	driftWarmup = 10 * time.Second
+	// Share of the drift corrected per frame, and the largest share of a frame interval the
+	// timeline is slewed by per frame (a 10% rate change)
+	driftSlewShare    = 100
+	driftSlewMaxShare = 10
+	// TimestampDiscontinuity events per session are limited to one per interval
+	timestampEventInterval = 5 * time.Second
+)
+
+// timestampConfig holds the settings of the timestamp conditioner (TIMESTAMP_CORRECTION).
+type timestampConfig struct {
+	jumpTolerance time.Duration // how far DTS may run ahead of the arrival clock between two frames
+	maxDrift      time.Duration // drift from the arrival clock that is slewed away, 0 to ignore drift
+}
+
+// timestampConfigFromEnv reads TIMESTAMP_CORRECTION (default true),
+// TIMESTAMP_JUMP_TOLERANCE (seconds, default 2) and TIMESTAMP_MAX_DRIFT (seconds,
+// default 2, 0 disables drift correction). It returns nil when correction is disabled.
+func timestampConfigFromEnv() *timestampConfig {
+	if value := os.Getenv("TIMESTAMP_CORRECTION"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Warning: invalid TIMESTAMP_CORRECTION %q, using true", value)
+		} else if !enabled {
+			return nil
+		}
+	}
+	return &timestampConfig{
+		jumpTolerance: envSeconds("TIMESTAMP_JUMP_TOLERANCE", 2*time.Second, false),
+		maxDrift:      envSeconds("TIMESTAMP_MAX_DRIFT", 2*time.Second, true),
+	}
+}
+
+// discontinuity is a timestamp error corrected by the conditioner.
+type discontinuity struct {
+	kind  string        // "backward", "forward" or "drift"
+	jump  time.Duration // DTS step of the publisher (backward / forward)
+	drift time.Duration // output timeline ahead (+) or behind (-) the arrival clock (drift)
+}
+
+// timestampConditioner keeps the timestamps of one track monotonic and close to real
+// time. Cheap cameras jump backwards (clock resets, encoder restarts), jump forward
+// (NTP corrections) and drift from real time; kvssink rejects such fragments and the
+// pipeline restarts. Jumps are bridged with the last frame interval; drift beyond
+// maxDrift is slewed away gradually. It is used by the reader goroutine only.
+type timestampConditioner struct {
+	config *timestampConfig
+
+	started  bool
+	offset   time.Duration // added to the publisher's timestamps
+	lastIn   time.Duration // last DTS of the publisher
+	lastOut  time.Duration // last DTS written
+	lastAt   time.Time     // arrival of the last frame
+	interval time.Duration // last frame interval
+
+	// Drift is measured against the arrival clock from a reference frame
+	startedAt time.Time
+	refOut    time.Duration
+	refAt     time.Time
+	anchored  bool // the reference was taken after the warmup
+	slewing   bool
+	drift     time.Duration
+
+	// Rate limiting of TimestampDiscontinuity events
+	lastEvent  time.Time
+	suppressed int
+}
+
+func newTimestampConditioner(config *timestampConfig) *timestampConditioner {
+	return &timestampConditioner{config: config}
+}
+
+// condition returns the corrected PTS and DTS of a frame that arrived at now, and the
+// discontinuity that was corrected, if any. The PTS-DTS offset of the frame is kept.
+func (c *timestampConditioner) condition(pts, dts time.Duration, now time.Time) (time.Duration, time.Duration, *discontinuity) {
+	if !c.started {
+		c.started = true
+		c.startedAt = now
+		c.lastIn, c.lastOut, c.lastAt = dts, dts, now
+		c.refOut, c.refAt = dts, now
+		return pts, dts, nil
+	}
+
+	var d *discontinuity
+	delta := dts - c.lastIn
+	switch {
+	case delta < 0:
+		d = &discontinuity{kind: "backward", jump: delta}
+	case delta > now.Sub(c.lastAt)+c.config.jumpTolerance:
+		d = &discontinuity{kind: "forward", jump: delta}
+	case delta > 0:
+		c.interval = delta
+	}
+
+	if d != nil {
+		// Continue as if the frame followed the last one on time
+		step := c.interval
+		if step <= 0 {
+			step = defaultFrameInterval
+		}
+		c.offset = c.lastOut + step - dts
+		c.refOut, c.refAt = c.lastOut+step, now
+		c.slewing = false
+	} else if c.config.maxDrift > 0 {
+		d = c.slew(dts+c.offset, now)
+	}
+
+	out := max(dts+c.offset, c.lastOut) // slewing never moves DTS backwards
+	c.lastIn, c.lastOut, c.lastAt = dts, out, now
+	return pts + out - dts, out, d
+}
+
+// slew measures the drift of the output timeline from the arrival clock and moves the
+// offset towards it while the drift exceeds maxDrift. It returns a discontinuity when
+// slewing starts.
+func (c *timestampConditioner) slew(out time.Duration, now time.Time) *discontinuity {
+	if !c.anchored {
+		if now.Sub(c.startedAt) < driftWarmup {
+			return nil
+		}
+		c.refOut, c.refAt, c.anchored = out, now, true
+	}
+	c.drift = (out - c.refOut) - now.Sub(c.refAt)
+
+	var d *discontinuity
+	if !c.slewing && (c.drift > c.config.maxDrift || c.drift < -c.config.maxDrift) {
+		c.slewing = true
+		d = &discontinuity{kind: "drift", drift: c.drift}
+	}
+	if !c.slewing {
+		return d
+	}
+	if c.drift < c.config.maxDrift/4 && c.drift > -c.config.maxDrift/4 {
+		c.slewing = false
+		return d
+	}
+	limit := max(c.interval, defaultFrameInterval) / driftSlewMaxShare
+	if c.drift > 0 {
+		c.offset -= min(c.drift/driftSlewShare, limit)
+	} else {
+		c.offset += min(-c.drift/driftSlewShare, limit)
+	}
+	return d
+}
+
+// conditionTimestamps corrects the timestamps of a frame, records corrections in the
+// session statistics and reports them as TimestampDiscontinuity events.
+func (ss *session) conditionTimestamps(c *timestampConditioner, track string, pts, dts time.Duration, now time.Time) (time.Duration, time.Duration) {
+	pts, dts, d := c.condition(pts, dts, now)
+	// The drift of a stream with video is the video's
+	if c == ss.videoTimestamps || ss.videoAudio == nil {
+		ss.stats.setClockDrift(c.drift)
+	}
+	if d == nil {
+		return pts, dts
+	}
+	ss.stats.addDiscontinuity()
+
+	if now.Sub(c.lastEvent) < timestampEventInterval {
+		c.suppressed++
+		return pts, dts
+	}
+	detail := map[string]any{
+		"track":      track,
+		"kind":       d.kind,
+		"suppressed": c.suppressed,
+	}
+	switch d.kind {
+	case "drift":
+		detail["drift_ms"] = d.drift.Milliseconds()
+		log.Printf("[%s] Clock of %s drifted %s from real time, slewing %s timestamps", ss.protocol, ss.streamPath, d.drift, track)
+	default:
+		detail["jump_ms"] = d.jump.Milliseconds()
+		log.Printf("[%s] %s timestamp of %s jumped %s (%s), rebased", ss.protocol, track, ss.streamPath, d.jump, d.kind)
+	}
+	c.lastEvent, c.suppressed = now, 0
+	events.Emit(events.Event{
+		Type:       events.TimestampDiscontinuity,
+		StreamPath: ss.streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   ss.route.CameraID,
+		RemoteAddr: ss.remoteAddr,
+		Protocol:   ss.protocol,
+		Detail:     detail,
+	})
+	return pts, dts
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTimestampConditioner(t *testing.T) {
+	ms := time.Millisecond
+	// frame is a publisher frame arriving at ms after the first one.
+	type frame struct {
+		at       time.Duration
+		pts, dts time.Duration
+	}
+	// corrected is the conditioner output of a frame.
+	type corrected struct {
+		pts, dts time.Duration
+		kind     string
+	}
+	tests := []struct {
+		name   string
+		frames []frame
+		want   []corrected
+	}{
+		{
+			name: "steady stream is unchanged",
+			frames: []frame{
+				{0, 5000 * ms, 5000 * ms},
+				{33 * ms, 5033 * ms, 5033 * ms},
+				{66 * ms, 5066 * ms, 5066 * ms},
+			},
+			want: []corrected{
+				{5000 * ms, 5000 * ms, ""},
+				{5033 * ms, 5033 * ms, ""},
+				{5066 * ms, 5066 * ms, ""},
+			},
+		},
+		{
+			name: "backward jump follows the last frame",
+			frames: []frame{
+				{0, 1000 * ms, 1000 * ms},
+				{40 * ms, 1040 * ms, 1040 * ms},
+				{80 * ms, 0, 0},
+				{120 * ms, 40 * ms, 40 * ms},
+			},
+			want: []corrected{
+				{1000 * ms, 1000 * ms, ""},
+				{1040 * ms, 1040 * ms, ""},
+				{1080 * ms, 1080 * ms, "backward"},
+				{1120 * ms, 1120 * ms, ""},
+			},
+		},
+		{
+			name: "forward jump beyond the arrival clock",
+			frames: []frame{
+				{0, 0, 0},
+				{40 * ms, 40 * ms, 40 * ms},
+				{80 * ms, time.Hour, time.Hour},
+				{120 * ms, time.Hour + 40*ms, time.Hour + 40*ms},
+			},
+			want: []corrected{
+				{0, 0, ""},
+				{40 * ms, 40 * ms, ""},
+				{80 * ms, 80 * ms, "forward"},
+				{120 * ms, 120 * ms, ""},
+			},
+		},
+		{
+			name: "gap matching the arrival clock is kept",
+			frames: []frame{
+				{0, 0, 0},
+				{40 * ms, 40 * ms, 40 * ms},
+				{5040 * ms, 5040 * ms, 5040 * ms},
+			},
+			want: []corrected{
+				{0, 0, ""},
+				{40 * ms, 40 * ms, ""},
+				{5040 * ms, 5040 * ms, ""},
+			},
+		},
+		{
+			name: "gap within the jump tolerance is kept",
+			frames: []frame{
+				{0, 0, 0},
+				{40 * ms, 40 * ms, 40 * ms},
+				{80 * ms, 2000 * ms, 2000 * ms},
+			},
+			want: []corrected{
+				{0, 0, ""},
+				{40 * ms, 40 * ms, ""},
+				{2000 * ms, 2000 * ms, ""},
+			},
+		},
+		{
+			name: "jump before any interval uses the default",
+			frames: []frame{
+				{0, 10 * time.Second, 10 * time.Second},
+				{40 * ms, 0, 0},
+			},
+			want: []corrected{
+				{10 * time.Second, 10 * time.Second, ""},
+				{10*time.Second + defaultFrameInterval, 10*time.Second + defaultFrameInterval, "backward"},
+			},
+		},
+		{
+			name: "B-frame offset is kept across a jump",
+			frames: []frame{
+				{0, 80 * ms, 0},
+				{40 * ms, 200 * ms, 40 * ms},
+				{80 * ms, 80 * ms, 0},
+			},
+			want: []corrected{
+				{80 * ms, 0, ""},
+				{200 * ms, 40 * ms, ""},
+				{160 * ms, 80 * ms, "backward"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTimestampConditioner(&timestampConfig{jumpTolerance: 2 * time.Second})
+			start := time.Now()
+			var got []corrected
+			for _, f := range tt.frames {
+				pts, dts, d := c.condition(f.pts, f.dts, start.Add(f.at))
+				out := corrected{pts: pts, dts: dts}
+				if d != nil {
+					out.kind = d.kind
+				}
+				got = append(got, out)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("corrected =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestampConditionerDrift(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      float64 // publisher clock speed relative to real time
+		maxDrift  time.Duration
+		wantDrift bool
+	}{
+		{name: "accurate clock", rate: 1, maxDrift: 2 * time.Second},
+		{name: "slightly fast clock", rate: 1.001, maxDrift: 2 * time.Second},
+		{name: "fast clock", rate: 1.05, maxDrift: 2 * time.Second, wantDrift: true},
+		{name: "slow clock", rate: 0.95, maxDrift: 2 * time.Second, wantDrift: true},
+		{name: "drift correction disabled", rate: 1.05},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTimestampConditioner(&timestampConfig{jumpTolerance: 2 * time.Second, maxDrift: tt.maxDrift})
+			start := time.Now()
+			interval := 40 * time.Millisecond
+
+			var drifted bool
+			lastOut := time.Duration(-1)
+			// Ten minutes of frames
+			for i := range 15000 {
+				at := time.Duration(i) * interval
+				in := time.Duration(float64(at) * tt.rate)
+				_, out, d := c.condition(in, in, start.Add(at))
+				if out < lastOut {
+					t.Fatalf("frame %d: DTS went backwards from %s to %s", i, lastOut, out)
+				}
+				lastOut = out
+				if d != nil {
+					if d.kind != "drift" {
+						t.Fatalf("frame %d: unexpected %s discontinuity", i, d.kind)
+					}
+					drifted = true
+				}
+			}
+			if drifted != tt.wantDrift {
+				t.Errorf("drift reported %v, want %v", drifted, tt.wantDrift)
+			}
+			if tt.wantDrift {
+				// Slewing keeps the output within maxDrift of the arrival clock
+				if c.drift > tt.maxDrift || c.drift < -tt.maxDrift {
+					t.Errorf("drift after slewing = %s, want within %s", c.drift, tt.maxDrift)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Package server implements RTMP/RTMPS server functionality.
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"rtmp_kvs/events"
+)
+
+// idleStreamTimeout reads IDLE_STREAM_TIMEOUT (seconds, default 0 = disabled).
+func idleStreamTimeout() time.Duration {
+	value := os.Getenv("IDLE_STREAM_TIMEOUT")
+	if value == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		log.Printf("Warning: invalid IDLE_STREAM_TIMEOUT %q, idle-stream watchdog disabled", value)
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// watchIdle closes the publisher connection when no frame arrives for idleTimeout, or no
+// video for videoTimeout, while the connection itself stays alive (e.g. a frozen camera
+// still answering pings, which never trips the read deadline). A zero timeout disables
+// its check.
+func (ss *session) watchIdle(idleTimeout, videoTimeout time.Duration) {
+	interval := time.Second
+	for _, timeout := range []time.Duration{idleTimeout, videoTimeout} {
+		if timeout > 0 {
+			interval = min(interval, timeout/4)
+		}
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if videoTimeout > 0 {
+				silent := time.Since(time.Unix(0, ss.lastVideoAt.Load()))
+				if silent >= videoTimeout {
+					log.Printf("[%s] ⚠️  No video messages from %s on %s for %s although the connection is alive, closing connection",
+						ss.protocol, ss.remoteAddr, ss.streamPath, silent.Truncate(time.Second))
+					ss.server.countFailure(ss.ctx, ss.protocol, ss.remoteAddr, failVideoTimeout)
+					ss.emitIdle(failVideoTimeout, silent)
+					ss.cancel() // closes the connection
+					return
+				}
+			}
+			if idleTimeout > 0 {
+				idle := time.Since(time.Unix(0, ss.lastFrameAt.Load()))
+				if idle >= idleTimeout {
+					log.Printf("[%s] ⚠️  No video from %s on %s for %s, closing connection",
+						ss.protocol, ss.remoteAddr, ss.streamPath, idle.Truncate(time.Second))
+					ss.server.idleDisconnects.Add(1)
+					ss.emitIdle(disconnectIdle, idle)
+					ss.endSession(disconnectIdle)
+					ss.cancel() // closes the connection
+					return
+				}
+			}
+		case <-ss.ctx.Done():
+			return
+		}
+	}
+}
+
+// emitIdle emits StreamIdle for a publisher disconnected by the watchdog. reason is
+// "idle" (IDLE_STREAM_TIMEOUT) or "video_timeout" (VIDEO_TIMEOUT).
+func (ss *session) emitIdle(reason string, idle time.Duration) {
+	events.Emit(events.Event{
+		Type:       events.StreamIdle,
+		StreamPath: ss.streamPath,
+		StreamName: ss.forwarder.StreamName(),
+		CameraID:   ss.route.CameraID,
+		RemoteAddr: ss.remoteAddr,
+		Protocol:   ss.protocol,
+		Detail: map[string]any{
+			"reason":       reason,
+			"idle_seconds": idle.Seconds(),
+			"frames":       ss.stats.snapshot().Frames,
+		},
+	})
+}
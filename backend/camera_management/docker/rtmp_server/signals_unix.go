@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals are the signals that trigger a graceful shutdown.
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// reloadSignals trigger a TLS certificate reload.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// shutdownSignals are the signals that trigger a graceful shutdown.
+// Windows only delivers os.Interrupt (Ctrl+C / Ctrl+Break).
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// reloadSignals trigger a TLS certificate reload. Windows has no SIGHUP; certificates are
+// reloaded by polling only.
+var reloadSignals []os.Signal
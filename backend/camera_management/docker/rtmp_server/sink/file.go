@@ -0,0 +1,67 @@
+// Package sink defines the outputs a published stream is written to and fans a stream out
+// to several of them.
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileSink archives a stream as FLV segments in a local directory:
+// <dir>/<stream>/<stream>-<YYYYMMDD-HHMMSS>.flv.
+type fileSink struct {
+	dir string
+	seg segmenter
+}
+
+func newFileSink(dir, streamName string, duration time.Duration) *fileSink {
+	f := &fileSink{dir: filepath.Join(dir, streamName)}
+	f.seg = segmenter{duration: duration, open: func(start time.Time) (io.WriteCloser, error) {
+		path := filepath.Join(f.dir, fmt.Sprintf("%s-%s.flv", streamName, start.Format("20060102-150405")))
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[Sink] Writing %s", path)
+		return &bufferedFile{Writer: bufio.NewWriterSize(file, 256*1024), file: file}, nil
+	}}
+	return f
+}
+
+func (f *fileSink) Name() string {
+	return "file"
+}
+
+func (f *fileSink) Start(ctx context.Context) error {
+	return os.MkdirAll(f.dir, 0o755)
+}
+
+func (f *fileSink) WriteAccessUnit(ctx context.Context, pts, dts time.Duration, au [][]byte) error {
+	return f.seg.write(pts, dts, au)
+}
+
+func (f *fileSink) Stop() {
+	if err := f.seg.close(); err != nil {
+		log.Printf("[Sink] ⚠️  Failed to close segment in %s: %v", f.dir, err)
+	}
+}
+
+// bufferedFile flushes its buffer when closed.
+type bufferedFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func (b *bufferedFile) Close() error {
+	err := b.Flush()
+	if closeErr := b.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
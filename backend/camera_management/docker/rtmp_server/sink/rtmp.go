@@ -0,0 +1,170 @@
+// Package sink defines the outputs a published stream is written to and fans a stream out
+// to several of them.
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/gortmplib"
+	"github.com/bluenviron/gortmplib/pkg/codecs"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+)
+
+const (
+	// Limit of connecting and publishing to the relay target
+	rtmpConnectTimeout = 10 * time.Second
+	// A write stalled for this long fails the relay, which then reconnects
+	rtmpWriteTimeout = 10 * time.Second
+)
+
+// rtmpSink re-publishes a stream to another RTMP(S) endpoint, such as an ingest server in
+// a backup region or a third-party service. It connects at the first keyframe, since
+// the track header needs the parameter sets, and reconnects when they change. A broken
+// connection fails the sink; the Tee then reconnects it with a backoff without
+// affecting KVS or the other sinks.
+type rtmpSink struct {
+	url *url.URL
+
+	client   *gortmplib.Client
+	writer   *gortmplib.Writer
+	track    *gortmplib.Track
+	startDTS time.Duration
+	sps, pps []byte
+	failed   *atomic.Pointer[error] // set when the target closes the current connection
+}
+
+func newRTMPSink(rawURL string) (*rtmpSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay URL: %w", err)
+	}
+	if (u.Scheme != "rtmp" && u.Scheme != "rtmps") || u.Host == "" {
+		return nil, fmt.Errorf("relay URL %s is not an rtmp:// or rtmps:// URL", redactURL(u))
+	}
+	return &rtmpSink{url: u}, nil
+}
+
+// CheckRelayURL checks that a relay target is an rtmp:// or rtmps:// URL.
+func CheckRelayURL(rawURL string) error {
+	_, err := newRTMPSink(rawURL)
+	return err
+}
+
+func (r *rtmpSink) Name() string {
+	return "rtmp"
+}
+
+func (r *rtmpSink) Start(ctx context.Context) error {
+	return nil
+}
+
+func (r *rtmpSink) WriteAccessUnit(ctx context.Context, pts, dts time.Duration, au [][]byte) error {
+	if r.client != nil {
+		if err := r.failed.Load(); err != nil {
+			return *err
+		}
+	}
+
+	nalus := make([][]byte, 0, len(au))
+	sps, pps := r.sps, r.pps
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			sps = nalu
+		case h264.NALUTypePPS:
+			pps = nalu
+		case h264.NALUTypeAccessUnitDelimiter:
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+
+	if h264.IsRandomAccess(au) && (r.client == nil || !bytes.Equal(sps, r.sps) || !bytes.Equal(pps, r.pps)) {
+		if r.client != nil {
+			log.Printf("[Sink] Parameter sets changed, republishing to %s", redactURL(r.url))
+			r.Stop()
+		}
+		if sps == nil || pps == nil {
+			return nil
+		}
+		if err := r.connect(ctx, sps, pps, dts); err != nil {
+			return err
+		}
+	}
+	if r.client == nil || len(nalus) == 0 {
+		return nil
+	}
+
+	r.client.NetConn().SetWriteDeadline(time.Now().Add(rtmpWriteTimeout))
+	return r.writer.WriteH264(r.track, pts-r.startDTS, max(dts-r.startDTS, 0), nalus)
+}
+
+// connect publishes to the target with the given parameter sets. The relayed timeline
+// starts at dts.
+func (r *rtmpSink) connect(ctx context.Context, sps, pps []byte, dts time.Duration) error {
+	client := &gortmplib.Client{URL: r.url, Publish: true}
+	if r.url.Scheme == "rtmps" {
+		client.TLSConfig = &tls.Config{ServerName: r.url.Hostname()}
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, rtmpConnectTimeout)
+	defer cancel()
+	if err := client.Initialize(connectCtx); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", redactURL(r.url), err)
+	}
+
+	track := &gortmplib.Track{Codec: &codecs.H264{SPS: sps, PPS: pps}}
+	writer := &gortmplib.Writer{Conn: client, Tracks: []*gortmplib.Track{track}}
+	client.NetConn().SetWriteDeadline(time.Now().Add(rtmpWriteTimeout))
+	if err := writer.Initialize(); err != nil {
+		client.Close()
+		return fmt.Errorf("failed to publish to %s: %w", redactURL(r.url), err)
+	}
+
+	r.client, r.writer, r.track = client, writer, track
+	r.sps, r.pps, r.startDTS = sps, pps, dts
+	failed := &atomic.Pointer[error]{}
+	r.failed = failed
+	log.Printf("[Sink] Relaying to %s", redactURL(r.url))
+
+	// The target only sends acknowledgements and pings while we publish. They are
+	// discarded unparsed, since the client cannot read and write concurrently; reading
+	// keeps them from filling the socket buffer and notices when the target hangs up.
+	go func() {
+		_, err := io.Copy(io.Discard, client.NetConn())
+		if err == nil {
+			err = io.EOF
+		}
+		err = fmt.Errorf("%s closed the connection: %w", redactURL(r.url), err)
+		failed.Store(&err)
+	}()
+	return nil
+}
+
+func (r *rtmpSink) Stop() {
+	if r.client == nil {
+		return
+	}
+	client := r.client
+	r.client, r.writer, r.track, r.failed = nil, nil, nil, nil
+	client.Close()
+}
+
+// redactURL returns the URL without its stream key and credentials, for logs.
+func redactURL(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// errNoRelayURL is returned for an rtmp sink without a target.
+var errNoRelayURL = errors.New("the rtmp sink needs SINK_RTMP_URL or a relay_url")
@@ -0,0 +1,117 @@
+// Package sink defines the outputs a published stream is written to and fans a stream out
+// to several of them.
+package sink
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"rtmp_kvs/awsapi"
+)
+
+const (
+	// Finished segments waiting for upload; older ones are dropped when uploads fall behind
+	s3UploadQueue = 4
+	// Attempts per segment, with a growing delay in between
+	s3UploadAttempts = 3
+	// Limit of one upload attempt
+	s3UploadTimeout = time.Minute
+)
+
+// s3Sink archives a stream as FLV segments in S3:
+// <prefix><stream>/<YYYY>/<MM>/<DD>/<stream>-<YYYYMMDDTHHMMSSZ>.flv. Segments are
+// buffered in memory and uploaded in the background, so a slow upload does not hold up
+// the stream; upload errors are logged and counted but do not restart the sink.
+type s3Sink struct {
+	client     *awsapi.S3
+	bucket     string
+	prefix     string
+	streamName string
+	seg        segmenter
+
+	uploads chan *s3Segment
+	wg      sync.WaitGroup
+}
+
+type s3Segment struct {
+	bytes.Buffer
+	sink *s3Sink
+	key  string
+}
+
+// Close hands the segment to the uploader.
+func (s *s3Segment) Close() error {
+	select {
+	case s.sink.uploads <- s:
+	default:
+		counters("s3").failures.Add(1)
+		log.Printf("[Sink] ⚠️  Upload of s3://%s/%s fell behind, dropping the segment", s.sink.bucket, s.key)
+	}
+	return nil
+}
+
+func newS3Sink(bucket, prefix, streamName, region string, duration time.Duration) *s3Sink {
+	s := &s3Sink{
+		client:     awsapi.NewS3(region),
+		bucket:     bucket,
+		prefix:     prefix,
+		streamName: streamName,
+	}
+	s.seg = segmenter{duration: duration, open: func(start time.Time) (io.WriteCloser, error) {
+		start = start.UTC()
+		key := s.prefix + s.streamName + "/" + start.Format("2006/01/02/") + s.streamName + "-" + start.Format("20060102T150405Z") + ".flv"
+		return &s3Segment{sink: s, key: key}, nil
+	}}
+	return s
+}
+
+func (s *s3Sink) Name() string {
+	return "s3"
+}
+
+func (s *s3Sink) Start(ctx context.Context) error {
+	s.uploads = make(chan *s3Segment, s3UploadQueue)
+	s.wg.Add(1)
+	go s.upload(context.WithoutCancel(ctx))
+	return nil
+}
+
+func (s *s3Sink) WriteAccessUnit(ctx context.Context, pts, dts time.Duration, au [][]byte) error {
+	return s.seg.write(pts, dts, au)
+}
+
+// Stop uploads the last segment and waits for the pending uploads.
+func (s *s3Sink) Stop() {
+	s.seg.close()
+	close(s.uploads)
+	s.wg.Wait()
+}
+
+// upload uploads finished segments until the queue is closed.
+func (s *s3Sink) upload(ctx context.Context) {
+	defer s.wg.Done()
+	for segment := range s.uploads {
+		var err error
+		for attempt := 1; attempt <= s3UploadAttempts; attempt++ {
+			uploadCtx, cancel := context.WithTimeout(ctx, s3UploadTimeout)
+			err = s.client.PutObject(uploadCtx, s.bucket, segment.key, "video/x-flv", segment.Bytes())
+			cancel()
+			if err == nil {
+				break
+			}
+			if attempt < s3UploadAttempts {
+				time.Sleep(time.Duration(attempt) * 2 * time.Second)
+			}
+		}
+		if err != nil {
+			counters("s3").failures.Add(1)
+			log.Printf("[Sink] ⚠️  Failed to upload s3://%s/%s: %v", s.bucket, segment.key, err)
+			continue
+		}
+		log.Printf("[Sink] Uploaded s3://%s/%s (%d bytes)", s.bucket, segment.key, segment.Len())
+	}
+}
@@ -0,0 +1,97 @@
+// Package sink defines the outputs a published stream is written to and fans a stream out
+// to several of them.
+package sink
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/flv"
+)
+
+// segmenter writes a stream as a series of self-contained FLV files, each starting with
+// a keyframe and cut at the first keyframe after the segment duration.
+type segmenter struct {
+	duration time.Duration
+	// open returns the destination of a new segment that starts at start
+	open func(start time.Time) (io.WriteCloser, error)
+
+	w        io.WriteCloser // current segment, nil before the first keyframe
+	fw       *flv.Writer
+	startDTS time.Duration
+	sps, pps []byte
+	changed  bool // the parameter sets differ from those of the current segment
+}
+
+// write adds an access unit, starting a new segment when due and when the parameter
+// sets (resolution) change.
+func (s *segmenter) write(pts, dts time.Duration, au [][]byte) error {
+	keyframe := h264.IsRandomAccess(au)
+	nalus := s.slices(au)
+	if keyframe && (s.w == nil || s.changed || dts-s.startDTS >= s.duration) {
+		if err := s.cut(dts); err != nil {
+			return err
+		}
+	}
+	if s.w == nil || len(nalus) == 0 {
+		return nil
+	}
+
+	ts := max(dts-s.startDTS, 0)
+	return s.fw.WriteH264(uint32(ts.Milliseconds()), int32((pts - dts).Milliseconds()), keyframe, nalus)
+}
+
+// slices records the parameter sets of an access unit and returns its other NAL units.
+func (s *segmenter) slices(au [][]byte) [][]byte {
+	nalus := make([][]byte, 0, len(au))
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			s.changed = s.changed || !bytes.Equal(s.sps, nalu)
+			s.sps = nalu
+		case h264.NALUTypePPS:
+			s.changed = s.changed || !bytes.Equal(s.pps, nalu)
+			s.pps = nalu
+		case h264.NALUTypeAccessUnitDelimiter:
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	return nalus
+}
+
+// cut closes the current segment and opens the next one at a keyframe. Until the
+// parameter sets are known no segment is opened.
+func (s *segmenter) cut(dts time.Duration) error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	if s.sps == nil || s.pps == nil {
+		return nil
+	}
+	w, err := s.open(time.Now())
+	if err != nil {
+		return err
+	}
+	s.w, s.fw, s.startDTS, s.changed = w, flv.NewWriter(w), dts, false
+	if err := s.fw.WriteHeader(true, false); err != nil {
+		return err
+	}
+	return s.fw.WriteH264Config(0, s.sps, s.pps)
+}
+
+// close finishes the current segment.
+func (s *segmenter) close() error {
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w, s.fw = nil, nil
+	return err
+}
@@ -0,0 +1,139 @@
+// Package sink defines the outputs a published stream is written to and fans a stream out
+// to several of them.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sink is an output of a stream. The KVS forwarder is the primary sink of every stream;
+// the others (S3 archive, local files) are secondary sinks written through a Tee.
+type Sink interface {
+	// Name identifies the kind of sink in logs and metrics ("kvs", "file", "s3").
+	Name() string
+	// Start prepares the sink for a new stream.
+	Start(ctx context.Context) error
+	// WriteAccessUnit writes an H.264 access unit. Keyframes carry their SPS/PPS.
+	WriteAccessUnit(ctx context.Context, pts, dts time.Duration, au [][]byte) error
+	// Stop flushes and releases the sink. It may be started again.
+	Stop()
+}
+
+// Config holds the settings of the secondary sinks.
+type Config struct {
+	FileDir         string        // directory of the file sink
+	S3Bucket        string        // bucket of the s3 sink
+	S3Prefix        string        // key prefix of the s3 sink
+	SegmentDuration time.Duration // length of the archived segments
+	RTMPURL         string        // relay target of the rtmp sink, {stream} is replaced by the stream name
+}
+
+// Stream is the stream a sink writes.
+type Stream struct {
+	Name     string // KVS stream name
+	Region   string
+	RelayURL string // relay target of the rtmp sink, overrides Config.RTMPURL
+}
+
+// ConfigFromEnv reads SINK_FILE_DIR (default "archive"), SINK_S3_BUCKET, SINK_S3_PREFIX
+// (default "archive/"), SINK_SEGMENT_DURATION (seconds, default 60) and SINK_RTMP_URL.
+func ConfigFromEnv() Config {
+	c := Config{
+		FileDir:         os.Getenv("SINK_FILE_DIR"),
+		S3Bucket:        os.Getenv("SINK_S3_BUCKET"),
+		S3Prefix:        os.Getenv("SINK_S3_PREFIX"),
+		SegmentDuration: time.Minute,
+		RTMPURL:         os.Getenv("SINK_RTMP_URL"),
+	}
+	if c.FileDir == "" {
+		c.FileDir = "archive"
+	}
+	if c.S3Prefix == "" {
+		c.S3Prefix = "archive/"
+	}
+	if value := os.Getenv("SINK_SEGMENT_DURATION"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			log.Printf("Warning: invalid SINK_SEGMENT_DURATION %q, using %s", value, c.SegmentDuration)
+		} else {
+			c.SegmentDuration = time.Duration(seconds) * time.Second
+		}
+	}
+	return c
+}
+
+// Kinds are the sink names accepted in SINKS and the per-stream "sinks" settings. "kvs"
+// names the primary sink, which is always written.
+var Kinds = []string{"kvs", "file", "s3", "rtmp"}
+
+// ParseList splits a comma-separated list of sink names.
+func ParseList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Valid reports whether name is a known sink.
+func Valid(name string) bool {
+	for _, kind := range Kinds {
+		if name == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// New creates a secondary sink of the given kind for a stream.
+func (c Config) New(kind string, stream Stream) (Sink, error) {
+	switch kind {
+	case "file":
+		return newFileSink(c.FileDir, stream.Name, c.SegmentDuration), nil
+	case "s3":
+		if c.S3Bucket == "" {
+			return nil, fmt.Errorf("the s3 sink needs SINK_S3_BUCKET")
+		}
+		return newS3Sink(c.S3Bucket, c.S3Prefix, stream.Name, stream.Region, c.SegmentDuration), nil
+	case "rtmp":
+		target := stream.RelayURL
+		if target == "" {
+			target = strings.ReplaceAll(c.RTMPURL, "{stream}", url.PathEscape(stream.Name))
+		}
+		if target == "" {
+			return nil, errNoRelayURL
+		}
+		return newRTMPSink(target)
+	default:
+		return nil, fmt.Errorf("unknown sink %q", kind)
+	}
+}
+
+// Secondary creates the secondary sinks among names, skipping "kvs" and duplicates and
+// logging the names that cannot be created.
+func (c Config) Secondary(names []string, stream Stream) []Sink {
+	var sinks []Sink
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "kvs" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		s, err := c.New(name, stream)
+		if err != nil {
+			log.Printf("Warning: %v, not writing %s to it", err, stream.Name)
+			continue
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks
+}
@@ -0,0 +1,195 @@
+// Package sink defines the outputs a published stream is written to and fans a stream out
+// to several of them.
+package sink
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+
+	"rtmp_kvs/metrics"
+)
+
+const (
+	// Access units queued per sink; a sink that falls further behind loses frames
+	queueSize = 300
+	// Delay before a failed sink is started again, doubled up to maxRestartDelay
+	minRestartDelay = 5 * time.Second
+	maxRestartDelay = time.Minute
+)
+
+type accessUnit struct {
+	pts, dts time.Duration
+	au       [][]byte
+}
+
+// Tee writes a stream to several sinks. Each sink has its own queue and goroutine, so a
+// slow or failing sink neither delays nor stops the others: its frames are dropped while
+// its queue is full, and after an error it is stopped and started again with a backoff,
+// resuming at the next keyframe.
+type Tee struct {
+	streamName string
+	outputs    []*output
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type output struct {
+	sink  Sink
+	queue chan accessUnit
+}
+
+// NewTee creates a tee of the sinks of a stream.
+func NewTee(streamName string, sinks ...Sink) *Tee {
+	t := &Tee{streamName: streamName}
+	for _, s := range sinks {
+		t.outputs = append(t.outputs, &output{sink: s, queue: make(chan accessUnit, queueSize)})
+	}
+	return t
+}
+
+// Name implements Sink.
+func (t *Tee) Name() string {
+	return "tee"
+}
+
+// Start starts the sinks. Sinks that fail to start are retried in the background, so it
+// always succeeds.
+func (t *Tee) Start(ctx context.Context) error {
+	ctx, t.cancel = context.WithCancel(ctx)
+	for _, o := range t.outputs {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.run(ctx, o)
+		}()
+	}
+	return nil
+}
+
+// WriteAccessUnit queues an access unit for every sink. It never blocks.
+func (t *Tee) WriteAccessUnit(ctx context.Context, pts, dts time.Duration, au [][]byte) error {
+	for _, o := range t.outputs {
+		select {
+		case o.queue <- accessUnit{pts: pts, dts: dts, au: au}:
+		default:
+			counters(o.sink.Name()).dropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// Stop stops the sinks and waits for them to flush.
+func (t *Tee) Stop() {
+	if t.cancel == nil {
+		return
+	}
+	t.cancel()
+	t.wg.Wait()
+}
+
+// run keeps a sink running until ctx is done.
+func (t *Tee) run(ctx context.Context, o *output) {
+	name := o.sink.Name()
+	delay := minRestartDelay
+	for {
+		startedAt := time.Now()
+		err := o.sink.Start(ctx)
+		if err == nil {
+			err = t.pump(ctx, o)
+			o.sink.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		counters(name).failures.Add(1)
+		if time.Since(startedAt) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+		log.Printf("[Sink] ⚠️  %s sink of %s failed: %v, restarting in %s", name, t.streamName, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, maxRestartDelay)
+		t.discard(o)
+	}
+}
+
+// discard drops the access units queued while a sink was down, so it resumes live.
+func (t *Tee) discard(o *output) {
+	c := counters(o.sink.Name())
+	for {
+		select {
+		case <-o.queue:
+			c.dropped.Add(1)
+		default:
+			return
+		}
+	}
+}
+
+// pump writes queued access units to a started sink, from the first keyframe on. It
+// returns nil when ctx is done and the write error otherwise.
+func (t *Tee) pump(ctx context.Context, o *output) error {
+	c := counters(o.sink.Name())
+	keyframe := false
+	for {
+		select {
+		case frame := <-o.queue:
+			if !keyframe {
+				if !h264.IsRandomAccess(frame.au) {
+					continue
+				}
+				keyframe = true
+			}
+			if err := o.sink.WriteAccessUnit(ctx, frame.pts, frame.dts, frame.au); err != nil {
+				return err
+			}
+			c.written.Add(1)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sinkCounters are the frame counters of one kind of sink, summed over streams.
+type sinkCounters struct {
+	written  atomic.Uint64
+	dropped  atomic.Uint64
+	failures atomic.Uint64
+}
+
+var (
+	countersMutex  sync.Mutex
+	countersByName = make(map[string]*sinkCounters)
+)
+
+func counters(name string) *sinkCounters {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+	c, ok := countersByName[name]
+	if !ok {
+		c = &sinkCounters{}
+		countersByName[name] = c
+	}
+	return c
+}
+
+// CollectMetrics writes the frame counters of the secondary sinks.
+func CollectMetrics(w *metrics.Writer) {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+	for name, c := range countersByName {
+		w.Counter("rtmp_sink_frames_total", "Access units written to secondary sinks", float64(c.written.Load()), "sink", name)
+		w.Counter("rtmp_sink_dropped_frames_total", "Access units dropped because a secondary sink fell behind", float64(c.dropped.Load()), "sink", name)
+		w.Counter("rtmp_sink_failures_total", "Failures of secondary sinks that led to a restart", float64(c.failures.Load()), "sink", name)
+	}
+}
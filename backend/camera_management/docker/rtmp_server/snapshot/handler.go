@@ -0,0 +1,209 @@
+// Package snapshot captures still images from live streams.
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"rtmp_kvs/admin"
+	"rtmp_kvs/awsapi"
+)
+
+// Handler serves snapshot requests on the admin API.
+//
+//	GET  /snapshot?path=/live/cam1&format=jpeg  returns the image
+//	POST /snapshot?path=/live/cam1&format=jpeg  uploads the image to S3 and returns its location
+type Handler struct {
+	source    KeyframeSource
+	s3        *awsapi.S3
+	bucket    string
+	prefix    string
+	urlExpiry time.Duration
+	timeout   time.Duration
+	publisher Publisher
+}
+
+// Publisher is notified of every uploaded snapshot.
+type Publisher interface {
+	Publish(ctx context.Context, upload *Upload)
+}
+
+// Presigned URLs are valid for at most 7 days
+const maxURLExpiry = 7 * 24 * time.Hour
+
+// NewHandlerFromEnv creates a handler. S3 uploads are enabled by SNAPSHOT_BUCKET
+// (key prefix SNAPSHOT_PREFIX, default "snapshots/"), and return a presigned URL valid
+// for SNAPSHOT_URL_EXPIRY seconds (default 3600, at most 7 days).
+func NewHandlerFromEnv(source KeyframeSource, region string) *Handler {
+	h := &Handler{
+		source:    source,
+		bucket:    os.Getenv("SNAPSHOT_BUCKET"),
+		prefix:    os.Getenv("SNAPSHOT_PREFIX"),
+		urlExpiry: time.Hour,
+		timeout:   15 * time.Second,
+	}
+	if h.prefix == "" {
+		h.prefix = "snapshots/"
+	}
+	if value := os.Getenv("SNAPSHOT_URL_EXPIRY"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			log.Printf("[Snapshot] ⚠️  Invalid SNAPSHOT_URL_EXPIRY %q, using %d", value, int(h.urlExpiry.Seconds()))
+		} else {
+			h.urlExpiry = min(time.Duration(seconds)*time.Second, maxURLExpiry)
+		}
+	}
+	if h.bucket != "" {
+		h.s3 = awsapi.NewS3(region)
+	}
+	return h
+}
+
+// Enabled reports whether snapshots are uploaded to S3.
+func (h *Handler) Enabled() bool {
+	return h.s3 != nil
+}
+
+// SetPublisher sets the publisher notified of uploaded snapshots.
+func (h *Handler) SetPublisher(p Publisher) {
+	h.publisher = p
+}
+
+// Register registers the snapshot endpoints on the admin server.
+func (h *Handler) Register(srv *admin.Server) {
+	srv.HandleFunc("GET /snapshot", h.serveImage)
+	srv.HandleFunc("POST /snapshot", h.serveUpload)
+}
+
+// capture validates the request and captures an image.
+func (h *Handler) capture(w http.ResponseWriter, r *http.Request) (string, string, []byte, bool) {
+	streamPath := r.URL.Query().Get("path")
+	if streamPath == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return "", "", nil, false
+	}
+	format, err := NormalizeFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	image, err := Capture(ctx, h.source, streamPath, format)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrStreamNotLive):
+			status = http.StatusNotFound
+		case errors.Is(err, context.DeadlineExceeded):
+			status = http.StatusGatewayTimeout
+		}
+		log.Printf("[Snapshot] Failed to capture %s: %v", streamPath, err)
+		http.Error(w, err.Error(), status)
+		return "", "", nil, false
+	}
+	return streamPath, format, image, true
+}
+
+func (h *Handler) serveImage(w http.ResponseWriter, r *http.Request) {
+	_, format, image, ok := h.capture(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", ContentType(format))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
+
+func (h *Handler) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if h.s3 == nil {
+		http.Error(w, ErrNoBucket.Error(), http.StatusNotImplemented)
+		return
+	}
+	streamPath, format, image, ok := h.capture(w, r)
+	if !ok {
+		return
+	}
+
+	upload, err := h.upload(r.Context(), streamPath, format, image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, upload)
+}
+
+// ErrNoBucket is returned by Upload when SNAPSHOT_BUCKET is not set.
+var ErrNoBucket = errors.New("SNAPSHOT_BUCKET is not configured")
+
+// Upload describes an uploaded snapshot.
+type Upload struct {
+	StreamPath   string    `json:"stream_path"`
+	Format       string    `json:"format"`
+	CapturedAt   time.Time `json:"captured_at"`
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	Size         int       `json:"size"`
+	URL          string    `json:"url,omitempty"` // presigned GET URL
+	URLExpiresAt time.Time `json:"url_expires_at,omitzero"`
+}
+
+// Upload captures an image of a live stream and uploads it to S3, like POST /snapshot.
+func (h *Handler) Upload(ctx context.Context, streamPath, format string) (*Upload, error) {
+	if h.s3 == nil {
+		return nil, ErrNoBucket
+	}
+	format, err := NormalizeFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	captureCtx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	image, err := Capture(captureCtx, h.source, streamPath, format)
+	if err != nil {
+		log.Printf("[Snapshot] Failed to capture %s: %v", streamPath, err)
+		return nil, err
+	}
+	return h.upload(ctx, streamPath, format, image)
+}
+
+// upload stores a captured image in the snapshot bucket.
+func (h *Handler) upload(ctx context.Context, streamPath, format string, image []byte) (*Upload, error) {
+	capturedAt := time.Now().UTC()
+	key := fmt.Sprintf("%s%s/%s%s", h.prefix, strings.Trim(streamPath, "/"),
+		capturedAt.Format("20060102-150405.000"), Extension(format))
+	if err := h.s3.PutObject(awsapi.WithStreamPath(ctx, streamPath), h.bucket, key, ContentType(format), image); err != nil {
+		log.Printf("[Snapshot] Failed to upload s3://%s/%s: %v", h.bucket, key, err)
+		return nil, fmt.Errorf("failed to upload snapshot: %w", err)
+	}
+
+	log.Printf("[Snapshot] Uploaded %s snapshot to s3://%s/%s (%d bytes)", streamPath, h.bucket, key, len(image))
+	upload := &Upload{
+		StreamPath: streamPath,
+		Format:     format,
+		CapturedAt: capturedAt,
+		Bucket:     h.bucket,
+		Key:        key,
+		Size:       len(image),
+	}
+	if url, err := h.s3.PresignGetObject(h.bucket, key, h.urlExpiry); err != nil {
+		log.Printf("[Snapshot] ⚠️  Failed to presign s3://%s/%s: %v", h.bucket, key, err)
+	} else {
+		upload.URL = url
+		upload.URLExpiresAt = time.Now().Add(h.urlExpiry).UTC()
+	}
+	if h.publisher != nil {
+		h.publisher.Publish(ctx, upload)
+	}
+	return upload, nil
+}
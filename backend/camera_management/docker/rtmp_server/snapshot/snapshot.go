@@ -0,0 +1,98 @@
+// Package snapshot captures still images from live streams.
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+)
+
+// ErrStreamNotLive is returned by a KeyframeSource when the stream has no active publisher.
+var ErrStreamNotLive = errors.New("stream is not live")
+
+// KeyframeSource provides the next keyframe of a live stream.
+type KeyframeSource interface {
+	Keyframe(ctx context.Context, streamPath string) ([][]byte, error)
+}
+
+// encoders maps image formats to GStreamer encoder elements.
+var encoders = map[string]string{
+	"jpeg": "jpegenc",
+	"png":  "pngenc",
+}
+
+// ContentType returns the MIME type of an image format.
+func ContentType(format string) string {
+	return "image/" + format
+}
+
+// Extension returns the file extension of an image format.
+func Extension(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+// NormalizeFormat validates an image format name ("jpeg", "jpg" or "png"; empty means jpeg).
+func NormalizeFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", "jpeg", "jpg":
+		return "jpeg", nil
+	case "png":
+		return "png", nil
+	}
+	return "", fmt.Errorf("unsupported image format: %s", format)
+}
+
+// Decode decodes a self-contained H.264 keyframe (SPS, PPS, IDR) into an image using GStreamer.
+func Decode(ctx context.Context, au [][]byte, format string) ([]byte, error) {
+	encoder, ok := encoders[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image format: %s", format)
+	}
+
+	annexb, err := h264.AnnexB(au).Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode access unit: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "gst-launch-1.0", "-q",
+		"fdsrc", "fd=0",
+		"!", "video/x-h264,stream-format=byte-stream",
+		"!", "h264parse",
+		"!", "avdec_h264",
+		"!", "videoconvert",
+		"!", encoder,
+		"!", "fdsink", "fd=1",
+	)
+	cmd.Stdin = bytes.NewReader(annexb)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("failed to decode keyframe: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("failed to decode keyframe: %w", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("failed to decode keyframe: no image produced")
+	}
+	return stdout.Bytes(), nil
+}
+
+// Capture waits for the next keyframe of the stream and decodes it.
+func Capture(ctx context.Context, src KeyframeSource, streamPath, format string) ([]byte, error) {
+	au, err := src.Keyframe(ctx, streamPath)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(ctx, au, format)
+}
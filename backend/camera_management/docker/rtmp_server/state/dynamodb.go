@@ -0,0 +1,69 @@
+// Package state keeps the runtime state of the KVS forwarders across task restarts.
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/kvs"
+)
+
+// DynamoDBStore keeps one item per stream, keyed by stream_key ("<region>/<stream>",
+// partition key). The state is stored as JSON in the state attribute; the main counters
+// are also written as attributes for the console.
+type DynamoDBStore struct {
+	table    string
+	instance string
+	client   *awsapi.DynamoDB
+}
+
+// NewDynamoDBStore creates a store for the table.
+func NewDynamoDBStore(table, region string) *DynamoDBStore {
+	instance, _ := os.Hostname()
+	return &DynamoDBStore{table: table, instance: instance, client: awsapi.NewDynamoDB(region)}
+}
+
+// Load implements Store. The read is consistent, so the state saved by a task that was
+// just stopped is seen by its replacement.
+func (d *DynamoDBStore) Load(ctx context.Context, streamName, region string) (*kvs.StreamState, error) {
+	item, err := d.client.GetItem(ctx, d.table, awsapi.Item{"stream_key": awsapi.String(region + "/" + streamName)}, true)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	data, ok := item.GetString("state")
+	if !ok {
+		return nil, fmt.Errorf("item of %s has no state attribute", streamName)
+	}
+	var state kvs.StreamState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, fmt.Errorf("invalid state of %s: %w", streamName, err)
+	}
+	return &state, nil
+}
+
+// Save implements Store.
+func (d *DynamoDBStore) Save(ctx context.Context, state *kvs.StreamState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	item := awsapi.Item{
+		"stream_key":       awsapi.String(state.Region + "/" + state.StreamName),
+		"stream_name":      awsapi.String(state.StreamName),
+		"state":            awsapi.String(string(data)),
+		"updated_at":       awsapi.String(time.Now().UTC().Format(time.RFC3339)),
+		"restarts":         awsapi.Number(int64(state.Restarts)),
+		"frames_forwarded": awsapi.Number(int64(state.FramesForwarded)),
+	}
+	if d.instance != "" {
+		item["instance"] = awsapi.String(d.instance)
+	}
+	if !state.LastPersistedTime.IsZero() {
+		item["last_persisted_time"] = awsapi.String(state.LastPersistedTime.UTC().Format(time.RFC3339Nano))
+	}
+	return d.client.PutItem(ctx, d.table, item)
+}
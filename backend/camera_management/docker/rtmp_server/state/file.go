@@ -0,0 +1,70 @@
+// Package state keeps the runtime state of the KVS forwarders across task restarts.
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rtmp_kvs/kvs"
+)
+
+// FileStore keeps one JSON file per stream, <dir>/<region>/<stream>.state.json. The
+// directory is typically an EFS volume mounted into every task of the service.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a store in dir.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// path returns the file of a stream.
+func (s *FileStore) path(streamName, region string) string {
+	if region == "" {
+		region = "local"
+	}
+	// Stream names cannot contain a slash, but keep a bad name inside the directory
+	name := strings.ReplaceAll(streamName, "/", "_")
+	return filepath.Join(s.dir, region, name+".state.json")
+}
+
+// Load implements Store.
+func (s *FileStore) Load(ctx context.Context, streamName, region string) (*kvs.StreamState, error) {
+	data, err := os.ReadFile(s.path(streamName, region))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state kvs.StreamState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file: %w", err)
+	}
+	return &state, nil
+}
+
+// Save implements Store. The file is replaced atomically, so a task stopped while saving
+// leaves the previous state.
+func (s *FileStore) Save(ctx context.Context, state *kvs.StreamState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := s.path(state.StreamName, state.Region)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,181 @@
+// Package state keeps the runtime state of the KVS forwarders (restart counters, frame
+// and fragment counters, last persisted producer timestamp, backfill position) in
+// DynamoDB or a directory on a mounted volume (e.g. EFS), so a task that replaces a
+// stopped one continues the statistics and backfills instead of starting from zero.
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/metrics"
+)
+
+// Store persists the state of streams.
+type Store interface {
+	// Load returns the saved state of a stream, nil if there is none.
+	Load(ctx context.Context, streamName, region string) (*kvs.StreamState, error)
+	Save(ctx context.Context, state *kvs.StreamState) error
+}
+
+// ForwarderSource provides the KVS forwarders whose state is saved.
+type ForwarderSource interface {
+	Forwarders() []*kvs.Forwarder
+}
+
+// Forwarders is a fixed list of forwarders (e.g. of the replay subcommand).
+type Forwarders []*kvs.Forwarder
+
+// Forwarders implements ForwarderSource.
+func (f Forwarders) Forwarders() []*kvs.Forwarder {
+	return f
+}
+
+// Time allowed to load the state of a stream before it starts from zero
+const loadTimeout = 10 * time.Second
+
+// Keeper restores the state of new forwarders and saves the state of all forwarders at a
+// fixed interval and on Close.
+type Keeper struct {
+	store      Store
+	forwarders ForwarderSource
+	interval   time.Duration
+
+	mutex sync.Mutex
+	saved map[string][]byte // last saved state by stream, to skip unchanged streams
+
+	restored atomic.Uint64
+	written  atomic.Uint64
+	failed   atomic.Uint64
+}
+
+// NewFromEnv creates a keeper for STATE_TABLE (DynamoDB) or STATE_DIR, saving every
+// STATE_INTERVAL seconds (default 30). It returns nil if neither is set.
+func NewFromEnv(region string, forwarders ForwarderSource) *Keeper {
+	var store Store
+	var target string
+	if table := os.Getenv("STATE_TABLE"); table != "" {
+		store = NewDynamoDBStore(table, region)
+		target = "DynamoDB table " + table
+	} else if dir := os.Getenv("STATE_DIR"); dir != "" {
+		store = NewFileStore(dir)
+		target = dir
+	} else {
+		return nil
+	}
+
+	k := New(store, forwarders, time.Duration(max(envInt("STATE_INTERVAL", 30), 1))*time.Second)
+	log.Printf("[State] Keeping stream state in %s, saved every %s", target, k.interval)
+	return k
+}
+
+// New creates a keeper. Call Run to start saving.
+func New(store Store, forwarders ForwarderSource, interval time.Duration) *Keeper {
+	return &Keeper{
+		store:      store,
+		forwarders: forwarders,
+		interval:   interval,
+		saved:      make(map[string][]byte),
+	}
+}
+
+// Restore loads the saved state of the forwarder's stream and continues from it (see
+// kvs.Pool.OnCreate). It returns the state, nil if there is none or it failed to load.
+func (k *Keeper) Restore(f *kvs.Forwarder) *kvs.StreamState {
+	ctx, cancel := context.WithTimeout(context.Background(), loadTimeout)
+	defer cancel()
+	s, err := k.store.Load(ctx, f.StreamName(), f.Region())
+	if err != nil {
+		log.Printf("[State] ⚠️  Failed to load the state of %s, starting from zero: %v", f.StreamName(), err)
+		return nil
+	}
+	if s == nil {
+		return nil
+	}
+	f.RestoreState(*s)
+	k.restored.Add(1)
+	return s
+}
+
+// Run saves the state of the forwarders until ctx is cancelled.
+func (k *Keeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			k.Save(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close saves the final state, after the forwarders flushed their pipelines.
+func (k *Keeper) Close() {
+	k.Save(context.Background())
+}
+
+// Save writes the state of every forwarder that changed since it was last saved.
+func (k *Keeper) Save(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var errs []error
+	for _, f := range k.forwarders.Forwarders() {
+		s := f.State()
+		data, err := json.Marshal(&s)
+		if err != nil {
+			continue
+		}
+		key := s.Region + "/" + s.StreamName
+		k.mutex.Lock()
+		unchanged := string(k.saved[key]) == string(data)
+		k.mutex.Unlock()
+		if unchanged {
+			continue
+		}
+
+		if err := k.store.Save(ctx, &s); err != nil {
+			k.failed.Add(1)
+			errs = append(errs, err)
+			continue
+		}
+		k.written.Add(1)
+		k.mutex.Lock()
+		k.saved[key] = data
+		k.mutex.Unlock()
+	}
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("[State] ⚠️  Failed to save the state of %d streams: %v", len(errs), err)
+	}
+}
+
+// CollectMetrics writes the number of states restored, saved and failed to save.
+func (k *Keeper) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_state_restored_total", "Streams that continued from the state of a previous task", float64(k.restored.Load()))
+	w.Counter("rtmp_state_saves_total", "Stream states saved", float64(k.written.Load()))
+	w.Counter("rtmp_state_errors_total", "Stream states that failed to be saved", float64(k.failed.Load()))
+}
+
+// envInt reads a non-negative integer environment variable, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("[State] ⚠️  Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,216 @@
+// Package stills samples one JPEG image per interval from every live stream and delivers
+// it through Amazon Data Firehose to S3, partitioned by site, camera, date and hour, as
+// cheap long-term imagery for batch analysis after the KVS retention has expired.
+package stills
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/metrics"
+	"rtmp_kvs/server"
+	"rtmp_kvs/snapshot"
+)
+
+const (
+	// Firehose limits: 1,000 KiB per record, 500 records and 4 MiB per PutRecordBatch
+	maxRecordBytes  = 1000 << 10
+	maxBatchRecords = 500
+	maxBatchBytes   = 4 << 20
+
+	captureTimeout = 15 * time.Second // keyframe wait and decode
+	requestTimeout = 30 * time.Second
+	// Streams captured at the same time; each decode runs a GStreamer process
+	maxConcurrentCaptures = 4
+)
+
+// Record is the JSON line written to Firehose for every image. Site, camera, date and
+// hour are the partition keys of the S3 layout.
+type Record struct {
+	Site       string    `json:"site"`
+	Camera     string    `json:"camera"`
+	Date       string    `json:"date"` // UTC, 2006-01-02
+	Hour       string    `json:"hour"` // UTC, 15
+	Time       time.Time `json:"time"`
+	StreamName string    `json:"stream_name"`
+	StreamPath string    `json:"stream_path"`
+	Format     string    `json:"format"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	Image      []byte    `json:"image"` // base64-encoded by encoding/json
+}
+
+// Source provides the active publishers and their keyframes.
+type Source interface {
+	snapshot.KeyframeSource
+	Stats() []server.StreamStats
+}
+
+// Sampler captures an image of every live stream at a fixed interval.
+type Sampler struct {
+	source         Source
+	firehose       *awsapi.Firehose
+	deliveryStream string
+	interval       time.Duration
+	site           string
+
+	captured        atomic.Uint64
+	captureFailures atomic.Uint64
+	delivered       atomic.Uint64
+	deliveryErrors  atomic.Uint64
+}
+
+// NewFromEnv creates a sampler writing to the Firehose delivery stream
+// STILLS_FIREHOSE_STREAM every STILLS_INTERVAL seconds (default 60). STILLS_SITE (default
+// "default") is the site of streams whose path template has no {site} parameter. It
+// returns nil if STILLS_FIREHOSE_STREAM is not set.
+func NewFromEnv(region string, source Source) *Sampler {
+	deliveryStream := os.Getenv("STILLS_FIREHOSE_STREAM")
+	if deliveryStream == "" {
+		return nil
+	}
+	s := &Sampler{
+		source:         source,
+		firehose:       awsapi.NewFirehose(region),
+		deliveryStream: deliveryStream,
+		interval:       time.Duration(max(envInt("STILLS_INTERVAL", 60), 1)) * time.Second,
+		site:           cmp.Or(os.Getenv("STILLS_SITE"), "default"),
+	}
+	log.Printf("[Stills] Delivering one image per %s of every stream to Firehose stream %s", s.interval, deliveryStream)
+	return s
+}
+
+// envInt reads an integer environment variable.
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("[Stills] ⚠️  Invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Run samples the live streams until ctx is cancelled.
+func (s *Sampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Sample(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sample captures an image of every live video stream and delivers them. Streams paused
+// in discard mode (privacy) are skipped.
+func (s *Sampler) Sample(ctx context.Context) {
+	var (
+		mutex   sync.Mutex
+		records [][]byte
+		wg      sync.WaitGroup
+	)
+	slots := make(chan struct{}, maxConcurrentCaptures)
+	for _, st := range s.source.Stats() {
+		if st.VideoCodec == "" || st.PauseMode == server.PauseDiscard {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			data, err := s.capture(ctx, st)
+			if err != nil {
+				s.captureFailures.Add(1)
+				log.Printf("[Stills] ⚠️  Failed to capture %s: %v", st.StreamPath, err)
+				return
+			}
+			s.captured.Add(1)
+			mutex.Lock()
+			records = append(records, data)
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) && n < maxBatchRecords && size+len(records[n]) <= maxBatchBytes {
+			size += len(records[n])
+			n++
+		}
+		s.deliver(ctx, records[:n])
+		records = records[n:]
+	}
+}
+
+// capture captures an image of a stream and encodes its record.
+func (s *Sampler) capture(ctx context.Context, st server.StreamStats) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, captureTimeout)
+	defer cancel()
+	image, err := snapshot.Capture(ctx, s.source, st.StreamPath, "jpeg")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	data, err := json.Marshal(Record{
+		Site:       cmp.Or(st.PathParams["site"], s.site),
+		Camera:     cmp.Or(st.PathParams["camera"], st.CameraID, st.StreamName),
+		Date:       now.Format(time.DateOnly),
+		Hour:       now.Format("15"),
+		Time:       now,
+		StreamName: st.StreamName,
+		StreamPath: st.StreamPath,
+		Format:     "jpeg",
+		Width:      st.Width,
+		Height:     st.Height,
+		Image:      image,
+	})
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+	if len(data) > maxRecordBytes {
+		return nil, fmt.Errorf("record of %d bytes exceeds the Firehose limit of 1000 KiB", len(data))
+	}
+	return data, nil
+}
+
+// deliver writes a batch of records. Failed records are not retried: the next interval
+// captures new images.
+func (s *Sampler) deliver(ctx context.Context, batch [][]byte) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	failed, err := s.firehose.PutRecordBatch(ctx, s.deliveryStream, batch)
+	s.delivered.Add(uint64(len(batch) - len(failed)))
+	if err != nil {
+		s.deliveryErrors.Add(uint64(len(failed)))
+		log.Printf("[Stills] ⚠️  Failed to deliver %d of %d images: %v", len(failed), len(batch), err)
+	}
+}
+
+// CollectMetrics writes the number of images captured and delivered.
+func (s *Sampler) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_stills_captured_total", "Images captured for Firehose", float64(s.captured.Load()))
+	w.Counter("rtmp_stills_capture_failures_total", "Images that could not be captured (no keyframe, decode error)", float64(s.captureFailures.Load()))
+	w.Counter("rtmp_stills_delivered_total", "Images delivered to Firehose", float64(s.delivered.Load()))
+	w.Counter("rtmp_stills_delivery_errors_total", "Images Firehose did not accept", float64(s.deliveryErrors.Load()))
+}
@@ -0,0 +1,226 @@
+// Package thumbnail publishes uploaded snapshots for the camera management console: the
+// presigned URL and metadata of the latest snapshot of each camera are written to a
+// DynamoDB table and emitted as SnapshotPublished events, so the console can show a
+// "last seen" thumbnail per camera. Snapshots are taken on demand (POST /snapshot, the
+// snapshot remote command) and optionally on a schedule.
+package thumbnail
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/events"
+	"rtmp_kvs/metrics"
+	"rtmp_kvs/server"
+	"rtmp_kvs/snapshot"
+)
+
+const (
+	writeTimeout = 10 * time.Second
+	// Streams captured at the same time by the schedule; each decode runs a GStreamer process
+	maxConcurrentCaptures = 4
+)
+
+// Source provides the active publishers.
+type Source interface {
+	Stats() []server.StreamStats
+}
+
+// Uploader captures snapshots and uploads them to S3.
+type Uploader interface {
+	Upload(ctx context.Context, streamPath, format string) (*snapshot.Upload, error)
+}
+
+// scheduledKey marks the context of snapshots taken by the schedule.
+type scheduledKey struct{}
+
+// Publisher publishes the snapshots uploaded by the snapshot handler.
+type Publisher struct {
+	source   Source
+	uploader Uploader
+	dynamodb *awsapi.DynamoDB
+	table    string
+	interval time.Duration // 0 when snapshots are only taken on demand
+
+	published     atomic.Uint64
+	writeErrors   atomic.Uint64
+	scheduled     atomic.Uint64
+	scheduleFails atomic.Uint64
+}
+
+// NewFromEnv creates the publisher of the snapshots of the handler, which writes the
+// latest snapshot of each camera to the DynamoDB table SNAPSHOT_TABLE (if set) and takes
+// a snapshot of every live stream each SNAPSHOT_INTERVAL seconds (default 0, on demand
+// only). It returns nil if snapshots are not uploaded (SNAPSHOT_BUCKET is not set).
+func NewFromEnv(region string, source Source, snapshots *snapshot.Handler) *Publisher {
+	if !snapshots.Enabled() {
+		return nil
+	}
+	p := &Publisher{
+		source:   source,
+		uploader: snapshots,
+		table:    os.Getenv("SNAPSHOT_TABLE"),
+		interval: time.Duration(max(envInt("SNAPSHOT_INTERVAL", 0), 0)) * time.Second,
+	}
+	if p.table != "" {
+		p.dynamodb = awsapi.NewDynamoDB(region)
+		log.Printf("[Thumbnail] Publishing the latest snapshot of each camera to DynamoDB table %s", p.table)
+	}
+	if p.interval > 0 {
+		log.Printf("[Thumbnail] Taking a snapshot of every live stream each %s", p.interval)
+	}
+	snapshots.SetPublisher(p)
+	return p
+}
+
+// envInt reads an integer environment variable.
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("[Thumbnail] ⚠️  Invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Publish writes the snapshot to the table and emits a SnapshotPublished event.
+// Failures are logged; the snapshot itself is already in S3.
+func (p *Publisher) Publish(ctx context.Context, upload *snapshot.Upload) {
+	trigger := "demand"
+	if ctx.Value(scheduledKey{}) != nil {
+		trigger = "schedule"
+	}
+	var st server.StreamStats
+	for _, s := range p.source.Stats() {
+		if s.StreamPath == upload.StreamPath {
+			st = s
+			break
+		}
+	}
+	// The console looks cameras up by ID; streams without a registry entry by KVS stream name
+	camera := st.CameraID
+	if camera == "" {
+		camera = st.StreamName
+	}
+	if camera == "" {
+		camera = upload.StreamPath
+	}
+
+	if p.dynamodb != nil {
+		item := awsapi.Item{
+			"camera_id":   awsapi.String(camera),
+			"stream_path": awsapi.String(upload.StreamPath),
+			"captured_at": awsapi.String(upload.CapturedAt.Format(time.RFC3339Nano)),
+			"bucket":      awsapi.String(upload.Bucket),
+			"key":         awsapi.String(upload.Key),
+			"size":        awsapi.Number(int64(upload.Size)),
+			"format":      awsapi.String(upload.Format),
+			"trigger":     awsapi.String(trigger),
+		}
+		if st.StreamName != "" {
+			item["stream_name"] = awsapi.String(st.StreamName)
+		}
+		if st.Width > 0 {
+			item["width"] = awsapi.Number(int64(st.Width))
+			item["height"] = awsapi.Number(int64(st.Height))
+		}
+		if upload.URL != "" {
+			item["url"] = awsapi.String(upload.URL)
+			item["url_expires_at"] = awsapi.Number(upload.URLExpiresAt.Unix())
+		}
+		writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), writeTimeout)
+		err := p.dynamodb.PutItem(awsapi.WithStreamPath(writeCtx, upload.StreamPath), p.table, item)
+		cancel()
+		if err != nil {
+			p.writeErrors.Add(1)
+			log.Printf("[Thumbnail] ⚠️  Failed to write the snapshot of %s to %s: %v", camera, p.table, err)
+		}
+	}
+
+	p.published.Add(1)
+	detail := map[string]any{
+		"bucket":      upload.Bucket,
+		"key":         upload.Key,
+		"size":        upload.Size,
+		"format":      upload.Format,
+		"captured_at": upload.CapturedAt,
+		"trigger":     trigger,
+	}
+	if upload.URL != "" {
+		detail["url"] = upload.URL
+		detail["url_expires_at"] = upload.URLExpiresAt
+	}
+	if st.Width > 0 {
+		detail["width"] = st.Width
+		detail["height"] = st.Height
+	}
+	events.Emit(events.Event{
+		Type:       events.SnapshotPublished,
+		StreamPath: upload.StreamPath,
+		StreamName: st.StreamName,
+		CameraID:   st.CameraID,
+		Detail:     detail,
+	})
+}
+
+// Run takes a snapshot of every live stream each SNAPSHOT_INTERVAL until ctx is
+// cancelled. It returns immediately when snapshots are only taken on demand.
+func (p *Publisher) Run(ctx context.Context) {
+	if p.interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.captureAll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// captureAll takes a snapshot of every live video stream, a few at a time.
+func (p *Publisher) captureAll(ctx context.Context) {
+	ctx = context.WithValue(ctx, scheduledKey{}, true)
+	slots := make(chan struct{}, maxConcurrentCaptures)
+	var wg sync.WaitGroup
+	for _, st := range p.source.Stats() {
+		// Audio-only streams have no image; discard mode is a privacy mode
+		if st.VideoCodec == "" || st.PauseMode == server.PauseDiscard {
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			p.scheduled.Add(1)
+			if _, err := p.uploader.Upload(ctx, st.StreamPath, "jpeg"); err != nil {
+				p.scheduleFails.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// CollectMetrics writes the number of published snapshots and failures.
+func (p *Publisher) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_snapshots_published_total", "Uploaded snapshots published to the management console", float64(p.published.Load()))
+	w.Counter("rtmp_snapshot_table_errors_total", "Published snapshots the DynamoDB table did not accept", float64(p.writeErrors.Load()))
+	w.Counter("rtmp_snapshots_scheduled_total", "Snapshots taken by SNAPSHOT_INTERVAL", float64(p.scheduled.Load()))
+	w.Counter("rtmp_snapshot_schedule_failures_total", "Scheduled snapshots that could not be captured or uploaded", float64(p.scheduleFails.Load()))
+}
@@ -0,0 +1,49 @@
+// Package tlscert provides a hot-reloadable TLS certificate for the RTMPS listener.
+package tlscert
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+
+	"rtmp_kvs/awsapi"
+)
+
+// ACMSource exports the certificate and key from ACM. Only exportable certificates (issued by
+// AWS Private CA, or public certificates requested as exportable) can be used. A random
+// passphrase is generated for every export and only used to decrypt the returned key.
+type ACMSource struct {
+	CertificateARN string
+	client         *awsapi.ACM
+}
+
+// NewACMSource creates a source for the given certificate ARN.
+func NewACMSource(certificateARN, region string) *ACMSource {
+	return &ACMSource{CertificateARN: certificateARN, client: awsapi.NewACM(region)}
+}
+
+// Name implements Source.
+func (s *ACMSource) Name() string {
+	return "ACM certificate " + s.CertificateARN
+}
+
+// Version implements Source using the serial number, which changes on renewal.
+func (s *ACMSource) Version(ctx context.Context) (string, error) {
+	return s.client.CertificateSerial(ctx, s.CertificateARN)
+}
+
+// Load implements Source.
+func (s *ACMSource) Load(ctx context.Context) (*tls.Certificate, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	passphrase := []byte(hex.EncodeToString(random))
+
+	exported, err := s.client.ExportCertificate(ctx, s.CertificateARN, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return keyPair(exported.Certificate, exported.CertificateChain, exported.PrivateKey, passphrase)
+}
@@ -0,0 +1,456 @@
+// Package tlscert provides a hot-reloadable TLS certificate for the RTMPS listener.
+package tlscert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/metrics"
+)
+
+// Let's Encrypt production directory, the default ACME server
+const letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	// TTL of the challenge TXT records
+	acmeRecordTTL = 60
+	// Interval between checks whether the certificate is due for renewal, and retries
+	// after a failed renewal
+	acmeCheckInterval = 12 * time.Hour
+	acmeRetryInterval = time.Hour
+	// Polling of the DNS change, the authorizations and the order
+	acmePollInterval = 3 * time.Second
+)
+
+// ACMESource obtains a publicly trusted certificate from an ACME server (Let's Encrypt by
+// default), proving control of the domains with dns-01 challenges in Route 53, and renews
+// it before it expires. Run renews in the background; the Reloader picks the new
+// certificate up through Version. The account key and certificate are kept in the cache
+// directory, so restarted tasks reuse them instead of issuing again (ACME servers limit
+// duplicate certificates per week).
+type ACMESource struct {
+	Domains      []string
+	Email        string
+	DirectoryURL string
+	HostedZoneID string        // looked up by domain if empty
+	CacheDir     string        // in-memory only if empty
+	RenewBefore  time.Duration // renew when the certificate expires within this
+
+	route53 *awsapi.Route53
+
+	mutex  sync.RWMutex
+	cert   *tls.Certificate
+	serial string
+
+	issued atomic.Uint64
+	failed atomic.Uint64
+}
+
+// NewACMESourceFromEnv creates a source for TLS_ACME_DOMAINS (comma-separated), with
+// TLS_ACME_EMAIL, TLS_ACME_DIRECTORY, TLS_ACME_HOSTED_ZONE_ID, TLS_ACME_CACHE_DIR and
+// TLS_ACME_RENEW_DAYS (default 30). It returns nil if TLS_ACME_DOMAINS is not set.
+func NewACMESourceFromEnv() *ACMESource {
+	var domains []string
+	for _, d := range strings.Split(os.Getenv("TLS_ACME_DOMAINS"), ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+
+	s := &ACMESource{
+		Domains:      domains,
+		Email:        os.Getenv("TLS_ACME_EMAIL"),
+		DirectoryURL: os.Getenv("TLS_ACME_DIRECTORY"),
+		HostedZoneID: os.Getenv("TLS_ACME_HOSTED_ZONE_ID"),
+		CacheDir:     os.Getenv("TLS_ACME_CACHE_DIR"),
+		RenewBefore:  30 * 24 * time.Hour,
+		route53:      awsapi.NewRoute53(),
+	}
+	if s.DirectoryURL == "" {
+		s.DirectoryURL = letsEncryptDirectory
+	}
+	if value := os.Getenv("TLS_ACME_RENEW_DAYS"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days <= 0 {
+			log.Printf("Warning: invalid TLS_ACME_RENEW_DAYS %q, using 30", value)
+		} else {
+			s.RenewBefore = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	if s.CacheDir == "" {
+		log.Printf("[TLS] ⚠️  TLS_ACME_CACHE_DIR is not set: every task start issues a new certificate, which the ACME server rate-limits")
+	}
+	return s
+}
+
+// Name implements Source.
+func (s *ACMESource) Name() string {
+	return "ACME certificate for " + strings.Join(s.Domains, ", ")
+}
+
+// Version implements Source using the serial number of the current certificate.
+func (s *ACMESource) Version(context.Context) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.serial, nil
+}
+
+// Load implements Source. It returns the certificate obtained by Obtain or Run.
+func (s *ACMESource) Load(context.Context) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.cert == nil {
+		return nil, errors.New("no certificate obtained yet")
+	}
+	cert := *s.cert
+	return &cert, nil
+}
+
+// Obtain loads the cached certificate, or issues one if there is none or it is due for
+// renewal. Call before creating the Reloader.
+func (s *ACMESource) Obtain(ctx context.Context) error {
+	if s.LoadCache() && !s.due() {
+		return nil
+	}
+	return s.issue(ctx)
+}
+
+// Run renews the certificate before it expires until ctx is cancelled. A certificate
+// renewed by another task sharing the cache directory is picked up instead of issuing.
+func (s *ACMESource) Run(ctx context.Context) {
+	interval := acmeCheckInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		interval = acmeCheckInterval
+		if s.LoadCache() && !s.due() {
+			continue
+		}
+		if err := s.issue(ctx); err != nil {
+			log.Printf("[TLS] ⚠️  Certificate renewal failed, retrying in %s: %v", acmeRetryInterval, err)
+			interval = acmeRetryInterval
+		}
+	}
+}
+
+// CollectMetrics writes the number of certificates issued and failed issuances.
+func (s *ACMESource) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmps_acme_certificates_issued_total", "Certificates issued by the ACME server", float64(s.issued.Load()))
+	w.Counter("rtmps_acme_errors_total", "Failed ACME certificate issuances", float64(s.failed.Load()))
+}
+
+// due reports whether the current certificate is missing or expires within RenewBefore.
+func (s *ACMESource) due() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert == nil || time.Until(s.cert.Leaf.NotAfter) < s.RenewBefore
+}
+
+// set makes cert (with Leaf set) the current certificate.
+func (s *ACMESource) set(cert *tls.Certificate) {
+	s.mutex.Lock()
+	s.cert = cert
+	s.serial = cert.Leaf.SerialNumber.String()
+	s.mutex.Unlock()
+}
+
+// LoadCache loads the cached certificate if it covers the domains and is newer than the
+// current one, and reports whether a certificate is available.
+func (s *ACMESource) LoadCache() bool {
+	if s.CacheDir != "" {
+		cert, err := tls.LoadX509KeyPair(s.cachePath("certificate.pem"), s.cachePath("certificate.key"))
+		if err == nil && cert.Leaf != nil && s.covers(cert.Leaf) {
+			s.mutex.RLock()
+			newer := s.cert == nil || cert.Leaf.NotAfter.After(s.cert.Leaf.NotAfter)
+			s.mutex.RUnlock()
+			if newer {
+				s.set(&cert)
+				log.Printf("[TLS] Loaded cached ACME certificate (expires %s)", cert.Leaf.NotAfter.Format(time.RFC3339))
+			}
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[TLS] ⚠️  Ignoring cached ACME certificate: %v", err)
+		}
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert != nil
+}
+
+// covers reports whether the certificate is valid for all domains.
+func (s *ACMESource) covers(leaf *x509.Certificate) bool {
+	for _, d := range s.Domains {
+		if !slices.Contains(leaf.DNSNames, d) {
+			return false
+		}
+	}
+	return true
+}
+
+// cachePath returns the path of a file in the cache directory.
+func (s *ACMESource) cachePath(name string) string {
+	return filepath.Join(s.CacheDir, name)
+}
+
+// issue orders a certificate for the domains and makes it the current one.
+func (s *ACMESource) issue(ctx context.Context) error {
+	log.Printf("[TLS] Requesting a certificate for %s from %s", strings.Join(s.Domains, ", "), s.DirectoryURL)
+	cert, err := s.order(ctx)
+	if err != nil {
+		s.failed.Add(1)
+		return err
+	}
+	s.issued.Add(1)
+	s.set(cert)
+	log.Printf("[TLS] ✅ Issued certificate for %s (expires %s)", strings.Join(s.Domains, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// order runs an ACME order: dns-01 challenges for every authorization, then finalization
+// with a new P-256 key.
+func (s *ACMESource) order(ctx context.Context) (*tls.Certificate, error) {
+	accountKey, err := s.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := newACMEClient(s.DirectoryURL, accountKey)
+	if err := client.register(ctx, s.Email); err != nil {
+		return nil, err
+	}
+	order, err := client.newOrder(ctx, s.Domains)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+	if err := s.authorize(ctx, client, order); err != nil {
+		return nil, err
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: s.Domains[0]},
+		DNSNames: s.Domains,
+	}, certKey)
+	if err != nil {
+		return nil, err
+	}
+	csrPayload := map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}
+	if _, _, err := client.post(ctx, order.Finalize, csrPayload, order); err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+	for order.Status != "valid" {
+		if order.Status == "invalid" {
+			return nil, fmt.Errorf("order is invalid: %v", order.Error)
+		}
+		if err := s.poll(ctx, client, order.URL, order); err != nil {
+			return nil, err
+		}
+	}
+
+	chainPEM, err := client.certificate(ctx, order.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(certKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(chainPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate from ACME server: %w", err)
+	}
+
+	if s.CacheDir != "" {
+		// The key is written first: a certificate is never cached without its key
+		if err := writeFileAtomic(s.cachePath("certificate.key"), keyPEM, 0o600); err != nil {
+			log.Printf("[TLS] ⚠️  Failed to cache the certificate: %v", err)
+		} else if err := writeFileAtomic(s.cachePath("certificate.pem"), chainPEM, 0o644); err != nil {
+			log.Printf("[TLS] ⚠️  Failed to cache the certificate: %v", err)
+		}
+	}
+	return &cert, nil
+}
+
+// authorize completes the pending authorizations of an order with dns-01 challenges. The
+// TXT records of all domains are created together (a domain and its wildcard share one
+// name), waited for until Route 53 has them in sync, and removed afterwards.
+func (s *ACMESource) authorize(ctx context.Context, client *acmeClient, order *acmeOrder) error {
+	type pending struct {
+		url       string
+		challenge acmeChallenge
+	}
+	var challenges []pending
+	records := make(map[string][]string) // TXT values by record name
+	for _, url := range order.Authorizations {
+		var authz acmeAuthorization
+		if _, err := client.get(ctx, url, &authz); err != nil {
+			return fmt.Errorf("failed to get authorization: %w", err)
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+		i := slices.IndexFunc(authz.Challenges, func(c acmeChallenge) bool { return c.Type == "dns-01" })
+		if i < 0 {
+			return fmt.Errorf("ACME server offers no dns-01 challenge for %s", authz.Identifier.Value)
+		}
+		name := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+		records[name] = append(records[name], client.dnsValue(authz.Challenges[i].Token))
+		challenges = append(challenges, pending{url: url, challenge: authz.Challenges[i]})
+	}
+	if len(challenges) == 0 {
+		return nil
+	}
+
+	zoneID := s.HostedZoneID
+	if zoneID == "" {
+		var err error
+		if zoneID, err = s.route53.PublicZoneFor(ctx, strings.TrimPrefix(s.Domains[0], "*.")); err != nil {
+			return err
+		}
+	}
+	var changes []string
+	for name, values := range records {
+		change, err := s.route53.ChangeTXT(ctx, zoneID, "UPSERT", name, values, acmeRecordTTL)
+		if err != nil {
+			return fmt.Errorf("failed to create challenge record %s: %w", name, err)
+		}
+		changes = append(changes, change)
+	}
+	defer func() {
+		// The records are removed even when ctx was cancelled
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		for name, values := range records {
+			if _, err := s.route53.ChangeTXT(cleanupCtx, zoneID, "DELETE", name, values, acmeRecordTTL); err != nil {
+				log.Printf("[TLS] ⚠️  Failed to remove challenge record %s: %v", name, err)
+			}
+		}
+	}()
+	for _, change := range changes {
+		if err := s.waitInSync(ctx, change); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range challenges {
+		if _, _, err := client.post(ctx, p.challenge.URL, struct{}{}, nil); err != nil {
+			return fmt.Errorf("failed to respond to challenge: %w", err)
+		}
+	}
+	for _, p := range challenges {
+		var authz acmeAuthorization
+		for authz.Status != "valid" {
+			if err := s.poll(ctx, client, p.url, &authz); err != nil {
+				return err
+			}
+			if authz.Status == "invalid" {
+				var problem *acmeProblem
+				if i := slices.IndexFunc(authz.Challenges, func(c acmeChallenge) bool { return c.Type == "dns-01" }); i >= 0 {
+					problem = authz.Challenges[i].Error
+				}
+				return fmt.Errorf("authorization of %s failed: %v", authz.Identifier.Value, problem)
+			}
+		}
+	}
+	return nil
+}
+
+// waitInSync waits until a Route 53 change is on all its name servers.
+func (s *ACMESource) waitInSync(ctx context.Context, change string) error {
+	for {
+		status, err := s.route53.ChangeStatus(ctx, change)
+		if err != nil {
+			return fmt.Errorf("failed to check challenge record: %w", err)
+		}
+		if status == "INSYNC" {
+			return nil
+		}
+		select {
+		case <-time.After(acmePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// poll waits, then fetches a resource of the ACME server into out.
+func (s *ACMESource) poll(ctx context.Context, client *acmeClient, url string, out any) error {
+	select {
+	case <-time.After(acmePollInterval):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if _, err := client.get(ctx, url, out); err != nil {
+		return fmt.Errorf("failed to poll %s: %w", url, err)
+	}
+	return nil
+}
+
+// accountKey loads the ACME account key from the cache directory, or creates it.
+func (s *ACMESource) accountKey() (*ecdsa.PrivateKey, error) {
+	path := s.cachePath("account.key")
+	if s.CacheDir != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return nil, fmt.Errorf("invalid ACME account key %s", path)
+			}
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if s.CacheDir != "" {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			log.Printf("[TLS] ⚠️  Failed to cache the ACME account key: %v", err)
+		}
+	}
+	return key, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,294 @@
+// Package tlscert provides a hot-reloadable TLS certificate for the RTMPS listener.
+package tlscert
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// acmeDirectory holds the endpoints of an ACME server (RFC 8555 section 7.1.1).
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeOrder is an ACME order (section 7.1.3).
+type acmeOrder struct {
+	URL            string       `json:"-"`
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+// acmeAuthorization is an ACME authorization of an identifier (section 7.1.4).
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Wildcard   bool            `json:"wildcard"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeChallenge is a challenge of an authorization (section 7.1.5).
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeProblem is an ACME error document (RFC 7807, section 6.7).
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("%s: %s", strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:"), p.Detail)
+}
+
+// acmeClient is a minimal ACME client: it registers an account and sends the requests of
+// an order, signing them with the account key (ES256).
+type acmeClient struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	httpClient   *http.Client
+
+	dir   *acmeDirectory
+	kid   string // account URL, after register
+	nonce string
+}
+
+// newACMEClient creates a client for the directory, using the account key.
+func newACMEClient(directoryURL string, key *ecdsa.PrivateKey) *acmeClient {
+	return &acmeClient{
+		directoryURL: directoryURL,
+		key:          key,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// register fetches the directory and creates the account, or finds the existing account
+// of the key.
+func (c *acmeClient) register(ctx context.Context, email string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch ACME directory: %w", err)
+	}
+	defer resp.Body.Close()
+	var dir acmeDirectory
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil || dir.NewAccount == "" {
+		return fmt.Errorf("invalid ACME directory at %s", c.directoryURL)
+	}
+	c.dir = &dir
+
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err = c.post(ctx, dir.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("failed to register ACME account: %w", err)
+	}
+	c.kid = resp.Header.Get("Location")
+	if c.kid == "" {
+		return errors.New("ACME server returned no account URL")
+	}
+	return nil
+}
+
+// newOrder creates an order for the domains.
+func (c *acmeClient) newOrder(ctx context.Context, domains []string) (*acmeOrder, error) {
+	identifiers := make([]map[string]string, len(domains))
+	for i, d := range domains {
+		identifiers[i] = map[string]string{"type": "dns", "value": d}
+	}
+	var order acmeOrder
+	resp, _, err := c.post(ctx, c.dir.NewOrder, map[string]any{"identifiers": identifiers}, &order)
+	if err != nil {
+		return nil, err
+	}
+	order.URL = resp.Header.Get("Location")
+	return &order, nil
+}
+
+// get fetches a resource with POST-as-GET (section 6.3) and decodes it into out, returning
+// the delay the server asked to wait before polling again.
+func (c *acmeClient) get(ctx context.Context, url string, out any) (time.Duration, error) {
+	resp, _, err := c.post(ctx, url, nil, out)
+	if err != nil {
+		return 0, err
+	}
+	return retryAfter(resp), nil
+}
+
+// certificate downloads the PEM certificate chain of a valid order.
+func (c *acmeClient) certificate(ctx context.Context, url string) ([]byte, error) {
+	_, body, err := c.post(ctx, url, nil, nil)
+	return body, err
+}
+
+// post sends a JWS-signed request with payload (nil for POST-as-GET) and decodes the
+// response into out. A bad nonce is retried once with the nonce of the error response.
+func (c *acmeClient) post(ctx context.Context, url string, payload, out any) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.send(ctx, url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			if json.Unmarshal(body, problem) != nil || problem.Type == "" {
+				problem.Type, problem.Detail = "HTTP "+strconv.Itoa(resp.StatusCode), strings.TrimSpace(string(body))
+			}
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			return nil, nil, problem
+		}
+		if out != nil {
+			if err := json.Unmarshal(body, out); err != nil {
+				return nil, nil, fmt.Errorf("invalid response from %s: %w", url, err)
+			}
+		}
+		return resp, body, nil
+	}
+}
+
+// send signs and sends one request.
+func (c *acmeClient) send(ctx context.Context, url string, payload any) (*http.Response, []byte, error) {
+	if c.nonce == "" {
+		if err := c.fetchNonce(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	body, err := c.sign(url, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+// fetchNonce gets a fresh anti-replay nonce.
+func (c *acmeClient) fetchNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get ACME nonce: %w", err)
+	}
+	resp.Body.Close()
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	if c.nonce == "" {
+		return errors.New("ACME server returned no nonce")
+	}
+	return nil
+}
+
+// sign returns the flattened JWS of payload (section 6.2): the account key is identified
+// by its JWK until the account is registered, by the account URL afterwards.
+func (c *acmeClient) sign(url string, payload any) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": c.nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	c.nonce = ""
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	encodedBody := base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(encodedHeader + "." + encodedBody))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// ES256 signatures are the 32-byte R and S concatenated
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedBody,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// jwk returns the public account key as a JWK, with the members in the lexicographic
+// order of the thumbprint (RFC 7638).
+func (c *acmeClient) jwk() json.RawMessage {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	c.key.X.FillBytes(x)
+	c.key.Y.FillBytes(y)
+	return json.RawMessage(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(x), base64.RawURLEncoding.EncodeToString(y)))
+}
+
+// dnsValue returns the TXT record value of a dns-01 challenge token (section 8.4): the
+// digest of the key authorization, token "." thumbprint of the account key.
+func (c *acmeClient) dnsValue(token string) string {
+	thumbprint := sha256.Sum256(c.jwk())
+	keyAuth := token + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	digest := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// retryAfter returns the Retry-After delay of a response, 0 if there is none.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
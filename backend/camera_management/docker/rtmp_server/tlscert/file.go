@@ -0,0 +1,43 @@
+// Package tlscert provides a hot-reloadable TLS certificate for the RTMPS listener.
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+)
+
+// FileSource loads a PEM certificate and key from disk.
+type FileSource struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Name implements Source.
+func (s *FileSource) Name() string {
+	return s.CertFile
+}
+
+// Version implements Source using the modification times and sizes of both files.
+func (s *FileSource) Version(context.Context) (string, error) {
+	certInfo, err := os.Stat(s.CertFile)
+	if err != nil {
+		return "", err
+	}
+	keyInfo, err := os.Stat(s.KeyFile)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d/%d/%d", certInfo.ModTime().UnixNano(), certInfo.Size(),
+		keyInfo.ModTime().UnixNano(), keyInfo.Size()), nil
+}
+
+// Load implements Source.
+func (s *FileSource) Load(context.Context) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -0,0 +1,134 @@
+// Package tlscert provides a hot-reloadable TLS certificate for the RTMPS listener.
+package tlscert
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Object identifiers of the PBES2 encryption used for encrypted PKCS#8 keys (RFC 8018).
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     algorithmIdentifier
+	EncryptedData []byte
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc algorithmIdentifier
+	EncryptionScheme  algorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                 `asn1:"optional"`
+	PRF            algorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8PEM decrypts an "ENCRYPTED PRIVATE KEY" PEM block (PBES2 with PBKDF2 and
+// AES-CBC, as produced by ACM and openssl pkcs8 -v2) into a "PRIVATE KEY" PEM block.
+func decryptPKCS8PEM(data, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return nil, errors.New("no ENCRYPTED PRIVATE KEY PEM block found")
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted private key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %s", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("failed to parse PBKDF2 parameters: %w", err)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 PRF %s", kdf.PRF.Algorithm)
+	}
+
+	var keyLength int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("unsupported encryption scheme %s", params.EncryptionScheme.Algorithm)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("failed to parse IV: %w", err)
+	}
+
+	key, err := pbkdf2.Key(prf, string(passphrase), kdf.Salt, kdf.IterationCount, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != blockCipher.BlockSize() || len(info.EncryptedData)%blockCipher.BlockSize() != 0 || len(info.EncryptedData) == 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(blockCipher, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// PKCS#7 padding; a wrong passphrase almost always produces invalid padding
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > blockCipher.BlockSize() {
+		return nil, errors.New("failed to decrypt private key (wrong passphrase?)")
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, errors.New("failed to decrypt private key (wrong passphrase?)")
+		}
+	}
+	plain = plain[:len(plain)-pad]
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: plain}), nil
+}
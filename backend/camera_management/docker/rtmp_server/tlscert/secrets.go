@@ -0,0 +1,120 @@
+// Package tlscert provides a hot-reloadable TLS certificate for the RTMPS listener.
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"rtmp_kvs/awsapi"
+)
+
+// SecretsManagerSource loads the certificate from a Secrets Manager secret. The secret is
+// either a PEM bundle (certificate, chain and private key) or a JSON object with the fields
+// certificate, certificate_chain (optional), private_key and passphrase (optional, for an
+// encrypted key). The field names of an ACM export (Certificate, CertificateChain,
+// PrivateKey) are accepted too, so an exported bundle can be stored as-is.
+type SecretsManagerSource struct {
+	SecretID string
+	client   *awsapi.SecretsManager
+}
+
+// NewSecretsManagerSource creates a source for the given secret name or ARN.
+func NewSecretsManagerSource(secretID, region string) *SecretsManagerSource {
+	return &SecretsManagerSource{SecretID: secretID, client: awsapi.NewSecretsManager(region)}
+}
+
+// Name implements Source.
+func (s *SecretsManagerSource) Name() string {
+	return "Secrets Manager secret " + s.SecretID
+}
+
+// Version implements Source using the AWSCURRENT version ID.
+func (s *SecretsManagerSource) Version(ctx context.Context) (string, error) {
+	return s.client.CurrentVersionID(ctx, s.SecretID)
+}
+
+// Load implements Source.
+func (s *SecretsManagerSource) Load(ctx context.Context) (*tls.Certificate, error) {
+	secret, err := s.client.GetSecretValue(ctx, s.SecretID)
+	if err != nil {
+		return nil, err
+	}
+	value := secret.SecretString
+	if value == "" {
+		value = string(secret.SecretBinary)
+	}
+	return parseSecret(value)
+}
+
+// certificateSecret is the JSON layout of a certificate secret.
+type certificateSecret struct {
+	Certificate      string `json:"certificate"`
+	CertificateChain string `json:"certificate_chain"`
+	PrivateKey       string `json:"private_key"`
+	Passphrase       string `json:"passphrase"`
+}
+
+// parseSecret decodes a PEM bundle or a JSON certificate secret.
+func parseSecret(value string) (*tls.Certificate, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "{") {
+		cert, err := tls.X509KeyPair([]byte(value), []byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PEM bundle: %w", err)
+		}
+		return &cert, nil
+	}
+
+	// encoding/json matches field names case-insensitively, but not the ACM CamelCase
+	// names without underscores, so decode both layouts.
+	var secret certificateSecret
+	var acm awsapi.ExportedCertificate
+	if err := json.Unmarshal([]byte(value), &secret); err != nil {
+		return nil, fmt.Errorf("failed to parse secret JSON: %w", err)
+	}
+	json.Unmarshal([]byte(value), &acm)
+	if secret.Certificate == "" {
+		secret.Certificate = acm.Certificate
+	}
+	if secret.CertificateChain == "" {
+		secret.CertificateChain = acm.CertificateChain
+	}
+	if secret.PrivateKey == "" {
+		secret.PrivateKey = acm.PrivateKey
+	}
+	if secret.Certificate == "" || secret.PrivateKey == "" {
+		return nil, errors.New("secret has no certificate or private_key")
+	}
+
+	return keyPair(secret.Certificate, secret.CertificateChain, secret.PrivateKey, []byte(secret.Passphrase))
+}
+
+// keyPair builds a certificate from PEM blocks, decrypting an encrypted PKCS#8 key.
+func keyPair(certPEM, chainPEM, keyPEM string, passphrase []byte) (*tls.Certificate, error) {
+	bundle := strings.TrimSpace(certPEM) + "\n"
+	if chainPEM != "" {
+		bundle += strings.TrimSpace(chainPEM) + "\n"
+	}
+
+	keyPEMBytes := []byte(keyPEM)
+	if strings.Contains(keyPEM, "ENCRYPTED PRIVATE KEY") {
+		if len(passphrase) == 0 {
+			return nil, errors.New("private key is encrypted but no passphrase is set")
+		}
+		decrypted, err := decryptPKCS8PEM(keyPEMBytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		keyPEMBytes = decrypted
+	}
+
+	cert, err := tls.X509KeyPair([]byte(bundle), keyPEMBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate and key: %w", err)
+	}
+	return &cert, nil
+}
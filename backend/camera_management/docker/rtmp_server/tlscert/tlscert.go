@@ -0,0 +1,163 @@
+// Package tlscert provides a hot-reloadable TLS certificate for the RTMPS listener.
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"rtmp_kvs/metrics"
+)
+
+// Source loads a certificate and reports when it has changed.
+type Source interface {
+	Name() string
+	// Version returns an identifier that changes whenever the certificate changes
+	// (file modification time, secret version, ...).
+	Version(ctx context.Context) (string, error)
+	Load(ctx context.Context) (*tls.Certificate, error)
+}
+
+// Reloader serves the current certificate of a Source through tls.Config.GetCertificate.
+// Reloading only affects new handshakes; established connections are not interrupted.
+type Reloader struct {
+	source Source
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	version string
+	expiry  time.Time
+	reloads uint64
+}
+
+// NewReloader loads the initial certificate from source.
+func NewReloader(source Source) (*Reloader, error) {
+	r := &Reloader{source: source}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate from the source. On failure the current certificate is kept.
+func (r *Reloader) Reload() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	version, err := r.source.Version(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check certificate version: %w", err)
+	}
+	cert, err := r.source.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate from %s: %w", r.source.Name(), err)
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+
+	r.mutex.Lock()
+	first := r.cert == nil
+	r.cert = cert
+	r.version = version
+	if leaf != nil {
+		r.expiry = leaf.NotAfter
+	}
+	if !first {
+		r.reloads++
+	}
+	r.mutex.Unlock()
+
+	if leaf != nil {
+		log.Printf("[TLS] Loaded certificate from %s (subject: %s, expires %s)",
+			r.source.Name(), leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	} else {
+		log.Printf("[TLS] Loaded certificate from %s", r.source.Name())
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns a server TLS configuration using the reloadable certificate.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS13,
+	}
+}
+
+// reloadIfChanged reloads the certificate when the source version differs from the loaded one.
+func (r *Reloader) reloadIfChanged() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	version, err := r.source.Version(ctx)
+	if err != nil {
+		log.Printf("[TLS] ⚠️  Failed to check %s for changes: %v", r.source.Name(), err)
+		return
+	}
+
+	r.mutex.RLock()
+	changed := version != r.version
+	r.mutex.RUnlock()
+
+	if changed {
+		log.Printf("[TLS] 🔄 Certificate changed, reloading")
+		if err := r.Reload(); err != nil {
+			log.Printf("[TLS] ⚠️  Reload failed, keeping current certificate: %v", err)
+		}
+	}
+}
+
+// Watch polls the source for changes every interval and reloads on demand when a value is
+// received on trigger (e.g. SIGHUP). It returns when ctx is cancelled.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, trigger <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			r.reloadIfChanged()
+		case <-trigger:
+			log.Printf("[TLS] 🔄 Reload requested")
+			if err := r.Reload(); err != nil {
+				log.Printf("[TLS] ⚠️  Reload failed, keeping current certificate: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CollectMetrics writes the certificate expiry and reload count.
+func (r *Reloader) CollectMetrics(w *metrics.Writer) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if !r.expiry.IsZero() {
+		w.Gauge("rtmps_certificate_expiry_timestamp_seconds", "Expiry (NotAfter) of the RTMPS certificate", float64(r.expiry.Unix()))
+	}
+	w.Counter("rtmps_certificate_reloads_total", "Successful RTMPS certificate reloads", float64(r.reloads))
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/control"
+	"rtmp_kvs/greengrass"
+	"rtmp_kvs/kvs"
+	"rtmp_kvs/logging"
+	"rtmp_kvs/server"
+	"rtmp_kvs/sink"
+	"rtmp_kvs/tlscert"
+)
+
+// Features that call AWS APIs, by the environment variable enabling them
+var awsFeatures = []struct {
+	env     string
+	actions []string // IAM actions the feature needs
+}{
+	{"REGISTRY_TABLE", []string{"dynamodb:GetItem"}},
+	{"EVENT_BUS_NAME", []string{"events:PutEvents"}},
+	{"ALERT_TOPIC_ARN", []string{"sns:Publish"}},
+	{"STATS_TABLE", []string{"dynamodb:PutItem"}},
+	{"STATE_TABLE", []string{"dynamodb:GetItem", "dynamodb:PutItem"}},
+	{"STATS_TIMESTREAM_DATABASE", []string{"timestream:WriteRecords", "timestream:DescribeEndpoints"}},
+	{"KINESIS_STREAM_NAME", []string{"kinesis:PutRecords"}},
+	{"AUDIT_LOG_GROUP", []string{"logs:CreateLogStream", "logs:PutLogEvents"}},
+	{"AUDIT_FIREHOSE_STREAM", []string{"firehose:PutRecordBatch"}},
+	{"STILLS_FIREHOSE_STREAM", []string{"firehose:PutRecordBatch"}},
+	{"REKOGNITION_ROLE_ARN", []string{"rekognition:CreateStreamProcessor", "rekognition:DescribeStreamProcessor",
+		"rekognition:StartStreamProcessor", "rekognition:StopStreamProcessor", "iam:PassRole"}},
+	{"SNAPSHOT_BUCKET", []string{"s3:PutObject"}},
+	{"SINK_S3_BUCKET", []string{"s3:PutObject"}},
+	{"TLS_SECRET_ID", []string{"secretsmanager:GetSecretValue", "secretsmanager:DescribeSecret"}},
+	{"TLS_ACM_CERTIFICATE_ARN", []string{"acm:ExportCertificate", "acm:DescribeCertificate"}},
+	{"TLS_ACME_DOMAINS", []string{"route53:ListHostedZonesByName", "route53:ChangeResourceRecordSets", "route53:GetChange"}},
+	{"KVS_KMS_KEY_ID", []string{"kms:DescribeKey", "kms:GenerateDataKey"}},
+}
+
+// IAM actions of the KVS forwarder (kvssink)
+var kvsActions = []string{
+	"kinesisvideo:DescribeStream", "kinesisvideo:CreateStream", "kinesisvideo:GetDataEndpoint",
+	"kinesisvideo:PutMedia", "kinesisvideo:TagStream",
+}
+
+// validation collects the results of the checks.
+type validation struct {
+	failures int
+	warnings int
+}
+
+func (v *validation) ok(format string, args ...any) {
+	fmt.Printf("[OK]   "+format+"\n", args...)
+}
+
+func (v *validation) warn(format string, args ...any) {
+	v.warnings++
+	fmt.Printf("[WARN] "+format+"\n", args...)
+}
+
+func (v *validation) fail(format string, args ...any) {
+	v.failures++
+	fmt.Printf("[FAIL] "+format+"\n", args...)
+}
+
+// runValidate implements the "validate" subcommand: it checks the flags, environment and
+// config files the server would start with, and the AWS resources and permissions it
+// needs, and exits non-zero if anything would fail. It takes the listener flags of the
+// server.
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	rtmpAddr := fs.String("rtmp", ":1935", "RTMP listen address")
+	rtmpsAddr := fs.String("rtmps", ":1936", "RTMPS listen address")
+	certFile := fs.String("cert", "certs/server.crt", "TLS certificate file")
+	keyFile := fs.String("key", "certs/server.key", "TLS private key file")
+	enableRTMPS := fs.Bool("enable-rtmps", true, "Enable RTMPS listener")
+	adminAddr := fs.String("admin", "", "Admin HTTP listen address (empty to disable)")
+	grpcAddr := fs.String("grpc", "", "gRPC control API listen address (empty to disable)")
+	mpegtsTCPAddr := fs.String("mpegts-tcp", "", "MPEG-TS over TCP listen address (empty to disable)")
+	mpegtsUDPAddr := fs.String("mpegts-udp", "", "MPEG-TS over UDP listen address (empty to disable)")
+	acceptAudioOnly := fs.Bool("accept-audio-only", false, "Accept publishers without video and forward their AAC/G.711 audio")
+	skipAWS := fs.Bool("skip-aws", false, "Do not call AWS APIs (credentials, KVS stream, IAM permissions)")
+	var listens listenFlags
+	fs.Var(&listens, "listen", "RTMP(S) listener: rtmp://host:port, rtmps://host:port or unix:///path (repeatable, replaces -rtmp and -rtmps)")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	v := &validation{}
+
+	// The component configuration supplies the environment on Greengrass
+	if component := greengrass.NewFromEnv(); component != nil {
+		if err := component.ApplyConfiguration(); err != nil {
+			v.fail("Greengrass component configuration: %v", err)
+		} else {
+			v.ok("Greengrass component configuration applied")
+		}
+	}
+
+	region := os.Getenv("AWS_REGION")
+	fileMode := os.Getenv("FORWARDER_MODE") == "file"
+	v.checkEnvironment(region, fileMode)
+	v.checkConfigFiles(ctx, region)
+	listeners, err := listenerDefs(listens)
+	if err != nil {
+		v.fail("Listeners: %v", err)
+	} else if listeners == nil {
+		listeners = []listenerDef{{network: "tcp", address: *rtmpAddr}}
+		if *enableRTMPS && *rtmpsAddr != "" {
+			listeners = append(listeners, listenerDef{tls: true, network: "tcp", address: *rtmpsAddr})
+		}
+	}
+	if slices.ContainsFunc(listeners, func(d listenerDef) bool { return d.tls }) {
+		v.checkCertificate(ctx, *certFile, *keyFile, region)
+	}
+	v.checkListeners(listeners)
+	v.checkPorts(map[string]string{
+		"admin": *adminAddr, "gRPC": *grpcAddr, "MPEG-TS/TCP": *mpegtsTCPAddr,
+	}, *mpegtsUDPAddr)
+	if !fileMode {
+		v.checkGStreamer(*acceptAudioOnly)
+	}
+	if region != "" && !*skipAWS {
+		v.checkAWS(ctx, region, fileMode)
+	}
+
+	fmt.Println()
+	if v.failures > 0 {
+		fmt.Printf("Validation failed: %d problems, %d warnings\n", v.failures, v.warnings)
+		os.Exit(1)
+	}
+	fmt.Printf("Validation passed (%d warnings)\n", v.warnings)
+}
+
+// checkEnvironment checks the variables the server requires.
+func (v *validation) checkEnvironment(region string, fileMode bool) {
+	streamName := os.Getenv("STREAM_NAME")
+	switch {
+	case streamName != "":
+		v.ok("KVS stream: %s", streamName)
+	case os.Getenv("REGISTRY_TABLE") != "":
+		v.ok("KVS streams resolved by the stream registry %s", os.Getenv("REGISTRY_TABLE"))
+	default:
+		v.fail("STREAM_NAME environment variable is required (or REGISTRY_TABLE)")
+	}
+	if keyID := os.Getenv("KVS_KMS_KEY_ID"); keyID != "" && !kvs.ValidKMSKeyID(keyID) {
+		v.fail("KVS_KMS_KEY_ID %q is not a KMS key ID, key ARN or alias", keyID)
+	}
+	for _, name := range sink.ParseList(os.Getenv("SINKS")) {
+		switch {
+		case !sink.Valid(name):
+			v.fail("SINKS has an unknown sink %q (known: %s)", name, strings.Join(sink.Kinds, ", "))
+		case name == "s3" && os.Getenv("SINK_S3_BUCKET") == "":
+			v.fail("SINKS includes s3 but SINK_S3_BUCKET is not set")
+		case name == "rtmp" && os.Getenv("SINK_RTMP_URL") == "":
+			v.warn("SINKS includes rtmp but SINK_RTMP_URL is not set; only streams with a relay_url are relayed")
+		}
+	}
+	if target := os.Getenv("SINK_RTMP_URL"); target != "" {
+		if err := sink.CheckRelayURL(target); err != nil {
+			v.fail("SINK_RTMP_URL: %v", err)
+		}
+	}
+	if controller := control.NewFromEnv(); controller != nil {
+		for _, problem := range controller.Check() {
+			v.fail("%s", problem)
+		}
+	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := logging.SetLevel(level); err != nil {
+			v.fail("LOG_LEVEL: %v", err)
+		}
+	}
+
+	var needRegion []string
+	if !fileMode {
+		needRegion = append(needRegion, "KVS forwarding")
+	}
+	for _, feature := range awsFeatures {
+		if os.Getenv(feature.env) != "" {
+			needRegion = append(needRegion, feature.env)
+		}
+	}
+	switch {
+	case region != "":
+		v.ok("AWS region: %s", region)
+	case len(needRegion) > 0:
+		v.fail("AWS_REGION environment variable is required (%s)", strings.Join(needRegion, ", "))
+	default:
+		v.ok("AWS region not needed (FORWARDER_MODE=file)")
+	}
+}
+
+// checkConfigFiles parses the stream, tenant, IP filter and publish path configuration.
+func (v *validation) checkConfigFiles(ctx context.Context, region string) {
+	pool := kvs.NewPool()
+	if file := os.Getenv("STREAM_CONFIG_FILE"); file != "" {
+		if configs, err := kvs.LoadStreamConfigFile(file); err != nil {
+			v.fail("STREAM_CONFIG_FILE: %v", err)
+		} else {
+			v.ok("STREAM_CONFIG_FILE: settings for %d streams", len(configs))
+			pool.SetStreamConfigs(configs)
+		}
+	}
+	if file := os.Getenv("TENANT_CONFIG_FILE"); file != "" {
+		if _, err := server.LoadTenants(file, pool, region); err != nil {
+			v.fail("TENANT_CONFIG_FILE: %v", err)
+		} else {
+			v.ok("TENANT_CONFIG_FILE: %s", file)
+		}
+	}
+	if filter, err := server.NewIPFilterFromEnv(ctx, region); err != nil {
+		v.fail("IP filter: %v", err)
+	} else if filter != nil {
+		v.ok("IP filter")
+	}
+	if templates, err := server.PathTemplatesFromEnv(pool, region); err != nil {
+		v.fail("Publish paths: %v", err)
+	} else if templates != nil {
+		v.ok("Publish paths: RTMP_APPS / PATH_TEMPLATES")
+	}
+}
+
+// checkCertificate loads the RTMPS certificate and checks its validity period.
+func (v *validation) checkCertificate(ctx context.Context, certFile, keyFile, region string) {
+	var source tlscert.Source
+	switch {
+	case (os.Getenv("TLS_SECRET_ID") != "" || os.Getenv("TLS_ACM_CERTIFICATE_ARN") != "") && region == "":
+		return // reported with the region
+	case os.Getenv("TLS_SECRET_ID") != "" || os.Getenv("TLS_ACM_CERTIFICATE_ARN") != "":
+		source = certificateSource(certFile, keyFile, region)
+	case os.Getenv("TLS_ACME_DOMAINS") != "":
+		// Validation does not issue a certificate, only checks a cached one
+		acme := tlscert.NewACMESourceFromEnv()
+		if !acme.LoadCache() {
+			v.ok("TLS certificate: issued by %s at startup", acme.DirectoryURL)
+			return
+		}
+		source = acme
+	default:
+		if _, err := os.Stat(certFile); err != nil {
+			v.warn("TLS certificate not found at %s, RTMPS would be disabled", certFile)
+			return
+		}
+		source = &tlscert.FileSource{CertFile: certFile, KeyFile: keyFile}
+	}
+
+	cert, err := source.Load(ctx)
+	if err != nil {
+		v.fail("TLS certificate (%s): %v", source.Name(), err)
+		return
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			v.fail("TLS certificate (%s): %v", source.Name(), err)
+			return
+		}
+	}
+	switch remaining := time.Until(leaf.NotAfter); {
+	case remaining <= 0:
+		v.fail("TLS certificate (%s) expired on %s", source.Name(), leaf.NotAfter.Format(time.DateOnly))
+	case remaining < 14*24*time.Hour:
+		v.warn("TLS certificate (%s) expires on %s", source.Name(), leaf.NotAfter.Format(time.DateOnly))
+	default:
+		v.ok("TLS certificate (%s): %s, valid until %s", source.Name(), leaf.Subject.CommonName, leaf.NotAfter.Format(time.DateOnly))
+	}
+}
+
+// checkListeners checks that the TCP listen addresses are free and that the directories
+// of Unix sockets exist. An existing socket is replaced by the server, so it is reported
+// but not removed (it may belong to a running server).
+func (v *validation) checkListeners(listeners []listenerDef) {
+	for _, def := range listeners {
+		if def.network == "unix" {
+			if info, err := os.Stat(filepath.Dir(def.address)); err != nil || !info.IsDir() {
+				v.fail("Listener %s: directory %s does not exist", def, filepath.Dir(def.address))
+			} else if _, err := os.Lstat(def.address); err == nil {
+				v.warn("Listener %s: %s exists and will be replaced", def, def.address)
+			} else {
+				v.ok("Listener %s is available", def)
+			}
+			continue
+		}
+		ln, err := net.Listen(def.network, def.address)
+		if err != nil {
+			v.fail("Listener %s: %v", def, err)
+			continue
+		}
+		ln.Close()
+		v.ok("Listener %s is available", def)
+	}
+}
+
+// checkPorts checks that the listen addresses are free.
+func (v *validation) checkPorts(tcp map[string]string, udp string) {
+	for _, name := range []string{"admin", "gRPC", "MPEG-TS/TCP"} {
+		address := tcp[name]
+		if address == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			v.fail("%s listener %s: %v", name, address, err)
+			continue
+		}
+		ln.Close()
+		v.ok("%s listener %s is available", name, address)
+	}
+	if udp != "" {
+		pc, err := net.ListenPacket("udp", udp)
+		if err != nil {
+			v.fail("MPEG-TS/UDP listener %s: %v", udp, err)
+			return
+		}
+		pc.Close()
+		v.ok("MPEG-TS/UDP listener %s is available", udp)
+	}
+}
+
+// checkGStreamer checks that the pipeline elements are installed. Without them the server
+// does not start.
+func (v *validation) checkGStreamer(audio bool) {
+	result, err := kvs.Probe(audio)
+	switch {
+	case err != nil:
+		v.fail("GStreamer: %v", err)
+	case len(result.Missing) > 0:
+		v.fail("GStreamer elements not found: %s", strings.Join(result.Missing, ", "))
+	default:
+		v.ok("GStreamer %s elements installed", result.Version)
+		for _, element := range result.Elements {
+			v.ok("  %s (%s %s)", element.Name, element.Plugin, element.Version)
+		}
+	}
+}
+
+// checkAWS checks the credentials, the KVS stream and the IAM permissions.
+func (v *validation) checkAWS(ctx context.Context, region string, fileMode bool) {
+	// Task role, instance profile, ... credentials are exported to the environment like at startup
+	credManager := kvs.NewCredentialManager()
+	if err := credManager.RefreshCredentials(); err != nil {
+		v.warn("Credential refresh (%s): %v", credManager.Source(), err)
+	} else if source := credManager.Source(); source != "" {
+		v.ok("Credential source: %s", source)
+	}
+	arn, account, err := awsapi.NewSTS(region).GetCallerIdentity(ctx)
+	if err != nil {
+		v.fail("AWS credentials: %v", err)
+		return
+	}
+	v.ok("AWS credentials: %s (account %s)", arn, account)
+
+	if streamName := os.Getenv("STREAM_NAME"); streamName != "" && !fileMode {
+		info, err := awsapi.NewKinesisVideo(region).DescribeStream(ctx, streamName)
+		switch {
+		case err == nil:
+			v.ok("KVS stream %s exists (encrypted with %s)", streamName, info.KmsKeyID)
+			v.checkStreamKey(ctx, region, info.KmsKeyID)
+		case awsapi.IsCode(err, "ResourceNotFoundException"):
+			v.warn("KVS stream %s does not exist, kvssink creates it on the first publish", streamName)
+		default:
+			v.fail("KVS stream %s: %v", streamName, err)
+		}
+	}
+
+	// IAM permissions, simulated for the role of the credentials
+	var actions []string
+	if !fileMode {
+		actions = append(actions, kvsActions...)
+	}
+	for _, feature := range awsFeatures {
+		if os.Getenv(feature.env) != "" {
+			actions = append(actions, feature.actions...)
+		}
+	}
+	if len(actions) == 0 {
+		return
+	}
+	decisions, err := awsapi.NewIAM().SimulatePrincipalPolicy(ctx, principalARN(arn), actions)
+	if err != nil {
+		v.warn("Cannot check IAM permissions of %s: %v", principalARN(arn), err)
+		return
+	}
+	var denied []string
+	for _, action := range actions {
+		if decisions[action] != "allowed" {
+			denied = append(denied, action)
+		}
+	}
+	if len(denied) > 0 {
+		v.fail("IAM permissions missing for %s: %s", principalARN(arn), strings.Join(denied, ", "))
+	} else {
+		v.ok("IAM permissions (%d actions)", len(actions))
+	}
+}
+
+// checkStreamKey checks that the existing stream is encrypted with KVS_KMS_KEY_ID, which
+// kvssink only applies when it creates the stream.
+func (v *validation) checkStreamKey(ctx context.Context, region, streamKey string) {
+	keyID := os.Getenv("KVS_KMS_KEY_ID")
+	if keyID == "" || !kvs.ValidKMSKeyID(keyID) {
+		return
+	}
+	client := awsapi.NewKMS(region)
+	want, err := client.KeyARN(ctx, keyID)
+	if err != nil {
+		v.fail("KMS key %s: %v", keyID, err)
+		return
+	}
+	have, err := client.KeyARN(ctx, streamKey)
+	switch {
+	case err != nil:
+		v.warn("Cannot resolve the KMS key %s of the stream: %v", streamKey, err)
+	case have != want:
+		v.fail("KVS stream is encrypted with %s, not with KVS_KMS_KEY_ID %s; the server refuses to forward to it", have, want)
+	default:
+		v.ok("KVS stream is encrypted with KVS_KMS_KEY_ID")
+	}
+}
+
+// principalARN returns the IAM role of an assumed-role ARN
+// (arn:aws:sts::<account>:assumed-role/<role>/<session>), or the ARN itself. Roles with a
+// path are not resolved.
+func principalARN(arn string) string {
+	prefix, rest, ok := strings.Cut(arn, ":assumed-role/")
+	if !ok {
+		return arn
+	}
+	role, _, _ := strings.Cut(rest, "/")
+	return strings.Replace(prefix, ":sts:", ":iam:", 1) + ":role/" + role
+}
@@ -0,0 +1,301 @@
+// Package xray traces the AWS API calls of the server with AWS X-Ray, so the latency,
+// errors and throttling of DynamoDB, S3, Kinesis, ... calls show up in the service map.
+// Segments are sent to the X-Ray daemon (or the CloudWatch agent) over UDP.
+package xray
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp_kvs/awsapi"
+	"rtmp_kvs/metrics"
+)
+
+// Header sent before every segment document
+const daemonHeader = "{\"format\": \"json\", \"version\": 1}\n"
+
+// X-Ray names of the services, by SigV4 signing name
+var serviceNames = map[string]string{
+	"acm":            "ACM",
+	"dynamodb":       "DynamoDB",
+	"ec2":            "EC2",
+	"events":         "EventBridge",
+	"kinesis":        "Kinesis",
+	"kinesisvideo":   "KinesisVideo",
+	"rekognition":    "Rekognition",
+	"s3":             "S3",
+	"secretsmanager": "SecretsManager",
+	"sns":            "SNS",
+	"sts":            "STS",
+	"timestream":     "TimestreamWrite",
+}
+
+// Tracer sends a segment per sampled AWS API call. It implements awsapi.Tracer.
+type Tracer struct {
+	conn   net.Conn
+	name   string  // segment name, the node of the server in the service map
+	origin string  // AWS::ECS::Container, AWS::EC2::Instance, ...
+	rate   float64 // fraction of calls sampled beyond the reservoir
+
+	// Reservoir: the first call of every second is always sampled
+	mutex           sync.Mutex
+	reservoirSecond int64
+
+	sent   atomic.Uint64
+	failed atomic.Uint64
+}
+
+// NewFromEnv creates a tracer when XRAY_ENABLED is true, sending to
+// AWS_XRAY_DAEMON_ADDRESS (default 127.0.0.1:2000). Segments are named
+// AWS_XRAY_TRACING_NAME (default rtmp-kvs); besides one call per second,
+// XRAY_SAMPLING_RATE of the calls are traced (default 0.05). It returns nil if disabled.
+func NewFromEnv() *Tracer {
+	if enabled, _ := strconv.ParseBool(os.Getenv("XRAY_ENABLED")); !enabled {
+		return nil
+	}
+	address := daemonAddress(os.Getenv("AWS_XRAY_DAEMON_ADDRESS"))
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		log.Printf("Warning: invalid AWS_XRAY_DAEMON_ADDRESS %q, X-Ray tracing disabled: %v", address, err)
+		return nil
+	}
+	t := &Tracer{
+		conn:   conn,
+		name:   os.Getenv("AWS_XRAY_TRACING_NAME"),
+		origin: origin(),
+		rate:   0.05,
+	}
+	if t.name == "" {
+		t.name = "rtmp-kvs"
+	}
+	if value := os.Getenv("XRAY_SAMPLING_RATE"); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Printf("Warning: invalid XRAY_SAMPLING_RATE %q, using %v", value, t.rate)
+		} else {
+			t.rate = rate
+		}
+	}
+	log.Printf("X-Ray tracing of AWS API calls enabled (daemon %s, name %s, sampling 1/s + %v)", address, t.name, t.rate)
+	return t
+}
+
+// daemonAddress returns the UDP address of the daemon. AWS_XRAY_DAEMON_ADDRESS is either
+// host:port or "tcp:host:port udp:host:port".
+func daemonAddress(value string) string {
+	for _, field := range strings.Fields(value) {
+		if address, ok := strings.CutPrefix(field, "udp:"); ok {
+			return address
+		}
+		if !strings.HasPrefix(field, "tcp:") {
+			return field
+		}
+	}
+	return "127.0.0.1:2000"
+}
+
+// origin returns the origin of the segments, from the environment the server runs in.
+func origin() string {
+	switch {
+	case os.Getenv("ECS_CONTAINER_METADATA_URI_V4") != "":
+		return "AWS::ECS::Container"
+	case os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "":
+		return "AWS::Lambda::Function"
+	default:
+		return "AWS::EC2::Instance"
+	}
+}
+
+// Start implements awsapi.Tracer.
+func (t *Tracer) Start(call awsapi.Call) awsapi.Span {
+	if !t.sample(call.Start) {
+		return nil
+	}
+	return &span{
+		tracer:       t,
+		call:         call,
+		traceID:      fmt.Sprintf("1-%08x-%s", call.Start.Unix(), randomHex(12)),
+		segmentID:    randomHex(8),
+		subsegmentID: randomHex(8),
+	}
+}
+
+// sample decides whether a call is traced: the first call of each second, and a
+// fraction of the others.
+func (t *Tracer) sample(now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if now.Unix() != t.reservoirSecond {
+		t.reservoirSecond = now.Unix()
+		return true
+	}
+	return mrand.Float64() < t.rate
+}
+
+// send writes a segment document to the daemon.
+func (t *Tracer) send(segment any) {
+	data, err := json.Marshal(segment)
+	if err != nil {
+		t.failed.Add(1)
+		return
+	}
+	if _, err := t.conn.Write(append([]byte(daemonHeader), data...)); err != nil {
+		t.failed.Add(1)
+		return
+	}
+	t.sent.Add(1)
+}
+
+// Close closes the connection to the daemon.
+func (t *Tracer) Close() {
+	t.conn.Close()
+}
+
+// CollectMetrics writes the number of segments sent and lost.
+func (t *Tracer) CollectMetrics(w *metrics.Writer) {
+	w.Counter("rtmp_xray_segments_total", "X-Ray segments sent to the daemon", float64(t.sent.Load()))
+	w.Counter("rtmp_xray_segment_errors_total", "X-Ray segments that could not be sent", float64(t.failed.Load()))
+}
+
+// span is a sampled AWS API call: a segment of the server with a subsegment for the call.
+type span struct {
+	tracer       *Tracer
+	call         awsapi.Call
+	traceID      string
+	segmentID    string
+	subsegmentID string
+}
+
+// Header implements awsapi.Span.
+func (s *span) Header() string {
+	return fmt.Sprintf("Root=%s;Parent=%s;Sampled=1", s.traceID, s.subsegmentID)
+}
+
+// End implements awsapi.Span.
+func (s *span) End(statusCode int, requestID string, err error) {
+	start, end := seconds(s.call.Start), seconds(time.Now())
+	service := serviceNames[s.call.Service]
+	if service == "" {
+		service = s.call.Service
+	}
+
+	sub := subsegment{
+		ID:        s.subsegmentID,
+		Name:      service,
+		Namespace: "aws",
+		StartTime: start,
+		EndTime:   end,
+		AWS: map[string]any{
+			"operation": s.call.Operation,
+			"region":    s.call.Region,
+		},
+	}
+	if requestID != "" {
+		sub.AWS["request_id"] = requestID
+	}
+	if statusCode != 0 {
+		sub.HTTP = &httpInfo{Response: map[string]any{"status": statusCode}}
+	}
+	if err != nil {
+		code := "Error"
+		apiErr, remote := err.(*awsapi.APIError)
+		if remote {
+			code = apiErr.Code
+		}
+		switch {
+		case statusCode == 429 || strings.Contains(code, "Throttl") || strings.Contains(code, "LimitExceeded"):
+			sub.Throttle, sub.Error = true, true
+		case statusCode >= 500 || !remote:
+			sub.Fault = true
+		default:
+			sub.Error = true
+		}
+		sub.Cause = &cause{Exceptions: []exception{{ID: randomHex(8), Type: code, Message: err.Error(), Remote: remote}}}
+	}
+
+	seg := segment{
+		ID:          s.segmentID,
+		TraceID:     s.traceID,
+		Name:        s.tracer.name,
+		Origin:      s.tracer.origin,
+		StartTime:   start,
+		EndTime:     end,
+		Subsegments: []subsegment{sub},
+		Annotations: map[string]string{"aws_service": service, "aws_operation": s.call.Operation},
+		Error:       sub.Error,
+		Fault:       sub.Fault,
+		Throttle:    sub.Throttle,
+	}
+	if s.call.StreamPath != "" {
+		seg.Annotations["stream_path"] = s.call.StreamPath
+	}
+	s.tracer.send(seg)
+}
+
+// segment is an X-Ray segment document.
+type segment struct {
+	ID          string            `json:"id"`
+	TraceID     string            `json:"trace_id"`
+	Name        string            `json:"name"`
+	Origin      string            `json:"origin,omitempty"`
+	StartTime   float64           `json:"start_time"`
+	EndTime     float64           `json:"end_time"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Subsegments []subsegment      `json:"subsegments"`
+	Error       bool              `json:"error,omitempty"`
+	Fault       bool              `json:"fault,omitempty"`
+	Throttle    bool              `json:"throttle,omitempty"`
+}
+
+// subsegment is the AWS call of a segment.
+type subsegment struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Namespace string         `json:"namespace"`
+	StartTime float64        `json:"start_time"`
+	EndTime   float64        `json:"end_time"`
+	AWS       map[string]any `json:"aws"`
+	HTTP      *httpInfo      `json:"http,omitempty"`
+	Error     bool           `json:"error,omitempty"`
+	Fault     bool           `json:"fault,omitempty"`
+	Throttle  bool           `json:"throttle,omitempty"`
+	Cause     *cause         `json:"cause,omitempty"`
+}
+
+type httpInfo struct {
+	Response map[string]any `json:"response"`
+}
+
+type cause struct {
+	Exceptions []exception `json:"exceptions"`
+}
+
+type exception struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Remote  bool   `json:"remote,omitempty"`
+}
+
+// seconds returns t as epoch seconds with microsecond precision.
+func seconds(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}